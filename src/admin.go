@@ -0,0 +1,151 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// processStarted is when this instance started, for its uptime
+var processStarted = time.Now()
+
+// AdminOverview is the state of the fleet and of the instance answering,
+// for operations dashboards
+type AdminOverview struct {
+	Instance InstanceOverview `json:"instance"`
+	Jobs     JobsOverview     `json:"jobs"`
+	Queue    QueueStats       `json:"queue"`
+	Tenants  []TenantToday    `json:"tenants"`
+	Storage  *StorageUsage    `json:"storage,omitempty"`
+
+	// StorageError is set instead of Storage if the store could not report
+	StorageError string    `json:"storage_error,omitempty"`
+	GeneratedAt  time.Time `json:"generated_at"`
+}
+
+// InstanceOverview describes the instance answering
+type InstanceOverview struct {
+	Name          string    `json:"name"`
+	Version       string    `json:"version"`
+	StartedAt     time.Time `json:"started_at"`
+	UptimeSeconds float64   `json:"uptime_seconds"`
+}
+
+// JobsOverview counts the jobs of every instance sharing the job store.
+// Today is the current UTC day.
+type JobsOverview struct {
+	Running        int     `json:"running"`
+	Queued         int     `json:"queued"`
+	CompletedToday int     `json:"completed_today"`
+	FailedToday    int     `json:"failed_today"`
+	ErrorRate      float64 `json:"error_rate"`
+}
+
+// TenantToday is the activity of one tenant during the current UTC day
+type TenantToday struct {
+	Tenant         string  `json:"tenant"`
+	Jobs           int     `json:"jobs"`
+	FailedJobs     int     `json:"failed_jobs"`
+	Rows           int     `json:"rows"`
+	RowsPerHour    float64 `json:"rows_per_hour"`
+	FailedRows     int     `json:"failed_rows"`
+	ErrorRate      float64 `json:"error_rate"`
+	RowFailureRate float64 `json:"row_failure_rate"`
+}
+
+// buildOverview gathers the overview at now. Jobs of an archive or batch
+// are counted once, through the job of the upload that sums them up.
+func buildOverview(now time.Time) (*AdminOverview, error) {
+	jobs, err := jobStore.ListJobs(0)
+	if err != nil {
+		return nil, err
+	}
+
+	overview := &AdminOverview{
+		Instance: InstanceOverview{
+			Name:          instanceName,
+			Version:       version,
+			StartedAt:     processStarted.UTC(),
+			UptimeSeconds: now.Sub(processStarted).Seconds(),
+		},
+		Queue:       jobQueue.Stats(),
+		Tenants:     []TenantToday{},
+		GeneratedAt: now.UTC(),
+	}
+
+	midnight := now.UTC().Truncate(24 * time.Hour)
+	hours := max(now.Sub(midnight).Hours(), 1.0/60)
+	tenants := make(map[string]*TenantToday)
+	for _, job := range jobs {
+		switch job.Status {
+		case JobRunning:
+			overview.Jobs.Running++
+		case JobQueued:
+			overview.Jobs.Queued++
+		}
+		if job.ParentID != "" || job.CreatedAt.Before(midnight) {
+			continue
+		}
+		tenant := job.Tenant
+		if tenant == "" {
+			tenant = defaultTenant
+		}
+		tt, ok := tenants[tenant]
+		if !ok {
+			tt = &TenantToday{Tenant: tenant}
+			tenants[tenant] = tt
+		}
+		tt.Jobs++
+		tt.Rows += job.ProcessedRows
+		tt.FailedRows += job.FailedRows
+		switch job.Status {
+		case JobCompleted:
+			overview.Jobs.CompletedToday++
+		case JobFailed:
+			overview.Jobs.FailedToday++
+			tt.FailedJobs++
+		}
+	}
+	if finished := overview.Jobs.CompletedToday + overview.Jobs.FailedToday; finished > 0 {
+		overview.Jobs.ErrorRate = float64(overview.Jobs.FailedToday) / float64(finished)
+	}
+
+	for _, tt := range tenants {
+		tt.RowsPerHour = float64(tt.Rows) / hours
+		if tt.Jobs > 0 {
+			tt.ErrorRate = float64(tt.FailedJobs) / float64(tt.Jobs)
+		}
+		if tt.Rows > 0 {
+			tt.RowFailureRate = float64(tt.FailedRows) / float64(tt.Rows)
+		}
+		overview.Tenants = append(overview.Tenants, *tt)
+	}
+	sort.Slice(overview.Tenants, func(i, j int) bool {
+		return overview.Tenants[i].Tenant < overview.Tenants[j].Tenant
+	})
+
+	// An unreachable store is reported without failing the overview
+	usage, err := jobStore.Usage()
+	if err != nil {
+		log.Printf("Failed to get storage usage: %v", err)
+		overview.StorageError = err.Error()
+	} else {
+		overview.Storage = &usage
+	}
+	return overview, nil
+}
+
+// adminOverviewHandler returns the overview for the admin dashboard
+func adminOverviewHandler(w http.ResponseWriter, r *http.Request) {
+	if !isAdmin(r) {
+		http.Error(w, "Admin token required", http.StatusForbidden)
+		return
+	}
+	overview, err := buildOverview(time.Now())
+	if err != nil {
+		http.Error(w, "Failed to build overview: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, overview)
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Annotation is a reviewer's note attached to a row of a job's result
+type Annotation struct {
+	Row       string    `json:"row"`
+	Author    string    `json:"author"`
+	Text      string    `json:"text"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// maxAnnotationSize limits the size of an annotation request body
+const maxAnnotationSize = 64 << 10
+
+// groupAnnotations indexes annotations by row key
+func groupAnnotations(annotations []Annotation) map[string][]Annotation {
+	if len(annotations) == 0 {
+		return nil
+	}
+	byRow := make(map[string][]Annotation)
+	for _, a := range annotations {
+		byRow[a.Row] = append(byRow[a.Row], a)
+	}
+	return byRow
+}
+
+// addAnnotationHandler attaches an annotation to a row of a job's result.
+// Rows are identified by the key used in the validation section.
+func addAnnotationHandler(w http.ResponseWriter, r *http.Request) {
+	jobID, rowKey := r.PathValue("id"), r.PathValue("key")
+
+	result, err := jobStore.GetResult(jobID)
+	if err != nil {
+		writeStoreError(w, "Failed to get result: ", err)
+		return
+	}
+	if _, ok := result.Validation[rowKey]; !ok {
+		http.Error(w, "Row not found: "+rowKey, http.StatusNotFound)
+		return
+	}
+
+	var body struct {
+		Author string `json:"author"`
+		Text   string `json:"text"`
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxAnnotationSize)
+	if err := decodeJSON(r.Body, "annotation-request.json", &body); err != nil {
+		writeError(w, "Invalid annotation: ", err)
+		return
+	}
+	body.Author = strings.TrimSpace(body.Author)
+	body.Text = strings.TrimSpace(body.Text)
+	if body.Author == "" || body.Text == "" {
+		http.Error(w, "Invalid annotation: author and text are required", http.StatusBadRequest)
+		return
+	}
+
+	annotation := Annotation{
+		Row:       rowKey,
+		Author:    body.Author,
+		Text:      body.Text,
+		CreatedAt: time.Now().UTC(),
+	}
+	if err := jobStore.AddAnnotation(jobID, annotation); err != nil {
+		writeStoreError(w, "Failed to save annotation: ", err)
+		return
+	}
+
+	writeJSONStatus(w, http.StatusCreated, annotation)
+}
+
+// annotationsHandler lists the annotations of a single row
+func annotationsHandler(w http.ResponseWriter, r *http.Request) {
+	annotations, err := jobStore.Annotations(r.PathValue("id"))
+	if err != nil {
+		writeStoreError(w, "Failed to get annotations: ", err)
+		return
+	}
+	rowAnnotations := groupAnnotations(annotations)[r.PathValue("key")]
+	if rowAnnotations == nil {
+		rowAnnotations = []Annotation{}
+	}
+	writeCachedJSON(w, r, struct {
+		Annotations []Annotation `json:"annotations"`
+	}{Annotations: rowAnnotations})
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"path"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// anonymizedKeptColumns are left as they are in anonymized samples: they
+// hold no commercial data and are what most checks look at
+var anonymizedKeptColumns = map[string]bool{
+	"Genre":                 true,
+	"Release Date":          true,
+	"Language":              true,
+	"Explicit":              true,
+	"Territories":           true,
+	"Royalty Artist %":      true,
+	"Royalty Label %":       true,
+	"Royalty Distributor %": true,
+	"Royalty Publisher %":   true,
+}
+
+// anonymizedNameColumns are replaced with made-up names of their kind
+var anonymizedNameColumns = map[string]string{
+	"Artist Name":   "artist",
+	"Label Name":    "label",
+	"Rights Holder": "company",
+	"Release Title": "title",
+	"Track Title":   "title",
+}
+
+// Words made-up names are put together from
+var (
+	fakeFirstNames = []string{
+		"Ada", "Bruno", "Carla", "Dmitri", "Elena", "Felix", "Greta", "Hugo",
+		"Ines", "Jonas", "Kira", "Luca", "Maya", "Nils", "Olga", "Pablo",
+		"Quinn", "Rosa", "Sami", "Tara", "Umar", "Vera", "Wim", "Xenia",
+		"Yusuf", "Zoe", "Arlo", "Bea", "Cyril", "Dora", "Emil", "Flora",
+	}
+	fakeLastNames = []string{
+		"Abbott", "Brandt", "Castillo", "Dahl", "Eriksen", "Fontaine", "Gallo", "Hart",
+		"Ibarra", "Jansen", "Keller", "Lindqvist", "Moreau", "Novak", "Okafor", "Petrov",
+		"Quist", "Rossi", "Sato", "Tanaka", "Ueda", "Varga", "Weber", "Xu",
+		"Yilmaz", "Zeller", "Alvarez", "Berg", "Costa", "Duval", "Engel", "Falk",
+	}
+	fakeAdjectives = []string{
+		"Amber", "Bright", "Silent", "Copper", "Distant", "Electric", "Faded", "Golden",
+		"Hollow", "Indigo", "Jagged", "Kinetic", "Lunar", "Midnight", "Neon", "Open",
+		"Pale", "Quiet", "Restless", "Scarlet", "Tidal", "Urban", "Velvet", "Wild",
+		"Young", "Zero", "Broken", "Crystal", "Drifting", "Endless", "Frozen", "Gentle",
+	}
+	fakeNouns = []string{
+		"Harbor", "Echo", "Signal", "Garden", "Mirror", "Tide", "Engine", "Forest",
+		"Lantern", "Orbit", "Parade", "Canyon", "Ember", "Horizon", "Island", "Meadow",
+		"Motel", "Pilot", "Radio", "River", "Satellite", "Shadow", "Summer", "Thunder",
+		"Valley", "Window", "Winter", "Anthem", "Circuit", "Desert", "Fever", "Highway",
+	}
+	fakeCompanySuffixes   = []string{"Records", "Music", "Recordings", "Sounds", "Audio", "Works"}
+	fakePublisherSuffixes = []string{"Publishing", "Rights", "Songs", "Music Publishing", "Editions"}
+)
+
+// anonymizer replaces the commercial data of rows with stand-ins derived
+// from a keyed hash of each value, so the same value always gets the same
+// stand-in and rows can be anonymized in any order or in parallel
+type anonymizer struct {
+	key []byte
+}
+
+// newAnonymizer creates an anonymizer for a seed. The same seed and
+// ANONYMIZE_SECRET always give the same sample and stand-ins.
+func newAnonymizer(seed string) *anonymizer {
+	mac := hmac.New(sha256.New, []byte(cfg.AnonymizeSecret))
+	mac.Write([]byte(seed))
+	return &anonymizer{key: mac.Sum(nil)}
+}
+
+// hash returns n bytes derived from a value of a kind
+func (a *anonymizer) hash(kind, value string, n int) []byte {
+	var out []byte
+	for block := uint32(0); len(out) < n; block++ {
+		mac := hmac.New(sha256.New, a.key)
+		mac.Write(binary.BigEndian.AppendUint32(nil, block))
+		mac.Write([]byte(kind))
+		mac.Write([]byte{0})
+		mac.Write([]byte(value))
+		out = mac.Sum(out)
+	}
+	return out[:n]
+}
+
+// sampled reports whether a row is in a sample of the given fraction.
+// Releases are sampled whole, so problems across the rows of a release are
+// kept.
+func (a *anonymizer) sampled(row map[string]string, fraction float64) bool {
+	if fraction >= 1 {
+		return true
+	}
+	key := row["Release ID"]
+	if key == "" {
+		key = row["Track ID"]
+	}
+	h := binary.BigEndian.Uint64(a.hash("sample", key, 8))
+	return float64(h) < fraction*math.Pow(2, 64)
+}
+
+// row returns an anonymized copy of a row
+func (a *anonymizer) row(row map[string]string) map[string]string {
+	out := make(map[string]string, len(row))
+	for column, value := range row {
+		switch {
+		case value == "" || anonymizedKeptColumns[column]:
+			out[column] = value
+		case anonymizedNameColumns[column] != "":
+			out[column] = a.name(anonymizedNameColumns[column], value)
+		case column == "File URL":
+			out[column] = a.url(value)
+		case column == "UPC":
+			out[column] = a.code(value)
+		default:
+			out[column] = a.identifier(value)
+		}
+	}
+	return out
+}
+
+// identifier replaces every letter and digit of a value with another of
+// the same kind, keeping its length, case and punctuation, so malformed
+// identifiers stay malformed in the same way
+func (a *anonymizer) identifier(value string) string {
+	h := a.hash("id", value, len(value))
+	var b strings.Builder
+	for i, r := range value {
+		c := h[i%len(h)]
+		switch {
+		case r >= '0' && r <= '9':
+			b.WriteByte('0' + c%10)
+		case r >= 'A' && r <= 'Z':
+			b.WriteByte('A' + c%26)
+		case r >= 'a' && r <= 'z':
+			b.WriteByte('a' + c%26)
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			b.WriteByte('x')
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// code replaces a UPC or EAN as an identifier, keeping a valid check digit
+// valid
+func (a *anonymizer) code(value string) string {
+	out := a.identifier(value)
+	if len(value) < 8 || !isDigits(value) || !validGTIN(value) {
+		return out
+	}
+	for digit := byte('0'); digit <= '9'; digit++ {
+		candidate := out[:len(out)-1] + string(digit)
+		if validGTIN(candidate) {
+			return candidate
+		}
+	}
+	return out
+}
+
+// url replaces a URL with one on example.com, keeping its file extension
+func (a *anonymizer) url(value string) string {
+	ext := path.Ext(value)
+	if len(ext) > 6 || strings.ContainsAny(ext, "/?#") {
+		ext = ""
+	}
+	return fmt.Sprintf("https://example.com/%x%s", a.hash("url", value, 8), ext)
+}
+
+// name makes up a name of a kind for a value, such as an artist or a label
+func (a *anonymizer) name(kind, value string) string {
+	h := a.hash("name", dictionaryKey(value), 4)
+	pick := func(words []string, i int) string { return words[int(h[i])%len(words)] }
+	switch kind {
+	case "artist":
+		if h[3]%4 == 0 {
+			return "The " + pick(fakeAdjectives, 0) + " " + pick(fakeNouns, 1) + "s"
+		}
+		return pick(fakeFirstNames, 0) + " " + pick(fakeLastNames, 1)
+	case "label":
+		return pick(fakeAdjectives, 0) + " " + pick(fakeNouns, 1) + " " + pick(fakeCompanySuffixes, 2)
+	case "company":
+		return pick(fakeLastNames, 0) + " & " + pick(fakeLastNames, 1) + " " + pick(fakePublisherSuffixes, 2)
+	}
+	return pick(fakeAdjectives, 0) + " " + pick(fakeNouns, 1) + " " + strconv.Itoa(int(h[2])<<8|int(h[3]))
+}
+
+// anonymizedSample returns an anonymized sample of a fraction of the rows
+// of a conversion
+func anonymizedSample(conversion Conversion, seed string, fraction float64) Conversion {
+	a := newAnonymizer(seed)
+	sample := Conversion{Columns: conversion.Columns}
+	for _, row := range conversion.Rows {
+		if a.sampled(row, fraction) {
+			sample.Rows = append(sample.Rows, a.row(row))
+		}
+	}
+	return sample
+}
@@ -0,0 +1,340 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// AppendResponse is the outcome of appending a part to a job's dataset.
+// Validation holds the appended rows, checked across the combined dataset.
+type AppendResponse struct {
+	JobID      string                   `json:"job_id"`
+	Part       int                      `json:"part"`
+	Rows       int                      `json:"rows"`
+	TotalRows  int                      `json:"total_rows"`
+	FailedRows int                      `json:"failed_rows"`
+	Validation map[string]RowValidation `json:"validation"`
+	Warnings   []string                 `json:"warnings,omitempty"`
+}
+
+// appendHandler adds a further CSV part of the same catalog to a completed
+// job. The part is processed like an upload with the job's profile, must
+// have the job's columns, and the checks across rows are rerun over the
+// combined dataset.
+func appendHandler(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	job, err := jobStore.GetJob(id)
+	if err != nil {
+		writeStoreError(w, "Failed to get job: ", err)
+		return
+	}
+	if job.Status != JobCompleted {
+		http.Error(w, "Parts can only be appended to completed jobs, job is "+job.Status, http.StatusConflict)
+		return
+	}
+	result, err := jobStore.GetResult(id)
+	if err != nil {
+		writeStoreError(w, "Failed to get result: ", err)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, cfg.MaxUploadSize)
+	if err := r.ParseMultipartForm(32 << 20); err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			writeError(w, "Failed to parse form: ", err)
+			return
+		}
+		http.Error(w, "Failed to parse form: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	file, header, err := r.FormFile("csvFile")
+	if err != nil {
+		http.Error(w, "Failed to get file: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+
+	// Parts are delimited text, optionally gzip-compressed
+	name := strings.ToLower(header.Filename)
+	gzipped, err := isGzip(file)
+	if err != nil {
+		http.Error(w, "Failed to read file: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	name = strings.TrimSuffix(name, ".gz")
+	extension := filepath.Ext(name)
+	if extension != ".csv" && extension != ".tsv" && extension != ".txt" {
+		http.Error(w, "Only CSV and TSV parts can be appended, optionally gzip-compressed", http.StatusUnsupportedMediaType)
+		return
+	}
+	checkContent := checkTextContent
+	if gzipped {
+		checkContent = checkGzipContent
+	}
+	if err := checkContent(file); err != nil {
+		writeError(w, "Invalid file: ", err)
+		return
+	}
+	if err := scanUpload(file, header.Filename); err != nil {
+		writeError(w, "Upload rejected: ", err)
+		return
+	}
+	upload := keepUpload(file)
+	var input io.Reader = file
+	if gzipped {
+		zr, err := newGzipReader(file)
+		if err != nil {
+			writeError(w, "Invalid file: ", err)
+			return
+		}
+		defer zr.Close()
+		input = zr
+	}
+
+	numWorkers, _, workersWarning, err := parseWorkers(r.FormValue("workers"))
+	if err != nil {
+		http.Error(w, "Invalid workers value: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	delimiter, err := parseDelimiter(r.FormValue("delimiter"))
+	if err != nil {
+		http.Error(w, "Invalid delimiter: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if delimiter == 0 && extension == ".tsv" {
+		delimiter = '\t'
+	}
+	normalization, err := parseNormalization(r)
+	if err != nil {
+		writeError(w, "Invalid normalize: ", err)
+		return
+	}
+
+	// Parts are read with the profile the job was processed with
+	var profile *Profile
+	if result.Metadata.Profile != "" {
+		profile, err = loadProfile(result.Metadata.Profile)
+		if errors.Is(err, ErrProfileNotFound) {
+			http.Error(w, "Profile no longer exists: "+result.Metadata.Profile, http.StatusConflict)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Failed to load profile: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	profiles, err := loadProfiles(result.Metadata.Profiles)
+	if err != nil {
+		http.Error(w, "Failed to load profiles: "+err.Error(), http.StatusConflict)
+		return
+	}
+	checks, err := storedChecks(result.Metadata.Checks)
+	if err != nil {
+		http.Error(w, "Failed to compile checks: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	computed, err := compileComputed(result.Metadata.Computed)
+	if err != nil {
+		http.Error(w, "Failed to compile computed columns: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	validators, err := loadValidators(result.Metadata.Validators)
+	if err != nil {
+		http.Error(w, "Failed to load validators: "+err.Error(), http.StatusConflict)
+		return
+	}
+
+	dictionary, err := tenantDictionary(job.Tenant)
+	if err != nil {
+		http.Error(w, "Failed to get dictionary: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	release, err := jobQueue.Acquire(r.Context())
+	if err != nil {
+		http.Error(w, "Append cancelled while waiting for a job slot", http.StatusServiceUnavailable)
+		return
+	}
+	defer release()
+
+	started := time.Now()
+	part, err := processCSV(r.Context(), input, ProcessOptions{
+		Workers:            numWorkers,
+		JobID:              id,
+		ScanPII:            formBool(r, "scan_pii") || result.PII != nil,
+		RepairNumerics:     formBool(r, "repair_numerics"),
+		Normalization:      normalization,
+		NormalizeRoyalties: formBool(r, "normalize_royalties"),
+		SingleReleaseType:  formBool(r, "single_release_type"),
+		StrictHeader:       formBool(r, "strict_header"),
+		Dictionary:         dictionary,
+		Profile:            profile,
+		Profiles:           profiles,
+		Checks:             checks,
+		Validators:         validators,
+		Dedupe:             storedDedupe(result.Metadata.Deduplication, result.Conversion.Rows),
+		MaxHeaderSkip:      cfg.MaxHeaderSkip,
+		Delimiter:          delimiter,
+	})
+	if err != nil {
+		writeError(w, "Failed to process CSV: ", err)
+		return
+	}
+	part.Metadata.JobID = id
+	if err := runCallout(r.Context(), part, job.Tenant); err != nil {
+		writeError(w, "Failed to process CSV: ", err)
+		return
+	}
+	if workersWarning != "" {
+		part.Warnings = append(part.Warnings, workersWarning)
+	}
+
+	// The stored result may have changed while the part was processed
+	resultMutex.Lock()
+	defer resultMutex.Unlock()
+	if job, err = jobStore.GetJob(id); err != nil {
+		writeStoreError(w, "Failed to get job: ", err)
+		return
+	}
+	if result, err = jobStore.GetResult(id); err != nil {
+		writeStoreError(w, "Failed to get result: ", err)
+		return
+	}
+	if err := checkSameColumns(withoutComputed(result.Metadata.Columns, result.Metadata.Computed), part.Metadata.Columns); err != nil {
+		writeError(w, "Part does not match the job: ", err)
+		return
+	}
+
+	combined := appendPart(result, part)
+	if formBool(r, "single_release_type") {
+		if err := checkSingleReleaseType(combined.Metadata.ReleaseTypes); err != nil {
+			writeError(w, "Part does not match the job: ", err)
+			return
+		}
+	}
+	// Computed columns may depend on the number of tracks of a release
+	part.Warnings = append(part.Warnings, computeColumns(combined, computed)...)
+	if checks == nil {
+		checks = profile.checkSet()
+	}
+	checkCrossRow(combined, checks)
+	countSeverities(combined)
+	combined.Summary = summarize(combined, result.Summary.duration()+time.Since(started))
+	if err := jobStore.SaveResult(id, combined); err != nil {
+		writeStoreError(w, "Failed to save result: ", err)
+		return
+	}
+	materializeViews(id, combined)
+	job.ProcessedRows = len(combined.Conversion.Rows)
+	job.countFailures(combined.Validation)
+	job.ReuseKey = ""
+	referenceUpload(job, upload)
+	saveJob(job)
+	log.Printf("Appended part %d of %d rows to job %s", combined.Metadata.Parts, len(part.Conversion.Rows), id)
+
+	response := AppendResponse{
+		JobID:      id,
+		Part:       combined.Metadata.Parts,
+		Rows:       len(part.Conversion.Rows),
+		TotalRows:  job.ProcessedRows,
+		FailedRows: job.FailedRows,
+		Validation: make(map[string]RowValidation, len(part.Validation)),
+		Warnings:   part.Warnings,
+	}
+	for trackID := range part.Validation {
+		response.Validation[trackID] = combined.Validation[trackID]
+	}
+	writeJSON(w, response)
+}
+
+// checkSameColumns reports columns of a part missing from the job or
+// missing from the part, in any order
+func checkSameColumns(columns, partColumns []string) error {
+	known := make(map[string]bool, len(columns))
+	for _, column := range columns {
+		known[column] = true
+	}
+	var missing, unexpected []string
+	for _, column := range partColumns {
+		if !known[column] {
+			unexpected = append(unexpected, column)
+		}
+		delete(known, column)
+	}
+	for _, column := range columns {
+		if known[column] {
+			missing = append(missing, column)
+		}
+	}
+
+	var problems []string
+	if len(missing) > 0 {
+		problems = append(problems, "missing columns "+strings.Join(missing, ", "))
+	}
+	if len(unexpected) > 0 {
+		problems = append(problems, "unexpected columns "+strings.Join(unexpected, ", "))
+	}
+	if len(problems) > 0 {
+		return fileErrorf(http.StatusUnprocessableEntity, "%s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// appendPart returns the result combining the stored dataset and a new part.
+// A row of the part with the Track ID of an earlier row takes over its
+// validation entry; the duplicate check flags both.
+func appendPart(result, part *OutputFormat) *OutputFormat {
+	combined := *result
+	combined.Metadata.Parts = max(result.Metadata.Parts, 1) + 1
+	combined.Metadata.RepairedCells += part.Metadata.RepairedCells
+	combined.Metadata.NormalizedCells += part.Metadata.NormalizedCells
+	combined.Metadata.Deduplication = mergeDeduplication(result.Metadata.Deduplication, part.Metadata.Deduplication, combined.Metadata.Parts)
+	combined.Metadata.Substitutions = mergeSubstitutions(result.Metadata.Substitutions, part.Metadata.Substitutions)
+	combined.Metadata.ReleaseTypes = mergeReleaseTypes(result.Metadata.ReleaseTypes, part.Metadata.ReleaseTypes)
+
+	rows := make([]map[string]string, 0, len(result.Conversion.Rows)+len(part.Conversion.Rows))
+	rows = append(rows, result.Conversion.Rows...)
+	combined.Conversion = Conversion{Columns: result.Conversion.Columns, Rows: append(rows, part.Conversion.Rows...)}
+
+	combined.Validation = make(map[string]RowValidation, len(result.Validation)+len(part.Validation))
+	for trackID, validation := range result.Validation {
+		combined.Validation[trackID] = validation
+	}
+	for trackID, validation := range part.Validation {
+		combined.Validation[trackID] = validation
+	}
+
+	if part.PII != nil {
+		combined.PII = make(PIIReport)
+		for _, report := range []PIIReport{result.PII, part.PII} {
+			for column, kinds := range report {
+				for kind, count := range kinds {
+					if combined.PII[column] == nil {
+						combined.PII[column] = make(map[string]int)
+					}
+					combined.PII[column][kind] += count
+				}
+			}
+		}
+	}
+
+	combined.MalformedRows = append([]MalformedRow(nil), result.MalformedRows...)
+	for _, row := range part.MalformedRows {
+		row.Part = combined.Metadata.Parts
+		combined.MalformedRows = append(combined.MalformedRows, row)
+	}
+
+	combined.Warnings = append([]string(nil), result.Warnings...)
+	for _, warning := range part.Warnings {
+		combined.Warnings = append(combined.Warnings, fmt.Sprintf("Part %d: %s", combined.Metadata.Parts, warning))
+	}
+	return &combined
+}
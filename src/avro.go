@@ -0,0 +1,591 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+	"math/big"
+	"mime/multipart"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// avroMagic starts every Avro object container file
+const avroMagic = "Obj\x01"
+
+// maxAvroBlock limits the size of a data block, compressed or not, and of
+// the file metadata
+const maxAvroBlock = 64 << 20
+
+// avroType is a parsed Avro schema type
+type avroType struct {
+	kind     string // primitive type name, or enum, fixed, array, map, record or union
+	logical  string
+	scale    int
+	size     int
+	symbols  []string
+	items    *avroType
+	branches []*avroType
+}
+
+// avroField is a field of the top-level record, read as a column
+type avroField struct {
+	name   string
+	header string
+	typ    *avroType
+}
+
+// avroFile reads an Avro object container file one block at a time. It
+// implements RowSource: the column names come first, then every record
+// with its fields formatted as they would appear in a CSV export.
+type avroFile struct {
+	r      *bufio.Reader
+	fields []avroField
+	codec  string
+	sync   []byte
+	header bool
+
+	block     avroDecoder
+	remaining int64
+}
+
+// avroDecoder reads Avro binary encoded values from a decoded block
+type avroDecoder struct {
+	data []byte
+	pos  int
+}
+
+var errAvroTruncated = errors.New("truncated data")
+
+// checkAvroContent rejects uploads that do not start with the Avro magic
+// bytes. The file is rewound to the beginning afterwards.
+func checkAvroContent(file multipart.File) error {
+	magic := make([]byte, len(avroMagic))
+	n, err := io.ReadFull(file, magic)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return fmt.Errorf("failed to read upload: %v", err)
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("failed to rewind upload: %v", err)
+	}
+	if string(magic[:n]) != avroMagic {
+		return fileErrorf(http.StatusUnsupportedMediaType,
+			"file content is not an Avro container file (detected %s)", http.DetectContentType(magic[:n]))
+	}
+	return nil
+}
+
+// openAvro reads the header of an Avro object container file. The schema
+// must be a record of flat fields: primitives, enums, fixed, arrays of
+// those and unions of them with null. Field names, or their aliases, that
+// match a known column once normalized are read as that column, so
+// release_id becomes Release ID; other fields keep their name.
+func openAvro(r io.Reader, known []string) (*avroFile, error) {
+	invalid := func(format string, args ...interface{}) error {
+		return fileErrorf(http.StatusUnprocessableEntity, "invalid Avro file: "+format, args...)
+	}
+
+	af := &avroFile{r: bufio.NewReaderSize(r, 64<<10)}
+	magic := make([]byte, len(avroMagic))
+	if _, err := io.ReadFull(af.r, magic); err != nil || string(magic) != avroMagic {
+		return nil, invalid("missing header")
+	}
+
+	// The metadata is a map of bytes, written in blocks
+	meta := make(map[string][]byte)
+	for size := 0; ; {
+		count, err := af.readLong()
+		if err != nil {
+			return nil, invalid("unreadable metadata: %v", err)
+		}
+		if count == 0 {
+			break
+		}
+		if count < 0 {
+			count = -count
+			if _, err := af.readLong(); err != nil {
+				return nil, invalid("unreadable metadata: %v", err)
+			}
+		}
+		for ; count > 0; count-- {
+			key, err := af.readBytes()
+			if err != nil {
+				return nil, invalid("unreadable metadata: %v", err)
+			}
+			value, err := af.readBytes()
+			if err != nil {
+				return nil, invalid("unreadable metadata: %v", err)
+			}
+			if size += len(key) + len(value); size > maxAvroBlock {
+				return nil, invalid("metadata exceeds %d MB", maxAvroBlock>>20)
+			}
+			meta[string(key)] = value
+		}
+	}
+	af.sync = make([]byte, 16)
+	if _, err := io.ReadFull(af.r, af.sync); err != nil {
+		return nil, invalid("missing sync marker")
+	}
+
+	af.codec = string(meta["avro.codec"])
+	switch af.codec {
+	case "":
+		af.codec = "null"
+	case "null", "deflate", "snappy":
+	default:
+		return nil, fileErrorf(http.StatusUnprocessableEntity, "unsupported Avro codec %q; use null, deflate or snappy", af.codec)
+	}
+
+	var raw json.RawMessage
+	if err := json.Unmarshal(meta["avro.schema"], &raw); err != nil {
+		return nil, invalid("unreadable schema: %v", err)
+	}
+	var record struct {
+		Type   string `json:"type"`
+		Fields []struct {
+			Name    string          `json:"name"`
+			Type    json.RawMessage `json:"type"`
+			Aliases []string        `json:"aliases"`
+		} `json:"fields"`
+	}
+	if err := json.Unmarshal(raw, &record); err != nil || record.Type != "record" {
+		return nil, fileErrorf(http.StatusUnprocessableEntity, "the Avro schema must be a record")
+	}
+	if len(record.Fields) == 0 {
+		return nil, invalid("schema has no fields")
+	}
+
+	byNormalized := make(map[string]string, len(known))
+	for _, column := range known {
+		byNormalized[normalizeColumnName(column)] = column
+	}
+	names := make(map[string]*avroType)
+	for _, f := range record.Fields {
+		typ, err := parseAvroType(f.Type, names)
+		if err != nil {
+			return nil, fileErrorf(http.StatusUnprocessableEntity, "Avro field %q: %v", f.Name, err)
+		}
+		if !typ.flat() {
+			return nil, fileErrorf(http.StatusUnprocessableEntity,
+				"Avro field %q is a nested record or map; only flat records are supported", f.Name)
+		}
+		af.fields = append(af.fields, avroField{name: f.Name, header: avroHeader(f.Name, f.Aliases, byNormalized), typ: typ})
+	}
+	if af.recordSize() == 0 {
+		return nil, invalid("records of the schema hold no data")
+	}
+	return af, nil
+}
+
+// avroHeader returns the known column a field name or alias stands for,
+// ignoring case, separators and a pct or percent suffix, or the field name
+func avroHeader(name string, aliases []string, byNormalized map[string]string) string {
+	for _, candidate := range append([]string{name}, aliases...) {
+		normalized := normalizeColumnName(candidate)
+		for _, key := range []string{normalized, strings.TrimSuffix(normalized, "pct"), strings.TrimSuffix(normalized, "percent")} {
+			if column, ok := byNormalized[key]; ok {
+				return column
+			}
+		}
+	}
+	return name
+}
+
+// parseAvroType parses a schema type. Named types are recorded in names,
+// by name and full name, so later fields can refer to them.
+func parseAvroType(raw json.RawMessage, names map[string]*avroType) (*avroType, error) {
+	var name string
+	if err := json.Unmarshal(raw, &name); err == nil {
+		switch name {
+		case "null", "boolean", "int", "long", "float", "double", "bytes", "string":
+			return &avroType{kind: name}, nil
+		}
+		if typ, ok := names[name]; ok {
+			return typ, nil
+		}
+		return nil, fmt.Errorf("unknown type %q", name)
+	}
+
+	var union []json.RawMessage
+	if err := json.Unmarshal(raw, &union); err == nil {
+		typ := &avroType{kind: "union"}
+		for _, branch := range union {
+			branchType, err := parseAvroType(branch, names)
+			if err != nil {
+				return nil, err
+			}
+			typ.branches = append(typ.branches, branchType)
+		}
+		return typ, nil
+	}
+
+	var schema struct {
+		Type        json.RawMessage `json:"type"`
+		Name        string          `json:"name"`
+		Namespace   string          `json:"namespace"`
+		LogicalType string          `json:"logicalType"`
+		Scale       int             `json:"scale"`
+		Size        int             `json:"size"`
+		Symbols     []string        `json:"symbols"`
+		Items       json.RawMessage `json:"items"`
+	}
+	if err := json.Unmarshal(raw, &schema); err != nil {
+		return nil, fmt.Errorf("invalid type: %v", err)
+	}
+	if schema.LogicalType == "decimal" && (schema.Scale < 0 || schema.Scale > maxDecimalScale) {
+		return nil, fmt.Errorf("invalid decimal scale %d", schema.Scale)
+	}
+	var kind string
+	if err := json.Unmarshal(schema.Type, &kind); err != nil {
+		// {"type": {...}} wraps another type
+		return parseAvroType(schema.Type, names)
+	}
+
+	typ := &avroType{kind: kind, logical: schema.LogicalType, scale: schema.Scale, size: schema.Size, symbols: schema.Symbols}
+	switch kind {
+	case "array":
+		items, err := parseAvroType(schema.Items, names)
+		if err != nil {
+			return nil, err
+		}
+		typ.items = items
+	case "enum", "fixed", "record", "map":
+	default:
+		primitive, err := parseAvroType(schema.Type, names)
+		if err != nil {
+			return nil, err
+		}
+		primitive.logical, primitive.scale = schema.LogicalType, schema.Scale
+		return primitive, nil
+	}
+	if schema.Name != "" {
+		names[schema.Name] = typ
+		if schema.Namespace != "" {
+			names[schema.Namespace+"."+schema.Name] = typ
+		}
+	}
+	if kind == "fixed" && (typ.size < 0 || typ.size > maxAvroBlock) {
+		return nil, fmt.Errorf("invalid fixed size %d", typ.size)
+	}
+	return typ, nil
+}
+
+// flat reports whether values of the type fit in a single cell
+func (t *avroType) flat() bool {
+	switch t.kind {
+	case "record", "map":
+		return false
+	case "array":
+		return t.items.kind != "array" && t.items.flat()
+	case "union":
+		for _, branch := range t.branches {
+			if !branch.flat() {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// minSize returns the fewest bytes a value of the type is encoded in
+func (t *avroType) minSize() int64 {
+	switch t.kind {
+	case "null":
+		return 0
+	case "float":
+		return 4
+	case "double":
+		return 8
+	case "fixed":
+		return int64(t.size)
+	case "union":
+		if len(t.branches) == 0 {
+			return 1
+		}
+		size := t.branches[0].minSize()
+		for _, branch := range t.branches[1:] {
+			size = min(size, branch.minSize())
+		}
+		return 1 + size
+	}
+	// A boolean, a number, a length, an index or an array's final count
+	return 1
+}
+
+// recordSize returns the fewest bytes a record is encoded in
+func (af *avroFile) recordSize() int64 {
+	var size int64
+	for _, field := range af.fields {
+		size += field.typ.minSize()
+	}
+	return size
+}
+
+// readLong reads a zigzag-encoded long from the file
+func (af *avroFile) readLong() (int64, error) {
+	return binary.ReadVarint(af.r)
+}
+
+// readBytes reads length-prefixed bytes from the file
+func (af *avroFile) readBytes() ([]byte, error) {
+	n, err := af.readLong()
+	if err != nil {
+		return nil, err
+	}
+	if n < 0 || n > maxAvroBlock {
+		return nil, fmt.Errorf("length %d is out of range", n)
+	}
+	// The buffer grows with the data rather than the length claimed
+	data, err := io.ReadAll(io.LimitReader(af.r, n))
+	if err == nil && int64(len(data)) < n {
+		err = io.ErrUnexpectedEOF
+	}
+	return data, err
+}
+
+// Read returns the header, then the records of each block in turn
+func (af *avroFile) Read() ([]string, error) {
+	if !af.header {
+		af.header = true
+		headers := make([]string, len(af.fields))
+		for i, field := range af.fields {
+			headers[i] = field.header
+		}
+		return headers, nil
+	}
+
+	for af.remaining == 0 {
+		if err := af.readBlock(); err != nil {
+			return nil, err
+		}
+	}
+	row := make([]string, len(af.fields))
+	for i, field := range af.fields {
+		value, err := af.block.value(field.typ)
+		if err != nil {
+			return nil, fileErrorf(http.StatusUnprocessableEntity, "invalid Avro file: field %q: %v", field.name, err)
+		}
+		row[i] = value
+	}
+	af.remaining--
+	if af.remaining == 0 && af.block.pos != len(af.block.data) {
+		return nil, fileErrorf(http.StatusUnprocessableEntity, "invalid Avro file: block has %d bytes past its records", len(af.block.data)-af.block.pos)
+	}
+	return row, nil
+}
+
+// readBlock reads and decompresses the next data block, returning io.EOF
+// after the last one
+func (af *avroFile) readBlock() error {
+	invalid := func(format string, args ...interface{}) error {
+		return fileErrorf(http.StatusUnprocessableEntity, "invalid Avro file: "+format, args...)
+	}
+
+	count, err := af.readLong()
+	if err == io.EOF {
+		return io.EOF
+	}
+	if err != nil {
+		return invalid("unreadable block: %v", err)
+	}
+	if count < 0 {
+		return invalid("negative record count")
+	}
+	data, err := af.readBytes()
+	if err != nil {
+		return invalid("unreadable block: %v", err)
+	}
+	sync := make([]byte, len(af.sync))
+	if _, err := io.ReadFull(af.r, sync); err != nil || !bytes.Equal(sync, af.sync) {
+		return invalid("sync marker mismatch")
+	}
+
+	switch af.codec {
+	case "deflate":
+		zr := flate.NewReader(bytes.NewReader(data))
+		data, err = io.ReadAll(io.LimitReader(zr, maxAvroBlock+1))
+		zr.Close()
+		if err == nil && len(data) > maxAvroBlock {
+			err = fmt.Errorf("exceeds %d MB", maxAvroBlock>>20)
+		}
+	case "snappy":
+		// Snappy blocks end with the CRC-32 of the uncompressed data
+		if len(data) < 4 {
+			return invalid("truncated Snappy block")
+		}
+		checksum := binary.BigEndian.Uint32(data[len(data)-4:])
+		data, err = decodeSnappy(data[:len(data)-4])
+		if err == nil && crc32.ChecksumIEEE(data) != checksum {
+			err = errors.New("checksum mismatch")
+		}
+	}
+	if err != nil {
+		return invalid("corrupt block: %v", err)
+	}
+	if count > int64(len(data))/af.recordSize() {
+		return invalid("block of %d bytes cannot hold %d records", len(data), count)
+	}
+	af.block = avroDecoder{data: data}
+	af.remaining = count
+	return nil
+}
+
+func (d *avroDecoder) long() (int64, error) {
+	v, n := binary.Varint(d.data[d.pos:])
+	if n <= 0 {
+		return 0, errAvroTruncated
+	}
+	d.pos += n
+	return v, nil
+}
+
+func (d *avroDecoder) take(n int64) ([]byte, error) {
+	if n < 0 || n > int64(len(d.data)-d.pos) {
+		return nil, errAvroTruncated
+	}
+	b := d.data[d.pos : d.pos+int(n)]
+	d.pos += int(n)
+	return b, nil
+}
+
+// value decodes a value of the given type as a cell. Nulls are empty and
+// arrays are comma-separated lists, as in JSON Lines uploads.
+func (d *avroDecoder) value(t *avroType) (string, error) {
+	switch t.kind {
+	case "null":
+		return "", nil
+	case "boolean":
+		b, err := d.take(1)
+		if err != nil {
+			return "", err
+		}
+		return strconv.FormatBool(b[0] != 0), nil
+	case "int", "long":
+		v, err := d.long()
+		if err != nil {
+			return "", err
+		}
+		return t.formatLong(v), nil
+	case "float":
+		b, err := d.take(4)
+		if err != nil {
+			return "", err
+		}
+		return strconv.FormatFloat(float64(math.Float32frombits(binary.LittleEndian.Uint32(b))), 'f', -1, 32), nil
+	case "double":
+		b, err := d.take(8)
+		if err != nil {
+			return "", err
+		}
+		return strconv.FormatFloat(math.Float64frombits(binary.LittleEndian.Uint64(b)), 'f', -1, 64), nil
+	case "bytes", "string":
+		n, err := d.long()
+		if err != nil {
+			return "", err
+		}
+		b, err := d.take(n)
+		if err != nil {
+			return "", err
+		}
+		return t.formatBytes(b), nil
+	case "fixed":
+		b, err := d.take(int64(t.size))
+		if err != nil {
+			return "", err
+		}
+		return t.formatBytes(b), nil
+	case "enum":
+		i, err := d.long()
+		if err != nil {
+			return "", err
+		}
+		if i < 0 || i >= int64(len(t.symbols)) {
+			return "", fmt.Errorf("enum index %d is out of range", i)
+		}
+		return t.symbols[i], nil
+	case "union":
+		i, err := d.long()
+		if err != nil {
+			return "", err
+		}
+		if i < 0 || i >= int64(len(t.branches)) {
+			return "", fmt.Errorf("union index %d is out of range", i)
+		}
+		return d.value(t.branches[i])
+	case "array":
+		var items []string
+		for {
+			count, err := d.long()
+			if err != nil {
+				return "", err
+			}
+			if count == 0 {
+				return strings.Join(items, ", "), nil
+			}
+			if count < 0 {
+				count = -count
+				if _, err := d.long(); err != nil {
+					return "", err
+				}
+			}
+			// Items that take no bytes may be no more than the block's bytes
+			if size := t.items.minSize(); size > 0 && count > int64(len(d.data)-d.pos)/size ||
+				size == 0 && count > int64(len(d.data)-len(items)) {
+				return "", errAvroTruncated
+			}
+			for ; count > 0; count-- {
+				item, err := d.value(t.items)
+				if err != nil {
+					return "", err
+				}
+				items = append(items, item)
+			}
+		}
+	}
+	return "", fmt.Errorf("unsupported type %s", t.kind)
+}
+
+// formatLong formats an int or long, applying dates, times and timestamps
+func (t *avroType) formatLong(v int64) string {
+	switch t.logical {
+	case "date":
+		return time.Unix(v*86400, 0).UTC().Format("2006-01-02")
+	case "time-millis":
+		return time.UnixMilli(v).UTC().Format("15:04:05.999")
+	case "time-micros":
+		return time.UnixMicro(v).UTC().Format("15:04:05.999999")
+	case "timestamp-millis":
+		return time.UnixMilli(v).UTC().Format(time.RFC3339Nano)
+	case "timestamp-micros":
+		return time.UnixMicro(v).UTC().Format(time.RFC3339Nano)
+	case "timestamp-nanos":
+		return time.Unix(0, v).UTC().Format(time.RFC3339Nano)
+	case "local-timestamp-millis":
+		return time.UnixMilli(v).UTC().Format("2006-01-02T15:04:05.999999999")
+	case "local-timestamp-micros":
+		return time.UnixMicro(v).UTC().Format("2006-01-02T15:04:05.999999999")
+	}
+	return strconv.FormatInt(v, 10)
+}
+
+// formatBytes formats bytes, strings and fixed values: decimals as numbers,
+// anything else as text
+func (t *avroType) formatBytes(b []byte) string {
+	if t.logical == "decimal" && len(b) > 0 {
+		v := new(big.Int).SetBytes(b)
+		if b[0]&0x80 != 0 {
+			v.Sub(v, new(big.Int).Lsh(big.NewInt(1), uint(8*len(b))))
+		}
+		return formatDecimal(v, t.scale)
+	}
+	return string(b)
+}
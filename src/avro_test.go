@@ -0,0 +1,285 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"math"
+	"os"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// readAvro opens an Avro container file and reads its header and records
+func readAvro(data []byte) ([][]string, error) {
+	af, err := openAvro(bytes.NewReader(data), expectedColumns)
+	if err != nil {
+		return nil, err
+	}
+	var rows [][]string
+	for {
+		row, err := af.Read()
+		if err == io.EOF {
+			return rows, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		rows = append(rows, row)
+	}
+}
+
+// avroTestSync is the sync marker of test files
+const avroTestSync = "0123456789abcdef"
+
+// avroTestBlock is a data block of a test file, before compression
+type avroTestBlock struct {
+	count int64
+	data  []byte
+}
+
+// avroTestFile writes an Avro container file with the given schema, codec
+// and blocks. An empty codec is left out of the metadata.
+func avroTestFile(schema, codec string, blocks ...avroTestBlock) []byte {
+	file := []byte(avroMagic)
+	meta := [][2]string{{"avro.schema", schema}}
+	if codec != "" {
+		meta = append(meta, [2]string{"avro.codec", codec})
+	}
+	file = binary.AppendVarint(file, int64(len(meta)))
+	for _, entry := range meta {
+		file = append(file, avroTestString(entry[0])...)
+		file = append(file, avroTestString(entry[1])...)
+	}
+	file = append(binary.AppendVarint(file, 0), avroTestSync...)
+
+	for _, block := range blocks {
+		data := block.data
+		switch codec {
+		case "deflate":
+			var buf bytes.Buffer
+			zw, _ := flate.NewWriter(&buf, flate.BestCompression)
+			zw.Write(data)
+			zw.Close()
+			data = buf.Bytes()
+		case "snappy":
+			data = binary.BigEndian.AppendUint32(avroTestSnappy(data), crc32.ChecksumIEEE(data))
+		}
+		file = binary.AppendVarint(file, block.count)
+		file = append(binary.AppendVarint(file, int64(len(data))), data...)
+		file = append(file, avroTestSync...)
+	}
+	return file
+}
+
+// avroTestSnappy encodes data as a Snappy block of literals
+func avroTestSnappy(data []byte) []byte {
+	out := binary.AppendUvarint(nil, uint64(len(data)))
+	for len(data) > 0 {
+		n := min(len(data), 60)
+		out = append(out, byte(n-1)<<2)
+		out = append(out, data[:n]...)
+		data = data[n:]
+	}
+	return out
+}
+
+// avroTestLong and avroTestString encode Avro values
+func avroTestLong(v int64) []byte {
+	return binary.AppendVarint(nil, v)
+}
+
+func avroTestString(s string) []byte {
+	return append(avroTestLong(int64(len(s))), s...)
+}
+
+// avroTestSchema is the schema of the fixture: a record of a field of
+// every kind read, one found by its alias
+const avroTestSchema = `{"type": "record", "name": "Release", "namespace": "com.example", "fields": [
+	{"name": "release_id", "type": "string"},
+	{"name": "title", "aliases": ["track_title"], "type": ["null", "string"]},
+	{"name": "release_date", "type": {"type": "int", "logicalType": "date"}},
+	{"name": "royalty_artist_pct", "type": ["null", {"type": "bytes", "logicalType": "decimal", "precision": 5, "scale": 2}]},
+	{"name": "explicit", "type": "boolean"},
+	{"name": "territories", "type": {"type": "array", "items": "string"}},
+	{"name": "genre", "type": {"type": "enum", "name": "Genre", "symbols": ["POP", "ROCK"]}},
+	{"name": "plays", "type": "long"},
+	{"name": "updated_at", "type": {"type": "long", "logicalType": "timestamp-millis"}},
+	{"name": "rating", "type": "double"},
+	{"name": "isrc", "type": {"type": "fixed", "name": "ISRC", "size": 12}}
+]}`
+
+// avroTestRecords returns the two records of the fixture, encoded
+func avroTestRecords() (first, second []byte) {
+	double := func(v float64) []byte {
+		return binary.LittleEndian.AppendUint64(nil, math.Float64bits(v))
+	}
+	// The territories are written as a block with its size in bytes
+	territories := append(avroTestString("US"), avroTestString("GB")...)
+	first = bytes.Join([][]byte{
+		avroTestString("REL001"),
+		avroTestLong(1), avroTestString("Pájaro ☂"),
+		avroTestLong(19372),
+		avroTestLong(1), avroTestString("\x1b\x58"),
+		{1},
+		avroTestLong(-2), avroTestLong(int64(len(territories))), territories, avroTestLong(0),
+		avroTestLong(0),
+		avroTestLong(1234567890123),
+		avroTestLong(1700000000000),
+		double(4.5),
+		[]byte("USABC1234567"),
+	}, nil)
+	second = bytes.Join([][]byte{
+		avroTestString("REL002"),
+		avroTestLong(0),
+		avroTestLong(-1),
+		avroTestLong(0),
+		{0},
+		avroTestLong(0),
+		avroTestLong(1),
+		avroTestLong(-5),
+		avroTestLong(0),
+		double(-0.25),
+		[]byte("GBXYZ2400001"),
+	}, nil)
+	return first, second
+}
+
+// avroTestRows are the header and records of the fixture
+var avroTestRows = [][]string{
+	{"Release ID", "Track Title", "Release Date", "Royalty Artist %", "Explicit", "Territories", "Genre", "plays", "updated_at", "rating", "ISRC"},
+	{"REL001", "Pájaro ☂", "2023-01-15", "70.00", "true", "US, GB", "POP", "1234567890123", "2023-11-14T22:13:20Z", "4.5", "USABC1234567"},
+	{"REL002", "", "1969-12-31", "", "false", "", "ROCK", "-5", "1970-01-01T00:00:00Z", "-0.25", "GBXYZ2400001"},
+}
+
+func TestAvroFixture(t *testing.T) {
+	data, err := os.ReadFile("testdata/releases.avro")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows, err := readAvro(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(rows, avroTestRows) {
+		t.Errorf("rows = %q, want %q", rows, avroTestRows)
+	}
+}
+
+func TestAvroCodecs(t *testing.T) {
+	first, second := avroTestRecords()
+	for _, codec := range []string{"", "null", "deflate", "snappy"} {
+		// Both records in one block, then each in its own
+		for _, blocks := range [][]avroTestBlock{
+			{{2, append(append([]byte(nil), first...), second...)}},
+			{{1, first}, {0, nil}, {1, second}},
+		} {
+			rows, err := readAvro(avroTestFile(avroTestSchema, codec, blocks...))
+			if err != nil {
+				t.Errorf("codec %q, %d blocks: %v", codec, len(blocks), err)
+				continue
+			}
+			if !reflect.DeepEqual(rows, avroTestRows) {
+				t.Errorf("codec %q, %d blocks: rows = %q, want %q", codec, len(blocks), rows, avroTestRows)
+			}
+		}
+	}
+}
+
+// TestAvroMalformed reads files with invalid schemas, or whose lengths and
+// counts run past their data; they must fail without allocating for what
+// is claimed
+func TestAvroMalformed(t *testing.T) {
+	first, _ := avroTestRecords()
+	record := func(fields string) string {
+		return `{"type": "record", "name": "R", "fields": [` + fields + `]}`
+	}
+	longs := record(`{"name": "plays", "type": "long"}`)
+	nulls := record(`{"name": "items", "type": {"type": "array", "items": "null"}}, {"name": "plays", "type": "long"}`)
+	strs := record(`{"name": "items", "type": {"type": "array", "items": "string"}}`)
+	enum := record(`{"name": "genre", "type": {"type": "enum", "name": "G", "symbols": ["POP"]}}`)
+	union := record(`{"name": "title", "type": ["null", "string"]}`)
+	header := avroTestFile(longs, "")
+	badSync := avroTestFile(longs, "", avroTestBlock{1, avroTestLong(7)})
+	badSync[len(badSync)-1] ^= 1
+	badChecksum := avroTestFile(longs, "snappy", avroTestBlock{1, avroTestLong(7)})
+	badChecksum[len(badChecksum)-len(avroTestSync)-1] ^= 1
+
+	tests := []struct {
+		name string
+		file []byte
+		err  string
+	}{
+		{"not an Avro file", []byte("Obj\x02"), "missing header"},
+		{"no sync marker", header[:len(header)-1], "missing sync marker"},
+		{"codec", avroTestFile(longs, "zstandard"), `unsupported Avro codec "zstandard"`},
+		{"schema not a record", avroTestFile(`"long"`, ""), "the Avro schema must be a record"},
+		{"no fields", avroTestFile(record(""), ""), "schema has no fields"},
+		{"nested record", avroTestFile(record(`{"name": "r", "type": `+longs+`}`), ""), "nested record or map"},
+		{"unknown type", avroTestFile(record(`{"name": "r", "type": "Missing"}`), ""), `unknown type "Missing"`},
+		{"decimal scale", avroTestFile(record(`{"name": "d", "type": {"type": "bytes", "logicalType": "decimal", "scale": 100000}}`), ""), "invalid decimal scale 100000"},
+		{"fixed size", avroTestFile(record(`{"name": "f", "type": {"type": "fixed", "name": "F", "size": 1099511627776}}`), ""), "invalid fixed size"},
+		{"records of nulls", avroTestFile(record(`{"name": "n", "type": "null"}`), ""), "records of the schema hold no data"},
+		{"metadata longer than the file", append([]byte(avroMagic), append(avroTestLong(1), avroTestLong(60<<20)...)...), "unreadable metadata: unexpected EOF"},
+		{"metadata too long", append([]byte(avroMagic), append(avroTestLong(1), avroTestLong(maxAvroBlock+1)...)...), "length 67108865 is out of range"},
+		{"block longer than the file", append(append(append([]byte(nil), header...), avroTestLong(1)...), avroTestLong(60<<20)...), "unreadable block: unexpected EOF"},
+		{"negative record count", avroTestFile(longs, "", avroTestBlock{-1, nil}), "negative record count"},
+		{"more records than bytes", avroTestFile(longs, "", avroTestBlock{1 << 40, avroTestLong(7)}), "block of 1 bytes cannot hold 1099511627776 records"},
+		{"sync marker", badSync, "sync marker mismatch"},
+		{"Snappy checksum", badChecksum, "checksum mismatch"},
+		{"bytes past the records", avroTestFile(longs, "", avroTestBlock{1, append(avroTestLong(7), 0)}), "1 bytes past its records"},
+		{"record past its block", avroTestFile(avroTestSchema, "", avroTestBlock{1, first[:len(first)-1]}), `field "isrc": truncated data`},
+		{"array of nulls", avroTestFile(nulls, "", avroTestBlock{1, append(avroTestLong(1<<40), avroTestLong(0)...)}), `field "items": truncated data`},
+		{"array of strings", avroTestFile(strs, "", avroTestBlock{1, append(avroTestLong(1<<40), avroTestLong(0)...)}), `field "items": truncated data`},
+		{"enum index", avroTestFile(enum, "", avroTestBlock{1, avroTestLong(1)}), "enum index 1 is out of range"},
+		{"union index", avroTestFile(union, "", avroTestBlock{1, avroTestLong(-1)}), "union index -1 is out of range"},
+	}
+	var before, after runtime.MemStats
+	for _, test := range tests {
+		runtime.ReadMemStats(&before)
+		_, err := readAvro(test.file)
+		runtime.ReadMemStats(&after)
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%s: error %v, want one containing %q", test.name, err, test.err)
+		}
+		if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 1<<20 {
+			t.Errorf("%s: allocated %d bytes", test.name, allocated)
+		}
+	}
+}
+
+// TestAvroCorrupt reads every truncation of the fixture and every
+// corruption of each of its bytes: they may fail but not panic, nor
+// allocate far beyond the size of the file
+func TestAvroCorrupt(t *testing.T) {
+	data, err := os.ReadFile("testdata/releases.avro")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A file cut between blocks holds the records before the cut
+	for n := range data {
+		rows, err := readAvro(data[:n])
+		if err == nil && !reflect.DeepEqual(rows, avroTestRows[:len(rows)]) {
+			t.Errorf("file truncated to %d bytes read as %q", n, rows)
+		}
+	}
+
+	var before, after runtime.MemStats
+	corrupt := make([]byte, len(data))
+	for i := range data {
+		for _, flip := range []byte{0x01, 0x80, 0xff} {
+			copy(corrupt, data)
+			corrupt[i] ^= flip
+			runtime.ReadMemStats(&before)
+			readAvro(corrupt)
+			runtime.ReadMemStats(&after)
+			if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 16<<20 {
+				t.Errorf("byte %d ^ %#x: allocated %d bytes", i, flip, allocated)
+			}
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"net/http"
+)
+
+// badgeCharWidth approximates the width of a character in the badge font
+const badgeCharWidth = 7
+
+// badgeTemplate is a flat two-part status badge: label on the left, message
+// on the right
+const badgeTemplate = `<svg xmlns="http://www.w3.org/2000/svg" width="%[1]d" height="20" role="img" aria-label="%[3]s: %[4]s">
+<title>%[3]s: %[4]s</title>
+<linearGradient id="s" x2="0" y2="100%%"><stop offset="0" stop-color="#bbb" stop-opacity=".1"/><stop offset="1" stop-opacity=".1"/></linearGradient>
+<clipPath id="r"><rect width="%[1]d" height="20" rx="3" fill="#fff"/></clipPath>
+<g clip-path="url(#r)"><rect width="%[2]d" height="20" fill="#555"/><rect x="%[2]d" width="%[6]d" height="20" fill="%[5]s"/><rect width="%[1]d" height="20" fill="url(#s)"/></g>
+<g fill="#fff" text-anchor="middle" font-family="Verdana,Geneva,DejaVu Sans,sans-serif" font-size="11">
+<text x="%[7]d" y="14">%[3]s</text>
+<text x="%[8]d" y="14">%[4]s</text>
+</g>
+</svg>
+`
+
+// badgeHandler renders an SVG status badge for a job from its stored
+// summary, for embedding in wikis and portals, e.g.
+// GET /jobs/{id}/badge.svg?label=catalogue
+func badgeHandler(w http.ResponseWriter, r *http.Request) {
+	job, err := jobStore.GetJob(r.PathValue("id"))
+	if err != nil {
+		writeStoreError(w, "Failed to get job: ", err)
+		return
+	}
+
+	label := r.URL.Query().Get("label")
+	if label == "" {
+		label = "validation"
+	}
+	message, color := badgeStatus(job)
+	serveDownload(w, r, "", "image/svg+xml", renderBadge(label, message, color))
+}
+
+// badgeStatus returns the badge message and colour for a job
+func badgeStatus(job *Job) (message, color string) {
+	switch {
+	case job.Active():
+		return job.Status, "#9f9f9f"
+	case job.Status == JobFailed:
+		return "failed", "#e05d44"
+	case job.FailedRows == 0:
+		return fmt.Sprintf("%d passed", job.ProcessedRows), "#4c1"
+	case job.FailedRows == job.ProcessedRows:
+		return fmt.Sprintf("%d failed", job.FailedRows), "#e05d44"
+	}
+	return fmt.Sprintf("%d passed, %d failed", job.ProcessedRows-job.FailedRows, job.FailedRows), "#fe7d37"
+}
+
+// renderBadge draws a badge, sizing each part to its text
+func renderBadge(label, message, color string) []byte {
+	labelWidth := len([]rune(label))*badgeCharWidth + 10
+	messageWidth := len([]rune(message))*badgeCharWidth + 10
+	return []byte(fmt.Sprintf(badgeTemplate,
+		labelWidth+messageWidth, labelWidth,
+		html.EscapeString(label), html.EscapeString(message), color, messageWidth,
+		labelWidth/2, labelWidth+messageWidth/2))
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"path/filepath"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxBatchFiles limits the number of files processed from one archive or
+// one multi-file upload
+const maxBatchFiles = 100
+
+// BatchResult is the response to a zip archive or a multi-file upload: one
+// section per file, keyed by its path in the archive or its file name, and
+// a summary of them all
+type BatchResult struct {
+	JobID    string                `json:"job_id"`
+	Files    map[string]*BatchFile `json:"files"`
+	Summary  BatchSummary          `json:"summary"`
+	Warnings []string              `json:"warnings,omitempty"`
+}
+
+// BatchFile is the outcome of one file of a batch, processed as its own
+// job. Error is set instead of the result if the file failed.
+type BatchFile struct {
+	JobID string `json:"job_id"`
+	Error string `json:"error,omitempty"`
+	*OutputFormat
+}
+
+// BatchSummary sums up the files of a batch
+type BatchSummary struct {
+	Files       int            `json:"files"`
+	FailedFiles int            `json:"failed_files"`
+	Rows        int            `json:"rows"`
+	FailedRows  int            `json:"failed_rows"`
+	Failures    map[string]int `json:"failures,omitempty"`
+}
+
+// isBatchExtension reports whether files with the extension can be
+// processed as part of a batch
+func isBatchExtension(extension string) bool {
+	return isNDJSONExtension(extension) || extension == ".csv" || extension == ".tsv" || extension == ".txt"
+}
+
+// processBatch processes each named file as a job of its own, recorded with
+// the batch's job as parent, and writes the per-file results. Up to
+// BATCH_CONCURRENCY files are processed at once; each child job reports its
+// own status as it runs. The batch's job sums up its files. The response
+// fails with the status of the error of the first file in the batch only if
+// no file could be processed.
+func processBatch(ctx context.Context, w http.ResponseWriter, job *Job, names []string, workersWarning string,
+	process func(ctx context.Context, child *Job, i int) (*OutputFormat, error)) {
+	response := BatchResult{JobID: job.ID, Files: make(map[string]*BatchFile, len(names))}
+	if workersWarning != "" {
+		response.Warnings = append(response.Warnings, workersWarning)
+	}
+
+	job.Failures = make(map[string]int)
+	var (
+		mu       sync.Mutex
+		wg       sync.WaitGroup
+		firstErr error
+		errIndex = len(names)
+	)
+	slots := make(chan struct{}, cfg.BatchConcurrency)
+	for i, name := range names {
+		startedAt := time.Now()
+		child := &Job{
+			ID:        newJobID(),
+			Tenant:    job.Tenant,
+			ParentID:  job.ID,
+			Filename:  name,
+			Status:    JobQueued,
+			Workers:   job.Workers,
+			Instance:  instanceName,
+			CreatedAt: startedAt,
+		}
+		saveJob(child)
+
+		slots <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-slots }()
+			result, err := processBatchFile(ctx, child, i, process)
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				if i < errIndex {
+					firstErr, errIndex = err, i
+				}
+				response.Files[name] = &BatchFile{JobID: child.ID, Error: err.Error()}
+				response.Summary.FailedFiles++
+				return
+			}
+			response.Files[name] = &BatchFile{JobID: child.ID, OutputFormat: result}
+
+			job.ProcessedRows += child.ProcessedRows
+			job.FailedRows += child.FailedRows
+			for check, count := range child.Failures {
+				job.Failures[check] += count
+			}
+		}()
+	}
+	wg.Wait()
+	response.Summary.Files = len(names)
+	response.Summary.Rows = job.ProcessedRows
+	response.Summary.FailedRows = job.FailedRows
+	if len(job.Failures) > 0 {
+		response.Summary.Failures = job.Failures
+	}
+
+	status := http.StatusOK
+	if firstErr != nil && response.Summary.FailedFiles == len(names) {
+		status = errorStatus(firstErr)
+		finishJob(job, fmt.Errorf("no file of the batch could be processed: %w", firstErr))
+	} else {
+		finishJob(job, nil)
+	}
+	writeJSONStatus(w, status, response)
+}
+
+// processBatchFile runs one file of a batch as its child job and records
+// the outcome. A panic fails the file rather than the server.
+func processBatchFile(ctx context.Context, child *Job, i int, process func(ctx context.Context, child *Job, i int) (*OutputFormat, error)) (result *OutputFormat, err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			log.Printf("File %s of batch %s panicked: %v\n%s", child.Filename, child.ParentID, p, debug.Stack())
+			result, err = nil, fmt.Errorf("processing panicked: %v", p)
+		}
+		finishJob(child, err)
+	}()
+	startedAt := time.Now()
+	child.Status = JobRunning
+	child.StartedAt = &startedAt
+	saveJob(child)
+	return process(ctx, child, i)
+}
+
+// processBatchInput checks and processes the content of a single file of a
+// batch as the given job
+func processBatchInput(ctx context.Context, job *Job, extension string, r io.Reader, opts ProcessOptions, requestedWorkers int) (*OutputFormat, error) {
+	// Check the content, as for a file uploaded on its own
+	input := bufio.NewReaderSize(r, sniffLen)
+	sample, err := input.Peek(sniffLen)
+	if err != nil && err != io.EOF && !errors.Is(err, bufio.ErrBufferFull) {
+		return nil, fileErrorf(http.StatusUnprocessableEntity, "failed to read file: %v", err)
+	}
+	if err := checkTextSample(sample); err != nil {
+		return nil, err
+	}
+
+	var rows io.Reader = input
+	switch {
+	case isNDJSONExtension(extension):
+		ndjson := streamNDJSON(input)
+		defer ndjson.Close()
+		rows = ndjson
+		opts.Delimiter = ','
+		opts.Converted = true
+	case opts.Delimiter == 0 && extension == ".tsv":
+		opts.Delimiter = '\t'
+	}
+	opts.Progress = func(rows int) {
+		job.ProcessedRows = rows
+		saveJob(job)
+	}
+	opts.Concurrent = true
+	return runJob(ctx, job, rows, opts, requestedWorkers, "")
+}
+
+// processUploadBatch processes several files sent together in the csvFile
+// field, each as a job of its own, as the files of an archive are
+func processUploadBatch(w http.ResponseWriter, r *http.Request, headers []*multipart.FileHeader) {
+	if len(headers) > maxBatchFiles {
+		http.Error(w, fmt.Sprintf("%d files were uploaded, at most %d are accepted", len(headers), maxBatchFiles), http.StatusUnprocessableEntity)
+		return
+	}
+	numWorkers, requestedWorkers, workersWarning, err := parseWorkers(r.FormValue("workers"))
+	if err != nil {
+		http.Error(w, "Invalid workers value: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	delimiter, err := parseDelimiter(r.FormValue("delimiter"))
+	if err != nil {
+		http.Error(w, "Invalid delimiter: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	profiles, err := parseProfiles(r.FormValue("profiles"))
+	if err != nil {
+		writeError(w, "Invalid profiles: ", err)
+		return
+	}
+	checks, err := uploadChecks(r)
+	if err != nil {
+		writeError(w, "Invalid checks: ", err)
+		return
+	}
+	validators, err := parseValidators(r.FormValue("validators"))
+	if err != nil {
+		writeError(w, "Invalid validators: ", err)
+		return
+	}
+	normalization, err := parseNormalization(r)
+	if err != nil {
+		writeError(w, "Invalid normalize: ", err)
+		return
+	}
+	computed, err := uploadComputed(r)
+	if err != nil {
+		writeError(w, "Invalid computed: ", err)
+		return
+	}
+	dedupe, err := parseDedupe(r)
+	if err != nil {
+		writeError(w, "Invalid dedupe: ", err)
+		return
+	}
+
+	// Files sharing a name are told apart by a counter
+	names := make([]string, len(headers))
+	seen := make(map[string]int, len(headers))
+	for i, header := range headers {
+		names[i] = header.Filename
+		if seen[header.Filename]++; seen[header.Filename] > 1 {
+			names[i] = fmt.Sprintf("%s (%d)", header.Filename, seen[header.Filename])
+		}
+	}
+
+	job, profile, release, ok := startUploadJob(w, r, fmt.Sprintf("%s and %d more", headers[0].Filename, len(headers)-1), numWorkers)
+	if !ok {
+		return
+	}
+	defer release()
+
+	opts := ProcessOptions{
+		Workers:            numWorkers,
+		ScanPII:            formBool(r, "scan_pii"),
+		RepairNumerics:     formBool(r, "repair_numerics"),
+		Normalization:      normalization,
+		NormalizeRoyalties: formBool(r, "normalize_royalties"),
+		SingleReleaseType:  formBool(r, "single_release_type"),
+		StrictHeader:       formBool(r, "strict_header"),
+		Profile:            profile,
+		Profiles:           profiles,
+		Checks:             checks,
+		Validators:         validators,
+		Computed:           computed,
+		Dedupe:             dedupe,
+		MaxHeaderSkip:      cfg.MaxHeaderSkip,
+		Delimiter:          delimiter,
+	}
+	processBatch(r.Context(), w, job, names, workersWarning, func(ctx context.Context, child *Job, i int) (*OutputFormat, error) {
+		return processUploadedFile(ctx, child, headers[i], opts, requestedWorkers)
+	})
+}
+
+// processUploadedFile checks and processes one file of a multi-file upload:
+// delimited text or JSON Lines, optionally gzip-compressed
+func processUploadedFile(ctx context.Context, job *Job, header *multipart.FileHeader, opts ProcessOptions, requestedWorkers int) (*OutputFormat, error) {
+	file, err := header.Open()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open upload: %v", err)
+	}
+	defer file.Close()
+
+	name := strings.ToLower(header.Filename)
+	gzipped, err := isGzip(file)
+	if err != nil {
+		return nil, err
+	}
+	if strings.HasSuffix(name, ".gz") {
+		gzipped = true
+		name = strings.TrimSuffix(name, ".gz")
+	}
+	extension := filepath.Ext(name)
+	if !isBatchExtension(extension) {
+		return nil, fileErrorf(http.StatusUnsupportedMediaType, "only CSV, TSV and JSON Lines files can be uploaded together, optionally gzip-compressed")
+	}
+	if gzipped {
+		if err := checkGzipContent(file); err != nil {
+			return nil, err
+		}
+	}
+	if err := scanUpload(file, header.Filename); err != nil {
+		return nil, fmt.Errorf("upload rejected: %w", err)
+	}
+	referenceUpload(job, keepUpload(file))
+
+	var input io.Reader = file
+	if gzipped {
+		zr, err := newGzipReader(file)
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+		input = zr
+	}
+	return processBatchInput(ctx, job, extension, input, opts, requestedWorkers)
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Callout failure policies
+const (
+	CalloutFail = "fail" // fail the job when a batch cannot be transformed
+	CalloutSkip = "skip" // keep the batch's rows unchanged and add a warning
+)
+
+// CalloutBatch is posted to the transformation service for each batch of
+// validated rows
+type CalloutBatch struct {
+	JobID      string              `json:"job_id"`
+	Tenant     string              `json:"tenant"`
+	Batch      int                 `json:"batch"`
+	Columns    []string            `json:"columns"`
+	Rows       []map[string]string `json:"rows"`
+	Validation []RowValidation     `json:"validation"`
+}
+
+// CalloutReply is the transformation service's response. Its rows replace
+// the rows of the batch; they may add, drop or rewrite rows and columns.
+type CalloutReply struct {
+	Rows []map[string]string `json:"rows"`
+}
+
+// calloutClient is shared by all callouts; requests are bounded by the
+// context deadline set per attempt
+var calloutClient = &http.Client{}
+
+// runCallout sends the result's rows in batches to the configured
+// transformation service and replaces them with the returned rows. Batches
+// are sent concurrently but reassembled in their original order. It does
+// nothing when no callout is configured.
+func runCallout(ctx context.Context, result *OutputFormat, tenant string) error {
+	if cfg.CalloutURL == "" || len(result.Conversion.Rows) == 0 {
+		return nil
+	}
+
+	rows := result.Conversion.Rows
+	var batches [][]map[string]string
+	for start := 0; start < len(rows); start += cfg.CalloutBatchSize {
+		batches = append(batches, rows[start:min(start+cfg.CalloutBatchSize, len(rows))])
+	}
+
+	replies := make([][]map[string]string, len(batches))
+	errs := make([]error, len(batches))
+	slots := make(chan struct{}, cfg.CalloutConcurrency)
+	var wg sync.WaitGroup
+	for i, batch := range batches {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			slots <- struct{}{}
+			defer func() { <-slots }()
+
+			request := CalloutBatch{
+				JobID:      result.Metadata.JobID,
+				Tenant:     tenant,
+				Batch:      i,
+				Columns:    result.Conversion.Columns,
+				Rows:       batch,
+				Validation: make([]RowValidation, len(batch)),
+			}
+			for j, row := range batch {
+				request.Validation[j] = result.Validation[row["Track ID"]]
+			}
+			replies[i], errs[i] = postCalloutBatch(ctx, &request)
+		}()
+	}
+	wg.Wait()
+
+	var transformed []map[string]string
+	for i, batch := range batches {
+		if errs[i] != nil {
+			if cfg.CalloutFailurePolicy != CalloutSkip {
+				return fileErrorf(http.StatusBadGateway, "transformation callout failed for batch %d: %v", i, errs[i])
+			}
+			log.Printf("Callout batch %d of job %s failed, keeping its rows: %v", i, result.Metadata.JobID, errs[i])
+			result.Warnings = append(result.Warnings, fmt.Sprintf("Transformation callout failed for batch %d (rows %d-%d); its rows were kept unchanged: %v",
+				i, i*cfg.CalloutBatchSize+1, i*cfg.CalloutBatchSize+len(batch), errs[i]))
+			transformed = append(transformed, batch...)
+			continue
+		}
+		transformed = append(transformed, replies[i]...)
+	}
+
+	// Columns introduced by the service follow the existing ones, sorted
+	// within the row they first appear in
+	known := make(map[string]bool, len(result.Conversion.Columns))
+	columns := append([]string(nil), result.Conversion.Columns...)
+	for _, column := range columns {
+		known[column] = true
+	}
+	for _, row := range transformed {
+		var added []string
+		for column := range row {
+			if !known[column] {
+				known[column] = true
+				added = append(added, column)
+			}
+		}
+		sort.Strings(added)
+		columns = append(columns, added...)
+	}
+
+	result.Conversion = Conversion{Columns: columns, Rows: transformed}
+	result.Metadata.Columns = columns
+	return nil
+}
+
+// postCalloutBatch posts a batch, retrying failed attempts with a growing
+// delay, and returns the transformed rows
+func postCalloutBatch(ctx context.Context, batch *CalloutBatch) ([]map[string]string, error) {
+	payload, err := json.Marshal(batch)
+	if err != nil {
+		return nil, err
+	}
+
+	for attempt := 0; ; attempt++ {
+		var rows []map[string]string
+		rows, err = postCallout(ctx, payload)
+		if err == nil || attempt >= cfg.CalloutRetries || ctx.Err() != nil {
+			return rows, err
+		}
+		select {
+		case <-time.After(time.Duration(attempt+1) * time.Second):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// postCallout makes a single callout request
+func postCallout(ctx context.Context, payload []byte) ([]map[string]string, error) {
+	ctx, cancel := context.WithTimeout(ctx, cfg.CalloutTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, cfg.CalloutURL, bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := calloutClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<20))
+		return nil, fmt.Errorf("service returned %s", resp.Status)
+	}
+
+	var reply CalloutReply
+	if err := json.NewDecoder(resp.Body).Decode(&reply); err != nil {
+		return nil, fmt.Errorf("invalid reply: %v", err)
+	}
+	if reply.Rows == nil {
+		return nil, fmt.Errorf("invalid reply: missing rows")
+	}
+	return reply.Rows, nil
+}
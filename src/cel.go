@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/common/types"
+	"github.com/google/cel-go/common/types/ref"
+	"github.com/google/cel-go/ext"
+)
+
+// celRowVariable is the variable holding the row in CEL expressions, a
+// map of column names to values
+const celRowVariable = "row"
+
+// celCostLimit bounds the work of evaluating an expression against one row,
+// in cel-go's cost units, so comprehensions over long values cannot stall
+// a worker
+const celCostLimit = 1_000_000
+
+// celProgram is a Common Expression Language expression evaluated against
+// rows, e.g.
+//
+//	double(row["Royalty Artist %"]) + double(row["Royalty Label %"]) <= 100.0
+//
+// Expressions are compiled by cel-go with the standard definitions, the
+// string extensions (lowerAscii, upperAscii, trim, split, replace, ...)
+// and number(), which reads a string as checks read numbers: surrounding
+// spaces and a trailing % are ignored. Numbers of different types compare
+// by value.
+type celProgram struct {
+	program cel.Program
+
+	// globals are the variables besides row the expression references
+	globals map[string]bool
+}
+
+// celVar is the value of a global variable of an expression
+type celVar struct {
+	name  string
+	value any
+}
+
+// compileCEL parses and type-checks a CEL expression. globals are the
+// variables it may reference besides row, of any type.
+func compileCEL(expr string, globals ...string) (*celProgram, error) {
+	options := []cel.EnvOption{
+		cel.Variable(celRowVariable, cel.MapType(cel.StringType, cel.StringType)),
+		cel.CrossTypeNumericComparisons(true),
+		ext.Strings(),
+		cel.Function("number", cel.Overload("number_string", []*cel.Type{cel.StringType}, cel.DoubleType,
+			cel.UnaryBinding(celNumber))),
+	}
+	for _, name := range globals {
+		options = append(options, cel.Variable(name, cel.DynType))
+	}
+	env, err := cel.NewEnv(options...)
+	if err != nil {
+		return nil, err
+	}
+	ast, issues := env.Compile(expr)
+	if issues.Err() != nil {
+		return nil, issues.Err()
+	}
+	program, err := env.Program(ast, cel.EvalOptions(cel.OptOptimize), cel.CostLimit(celCostLimit))
+	if err != nil {
+		return nil, err
+	}
+	c := &celProgram{program: program, globals: make(map[string]bool)}
+	for _, reference := range ast.NativeRep().ReferenceMap() {
+		if slices.Contains(globals, reference.Name) {
+			c.globals[reference.Name] = true
+		}
+	}
+	return c, nil
+}
+
+// uses reports whether the expression references the global variable
+func (c *celProgram) uses(name string) bool {
+	return c.globals[name]
+}
+
+// celNumber is number(): a string read as a double, with surrounding
+// spaces and a trailing % ignored
+func celNumber(value ref.Val) ref.Val {
+	s := string(value.(types.String))
+	n, err := parsePercentage(s)
+	if err != nil {
+		return types.NewErr("%q is not a number", s)
+	}
+	return types.Double(n)
+}
+
+// eval evaluates the expression against a row. Expressions that do not
+// return a bool fail.
+func (c *celProgram) eval(row map[string]string) (bool, error) {
+	value, err := c.evalValue(row)
+	if err != nil {
+		return false, err
+	}
+	b, ok := value.(bool)
+	if !ok {
+		return false, fmt.Errorf("expression returned %s, not bool", celTypeName(value))
+	}
+	return b, nil
+}
+
+// evalValue evaluates the expression against a row and the values of its
+// globals. Bools, numbers and strings are returned as bool, int64, uint64,
+// float64 and string, null as nil and other values as they are.
+func (c *celProgram) evalValue(row map[string]string, globals ...celVar) (any, error) {
+	vars := make(map[string]any, len(globals)+1)
+	vars[celRowVariable] = row
+	for _, global := range globals {
+		vars[global.name] = global.value
+	}
+	out, _, err := c.program.Eval(vars)
+	if err != nil {
+		return nil, err
+	}
+	switch v := out.(type) {
+	case types.Bool:
+		return bool(v), nil
+	case types.Int:
+		return int64(v), nil
+	case types.Uint:
+		return uint64(v), nil
+	case types.Double:
+		return float64(v), nil
+	case types.String:
+		return string(v), nil
+	case types.Null:
+		return nil, nil
+	}
+	return out, nil
+}
+
+// celTypeName returns the CEL name of the type of a value returned by
+// evalValue
+func celTypeName(v any) string {
+	switch v := v.(type) {
+	case bool:
+		return "bool"
+	case int64:
+		return "int"
+	case uint64:
+		return "uint"
+	case float64:
+		return "double"
+	case string:
+		return "string"
+	case nil:
+		return "null_type"
+	case ref.Val:
+		return v.Type().TypeName()
+	}
+	return fmt.Sprintf("%T", v)
+}
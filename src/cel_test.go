@@ -0,0 +1,145 @@
+package main
+
+import (
+	"maps"
+	"strings"
+	"testing"
+)
+
+func TestCELEval(t *testing.T) {
+	row := map[string]string{
+		"Genre":            "Pop",
+		"Release Date":     "2024-08-01",
+		"Royalty Artist %": "70",
+		"Royalty Label %":  " 30% ",
+		"Territories":      "US, GB",
+	}
+	tests := []struct {
+		expr string
+		want bool
+		err  string
+	}{
+		{expr: `row.Genre == "Pop"`, want: true},
+		{expr: `row["Release Date"].startsWith("2024")`, want: true},
+		{expr: `row.Genre.lowerAscii() in ["pop", "rock"]`, want: true},
+		{expr: `row.Territories.split(", ").all(t, size(t) == 2)`, want: true},
+		{expr: `row["Release Date"].matches("^\\d{4}-\\d{2}-\\d{2}$")`, want: true},
+		{expr: `double(row["Royalty Artist %"]) + number(row["Royalty Label %"]) == 100.0`, want: true},
+		{expr: `int(row["Royalty Artist %"]) > 69.5`, want: true},
+		{expr: `has(row.Language)`, want: false},
+		{expr: `"Genre" in row`, want: true},
+		{expr: `has(row.Language) && row.Language == "English"`, want: false},
+		// Errors are absorbed when the other side decides the outcome
+		{expr: `row.Language == "English" || row.Genre == "Pop"`, want: true},
+		{expr: `row.Language == "English"`, err: "no such key"},
+		{expr: `double(row["Royalty Label %"]) > 0.0`, err: "double"},
+		{expr: `number(row.Genre) > 0.0`, err: `"Pop" is not a number`},
+		{expr: `row.Genre`, err: "returned string, not bool"},
+	}
+	for _, test := range tests {
+		program, err := compileCEL(test.expr)
+		if err != nil {
+			t.Errorf("compileCEL(%s): %v", test.expr, err)
+			continue
+		}
+		got, err := program.eval(row)
+		switch {
+		case test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)):
+			t.Errorf("%s: error %v, want one containing %q", test.expr, err, test.err)
+		case test.err == "" && err != nil:
+			t.Errorf("%s: %v", test.expr, err)
+		case got != test.want:
+			t.Errorf("%s = %v, want %v", test.expr, got, test.want)
+		}
+	}
+}
+
+func TestCELCompileErrors(t *testing.T) {
+	for _, expr := range []string{
+		`row.Genre ==`,
+		`release.tracks > 1`,
+		`double(row["Royalty Artist %"]) + 1`,
+		`size(row.Genre) + "x"`,
+		`unknown(row.Genre)`,
+		strings.Repeat("(", 300) + "true" + strings.Repeat(")", 300),
+	} {
+		if _, err := compileCEL(expr); err == nil {
+			t.Errorf("compileCEL(%.40s) succeeded, want an error", expr)
+		}
+	}
+}
+
+func TestCELEvalValue(t *testing.T) {
+	row := map[string]string{"Release ID": "REL001", "Royalty Artist %": "70"}
+	release := map[string]any{"id": "REL001", "tracks": int64(3)}
+	tests := []struct {
+		expr string
+		want any
+	}{
+		{`release.tracks`, int64(3)},
+		{`release.id + "-" + row["Release ID"]`, "REL001-REL001"},
+		{`double(row["Royalty Artist %"]) / 2.0`, 35.0},
+		{`uint(release.tracks)`, uint64(3)},
+		{`release.tracks > 2`, true},
+		{`null`, nil},
+	}
+	for _, test := range tests {
+		program, err := compileCEL(test.expr, celReleaseVariable)
+		if err != nil {
+			t.Errorf("compileCEL(%s): %v", test.expr, err)
+			continue
+		}
+		got, err := program.evalValue(row, celVar{name: celReleaseVariable, value: release})
+		if err != nil {
+			t.Errorf("%s: %v", test.expr, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("%s = %#v, want %#v", test.expr, got, test.want)
+		}
+	}
+
+	program, err := compileCEL(`[1, 2]`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	value, err := program.evalValue(row)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name := celTypeName(value); name != "list" {
+		t.Errorf("celTypeName of a list = %s", name)
+	}
+}
+
+func TestCELCostLimit(t *testing.T) {
+	row := map[string]string{"Track Title": strings.Repeat("a", 2000)}
+	program, err := compileCEL(`row["Track Title"].split("").all(a, row["Track Title"].split("").all(b, a == b))`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := program.eval(row); err == nil || !strings.Contains(err.Error(), "cost limit") {
+		t.Errorf("eval = %v, want the cost limit exceeded", err)
+	}
+}
+
+func TestComputeRow(t *testing.T) {
+	columns, err := compileComputed([]ComputedColumn{
+		{Name: "year", Expr: `row["Release Date"].split("-")[0]`},
+		{Name: "decade", Expr: `row.year.substring(0, 3) + "0s"`},
+		{Name: "tracks", Expr: `release.tracks`},
+		{Name: "label", Expr: `row["Label Name"].upperAscii()`},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	row := map[string]string{"Release Date": "2024-08-01", "Label Name": "Moonlit Records"}
+	got := computeRow(row, columns)
+	want := map[string]string{"Release Date": "2024-08-01", "Label Name": "Moonlit Records", "year": "2024", "decade": "2020s"}
+	if !maps.Equal(got, want) {
+		t.Errorf("computeRow = %v, want %v", got, want)
+	}
+	if len(row) != 2 {
+		t.Errorf("computeRow modified the row: %v", row)
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+)
+
+// Cell is the outcome of a check on one cell of the conversion, so
+// spreadsheet-style front-ends can highlight the cells at fault
+type Cell struct {
+	// Row is the position of the row in the conversion, counting from 1
+	Row      int    `json:"row"`
+	Column   string `json:"column"`
+	Check    string `json:"check"`
+	Passed   bool   `json:"passed"`
+	Severity string `json:"severity,omitempty"`
+	Message  string `json:"message,omitempty"`
+}
+
+// Options of the cells parameter: every cell checked, or only those that
+// failed a check
+const (
+	cellsAll    = "all"
+	cellsFailed = "failed"
+)
+
+// parseCells reads the cells option of a request
+func parseCells(r *http.Request) (string, error) {
+	switch value := r.FormValue("cells"); value {
+	case "", "false":
+		return "", nil
+	case "true", cellsAll:
+		return cellsAll, nil
+	case cellsFailed:
+		return cellsFailed, nil
+	default:
+		return "", fileErrorf(http.StatusBadRequest, "unsupported cells %q, expected all or failed", value)
+	}
+}
+
+// cellChecks maps the checks run on every row of a result to the columns
+// of the result they concern. Checks of the job's check set are included
+// for the rows they ran on.
+func cellChecks(result *OutputFormat) map[string][]string {
+	present := make(map[string]bool, len(result.Conversion.Columns))
+	for _, column := range result.Conversion.Columns {
+		present[column] = true
+	}
+	checks := make(map[string][]string)
+	add := func(check string, columns ...string) {
+		for _, column := range columns {
+			if present[column] && !slices.Contains(checks[check], column) {
+				checks[check] = append(checks[check], column)
+			}
+		}
+	}
+
+	add("territories", "Territories")
+	add("upc", "UPC")
+	add("required_fields", cfg.RequiredColumns...)
+	add("release_date", releaseDateColumn)
+	add("isrc", isrcColumn)
+	add("release_type", releaseTypeColumn)
+	add("duplicate_track", "Track ID")
+	add("duplicate_isrc", isrcColumn)
+	add("release_consistency", releaseFields...)
+	if genres != nil {
+		add("genre", genreColumn)
+	}
+	if labels != nil {
+		add("label", labelColumn)
+	}
+	if rightsHolders != nil {
+		add("rights_holder", rightsHolderColumn)
+	}
+	header := make(map[string]string, len(result.Conversion.Columns))
+	for _, column := range result.Conversion.Columns {
+		header[column] = ""
+	}
+	for _, column := range payeeColumns(header) {
+		add("payee_ids", column.name)
+	}
+
+	for _, check := range resultCheckDefinitions(result) {
+		if check.Column != "" {
+			add(check.Name, check.Column)
+		}
+		add(check.Name, check.Columns...)
+	}
+	return checks
+}
+
+// resultCheckDefinitions returns the check set a result was processed
+// with: the one sent with its upload, its profile's or the default one. A
+// profile removed since has no checks.
+func resultCheckDefinitions(result *OutputFormat) []CheckDefinition {
+	if len(result.Metadata.Checks) > 0 {
+		return result.Metadata.Checks
+	}
+	var profile *Profile
+	if result.Metadata.Profile != "" {
+		var err error
+		if profile, err = loadProfile(result.Metadata.Profile); err != nil {
+			return nil
+		}
+	}
+	return profile.checkSet().Checks
+}
+
+// rowCells returns the cells of a row checked, the row counting from 1 in
+// the conversion. A failed check flags the columns its issues name, or
+// every column it concerns if they name none; its other columns are not
+// listed. With failedOnly, cells that passed are left out.
+func rowCells(row int, v RowValidation, checks map[string][]string, failedOnly bool) []Cell {
+	var cells []Cell
+	failed := make(map[string]bool)
+	for _, issue := range v.Issues {
+		failed[issue.Check] = true
+		columns := checks[issue.Check]
+		if issue.Column != "" {
+			columns = []string{issue.Column}
+		}
+		for _, column := range columns {
+			cells = append(cells, Cell{Row: row, Column: column, Check: issue.Check, Severity: issue.Severity, Message: issue.Message})
+		}
+	}
+	if failedOnly {
+		return cells
+	}
+
+	for _, check := range v.FailedChecks() {
+		failed[check] = true
+	}
+	for _, check := range sortedKeys(checks) {
+		if failed[check] {
+			continue
+		}
+		// Checks of the check set ran on the row if it has their outcome
+		if _, ran := v.Checks[check]; !ran && isSetCheck(check) {
+			continue
+		}
+		for _, column := range checks[check] {
+			cells = append(cells, Cell{Row: row, Column: column, Check: check, Passed: true})
+		}
+	}
+	return cells
+}
+
+// isSetCheck reports whether a check comes from a check set, rather than
+// being built in. Outcomes of royalties_sum and date_format are recorded
+// outside the row's checks, so they always ran.
+func isSetCheck(check string) bool {
+	if check == royaltiesSumCheck || check == dateFormatCheck {
+		return false
+	}
+	return !slices.Contains(reservedCheckNames, check)
+}
+
+// resultCells returns the cells of every row of a result checked, in row
+// order
+func resultCells(result *OutputFormat, mode string) []Cell {
+	checks := cellChecks(result)
+	var cells []Cell
+	for i, row := range result.Conversion.Rows {
+		if v, ok := result.Validation[row["Track ID"]]; ok {
+			cells = append(cells, rowCells(i+1, v, checks, mode == cellsFailed)...)
+		}
+	}
+	return cells
+}
@@ -0,0 +1,509 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"math/big"
+	"net/http"
+	"os"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// maxChecksSize bounds a checks document sent with an upload
+const maxChecksSize = 1 << 20
+
+// Check types
+const (
+	checkRequired = "required"
+	checkRegex    = "regex"
+	checkRange    = "range"
+	checkEnum     = "enum"
+	checkSum      = "sum"
+	checkCEL      = "cel"
+	checkUnique   = "unique"
+)
+
+// Checks whose outcome is reported in RowValidation fields of their own
+const (
+	royaltiesSumCheck = "royalties_sum"
+	dateFormatCheck   = "date_format"
+)
+
+// royaltyRangeCheck is the built-in check that each royalty share is a
+// percentage, which the sum alone does not catch: 150, -50, 0 and 0 add
+// up to 100
+const royaltyRangeCheck = "royalty_range"
+
+// patternCheckPrefix starts the names of the checks of column patterns
+// sent with an upload
+const patternCheckPrefix = "pattern:"
+
+// CheckDefinition is a check of the values of a row, as written in a checks
+// file:
+//
+//	required  Column is not empty
+//	regex     Column matches Pattern
+//	range     Column, or each of Columns, is a number from Min to Max
+//	enum      Column is one of Values, optionally ignoring case
+//	sum       the numbers in Columns add up to Equals, within Tolerance
+//	cel       the CEL expression Expr is true for the row
+//	unique    no other row has the same values in Columns, optionally
+//	          ignoring case; checked across rows by checkCrossRow
+//
+// Optional checks pass empty values of Column, or of each of Columns.
+// Numbers may end in %; values that are not numbers count as 0 in sums and
+// fail ranges. Checks with a When condition pass the rows it does not
+// hold for. Failing a check of warning severity does not fail the row.
+type CheckDefinition struct {
+	Name       string   `json:"name"`
+	Type       string   `json:"type"`
+	Column     string   `json:"column,omitempty"`
+	Columns    []string `json:"columns,omitempty"`
+	Pattern    string   `json:"pattern,omitempty"`
+	Min        *float64 `json:"min,omitempty"`
+	Max        *float64 `json:"max,omitempty"`
+	Values     []string `json:"values,omitempty"`
+	IgnoreCase bool     `json:"ignore_case,omitempty"`
+	Equals     float64  `json:"equals,omitempty"`
+	Tolerance  float64  `json:"tolerance,omitempty"`
+	Expr       string   `json:"expr,omitempty"`
+	Optional   bool     `json:"optional,omitempty"`
+	Severity   string   `json:"severity,omitempty"`
+
+	When *CheckCondition `json:"when,omitempty"`
+}
+
+// CheckCondition restricts a check to the rows whose Column is one of
+// Values, optionally ignoring case, or matches Pattern; with neither, to
+// the rows where Column is not empty
+type CheckCondition struct {
+	Column     string   `json:"column"`
+	Values     []string `json:"values,omitempty"`
+	Pattern    string   `json:"pattern,omitempty"`
+	IgnoreCase bool     `json:"ignore_case,omitempty"`
+}
+
+// compiledCondition is a check condition ready to evaluate
+type compiledCondition struct {
+	CheckCondition
+	pattern *regexp.Regexp
+	values  map[string]bool
+}
+
+// CheckSet is the checks every row is validated with, loaded from a checks
+// file. The built-in set checks the royalty sum and the release date.
+type CheckSet struct {
+	Checks []CheckDefinition `json:"checks"`
+
+	compiled []compiledCheck
+}
+
+// compiledCheck is a check ready to run
+type compiledCheck struct {
+	CheckDefinition
+	pattern *regexp.Regexp
+	values  map[string]bool
+	program *celProgram
+	when    *compiledCondition
+
+	// equals and tolerance of a sum check as exact decimals
+	equals, tolerance *big.Rat
+}
+
+// royaltyShareRange bounds each royalty share
+var royaltyShareRange = [2]float64{0, 100}
+
+// builtinChecks are the checks rows are validated with unless CHECKS_FILE
+// or the upload gives others
+var builtinChecks = CheckSet{Checks: []CheckDefinition{
+	{Name: royaltiesSumCheck, Type: checkSum, Columns: royaltyColumns, Equals: 100, Tolerance: 0.1},
+	{Name: royaltyRangeCheck, Type: checkRange, Columns: royaltyColumns, Min: &royaltyShareRange[0], Max: &royaltyShareRange[1], Optional: true},
+	{Name: dateFormatCheck, Type: checkRegex, Column: "Release Date", Pattern: dateRegex.String()},
+}}
+
+// defaultChecks is the check set of jobs that do not send their own
+var defaultChecks = loadDefaultChecks()
+
+// loadDefaultChecks reads CHECKS_FILE, or returns the built-in checks
+func loadDefaultChecks() *CheckSet {
+	if cfg.ChecksFile == "" {
+		set := builtinChecks
+		if err := set.compile(); err != nil {
+			log.Fatalf("Invalid built-in checks: %v", err)
+		}
+		return &set
+	}
+	data, err := os.ReadFile(cfg.ChecksFile)
+	if err != nil {
+		log.Fatalf("Failed to read CHECKS_FILE: %v", err)
+	}
+	set, err := readChecks(bytes.NewReader(data), isYAML(cfg.ChecksFile, ""))
+	if err != nil {
+		log.Fatalf("Invalid CHECKS_FILE %s: %v", cfg.ChecksFile, err)
+	}
+	return set
+}
+
+// readChecks reads and compiles a checks document, written in YAML if
+// yamlDocument is set and in JSON otherwise
+func readChecks(r io.Reader, yamlDocument bool) (*CheckSet, error) {
+	if yamlDocument {
+		var err error
+		if r, err = yamlToJSON(r); err != nil {
+			return nil, err
+		}
+	}
+	var set CheckSet
+	if err := decodeJSON(r, "checks.json", &set); err != nil {
+		return nil, err
+	}
+	if err := set.compile(); err != nil {
+		return nil, fileErrorf(http.StatusBadRequest, "%v", err)
+	}
+	return &set, nil
+}
+
+// uploadChecks returns the checks sent with an upload as a checks file
+// part or field, together with the column patterns of its patterns field
+// and the royalty sum of its royalty_target and royalty_tolerance fields,
+// or nil if none of them was sent. Patterns and royalty sums change the
+// check set of the upload's profile if it sends none.
+func uploadChecks(r *http.Request) (*CheckSet, error) {
+	set, err := uploadCheckSet(r)
+	if err != nil {
+		return nil, err
+	}
+	if value := r.FormValue("patterns"); value != "" {
+		if set, err = withPatterns(orProfileChecks(r, set), value); err != nil {
+			return nil, err
+		}
+	}
+	target, tolerance := r.FormValue("royalty_target"), r.FormValue("royalty_tolerance")
+	if target != "" || tolerance != "" {
+		if set, err = withRoyaltySum(orProfileChecks(r, set), target, tolerance); err != nil {
+			return nil, err
+		}
+	}
+	return set, nil
+}
+
+// orProfileChecks returns a check set, or if it is nil that of the profile
+// of the upload. Profiles that fail to load are reported as the job starts.
+func orProfileChecks(r *http.Request, set *CheckSet) *CheckSet {
+	if set != nil {
+		return set
+	}
+	var profile *Profile
+	if name := r.FormValue("profile"); name != "" {
+		profile, _ = loadProfile(name)
+	}
+	return &CheckSet{Checks: profile.checkSet().Checks}
+}
+
+// uploadCheckSet returns the check set sent with an upload, or nil. A
+// checks file part is read as YAML if its name ends in .yaml or .yml or it
+// is sent as YAML, and a checks field if it does not start with {.
+func uploadCheckSet(r *http.Request) (*CheckSet, error) {
+	if r.MultipartForm != nil && len(r.MultipartForm.File["checks"]) > 0 {
+		header := r.MultipartForm.File["checks"][0]
+		file, err := header.Open()
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+		return readChecks(io.LimitReader(file, maxChecksSize), isYAML(header.Filename, header.Header.Get("Content-Type")))
+	}
+	if value := r.FormValue("checks"); value != "" {
+		return readChecks(strings.NewReader(value), !strings.HasPrefix(strings.TrimSpace(value), "{"))
+	}
+	return nil, nil
+}
+
+// withRoyaltySum returns a check set whose royalties_sum check has another
+// target or tolerance; empty values keep those of the set
+func withRoyaltySum(set *CheckSet, target, tolerance string) (*CheckSet, error) {
+	changed := &CheckSet{Checks: append([]CheckDefinition(nil), set.Checks...)}
+	i := slices.IndexFunc(changed.Checks, func(check CheckDefinition) bool { return check.Name == royaltiesSumCheck })
+	if i < 0 || changed.Checks[i].Type != checkSum {
+		return nil, fileErrorf(http.StatusBadRequest, "the check set has no %s check of type %s", royaltiesSumCheck, checkSum)
+	}
+	if target != "" {
+		value, err := strconv.ParseFloat(target, 64)
+		if err != nil || value <= 0 || math.IsInf(value, 0) {
+			return nil, fileErrorf(http.StatusBadRequest, "royalty_target must be a positive number")
+		}
+		changed.Checks[i].Equals = value
+	}
+	if tolerance != "" {
+		value, err := strconv.ParseFloat(tolerance, 64)
+		if err != nil || value < 0 || math.IsInf(value, 0) {
+			return nil, fileErrorf(http.StatusBadRequest, "royalty_tolerance must be a number of at least 0")
+		}
+		changed.Checks[i].Tolerance = value
+	}
+	if err := changed.compile(); err != nil {
+		return nil, fileErrorf(http.StatusBadRequest, "%v", err)
+	}
+	return changed, nil
+}
+
+// withPatterns returns a check set extended with a regex check named
+// pattern:<column> for each column of a JSON object of column patterns
+func withPatterns(set *CheckSet, value string) (*CheckSet, error) {
+	var patterns map[string]string
+	if err := decodeJSON(strings.NewReader(value), "patterns.json", &patterns); err != nil {
+		return nil, err
+	}
+	columns := make([]string, 0, len(patterns))
+	for column := range patterns {
+		columns = append(columns, column)
+	}
+	sort.Strings(columns)
+
+	extended := &CheckSet{Checks: append([]CheckDefinition(nil), set.Checks...)}
+	for _, column := range columns {
+		extended.Checks = append(extended.Checks, CheckDefinition{
+			Name:    patternCheckPrefix + column,
+			Type:    checkRegex,
+			Column:  column,
+			Pattern: patterns[column],
+		})
+	}
+	if err := extended.compile(); err != nil {
+		return nil, fileErrorf(http.StatusBadRequest, "%v", err)
+	}
+	return extended, nil
+}
+
+// storedChecks returns the check set a job was processed with, as recorded
+// in its result: the one sent with its upload, or nil for the default
+func storedChecks(definitions []CheckDefinition) (*CheckSet, error) {
+	if len(definitions) == 0 {
+		return nil, nil
+	}
+	set := &CheckSet{Checks: definitions}
+	if err := set.compile(); err != nil {
+		return nil, err
+	}
+	return set, nil
+}
+
+// reservedCheckNames are the names of the checks that are not part of a
+// check set
+var reservedCheckNames = strings.Fields("territories release_date upc required_fields isrc genre label rights_holder payee_ids numerics release_type duplicate_track duplicate_isrc release_consistency")
+
+// compile checks the definitions and prepares them to run
+func (s *CheckSet) compile() error {
+	s.compiled = make([]compiledCheck, 0, len(s.Checks))
+	names := make(map[string]bool, len(s.Checks))
+	for _, name := range reservedCheckNames {
+		names[name] = true
+	}
+	for _, def := range s.Checks {
+		if names[def.Name] {
+			return fmt.Errorf("check %s: defined more than once, or the name of a built-in check", def.Name)
+		}
+		names[def.Name] = true
+		if def.Severity != "" && def.Severity != severityError && def.Severity != severityWarning {
+			return fmt.Errorf("check %s: unknown severity %q", def.Name, def.Severity)
+		}
+		check := compiledCheck{CheckDefinition: def}
+		switch def.Type {
+		case checkRequired, checkRange:
+		case checkRegex:
+			pattern, err := regexp.Compile(def.Pattern)
+			if err != nil {
+				return fmt.Errorf("check %s: invalid pattern: %v", def.Name, err)
+			}
+			check.pattern = pattern
+		case checkEnum:
+			check.values = make(map[string]bool, len(def.Values))
+			for _, value := range def.Values {
+				if def.IgnoreCase {
+					value = strings.ToLower(value)
+				}
+				check.values[value] = true
+			}
+		case checkSum, checkUnique:
+			if len(def.Columns) == 0 {
+				return fmt.Errorf("check %s: a %s check needs columns", def.Name, def.Type)
+			}
+			check.equals, check.tolerance = decimalOf(def.Equals), decimalOf(def.Tolerance)
+		case checkCEL:
+			program, err := compileCEL(def.Expr)
+			if err != nil {
+				return fmt.Errorf("check %s: invalid expression: %v", def.Name, err)
+			}
+			check.program = program
+			if def.Optional && def.Column == "" {
+				return fmt.Errorf("check %s: an optional cel check needs a column", def.Name)
+			}
+		default:
+			return fmt.Errorf("check %s: unknown type %q", def.Name, def.Type)
+		}
+		if def.When != nil {
+			when, err := compileCondition(*def.When)
+			if err != nil {
+				return fmt.Errorf("check %s: %v", def.Name, err)
+			}
+			check.when = when
+		}
+		overColumns := def.Type == checkSum || def.Type == checkUnique || def.Type == checkRange && len(def.Columns) > 0
+		if !overColumns && def.Type != checkCEL && def.Column == "" {
+			return fmt.Errorf("check %s: a %s check needs a column", def.Name, def.Type)
+		}
+		s.compiled = append(s.compiled, check)
+	}
+	return nil
+}
+
+// compileCondition checks a condition and prepares it to evaluate
+func compileCondition(cond CheckCondition) (*compiledCondition, error) {
+	if cond.Column == "" {
+		return nil, fmt.Errorf("a condition needs a column")
+	}
+	if len(cond.Values) > 0 && cond.Pattern != "" {
+		return nil, fmt.Errorf("a condition has values or a pattern, not both")
+	}
+	compiled := &compiledCondition{CheckCondition: cond}
+	if cond.Pattern != "" {
+		pattern, err := regexp.Compile(cond.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid condition pattern: %v", err)
+		}
+		compiled.pattern = pattern
+	}
+	if len(cond.Values) > 0 {
+		compiled.values = make(map[string]bool, len(cond.Values))
+		for _, value := range cond.Values {
+			if cond.IgnoreCase {
+				value = strings.ToLower(value)
+			}
+			compiled.values[strings.TrimSpace(value)] = true
+		}
+	}
+	return compiled, nil
+}
+
+// holds reports whether a condition holds for a record
+func (c *compiledCondition) holds(record map[string]string) bool {
+	value := record[c.Column]
+	switch {
+	case c.pattern != nil:
+		return c.pattern.MatchString(value)
+	case c.values != nil:
+		value = strings.TrimSpace(value)
+		if c.IgnoreCase {
+			value = strings.ToLower(value)
+		}
+		return c.values[value]
+	}
+	return strings.TrimSpace(value) != ""
+}
+
+// sum adds up the numbers in the columns of a sum check exactly, as
+// decimals, so that 33.33, 33.33 and 33.34 make exactly 100
+func (c compiledCheck) sum(record map[string]string) *big.Rat {
+	sum := new(big.Rat)
+	for _, column := range c.Columns {
+		if value, ok := parseDecimal(record[column]); ok {
+			sum.Add(sum, value)
+		}
+	}
+	return sum
+}
+
+// outOfRange returns the columns of a range check over columns whose
+// values are not numbers in the range
+func (c compiledCheck) outOfRange(record map[string]string) []string {
+	var columns []string
+	for _, column := range c.Columns {
+		single := c
+		single.Column, single.Columns = column, nil
+		if !single.passes(record) {
+			columns = append(columns, column)
+		}
+	}
+	return columns
+}
+
+// passes evaluates a check against a record
+func (c compiledCheck) passes(record map[string]string) bool {
+	if c.when != nil && !c.when.holds(record) {
+		return true
+	}
+	if c.Type == checkSum {
+		diff := new(big.Rat).Sub(c.sum(record), c.equals)
+		return diff.Abs(diff).Cmp(c.tolerance) <= 0
+	}
+	if c.Type == checkRange && c.Column == "" {
+		return len(c.outOfRange(record)) == 0
+	}
+
+	value := strings.TrimSpace(record[c.Column])
+	if value == "" && c.Type == checkRequired {
+		return false
+	}
+	if value == "" && c.Optional {
+		return true
+	}
+	switch c.Type {
+	case checkRegex:
+		return c.pattern.MatchString(record[c.Column])
+	case checkRange:
+		number, err := parsePercentage(value)
+		if err != nil {
+			return false
+		}
+		return (c.Min == nil || number >= *c.Min) && (c.Max == nil || number <= *c.Max)
+	case checkEnum:
+		if c.IgnoreCase {
+			value = strings.ToLower(value)
+		}
+		return c.values[value]
+	case checkCEL:
+		passed, err := c.program.eval(record)
+		return passed && err == nil
+	}
+	return true
+}
+
+// applyChecks runs a check set against a record and records the outcomes
+// in a row's validation. The royalty sum and date format checks keep their
+// fields, passing if the set has no such check, and a royalty sum check of
+// type sum reports the sum it computed; the others are reported in Checks.
+// Unique checks are left to checkCrossRow.
+func applyChecks(validation *RowValidation, set *CheckSet, record map[string]string) {
+	validation.RoyaltiesSum, validation.DateFormat = true, true
+	for _, check := range set.compiled {
+		if check.Type == checkUnique {
+			continue
+		}
+		passed := check.passes(record)
+		if !passed {
+			validation.Issues = append(validation.Issues, check.issue(record))
+		}
+		switch name := check.Name; name {
+		case royaltiesSumCheck:
+			validation.RoyaltiesSum = passed
+			if check.Type == checkSum {
+				total, _ := roundHalfEven(check.sum(record), cfg.SumDecimals).Float64()
+				validation.RoyaltiesTotal = &total
+			}
+		case dateFormatCheck:
+			validation.DateFormat = passed
+		default:
+			if validation.Checks == nil {
+				validation.Checks = make(map[string]bool)
+			}
+			validation.Checks[name] = passed
+		}
+	}
+}
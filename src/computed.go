@@ -0,0 +1,213 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// maxComputedColumns limits the computed columns of a job
+const maxComputedColumns = 32
+
+// celReleaseVariable holds the row's release in the expressions of
+// computed columns: its id and the number of tracks the dataset has of it
+const celReleaseVariable = "release"
+
+// ComputedColumn is an output column whose value a CEL expression computes
+// from the rest of the row, e.g. a release_year of
+//
+//	row["Release Date"].split("-")[0]
+type ComputedColumn struct {
+	Name string `json:"name"`
+	Expr string `json:"expr"`
+}
+
+// compiledColumn is a computed column ready to evaluate
+type compiledColumn struct {
+	ComputedColumn
+	program *celProgram
+}
+
+// compileComputed checks computed column definitions and parses their
+// expressions
+func compileComputed(definitions []ComputedColumn) ([]compiledColumn, error) {
+	if len(definitions) > maxComputedColumns {
+		return nil, fmt.Errorf("%d computed columns, at most %d are allowed", len(definitions), maxComputedColumns)
+	}
+	compiled := make([]compiledColumn, 0, len(definitions))
+	names := make(map[string]bool, len(definitions))
+	for _, definition := range definitions {
+		switch {
+		case names[definition.Name]:
+			return nil, fmt.Errorf("computed column %s is defined more than once", definition.Name)
+		case definition.Name == nestedValidationKey:
+			return nil, fmt.Errorf("computed column %s has a reserved name", definition.Name)
+		}
+		names[definition.Name] = true
+		program, err := compileCEL(definition.Expr, celReleaseVariable)
+		if err != nil {
+			return nil, fmt.Errorf("computed column %s: %v", definition.Name, err)
+		}
+		compiled = append(compiled, compiledColumn{ComputedColumn: definition, program: program})
+	}
+	return compiled, nil
+}
+
+// uploadComputed returns the computed columns sent with an upload in its
+// computed field, a JSON array, or nil if it sends none
+func uploadComputed(r *http.Request) ([]compiledColumn, error) {
+	value := r.FormValue("computed")
+	if value == "" {
+		return nil, nil
+	}
+	var definitions []ComputedColumn
+	if err := decodeJSON(strings.NewReader(value), "computed.json", &definitions); err != nil {
+		return nil, err
+	}
+	compiled, err := compileComputed(definitions)
+	if err != nil {
+		return nil, fileErrorf(http.StatusBadRequest, "%v", err)
+	}
+	return compiled, nil
+}
+
+// computedColumns returns the computed columns of a job with the profile
+// that sends none
+func (p *Profile) computedColumns() []compiledColumn {
+	if p == nil {
+		return nil
+	}
+	return p.computed
+}
+
+// computedDefinitions returns the definitions of compiled columns
+func computedDefinitions(columns []compiledColumn) []ComputedColumn {
+	var definitions []ComputedColumn
+	for _, column := range columns {
+		definitions = append(definitions, column.ComputedColumn)
+	}
+	return definitions
+}
+
+// withoutComputed returns the columns other than the computed ones
+func withoutComputed(columns []string, computed []ComputedColumn) []string {
+	if len(computed) == 0 {
+		return columns
+	}
+	return slices.DeleteFunc(slices.Clone(columns), func(column string) bool {
+		return slices.ContainsFunc(computed, func(c ComputedColumn) bool { return c.Name == column })
+	})
+}
+
+// computeColumns sets the computed columns of every row of a result,
+// following the file's columns, and records them in its metadata. Each
+// expression sees the columns computed before it. A column named like one
+// of the file replaces its values. An expression failing on a row leaves
+// its value empty; the failures are returned as warnings.
+func computeColumns(result *OutputFormat, columns []compiledColumn) []string {
+	if len(columns) == 0 {
+		return nil
+	}
+	tracks := make(map[string]int64)
+	for _, row := range result.Conversion.Rows {
+		tracks[row["Release ID"]]++
+	}
+
+	type failures struct {
+		rows, line int
+		err        error
+	}
+	failed := make([]failures, len(columns))
+	// The rows may be shared with a stored result, so computed values are
+	// written to copies
+	rows := make([]map[string]string, len(result.Conversion.Rows))
+	for r, row := range result.Conversion.Rows {
+		row = maps.Clone(row)
+		rows[r] = row
+		release := map[string]any{"id": row["Release ID"], "tracks": tracks[row["Release ID"]]}
+		for i, column := range columns {
+			value, err := column.evaluate(row, release)
+			if err != nil {
+				if failed[i].rows == 0 {
+					failed[i].line, failed[i].err = result.Validation[row["Track ID"]].Line, err
+				}
+				failed[i].rows++
+			}
+			row[column.Name] = value
+		}
+	}
+	result.Conversion.Rows = rows
+
+	// The conversion and the metadata may share their column list
+	conversionColumns := slices.Clone(result.Conversion.Columns)
+	metadataColumns := slices.Clone(result.Metadata.Columns)
+	for _, column := range columns {
+		if !slices.Contains(conversionColumns, column.Name) {
+			conversionColumns = append(conversionColumns, column.Name)
+		}
+		if !slices.Contains(metadataColumns, column.Name) {
+			metadataColumns = append(metadataColumns, column.Name)
+		}
+	}
+	result.Conversion.Columns, result.Metadata.Columns = conversionColumns, metadataColumns
+	result.Metadata.Computed = computedDefinitions(columns)
+
+	var warnings []string
+	for i, f := range failed {
+		if f.rows > 0 {
+			warnings = append(warnings, fmt.Sprintf("Computed column %s could not be computed for %d rows, the first on line %d: %v",
+				columns[i].Name, f.rows, f.line, f.err))
+		}
+	}
+	return warnings
+}
+
+// computeRow returns a copy of a row with the computed columns known before
+// the rest of the dataset: those before the first reading the release,
+// whose track count is only known once every row is in. Failures leave a
+// value empty.
+func computeRow(row map[string]string, columns []compiledColumn) map[string]string {
+	if len(columns) == 0 || columns[0].program.uses(celReleaseVariable) {
+		return row
+	}
+	row = maps.Clone(row)
+	for _, column := range columns {
+		if column.program.uses(celReleaseVariable) {
+			break
+		}
+		row[column.Name], _ = column.evaluate(row, nil)
+	}
+	return row
+}
+
+// evaluate computes the value of the column for a row: strings as they
+// are, numbers in their shortest form, doubles rounded to SUM_DECIMALS
+// places, and bools as true or false
+func (c compiledColumn) evaluate(row map[string]string, release map[string]any) (string, error) {
+	value, err := c.program.evalValue(row, celVar{name: celReleaseVariable, value: release})
+	if err != nil {
+		return "", err
+	}
+	switch v := value.(type) {
+	case string:
+		return v, nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case int64:
+		return strconv.FormatInt(v, 10), nil
+	case uint64:
+		return strconv.FormatUint(v, 10), nil
+	case float64:
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return "", fmt.Errorf("expression returned %v", v)
+		}
+		return formatSum(decimalOf(v)), nil
+	case nil:
+		return "", nil
+	}
+	return "", fmt.Errorf("expression returned %s, not a string, number or bool", celTypeName(value))
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config holds the server settings read from the environment at startup
+type Config struct {
+	Port              string
+	MaxUploadSize     int64
+	MaxConcurrentJobs int
+	MaxWorkers        int
+	BatchConcurrency  int
+	MaxHeaderSkip     int
+	ReleaseTypes      []string
+	RequiredColumns   []string
+	AlertQueueLength  int
+	AlertQueueWait    time.Duration
+	AlertCooldown     time.Duration
+	AlertWebhookURL   string
+	JobStore          string
+	JobStoreDir       string
+	JobIDFormat       string
+	JobHistory        int
+	JobTTL            time.Duration
+	RedisAddr         string
+	RedisPassword     string
+	RedisDB           int
+	ProfilesDir       string
+	ChecksFile        string
+	DigestSchedule    string
+	DigestHour        int
+	DigestWebhookURL  string
+	DigestEmailFrom   string
+	DigestEmailTo     []string
+	SMTPAddr          string
+	SMTPUsername      string
+	SMTPPassword      string
+	VirusScanURL      string
+	VirusScanTimeout  time.Duration
+	NotifyWebhookURL  string
+	NotifyRoutes      []string
+
+	// Field encryption of stored results
+	EncryptColumns     []string
+	EncryptionKeyFile  string
+	VaultAddr          string
+	VaultToken         string
+	VaultTransitKey    string
+	SensitiveReadToken string
+	AdminToken         string
+
+	// AnonymizeSecret is mixed into the hashes of anonymized samples
+	AnonymizeSecret string
+
+	// Transformation callout stage
+	CalloutURL           string
+	CalloutBatchSize     int
+	CalloutConcurrency   int
+	CalloutTimeout       time.Duration
+	CalloutRetries       int
+	CalloutFailurePolicy string
+
+	// Server timeouts; zero disables a timeout
+	ReadHeaderTimeout time.Duration
+	ReadTimeout       time.Duration
+	WriteTimeout      time.Duration
+	IdleTimeout       time.Duration
+	RequestTimeout    time.Duration
+	ProcessingTimeout time.Duration
+
+	// Largest size a compressed upload may expand to
+	MaxDecompressedSize int64
+
+	// Memory processing jobs may hold together; zero disables the limit
+	MaxInFlightBytes int64
+
+	// Slices of each result precomputed as jobs complete
+	MaterializedViews []string
+
+	// Directory of the operators' export templates
+	TemplatesDir string
+
+	// Base URL Google Sheets are exported from
+	GoogleSheetsURL string
+
+	// Directory uploaded files are kept in, by content
+	UploadStoreDir string
+
+	// Webhook deliveries: retries before a failed delivery is parked, and
+	// how often parked deliveries are re-driven; zero disables re-driving
+	DeliveryRetries       int
+	DeliveryRetryInterval time.Duration
+
+	// How far ahead release dates may be; zero allows any future date
+	ReleaseDateMaxFutureDays int
+
+	// File listing the genres rows may have; empty accepts any genre
+	GenresFile string
+
+	// JSON file of further territory regions, such as NORDICS, and the
+	// countries they cover
+	TerritoriesFile string
+
+	// Reference lists of approved labels and rights holders, as CSV files
+	// or SQLite databases with the table to read; empty accepts any name
+	LabelsFile         string
+	LabelsTable        string
+	RightsHoldersFile  string
+	RightsHoldersTable string
+
+	// Checks whose failures are warnings rather than errors
+	WarningChecks []string
+
+	// Directory of the WebAssembly validators, and the instructions a
+	// validator may run for one row
+	ValidatorsDir string
+	ValidatorFuel int64
+
+	// Decimal places sums are reported to
+	SumDecimals int
+}
+
+// cfg is the active server configuration
+var cfg = loadConfig()
+
+// loadConfig reads the server configuration from environment variables
+func loadConfig() Config {
+	return Config{
+		Port:              envString("PORT", "8080"),
+		MaxUploadSize:     int64(envInt("MAX_UPLOAD_MB", 512)) << 20,
+		MaxConcurrentJobs: envInt("MAX_CONCURRENT_JOBS", 2),
+		MaxWorkers:        max(envInt("MAX_WORKERS", 64), 1),
+		BatchConcurrency:  max(envInt("BATCH_CONCURRENCY", 4), 1),
+		MaxHeaderSkip:     max(envInt("MAX_HEADER_SKIP", 10), 0),
+		ReleaseTypes:      envListDefault("RELEASE_TYPES", []string{"Album", "Single", "EP"}),
+		RequiredColumns:   envListDefault("REQUIRED_COLUMNS", []string{"Release ID", "Track ID", "ISRC", "Artist Name"}),
+		AlertQueueLength:  envInt("ALERT_QUEUE_LENGTH", 0),
+		AlertQueueWait:    time.Duration(envInt("ALERT_QUEUE_WAIT_SECONDS", 0)) * time.Second,
+		AlertCooldown:     time.Duration(envInt("ALERT_COOLDOWN_SECONDS", 300)) * time.Second,
+		AlertWebhookURL:   envString("ALERT_WEBHOOK_URL", ""),
+		JobStore:          envString("JOB_STORE", "memory"),
+		JobStoreDir:       envString("JOB_STORE_DIR", "data"),
+		JobIDFormat:       envString("JOB_ID_FORMAT", "hex"),
+		JobHistory:        envInt("JOB_HISTORY", 100),
+		JobTTL:            time.Duration(max(envInt("JOB_TTL_HOURS", 24), 1)) * time.Hour,
+		RedisAddr:         envString("REDIS_ADDR", "localhost:6379"),
+		RedisPassword:     envString("REDIS_PASSWORD", ""),
+		RedisDB:           envInt("REDIS_DB", 0),
+		ProfilesDir:       envString("PROFILES_DIR", "profiles"),
+		ChecksFile:        envString("CHECKS_FILE", ""),
+		DigestSchedule:    envString("DIGEST_SCHEDULE", ""),
+		DigestHour:        envInt("DIGEST_HOUR", 6),
+		DigestWebhookURL:  envString("DIGEST_WEBHOOK_URL", ""),
+		DigestEmailFrom:   envString("DIGEST_EMAIL_FROM", "csvapi@localhost"),
+		DigestEmailTo:     envList("DIGEST_EMAIL_TO"),
+		SMTPAddr:          envString("SMTP_ADDR", ""),
+		SMTPUsername:      envString("SMTP_USERNAME", ""),
+		SMTPPassword:      envString("SMTP_PASSWORD", ""),
+		VirusScanURL:      envString("VIRUS_SCAN_URL", ""),
+		VirusScanTimeout:  time.Duration(max(envInt("VIRUS_SCAN_TIMEOUT_SECONDS", 120), 1)) * time.Second,
+		NotifyWebhookURL:  envString("NOTIFY_WEBHOOK_URL", ""),
+		NotifyRoutes:      envList("NOTIFY_ROUTES"),
+
+		EncryptColumns:     envList("ENCRYPT_COLUMNS"),
+		EncryptionKeyFile:  envString("ENCRYPTION_KEY_FILE", ""),
+		VaultAddr:          envString("VAULT_ADDR", ""),
+		VaultToken:         envString("VAULT_TOKEN", ""),
+		VaultTransitKey:    envString("VAULT_TRANSIT_KEY", "csvapi"),
+		SensitiveReadToken: envString("SENSITIVE_READ_TOKEN", ""),
+		AdminToken:         envString("ADMIN_TOKEN", ""),
+
+		AnonymizeSecret: envString("ANONYMIZE_SECRET", ""),
+
+		CalloutURL:           envString("CALLOUT_URL", ""),
+		CalloutBatchSize:     max(envInt("CALLOUT_BATCH_SIZE", 500), 1),
+		CalloutConcurrency:   max(envInt("CALLOUT_CONCURRENCY", 4), 1),
+		CalloutTimeout:       time.Duration(max(envInt("CALLOUT_TIMEOUT_SECONDS", 30), 1)) * time.Second,
+		CalloutRetries:       max(envInt("CALLOUT_RETRIES", 2), 0),
+		CalloutFailurePolicy: envString("CALLOUT_FAILURE_POLICY", CalloutFail),
+
+		ReadHeaderTimeout: time.Duration(max(envInt("READ_HEADER_TIMEOUT_SECONDS", 10), 0)) * time.Second,
+		ReadTimeout:       time.Duration(max(envInt("READ_TIMEOUT_SECONDS", 600), 0)) * time.Second,
+		WriteTimeout:      time.Duration(max(envInt("WRITE_TIMEOUT_SECONDS", 2100), 0)) * time.Second,
+		IdleTimeout:       time.Duration(max(envInt("IDLE_TIMEOUT_SECONDS", 120), 0)) * time.Second,
+		RequestTimeout:    time.Duration(max(envInt("REQUEST_TIMEOUT_SECONDS", 60), 0)) * time.Second,
+		ProcessingTimeout: time.Duration(max(envInt("PROCESSING_TIMEOUT_SECONDS", 1800), 0)) * time.Second,
+
+		MaxDecompressedSize: int64(max(envInt("MAX_DECOMPRESSED_MB", 4096), 1)) << 20,
+		MaxInFlightBytes:    int64(max(envInt("MAX_IN_FLIGHT_MB", 0), 0)) << 20,
+
+		MaterializedViews: envList("MATERIALIZED_VIEWS"),
+
+		TemplatesDir: envString("TEMPLATES_DIR", "templates"),
+
+		GoogleSheetsURL: envString("GOOGLE_SHEETS_URL", "https://docs.google.com"),
+
+		UploadStoreDir: envString("UPLOAD_STORE_DIR", ""),
+
+		DeliveryRetries:       max(envInt("DELIVERY_RETRIES", 2), 0),
+		DeliveryRetryInterval: time.Duration(max(envInt("DELIVERY_RETRY_INTERVAL_SECONDS", 300), 0)) * time.Second,
+
+		ReleaseDateMaxFutureDays: max(envInt("RELEASE_DATE_MAX_FUTURE_DAYS", 0), 0),
+
+		GenresFile: envString("GENRES_FILE", ""),
+
+		TerritoriesFile: envString("TERRITORIES_FILE", ""),
+
+		LabelsFile:         envString("LABELS_FILE", ""),
+		LabelsTable:        envString("LABELS_TABLE", "labels"),
+		RightsHoldersFile:  envString("RIGHTS_HOLDERS_FILE", ""),
+		RightsHoldersTable: envString("RIGHTS_HOLDERS_TABLE", "rights_holders"),
+
+		WarningChecks: envList("WARNING_CHECKS"),
+
+		ValidatorsDir: envString("VALIDATORS_DIR", "validators"),
+		ValidatorFuel: int64(max(envInt("VALIDATOR_FUEL", 10_000_000), 1000)),
+
+		SumDecimals: min(max(envInt("SUM_DECIMALS", 9), 0), 18),
+	}
+}
+
+// envString returns the value of an environment variable or a default
+func envString(name, def string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return def
+}
+
+// envList returns the comma-separated values of an environment variable
+func envList(name string) []string {
+	var values []string
+	for _, v := range strings.Split(os.Getenv(name), ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			values = append(values, v)
+		}
+	}
+	return values
+}
+
+// envListDefault returns a comma-separated list from an environment
+// variable, or a default if it is unset or empty
+func envListDefault(name string, def []string) []string {
+	if values := envList(name); len(values) > 0 {
+		return values
+	}
+	return def
+}
+
+// envInt returns the integer value of an environment variable or a default
+func envInt(name string, def int) int {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		log.Printf("Invalid value for %s: %q, using default %d", name, v, def)
+		return def
+	}
+	return n
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+)
+
+// Conversion is the converted data. Rows are written as JSON objects whose
+// keys follow Columns, rather than the sorted key order of Go maps, so every
+// export of the same schema is structurally identical.
+type Conversion struct {
+	Columns []string
+	Rows    []map[string]string
+
+	// split holds the columns written as arrays of the values they list
+	split map[string]bool
+}
+
+// MarshalJSON writes the rows as an array of objects in column order. Keys
+// that are not in Columns follow in sorted order.
+func (c Conversion) MarshalJSON() ([]byte, error) {
+	return c.marshalRows(true, nil)
+}
+
+// marshalRows writes the rows as MarshalJSON does, or empty objects without
+// values. If extra is set, each object ends with the field it returns for
+// the row.
+func (c Conversion) marshalRows(values bool, extra rowField) ([]byte, error) {
+	known := c.known()
+	var buf bytes.Buffer
+	buf.WriteByte('[')
+	for i, row := range c.Rows {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		if err := c.writeRow(&buf, row, known, values, extra); err != nil {
+			return nil, err
+		}
+	}
+	buf.WriteByte(']')
+	return buf.Bytes(), nil
+}
+
+// rowField returns a field added to the JSON object of a row
+type rowField func(row map[string]string) (key string, value []byte, err error)
+
+// known returns the set of Columns
+func (c Conversion) known() map[string]bool {
+	known := make(map[string]bool, len(c.Columns))
+	for _, column := range c.Columns {
+		known[column] = true
+	}
+	return known
+}
+
+// writeRow writes a row as a JSON object, as marshalRows does
+func (c Conversion) writeRow(buf *bytes.Buffer, row map[string]string, known map[string]bool, values bool, extra rowField) error {
+	buf.WriteByte('{')
+	first := true
+	writeField := func(key string, value []byte) {
+		if !first {
+			buf.WriteByte(',')
+		}
+		first = false
+		k, _ := json.Marshal(key)
+		buf.Write(k)
+		buf.WriteByte(':')
+		buf.Write(value)
+	}
+	writeString := func(key, value string) {
+		if c.split[key] {
+			writeField(key, splitValue(key, value))
+			return
+		}
+		v, _ := json.Marshal(value)
+		writeField(key, v)
+	}
+
+	if values {
+		for _, column := range c.Columns {
+			if value, ok := row[column]; ok {
+				writeString(column, value)
+			}
+		}
+		if len(row) > len(c.Columns) {
+			var unknown []string
+			for key := range row {
+				if !known[key] {
+					unknown = append(unknown, key)
+				}
+			}
+			sort.Strings(unknown)
+			for _, key := range unknown {
+				writeString(key, row[key])
+			}
+		}
+	}
+	if extra != nil {
+		key, value, err := extra(row)
+		if err != nil {
+			return err
+		}
+		writeField(key, value)
+	}
+	buf.WriteByte('}')
+	return nil
+}
+
+// UnmarshalJSON reads an array of objects, recovering the column order from
+// the key order of the objects
+func (c *Conversion) UnmarshalJSON(data []byte) error {
+	c.Columns, c.Rows = nil, nil
+	if string(bytes.TrimSpace(data)) == "null" {
+		return nil
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	if err := expectDelim(decoder, '['); err != nil {
+		return err
+	}
+	seen := make(map[string]bool)
+	for decoder.More() {
+		if err := expectDelim(decoder, '{'); err != nil {
+			return err
+		}
+		row := make(map[string]string)
+		for decoder.More() {
+			token, err := decoder.Token()
+			if err != nil {
+				return err
+			}
+			key, _ := token.(string)
+			var value string
+			if err := decoder.Decode(&value); err != nil {
+				return err
+			}
+			row[key] = value
+			if !seen[key] {
+				seen[key] = true
+				c.Columns = append(c.Columns, key)
+			}
+		}
+		if err := expectDelim(decoder, '}'); err != nil {
+			return err
+		}
+		c.Rows = append(c.Rows, row)
+	}
+	return expectDelim(decoder, ']')
+}
+
+// expectDelim reads the next token and checks it is the given delimiter
+func expectDelim(decoder *json.Decoder, delim json.Delim) error {
+	token, err := decoder.Token()
+	if err != nil {
+		return err
+	}
+	if token != delim {
+		return fmt.Errorf("conversion: expected %v, got %v", delim, token)
+	}
+	return nil
+}
+
+// outputColumns works out the output columns of a file. Without canonical
+// columns the input header order is kept. Otherwise input headers are renamed
+// to the canonical column they match (ignoring case, spaces and punctuation),
+// canonical columns missing from the file are output empty, and input columns
+// outside the canonical schema are dropped.
+//
+// names holds the output name of each input column, or "" if it is dropped.
+func outputColumns(headers, canonical []string) (columns, names, dropped []string) {
+	if len(canonical) == 0 {
+		return headers, headers, nil
+	}
+
+	byNormalized := make(map[string]string, len(canonical))
+	for _, column := range canonical {
+		byNormalized[normalizeColumnName(column)] = column
+	}
+
+	names = make([]string, len(headers))
+	for i, header := range headers {
+		if column, ok := byNormalized[normalizeColumnName(header)]; ok {
+			names[i] = column
+		} else {
+			dropped = append(dropped, header)
+		}
+	}
+	return canonical, names, dropped
+}
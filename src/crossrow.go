@@ -0,0 +1,223 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// releaseFields must hold the same value on every row of a release
+var releaseFields = []string{"Release Title", "Release Date", "Label Name", "UPC"}
+
+// Duplicates lists the Track IDs and ISRCs used by more than one row, with
+// the positions of those rows in the conversion, counting from 1. Rows
+// sharing a Track ID share its entry in the validation map, which holds
+// the outcome of the last of them.
+type Duplicates struct {
+	TrackIDs map[string][]int `json:"track_ids,omitempty"`
+	ISRCs    map[string][]int `json:"isrcs,omitempty"`
+}
+
+// checkCrossRow runs the checks that span rows over the whole dataset of a
+// result: Track IDs and ISRCs used by more than one row, releases whose
+// rows disagree on a release field and the unique checks of the check set.
+// Rows leaving a field empty are not counted as disagreeing. Earlier
+// outcomes of these checks are replaced, so the checks can be rerun as rows
+// change or are added.
+func checkCrossRow(result *OutputFormat, checks *CheckSet) {
+	tracks := make(map[string][]int, len(result.Conversion.Rows))
+	isrcs := make(map[string][]int, len(result.Conversion.Rows))
+	values := make(map[string]map[string]map[string]bool)
+	for i, row := range result.Conversion.Rows {
+		if trackID := row["Track ID"]; trackID != "" {
+			tracks[trackID] = append(tracks[trackID], i+1)
+		}
+		if isrc := normalizeISRC(row[isrcColumn]); isrc != "" {
+			isrcs[isrc] = append(isrcs[isrc], i+1)
+		}
+		releaseID := row["Release ID"]
+		if releaseID == "" {
+			continue
+		}
+		if values[releaseID] == nil {
+			values[releaseID] = make(map[string]map[string]bool)
+		}
+		for _, field := range releaseFields {
+			value := strings.TrimSpace(row[field])
+			if value == "" {
+				continue
+			}
+			if values[releaseID][field] == nil {
+				values[releaseID][field] = make(map[string]bool)
+			}
+			values[releaseID][field][value] = true
+		}
+	}
+
+	conflicts := make(map[string][]string)
+	for releaseID, fields := range values {
+		for field, seen := range fields {
+			if len(seen) > 1 {
+				conflicts[releaseID] = append(conflicts[releaseID], field)
+			}
+		}
+		sort.Strings(conflicts[releaseID])
+	}
+
+	// Any row of a Track ID with a duplicate ISRC marks its validation
+	duplicateISRCs := make(map[string]string)
+	for _, row := range result.Conversion.Rows {
+		if isrc := normalizeISRC(row[isrcColumn]); len(isrcs[isrc]) > 1 {
+			duplicateISRCs[row["Track ID"]] = isrc
+		}
+	}
+
+	for trackID, validation := range result.Validation {
+		validation.DuplicateTrack = len(tracks[trackID]) > 1
+		validation.ReleaseConflicts = conflicts[validation.ReleaseID]
+		validation.DuplicateISRC = duplicateISRCs[trackID] != ""
+
+		validation.Issues = withoutChecks(validation.Issues, "duplicate_track", "duplicate_isrc", "release_consistency")
+		if validation.DuplicateTrack {
+			validation.Issues = append(validation.Issues, Issue{Check: "duplicate_track", Column: "Track ID", Value: trackID,
+				Message: fmt.Sprintf("Track ID is used by %d rows", len(tracks[trackID]))})
+		}
+		if isrc := duplicateISRCs[trackID]; isrc != "" {
+			validation.Issues = append(validation.Issues, Issue{Check: "duplicate_isrc", Column: isrcColumn, Value: isrc,
+				Message: fmt.Sprintf("ISRC is used by %d rows", len(isrcs[isrc]))})
+		}
+		for _, field := range validation.ReleaseConflicts {
+			validation.Issues = append(validation.Issues, Issue{Check: "release_consistency", Column: field,
+				Message: fmt.Sprintf("the rows of release %s disagree on %s: %s", validation.ReleaseID, field,
+					strings.Join(sortedKeys(values[validation.ReleaseID][field]), ", "))})
+		}
+		result.Validation[trackID] = validation
+	}
+
+	result.Duplicates = nil
+	trackDuplicates, isrcDuplicates := duplicated(tracks), duplicated(isrcs)
+	if trackDuplicates != nil || isrcDuplicates != nil {
+		result.Duplicates = &Duplicates{TrackIDs: trackDuplicates, ISRCs: isrcDuplicates}
+	}
+
+	for _, check := range checks.compiled {
+		if check.Type == checkUnique {
+			checkUniqueKey(result, check)
+		}
+	}
+}
+
+// checkUniqueKey runs a unique check: rows sharing their values of its
+// columns fail it, and list the lines of the others in Conflicts. Rows
+// leaving any of the columns empty, or its condition does not hold for,
+// are not compared.
+func checkUniqueKey(result *OutputFormat, check compiledCheck) {
+	keys := make(map[string][]int)
+	rowKeys := make(map[string][]string)
+	for i, row := range result.Conversion.Rows {
+		if check.when != nil && !check.when.holds(row) {
+			continue
+		}
+		values := make([]string, len(check.Columns))
+		for j, column := range check.Columns {
+			values[j] = strings.TrimSpace(row[column])
+			if values[j] == "" {
+				values = nil
+				break
+			}
+		}
+		if values == nil {
+			continue
+		}
+		key := strings.Join(values, "\x00")
+		if check.IgnoreCase {
+			key = strings.ToLower(key)
+		}
+		keys[key] = append(keys[key], i)
+		rowKeys[row["Track ID"]] = append(rowKeys[row["Track ID"]], key)
+	}
+
+	for trackID, validation := range result.Validation {
+		// The maps may be shared with a stored result
+		validation.Conflicts = maps.Clone(validation.Conflicts)
+		validation.Checks = maps.Clone(validation.Checks)
+		validation.Issues = withoutChecks(validation.Issues, check.Name)
+		delete(validation.Conflicts, check.Name)
+		passed := true
+		for _, key := range rowKeys[trackID] {
+			rows := keys[key]
+			if len(rows) < 2 {
+				continue
+			}
+			passed = false
+
+			// The rows of a Track ID share the line of the last of them
+			var others []int
+			for _, i := range rows {
+				line := result.Validation[result.Conversion.Rows[i]["Track ID"]].Line
+				if line > 0 && line != validation.Line && !slices.Contains(others, line) {
+					others = append(others, line)
+				}
+			}
+			sort.Ints(others)
+			if len(others) > 0 {
+				if validation.Conflicts == nil {
+					validation.Conflicts = make(map[string][]int)
+				}
+				validation.Conflicts[check.Name] = others
+			}
+
+			values := make([]string, len(check.Columns))
+			for j, column := range check.Columns {
+				values[j] = fmt.Sprintf("%q", result.Conversion.Rows[rows[0]][column])
+			}
+			message := fmt.Sprintf("%s %s is used by %d rows", strings.Join(check.Columns, ", "), strings.Join(values, ", "), len(rows))
+			switch len(others) {
+			case 0:
+			case 1:
+				message += fmt.Sprintf(", also on line %d", others[0])
+			default:
+				message += fmt.Sprintf(", also on lines %s", joinInts(others))
+			}
+			validation.Issues = append(validation.Issues, Issue{Check: check.Name, Column: check.Columns[0],
+				Value: result.Conversion.Rows[rows[0]][check.Columns[0]], Message: message})
+			break
+		}
+		if len(validation.Conflicts) == 0 {
+			validation.Conflicts = nil
+		}
+		if validation.Checks == nil {
+			validation.Checks = make(map[string]bool)
+		}
+		validation.Checks[check.Name] = passed
+		result.Validation[trackID] = validation
+	}
+}
+
+// joinInts joins numbers with ", "
+func joinInts(numbers []int) string {
+	parts := make([]string, len(numbers))
+	for i, n := range numbers {
+		parts[i] = strconv.Itoa(n)
+	}
+	return strings.Join(parts, ", ")
+}
+
+// duplicated returns the values of more than one row, or nil if there are
+// none
+func duplicated(rows map[string][]int) map[string][]int {
+	var duplicates map[string][]int
+	for value, positions := range rows {
+		if len(positions) < 2 {
+			continue
+		}
+		if duplicates == nil {
+			duplicates = make(map[string][]int)
+		}
+		duplicates[value] = positions
+	}
+	return duplicates
+}
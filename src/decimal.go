@@ -0,0 +1,95 @@
+package main
+
+import (
+	"math"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+// Rounding describes how sum checks add up values: exactly, as the
+// decimals written in the file, with only the totals reported rounded
+// half to even to Decimals places
+type Rounding struct {
+	Arithmetic string `json:"arithmetic"`
+	Mode       string `json:"mode"`
+	Decimals   int    `json:"decimals"`
+}
+
+// sumRounding returns the rounding of the sums of a check set, or nil if it
+// has no sum check
+func sumRounding(set *CheckSet) *Rounding {
+	for _, check := range set.Checks {
+		if check.Type == checkSum {
+			return &Rounding{Arithmetic: "decimal", Mode: "half_even", Decimals: cfg.SumDecimals}
+		}
+	}
+	return nil
+}
+
+// parseDecimal parses a number as the exact decimal it is written as. It
+// accepts what parsePercentage accepts, a trailing % included, except
+// infinities and NaN.
+func parseDecimal(s string) (*big.Rat, bool) {
+	s = strings.TrimSuffix(strings.TrimSpace(s), "%")
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+		return nil, false
+	}
+	if r, ok := new(big.Rat).SetString(s); ok {
+		return r, true
+	}
+	// Hexadecimal floats and the like are exact as parsed
+	return new(big.Rat).SetFloat64(f), true
+}
+
+// decimalOf returns the decimal a float64 was written as, such as 0.1 for
+// the float64 nearest to it
+func decimalOf(f float64) *big.Rat {
+	r, _ := new(big.Rat).SetString(strconv.FormatFloat(f, 'g', -1, 64))
+	return r
+}
+
+// roundHalfEven rounds a number to a number of decimal places, rounding
+// halves to the even neighbour
+func roundHalfEven(r *big.Rat, decimals int) *big.Rat {
+	scale := new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(decimals)), nil)
+	scaled := new(big.Rat).Mul(r, new(big.Rat).SetInt(scale))
+	quo, rem := new(big.Int).QuoRem(scaled.Num(), scaled.Denom(), new(big.Int))
+
+	// Compare twice the remainder with the denominator to find halves
+	twice := new(big.Int).Mul(new(big.Int).Abs(rem), big.NewInt(2))
+	switch cmp := twice.Cmp(scaled.Denom()); {
+	case cmp > 0, cmp == 0 && quo.Bit(0) == 1:
+		if rem.Sign() < 0 {
+			quo.Sub(quo, big.NewInt(1))
+		} else {
+			quo.Add(quo, big.NewInt(1))
+		}
+	}
+	return new(big.Rat).SetFrac(quo, scale)
+}
+
+// formatExact writes a decimal in its shortest form, to at most 12
+// places
+func formatExact(r *big.Rat) string {
+	s := r.FloatString(12)
+	s = strings.TrimRight(strings.TrimRight(s, "0"), ".")
+	if s == "-0" {
+		s = "0"
+	}
+	return s
+}
+
+// formatSum writes a sum rounded to SUM_DECIMALS places, without
+// trailing zeros
+func formatSum(r *big.Rat) string {
+	s := roundHalfEven(r, cfg.SumDecimals).FloatString(cfg.SumDecimals)
+	if strings.Contains(s, ".") {
+		s = strings.TrimRight(strings.TrimRight(s, "0"), ".")
+	}
+	if s == "-0" {
+		s = "0"
+	}
+	return s
+}
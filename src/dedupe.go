@@ -0,0 +1,189 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// maxRemovedRows limits the removed duplicate rows listed in a result
+const maxRemovedRows = 1000
+
+// Dedupe selects the duplicate rows dropped from the conversion: rows
+// whose values equal an earlier row's in every column, or in the columns
+// of key
+type Dedupe struct {
+	key []string
+
+	// earlier are rows of the dataset the file is appended to, which its
+	// rows are compared with too
+	earlier []map[string]string
+}
+
+// Deduplication reports the duplicate rows dropped from the conversion
+type Deduplication struct {
+	// Key lists the columns rows were compared on, none for every column
+	Key     []string `json:"key,omitempty"`
+	Removed int      `json:"removed"`
+
+	// Rows lists the first maxRemovedRows rows removed, in line order
+	Rows []RemovedRow `json:"rows"`
+}
+
+// RemovedRow is a row dropped as a duplicate of an earlier one
+type RemovedRow struct {
+	// Line is the line of the file the row starts on, and Part the part it
+	// was appended in
+	Line int `json:"line"`
+	Part int `json:"part,omitempty"`
+}
+
+// parseDedupe reads the dedupe option of a request: true to drop rows
+// duplicating another in every column, or the comma-separated columns to
+// compare rows on
+func parseDedupe(r *http.Request) (*Dedupe, error) {
+	switch value := strings.TrimSpace(r.FormValue("dedupe")); value {
+	case "", "false":
+		return nil, nil
+	case "true":
+		return &Dedupe{}, nil
+	default:
+		var key []string
+		for _, column := range strings.Split(value, ",") {
+			column = strings.TrimSpace(column)
+			if column == "" {
+				return nil, fileErrorf(http.StatusBadRequest, "empty column name in %q", value)
+			}
+			key = append(key, column)
+		}
+		return &Dedupe{key: key}, nil
+	}
+}
+
+// storedDedupe returns the deduplication of the parts appended to a job,
+// as recorded in its result, comparing them with its rows
+func storedDedupe(deduplication *Deduplication, rows []map[string]string) *Dedupe {
+	if deduplication == nil {
+		return nil
+	}
+	return &Dedupe{key: deduplication.Key, earlier: rows}
+}
+
+// columns resolves the key against the columns of a file, ignoring case,
+// spaces and punctuation. Without a key rows are compared on every column.
+func (d *Dedupe) columns(columns []string) ([]string, error) {
+	if len(d.key) == 0 {
+		return nil, nil
+	}
+	byNormalized := make(map[string]string, len(columns))
+	for _, column := range columns {
+		byNormalized[normalizeColumnName(column)] = column
+	}
+	resolved := make([]string, 0, len(d.key))
+	for _, name := range d.key {
+		column, ok := byNormalized[normalizeColumnName(name)]
+		if !ok {
+			return nil, fileErrorf(http.StatusUnprocessableEntity, "dedupe column %q is not in the file", name)
+		}
+		if !slices.Contains(resolved, column) {
+			resolved = append(resolved, column)
+		}
+	}
+	return resolved, nil
+}
+
+// remove drops the rows of a file duplicating an earlier row and returns
+// the rows kept, their validation and what was removed. validations holds
+// the outcome of each row, in the order of records; key is the resolved
+// key, or nil to compare every one of columns. Rows are compared with
+// surrounding spaces ignored when compared on a key, and rows leaving
+// every column of the key empty are kept.
+func (d *Dedupe) remove(records []map[string]string, validations []RowValidation, key, columns []string) ([]map[string]string, map[string]RowValidation, *Deduplication) {
+	compared := columns
+	if key != nil {
+		compared = key
+	}
+	rowKey := func(record map[string]string) (string, bool) {
+		values := make([]string, len(compared))
+		empty := true
+		for i, column := range compared {
+			values[i] = record[column]
+			if key != nil {
+				values[i] = strings.TrimSpace(values[i])
+			}
+			empty = empty && values[i] == ""
+		}
+		return strings.Join(values, "\x00"), !empty || key == nil
+	}
+
+	seen := make(map[string]bool, len(records)+len(d.earlier))
+	for _, record := range d.earlier {
+		if k, ok := rowKey(record); ok {
+			seen[k] = true
+		}
+	}
+
+	// Rows are collected as workers finish them; the first in the file is
+	// the one kept
+	order := make([]int, len(records))
+	for i := range order {
+		order[i] = i
+	}
+	slices.SortFunc(order, func(a, b int) int { return validations[a].Line - validations[b].Line })
+
+	report := &Deduplication{Key: key, Rows: []RemovedRow{}}
+	removed := make([]bool, len(records))
+	for _, i := range order {
+		k, ok := rowKey(records[i])
+		if !ok {
+			continue
+		}
+		if !seen[k] {
+			seen[k] = true
+			continue
+		}
+		removed[i] = true
+		report.Removed++
+		if len(report.Rows) < maxRemovedRows {
+			report.Rows = append(report.Rows, RemovedRow{Line: validations[i].Line})
+		}
+	}
+
+	kept := records[:0:0]
+	byTrack := make(map[string]RowValidation, len(records)-report.Removed)
+	for i, record := range records {
+		if removed[i] {
+			continue
+		}
+		kept = append(kept, record)
+		// Keep the last row of a Track ID used by several, as processCSV
+		if v, ok := byTrack[validations[i].TrackID]; !ok || v.Line < validations[i].Line {
+			byTrack[validations[i].TrackID] = validations[i]
+		}
+	}
+	return kept, byTrack, report
+}
+
+// mergeDeduplication combines the deduplication of a dataset and of a part
+// appended to it
+func mergeDeduplication(deduplication, part *Deduplication, partNumber int) *Deduplication {
+	if part == nil {
+		return deduplication
+	}
+	if deduplication == nil {
+		deduplication = &Deduplication{Key: part.Key}
+	}
+	merged := &Deduplication{
+		Key:     deduplication.Key,
+		Removed: deduplication.Removed + part.Removed,
+		Rows:    append([]RemovedRow{}, deduplication.Rows...),
+	}
+	for _, row := range part.Rows {
+		if len(merged.Rows) == maxRemovedRows {
+			break
+		}
+		row.Part = partNumber
+		merged.Rows = append(merged.Rows, row)
+	}
+	return merged
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// delimiterSampleLines is how many leading lines are inspected to detect the
+// delimiter
+const delimiterSampleLines = 20
+
+// candidateDelimiters are the delimiters tried by detection, in order of
+// preference when they score equally
+var candidateDelimiters = []rune{',', '\t', ';', '|'}
+
+// delimiterNames are the names accepted by the delimiter form field and
+// reported in the job metadata
+var delimiterNames = map[string]rune{
+	"comma":     ',',
+	"tab":       '\t',
+	"semicolon": ';',
+	"pipe":      '|',
+}
+
+// parseDelimiter reads the delimiter form field: a name from delimiterNames,
+// a single character, or "auto" or "" for detection, reported as 0
+func parseDelimiter(value string) (rune, error) {
+	if value == "" || strings.EqualFold(value, "auto") {
+		return 0, nil
+	}
+	if value == `\t` {
+		return '\t', nil
+	}
+	if delimiter, ok := delimiterNames[strings.ToLower(value)]; ok {
+		return delimiter, nil
+	}
+	delimiter, size := utf8.DecodeRuneInString(value)
+	if size != len(value) || delimiter == '"' || delimiter == '\r' || delimiter == '\n' || delimiter == utf8.RuneError {
+		return 0, fmt.Errorf("expected comma, tab, semicolon, pipe, auto or a single character, got %q", value)
+	}
+	return delimiter, nil
+}
+
+// delimiterName returns the name of a delimiter for the job metadata
+func delimiterName(delimiter rune) string {
+	for name, d := range delimiterNames {
+		if d == delimiter {
+			return name
+		}
+	}
+	return string(delimiter)
+}
+
+// detectDelimiter guesses the delimiter from the start of the file without
+// consuming it. Each candidate is scored by how many sample lines contain
+// it the same, non-zero number of times outside quotes; the best score
+// wins, preferring commas. Files that give no signal are read as commas.
+func detectDelimiter(reader *bufio.Reader) rune {
+	sample, _ := reader.Peek(reader.Size())
+	lines := bytes.Split(sample, []byte("\n"))
+	if len(lines) > 1 {
+		// The last line may be cut short by the sample size
+		lines = lines[:len(lines)-1]
+	}
+	if len(lines) > delimiterSampleLines {
+		lines = lines[:delimiterSampleLines]
+	}
+
+	best, bestScore := ',', 0
+	for _, candidate := range candidateDelimiters {
+		frequency := make(map[int]int)
+		for _, line := range lines {
+			if n := countUnquoted(line, candidate); n > 0 {
+				frequency[n]++
+			}
+		}
+		score := 0
+		for _, lines := range frequency {
+			score = max(score, lines)
+		}
+		if score > bestScore {
+			best, bestScore = candidate, score
+		}
+	}
+	return best
+}
+
+// countUnquoted counts occurrences of the delimiter in a line outside
+// double-quoted fields
+func countUnquoted(line []byte, delimiter rune) int {
+	count, quoted := 0, false
+	for _, r := range string(line) {
+		switch {
+		case r == '"':
+			quoted = !quoted
+		case r == delimiter && !quoted:
+			count++
+		}
+	}
+	return count
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ErrDeliveryNotFound is returned for unknown parked deliveries
+var ErrDeliveryNotFound = errors.New("delivery not found")
+
+// Sinks whose failed deliveries are parked
+const (
+	SinkJobWebhook   = "job_webhook"
+	SinkNotification = "notification"
+	SinkDigest       = "digest"
+)
+
+// maxDeliveryBackoff caps the wait between attempts to re-drive a parked
+// delivery
+const maxDeliveryBackoff = 6 * time.Hour
+
+// Delivery is a payload posted to a downstream webhook. Deliveries still
+// failing after DELIVERY_RETRIES retries are parked in the job store and
+// re-driven until they succeed or an admin drops them.
+type Delivery struct {
+	ID     string `json:"id"`
+	Sink   string `json:"sink"`
+	URL    string `json:"url"`
+	JobID  string `json:"job_id,omitempty"`
+	Tenant string `json:"tenant,omitempty"`
+
+	// Payload is the JSON body posted, left out of delivery lists
+	Payload json.RawMessage `json:"payload,omitempty"`
+
+	Attempts      int       `json:"attempts"`
+	LastError     string    `json:"last_error,omitempty"`
+	CreatedAt     time.Time `json:"created_at"`
+	LastAttemptAt time.Time `json:"last_attempt_at"`
+	NextAttemptAt time.Time `json:"next_attempt_at"`
+}
+
+// deliveryClient posts deliveries
+var deliveryClient = &http.Client{Timeout: 30 * time.Second}
+
+// deliver posts a payload to a sink in the background, retrying a few times
+// and parking it for later if it still fails
+func deliver(d *Delivery) {
+	d.CreatedAt = time.Now()
+	go func() {
+		var err error
+		for attempt := 0; ; attempt++ {
+			d.Attempts++
+			d.LastAttemptAt = time.Now()
+			if err = d.post(); err == nil || attempt >= cfg.DeliveryRetries {
+				break
+			}
+			time.Sleep(time.Duration(attempt+1) * time.Second)
+		}
+		if err != nil {
+			park(d, err)
+		}
+	}()
+}
+
+// post makes a single attempt at a delivery
+func (d *Delivery) post() error {
+	resp, err := deliveryClient.Post(d.URL, "application/json", bytes.NewReader(d.Payload))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
+
+// park stores a failed delivery to be re-driven later
+func park(d *Delivery, err error) {
+	if d.ID == "" {
+		d.ID = newJobID()
+	}
+	d.LastError = err.Error()
+	d.NextAttemptAt = d.LastAttemptAt.Add(deliveryBackoff(d.Attempts))
+	if saveErr := jobStore.SaveDelivery(d); saveErr != nil {
+		log.Printf("Failed to park %s delivery for job %s, it is lost: %v (delivery failed: %v)", d.Sink, d.JobID, saveErr, err)
+		return
+	}
+	log.Printf("Parked %s delivery %s for job %s after %d attempts: %v", d.Sink, d.ID, d.JobID, d.Attempts, err)
+}
+
+// deliveryBackoff is the wait before re-driving a parked delivery after
+// the given number of attempts, doubling from the retry interval
+func deliveryBackoff(attempts int) time.Duration {
+	backoff := max(cfg.DeliveryRetryInterval, time.Minute)
+	for i := cfg.DeliveryRetries + 1; i < attempts && backoff < maxDeliveryBackoff; i++ {
+		backoff *= 2
+	}
+	return min(backoff, maxDeliveryBackoff)
+}
+
+// redriving holds the IDs of the parked deliveries being re-driven, so the
+// retrier and admins never post one twice at once
+var (
+	redriving   = make(map[string]bool)
+	redrivingMu sync.Mutex
+)
+
+// redrive makes one attempt at a parked delivery, removing it once
+// delivered and parking it again otherwise
+func redrive(d *Delivery) error {
+	redrivingMu.Lock()
+	if redriving[d.ID] {
+		redrivingMu.Unlock()
+		return errors.New("delivery is already being re-driven")
+	}
+	redriving[d.ID] = true
+	redrivingMu.Unlock()
+	defer func() {
+		redrivingMu.Lock()
+		delete(redriving, d.ID)
+		redrivingMu.Unlock()
+	}()
+
+	d.Attempts++
+	d.LastAttemptAt = time.Now()
+	if err := d.post(); err != nil {
+		park(d, err)
+		return err
+	}
+	if err := jobStore.DeleteDelivery(d.ID); err != nil && !errors.Is(err, ErrDeliveryNotFound) {
+		log.Printf("Failed to remove delivered %s delivery %s: %v", d.Sink, d.ID, err)
+	}
+	log.Printf("Delivered parked %s delivery %s for job %s after %d attempts", d.Sink, d.ID, d.JobID, d.Attempts)
+	return nil
+}
+
+// runDeliveryRetrier re-drives parked deliveries as they fall due
+func runDeliveryRetrier() {
+	for {
+		time.Sleep(cfg.DeliveryRetryInterval)
+		deliveries, err := jobStore.ListDeliveries()
+		if err != nil {
+			log.Printf("Failed to list parked deliveries: %v", err)
+			continue
+		}
+		for _, d := range deliveries {
+			if time.Now().Before(d.NextAttemptAt) {
+				continue
+			}
+			redrive(d)
+		}
+	}
+}
+
+// sortDeliveries orders deliveries oldest first
+func sortDeliveries(list []*Delivery) {
+	sort.Slice(list, func(i, j int) bool {
+		if !list[i].CreatedAt.Equal(list[j].CreatedAt) {
+			return list[i].CreatedAt.Before(list[j].CreatedAt)
+		}
+		return list[i].ID < list[j].ID
+	})
+}
+
+// DeliveryOutcome is the result of re-driving a parked delivery
+type DeliveryOutcome struct {
+	ID        string `json:"id"`
+	Delivered bool   `json:"delivered"`
+	Error     string `json:"error,omitempty"`
+}
+
+// deliveriesHandler lists the parked deliveries, oldest first, without
+// their payloads
+func deliveriesHandler(w http.ResponseWriter, r *http.Request) {
+	if !isAdmin(r) {
+		http.Error(w, "Admin token required", http.StatusForbidden)
+		return
+	}
+	deliveries, err := jobStore.ListDeliveries()
+	if err != nil {
+		http.Error(w, "Failed to list deliveries: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	for _, d := range deliveries {
+		d.Payload = nil
+	}
+	writeJSON(w, struct {
+		Deliveries []*Delivery `json:"deliveries"`
+	}{Deliveries: deliveries})
+}
+
+// deliveryHandler returns a parked delivery with its payload
+func deliveryHandler(w http.ResponseWriter, r *http.Request) {
+	if !isAdmin(r) {
+		http.Error(w, "Admin token required", http.StatusForbidden)
+		return
+	}
+	d, ok := getDelivery(w, r.PathValue("id"))
+	if !ok {
+		return
+	}
+	writeJSON(w, d)
+}
+
+// retryDeliveryHandler re-drives a parked delivery now. It is removed if
+// delivered and otherwise stays parked with the new error.
+func retryDeliveryHandler(w http.ResponseWriter, r *http.Request) {
+	if !isAdmin(r) {
+		http.Error(w, "Admin token required", http.StatusForbidden)
+		return
+	}
+	d, ok := getDelivery(w, r.PathValue("id"))
+	if !ok {
+		return
+	}
+	outcome := DeliveryOutcome{ID: d.ID, Delivered: true}
+	if err := redrive(d); err != nil {
+		outcome = DeliveryOutcome{ID: d.ID, Error: err.Error()}
+	}
+	writeJSON(w, outcome)
+}
+
+// retryDeliveriesHandler re-drives every parked delivery now, optionally
+// only those of a sink (?sink=) or a job (?job_id=)
+func retryDeliveriesHandler(w http.ResponseWriter, r *http.Request) {
+	if !isAdmin(r) {
+		http.Error(w, "Admin token required", http.StatusForbidden)
+		return
+	}
+	deliveries, err := jobStore.ListDeliveries()
+	if err != nil {
+		http.Error(w, "Failed to list deliveries: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	sink, jobID := r.URL.Query().Get("sink"), r.URL.Query().Get("job_id")
+	outcomes := []DeliveryOutcome{}
+	for _, d := range deliveries {
+		if (sink != "" && d.Sink != sink) || (jobID != "" && d.JobID != jobID) {
+			continue
+		}
+		outcome := DeliveryOutcome{ID: d.ID, Delivered: true}
+		if err := redrive(d); err != nil {
+			outcome = DeliveryOutcome{ID: d.ID, Error: err.Error()}
+		}
+		outcomes = append(outcomes, outcome)
+	}
+	writeJSON(w, struct {
+		Deliveries []DeliveryOutcome `json:"deliveries"`
+	}{Deliveries: outcomes})
+}
+
+// deleteDeliveryHandler drops a parked delivery without delivering it
+func deleteDeliveryHandler(w http.ResponseWriter, r *http.Request) {
+	if !isAdmin(r) {
+		http.Error(w, "Admin token required", http.StatusForbidden)
+		return
+	}
+	err := jobStore.DeleteDelivery(r.PathValue("id"))
+	if errors.Is(err, ErrDeliveryNotFound) {
+		http.Error(w, "Delivery not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to delete delivery: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// getDelivery reads a parked delivery, writing the error response if it
+// cannot
+func getDelivery(w http.ResponseWriter, id string) (*Delivery, bool) {
+	d, err := jobStore.GetDelivery(id)
+	if errors.Is(err, ErrDeliveryNotFound) {
+		http.Error(w, "Delivery not found", http.StatusNotFound)
+		return nil, false
+	}
+	if err != nil {
+		http.Error(w, "Failed to get delivery: "+err.Error(), http.StatusInternalServerError)
+		return nil, false
+	}
+	return d, true
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"unicode/utf8"
+)
+
+// maxDialectDeviations limits how many deviations a dialect report lists
+const maxDialectDeviations = 20
+
+// Dialect describes how a delimited text file is written, and where rows
+// deviate from it
+type Dialect struct {
+	Delimiter string `json:"delimiter"`
+
+	// Quoting is "all" if every field is quoted, "minimal" if only some
+	// are and "none" if none are
+	Quoting string `json:"quoting"`
+
+	// LineEndings is "crlf", "lf" or "cr", or "mixed" if records end in
+	// more than one way
+	LineEndings string `json:"line_endings"`
+
+	BOM bool `json:"bom,omitempty"`
+
+	// Header reports whether the header row names known columns; if not,
+	// the first row was taken for the header
+	Header  bool `json:"header"`
+	Columns int  `json:"columns"`
+
+	// Deviations are changes of line endings or quoting and rows of the
+	// wrong width, by line
+	Deviations []string `json:"deviations,omitempty"`
+}
+
+// dialectRecord is a record as it was written
+type dialectRecord struct {
+	line   int
+	fields int
+	quoted int
+	ending string
+}
+
+// dialectScanner works out the dialect of delimited text written to it, as
+// the CSV reader consumes it. Records are told apart as the CSV reader
+// does, so quoted fields may span lines.
+type dialectScanner struct {
+	delimiter []byte
+	started   bool
+	bom       bool
+
+	// Scanning state
+	line        int
+	inQuotes    bool
+	quoteClosed bool
+	fieldStart  bool
+	pendingCR   bool
+	recent      []byte
+	record      dialectRecord
+	empty       bool
+
+	// Records before the header is known, and the header
+	pending    []dialectRecord
+	headerLine int
+	columns    int
+	header     bool
+
+	// Findings over the records after the header
+	endings      map[string]bool
+	ending       string
+	allQuoted    *bool
+	anyQuoted    bool
+	deviations   []string
+	moreDeviated int
+}
+
+// newDialectScanner creates a scanner of text delimited by delimiter
+func newDialectScanner(delimiter rune) *dialectScanner {
+	return &dialectScanner{
+		delimiter:  utf8.AppendRune(nil, delimiter),
+		line:       1,
+		fieldStart: true,
+		empty:      true,
+		record:     dialectRecord{line: 1, fields: 1},
+		headerLine: -1,
+		endings:    make(map[string]bool),
+	}
+}
+
+// Write scans the next part of the text
+func (d *dialectScanner) Write(p []byte) (int, error) {
+	data := p
+	if !d.started {
+		d.started = true
+		if rest, ok := bytes.CutPrefix(data, []byte("\xef\xbb\xbf")); ok {
+			d.bom = true
+			data = rest
+		}
+	}
+	for _, c := range data {
+		d.scan(c)
+	}
+	return len(p), nil
+}
+
+// scan advances over one byte
+func (d *dialectScanner) scan(c byte) {
+	afterCR := d.pendingCR
+	if afterCR {
+		d.pendingCR = false
+		if c != '\n' {
+			d.endRecord("cr")
+		}
+	}
+	if d.inQuotes {
+		switch {
+		case d.quoteClosed && c == '"':
+			// A doubled quote stands for a quote
+			d.quoteClosed = false
+		case d.quoteClosed:
+			d.inQuotes, d.quoteClosed = false, false
+		case c == '"':
+			d.quoteClosed = true
+		}
+		if d.inQuotes {
+			if c == '\n' {
+				d.line++
+			}
+			return
+		}
+	}
+
+	d.recent = append(d.recent, c)
+	if len(d.recent) > len(d.delimiter) {
+		d.recent = d.recent[1:]
+	}
+	switch {
+	case c == '\n':
+		ending := "lf"
+		if afterCR {
+			ending = "crlf"
+		}
+		d.endRecord(ending)
+		d.line++
+		d.record.line = d.line
+	case c == '\r':
+		d.pendingCR = true
+	case bytes.Equal(d.recent, d.delimiter):
+		d.record.fields++
+		d.fieldStart = true
+		d.empty = false
+	case c == '"' && d.fieldStart:
+		d.inQuotes = true
+		d.record.quoted++
+		d.fieldStart = false
+		d.empty = false
+	default:
+		d.fieldStart = false
+		d.empty = false
+	}
+}
+
+// endRecord finishes the record being scanned. Empty lines are skipped, as
+// the CSV reader skips them.
+func (d *dialectScanner) endRecord(ending string) {
+	record := d.record
+	record.ending = ending
+	d.record = dialectRecord{line: d.line, fields: 1}
+	d.fieldStart = true
+	d.recent = d.recent[:0]
+	if d.empty {
+		return
+	}
+	d.empty = true
+	if d.headerLine < 0 {
+		d.pending = append(d.pending, record)
+		return
+	}
+	d.check(record)
+}
+
+// setHeader tells the scanner which line holds the header, how many
+// columns it has and whether it names known columns. Records above it are
+// not part of the table.
+func (d *dialectScanner) setHeader(line, columns int, known bool) {
+	d.headerLine, d.columns, d.header = line, columns, known
+	for _, record := range d.pending {
+		d.check(record)
+	}
+	d.pending = nil
+}
+
+// check compares a record with the dialect so far
+func (d *dialectScanner) check(record dialectRecord) {
+	if record.line < d.headerLine {
+		return
+	}
+
+	if record.ending != "" {
+		if d.ending != "" && record.ending != d.ending {
+			d.deviate("line endings switch from %s to %s at line %d", endingName(d.ending), endingName(record.ending), record.line)
+		}
+		d.ending = record.ending
+		d.endings[record.ending] = true
+	}
+	if record.line == d.headerLine {
+		return
+	}
+
+	if record.fields != d.columns {
+		d.deviate("line %d has %d fields instead of %d", record.line, record.fields, d.columns)
+	}
+	all := record.quoted == record.fields
+	d.anyQuoted = d.anyQuoted || record.quoted > 0
+	if d.allQuoted != nil && *d.allQuoted != all {
+		from, to := "every field", "only some fields"
+		if all {
+			from, to = to, from
+		}
+		d.deviate("quoting switches from %s to %s at line %d", from, to, record.line)
+	}
+	if d.allQuoted == nil || *d.allQuoted {
+		d.allQuoted = &all
+	}
+}
+
+// deviate records a deviation, counting those beyond the limit
+func (d *dialectScanner) deviate(format string, args ...interface{}) {
+	if len(d.deviations) >= maxDialectDeviations {
+		d.moreDeviated++
+		return
+	}
+	d.deviations = append(d.deviations, fmt.Sprintf(format, args...))
+}
+
+// report finishes scanning and returns the dialect found
+func (d *dialectScanner) report(delimiter string) *Dialect {
+	if d.pendingCR {
+		d.pendingCR = false
+		d.endRecord("cr")
+	} else {
+		// The last record may end without a line break
+		d.endRecord("")
+	}
+	if d.headerLine < 0 {
+		d.setHeader(1, 0, false)
+	}
+
+	dialect := &Dialect{
+		Delimiter:   delimiter,
+		Quoting:     "none",
+		LineEndings: d.ending,
+		BOM:         d.bom,
+		Header:      d.header,
+		Columns:     d.columns,
+		Deviations:  d.deviations,
+	}
+	switch {
+	case d.allQuoted != nil && *d.allQuoted:
+		dialect.Quoting = "all"
+	case d.anyQuoted:
+		dialect.Quoting = "minimal"
+	}
+	if len(d.endings) > 1 {
+		dialect.LineEndings = "mixed"
+	}
+	if d.moreDeviated > 0 {
+		dialect.Deviations = append(dialect.Deviations, fmt.Sprintf("%d further deviations not listed", d.moreDeviated))
+	}
+	return dialect
+}
+
+// endingName names a line ending in deviations
+func endingName(ending string) string {
+	switch ending {
+	case "crlf":
+		return "CRLF"
+	case "cr":
+		return "CR"
+	}
+	return "LF"
+}
+
+// knownHeader reports whether a header row names known columns, as
+// findHeader recognises header rows
+func knownHeader(headers, known []string) bool {
+	knownNames := make(map[string]bool, len(known))
+	for _, column := range known {
+		knownNames[normalizeColumnName(column)] = true
+	}
+	matches := 0
+	for _, field := range headers {
+		if knownNames[normalizeColumnName(field)] {
+			matches++
+		}
+	}
+	return matches > 0 && matches >= min(2, len(knownNames))
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// maxDictionaryRequestSize limits the size of a dictionary body
+const maxDictionaryRequestSize = 4 << 20
+
+// maxDictionaryEntries limits the number of variants a dictionary maps
+const maxDictionaryEntries = 100000
+
+// ErrDictionaryNotFound is returned for tenants without a dictionary
+var ErrDictionaryNotFound = errors.New("tenant has no dictionary")
+
+// dictionaryColumns are the columns canonicalized by a tenant's dictionary
+var dictionaryColumns = []string{"Artist Name", "Label Name", "Rights Holder"}
+
+// Dictionary maps variants of artist and label names, as operators enter
+// them, to the tenant's canonical names. Variants match regardless of case
+// and spacing.
+type Dictionary struct {
+	Tenant    string            `json:"tenant"`
+	Entries   map[string]string `json:"entries"`
+	UpdatedAt time.Time         `json:"updated_at"`
+}
+
+// Substitution reports a variant replaced by its canonical name in a
+// column, and in how many rows
+type Substitution struct {
+	Column string `json:"column"`
+	From   string `json:"from"`
+	To     string `json:"to"`
+	Rows   int    `json:"rows"`
+}
+
+// dictionaryKey is the form variants are matched in
+func dictionaryKey(name string) string {
+	return strings.ToLower(strings.Join(strings.Fields(name), " "))
+}
+
+// canonicalizer replaces variants with canonical names
+type canonicalizer map[string]string
+
+// canonicalizer returns the dictionary's variants by their matching form
+func (d *Dictionary) canonicalizer() canonicalizer {
+	if d == nil || len(d.Entries) == 0 {
+		return nil
+	}
+	c := make(canonicalizer, len(d.Entries))
+	for variant, canonical := range d.Entries {
+		c[dictionaryKey(variant)] = canonical
+	}
+	return c
+}
+
+// apply replaces the variants in a record's name columns with their
+// canonical names and returns the substitutions made
+func (c canonicalizer) apply(record map[string]string) []Substitution {
+	var substitutions []Substitution
+	for _, column := range dictionaryColumns {
+		value, ok := record[column]
+		if !ok || value == "" {
+			continue
+		}
+		canonical, ok := c[dictionaryKey(value)]
+		if !ok || canonical == value {
+			continue
+		}
+		record[column] = canonical
+		substitutions = append(substitutions, Substitution{Column: column, From: value, To: canonical, Rows: 1})
+	}
+	return substitutions
+}
+
+// substitutionCounts totals the substitutions made across rows
+type substitutionCounts map[Substitution]int
+
+func (s substitutionCounts) add(substitutions []Substitution) {
+	for _, sub := range substitutions {
+		rows := sub.Rows
+		sub.Rows = 0
+		s[sub] += rows
+	}
+}
+
+// report lists the substitutions, most frequent first
+func (s substitutionCounts) report() []Substitution {
+	if len(s) == 0 {
+		return nil
+	}
+	list := make([]Substitution, 0, len(s))
+	for sub, rows := range s {
+		sub.Rows = rows
+		list = append(list, sub)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		a, b := list[i], list[j]
+		if a.Rows != b.Rows {
+			return a.Rows > b.Rows
+		}
+		if a.Column != b.Column {
+			return a.Column < b.Column
+		}
+		return a.From < b.From
+	})
+	return list
+}
+
+// mergeSubstitutions combines the substitutions reported for two parts of
+// a dataset
+func mergeSubstitutions(a, b []Substitution) []Substitution {
+	counts := make(substitutionCounts)
+	counts.add(a)
+	counts.add(b)
+	return counts.report()
+}
+
+// recountSubstitutions returns the substitutions still applying to rows,
+// as after some were purged: each is limited to the rows holding its
+// canonical name, and dropped when none does. Which variant a row held is
+// not kept, so the counts are upper bounds.
+func recountSubstitutions(substitutions []Substitution, rows []map[string]string) []Substitution {
+	if len(substitutions) == 0 {
+		return substitutions
+	}
+	holding := make(map[[2]string]int)
+	for _, row := range rows {
+		for _, column := range dictionaryColumns {
+			if value := row[column]; value != "" {
+				holding[[2]string{column, value}]++
+			}
+		}
+	}
+	counts := make(substitutionCounts)
+	for _, sub := range substitutions {
+		if rows := holding[[2]string{sub.Column, sub.To}]; rows > 0 {
+			sub.Rows = min(sub.Rows, rows)
+			counts.add([]Substitution{sub})
+		}
+	}
+	return counts.report()
+}
+
+// tenantDictionary returns a tenant's dictionary, or nil if it has none
+func tenantDictionary(tenant string) (*Dictionary, error) {
+	dictionary, err := jobStore.GetDictionary(tenant)
+	if errors.Is(err, ErrDictionaryNotFound) {
+		return nil, nil
+	}
+	return dictionary, err
+}
+
+// dictionaryHandler returns a tenant's dictionary
+func dictionaryHandler(w http.ResponseWriter, r *http.Request) {
+	if !isAdmin(r) {
+		http.Error(w, "Admin token required", http.StatusForbidden)
+		return
+	}
+	dictionary, err := jobStore.GetDictionary(r.PathValue("tenant"))
+	if errors.Is(err, ErrDictionaryNotFound) {
+		http.Error(w, "Tenant has no dictionary", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to get dictionary: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, dictionary)
+}
+
+// putDictionaryHandler creates or replaces a tenant's dictionary
+func putDictionaryHandler(w http.ResponseWriter, r *http.Request) {
+	if !isAdmin(r) {
+		http.Error(w, "Admin token required", http.StatusForbidden)
+		return
+	}
+	tenant := r.PathValue("tenant")
+	if !tenantRegex.MatchString(tenant) {
+		http.Error(w, "Invalid tenant: "+tenant, http.StatusBadRequest)
+		return
+	}
+
+	var dictionary Dictionary
+	r.Body = http.MaxBytesReader(w, r.Body, maxDictionaryRequestSize)
+	if err := decodeJSON(r.Body, "dictionary-request.json", &dictionary); err != nil {
+		writeError(w, "Invalid dictionary: ", err)
+		return
+	}
+	if len(dictionary.Entries) > maxDictionaryEntries {
+		http.Error(w, fmt.Sprintf("Invalid dictionary: at most %d entries are allowed", maxDictionaryEntries), http.StatusBadRequest)
+		return
+	}
+
+	// Variants differing only in case or spacing must agree, and no
+	// canonical name may itself be a variant of another
+	entries := make(map[string]string, len(dictionary.Entries))
+	seen := make(map[string]string, len(dictionary.Entries))
+	for _, variant := range sortedKeys(dictionary.Entries) {
+		canonical := strings.TrimSpace(dictionary.Entries[variant])
+		key := dictionaryKey(variant)
+		if key == "" || canonical == "" {
+			http.Error(w, "Invalid dictionary: variants and canonical names must not be empty", http.StatusBadRequest)
+			return
+		}
+		if other, ok := seen[key]; ok && dictionary.Entries[other] != dictionary.Entries[variant] {
+			http.Error(w, fmt.Sprintf("Invalid dictionary: %q and %q map to different names", other, variant), http.StatusBadRequest)
+			return
+		}
+		seen[key] = variant
+		entries[strings.TrimSpace(variant)] = canonical
+	}
+	for variant, canonical := range entries {
+		if other, ok := seen[dictionaryKey(canonical)]; ok && dictionaryKey(dictionary.Entries[other]) != dictionaryKey(canonical) {
+			http.Error(w, fmt.Sprintf("Invalid dictionary: %q maps to %q, which is itself a variant", variant, canonical), http.StatusBadRequest)
+			return
+		}
+	}
+	dictionary.Tenant = tenant
+	dictionary.Entries = entries
+	dictionary.UpdatedAt = time.Now().UTC()
+
+	if err := jobStore.SaveDictionary(&dictionary); err != nil {
+		http.Error(w, "Failed to save dictionary: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Updated dictionary of tenant %s with %d entries", tenant, len(entries))
+	writeJSON(w, dictionary)
+}
+
+// deleteDictionaryHandler removes a tenant's dictionary
+func deleteDictionaryHandler(w http.ResponseWriter, r *http.Request) {
+	if !isAdmin(r) {
+		http.Error(w, "Admin token required", http.StatusForbidden)
+		return
+	}
+	err := jobStore.DeleteDictionary(r.PathValue("tenant"))
+	if errors.Is(err, ErrDictionaryNotFound) {
+		http.Error(w, "Tenant has no dictionary", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to delete dictionary: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/smtp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// topFailureCount is how many failing checks are listed per tenant
+const topFailureCount = 5
+
+// Digest aggregates the jobs processed during a reporting period per tenant
+type Digest struct {
+	Period  string         `json:"period"`
+	From    time.Time      `json:"from"`
+	To      time.Time      `json:"to"`
+	Tenants []TenantDigest `json:"tenants"`
+}
+
+// TenantDigest is the activity of one tenant during a digest period
+type TenantDigest struct {
+	Tenant         string         `json:"tenant"`
+	Jobs           int            `json:"jobs"`
+	FailedJobs     int            `json:"failed_jobs"`
+	Rows           int            `json:"rows"`
+	FailedRows     int            `json:"failed_rows"`
+	RowFailureRate float64        `json:"row_failure_rate"`
+	TopFailures    []FailureCount `json:"top_failures,omitempty"`
+}
+
+// FailureCount is the number of rows failing a validation check
+type FailureCount struct {
+	Check string `json:"check"`
+	Count int    `json:"count"`
+}
+
+// Digest periods, by their canonical names
+const (
+	periodDaily  = "daily"
+	periodWeekly = "weekly"
+)
+
+// periodLength returns the canonical name of a digest period, daily or
+// weekly, and the duration it covers
+func periodLength(period string) (string, time.Duration, error) {
+	switch period {
+	case periodDaily, "day":
+		return periodDaily, 24 * time.Hour, nil
+	case periodWeekly, "week":
+		return periodWeekly, 7 * 24 * time.Hour, nil
+	}
+	return "", 0, fmt.Errorf("unknown period %q, expected daily or weekly", period)
+}
+
+// buildDigest aggregates the stored jobs created within the period ending at
+// to. Only jobs still retained by the job store are included.
+func buildDigest(period string, to time.Time) (*Digest, error) {
+	period, length, err := periodLength(period)
+	if err != nil {
+		return nil, err
+	}
+	from := to.Add(-length)
+
+	jobs, err := jobStore.ListJobs(0)
+	if err != nil {
+		return nil, err
+	}
+
+	tenants := make(map[string]*TenantDigest)
+	failures := make(map[string]map[string]int)
+	for _, job := range jobs {
+		if job.CreatedAt.Before(from) || !job.CreatedAt.Before(to) || job.Active() {
+			continue
+		}
+		tenant := job.Tenant
+		if tenant == "" {
+			tenant = defaultTenant
+		}
+		td, ok := tenants[tenant]
+		if !ok {
+			td = &TenantDigest{Tenant: tenant}
+			tenants[tenant] = td
+			failures[tenant] = make(map[string]int)
+		}
+		td.Jobs++
+		if job.Status == JobFailed {
+			td.FailedJobs++
+		}
+		td.Rows += job.ProcessedRows
+		td.FailedRows += job.FailedRows
+		for check, count := range job.Failures {
+			failures[tenant][check] += count
+		}
+	}
+
+	digest := &Digest{Period: period, From: from, To: to, Tenants: []TenantDigest{}}
+	for name, td := range tenants {
+		if td.Rows > 0 {
+			td.RowFailureRate = float64(td.FailedRows) / float64(td.Rows)
+		}
+		for check, count := range failures[name] {
+			td.TopFailures = append(td.TopFailures, FailureCount{Check: check, Count: count})
+		}
+		sort.Slice(td.TopFailures, func(i, j int) bool {
+			if td.TopFailures[i].Count != td.TopFailures[j].Count {
+				return td.TopFailures[i].Count > td.TopFailures[j].Count
+			}
+			return td.TopFailures[i].Check < td.TopFailures[j].Check
+		})
+		if len(td.TopFailures) > topFailureCount {
+			td.TopFailures = td.TopFailures[:topFailureCount]
+		}
+		digest.Tenants = append(digest.Tenants, *td)
+	}
+	sort.Slice(digest.Tenants, func(i, j int) bool {
+		return digest.Tenants[i].Tenant < digest.Tenants[j].Tenant
+	})
+	return digest, nil
+}
+
+// Text renders the digest as a plain-text report for email
+func (d *Digest) Text() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "CSV Processor %s digest\n", d.Period)
+	fmt.Fprintf(&b, "%s to %s\n\n", d.From.Format(time.RFC1123), d.To.Format(time.RFC1123))
+	if len(d.Tenants) == 0 {
+		b.WriteString("No jobs were processed in this period.\n")
+	}
+	for _, td := range d.Tenants {
+		fmt.Fprintf(&b, "%s\n", td.Tenant)
+		fmt.Fprintf(&b, "  Jobs: %d (%d failed)\n", td.Jobs, td.FailedJobs)
+		fmt.Fprintf(&b, "  Rows: %d (%d failing validation, %.1f%%)\n", td.Rows, td.FailedRows, td.RowFailureRate*100)
+		for _, f := range td.TopFailures {
+			fmt.Fprintf(&b, "  - %s: %d rows\n", f.Check, f.Count)
+		}
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+// deliverDigest sends the digest to the configured webhook and email
+// recipients. The webhook is posted in the background, and parked for
+// retry if it fails.
+func deliverDigest(d *Digest) error {
+	var errs []string
+
+	if cfg.DigestWebhookURL != "" {
+		payload, err := json.Marshal(d)
+		if err != nil {
+			return err
+		}
+		deliver(&Delivery{Sink: SinkDigest, URL: cfg.DigestWebhookURL, Payload: payload})
+	}
+
+	if cfg.SMTPAddr != "" && len(cfg.DigestEmailTo) > 0 {
+		if err := sendDigestEmail(d); err != nil {
+			errs = append(errs, fmt.Sprintf("email: %v", err))
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("failed to deliver digest: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// sendDigestEmail mails the plain-text digest through the configured SMTP server
+func sendDigestEmail(d *Digest) error {
+	var auth smtp.Auth
+	if cfg.SMTPUsername != "" {
+		host := cfg.SMTPAddr
+		if i := strings.LastIndex(host, ":"); i >= 0 {
+			host = host[:i]
+		}
+		auth = smtp.PlainAuth("", cfg.SMTPUsername, cfg.SMTPPassword, host)
+	}
+
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", cfg.DigestEmailFrom)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(cfg.DigestEmailTo, ", "))
+	fmt.Fprintf(&msg, "Subject: CSV Processor %s digest for %s\r\n", d.Period, d.To.Format("2006-01-02"))
+	msg.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	msg.WriteString(strings.ReplaceAll(d.Text(), "\n", "\r\n"))
+
+	return smtp.SendMail(cfg.SMTPAddr, auth, cfg.DigestEmailFrom, cfg.DigestEmailTo, msg.Bytes())
+}
+
+// nextDigestRun returns the next scheduled digest time after now: the
+// configured UTC hour every day, or on Mondays for weekly digests. period
+// is a canonical name, as returned by periodLength.
+func nextDigestRun(now time.Time, period string, hour int) time.Time {
+	now = now.UTC()
+	next := time.Date(now.Year(), now.Month(), now.Day(), hour, 0, 0, 0, time.UTC)
+	for !next.After(now) || (period == periodWeekly && next.Weekday() != time.Monday) {
+		next = next.AddDate(0, 0, 1)
+	}
+	return next
+}
+
+// runDigestScheduler builds and delivers a digest on the configured schedule
+func runDigestScheduler() {
+	period, _, err := periodLength(cfg.DigestSchedule)
+	if err != nil {
+		log.Printf("Digest reports disabled: %v", err)
+		return
+	}
+	for {
+		next := nextDigestRun(time.Now(), period, cfg.DigestHour)
+		log.Printf("Next %s digest at %s", period, next.Format(time.RFC3339))
+		time.Sleep(time.Until(next))
+
+		digest, err := buildDigest(period, next)
+		if err != nil {
+			log.Printf("Failed to build digest: %v", err)
+			continue
+		}
+		if err := deliverDigest(digest); err != nil {
+			log.Print(err)
+		}
+	}
+}
+
+// digestHandler returns the digest for the period ending now, e.g.
+// GET /reports/digest?period=weekly
+func digestHandler(w http.ResponseWriter, r *http.Request) {
+	period := r.URL.Query().Get("period")
+	if period == "" {
+		period = periodDaily
+	}
+	if _, _, err := periodLength(period); err != nil {
+		http.Error(w, "Invalid period: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	digest, err := buildDigest(period, time.Now().UTC())
+	if err != nil {
+		http.Error(w, "Failed to build digest: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, digest)
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"mime"
+	"net/http"
+	"time"
+)
+
+// serveDownload writes a generated file with a content-derived ETag. Range
+// and If-Range requests are honoured, so an interrupted download resumes
+// where it stopped as long as the content is unchanged, and If-None-Match
+// requests for unchanged content get 304 Not Modified.
+//
+// filename, if set, is offered as the name to save the file under.
+func serveDownload(w http.ResponseWriter, r *http.Request, filename, contentType string, data []byte) {
+	sum := sha256.Sum256(data)
+	w.Header().Set("ETag", `"`+hex.EncodeToString(sum[:16])+`"`)
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Expose-Headers", "ETag, Content-Range, Accept-Ranges, Content-Disposition")
+	if filename != "" {
+		w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": filename}))
+	}
+	http.ServeContent(w, r, filename, time.Time{}, bytes.NewReader(data))
+}
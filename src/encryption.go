@@ -0,0 +1,502 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+// encryptedPrefix marks an encrypted cell value
+const encryptedPrefix = "enc:v1:"
+
+// redactedValue replaces sensitive values for readers without access
+const redactedValue = "[encrypted]"
+
+// Encryption records how the sensitive columns of a stored result were
+// encrypted: the wrapped data key and the columns it covers
+type Encryption struct {
+	Key     string   `json:"key"`
+	Columns []string `json:"columns"`
+}
+
+// KeyWrapper protects the per-result data keys with a master key
+type KeyWrapper interface {
+	Wrap(key []byte) (string, error)
+	Unwrap(wrapped string) ([]byte, error)
+}
+
+// LocalKeyWrapper wraps data keys with AES-GCM under a master key read from
+// a local file
+type LocalKeyWrapper struct {
+	aead cipher.AEAD
+}
+
+// NewLocalKeyWrapper reads a 256-bit master key from path, given as 32 raw
+// bytes, 64 hex digits or base64
+func NewLocalKeyWrapper(path string) (*LocalKeyWrapper, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read key file: %v", err)
+	}
+	key := data
+	if len(key) != 32 {
+		text := strings.TrimSpace(string(data))
+		if key, err = hex.DecodeString(text); err != nil || len(key) != 32 {
+			key, err = base64.StdEncoding.DecodeString(text)
+		}
+		if err != nil || len(key) != 32 {
+			return nil, errors.New("key file must hold a 256-bit key as raw bytes, hex or base64")
+		}
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	return &LocalKeyWrapper{aead: aead}, nil
+}
+
+// Wrap encrypts a data key under the master key
+func (w *LocalKeyWrapper) Wrap(key []byte) (string, error) {
+	sealed, err := sealValue(w.aead, key)
+	if err != nil {
+		return "", err
+	}
+	return "local:" + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// Unwrap decrypts a data key wrapped by Wrap
+func (w *LocalKeyWrapper) Unwrap(wrapped string) ([]byte, error) {
+	encoded, ok := strings.CutPrefix(wrapped, "local:")
+	if !ok {
+		return nil, errors.New("data key was not wrapped with a local key")
+	}
+	sealed, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, err
+	}
+	return openValue(w.aead, sealed)
+}
+
+// VaultKeyWrapper wraps data keys with a HashiCorp Vault transit key, so the
+// master key never leaves the key management service
+type VaultKeyWrapper struct {
+	addr   string
+	token  string
+	key    string
+	client *http.Client
+}
+
+// NewVaultKeyWrapper creates a wrapper using the transit key named key on
+// the Vault server at addr
+func NewVaultKeyWrapper(addr, token, key string) *VaultKeyWrapper {
+	return &VaultKeyWrapper{
+		addr:   strings.TrimRight(addr, "/"),
+		token:  token,
+		key:    key,
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// Wrap encrypts a data key with the transit key
+func (w *VaultKeyWrapper) Wrap(key []byte) (string, error) {
+	var reply struct {
+		Data struct {
+			Ciphertext string `json:"ciphertext"`
+		} `json:"data"`
+	}
+	err := w.call("encrypt", map[string]string{"plaintext": base64.StdEncoding.EncodeToString(key)}, &reply)
+	if err != nil {
+		return "", err
+	}
+	return reply.Data.Ciphertext, nil
+}
+
+// Unwrap decrypts a data key with the transit key
+func (w *VaultKeyWrapper) Unwrap(wrapped string) ([]byte, error) {
+	var reply struct {
+		Data struct {
+			Plaintext string `json:"plaintext"`
+		} `json:"data"`
+	}
+	if err := w.call("decrypt", map[string]string{"ciphertext": wrapped}, &reply); err != nil {
+		return nil, err
+	}
+	return base64.StdEncoding.DecodeString(reply.Data.Plaintext)
+}
+
+// call posts a request to a transit endpoint and decodes the reply
+func (w *VaultKeyWrapper) call(operation string, body, reply interface{}) error {
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, w.addr+"/v1/transit/"+operation+"/"+w.key, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Vault-Token", w.token)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("vault: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("vault: %s returned %s", operation, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(reply)
+}
+
+// newKeyWrapper creates the key wrapper selected by the configuration, or
+// nil when field encryption is disabled
+func newKeyWrapper() KeyWrapper {
+	if len(cfg.EncryptColumns) == 0 {
+		return nil
+	}
+	switch {
+	case cfg.VaultAddr != "":
+		return NewVaultKeyWrapper(cfg.VaultAddr, cfg.VaultToken, cfg.VaultTransitKey)
+	case cfg.EncryptionKeyFile != "":
+		wrapper, err := NewLocalKeyWrapper(cfg.EncryptionKeyFile)
+		if err != nil {
+			log.Fatalf("Field encryption: %v", err)
+		}
+		return wrapper
+	}
+	log.Fatal("ENCRYPT_COLUMNS is set but neither ENCRYPTION_KEY_FILE nor VAULT_ADDR is configured")
+	return nil
+}
+
+// EncryptingJobStore encrypts the sensitive columns of results before they
+// reach the underlying store and decrypts them on the way back. Every
+// result gets its own data key, wrapped by the master key.
+type EncryptingJobStore struct {
+	JobStore
+	keys    KeyWrapper
+	columns []string
+}
+
+// NewEncryptingJobStore wraps store, encrypting the given columns
+func NewEncryptingJobStore(store JobStore, keys KeyWrapper, columns []string) *EncryptingJobStore {
+	return &EncryptingJobStore{JobStore: store, keys: keys, columns: columns}
+}
+
+// SaveResult stores a copy of the result with its sensitive columns
+// encrypted. The caller's result is left in plain text.
+func (s *EncryptingJobStore) SaveResult(id string, result *OutputFormat) error {
+	encrypted, err := s.encrypt(result)
+	if err != nil {
+		return err
+	}
+	return s.JobStore.SaveResult(id, encrypted)
+}
+
+// GetResult returns a result with its sensitive columns decrypted
+func (s *EncryptingJobStore) GetResult(id string) (*OutputFormat, error) {
+	stored, err := s.JobStore.GetResult(id)
+	if err != nil {
+		return nil, err
+	}
+	return s.decrypt(stored)
+}
+
+// SaveViews stores the views of a result with their sensitive columns
+// encrypted, each under a data key of its own
+func (s *EncryptingJobStore) SaveViews(id string, views map[string]*OutputFormat) error {
+	encrypted := make(map[string]*OutputFormat, len(views))
+	for name, view := range views {
+		var err error
+		if encrypted[name], err = s.encrypt(view); err != nil {
+			return err
+		}
+	}
+	return s.JobStore.SaveViews(id, encrypted)
+}
+
+// GetView returns a view with its sensitive columns decrypted
+func (s *EncryptingJobStore) GetView(id, name string) (*OutputFormat, error) {
+	stored, err := s.JobStore.GetView(id, name)
+	if err != nil {
+		return nil, err
+	}
+	return s.decrypt(stored)
+}
+
+// encrypt returns a copy of the result with its sensitive columns encrypted,
+// together with the values quoted by their issues and substitutions
+func (s *EncryptingJobStore) encrypt(result *OutputFormat) (*OutputFormat, error) {
+	columns := matchColumns(s.columns, result.Conversion.Columns)
+	if len(columns) == 0 {
+		return result, nil
+	}
+
+	dataKey := make([]byte, 32)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	wrapped, err := s.keys.Wrap(dataKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to wrap data key: %v", err)
+	}
+
+	encrypted := *result
+	encrypted.Encryption = &Encryption{Key: wrapped, Columns: columns}
+	encrypted.Conversion.Rows = make([]map[string]string, len(result.Conversion.Rows))
+	for i, row := range result.Conversion.Rows {
+		rowCopy := make(map[string]string, len(row))
+		for column, value := range row {
+			rowCopy[column] = value
+		}
+		for _, column := range columns {
+			if value, ok := row[column]; ok && value != "" {
+				if rowCopy[column], err = sealString(aead, value); err != nil {
+					return nil, err
+				}
+			}
+		}
+		encrypted.Conversion.Rows[i] = rowCopy
+	}
+
+	// Issues and substitutions of sensitive columns quote their values
+	seal := func(value string) (string, error) {
+		return sealString(aead, value)
+	}
+	if encrypted.Validation, err = mapSensitiveIssues(result.Validation, columns, seal); err != nil {
+		return nil, err
+	}
+	if encrypted.Metadata.Substitutions, err = mapSensitiveSubstitutions(result.Metadata.Substitutions, columns, seal); err != nil {
+		return nil, err
+	}
+	return &encrypted, nil
+}
+
+// decrypt returns a copy of a stored result with its sensitive columns
+// decrypted
+func (s *EncryptingJobStore) decrypt(stored *OutputFormat) (*OutputFormat, error) {
+	if stored.Encryption == nil {
+		return stored, nil
+	}
+
+	dataKey, err := s.keys.Unwrap(stored.Encryption.Key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unwrap data key: %v", err)
+	}
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	result := *stored
+	result.Encryption = nil
+	result.SensitiveColumns = stored.Encryption.Columns
+	result.Conversion.Rows = make([]map[string]string, len(stored.Conversion.Rows))
+	for i, row := range stored.Conversion.Rows {
+		rowCopy := make(map[string]string, len(row))
+		for column, value := range row {
+			rowCopy[column] = value
+		}
+		for _, column := range stored.Encryption.Columns {
+			value, ok := row[column]
+			if !ok {
+				continue
+			}
+			if rowCopy[column], err = openString(aead, value); err != nil {
+				return nil, fmt.Errorf("failed to decrypt %s: %v", column, err)
+			}
+		}
+		result.Conversion.Rows[i] = rowCopy
+	}
+
+	open := func(value string) (string, error) {
+		return openString(aead, value)
+	}
+	if result.Validation, err = mapSensitiveIssues(stored.Validation, stored.Encryption.Columns, open); err != nil {
+		return nil, fmt.Errorf("failed to decrypt issues: %v", err)
+	}
+	if result.Metadata.Substitutions, err = mapSensitiveSubstitutions(stored.Metadata.Substitutions, stored.Encryption.Columns, open); err != nil {
+		return nil, fmt.Errorf("failed to decrypt substitutions: %v", err)
+	}
+	return &result, nil
+}
+
+// sealString encrypts a value as an encryptedPrefix string
+func sealString(aead cipher.AEAD, value string) (string, error) {
+	sealed, err := sealValue(aead, []byte(value))
+	if err != nil {
+		return "", err
+	}
+	return encryptedPrefix + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// openString decrypts a value written by sealString. Values without
+// encryptedPrefix are returned as they are.
+func openString(aead cipher.AEAD, value string) (string, error) {
+	encoded, ok := strings.CutPrefix(value, encryptedPrefix)
+	if !ok {
+		return value, nil
+	}
+	sealed, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", err
+	}
+	plain, err := openValue(aead, sealed)
+	if err != nil {
+		return "", err
+	}
+	return string(plain), nil
+}
+
+// mapSensitiveIssues returns a copy of validations with f applied to the
+// non-empty values and messages of the issues of the given columns.
+// Validations without such issues are shared with the original.
+func mapSensitiveIssues(validations map[string]RowValidation, columns []string, f func(string) (string, error)) (map[string]RowValidation, error) {
+	if len(validations) == 0 {
+		return validations, nil
+	}
+	mapped := make(map[string]RowValidation, len(validations))
+	for trackID, validation := range validations {
+		var issues []Issue
+		for i, issue := range validation.Issues {
+			if !slices.Contains(columns, issue.Column) {
+				continue
+			}
+			if issues == nil {
+				issues = slices.Clone(validation.Issues)
+			}
+			var err error
+			if issue.Value != "" {
+				if issues[i].Value, err = f(issue.Value); err != nil {
+					return nil, err
+				}
+			}
+			if issue.Message != "" {
+				if issues[i].Message, err = f(issue.Message); err != nil {
+					return nil, err
+				}
+			}
+		}
+		if issues != nil {
+			validation.Issues = issues
+		}
+		mapped[trackID] = validation
+	}
+	return mapped, nil
+}
+
+// mapSensitiveSubstitutions returns a copy of substitutions with f applied
+// to the names replaced in the given columns
+func mapSensitiveSubstitutions(substitutions []Substitution, columns []string, f func(string) (string, error)) ([]Substitution, error) {
+	if len(substitutions) == 0 {
+		return substitutions, nil
+	}
+	mapped := slices.Clone(substitutions)
+	for i, sub := range mapped {
+		if !slices.Contains(columns, sub.Column) {
+			continue
+		}
+		var err error
+		if mapped[i].From, err = f(sub.From); err != nil {
+			return nil, err
+		}
+		if mapped[i].To, err = f(sub.To); err != nil {
+			return nil, err
+		}
+	}
+	return mapped, nil
+}
+
+// matchColumns returns the result columns named by the configured sensitive
+// columns, ignoring case, spaces and punctuation
+func matchColumns(sensitive, columns []string) []string {
+	names := make(map[string]bool, len(sensitive))
+	for _, column := range sensitive {
+		names[normalizeColumnName(column)] = true
+	}
+	var matched []string
+	for _, column := range columns {
+		if names[normalizeColumnName(column)] {
+			matched = append(matched, column)
+		}
+	}
+	return matched
+}
+
+// canReadSensitive reports whether the request may see decrypted sensitive
+// columns. Without a configured read token every reader may.
+func canReadSensitive(r *http.Request) bool {
+	if cfg.SensitiveReadToken == "" {
+		return true
+	}
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && subtle.ConstantTimeCompare([]byte(token), []byte(cfg.SensitiveReadToken)) == 1
+}
+
+// redactSensitive returns a copy of the result with its sensitive columns,
+// and the issues and substitutions quoting them, replaced by a placeholder
+func redactSensitive(result *OutputFormat) *OutputFormat {
+	redacted := *result
+	redacted.Conversion.Rows = make([]map[string]string, len(result.Conversion.Rows))
+	for i, row := range result.Conversion.Rows {
+		rowCopy := make(map[string]string, len(row))
+		for column, value := range row {
+			rowCopy[column] = value
+		}
+		for _, column := range result.SensitiveColumns {
+			if rowCopy[column] != "" {
+				rowCopy[column] = redactedValue
+			}
+		}
+		redacted.Conversion.Rows[i] = rowCopy
+	}
+	redact := func(string) (string, error) {
+		return redactedValue, nil
+	}
+	redacted.Validation, _ = mapSensitiveIssues(result.Validation, result.SensitiveColumns, redact)
+	redacted.Metadata.Substitutions, _ = mapSensitiveSubstitutions(result.Metadata.Substitutions, result.SensitiveColumns, redact)
+	return &redacted
+}
+
+// newAEAD returns AES-256-GCM for the key
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// sealValue encrypts plaintext with a random nonce prepended to the ciphertext
+func sealValue(aead cipher.AEAD, plaintext []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plaintext)+aead.Overhead())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+// openValue decrypts a value produced by sealValue
+func openValue(aead cipher.AEAD, sealed []byte) ([]byte, error) {
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("ciphertext too short")
+	}
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	return aead.Open(nil, nonce, ciphertext, nil)
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// FileError is a problem with the uploaded file itself rather than with the
+// server, carrying the HTTP status it should be reported with
+type FileError struct {
+	Status  int
+	Message string
+}
+
+func (e *FileError) Error() string {
+	return e.Message
+}
+
+// fileErrorf builds a FileError with a formatted message
+func fileErrorf(status int, format string, args ...interface{}) error {
+	return &FileError{Status: status, Message: fmt.Sprintf(format, args...)}
+}
+
+// errorStatus maps an error to the HTTP status code it should be reported with.
+// File problems keep their own status, oversized bodies become 413, an
+// unreachable virus scanner or a request past its deadline 503 and anything
+// else is treated as a genuine server fault.
+func errorStatus(err error) int {
+	var fileErr *FileError
+	if errors.As(err, &fileErr) {
+		return fileErr.Status
+	}
+	var scanErr *ScanError
+	if errors.As(err, &scanErr) || errors.Is(err, context.DeadlineExceeded) {
+		return http.StatusServiceUnavailable
+	}
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		return http.StatusRequestEntityTooLarge
+	}
+	return http.StatusInternalServerError
+}
+
+// writeError writes err to the response with the status from errorStatus
+func writeError(w http.ResponseWriter, prefix string, err error) {
+	http.Error(w, prefix+err.Error(), errorStatus(err))
+}
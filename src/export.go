@@ -0,0 +1,342 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ExportLocale controls how numbers and dates are written in human-facing
+// exports. The JSON result always keeps the canonical representation.
+type ExportLocale struct {
+	DecimalSeparator string
+	DateLayout       string
+	Delimiter        rune
+}
+
+// canonicalLocale writes values as they are stored
+var canonicalLocale = ExportLocale{DecimalSeparator: ".", DateLayout: "2006-01-02", Delimiter: ','}
+
+// exportLocales are the supported export locales. Locales writing a decimal
+// comma use semicolons between fields, as spreadsheet applications in those
+// locales expect.
+var exportLocales = map[string]ExportLocale{
+	"en":    canonicalLocale,
+	"en-us": {DecimalSeparator: ".", DateLayout: "01/02/2006", Delimiter: ','},
+	"en-gb": {DecimalSeparator: ".", DateLayout: "02/01/2006", Delimiter: ','},
+	"de":    {DecimalSeparator: ",", DateLayout: "02.01.2006", Delimiter: ';'},
+	"fr":    {DecimalSeparator: ",", DateLayout: "02/01/2006", Delimiter: ';'},
+	"es":    {DecimalSeparator: ",", DateLayout: "02/01/2006", Delimiter: ';'},
+	"it":    {DecimalSeparator: ",", DateLayout: "02/01/2006", Delimiter: ';'},
+	"nl":    {DecimalSeparator: ",", DateLayout: "02-01-2006", Delimiter: ';'},
+	"pt":    {DecimalSeparator: ",", DateLayout: "02/01/2006", Delimiter: ';'},
+	"pl":    {DecimalSeparator: ",", DateLayout: "02.01.2006", Delimiter: ';'},
+	"sv":    {DecimalSeparator: ",", DateLayout: "2006-01-02", Delimiter: ';'},
+}
+
+// decimalRegex matches decimal numbers and percentages in canonical form
+var decimalRegex = regexp.MustCompile(`^[+-]?\d+\.\d+%?$`)
+
+// lookupExportLocale finds a locale by tag, ignoring case and falling back
+// from a regional tag such as de-AT to its language. An empty tag selects
+// the canonical representation.
+func lookupExportLocale(tag string) (ExportLocale, bool) {
+	tag = strings.ToLower(strings.ReplaceAll(strings.TrimSpace(tag), "_", "-"))
+	if tag == "" {
+		return canonicalLocale, true
+	}
+	if locale, ok := exportLocales[tag]; ok {
+		return locale, true
+	}
+	language, _, _ := strings.Cut(tag, "-")
+	locale, ok := exportLocales[language]
+	return locale, ok
+}
+
+// Format writes a cell value in the locale. Only decimal numbers and
+// YYYY-MM-DD dates are changed; identifiers and text are left alone.
+func (l ExportLocale) Format(value string) string {
+	if l.DecimalSeparator != "." && decimalRegex.MatchString(value) {
+		return strings.Replace(value, ".", l.DecimalSeparator, 1)
+	}
+	if l.DateLayout != canonicalLocale.DateLayout && dateRegex.MatchString(value) {
+		if date, err := time.Parse("2006-01-02", value); err == nil {
+			return date.Format(l.DateLayout)
+		}
+	}
+	return value
+}
+
+// exportColumns returns the columns of the conversion followed by any
+// further columns of its rows, sorted
+func exportColumns(conversion Conversion) []string {
+	columns := append([]string(nil), conversion.Columns...)
+	known := make(map[string]bool, len(columns))
+	for _, column := range columns {
+		known[column] = true
+	}
+	var extra []string
+	for _, row := range conversion.Rows {
+		for column := range row {
+			if !known[column] {
+				known[column] = true
+				extra = append(extra, column)
+			}
+		}
+	}
+	sort.Strings(extra)
+	return append(columns, extra...)
+}
+
+// writeConversionCSV writes the converted rows as CSV in the locale
+func writeConversionCSV(conversion Conversion, locale ExportLocale) ([]byte, error) {
+	columns := exportColumns(conversion)
+	var buf bytes.Buffer
+	writer := csv.NewWriter(&buf)
+	writer.Comma = locale.Delimiter
+	writer.Write(columns)
+	record := make([]string, len(columns))
+	for _, row := range conversion.Rows {
+		for i, column := range columns {
+			record[i] = locale.Format(row[column])
+		}
+		writer.Write(record)
+	}
+	writer.Flush()
+	return buf.Bytes(), writer.Error()
+}
+
+// failureReasonsColumn is the column of invalid.csv giving the failed
+// checks of each row
+const failureReasonsColumn = "Failure Reasons"
+
+// writeSplitCSV writes the rows passing every check and the failing rows as
+// valid.csv and invalid.csv in a zip archive, in the locale. Failing rows
+// are followed by the checks they failed and the issues found.
+func writeSplitCSV(result *OutputFormat, locale ExportLocale) ([]byte, error) {
+	valid := sliceResult(result, func(row map[string]string) bool {
+		return !failedRow(result, row)
+	})
+	invalid := sliceResult(result, func(row map[string]string) bool {
+		return failedRow(result, row)
+	})
+	invalid.Conversion.Columns = append(exportColumns(invalid.Conversion), failureReasonsColumn)
+	for i, row := range invalid.Conversion.Rows {
+		annotated := make(map[string]string, len(row)+1)
+		for column, value := range row {
+			annotated[column] = value
+		}
+		annotated[failureReasonsColumn] = failureReasons(result.Validation[row["Track ID"]])
+		invalid.Conversion.Rows[i] = annotated
+	}
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, file := range []struct {
+		name       string
+		conversion Conversion
+	}{{"valid.csv", valid.Conversion}, {"invalid.csv", invalid.Conversion}} {
+		data, err := writeConversionCSV(file.conversion, locale)
+		if err != nil {
+			return nil, err
+		}
+		w, err := zw.Create(file.name)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := w.Write(data); err != nil {
+			return nil, err
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// failureReasons describes the failed checks of a row, with the issues
+// found by those that report them, such as
+// "date_format; territories (unknown territory XX)"
+func failureReasons(v RowValidation) string {
+	details := map[string][]string{
+		"territories":         v.TerritoryIssues,
+		"release_date":        v.DateIssues,
+		"payee_ids":           v.PayeeIssues,
+		"required_fields":     v.MissingFields,
+		"numerics":            v.NumericIssues,
+		"release_type":        v.ReleaseTypeIssues,
+		"isrc":                v.ISRCIssues,
+		"genre":               v.GenreIssues,
+		"label":               v.LabelIssues,
+		"rights_holder":       v.RightsHolderIssues,
+		"release_consistency": v.ReleaseConflicts,
+	}
+	failed := v.FailedChecks()
+	sort.Strings(failed)
+	reasons := make([]string, len(failed))
+	for i, check := range failed {
+		reasons[i] = check
+		if issues := details[check]; len(issues) > 0 {
+			reasons[i] += " (" + strings.Join(issues, ", ") + ")"
+		}
+	}
+	return strings.Join(reasons, "; ")
+}
+
+// exportHandler returns the converted rows of a job as a CSV file,
+// optionally formatted for a locale, as a zip of the valid and the invalid
+// rows, as an XLSX workbook with the validation of each row, as a typed
+// Parquet file, as a SQLite database of the rows and their validation, as
+// an anonymized sample to share for debugging, or in the
+// format of an operator's export template, and optionally limited to a
+// label, a genre or the failing rows, e.g.
+// GET /jobs/{id}/export.csv?locale=de&label=Warp%20Records
+// GET /jobs/{id}/export?format=split
+// GET /jobs/{id}/export.xlsx?failures=true
+// GET /jobs/{id}/export.parquet
+// GET /jobs/{id}/export.sqlite
+// GET /jobs/{id}/export?format=anonymized&sample=0.1&failures=true
+// GET /jobs/{id}/export?format=template:fixed-width
+func exportHandler(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	locale, ok := lookupExportLocale(r.URL.Query().Get("locale"))
+	if !ok {
+		http.Error(w, fmt.Sprintf("Unsupported locale: %q", r.URL.Query().Get("locale")), http.StatusBadRequest)
+		return
+	}
+	format := r.URL.Query().Get("format")
+	if format == "" && strings.HasSuffix(r.URL.Path, ".xlsx") {
+		format = "xlsx"
+	}
+	if format == "" && strings.HasSuffix(r.URL.Path, ".parquet") {
+		format = "parquet"
+	}
+	if format == "" && strings.HasSuffix(r.URL.Path, ".sqlite") {
+		format = "sqlite"
+	}
+	var exportTemplate *ExportTemplate
+	switch {
+	case format == "" || format == "csv" || format == "split" || format == "xlsx" || format == "parquet" || format == "sqlite" || format == "anonymized":
+	case strings.HasPrefix(format, "template:"):
+		name := strings.TrimPrefix(format, "template:")
+		var err error
+		exportTemplate, err = loadTemplate(name)
+		if errors.Is(err, ErrTemplateNotFound) {
+			http.Error(w, "Unknown template: "+name, http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Failed to load template: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+	default:
+		http.Error(w, fmt.Sprintf("Unsupported format: %q, expected csv, split, xlsx, parquet, sqlite, anonymized or template:<name>", format), http.StatusBadRequest)
+		return
+	}
+	fraction := 1.0
+	if value := r.URL.Query().Get("sample"); value != "" {
+		var err error
+		fraction, err = strconv.ParseFloat(value, 64)
+		if err != nil || !(fraction > 0 && fraction <= 1) {
+			http.Error(w, fmt.Sprintf("Invalid sample: %q, expected a fraction above 0 and up to 1", value), http.StatusBadRequest)
+			return
+		}
+	}
+	view, err := exportView(r)
+	if err != nil {
+		http.Error(w, "Invalid filter: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	var result *OutputFormat
+	if view != "" {
+		result, err = loadView(id, view)
+	} else {
+		result, err = jobStore.GetResult(id)
+	}
+	if err != nil {
+		writeStoreError(w, "Failed to get result: ", err)
+		return
+	}
+	if len(result.SensitiveColumns) > 0 && !canReadSensitive(r) {
+		result = redactSensitive(result)
+	}
+
+	if exportTemplate != nil {
+		data, err := exportTemplate.Render(id, result)
+		if err != nil {
+			http.Error(w, "Failed to render template: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		serveDownload(w, r, "export-"+id+exportTemplate.Extension, exportTemplate.ContentType(), data)
+		return
+	}
+
+	if format == "split" {
+		data, err := writeSplitCSV(result, locale)
+		if err != nil {
+			http.Error(w, "Failed to write CSV: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		serveDownload(w, r, "export-"+id+".zip", "application/zip", data)
+		return
+	}
+
+	if format == "xlsx" {
+		data, err := writeResultXLSX(result)
+		if err != nil {
+			http.Error(w, "Failed to write workbook: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		serveDownload(w, r, "export-"+id+".xlsx", xlsxContentType, data)
+		return
+	}
+
+	if format == "parquet" {
+		data, err := writeConversionParquet(result.Conversion)
+		if err != nil {
+			http.Error(w, "Failed to write Parquet file: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		serveDownload(w, r, "export-"+id+".parquet", parquetContentType, data)
+		return
+	}
+
+	if format == "sqlite" {
+		data, err := writeResultSQLite(result)
+		if err != nil {
+			http.Error(w, "Failed to write database: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		serveDownload(w, r, "export-"+id+".sqlite", sqliteContentType, data)
+		return
+	}
+
+	if format == "anonymized" {
+		seed := r.URL.Query().Get("seed")
+		if seed == "" {
+			seed = id
+		}
+		data, err := writeConversionCSV(anonymizedSample(result.Conversion, seed, fraction), locale)
+		if err != nil {
+			http.Error(w, "Failed to write CSV: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		serveDownload(w, r, "sample-"+id+".csv", "text/csv; charset=utf-8", data)
+		return
+	}
+
+	data, err := writeConversionCSV(result.Conversion, locale)
+	if err != nil {
+		http.Error(w, "Failed to write CSV: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	serveDownload(w, r, "export-"+id+".csv", "text/csv; charset=utf-8", data)
+}
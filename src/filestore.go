@@ -0,0 +1,542 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// compactMinRecords is the log size below which the file store is never
+// compacted
+const compactMinRecords = 1000
+
+// fileRecord is a line of the file store's log. Later records for a job
+// replace earlier ones.
+type fileRecord struct {
+	Op         string          `json:"op"`
+	Job        *Job            `json:"job,omitempty"`
+	ID         string          `json:"id,omitempty"`
+	Annotation *Annotation     `json:"annotation,omitempty"`
+	Tenant     string          `json:"tenant,omitempty"`
+	ExternalID string          `json:"external_id,omitempty"`
+	Tombstone  *Tombstone      `json:"tombstone,omitempty"`
+	Settings   *TenantSettings `json:"settings,omitempty"`
+	Dictionary *Dictionary     `json:"dictionary,omitempty"`
+	Delivery   *Delivery       `json:"delivery,omitempty"`
+}
+
+// FileJobStore keeps jobs on local disk without any external service, for
+// single-binary deployments that should survive restarts. Job state,
+// annotations and external IDs are appended to a log that is replayed on
+// startup and compacted as it grows; results are stored as one file per
+// job, with the materialized views of a result in a directory of their
+// own. Like the memory store it serves a single replica and keeps the most
+// recent jobs up to its history limit.
+type FileJobStore struct {
+	mem *MemoryJobStore
+	dir string
+
+	mu      sync.Mutex
+	log     *os.File
+	records int
+}
+
+// NewFileJobStore opens the store in dir, creating it if needed, and
+// replays its log
+func NewFileJobStore(dir string, history int) (*FileJobStore, error) {
+	for _, sub := range []string{"results", "views"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0o755); err != nil {
+			return nil, err
+		}
+	}
+	s := &FileJobStore{mem: NewMemoryJobStore(history), dir: dir}
+	if err := s.replay(); err != nil {
+		return nil, err
+	}
+
+	// Jobs still active in the log were interrupted by a restart
+	for _, job := range s.mem.jobs {
+		if job.Active() {
+			finishedAt := time.Now()
+			job.Status = JobFailed
+			job.Error = "interrupted by a server restart"
+			job.FinishedAt = &finishedAt
+		}
+	}
+
+	if err := s.compact(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *FileJobStore) logPath() string { return filepath.Join(s.dir, "jobs.log") }
+func (s *FileJobStore) resultPath(id string) string {
+	return filepath.Join(s.dir, "results", id+".json")
+}
+
+// viewPath names view files by a hash of the view name, which holds
+// arbitrary label and genre values
+func (s *FileJobStore) viewPath(id, name string) string {
+	sum := sha256.Sum256([]byte(name))
+	return filepath.Join(s.dir, "views", id, hex.EncodeToString(sum[:16])+".json")
+}
+
+// replay rebuilds the in-memory state from the log. A truncated last line,
+// left by a crash mid-write, is ignored.
+func (s *FileJobStore) replay() error {
+	file, err := os.Open(s.logPath())
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64<<10), 16<<20)
+	line := 0
+	for scanner.Scan() {
+		line++
+		var record fileRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			log.Printf("Job store: ignoring unreadable record on line %d of %s: %v", line, s.logPath(), err)
+			continue
+		}
+		if err := s.apply(&record); err != nil && !errors.Is(err, ErrJobNotFound) {
+			log.Printf("Job store: ignoring record on line %d of %s: %v", line, s.logPath(), err)
+		}
+	}
+	return scanner.Err()
+}
+
+// apply updates the in-memory state with a log record
+func (s *FileJobStore) apply(record *fileRecord) error {
+	switch record.Op {
+	case "job":
+		return s.mem.SaveJob(record.Job)
+	case "annotation":
+		return s.mem.AddAnnotation(record.ID, *record.Annotation)
+	case "external":
+		_, err := s.mem.ClaimExternalID(record.Tenant, record.ExternalID, record.ID)
+		return err
+	case "tombstone":
+		return s.mem.AddTombstone(record.Tombstone)
+	case "settings":
+		return s.mem.SaveTenantSettings(record.Settings)
+	case "delete_settings":
+		return s.mem.DeleteTenantSettings(record.Tenant)
+	case "dictionary":
+		return s.mem.SaveDictionary(record.Dictionary)
+	case "delete_dictionary":
+		return s.mem.DeleteDictionary(record.Tenant)
+	case "delivery":
+		return s.mem.SaveDelivery(record.Delivery)
+	case "delete_delivery":
+		return s.mem.DeleteDelivery(record.ID)
+	}
+	return fmt.Errorf("unknown record %q", record.Op)
+}
+
+// append writes a record to the log, compacting it first when it has grown
+// well beyond the live state. The caller must hold the lock.
+func (s *FileJobStore) append(record *fileRecord) error {
+	s.mem.mu.RLock()
+	live := len(s.mem.jobs)
+	s.mem.mu.RUnlock()
+	if s.records > max(compactMinRecords, 4*live) {
+		if err := s.compact(); err != nil {
+			log.Printf("Job store: compaction failed: %v", err)
+		}
+	}
+
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	if _, err := s.log.Write(append(data, '\n')); err != nil {
+		return fmt.Errorf("failed to write job log: %v", err)
+	}
+	s.records++
+	return nil
+}
+
+// compact rewrites the log with one record per live job, annotation,
+// external ID, tombstone, delivery and tenant's settings and dictionary,
+// and removes the results and views of jobs no longer kept
+func (s *FileJobStore) compact() error {
+	tmpPath := s.logPath() + ".tmp"
+	tmp, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(tmp)
+	encoder := json.NewEncoder(w)
+	records := 0
+
+	s.mem.mu.RLock()
+	for _, job := range s.mem.jobs {
+		encoder.Encode(fileRecord{Op: "job", Job: job})
+		records++
+	}
+	for id, annotations := range s.mem.annotations {
+		for i := range annotations {
+			encoder.Encode(fileRecord{Op: "annotation", ID: id, Annotation: &annotations[i]})
+			records++
+		}
+	}
+	for key, id := range s.mem.externalIDs {
+		tenant, externalID, _ := strings.Cut(key, "\x00")
+		encoder.Encode(fileRecord{Op: "external", ID: id, Tenant: tenant, ExternalID: externalID})
+		records++
+	}
+	for _, tombstone := range s.mem.tombstones {
+		encoder.Encode(fileRecord{Op: "tombstone", Tombstone: tombstone})
+		records++
+	}
+	for _, settings := range s.mem.settings {
+		encoder.Encode(fileRecord{Op: "settings", Settings: settings})
+		records++
+	}
+	for _, dictionary := range s.mem.dictionaries {
+		encoder.Encode(fileRecord{Op: "dictionary", Dictionary: dictionary})
+		records++
+	}
+	for _, d := range s.mem.deliveries {
+		encoder.Encode(fileRecord{Op: "delivery", Delivery: d})
+		records++
+	}
+	live := make(map[string]bool, len(s.mem.jobs))
+	for id := range s.mem.jobs {
+		live[id] = true
+	}
+	s.mem.mu.RUnlock()
+
+	err = w.Flush()
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, s.logPath())
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	if s.log != nil {
+		s.log.Close()
+	}
+	if s.log, err = os.OpenFile(s.logPath(), os.O_WRONLY|os.O_APPEND, 0o644); err != nil {
+		return err
+	}
+	s.records = records
+
+	entries, err := os.ReadDir(filepath.Join(s.dir, "results"))
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if id, ok := strings.CutSuffix(entry.Name(), ".json"); ok && !live[id] {
+			os.Remove(filepath.Join(s.dir, "results", entry.Name()))
+		}
+	}
+	if entries, err = os.ReadDir(filepath.Join(s.dir, "views")); err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if !live[entry.Name()] {
+			os.RemoveAll(filepath.Join(s.dir, "views", entry.Name()))
+		}
+	}
+	return nil
+}
+
+// SaveJob records the job's current state
+func (s *FileJobStore) SaveJob(job *Job) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	jobCopy := *job
+	s.mem.SaveJob(&jobCopy)
+	return s.append(&fileRecord{Op: "job", Job: &jobCopy})
+}
+
+// GetJob returns the job with the given ID
+func (s *FileJobStore) GetJob(id string) (*Job, error) {
+	return s.mem.GetJob(id)
+}
+
+// ListJobs returns up to limit jobs, most recent first
+func (s *FileJobStore) ListJobs(limit int) ([]*Job, error) {
+	return s.mem.ListJobs(limit)
+}
+
+// SaveResult writes the result of a job to its own file
+func (s *FileJobStore) SaveResult(id string, result *OutputFormat) error {
+	if _, err := s.mem.GetJob(id); err != nil {
+		return err
+	}
+	data, err := json.Marshal(result)
+	if err != nil {
+		return err
+	}
+	tmpPath := s.resultPath(id) + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, s.resultPath(id))
+}
+
+// GetResult reads the result of a job
+func (s *FileJobStore) GetResult(id string) (*OutputFormat, error) {
+	if _, err := s.mem.GetJob(id); err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(s.resultPath(id))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, ErrJobNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	var result OutputFormat
+	if err := json.Unmarshal(data, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// AddAnnotation appends an annotation to a job
+func (s *FileJobStore) AddAnnotation(id string, annotation Annotation) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.mem.AddAnnotation(id, annotation); err != nil {
+		return err
+	}
+	return s.append(&fileRecord{Op: "annotation", ID: id, Annotation: &annotation})
+}
+
+// Annotations returns the annotations of a job in the order they were added
+func (s *FileJobStore) Annotations(id string) ([]Annotation, error) {
+	return s.mem.Annotations(id)
+}
+
+// ClaimExternalID records the job holding a tenant's external ID
+func (s *FileJobStore) ClaimExternalID(tenant, externalID, jobID string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	owner, err := s.mem.ClaimExternalID(tenant, externalID, jobID)
+	if err != nil || owner != jobID {
+		return owner, err
+	}
+	return owner, s.append(&fileRecord{Op: "external", ID: jobID, Tenant: tenant, ExternalID: externalID})
+}
+
+// FindExternalID returns the job holding a tenant's external ID
+func (s *FileJobStore) FindExternalID(tenant, externalID string) (string, error) {
+	return s.mem.FindExternalID(tenant, externalID)
+}
+
+// FindReuseKey returns the last completed job saved with a tenant's reuse
+// key. Keys are indexed as jobs are saved and replayed.
+func (s *FileJobStore) FindReuseKey(tenant, key string) (string, error) {
+	return s.mem.FindReuseKey(tenant, key)
+}
+
+// DeleteAnnotations removes a job's annotations on the given rows. The log
+// is compacted straight away so the deleted annotations do not linger in
+// earlier records.
+func (s *FileJobStore) DeleteAnnotations(id string, rows []string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	removed, err := s.mem.DeleteAnnotations(id, rows)
+	if err != nil || removed == 0 {
+		return removed, err
+	}
+	return removed, s.compact()
+}
+
+// AddTombstone records a purge
+func (s *FileJobStore) AddTombstone(tombstone *Tombstone) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.mem.AddTombstone(tombstone)
+	return s.append(&fileRecord{Op: "tombstone", Tombstone: tombstone})
+}
+
+// Tombstones returns the recorded purges, oldest first
+func (s *FileJobStore) Tombstones() ([]*Tombstone, error) {
+	return s.mem.Tombstones()
+}
+
+// GetTenantSettings returns a tenant's settings
+func (s *FileJobStore) GetTenantSettings(tenant string) (*TenantSettings, error) {
+	return s.mem.GetTenantSettings(tenant)
+}
+
+// SaveTenantSettings records a tenant's settings
+func (s *FileJobStore) SaveTenantSettings(settings *TenantSettings) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.mem.SaveTenantSettings(settings)
+	return s.append(&fileRecord{Op: "settings", Settings: settings})
+}
+
+// DeleteTenantSettings records the removal of a tenant's settings
+func (s *FileJobStore) DeleteTenantSettings(tenant string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.mem.DeleteTenantSettings(tenant); err != nil {
+		return err
+	}
+	return s.append(&fileRecord{Op: "delete_settings", Tenant: tenant})
+}
+
+// ListTenantSettings returns the settings of every tenant, by tenant
+func (s *FileJobStore) ListTenantSettings() ([]*TenantSettings, error) {
+	return s.mem.ListTenantSettings()
+}
+
+// GetDictionary returns a tenant's dictionary
+func (s *FileJobStore) GetDictionary(tenant string) (*Dictionary, error) {
+	return s.mem.GetDictionary(tenant)
+}
+
+// SaveDictionary records a tenant's dictionary
+func (s *FileJobStore) SaveDictionary(dictionary *Dictionary) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.mem.SaveDictionary(dictionary)
+	return s.append(&fileRecord{Op: "dictionary", Dictionary: dictionary})
+}
+
+// DeleteDictionary records the removal of a tenant's dictionary
+func (s *FileJobStore) DeleteDictionary(tenant string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.mem.DeleteDictionary(tenant); err != nil {
+		return err
+	}
+	return s.append(&fileRecord{Op: "delete_dictionary", Tenant: tenant})
+}
+
+// GetDelivery returns a parked delivery
+func (s *FileJobStore) GetDelivery(id string) (*Delivery, error) {
+	return s.mem.GetDelivery(id)
+}
+
+// SaveDelivery records a parked delivery
+func (s *FileJobStore) SaveDelivery(d *Delivery) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.mem.SaveDelivery(d)
+	return s.append(&fileRecord{Op: "delivery", Delivery: d})
+}
+
+// DeleteDelivery records the removal of a parked delivery
+func (s *FileJobStore) DeleteDelivery(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.mem.DeleteDelivery(id); err != nil {
+		return err
+	}
+	return s.append(&fileRecord{Op: "delete_delivery", ID: id})
+}
+
+// ListDeliveries returns the parked deliveries, oldest first
+func (s *FileJobStore) ListDeliveries() ([]*Delivery, error) {
+	return s.mem.ListDeliveries()
+}
+
+// SaveViews writes the views of a job to a new directory that replaces the
+// previous one
+func (s *FileJobStore) SaveViews(id string, views map[string]*OutputFormat) error {
+	if _, err := s.mem.GetJob(id); err != nil {
+		return err
+	}
+	dir := filepath.Join(s.dir, "views", id)
+	tmpDir := dir + ".tmp"
+	os.RemoveAll(tmpDir)
+	if err := os.MkdirAll(tmpDir, 0o755); err != nil {
+		return err
+	}
+	for name, view := range views {
+		data, err := json.Marshal(view)
+		if err == nil {
+			err = os.WriteFile(filepath.Join(tmpDir, filepath.Base(s.viewPath(id, name))), data, 0o644)
+		}
+		if err != nil {
+			os.RemoveAll(tmpDir)
+			return err
+		}
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		return err
+	}
+	return os.Rename(tmpDir, dir)
+}
+
+// GetView reads a materialized view of a job's result
+func (s *FileJobStore) GetView(id, name string) (*OutputFormat, error) {
+	if _, err := s.mem.GetJob(id); err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(s.viewPath(id, name))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, ErrJobNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	var view OutputFormat
+	if err := json.Unmarshal(data, &view); err != nil {
+		return nil, err
+	}
+	return &view, nil
+}
+
+// Usage counts the jobs and stored results and adds up the size of the
+// store's directory
+func (s *FileJobStore) Usage() (StorageUsage, error) {
+	usage, err := s.mem.Usage()
+	if err != nil {
+		return usage, err
+	}
+	usage.Results = 0
+	err = filepath.WalkDir(s.dir, func(path string, entry fs.DirEntry, err error) error {
+		// Files may be replaced or removed while the directory is walked
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		if err != nil || entry.IsDir() {
+			return err
+		}
+		info, err := entry.Info()
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		usage.Bytes += info.Size()
+		if filepath.Dir(path) == filepath.Join(s.dir, "results") && strings.HasSuffix(path, ".json") {
+			usage.Results++
+		}
+		return nil
+	})
+	return usage, err
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// rowFilter selects the rows of a result returned to a client, so clients
+// after a slice of a large result need not download all of it
+type rowFilter struct {
+	// failures keeps the rows failing a check of error severity
+	failures bool
+
+	// label and genre keep the rows of a label or genre, in matching form
+	label, genre string
+
+	// territories, if set, keeps the rows released in any of its countries
+	territories *territorySet
+}
+
+// parseRowFilter reads the failures, label, genre and territory options
+// of a request, or returns nil if it sets none. territory is a territory
+// list such as US, GB or EU, matching the rows covering any of its
+// countries.
+func parseRowFilter(r *http.Request) (*rowFilter, error) {
+	filter := &rowFilter{
+		label: strings.ToLower(strings.TrimSpace(r.FormValue("label"))),
+		genre: strings.ToLower(strings.TrimSpace(r.FormValue("genre"))),
+	}
+	switch value := r.FormValue("failures"); value {
+	case "", "false", "0":
+	case "true", "1":
+		filter.failures = true
+	default:
+		return nil, fileErrorf(http.StatusBadRequest, "failures must be true or false, got %q", value)
+	}
+	if value := strings.TrimSpace(r.FormValue("territory")); value != "" {
+		territories, issues, ok := territoryCoverage(value)
+		if !ok {
+			return nil, fileErrorf(http.StatusBadRequest, "invalid territory %q: %s", value, strings.Join(issues, "; "))
+		}
+		filter.territories = territories
+	}
+	if !filter.failures && filter.label == "" && filter.genre == "" && filter.territories == nil {
+		return nil, nil
+	}
+	return filter, nil
+}
+
+// territoryCoverage returns the countries a territory list covers, with
+// the issues of a list that is not valid
+func territoryCoverage(value string) (*territorySet, []string, bool) {
+	normalized, issues, ok := normalizeTerritories(value)
+	if !ok {
+		return nil, issues, false
+	}
+	var covered territorySet
+	for _, code := range strings.Split(normalized, ", ") {
+		if set := territorySets[code]; set != nil {
+			covered.add(set)
+		}
+	}
+	return &covered, nil, true
+}
+
+// apply returns the result with the rows the filter keeps and their
+// validations. The rest of the result still describes the whole job, but
+// for duplicates, whose positions would not match the rows returned.
+func (f *rowFilter) apply(result *OutputFormat) *OutputFormat {
+	if f == nil {
+		return result
+	}
+	coverage := make(map[string]*territorySet)
+	keep := func(row map[string]string) bool {
+		switch {
+		case f.failures && !failedRow(result, row):
+			return false
+		case f.label != "" && strings.ToLower(strings.TrimSpace(row[labelColumn])) != f.label:
+			return false
+		case f.genre != "" && strings.ToLower(strings.TrimSpace(row[genreColumn])) != f.genre:
+			return false
+		case f.territories == nil:
+			return true
+		}
+		value := row["Territories"]
+		covered, seen := coverage[value]
+		if !seen {
+			covered, _, _ = territoryCoverage(value)
+			coverage[value] = covered
+		}
+		return covered != nil && covered.overlaps(f.territories)
+	}
+
+	filtered := *result
+	slice := sliceResult(result, keep)
+	filtered.Conversion, filtered.Validation = slice.Conversion, slice.Validation
+	filtered.Duplicates = nil
+	return &filtered
+}
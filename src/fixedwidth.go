@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// maxFixedWidthLine limits the size of a single fixed-width record
+const maxFixedWidthLine = 1 << 20
+
+// maxFixedWidthColumns limits the number of columns of a fixed-width spec
+const maxFixedWidthColumns = 512
+
+// FixedWidthColumn is a field of a fixed-width record: Width characters
+// starting Offset characters into the line
+type FixedWidthColumn struct {
+	Name   string `json:"name"`
+	Offset int    `json:"offset"`
+	Width  int    `json:"width"`
+}
+
+// isFixedWidthExtension reports whether a file extension may hold a
+// fixed-width file
+func isFixedWidthExtension(extension string) bool {
+	return extension == ".txt" || extension == ".dat" || extension == ".fwf"
+}
+
+// parseFixedWidthSpec reads the column spec of a fixed-width file, a JSON
+// array of columns. Names must be unique and columns may not overlap.
+func parseFixedWidthSpec(value string) ([]FixedWidthColumn, error) {
+	var columns []FixedWidthColumn
+	decoder := json.NewDecoder(strings.NewReader(value))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&columns); err != nil {
+		return nil, fmt.Errorf("expected a JSON array of {name, offset, width}: %v", err)
+	}
+	if len(columns) == 0 {
+		return nil, fmt.Errorf("no columns")
+	}
+	if len(columns) > maxFixedWidthColumns {
+		return nil, fmt.Errorf("more than %d columns", maxFixedWidthColumns)
+	}
+
+	names := make(map[string]bool, len(columns))
+	for i, column := range columns {
+		column.Name = strings.TrimSpace(column.Name)
+		switch {
+		case column.Name == "":
+			return nil, fmt.Errorf("column %d has no name", i+1)
+		case names[column.Name]:
+			return nil, fmt.Errorf("column %q is defined twice", column.Name)
+		case column.Offset < 0:
+			return nil, fmt.Errorf("column %q has a negative offset", column.Name)
+		case column.Width < 1 || column.Width > maxFixedWidthLine:
+			return nil, fmt.Errorf("column %q has an invalid width %d", column.Name, column.Width)
+		}
+		names[column.Name] = true
+		columns[i] = column
+	}
+
+	byOffset := append([]FixedWidthColumn(nil), columns...)
+	sort.Slice(byOffset, func(i, j int) bool { return byOffset[i].Offset < byOffset[j].Offset })
+	for i := 1; i < len(byOffset); i++ {
+		if previous := byOffset[i-1]; previous.Offset+previous.Width > byOffset[i].Offset {
+			return nil, fmt.Errorf("columns %q and %q overlap", previous.Name, byOffset[i].Name)
+		}
+	}
+	return columns, nil
+}
+
+// fixedWidthReader reads a fixed-width file as a RowSource: the spec's
+// column names first, then the fields of every non-blank line with their
+// padding trimmed. Fields past the end of a short line are empty.
+type fixedWidthReader struct {
+	scanner *bufio.Scanner
+	columns []FixedWidthColumn
+	header  bool
+	line    int
+}
+
+// newFixedWidthReader reads r with the given column spec
+func newFixedWidthReader(r io.Reader, columns []FixedWidthColumn) *fixedWidthReader {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64<<10), maxFixedWidthLine)
+	return &fixedWidthReader{scanner: scanner, columns: columns}
+}
+
+// FieldPos returns the line of the row last read, as csv.Reader does
+func (f *fixedWidthReader) FieldPos(field int) (line, column int) {
+	return f.line, 1
+}
+
+// Read returns the next row
+func (f *fixedWidthReader) Read() ([]string, error) {
+	if !f.header {
+		f.header = true
+		names := make([]string, len(f.columns))
+		for i, column := range f.columns {
+			names[i] = column.Name
+		}
+		return names, nil
+	}
+
+	for f.scanner.Scan() {
+		f.line++
+		line := strings.TrimRight(f.scanner.Text(), "\r")
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		// Offsets count characters, not bytes, so multi-byte names do not
+		// shift the fields after them
+		runes := []rune(line)
+		row := make([]string, len(f.columns))
+		for i, column := range f.columns {
+			if column.Offset >= len(runes) {
+				continue
+			}
+			end := min(column.Offset+column.Width, len(runes))
+			row[i] = strings.TrimSpace(string(runes[column.Offset:end]))
+		}
+		return row, nil
+	}
+	if err := f.scanner.Err(); err != nil {
+		if err == bufio.ErrTooLong {
+			return nil, fileErrorf(http.StatusUnprocessableEntity,
+				"line %d: record exceeds %d MB", f.line+1, maxFixedWidthLine>>20)
+		}
+		return nil, err
+	}
+	return nil, io.EOF
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"unicode"
+)
+
+// genreColumn is the column holding each track's genre
+const genreColumn = "Genre"
+
+// Genre suggestions: the number offered for an unknown genre, and the
+// number of unknown genres whose suggestions are remembered
+const (
+	maxGenreSuggestions  = 3
+	genreSuggestionCache = 10000
+)
+
+// genreVocabulary is the controlled vocabulary genres are checked against
+type genreVocabulary struct {
+	// genres maps each genre in lower case to its spelling in the file
+	genres map[string]string
+	// keys holds each genre's comparison key, for suggestions
+	keys map[string]string
+
+	suggestions sync.Map
+	cached      atomic.Int64
+}
+
+// genres is the vocabulary of GENRES_FILE, or nil if genres are not checked
+var genres = loadGenres()
+
+// loadGenres reads GENRES_FILE: one genre per line, ignoring blank lines
+// and lines starting with #
+func loadGenres() *genreVocabulary {
+	if cfg.GenresFile == "" {
+		return nil
+	}
+	file, err := os.Open(cfg.GenresFile)
+	if err != nil {
+		log.Fatalf("Failed to read GENRES_FILE: %v", err)
+	}
+	defer file.Close()
+
+	vocabulary := &genreVocabulary{genres: make(map[string]string), keys: make(map[string]string)}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		genre := strings.TrimSpace(scanner.Text())
+		if genre == "" || strings.HasPrefix(genre, "#") {
+			continue
+		}
+		vocabulary.genres[strings.ToLower(genre)] = genre
+		vocabulary.keys[genre] = genreKey(genre)
+	}
+	if err := scanner.Err(); err != nil {
+		log.Fatalf("Failed to read GENRES_FILE: %v", err)
+	}
+	if len(vocabulary.genres) == 0 {
+		log.Fatalf("GENRES_FILE %s lists no genres", cfg.GenresFile)
+	}
+	return vocabulary
+}
+
+// genreKey is the form genres are compared in for suggestions: lower case
+// letters and digits only, so "Hip Hop" and "hip-hop" are alike
+func genreKey(genre string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			return unicode.ToLower(r)
+		}
+		return -1
+	}, genre)
+}
+
+// checkGenre rewrites the genre of a record in the vocabulary's spelling
+// and returns the issue found with it and the closest genres of the
+// vocabulary, if it is not in it. Records without the column, with it
+// empty, or checked without a vocabulary pass.
+func checkGenre(record map[string]string) ([]string, []string) {
+	value := strings.TrimSpace(record[genreColumn])
+	if genres == nil || value == "" {
+		return nil, nil
+	}
+	if genre, ok := genres.genres[strings.ToLower(value)]; ok {
+		record[genreColumn] = genre
+		return nil, nil
+	}
+	return []string{fmt.Sprintf("unknown genre %q", value)}, genres.suggest(value)
+}
+
+// suggest returns the genres closest to an unknown one by edit distance,
+// nearest first, leaving out those too far apart to be a misspelling
+func (g *genreVocabulary) suggest(value string) []string {
+	if cached, ok := g.suggestions.Load(value); ok {
+		return cached.([]string)
+	}
+	suggestions := closestNames(value, g.keys, maxGenreSuggestions)
+	if g.cached.Load() < genreSuggestionCache {
+		if _, loaded := g.suggestions.LoadOrStore(value, suggestions); !loaded {
+			g.cached.Add(1)
+		}
+	}
+	return suggestions
+}
+
+// closestNames returns up to limit names closest to a value by edit
+// distance of their comparison keys, as made by genreKey, nearest first,
+// leaving out those too far apart to be a misspelling
+func closestNames(value string, keys map[string]string, limit int) []string {
+	type candidate struct {
+		name     string
+		distance int
+	}
+	key := genreKey(value)
+	var candidates []candidate
+	for name, nameKey := range keys {
+		distance := editDistance(key, nameKey)
+		if distance <= max(2, len([]rune(nameKey))/3) {
+			candidates = append(candidates, candidate{name, distance})
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		if candidates[i].distance != candidates[j].distance {
+			return candidates[i].distance < candidates[j].distance
+		}
+		return candidates[i].name < candidates[j].name
+	})
+	var names []string
+	for i := 0; i < len(candidates) && i < limit; i++ {
+		names = append(names, candidates[i].name)
+	}
+	return names
+}
+
+// editDistance returns the Levenshtein distance between two strings
+func editDistance(a, b string) int {
+	s, t := []rune(a), []rune(b)
+	previous := make([]int, len(t)+1)
+	current := make([]int, len(t)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+	for i := 1; i <= len(s); i++ {
+		current[0] = i
+		for j := 1; j <= len(t); j++ {
+			cost := 1
+			if s[i-1] == t[j-1] {
+				cost = 0
+			}
+			current[j] = min(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+		}
+		previous, current = current, previous
+	}
+	return previous[len(t)]
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"runtime/debug"
+	"sync"
+)
+
+// group runs goroutines working on one task, as errgroup.Group does: the
+// first to fail cancels the group's context so the others stop, and its
+// error is what Wait returns. A panicking goroutine fails the group instead
+// of taking the server down with it.
+type group struct {
+	wg     sync.WaitGroup
+	cancel context.CancelCauseFunc
+	once   sync.Once
+	err    error
+}
+
+// newGroup returns a group and the context its goroutines should watch
+func newGroup(ctx context.Context) (*group, context.Context) {
+	ctx, cancel := context.WithCancelCause(ctx)
+	return &group{cancel: cancel}, ctx
+}
+
+// Go runs f in a new goroutine. name identifies it if it panics.
+func (g *group) Go(name string, f func() error) {
+	g.wg.Add(1)
+	go func() {
+		defer g.wg.Done()
+		defer func() {
+			if p := recover(); p != nil {
+				log.Printf("%s panicked: %v\n%s", name, p, debug.Stack())
+				g.fail(fmt.Errorf("%s panicked: %v", name, p))
+			}
+		}()
+		if err := f(); err != nil {
+			g.fail(err)
+		}
+	}()
+}
+
+// fail records the first error and cancels the group
+func (g *group) fail(err error) {
+	g.once.Do(func() {
+		g.err = err
+		g.cancel(err)
+	})
+}
+
+// Wait waits for every goroutine to return and returns the first error
+func (g *group) Wait() error {
+	g.wg.Wait()
+	g.cancel(nil)
+	return g.err
+}
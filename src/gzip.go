@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+)
+
+// gzipMagic is the header every gzip stream starts with
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// isGzip reports whether the upload is gzip-compressed, judging by its first
+// bytes. The file is rewound to the beginning afterwards.
+func isGzip(file multipart.File) (bool, error) {
+	magic := make([]byte, len(gzipMagic))
+	n, err := io.ReadFull(file, magic)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return false, fmt.Errorf("failed to read upload: %v", err)
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return false, fmt.Errorf("failed to rewind upload: %v", err)
+	}
+	return bytes.Equal(magic[:n], gzipMagic), nil
+}
+
+// checkGzipContent rejects compressed uploads whose decompressed content is
+// not plain text. The file is rewound to the beginning afterwards.
+func checkGzipContent(file multipart.File) error {
+	zr, err := newGzipReader(file)
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, sniffLen)
+	n, err := io.ReadFull(zr, buf)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return err
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("failed to rewind upload: %v", err)
+	}
+	return checkTextSample(buf[:n])
+}
+
+// gzipReader decompresses an upload, reporting corrupt data as a problem
+// with the file and refusing to inflate beyond MAX_DECOMPRESSED_MB so a
+// small upload cannot expand without bound
+type gzipReader struct {
+	zr        *gzip.Reader
+	remaining int64
+}
+
+// newGzipReader starts decompressing the upload
+func newGzipReader(r io.Reader) (*gzipReader, error) {
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, fileErrorf(http.StatusUnprocessableEntity, "invalid gzip data: %v", err)
+	}
+	return &gzipReader{zr: zr, remaining: cfg.MaxDecompressedSize}, nil
+}
+
+func (g *gzipReader) Read(p []byte) (int, error) {
+	if g.remaining <= 0 {
+		// Content of exactly the maximum size is fine
+		var probe [1]byte
+		if n, err := g.zr.Read(probe[:]); n == 0 && err == io.EOF {
+			return 0, io.EOF
+		}
+		return 0, fileErrorf(http.StatusRequestEntityTooLarge,
+			"decompressed file exceeds %d MB", cfg.MaxDecompressedSize>>20)
+	}
+	if int64(len(p)) > g.remaining {
+		p = p[:g.remaining]
+	}
+	n, err := g.zr.Read(p)
+	g.remaining -= int64(n)
+	if err != nil && err != io.EOF {
+		err = fileErrorf(http.StatusUnprocessableEntity, "invalid gzip data: %v", err)
+	}
+	return n, err
+}
+
+func (g *gzipReader) Close() error {
+	return g.zr.Close()
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// expectedColumns are the columns of the standard catalogue export, used to
+// recognise the header row when no profile schema is selected
+var expectedColumns = []string{
+	"Release ID", "Release Title", "Track ID", "Track Title", "ISRC",
+	"Artist Name", "Genre", "Release Date", "Label Name", "UPC", "Language",
+	"Explicit", "Territories", "Rights Holder", "File URL", "Royalty Artist %",
+	"Royalty Label %", "Royalty Distributor %", "Royalty Publisher %",
+}
+
+// HeaderReport compares the header row of a file with the columns expected
+// of it: those of the profile's schema, or the standard catalogue export.
+// A header that looks like a misspelling of a missing column is listed in
+// Misspelled rather than Unexpected, and the column stays missing.
+type HeaderReport struct {
+	Missing         []string          `json:"missing,omitempty"`
+	MissingRequired []string          `json:"missing_required,omitempty"`
+	Unexpected      []string          `json:"unexpected,omitempty"`
+	Misspelled      map[string]string `json:"misspelled,omitempty"`
+}
+
+// checkHeader compares headers with the expected columns. Without a
+// profile schema headers must name the columns exactly, since their values
+// are looked up by name; a schema maps headers ignoring case, spaces and
+// punctuation. The report is nil if the header matches.
+func checkHeader(headers, expected []string, exact bool) *HeaderReport {
+	key := normalizeColumnName
+	if exact {
+		key = func(name string) string { return name }
+	}
+	present := make(map[string]bool, len(headers))
+	for _, header := range headers {
+		present[key(header)] = true
+	}
+	wanted := make(map[string]bool, len(expected))
+	report := &HeaderReport{}
+	for _, column := range expected {
+		wanted[key(column)] = true
+		if !present[key(column)] {
+			report.Missing = append(report.Missing, column)
+			if slices.Contains(cfg.RequiredColumns, column) {
+				report.MissingRequired = append(report.MissingRequired, column)
+			}
+		}
+	}
+	var unexpected []string
+	for _, header := range headers {
+		if !wanted[key(header)] {
+			unexpected = append(unexpected, header)
+		}
+	}
+
+	// Pair unexpected headers with the missing columns they come closest
+	// to, each column at most once
+	type pair struct {
+		header, column string
+		distance       int
+	}
+	var pairs []pair
+	for _, header := range unexpected {
+		for _, column := range report.Missing {
+			a, b := normalizeColumnName(header), normalizeColumnName(column)
+			if distance := editDistance(a, b); distance <= max(2, len([]rune(b))/5) {
+				pairs = append(pairs, pair{header, column, distance})
+			}
+		}
+	}
+	sort.SliceStable(pairs, func(i, j int) bool { return pairs[i].distance < pairs[j].distance })
+	claimed := make(map[string]bool)
+	for _, p := range pairs {
+		if _, ok := report.Misspelled[p.header]; ok || claimed[p.column] {
+			continue
+		}
+		if report.Misspelled == nil {
+			report.Misspelled = make(map[string]string)
+		}
+		report.Misspelled[p.header] = p.column
+		claimed[p.column] = true
+	}
+	for _, header := range unexpected {
+		if _, ok := report.Misspelled[header]; !ok {
+			report.Unexpected = append(report.Unexpected, header)
+		}
+	}
+
+	if len(report.Missing) == 0 && len(report.Unexpected) == 0 {
+		return nil
+	}
+	return report
+}
+
+// warnings describes the problems of a header that leave values empty:
+// misspelled and missing required columns
+func (r *HeaderReport) warnings() []string {
+	var warnings []string
+	for _, header := range sortedKeys(r.Misspelled) {
+		warnings = append(warnings, fmt.Sprintf("Column %q looks like a misspelling of %q, which is missing", header, r.Misspelled[header]))
+	}
+	if len(r.MissingRequired) > 0 {
+		warnings = append(warnings, "Required columns are missing: "+strings.Join(r.MissingRequired, ", "))
+	}
+	return warnings
+}
+
+// strictError rejects a header with misspelled or missing required
+// columns, for uploads asking for an exact header
+func (r *HeaderReport) strictError() error {
+	if r == nil || (len(r.Misspelled) == 0 && len(r.MissingRequired) == 0) {
+		return nil
+	}
+	return fileErrorf(http.StatusUnprocessableEntity, "header does not match the expected columns: %s", strings.Join(r.warnings(), "; "))
+}
+
+// sourceRow is a data row and the line of the file it starts on. Rows the
+// reader rejected carry the error.
+type sourceRow struct {
+	line   int
+	fields []string
+	err    *csv.ParseError
+}
+
+// scannedRecord is a record read while looking for the header row
+type scannedRecord struct {
+	fields []string
+	line   int
+	err    error
+}
+
+// findHeader reads the header row, skipping up to maxSkip leading title or
+// metadata lines that some exports put above it. The header is the first
+// record naming at least two known columns or, failing that, the first
+// record of two or more non-empty fields followed by a record of the same
+// width. If neither is found the first record is the header, as without
+// skipping.
+//
+// Records read past the header are returned in pending, to be processed
+// before the rest of the file, malformed ones with their error, and skipped
+// is the number of lines above the header. The reader is left enforcing the
+// header's field count.
+func findHeader(reader *csv.Reader, maxSkip int, known []string) (headers []string, pending []sourceRow, skipped int, err error) {
+	if maxSkip <= 0 {
+		headers, err = reader.Read()
+		return headers, nil, 0, err
+	}
+
+	// Read the candidates plus one record of lookahead, letting lines
+	// above the header have any number of fields
+	reader.FieldsPerRecord = -1
+	var records []scannedRecord
+	for len(records) < maxSkip+2 {
+		fields, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		var parseErr *csv.ParseError
+		if err != nil && !errors.As(err, &parseErr) {
+			return nil, nil, 0, err
+		}
+		record := scannedRecord{fields: fields, err: err}
+		if err != nil {
+			record.line = parseErr.StartLine
+		} else {
+			record.line, _ = reader.FieldPos(0)
+		}
+		records = append(records, record)
+	}
+	if len(records) == 0 {
+		return nil, nil, 0, io.EOF
+	}
+
+	header := headerIndex(records, maxSkip, known)
+	if records[header].err != nil {
+		return nil, nil, 0, records[header].err
+	}
+	headers = records[header].fields
+	skipped = records[header].line - 1
+
+	for _, record := range records[header+1:] {
+		row := sourceRow{line: record.line, fields: record.fields}
+		switch {
+		case record.err != nil:
+			row.err = record.err.(*csv.ParseError)
+		case len(record.fields) != len(headers):
+			row.err = &csv.ParseError{StartLine: record.line, Line: record.line, Err: csv.ErrFieldCount}
+		}
+		pending = append(pending, row)
+	}
+	reader.FieldsPerRecord = len(headers)
+	return headers, pending, skipped, nil
+}
+
+// headerIndex picks the header among the scanned records
+func headerIndex(records []scannedRecord, maxSkip int, known []string) int {
+	knownNames := make(map[string]bool, len(known))
+	for _, column := range known {
+		knownNames[normalizeColumnName(column)] = true
+	}
+	candidates := min(maxSkip+1, len(records))
+
+	for i, record := range records[:candidates] {
+		if record.err != nil {
+			continue
+		}
+		matches := 0
+		for _, field := range record.fields {
+			if knownNames[normalizeColumnName(field)] {
+				matches++
+			}
+		}
+		if matches > 0 && matches >= min(2, len(knownNames)) {
+			return i
+		}
+	}
+
+	for i, record := range records[:candidates] {
+		if record.err != nil || len(record.fields) < 2 {
+			continue
+		}
+		complete := true
+		for _, field := range record.fields {
+			if field == "" {
+				complete = false
+				break
+			}
+		}
+		next := i + 1
+		if complete && (next == len(records) || (records[next].err == nil && len(records[next].fields) == len(record.fields))) {
+			return i
+		}
+	}
+	return 0
+}
@@ -0,0 +1,75 @@
+package main
+
+import "time"
+
+// Processing stages reported to Hooks.OnStageComplete
+const (
+	StageHeader    = "header"
+	StageValidate  = "validate"
+	StageTransform = "transform"
+	StageStore     = "store"
+)
+
+// Hooks let an application embedding the processor follow a job without
+// polling the HTTP endpoints. Every hook is optional. They are called from
+// the goroutine collecting results, one at a time, so they need no locking
+// of their own but should return quickly: a slow hook holds up the workers.
+type Hooks struct {
+	// OnRowProcessed is called for each row once a worker has validated it
+	OnRowProcessed func(RowEvent)
+
+	// OnValidationIssue is called for each check a row failed
+	OnValidationIssue func(ValidationIssue)
+
+	// OnStageComplete is called as each stage of the job finishes
+	OnStageComplete func(StageEvent)
+}
+
+// RowEvent describes a row that was processed. Processed counts the rows
+// done so far, including this one; rows finish in no particular order.
+// Row and Validation must not be modified; checks across rows, such as
+// duplicate_track, are not yet reflected in Validation.
+type RowEvent struct {
+	Worker     int
+	TrackID    string
+	Processed  int
+	Row        map[string]string
+	Validation RowValidation
+}
+
+// ValidationIssue is a check failed by a row
+type ValidationIssue struct {
+	ReleaseID string
+	TrackID   string
+	Check     string
+}
+
+// StageEvent reports a finished stage and how long it took
+type StageEvent struct {
+	Stage    string
+	Rows     int
+	Duration time.Duration
+}
+
+// rowProcessed reports a processed row and its failed checks
+func (h *Hooks) rowProcessed(worker, processed int, row map[string]string, validation RowValidation) {
+	if h == nil {
+		return
+	}
+	if h.OnRowProcessed != nil {
+		h.OnRowProcessed(RowEvent{Worker: worker, TrackID: validation.TrackID, Processed: processed, Row: row, Validation: validation})
+	}
+	if h.OnValidationIssue != nil {
+		for _, check := range validation.FailedChecks() {
+			h.OnValidationIssue(ValidationIssue{ReleaseID: validation.ReleaseID, TrackID: validation.TrackID, Check: check})
+		}
+	}
+}
+
+// stageComplete reports a finished stage that began at started
+func (h *Hooks) stageComplete(stage string, rows int, started time.Time) {
+	if h == nil || h.OnStageComplete == nil {
+		return
+	}
+	h.OnStageComplete(StageEvent{Stage: stage, Rows: rows, Duration: time.Since(started)})
+}
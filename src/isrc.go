@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// isrcColumn is the column holding each track's ISRC
+const isrcColumn = "ISRC"
+
+// isrcRegex matches an ISRC without hyphens: country code, registrant
+// code, year of reference and designation code
+var isrcRegex = regexp.MustCompile(`^([A-Z]{2})([A-Z0-9]{3})([0-9]{2})([0-9]{5})$`)
+
+// isrcPrefixes are the country codes of ISRCs beyond ISO 3166-1: codes
+// issued by the ISRC agencies of the UK and the US, and by IFPI
+var isrcPrefixes = strings.Fields("UK QM QN QO QP QT QZ ZZ CP DG FX TC YU CS")
+
+// isrcCountries are the country codes ISRCs may start with
+var isrcCountries = func() map[string]bool {
+	countries := make(map[string]bool, len(isoCountries)+len(isrcPrefixes))
+	for _, code := range append(append([]string(nil), isoCountries...), isrcPrefixes...) {
+		countries[code] = true
+	}
+	return countries
+}()
+
+// normalizeISRC returns an ISRC in its usual form, upper case without
+// hyphens or spaces
+func normalizeISRC(value string) string {
+	return strings.NewReplacer("-", "", " ", "").Replace(strings.ToUpper(strings.TrimSpace(value)))
+}
+
+// checkISRC rewrites the ISRC of a record in its usual form and returns
+// the issues found with it. ISRCs carry no check digit, so their
+// structure is what is checked: CC-XXX-YY-NNNNN, with a known country
+// code, an alphanumeric registrant code that is not a placeholder, two
+// digits of year and five of designation. Records without the column, or
+// with it empty, pass.
+func checkISRC(record map[string]string) []string {
+	value, ok := record[isrcColumn]
+	if !ok || strings.TrimSpace(value) == "" {
+		return nil
+	}
+	isrc := normalizeISRC(value)
+	parts := isrcRegex.FindStringSubmatch(isrc)
+	if parts == nil {
+		return []string{fmt.Sprintf("%q is not of the form CC-XXX-YY-NNNNN", value)}
+	}
+	record[isrcColumn] = isrc
+
+	var issues []string
+	if !isrcCountries[parts[1]] {
+		issues = append(issues, fmt.Sprintf("unknown country code %s", parts[1]))
+	}
+	if parts[2] == "000" || parts[2] == "XXX" {
+		issues = append(issues, fmt.Sprintf("placeholder registrant code %s", parts[2]))
+	}
+	if parts[4] == "00000" {
+		issues = append(issues, "placeholder designation code 00000")
+	}
+	return issues
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// maxEnumValuesShown bounds the allowed values quoted in an enum check's
+// message
+const maxEnumValuesShown = 10
+
+// Issue describes a failed check of a row: the column and value at fault,
+// where there is one, and what is wrong with them
+type Issue struct {
+	Check    string `json:"check"`
+	Severity string `json:"severity"`
+	Column   string `json:"column,omitempty"`
+	Value    string `json:"value,omitempty"`
+	Message  string `json:"message"`
+}
+
+// issue describes the failure of a check against a record
+func (c compiledCheck) issue(record map[string]string) Issue {
+	issue := Issue{Check: c.Name, Column: c.Column, Value: record[c.Column]}
+	switch c.Type {
+	case checkRequired:
+		issue.Message = fmt.Sprintf("%s is empty", c.Column)
+	case checkRegex:
+		issue.Message = fmt.Sprintf("%s %q does not match %s", c.Column, issue.Value, c.Pattern)
+	case checkRange:
+		if c.Column != "" {
+			issue.Message = fmt.Sprintf("%s %q is not a number %s", c.Column, issue.Value, describeRange(c.Min, c.Max))
+			break
+		}
+		// A range over columns points at the first column out of range
+		columns := c.outOfRange(record)
+		if len(columns) == 0 {
+			break
+		}
+		issue.Column, issue.Value = columns[0], record[columns[0]]
+		messages := make([]string, len(columns))
+		for i, column := range columns {
+			messages[i] = fmt.Sprintf("%s %q", column, record[column])
+		}
+		if len(columns) == 1 {
+			issue.Message = fmt.Sprintf("%s is not a number %s", messages[0], describeRange(c.Min, c.Max))
+		} else {
+			issue.Message = fmt.Sprintf("%s are not numbers %s", strings.Join(messages, ", "), describeRange(c.Min, c.Max))
+		}
+	case checkEnum:
+		values := c.Values
+		if len(values) > maxEnumValuesShown {
+			values = append(values[:maxEnumValuesShown:maxEnumValuesShown], "...")
+		}
+		issue.Message = fmt.Sprintf("%s %q is not one of %s", c.Column, issue.Value, strings.Join(values, ", "))
+	case checkSum:
+		issue.Column, issue.Value = "", formatSum(c.sum(record))
+		issue.Message = fmt.Sprintf("%s add up to %s, expected %s ± %s", strings.Join(c.Columns, ", "), issue.Value,
+			formatNumber(c.Equals), formatNumber(c.Tolerance))
+	case checkCEL:
+		if _, err := c.program.eval(record); err != nil {
+			issue.Message = fmt.Sprintf("%s failed: %v", c.Expr, err)
+		} else {
+			issue.Message = fmt.Sprintf("%s is false", c.Expr)
+		}
+	}
+	if c.when != nil {
+		issue.Message += fmt.Sprintf(", as %s is %q", c.when.Column, record[c.when.Column])
+	}
+	return issue
+}
+
+// describeRange describes the bounds of a range check
+func describeRange(min, max *float64) string {
+	switch {
+	case min != nil && max != nil:
+		return fmt.Sprintf("from %s to %s", formatNumber(*min), formatNumber(*max))
+	case min != nil:
+		return fmt.Sprintf("of at least %s", formatNumber(*min))
+	case max != nil:
+		return fmt.Sprintf("of at most %s", formatNumber(*max))
+	}
+	return "at all"
+}
+
+// formatNumber writes a number in its shortest form
+func formatNumber(value float64) string {
+	return strconv.FormatFloat(value, 'f', -1, 64)
+}
+
+// describe adds an issue for each failed check of a row that the check set
+// has not described: the built-in checks, with the values at fault, and
+// the rules of its profiles. Checks across rows are described by
+// checkCrossRow.
+func (v *RowValidation) describe(record map[string]string, rules []*Rule, profiles []profileRules) {
+	add := func(check, column, message string) {
+		issue := Issue{Check: check, Column: column, Message: message}
+		if column != "" {
+			issue.Value = record[column]
+		}
+		v.Issues = append(v.Issues, issue)
+	}
+
+	for _, issue := range v.DateIssues {
+		add("release_date", releaseDateColumn, issue)
+	}
+	if !v.Territories {
+		add("territories", "Territories", strings.Join(v.TerritoryIssues, "; "))
+	}
+	if !v.UPCValid {
+		add("upc", "UPC", "not a 12-digit UPC-A or 13-digit EAN-13 code with a correct check digit")
+	}
+	for _, column := range v.MissingFields {
+		if _, ok := record[column]; ok {
+			add("required_fields", column, fmt.Sprintf("%s is empty", column))
+		} else {
+			add("required_fields", column, fmt.Sprintf("the file has no %s column", column))
+		}
+	}
+	for _, issue := range v.PayeeIssues {
+		add("payee_ids", "", issue)
+	}
+	for _, issue := range v.NumericIssues {
+		add("numerics", "UPC", issue)
+	}
+	for _, issue := range v.ReleaseTypeIssues {
+		add("release_type", releaseTypeColumn, issue)
+	}
+	for _, issue := range v.ISRCIssues {
+		add("isrc", isrcColumn, issue)
+	}
+	for _, issue := range v.GenreIssues {
+		if len(v.GenreSuggestions) > 0 {
+			issue += fmt.Sprintf("; did you mean %s?", strings.Join(v.GenreSuggestions, " or "))
+		}
+		add("genre", genreColumn, issue)
+	}
+	for _, issue := range v.LabelIssues {
+		if len(v.LabelSuggestions) > 0 {
+			issue += fmt.Sprintf("; did you mean %s?", strings.Join(v.LabelSuggestions, " or "))
+		}
+		add("label", labelColumn, issue)
+	}
+	for _, issue := range v.RightsHolderIssues {
+		if len(v.RightsHolderSuggestions) > 0 {
+			issue += fmt.Sprintf("; did you mean %s?", strings.Join(v.RightsHolderSuggestions, " or "))
+		}
+		add("rights_holder", rightsHolderColumn, issue)
+	}
+	for _, rule := range rules {
+		if !v.Rules[rule.Name] {
+			add(rule.Name, "", fmt.Sprintf("rule failed: %s", rule.Expr))
+		}
+	}
+	for _, profile := range profiles {
+		for _, rule := range profile.rules {
+			if !v.ProfileRules[profile.name][rule.Name] {
+				add(profile.name+":"+rule.Name, "", fmt.Sprintf("rule of profile %s failed: %s", profile.name, rule.Expr))
+			}
+		}
+	}
+}
+
+// withoutChecks returns issues without those of the named checks, in a
+// new slice
+func withoutChecks(issues []Issue, checks ...string) []Issue {
+	var kept []Issue
+	for _, issue := range issues {
+		if !slices.Contains(checks, issue.Check) {
+			kept = append(kept, issue)
+		}
+	}
+	return kept
+}
@@ -0,0 +1,779 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Job states
+const (
+	JobQueued    = "queued"
+	JobRunning   = "running"
+	JobCompleted = "completed"
+	JobFailed    = "failed"
+)
+
+// Job describes a single upload and its progress
+type Job struct {
+	ID            string     `json:"id"`
+	Tenant        string     `json:"tenant"`
+	ExternalID    string     `json:"external_id,omitempty"`
+	ParentID      string     `json:"parent_id,omitempty"`
+	Filename      string     `json:"filename"`
+	Status        string     `json:"status"`
+	Workers       int        `json:"workers"`
+	ProcessedRows int        `json:"processed_rows"`
+	Error         string     `json:"error,omitempty"`
+	Instance      string     `json:"instance"`
+	CreatedAt     time.Time  `json:"created_at"`
+	StartedAt     *time.Time `json:"started_at,omitempty"`
+	FinishedAt    *time.Time `json:"finished_at,omitempty"`
+
+	// FailedRows and Failures summarise the validation outcome of a
+	// completed job: rows failing a check of error severity and rows
+	// failing each check. Errors and Warnings are the failed checks of
+	// each severity over all rows.
+	FailedRows int            `json:"failed_rows"`
+	Failures   map[string]int `json:"failures,omitempty"`
+	Errors     int            `json:"errors"`
+	Warnings   int            `json:"warnings"`
+
+	// ProfileFailures is the number of rows failing each further profile
+	// the job was validated against
+	ProfileFailures map[string]int `json:"profile_failures,omitempty"`
+
+	// Uploads are the digests of the job's files in the upload store, the
+	// original upload first and then any appended parts
+	Uploads []string `json:"uploads,omitempty"`
+
+	// ContentHash is the SHA-256 of the uploaded file. ReuseKey identifies
+	// the file and the options it was processed with, for answering later
+	// uploads of it with this job's result; it is cleared once the result
+	// changes.
+	ContentHash string `json:"content_hash,omitempty"`
+	ReuseKey    string `json:"reuse_key,omitempty"`
+}
+
+// Active reports whether the job is still queued or running
+func (j *Job) Active() bool {
+	return j.Status == JobQueued || j.Status == JobRunning
+}
+
+// countFailures sets FailedRows, Failures, Errors, Warnings and
+// ProfileFailures from the validation results
+func (j *Job) countFailures(validations map[string]RowValidation) {
+	j.FailedRows, j.Errors, j.Warnings = 0, 0, 0
+	j.Failures = make(map[string]int)
+	j.ProfileFailures = nil
+	for _, validation := range validations {
+		failed := validation.FailedChecks()
+		if validation.Failed() {
+			j.FailedRows++
+		}
+		j.Errors += len(failed) - validation.Warnings
+		j.Warnings += validation.Warnings
+		for _, check := range failed {
+			j.Failures[check]++
+		}
+		for _, profile := range validation.FailedProfiles() {
+			if j.ProfileFailures == nil {
+				j.ProfileFailures = make(map[string]int)
+			}
+			j.ProfileFailures[profile]++
+		}
+	}
+}
+
+// ErrJobNotFound is returned by a JobStore for unknown job IDs
+var ErrJobNotFound = errors.New("job not found")
+
+// externalIDRegex restricts client-supplied external IDs to printable ASCII
+var externalIDRegex = regexp.MustCompile(`^[\x21-\x7e]{1,128}$`)
+
+// JobStore persists job state and results so that any replica can answer
+// for any job
+type JobStore interface {
+	SaveJob(job *Job) error
+	GetJob(id string) (*Job, error)
+	ListJobs(limit int) ([]*Job, error)
+	SaveResult(id string, result *OutputFormat) error
+	GetResult(id string) (*OutputFormat, error)
+	AddAnnotation(id string, annotation Annotation) error
+	Annotations(id string) ([]Annotation, error)
+
+	// ClaimExternalID records jobID as the job with the tenant's external
+	// ID unless another job already has it, and returns the ID of the job
+	// that holds it
+	ClaimExternalID(tenant, externalID, jobID string) (string, error)
+	// FindExternalID returns the ID of the tenant's job with the external ID
+	FindExternalID(tenant, externalID string) (string, error)
+
+	// FindReuseKey returns the ID of the tenant's last completed job saved
+	// with the reuse key. The caller checks the job still has it.
+	FindReuseKey(tenant, key string) (string, error)
+
+	// DeleteAnnotations removes a job's annotations on the given rows and
+	// returns how many were removed
+	DeleteAnnotations(id string, rows []string) (int, error)
+	// AddTombstone records a purge. Tombstones are kept beyond the job
+	// history.
+	AddTombstone(tombstone *Tombstone) error
+	// Tombstones returns the recorded purges, oldest first
+	Tombstones() ([]*Tombstone, error)
+
+	// SaveViews replaces the materialized views of a job's result
+	SaveViews(id string, views map[string]*OutputFormat) error
+	// GetView returns a materialized view of a job's result by name
+	GetView(id, name string) (*OutputFormat, error)
+
+	// Usage reports how much the store holds
+	Usage() (StorageUsage, error)
+
+	// GetTenantSettings returns a tenant's settings, or ErrSettingsNotFound
+	GetTenantSettings(tenant string) (*TenantSettings, error)
+	// SaveTenantSettings creates or replaces a tenant's settings. Settings
+	// are kept beyond the job history.
+	SaveTenantSettings(settings *TenantSettings) error
+	// DeleteTenantSettings removes a tenant's settings
+	DeleteTenantSettings(tenant string) error
+	// ListTenantSettings returns the settings of every tenant, by tenant
+	ListTenantSettings() ([]*TenantSettings, error)
+
+	// GetDictionary returns a tenant's dictionary, or ErrDictionaryNotFound
+	GetDictionary(tenant string) (*Dictionary, error)
+	// SaveDictionary creates or replaces a tenant's dictionary.
+	// Dictionaries are kept beyond the job history.
+	SaveDictionary(dictionary *Dictionary) error
+	// DeleteDictionary removes a tenant's dictionary
+	DeleteDictionary(tenant string) error
+
+	// GetDelivery returns a parked delivery, or ErrDeliveryNotFound
+	GetDelivery(id string) (*Delivery, error)
+	// SaveDelivery parks a delivery or updates a parked one. Parked
+	// deliveries are kept beyond the job history.
+	SaveDelivery(d *Delivery) error
+	// DeleteDelivery removes a parked delivery
+	DeleteDelivery(id string) error
+	// ListDeliveries returns the parked deliveries, oldest first
+	ListDeliveries() ([]*Delivery, error)
+}
+
+// StorageUsage is the number of jobs and results a job store holds and,
+// where the store can tell, the bytes it uses
+type StorageUsage struct {
+	Jobs    int   `json:"jobs"`
+	Results int   `json:"results"`
+	Bytes   int64 `json:"bytes,omitempty"`
+}
+
+// jobStore is the configured job store
+var jobStore = newJobStore()
+
+// instanceName identifies this replica in job records
+var instanceName, _ = os.Hostname()
+
+// newJobStore creates the job store selected by the JOB_STORE setting,
+// encrypting sensitive columns if configured
+func newJobStore() JobStore {
+	var store JobStore
+	switch cfg.JobStore {
+	case "redis":
+		store = NewRedisJobStore(cfg.RedisAddr, cfg.RedisPassword, cfg.RedisDB, cfg.JobTTL)
+	case "file":
+		fileStore, err := NewFileJobStore(cfg.JobStoreDir, cfg.JobHistory)
+		if err != nil {
+			log.Fatalf("Failed to open job store in %s: %v", cfg.JobStoreDir, err)
+		}
+		store = fileStore
+	case "memory", "":
+		store = NewMemoryJobStore(cfg.JobHistory)
+	default:
+		log.Fatalf("Unknown JOB_STORE %q, expected memory, file or redis", cfg.JobStore)
+	}
+	if keys := newKeyWrapper(); keys != nil {
+		store = NewEncryptingJobStore(store, keys, cfg.EncryptColumns)
+	}
+	return store
+}
+
+// jobIDGenerators are the available job ID formats, selected with JOB_ID_FORMAT
+var jobIDGenerators = map[string]func() string{
+	"hex": func() string {
+		return hex.EncodeToString(randomBytes(8))
+	},
+	"uuid": func() string {
+		b := randomBytes(16)
+		b[6] = b[6]&0x0f | 0x40 // version 4
+		b[8] = b[8]&0x3f | 0x80 // RFC 4122 variant
+		return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+	},
+}
+
+// newJobID returns a new job identifier in the configured format
+var newJobID = func() func() string {
+	generate, ok := jobIDGenerators[cfg.JobIDFormat]
+	if !ok {
+		log.Fatalf("Unknown JOB_ID_FORMAT %q, expected hex or uuid", cfg.JobIDFormat)
+	}
+	return generate
+}()
+
+// randomBytes returns n random bytes, falling back to the clock if the
+// system source fails
+func randomBytes(n int) []byte {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		binary.BigEndian.PutUint64(b[:min(n, 8)], uint64(time.Now().UnixNano()))
+	}
+	return b
+}
+
+// saveJob stores the job, logging rather than failing the upload when the
+// store is unavailable
+func saveJob(job *Job) {
+	if err := jobStore.SaveJob(job); err != nil {
+		log.Printf("Failed to save job %s: %v", job.ID, err)
+	}
+}
+
+// MemoryJobStore keeps jobs in process memory. It only serves a single
+// replica and keeps the most recent jobs up to its history limit.
+type MemoryJobStore struct {
+	mu           sync.RWMutex
+	history      int
+	jobs         map[string]*Job
+	results      map[string]*OutputFormat
+	views        map[string]map[string]*OutputFormat
+	annotations  map[string][]Annotation
+	externalIDs  map[string]string
+	reuseKeys    map[string]string
+	tombstones   []*Tombstone
+	settings     map[string]*TenantSettings
+	dictionaries map[string]*Dictionary
+	deliveries   map[string]*Delivery
+}
+
+// NewMemoryJobStore creates an in-memory store keeping up to history jobs
+func NewMemoryJobStore(history int) *MemoryJobStore {
+	return &MemoryJobStore{
+		history:      max(history, 1),
+		jobs:         make(map[string]*Job),
+		results:      make(map[string]*OutputFormat),
+		views:        make(map[string]map[string]*OutputFormat),
+		annotations:  make(map[string][]Annotation),
+		externalIDs:  make(map[string]string),
+		reuseKeys:    make(map[string]string),
+		settings:     make(map[string]*TenantSettings),
+		dictionaries: make(map[string]*Dictionary),
+		deliveries:   make(map[string]*Delivery),
+	}
+}
+
+// SaveJob stores a copy of the job
+func (s *MemoryJobStore) SaveJob(job *Job) error {
+	jobCopy := *job
+	s.mu.Lock()
+	s.jobs[job.ID] = &jobCopy
+	if job.ReuseKey != "" && job.Status == JobCompleted {
+		s.reuseKeys[job.Tenant+"\x00"+job.ReuseKey] = job.ID
+	}
+	s.evict()
+	s.mu.Unlock()
+	return nil
+}
+
+// GetJob returns a copy of the job with the given ID
+func (s *MemoryJobStore) GetJob(id string) (*Job, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	job, ok := s.jobs[id]
+	if !ok {
+		return nil, ErrJobNotFound
+	}
+	jobCopy := *job
+	return &jobCopy, nil
+}
+
+// ListJobs returns up to limit jobs, most recent first
+func (s *MemoryJobStore) ListJobs(limit int) ([]*Job, error) {
+	s.mu.RLock()
+	jobs := make([]*Job, 0, len(s.jobs))
+	for _, job := range s.jobs {
+		jobCopy := *job
+		jobs = append(jobs, &jobCopy)
+	}
+	s.mu.RUnlock()
+
+	sortJobs(jobs)
+	if limit > 0 && len(jobs) > limit {
+		jobs = jobs[:limit]
+	}
+	return jobs, nil
+}
+
+// SaveResult stores the result of a job
+func (s *MemoryJobStore) SaveResult(id string, result *OutputFormat) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.jobs[id]; !ok {
+		return ErrJobNotFound
+	}
+	s.results[id] = result
+	return nil
+}
+
+// GetResult returns the stored result of a job
+func (s *MemoryJobStore) GetResult(id string) (*OutputFormat, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	result, ok := s.results[id]
+	if !ok {
+		return nil, ErrJobNotFound
+	}
+	return result, nil
+}
+
+// AddAnnotation appends an annotation to a job
+func (s *MemoryJobStore) AddAnnotation(id string, annotation Annotation) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.jobs[id]; !ok {
+		return ErrJobNotFound
+	}
+	s.annotations[id] = append(s.annotations[id], annotation)
+	return nil
+}
+
+// Annotations returns the annotations of a job in the order they were added
+func (s *MemoryJobStore) Annotations(id string) ([]Annotation, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if _, ok := s.jobs[id]; !ok {
+		return nil, ErrJobNotFound
+	}
+	return append([]Annotation(nil), s.annotations[id]...), nil
+}
+
+// ClaimExternalID records the job holding a tenant's external ID
+func (s *MemoryJobStore) ClaimExternalID(tenant, externalID, jobID string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := tenant + "\x00" + externalID
+	if owner, ok := s.externalIDs[key]; ok {
+		return owner, nil
+	}
+	s.externalIDs[key] = jobID
+	return jobID, nil
+}
+
+// FindExternalID returns the job holding a tenant's external ID
+func (s *MemoryJobStore) FindExternalID(tenant, externalID string) (string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	owner, ok := s.externalIDs[tenant+"\x00"+externalID]
+	if !ok {
+		return "", ErrJobNotFound
+	}
+	return owner, nil
+}
+
+// FindReuseKey returns the last completed job saved with a tenant's reuse
+// key
+func (s *MemoryJobStore) FindReuseKey(tenant, key string) (string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	id, ok := s.reuseKeys[tenant+"\x00"+key]
+	if !ok {
+		return "", ErrJobNotFound
+	}
+	return id, nil
+}
+
+// DeleteAnnotations removes a job's annotations on the given rows
+func (s *MemoryJobStore) DeleteAnnotations(id string, rows []string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.jobs[id]; !ok {
+		return 0, ErrJobNotFound
+	}
+	deleted := make(map[string]bool, len(rows))
+	for _, row := range rows {
+		deleted[row] = true
+	}
+	var kept []Annotation
+	for _, annotation := range s.annotations[id] {
+		if !deleted[annotation.Row] {
+			kept = append(kept, annotation)
+		}
+	}
+	removed := len(s.annotations[id]) - len(kept)
+	if len(kept) == 0 {
+		delete(s.annotations, id)
+	} else {
+		s.annotations[id] = kept
+	}
+	return removed, nil
+}
+
+// AddTombstone records a purge
+func (s *MemoryJobStore) AddTombstone(tombstone *Tombstone) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tombstones = append(s.tombstones, tombstone)
+	return nil
+}
+
+// Tombstones returns the recorded purges, oldest first
+func (s *MemoryJobStore) Tombstones() ([]*Tombstone, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return append([]*Tombstone(nil), s.tombstones...), nil
+}
+
+// GetTenantSettings returns a copy of a tenant's settings
+func (s *MemoryJobStore) GetTenantSettings(tenant string) (*TenantSettings, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	settings, ok := s.settings[tenant]
+	if !ok {
+		return nil, ErrSettingsNotFound
+	}
+	settingsCopy := *settings
+	return &settingsCopy, nil
+}
+
+// SaveTenantSettings stores a copy of a tenant's settings
+func (s *MemoryJobStore) SaveTenantSettings(settings *TenantSettings) error {
+	settingsCopy := *settings
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.settings[settings.Tenant] = &settingsCopy
+	return nil
+}
+
+// DeleteTenantSettings removes a tenant's settings
+func (s *MemoryJobStore) DeleteTenantSettings(tenant string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.settings[tenant]; !ok {
+		return ErrSettingsNotFound
+	}
+	delete(s.settings, tenant)
+	return nil
+}
+
+// ListTenantSettings returns copies of every tenant's settings, by tenant
+func (s *MemoryJobStore) ListTenantSettings() ([]*TenantSettings, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	list := make([]*TenantSettings, 0, len(s.settings))
+	for _, tenant := range sortedKeys(s.settings) {
+		settingsCopy := *s.settings[tenant]
+		list = append(list, &settingsCopy)
+	}
+	return list, nil
+}
+
+// GetDictionary returns a copy of a tenant's dictionary
+func (s *MemoryJobStore) GetDictionary(tenant string) (*Dictionary, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	dictionary, ok := s.dictionaries[tenant]
+	if !ok {
+		return nil, ErrDictionaryNotFound
+	}
+	dictionaryCopy := *dictionary
+	dictionaryCopy.Entries = maps.Clone(dictionary.Entries)
+	return &dictionaryCopy, nil
+}
+
+// SaveDictionary stores a copy of a tenant's dictionary
+func (s *MemoryJobStore) SaveDictionary(dictionary *Dictionary) error {
+	dictionaryCopy := *dictionary
+	dictionaryCopy.Entries = maps.Clone(dictionary.Entries)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.dictionaries[dictionary.Tenant] = &dictionaryCopy
+	return nil
+}
+
+// DeleteDictionary removes a tenant's dictionary
+func (s *MemoryJobStore) DeleteDictionary(tenant string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.dictionaries[tenant]; !ok {
+		return ErrDictionaryNotFound
+	}
+	delete(s.dictionaries, tenant)
+	return nil
+}
+
+// GetDelivery returns a copy of a parked delivery
+func (s *MemoryJobStore) GetDelivery(id string) (*Delivery, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	d, ok := s.deliveries[id]
+	if !ok {
+		return nil, ErrDeliveryNotFound
+	}
+	deliveryCopy := *d
+	return &deliveryCopy, nil
+}
+
+// SaveDelivery stores a copy of a parked delivery
+func (s *MemoryJobStore) SaveDelivery(d *Delivery) error {
+	deliveryCopy := *d
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.deliveries[d.ID] = &deliveryCopy
+	return nil
+}
+
+// DeleteDelivery removes a parked delivery
+func (s *MemoryJobStore) DeleteDelivery(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.deliveries[id]; !ok {
+		return ErrDeliveryNotFound
+	}
+	delete(s.deliveries, id)
+	return nil
+}
+
+// ListDeliveries returns copies of the parked deliveries, oldest first
+func (s *MemoryJobStore) ListDeliveries() ([]*Delivery, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	list := make([]*Delivery, 0, len(s.deliveries))
+	for _, d := range s.deliveries {
+		deliveryCopy := *d
+		list = append(list, &deliveryCopy)
+	}
+	sortDeliveries(list)
+	return list, nil
+}
+
+// SaveViews replaces the materialized views of a job's result
+func (s *MemoryJobStore) SaveViews(id string, views map[string]*OutputFormat) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.jobs[id]; !ok {
+		return ErrJobNotFound
+	}
+	s.views[id] = views
+	return nil
+}
+
+// GetView returns a materialized view of a job's result
+func (s *MemoryJobStore) GetView(id, name string) (*OutputFormat, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	view, ok := s.views[id][name]
+	if !ok {
+		return nil, ErrJobNotFound
+	}
+	return view, nil
+}
+
+// Usage counts the jobs and results held in memory
+func (s *MemoryJobStore) Usage() (StorageUsage, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return StorageUsage{Jobs: len(s.jobs), Results: len(s.results)}, nil
+}
+
+// evict drops the oldest finished jobs beyond the history limit. The caller
+// must hold the write lock.
+func (s *MemoryJobStore) evict() {
+	if len(s.jobs) <= s.history {
+		return
+	}
+	jobs := make([]*Job, 0, len(s.jobs))
+	for _, job := range s.jobs {
+		jobs = append(jobs, job)
+	}
+	sortJobs(jobs)
+	for _, job := range jobs[s.history:] {
+		if job.Active() {
+			continue
+		}
+		delete(s.jobs, job.ID)
+		delete(s.results, job.ID)
+		delete(s.views, job.ID)
+		delete(s.annotations, job.ID)
+		if job.ExternalID != "" {
+			delete(s.externalIDs, job.Tenant+"\x00"+job.ExternalID)
+		}
+		if key := job.Tenant + "\x00" + job.ReuseKey; job.ReuseKey != "" && s.reuseKeys[key] == job.ID {
+			delete(s.reuseKeys, key)
+		}
+	}
+}
+
+// sortJobs orders jobs by creation time, most recent first, and by ID for
+// jobs created at the same time so listings are stable
+func sortJobs(jobs []*Job) {
+	sort.Slice(jobs, func(i, j int) bool {
+		if !jobs[i].CreatedAt.Equal(jobs[j].CreatedAt) {
+			return jobs[i].CreatedAt.After(jobs[j].CreatedAt)
+		}
+		return jobs[i].ID < jobs[j].ID
+	})
+}
+
+// jobsHandler lists the most recent jobs, or the tenant's job with the
+// external ID given as ?external_id=
+func jobsHandler(w http.ResponseWriter, r *http.Request) {
+	var jobs []*Job
+	var err error
+	if externalID := r.URL.Query().Get("external_id"); externalID != "" {
+		jobs, err = jobsByExternalID(r, externalID)
+	} else {
+		jobs, err = jobStore.ListJobs(100)
+	}
+	if err != nil {
+		writeError(w, "Failed to list jobs: ", err)
+		return
+	}
+	writeCachedJSON(w, r, struct {
+		Jobs []*Job `json:"jobs"`
+	}{Jobs: jobs})
+}
+
+// jobsByExternalID looks up the requesting tenant's job with an external ID.
+// No jobs are returned when there is none.
+func jobsByExternalID(r *http.Request, externalID string) ([]*Job, error) {
+	tenant, ok := tenantFromRequest(r)
+	if !ok {
+		return nil, fileErrorf(http.StatusBadRequest, "invalid tenant %q", tenant)
+	}
+	jobs := []*Job{}
+	id, err := jobStore.FindExternalID(tenant, externalID)
+	if errors.Is(err, ErrJobNotFound) {
+		return jobs, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	job, err := jobStore.GetJob(id)
+	if errors.Is(err, ErrJobNotFound) {
+		return jobs, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return append(jobs, job), nil
+}
+
+// jobHandler returns the state of a single job
+func jobHandler(w http.ResponseWriter, r *http.Request) {
+	job, err := jobStore.GetJob(r.PathValue("id"))
+	if err != nil {
+		writeStoreError(w, "Failed to get job: ", err)
+		return
+	}
+	writeCachedJSON(w, r, job)
+}
+
+// jobResultHandler returns the stored result of a finished job together
+// with its annotations. Large results can be downloaded in ranges.
+func jobResultHandler(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	shape, err := parseShape(r)
+	if err != nil {
+		writeError(w, "Invalid shape: ", err)
+		return
+	}
+	result, err := jobStore.GetResult(id)
+	if err != nil {
+		writeStoreError(w, "Failed to get result: ", err)
+		return
+	}
+	annotations, err := jobStore.Annotations(id)
+	if err != nil {
+		writeStoreError(w, "Failed to get annotations: ", err)
+		return
+	}
+
+	// Readers without access to sensitive columns get placeholders
+	if len(result.SensitiveColumns) > 0 && !canReadSensitive(r) {
+		result = redactSensitive(result)
+	}
+
+	// Copy the result so the stored one is left untouched
+	resultCopy := *result
+	resultCopy.Annotations = groupAnnotations(annotations)
+
+	// Consumers of large results can ask for protobuf instead of JSON
+	w.Header().Add("Vary", "Accept")
+	if acceptsProtobuf(r) {
+		var filename string
+		if r.URL.Query().Has("download") {
+			filename = "result-" + id + ".pb"
+		}
+		serveDownload(w, r, filename, protobufContentType, encodeResultProto(shape.Filter.apply(&resultCopy)))
+		return
+	}
+
+	data, err := json.MarshalIndent(shape.apply(&resultCopy), "", "  ")
+	if err != nil {
+		http.Error(w, "Failed to encode result: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	var filename string
+	if r.URL.Query().Has("download") {
+		filename = "result-" + id + ".json"
+	}
+	serveDownload(w, r, filename, "application/json", append(data, '\n'))
+}
+
+// writeStoreError reports a job store error, using 404 for unknown jobs
+func writeStoreError(w http.ResponseWriter, prefix string, err error) {
+	if errors.Is(err, ErrJobNotFound) {
+		http.Error(w, prefix+err.Error(), http.StatusNotFound)
+		return
+	}
+	http.Error(w, prefix+err.Error(), http.StatusInternalServerError)
+}
+
+// writeCachedJSON writes v as indented JSON with a content-derived ETag, so
+// clients polling with If-None-Match get 304 Not Modified while nothing
+// has changed
+func writeCachedJSON(w http.ResponseWriter, r *http.Request, v interface{}) {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		http.Error(w, "Failed to encode response: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	serveDownload(w, r, "", "application/json", append(data, '\n'))
+}
+
+// writeJSON writes v as indented JSON
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	writeJSONStatus(w, http.StatusOK, v)
+}
+
+// writeJSONStatus writes v as indented JSON with the given status code
+func writeJSONStatus(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.WriteHeader(status)
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(v); err != nil {
+		http.Error(w, "Failed to encode response: "+err.Error(), http.StatusInternalServerError)
+	}
+}
@@ -1,16 +1,20 @@
 package main
 
 import (
+	"archive/zip"
+	"bufio"
+	"context"
 	"encoding/csv"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"mime/multipart"
 	"net/http"
-	"os"
+	"path/filepath"
 	"regexp"
 	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -42,16 +46,366 @@ type Record struct {
 
 // RowValidation represents the validation results for a single row
 type RowValidation struct {
-	ReleaseID    string `json:"release_id"`
-	TrackID      string `json:"track_id"`
-	RoyaltiesSum bool   `json:"royalties_sum"`
-	DateFormat   bool   `json:"date_format"`
+	ReleaseID       string          `json:"release_id"`
+	TrackID         string          `json:"track_id"`
+	Line            int             `json:"line,omitempty"`
+	RoyaltiesSum    bool            `json:"royalties_sum"`
+	RoyaltiesTotal  *float64        `json:"royalties_total,omitempty"`
+
+	// Errors and Warnings count the failed checks of each severity; the
+	// row fails if any is an error
+	Errors   int `json:"errors,omitempty"`
+	Warnings int `json:"warnings,omitempty"`
+
+	// RoyaltyFormat is how the royalty shares were written, as a fraction,
+	// percent or number, when they were rewritten as percentages
+	RoyaltyFormat string `json:"royalty_format,omitempty"`
+
+	DateFormat      bool            `json:"date_format"`
+	Territories     bool            `json:"territories"`
+	TerritoryIssues []string        `json:"territory_issues,omitempty"`
+	Rules           map[string]bool `json:"rules,omitempty"`
+
+	// Checks holds the outcome of each check of the job's check set other
+	// than royalties_sum and date_format
+	Checks map[string]bool `json:"checks,omitempty"`
+
+	// UPCValid is false for a UPC of the wrong length, with other than
+	// digits or with a wrong check digit
+	UPCValid bool `json:"upc_valid"`
+
+	// MissingFields lists the required columns the row leaves empty
+	MissingFields []string `json:"missing_fields,omitempty"`
+
+	// DateIssues lists the sanity rules a well-formed release date fails
+	DateIssues []string `json:"date_issues,omitempty"`
+
+	// OriginalReleaseDate is the release date as written, when it was
+	// converted to YYYY-MM-DD from another format
+	OriginalReleaseDate string `json:"original_release_date,omitempty"`
+
+	// GenreIssues flags a genre outside GENRES_FILE, and GenreSuggestions
+	// holds the closest genres of the vocabulary
+	GenreIssues      []string `json:"genre_issues,omitempty"`
+	GenreSuggestions []string `json:"genre_suggestions,omitempty"`
+
+	// LabelIssues and RightsHolderIssues flag names outside LABELS_FILE and
+	// RIGHTS_HOLDERS_FILE, with the closest names of the lists
+	LabelIssues             []string `json:"label_issues,omitempty"`
+	LabelSuggestions        []string `json:"label_suggestions,omitempty"`
+	RightsHolderIssues      []string `json:"rights_holder_issues,omitempty"`
+	RightsHolderSuggestions []string `json:"rights_holder_suggestions,omitempty"`
+
+	// PayeeIssues lists invalid IPI/IPN identifiers and royalty shares of
+	// parties with no identifier, when the file has identifier columns
+	PayeeIssues []string `json:"payee_issues,omitempty"`
+
+	// NumericIssues lists values mangled by Excel that could not be
+	// repaired, when repairing is requested
+	NumericIssues []string `json:"numeric_issues,omitempty"`
+
+	// ReleaseTypeIssues lists a missing or unknown release type, when the
+	// file has a Release Type column
+	ReleaseTypeIssues []string `json:"release_type_issues,omitempty"`
+
+	// ISRCIssues lists problems with the structure of the row's ISRC
+	ISRCIssues []string `json:"isrc_issues,omitempty"`
+
+	// ProfileRules holds the rule outcomes of each further profile the
+	// file was validated against
+	ProfileRules map[string]map[string]bool `json:"profile_rules,omitempty"`
+
+	// Validators holds the outcome of each WebAssembly validator
+	Validators map[string]bool `json:"validators,omitempty"`
+
+	// Checks across rows of the dataset: the Track ID is used by another
+	// row, and the release fields the row's release disagrees on
+	DuplicateTrack   bool     `json:"duplicate_track,omitempty"`
+	ReleaseConflicts []string `json:"release_conflicts,omitempty"`
+
+	// DuplicateISRC marks an ISRC used by another row of the dataset
+	DuplicateISRC bool `json:"duplicate_isrc,omitempty"`
+
+	// Conflicts holds the lines of the other rows sharing the row's key,
+	// by unique check it fails
+	Conflicts map[string][]int `json:"conflicts,omitempty"`
+
+	// Issues describes each failed check: the column and value at fault
+	// and a message
+	Issues []Issue `json:"issues,omitempty"`
+}
+
+// FailedChecks returns the names of the checks the row failed
+func (v RowValidation) FailedChecks() []string {
+	var failed []string
+	if !v.RoyaltiesSum {
+		failed = append(failed, "royalties_sum")
+	}
+	if !v.DateFormat {
+		failed = append(failed, "date_format")
+	}
+	if len(v.DateIssues) > 0 {
+		failed = append(failed, "release_date")
+	}
+	if !v.Territories {
+		failed = append(failed, "territories")
+	}
+	if !v.UPCValid {
+		failed = append(failed, "upc")
+	}
+	if len(v.MissingFields) > 0 {
+		failed = append(failed, "required_fields")
+	}
+	if len(v.PayeeIssues) > 0 {
+		failed = append(failed, "payee_ids")
+	}
+	if len(v.NumericIssues) > 0 {
+		failed = append(failed, "numerics")
+	}
+	if len(v.ReleaseTypeIssues) > 0 {
+		failed = append(failed, "release_type")
+	}
+	if len(v.ISRCIssues) > 0 {
+		failed = append(failed, "isrc")
+	}
+	if len(v.GenreIssues) > 0 {
+		failed = append(failed, "genre")
+	}
+	if len(v.LabelIssues) > 0 {
+		failed = append(failed, "label")
+	}
+	if len(v.RightsHolderIssues) > 0 {
+		failed = append(failed, "rights_holder")
+	}
+	if v.DuplicateTrack {
+		failed = append(failed, "duplicate_track")
+	}
+	if len(v.ReleaseConflicts) > 0 {
+		failed = append(failed, "release_consistency")
+	}
+	if v.DuplicateISRC {
+		failed = append(failed, "duplicate_isrc")
+	}
+	for name, passed := range v.Checks {
+		if !passed {
+			failed = append(failed, name)
+		}
+	}
+	for name, passed := range v.Rules {
+		if !passed {
+			failed = append(failed, name)
+		}
+	}
+	for name, passed := range v.Validators {
+		if !passed {
+			failed = append(failed, validatorCheckPrefix+name)
+		}
+	}
+	for profile, rules := range v.ProfileRules {
+		for name, passed := range rules {
+			if !passed {
+				failed = append(failed, profile+":"+name)
+			}
+		}
+	}
+	return failed
 }
 
 // OutputFormat represents the final output format
 type OutputFormat struct {
 	Validation map[string]RowValidation `json:"validation"`
-	Conversion []map[string]string      `json:"conversion"`
+	Conversion Conversion               `json:"conversion"`
+	PII        PIIReport                `json:"pii,omitempty"`
+	Metadata   JobMetadata              `json:"metadata"`
+	Warnings   []string                 `json:"warnings,omitempty"`
+
+	// Summary totals the validation of the rows
+	Summary *Summary `json:"summary,omitempty"`
+
+	// MalformedRows lists the rows that could not be read and were left
+	// out
+	MalformedRows []MalformedRow `json:"malformed_rows,omitempty"`
+
+	// Cells holds the outcome of the checks on each cell, when asked for
+	// in the response. It is never stored.
+	Cells []Cell `json:"cells,omitempty"`
+
+	// Duplicates lists the rows sharing a Track ID or an ISRC
+	Duplicates *Duplicates `json:"duplicates,omitempty"`
+
+	// Annotations are reviewer notes keyed by row, added when a stored
+	// result is read back
+	Annotations map[string][]Annotation `json:"annotations,omitempty"`
+
+	// Encryption describes the encrypted columns of a stored result.
+	// SensitiveColumns lists them once decrypted, for redaction.
+	Encryption       *Encryption `json:"encryption,omitempty"`
+	SensitiveColumns []string    `json:"-"`
+}
+
+// JobMetadata describes how a job was processed
+type JobMetadata struct {
+	JobID            string `json:"job_id,omitempty"`
+	Workers          int    `json:"workers"`
+	RequestedWorkers int    `json:"requested_workers,omitempty"`
+	Profile          string `json:"profile,omitempty"`
+
+	// Parts is the number of files the dataset was sent in, when parts
+	// were appended to the first
+	Parts int `json:"parts,omitempty"`
+
+	// Delimiter is the field delimiter used, as given or detected
+	Delimiter string `json:"delimiter,omitempty"`
+
+	// SkippedLines is the number of lines above the header row
+	SkippedLines int `json:"skipped_lines,omitempty"`
+
+	// RepairedCells is the number of values mangled by Excel that were
+	// repaired
+	RepairedCells int `json:"repaired_cells,omitempty"`
+
+	// NormalizedCells is the number of values changed by normalization
+	NormalizedCells int `json:"normalized_cells,omitempty"`
+
+	// Normalize, NormalizeRoyalties, RepairNumerics and Dictionary record
+	// how the rows were cleaned before validation, so corrected rows are
+	// cleaned the same way
+	Normalize          *Normalization `json:"normalize,omitempty"`
+	NormalizeRoyalties bool           `json:"normalize_royalties,omitempty"`
+	RepairNumerics     bool           `json:"repair_numerics,omitempty"`
+	Dictionary         bool           `json:"dictionary,omitempty"`
+
+	// Dialect describes how an uploaded delimited file is written
+	Dialect *Dialect `json:"dialect,omitempty"`
+
+	// Header lists the expected columns missing from the header row and
+	// its unexpected and misspelled columns, if it does not match
+	Header *HeaderReport `json:"header,omitempty"`
+
+	// Substitutions are the names replaced by the tenant's dictionary
+	Substitutions []Substitution `json:"substitutions,omitempty"`
+
+	// ReleaseTypes is the number of rows of each release type, when the
+	// file has a Release Type column
+	ReleaseTypes map[string]int `json:"release_types,omitempty"`
+
+	// Profiles are the further profiles the file was validated against
+	Profiles []string `json:"profiles,omitempty"`
+
+	// Checks is the check set sent with the upload, if any
+	Checks []CheckDefinition `json:"checks,omitempty"`
+
+	// Deduplication reports the duplicate rows dropped, when rows were
+	// deduplicated
+	Deduplication *Deduplication `json:"deduplication,omitempty"`
+
+	// Computed are the computed columns added to the rows, if any
+	Computed []ComputedColumn `json:"computed,omitempty"`
+
+	// Rounding describes how sum checks added up values
+	Rounding *Rounding `json:"rounding,omitempty"`
+
+	// Validators are the WebAssembly validators rows were checked with
+	Validators []string `json:"validators,omitempty"`
+
+	// WarningChecks are the checks whose failures are warnings, and
+	// Errors and Warnings the failed checks of each severity over all rows
+	WarningChecks []string `json:"warning_checks,omitempty"`
+	Errors        int      `json:"errors"`
+	Warnings      int      `json:"warnings"`
+
+	// Columns is the column order of the conversion rows
+	Columns []string `json:"columns"`
+}
+
+// RowSource yields rows one at a time and io.EOF after the last one.
+// csv.Reader is one.
+type RowSource interface {
+	Read() ([]string, error)
+}
+
+// linePositioner is a RowSource that knows the line each row starts on,
+// as csv.Reader does. Rows of other sources are numbered from the header,
+// which is line 1.
+type linePositioner interface {
+	FieldPos(field int) (line, column int)
+}
+
+// ProcessOptions holds the per-upload settings for processCSV
+type ProcessOptions struct {
+	Workers int
+	ScanPII bool
+	Profile *Profile
+
+	// Profiles are further profiles whose rules every row is checked
+	// against, each with a verdict of its own
+	Profiles []*Profile
+
+	// Checks replaces the default checks of the royalty sum, the release
+	// date and those of CHECKS_FILE
+	Checks *CheckSet
+
+	// Validators are WebAssembly modules every row is checked with
+	Validators []*Validator
+
+	// JobID names the job in memory statistics
+	JobID string
+
+	// RepairNumerics reverses Excel's damage to UPCs before validation
+	RepairNumerics bool
+
+	// Normalization, if set, tidies values before validation
+	Normalization *Normalization
+
+	// NormalizeRoyalties rewrites royalty shares written as fractions or
+	// with a % sign as plain percentages before validation
+	NormalizeRoyalties bool
+
+	// Dedupe, if set, drops rows duplicating an earlier one
+	Dedupe *Dedupe
+
+	// Computed are the columns computed for every row after validation,
+	// instead of the profile's
+	Computed []compiledColumn
+
+	// Dictionary, if set, canonicalizes artist and label names before
+	// validation
+	Dictionary *Dictionary
+
+	// SingleReleaseType rejects files whose rows are of more than one
+	// release type
+	SingleReleaseType bool
+
+	// StrictHeader rejects files whose header misspells or lacks required
+	// columns
+	StrictHeader bool
+
+	// MaxHeaderSkip is how many leading lines may be skipped to find the
+	// header row
+	MaxHeaderSkip int
+
+	// Delimiter is the field delimiter, or 0 to detect it from the file
+	Delimiter rune
+
+	// Converted marks delimited text converted from another format, whose
+	// dialect is not reported
+	Converted bool
+
+	// Rows, if set, yields the rows of a typed source such as a Parquet
+	// file, header first, and the file is not read as delimited text
+	Rows RowSource
+
+	// Progress, if set, is called about once a second with the number of
+	// rows processed so far
+	Progress func(rows int)
+
+	// Hooks, if set, are called as rows are processed and stages finish
+	Hooks *Hooks
+
+	// Concurrent marks a file processed alongside others, as the files of
+	// a batch are. Its workers are left out of /status, which shows those
+	// of a single job.
+	Concurrent bool
 }
 
 // WorkerStatus represents the current status of a worker goroutine
@@ -79,27 +433,35 @@ func parsePercentage(s string) (float64, error) {
 	return strconv.ParseFloat(s, 64)
 }
 
-// processCSV processes the CSV file and returns the validation results
-func processCSV(file multipart.File, numWorkers int) (*OutputFormat, error) {
-	// Reset worker statuses when starting a new job
-	statusMutex.Lock()
-	workerStatuses = make(map[int]*WorkerStatus)
-	statusMutex.Unlock()
-	
-	// Set active job flag
-	activeJobMutex.Lock()
-	activeJob = true
-	activeJobMutex.Unlock()
+// processCSV processes the CSV file and returns the validation results.
+// Reading stops early if ctx is done.
+func processCSV(ctx context.Context, file io.Reader, opts ProcessOptions) (*OutputFormat, error) {
+	// Reset worker statuses when starting a new job. Workers update the
+	// statuses of their own job, which /status shows unless the job runs
+	// alongside others.
+	statuses := make(map[int]*WorkerStatus)
+	if !opts.Concurrent {
+		statusMutex.Lock()
+		workerStatuses = statuses
+		statusMutex.Unlock()
+		
+		// Set active job flag
+		activeJobMutex.Lock()
+		activeJob = true
+		activeJobMutex.Unlock()
+	}
 	
 	defer func() {
 		// Mark job as inactive when done
-		activeJobMutex.Lock()
-		activeJob = false
-		activeJobMutex.Unlock()
+		if !opts.Concurrent {
+			activeJobMutex.Lock()
+			activeJob = false
+			activeJobMutex.Unlock()
+		}
 		
 		// Explicitly mark all workers as inactive when job completes
 		statusMutex.Lock()
-		for _, worker := range workerStatuses {
+		for _, worker := range statuses {
 			worker.Active = false
 			worker.LastUpdate = time.Now()
 			worker.CurrentRow = ""
@@ -107,35 +469,145 @@ func processCSV(file multipart.File, numWorkers int) (*OutputFormat, error) {
 		statusMutex.Unlock()
 	}()
 
-	reader := csv.NewReader(file)
-	
-	headers, err := reader.Read()
+	started := time.Now()
+	var (
+		rows      = opts.Rows
+		delimiter rune
+		dialect   *dialectScanner
+		headers   []string
+		pending   []sourceRow
+		skipped   int
+		err       error
+	)
+	if rows != nil {
+		// Typed sources name their columns in the first row
+		headers, err = rows.Read()
+	} else {
+		// Detect the delimiter unless one was given
+		buffered := bufio.NewReaderSize(file, 64<<10)
+		delimiter = opts.Delimiter
+		if delimiter == 0 {
+			delimiter = detectDelimiter(buffered)
+		}
+		var text io.Reader = buffered
+		if !opts.Converted {
+			dialect = newDialectScanner(delimiter)
+			text = io.TeeReader(buffered, dialect)
+		}
+		reader := csv.NewReader(text)
+		reader.Comma = delimiter
+
+		// Prefer the profile's schema for recognising the header row
+		known := expectedColumns
+		if opts.Profile != nil && len(opts.Profile.Columns) > 0 {
+			known = opts.Profile.Columns
+		}
+		headers, pending, skipped, err = findHeader(reader, opts.MaxHeaderSkip, known)
+		if dialect != nil && err == nil {
+			dialect.setHeader(skipped+1, len(headers), knownHeader(headers, known))
+		}
+		rows = reader
+	}
+	if err == io.EOF {
+		return nil, fileErrorf(http.StatusUnprocessableEntity, "file is empty")
+	}
+	var parseErr *csv.ParseError
+	if errors.As(err, &parseErr) {
+		return nil, fileErrorf(http.StatusUnprocessableEntity, "failed to read CSV header: %v", err)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CSV header: %w", err)
+	}
+
+	// Compare the header with the profile's schema, or the standard columns
+	expected, exact := expectedColumns, true
+	if opts.Profile != nil && len(opts.Profile.Columns) > 0 {
+		expected, exact = opts.Profile.Columns, false
+	}
+	headerReport := checkHeader(headers, expected, exact)
+	if opts.StrictHeader {
+		if err := headerReport.strictError(); err != nil {
+			return nil, err
+		}
+	}
+
+	// Map the input headers onto the profile's canonical columns and resolve
+	// its cross-field rules against them
+	columns, columnNames, canonical := headers, headers, []string(nil)
+	var rules []*Rule
+	var warnings []string
+	if skipped > 0 {
+		warnings = append(warnings, fmt.Sprintf("Skipped %d lines above the header row", skipped))
+	}
+	if headerReport != nil {
+		warnings = append(warnings, headerReport.warnings()...)
+	}
+	if opts.Profile != nil {
+		plan, err := opts.Profile.plan(headers)
+		if err != nil {
+			return nil, fmt.Errorf("failed to compile profile rules: %v", err)
+		}
+		columns, columnNames, canonical, rules = plan.columns, plan.names, opts.Profile.Columns, plan.rules
+		if len(plan.dropped) > 0 {
+			warnings = append(warnings, fmt.Sprintf("Columns not in the canonical schema were dropped: %s", strings.Join(plan.dropped, ", ")))
+		}
+		warnings = append(warnings, plan.warnings...)
+	}
+	profileRules, profileWarnings, err := compileProfileRules(opts.Profiles, columns)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read CSV header: %v", err)
+		return nil, fmt.Errorf("failed to compile profile rules: %v", err)
+	}
+	warnings = append(warnings, profileWarnings...)
+	var dedupeKey []string
+	if opts.Dedupe != nil {
+		if dedupeKey, err = opts.Dedupe.columns(columns); err != nil {
+			return nil, err
+		}
 	}
+	opts.Hooks.stageComplete(StageHeader, 0, started)
+	started = time.Now()
 
 	type result struct {
-		Data       map[string]string
-		Validation RowValidation
+		Worker      int
+		Data        map[string]string
+		Validation  RowValidation
+		PII         []piiFinding
+		Repaired    int
+		Normalized  int
+		Substituted []Substitution
+		Size        int64
 	}
 
 	batchSize := 1000
-	rowsChan := make(chan []string, batchSize)
+	rowsChan := make(chan sourceRow, batchSize)
 	resultsChan := make(chan result, batchSize)
-	
-	var wg sync.WaitGroup
-	
-	// Date format regex (YYYY-MM-DD)
-	dateRegex := regexp.MustCompile(`^\d{4}-\d{2}-\d{2}$`)
+
+	// The reader, the workers and the collector run as one group: the
+	// first of them to fail, or panic, cancels the others and its error
+	// fails the job
+	g, gctx := newGroup(ctx)
+	stopped := func() error {
+		return fmt.Errorf("processing stopped: %w", gctx.Err())
+	}
+	var workers sync.WaitGroup
+	memory := memoryMeter.Track(opts.JobID)
+	defer memory.Done()
+	names := opts.Dictionary.canonicalizer()
+	checks := opts.Checks
+	if checks == nil {
+		checks = opts.Profile.checkSet()
+	}
+	warningNames := warningChecks(checks, opts.Profile, opts.Profiles)
+	severities := warningSet(warningNames)
 	
 	// Start worker goroutines
-	for i := 0; i < numWorkers; i++ {
-		wg.Add(1)
+	for i := 0; i < opts.Workers; i++ {
+		workers.Add(1)
 		
 		// Initialize worker status
 		workerID := i
 		statusMutex.Lock()
-		workerStatuses[workerID] = &WorkerStatus{
+		statuses[workerID] = &WorkerStatus{
 			ID:        workerID,
 			Active:    true,
 			StartTime: time.Now(),
@@ -143,23 +615,24 @@ func processCSV(file multipart.File, numWorkers int) (*OutputFormat, error) {
 		}
 		statusMutex.Unlock()
 		
-		go func() {
-			defer wg.Done()
+		g.Go(fmt.Sprintf("worker %d", workerID), func() error {
+			defer workers.Done()
 			
 			// Cleanup worker status when done
 			defer func() {
 				statusMutex.Lock()
-				if ws, exists := workerStatuses[workerID]; exists {
+				if ws, exists := statuses[workerID]; exists {
 					ws.Active = false
 					ws.LastUpdate = time.Now()
 				}
 				statusMutex.Unlock()
 			}()
 			
-			for row := range rowsChan {
+			for source := range rowsChan {
+				row := source.fields
 				// Update worker status
 				statusMutex.Lock()
-				if ws, exists := workerStatuses[workerID]; exists {
+				if ws, exists := statuses[workerID]; exists {
 					ws.ProcessedRows++
 					if len(row) > 0 {
 						ws.CurrentRow = row[0] // First column (Release ID)
@@ -168,104 +641,324 @@ func processCSV(file multipart.File, numWorkers int) (*OutputFormat, error) {
 				}
 				statusMutex.Unlock()
 				
-				// Create a map for the row data
-				recordMap := make(map[string]string)
-				for i, value := range row {
-					if i < len(headers) {
-						recordMap[headers[i]] = value
-					}
-				}
-
-				// Initialize validation for this row
-				validation := RowValidation{
-					ReleaseID:    recordMap["Release ID"],
-					TrackID:      recordMap["Track ID"],
-					RoyaltiesSum: true,
-					DateFormat:   true,
-				}
-
-				// Validate royalty percentages
-				artistPct, labelPct, distPct, pubPct := 0.0, 0.0, 0.0, 0.0
-				
-				if pct, err := parsePercentage(recordMap["Royalty Artist %"]); err == nil {
-					artistPct = pct
-				}
-				
-				if pct, err := parsePercentage(recordMap["Royalty Label %"]); err == nil {
-					labelPct = pct
-				}
-				
-				if pct, err := parsePercentage(recordMap["Royalty Distributor %"]); err == nil {
-					distPct = pct
+				recordMap := buildRecord(row, columnNames, canonical)
+				normalized := opts.Normalization.apply(recordMap)
+				var royaltyFormat string
+				if opts.NormalizeRoyalties {
+					royaltyFormat = normalizeShares(recordMap)
 				}
-				
-				if pct, err := parsePercentage(recordMap["Royalty Publisher %"]); err == nil {
-					pubPct = pct
+				var repaired int
+				var numericIssues []string
+				if opts.RepairNumerics {
+					repaired, numericIssues = repairNumerics(recordMap)
 				}
-				
-				sum := artistPct + labelPct + distPct + pubPct
-				if sum != 100.0 && (sum < 99.9 || sum > 100.1) {
-					validation.RoyaltiesSum = false
+				var substituted []Substitution
+				if names != nil {
+					substituted = names.apply(recordMap)
 				}
+				validation := validateRow(recordMap, checks, rules)
+				validation.NumericIssues = numericIssues
+				validation.RoyaltyFormat = royaltyFormat
+				validation.ProfileRules = checkProfileRules(recordMap, profileRules)
+				validation.Line = source.line
+				validation.describe(recordMap, rules, profileRules)
+				var validatorIssues []Issue
+				validation.Validators, validatorIssues = checkValidators(recordMap, opts.Validators)
+				validation.Issues = append(validation.Issues, validatorIssues...)
+				validation.classify(severities)
 				
-				// Validate date format
-				releaseDate := recordMap["Release Date"]
-				if !dateRegex.MatchString(releaseDate) {
-					validation.DateFormat = false
+				// Look for personal data in unexpected columns
+				var pii []piiFinding
+				if opts.ScanPII {
+					pii = scanPII(recordMap)
 				}
 				
-				resultsChan <- result{
-					Data:       recordMap,
-					Validation: validation,
+				select {
+				case resultsChan <- result{
+					Worker:      workerID,
+					Data:        recordMap,
+					Validation:  validation,
+					PII:         pii,
+					Repaired:    repaired,
+					Normalized:  normalized,
+					Substituted: substituted,
+					Size:        rowSize(row, columnNames),
+				}:
+				case <-gctx.Done():
+					return stopped()
 				}
 			}
-		}()
+			return nil
+		})
 	}
 	
-	// Start a goroutine to close resultsChan when all workers are done
+	// Close resultsChan when all workers are done
 	go func() {
-		wg.Wait()
+		workers.Wait()
 		close(resultsChan)
 	}()
 	
-	// Read and process rows in batches
+	// Read and process rows in batches. Under memory pressure the reader
+	// waits for queued rows to be collected before queueing more.
 	var count int
-	go func() {
+	var malformed malformedRows
+	g.Go("reader", func() error {
+		defer close(rowsChan)
+		send := func(row sourceRow) error {
+			if err := memory.Queue(gctx, rowSize(row.fields, columnNames)); err != nil {
+				if gctx.Err() != nil {
+					return stopped()
+				}
+				return err
+			}
+			select {
+			case rowsChan <- row:
+				count++
+				return nil
+			case <-gctx.Done():
+				return stopped()
+			}
+		}
+		for _, row := range pending {
+			if row.err != nil {
+				malformed.add(newMalformedRow(row.fields, len(headers), row.err))
+				continue
+			}
+			if err := send(row); err != nil {
+				return err
+			}
+		}
+		positioner, _ := rows.(linePositioner)
+		line := 1
 		for {
-			row, err := reader.Read()
+			if gctx.Err() != nil {
+				return stopped()
+			}
+			row, err := rows.Read()
 			if err == io.EOF {
-				break
+				return nil
+			}
+			line++
+			// Malformed rows are reported and skipped, but a failing
+			// stream cannot be read any further
+			var rowErr *csv.ParseError
+			if err != nil && !errors.As(err, &rowErr) {
+				return fmt.Errorf("failed to read file: %w", err)
 			}
 			if err != nil {
-				log.Printf("Error reading row: %s", err)
+				malformed.add(newMalformedRow(row, len(headers), rowErr))
 				continue
 			}
+			if positioner != nil {
+				line, _ = positioner.FieldPos(0)
+			}
 			
-			rowsChan <- row
-			count++
+			if err := send(sourceRow{line: line, fields: row}); err != nil {
+				return err
+			}
 		}
-		close(rowsChan)
-	}()
+	})
 	
 	// Collect all results
 	var records []map[string]string
 	validations := make(map[string]RowValidation)
+	var piiReport PIIReport
+	var repaired, normalized int
+	substitutions := make(substitutionCounts)
+	releaseTypes := make(releaseTypeCounts)
+	// Deduplication needs the outcome of every row, not only the last of
+	// each Track ID
+	var rowValidations []RowValidation
+	if opts.ScanPII {
+		piiReport = make(PIIReport)
+	}
 	
-	for result := range resultsChan {
-		records = append(records, result.Data)
-		// Use TrackID as the key for validations
-		validations[result.Validation.TrackID] = result.Validation
+	g.Go("collector", func() error {
+		lastProgress := time.Now()
+		for {
+			var result result
+			var ok bool
+			select {
+			case result, ok = <-resultsChan:
+			case <-gctx.Done():
+				return stopped()
+			}
+			if !ok {
+				return nil
+			}
+			records = append(records, result.Data)
+			if opts.Dedupe != nil {
+				rowValidations = append(rowValidations, result.Validation)
+			}
+			memory.Collect(result.Size, recordSize(result.Data, result.Validation))
+			if opts.Progress != nil && time.Since(lastProgress) >= time.Second {
+				opts.Progress(len(records))
+				lastProgress = time.Now()
+			}
+			// Use TrackID as the key for validations, keeping the last
+			// row of a Track ID used by several
+			if kept, ok := validations[result.Validation.TrackID]; !ok || kept.Line < result.Validation.Line {
+				validations[result.Validation.TrackID] = result.Validation
+			}
+			for _, finding := range result.PII {
+				piiReport.add(finding)
+			}
+			repaired += result.Repaired
+			normalized += result.Normalized
+			substitutions.add(result.Substituted)
+			releaseTypes.add(result.Data)
+			opts.Hooks.rowProcessed(result.Worker, len(records), result.Data, result.Validation)
+		}
+	})
+
+	if err := g.Wait(); err != nil {
+		return nil, err
+	}
+	if len(records) == 0 && malformed.count > 0 {
+		first := malformed.rows[0]
+		return nil, fileErrorf(http.StatusUnprocessableEntity, "file contains a header but no well-formed data rows (%d malformed, the first on line %d: %s)",
+			malformed.count, first.Line, first.Message)
 	}
+	if len(records) == 0 {
+		return nil, fileErrorf(http.StatusUnprocessableEntity, "file contains a header but no data rows")
+	}
+	var deduplication *Deduplication
+	if opts.Dedupe != nil {
+		records, validations, deduplication = opts.Dedupe.remove(records, rowValidations, dedupeKey, columns)
+		releaseTypes = make(releaseTypeCounts)
+		for _, record := range records {
+			releaseTypes.add(record)
+		}
+	}
+	if opts.SingleReleaseType {
+		if err := checkSingleReleaseType(releaseTypes); err != nil {
+			return nil, err
+		}
+	}
+	opts.Hooks.stageComplete(StageValidate, len(records), started)
 	
 	// Create final output structure
 	outputData := &OutputFormat{
 		Validation: validations,
-		Conversion: records,
+		Conversion: Conversion{Columns: columns, Rows: records},
+		PII:        piiReport,
+		Metadata: JobMetadata{
+			Workers:       opts.Workers,
+			SkippedLines:  skipped,
+			RepairedCells:   repaired,
+			NormalizedCells: normalized,
+			Normalize:          opts.Normalization,
+			NormalizeRoyalties: opts.NormalizeRoyalties,
+			RepairNumerics:     opts.RepairNumerics,
+			Dictionary:         names != nil,
+			Header:        headerReport,
+			Substitutions: substitutions.report(),
+			ReleaseTypes:  releaseTypes.report(),
+			Columns:       columns,
+			WarningChecks: warningNames,
+			Rounding:      sumRounding(checks),
+			Deduplication: deduplication,
+		},
+		Warnings:      warnings,
+		MalformedRows: malformed.rows,
+	}
+	if warning := malformed.warning(); warning != "" {
+		outputData.Warnings = append(outputData.Warnings, warning)
+	}
+	if delimiter != 0 {
+		outputData.Metadata.Delimiter = delimiterName(delimiter)
+	}
+	if dialect != nil {
+		outputData.Metadata.Dialect = dialect.report(delimiterName(delimiter))
+	}
+	if opts.Profile != nil {
+		outputData.Metadata.Profile = opts.Profile.Name
+	}
+	if len(opts.Profiles) > 0 {
+		outputData.Metadata.Profiles = profileNames(opts.Profiles)
+	}
+	if opts.Checks != nil {
+		outputData.Metadata.Checks = opts.Checks.Checks
+	}
+	if len(opts.Validators) > 0 {
+		outputData.Metadata.Validators = validatorNames(opts.Validators)
 	}
 	
 	return outputData, nil
 }
 
+// dateRegex matches release dates in YYYY-MM-DD format
+var dateRegex = regexp.MustCompile(`^\d{4}-\d{2}-\d{2}$`)
+
+// buildRecord maps a CSV row onto the output columns. names holds the output
+// name of each input column, as returned by outputColumns.
+func buildRecord(row, names, canonical []string) map[string]string {
+	record := make(map[string]string, max(len(canonical), len(row)))
+	for _, column := range canonical {
+		record[column] = ""
+	}
+	for i, value := range row {
+		if i < len(names) && names[i] != "" {
+			record[names[i]] = value
+		}
+	}
+	return record
+}
+
+// validateRow runs every check against a record. The territory list is
+// normalized in place, before the checks and rules see it.
+func validateRow(record map[string]string, checks *CheckSet, rules []*Rule) RowValidation {
+	validation := RowValidation{
+		ReleaseID:   record["Release ID"],
+		TrackID:     record["Track ID"],
+		Territories: true,
+		UPCValid:    validUPC(record["UPC"]),
+	}
+
+	// Find required columns left empty
+	validation.MissingFields = missingFields(record)
+
+	// Rewrite the territory list as sorted ISO codes
+	if territories, ok := record["Territories"]; ok {
+		record["Territories"], validation.TerritoryIssues, validation.Territories = normalizeTerritories(territories)
+	}
+
+	// Run the check set, by default the royalty sum and the date format
+	applyChecks(&validation, checks, record)
+
+	// Convert release dates of other formats, which date_format has
+	// flagged, to YYYY-MM-DD
+	validation.OriginalReleaseDate = convertReleaseDate(record)
+
+	// Check the release date is plausible
+	validation.DateIssues = checkReleaseDate(record, time.Now())
+
+	// Validate payee identifiers
+	validation.PayeeIssues = checkPayees(record)
+
+	// Validate the release type
+	validation.ReleaseTypeIssues = checkReleaseType(record)
+
+	// Validate the ISRC
+	validation.ISRCIssues = checkISRC(record)
+
+	// Check the genre against the vocabulary
+	validation.GenreIssues, validation.GenreSuggestions = checkGenre(record)
+
+	// Check the label and rights holder against the reference lists
+	validation.LabelIssues, validation.LabelSuggestions = labels.check(record)
+	validation.RightsHolderIssues, validation.RightsHolderSuggestions = rightsHolders.check(record)
+
+	// Evaluate cross-field rules
+	if len(rules) > 0 {
+		validation.Rules = make(map[string]bool, len(rules))
+		for _, rule := range rules {
+			validation.Rules[rule.Name] = rule.Check(record)
+		}
+	}
+	return validation
+}
+
 // uploadHandler handles the CSV file upload
 func uploadHandler(w http.ResponseWriter, r *http.Request) {
 	// Only allow POST method
@@ -279,52 +972,522 @@ func uploadHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Access-Control-Allow-Methods", "POST")
 	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
 
-	// Parse multipart form with 32MB max memory
+	// Limit the request body to the configured maximum upload size
+	r.Body = http.MaxBytesReader(w, r.Body, cfg.MaxUploadSize)
+
+	// Parse multipart form with 32MB max memory. A Google Sheets link may
+	// also be posted as a plain form.
 	err := r.ParseMultipartForm(32 << 20)
+	if errors.Is(err, http.ErrNotMultipart) && r.FormValue("sheet_url") != "" {
+		err = nil
+	}
 	if err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			writeError(w, "Failed to parse form: ", err)
+			return
+		}
 		http.Error(w, "Failed to parse form: "+err.Error(), http.StatusBadRequest)
 		return
 	}
+	if !applyTenantSettings(w, r) {
+		return
+	}
 
-	// Get the uploaded file
-	file, header, err := r.FormFile("csvFile")
-	if err != nil {
-		http.Error(w, "Failed to get file: "+err.Error(), http.StatusBadRequest)
+	// Get the uploaded file, or fetch the Google Sheet linked instead
+	var file multipart.File
+	var header *multipart.FileHeader
+	if sheetURL := r.FormValue("sheet_url"); sheetURL != "" {
+		sheet, err := fetchSheet(r.Context(), sheetURL, r.FormValue("sheet_token"))
+		if err != nil {
+			writeError(w, "Failed to fetch sheet: ", err)
+			return
+		}
+		file, header = sheet, &multipart.FileHeader{Filename: sheet.name, Size: sheet.size}
+	} else if uploads := r.MultipartForm.File["csvFile"]; len(uploads) > 1 {
+		// Several files are processed as a batch, each as a job of its own
+		processUploadBatch(w, r, uploads)
 		return
+	} else {
+		file, header, err = r.FormFile("csvFile")
+		if err != nil {
+			http.Error(w, "Failed to get file: "+err.Error(), http.StatusBadRequest)
+			return
+		}
 	}
 	defer file.Close()
 
-	// Check if the file is a CSV
-	if !strings.HasSuffix(strings.ToLower(header.Filename), ".csv") {
-		http.Error(w, "Only CSV files are allowed", http.StatusBadRequest)
+	// Compressed feeds are recognised by a .gz suffix or the gzip magic bytes
+	name := strings.ToLower(header.Filename)
+	isGzipped, err := isGzip(file)
+	if err != nil {
+		writeError(w, "Invalid file: ", err)
+		return
+	}
+	if strings.HasSuffix(name, ".gz") {
+		isGzipped = true
+		name = strings.TrimSuffix(name, ".gz")
+	}
+
+	// Check if the file is delimited text, JSON Lines, an XLSX or XLS
+	// workbook, a Parquet or Avro file or a zip archive of delimited text
+	// files. format=ndjson reads .json and .txt files as JSON Lines, and a
+	// fixed_width column spec reads .txt, .dat and .fwf files as fixed-width
+	// records.
+	extension := filepath.Ext(name)
+	isXLSX := extension == ".xlsx"
+	isXLS := extension == ".xls"
+	isParquet := extension == ".parquet"
+	isAvro := extension == ".avro"
+	isZip := extension == ".zip"
+	isNDJSON := isNDJSONExtension(extension) ||
+		(r.FormValue("format") == "ndjson" && (extension == ".json" || extension == ".txt"))
+	var fixedWidth []FixedWidthColumn
+	if spec := r.FormValue("fixed_width"); spec != "" {
+		if isNDJSON || !isFixedWidthExtension(extension) {
+			http.Error(w, "Fixed-width files must be .txt, .dat or .fwf files, optionally gzip-compressed", http.StatusUnsupportedMediaType)
+			return
+		}
+		if fixedWidth, err = parseFixedWidthSpec(spec); err != nil {
+			http.Error(w, "Invalid fixed_width: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if fixedWidth == nil && !isXLSX && !isXLS && !isParquet && !isAvro && !isZip && !isNDJSON && extension != ".csv" && extension != ".tsv" && extension != ".txt" {
+		http.Error(w, "Only CSV, TSV, JSON Lines, XLSX, XLS, Parquet, Avro, fixed-width and ZIP files are allowed, optionally gzip-compressed", http.StatusUnsupportedMediaType)
+		return
+	}
+	if (isXLSX || isParquet || isAvro || isZip) && isGzipped {
+		http.Error(w, "XLSX workbooks, Parquet and Avro files and ZIP archives are already compressed and cannot be gzipped", http.StatusUnsupportedMediaType)
+		return
+	}
+	if isXLS && isGzipped {
+		http.Error(w, "XLS workbooks cannot be gzipped", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	// Check the content itself, since the extension is trivially faked
+	checkContent := checkTextContent
+	switch {
+	case isXLSX:
+		checkContent = checkXLSXContent
+	case isXLS:
+		checkContent = checkXLSContent
+	case isParquet:
+		checkContent = checkParquetContent
+	case isAvro:
+		checkContent = checkAvroContent
+	case isZip:
+		checkContent = checkZipContent
+	case isGzipped:
+		checkContent = checkGzipContent
+	}
+	if err := checkContent(file); err != nil {
+		writeError(w, "Invalid file: ", err)
+		return
+	}
+
+	// Reject infected files before any parsing
+	if err := scanUpload(file, header.Filename); err != nil {
+		writeError(w, "Upload rejected: ", err)
 		return
 	}
+	upload := keepUpload(file)
+
+	// Workbooks are streamed through the CSV pipeline one sheet at a time,
+	// Parquet files are read one row group at a time, Avro files one block
+	// at a time, fixed-width files one line at a time, compressed files are
+	// decompressed as they are read and the files of an archive are
+	// processed one after the other later on
+	var input io.Reader = file
+	var members []*zip.File
+	var rows RowSource
+	if isParquet {
+		if rows, err = openParquet(file, header.Size); err != nil {
+			writeError(w, "Invalid file: ", err)
+			return
+		}
+	}
+	if isAvro {
+		if rows, err = openAvro(file, expectedColumns); err != nil {
+			writeError(w, "Invalid file: ", err)
+			return
+		}
+	}
+	if isZip {
+		if members, err = openArchive(file, header.Size); err != nil {
+			writeError(w, "Invalid file: ", err)
+			return
+		}
+	}
+	if isGzipped {
+		zr, err := newGzipReader(file)
+		if err != nil {
+			writeError(w, "Invalid file: ", err)
+			return
+		}
+		defer zr.Close()
+		input = zr
+	}
+	if isXLSX {
+		workbook, err := openXLSX(file, header.Size)
+		if err != nil {
+			writeError(w, "Invalid file: ", err)
+			return
+		}
+		sheet, err := workbook.sheet(r.FormValue("sheet"))
+		if err != nil {
+			writeError(w, "Invalid file: ", err)
+			return
+		}
+		rows, err := workbook.streamCSV(sheet)
+		if err != nil {
+			writeError(w, "Invalid file: ", err)
+			return
+		}
+		defer rows.Close()
+		input = rows
+	}
+	if isXLS {
+		workbook, err := openXLS(file, header.Size)
+		if err != nil {
+			writeError(w, "Invalid file: ", err)
+			return
+		}
+		sheet, err := workbook.sheet(r.FormValue("sheet"))
+		if err != nil {
+			writeError(w, "Invalid file: ", err)
+			return
+		}
+		rows := workbook.streamCSV(sheet)
+		defer rows.Close()
+		input = rows
+	}
+	if isNDJSON {
+		rows := streamNDJSON(input)
+		defer rows.Close()
+		input = rows
+	}
+	if fixedWidth != nil {
+		rows = newFixedWidthReader(input, fixedWidth)
+	}
 
 	// Get the number of workers
-	numWorkersStr := r.FormValue("workers")
-	numWorkers := runtime.NumCPU() // Default to number of CPU cores
-	if numWorkersStr != "" {
-		parsedWorkers, err := strconv.Atoi(numWorkersStr)
-		if err == nil && parsedWorkers > 0 {
-			numWorkers = parsedWorkers
+	numWorkers, requestedWorkers, workersWarning, err := parseWorkers(r.FormValue("workers"))
+	if err != nil {
+		http.Error(w, "Invalid workers value: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Tab-separated files need no detection; workbooks and JSON Lines are
+	// converted to CSV
+	delimiter, err := parseDelimiter(r.FormValue("delimiter"))
+	if err != nil {
+		http.Error(w, "Invalid delimiter: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	switch {
+	case isXLSX || isXLS || isNDJSON:
+		delimiter = ','
+	case delimiter == 0 && extension == ".tsv":
+		delimiter = '\t'
+	}
+	shape, err := parseShape(r)
+	if err != nil {
+		writeError(w, "Invalid shape: ", err)
+		return
+	}
+	profiles, err := parseProfiles(r.FormValue("profiles"))
+	if err != nil {
+		writeError(w, "Invalid profiles: ", err)
+		return
+	}
+	checks, err := uploadChecks(r)
+	if err != nil {
+		writeError(w, "Invalid checks: ", err)
+		return
+	}
+	validators, err := parseValidators(r.FormValue("validators"))
+	if err != nil {
+		writeError(w, "Invalid validators: ", err)
+		return
+	}
+	normalization, err := parseNormalization(r)
+	if err != nil {
+		writeError(w, "Invalid normalize: ", err)
+		return
+	}
+	computed, err := uploadComputed(r)
+	if err != nil {
+		writeError(w, "Invalid computed: ", err)
+		return
+	}
+	dedupe, err := parseDedupe(r)
+	if err != nil {
+		writeError(w, "Invalid dedupe: ", err)
+		return
+	}
+
+	// A file already processed with the same options is answered with the
+	// earlier job's result, when the job store outlives restarts
+	contentHash := upload
+	if contentHash == "" {
+		contentHash = hashUpload(file)
+	}
+	var key string
+	if persistentJobStore() && contentHash != "" && members == nil && !acceptsNDJSON(r) {
+		key = reuseKey(r, contentHash)
+		if tenant, ok := tenantFromRequest(r); ok && !formBool(r, "reprocess") {
+			if prior, result, ok := priorResult(tenant, key); ok {
+				reuseResult(w, shape, prior, result)
+				return
+			}
+		}
+	}
+
+	job, profile, release, ok := startUploadJob(w, r, header.Filename, numWorkers)
+	if !ok {
+		return
+	}
+	defer release()
+	referenceUpload(job, upload)
+	job.ContentHash, job.ReuseKey = contentHash, key
+
+	opts := ProcessOptions{
+		Workers:            numWorkers,
+		ScanPII:            formBool(r, "scan_pii"),
+		RepairNumerics:     formBool(r, "repair_numerics"),
+		Normalization:      normalization,
+		NormalizeRoyalties: formBool(r, "normalize_royalties"),
+		Profile:            profile,
+		Profiles:           profiles,
+		Checks:             checks,
+		Validators:         validators,
+		Computed:           computed,
+		Dedupe:             dedupe,
+		MaxHeaderSkip:      cfg.MaxHeaderSkip,
+		Delimiter:          delimiter,
+		Converted:          isXLSX || isXLS || isNDJSON,
+		SingleReleaseType:  formBool(r, "single_release_type"),
+		StrictHeader:       formBool(r, "strict_header"),
+		Rows:               rows,
+		Progress: func(rows int) {
+			job.ProcessedRows = rows
+			saveJob(job)
+		},
+	}
+
+	// Each file of an archive is a job of its own
+	if members != nil {
+		processArchive(r.Context(), w, job, members, opts, requestedWorkers, workersWarning)
+		return
+	}
+
+	// Clients asking for JSON Lines receive each row as it is validated,
+	// or once duplicates are removed if the file is deduplicated
+	var stream *rowStream
+	if acceptsNDJSON(r) {
+		computed := opts.Computed
+		if computed == nil {
+			computed = opts.Profile.computedColumns()
 		}
+		stream = newRowStream(w, opts.Dedupe != nil, computed)
+		opts.Hooks = stream.hooks()
 	}
 
 	// Process the CSV file
-	result, err := processCSV(file, numWorkers)
+	result, err := runJob(r.Context(), job, input, opts, requestedWorkers, workersWarning)
 	if err != nil {
-		http.Error(w, "Failed to process CSV: "+err.Error(), http.StatusInternalServerError)
+		finishJob(job, err)
+		if stream != nil && stream.started {
+			stream.fail(err)
+			return
+		}
+		writeError(w, "Failed to process CSV: ", err)
 		return
 	}
-
-	// Return the results as JSON
-	w.Header().Set("Content-Type", "application/json")
-	encoder := json.NewEncoder(w)
-	encoder.SetIndent("", "  ")
-	if err := encoder.Encode(result); err != nil {
-		http.Error(w, "Failed to encode results: "+err.Error(), http.StatusInternalServerError)
+	finishJob(job, nil)
+	if stream != nil {
+		stream.summary(job, result)
 		return
 	}
+
+	// Return the results as JSON, sent as they are encoded
+	if err := streamResult(w, shape, result); err != nil {
+		log.Printf("Failed to send result of job %s: %v", job.ID, err)
+	}
+}
+
+// startUploadJob records the job of an upload with the tenant, external ID
+// and profile of the request, and waits for a free job slot. If the job
+// cannot start, the error is written and ok is false; otherwise the caller
+// calls release once the job is done.
+func startUploadJob(w http.ResponseWriter, r *http.Request, filename string, workers int) (job *Job, profile *Profile, release func(), ok bool) {
+	tenant, ok := tenantFromRequest(r)
+	if !ok {
+		http.Error(w, "Invalid tenant: "+tenant, http.StatusBadRequest)
+		return nil, nil, nil, false
+	}
+
+	// Clients may tag the job with their own ID to look it up by later
+	externalID := strings.TrimSpace(r.Header.Get("X-External-ID"))
+	if externalID == "" {
+		externalID = strings.TrimSpace(r.FormValue("external_id"))
+	}
+	if externalID != "" && !externalIDRegex.MatchString(externalID) {
+		http.Error(w, "Invalid external_id: must be 1 to 128 printable characters without spaces", http.StatusBadRequest)
+		return nil, nil, nil, false
+	}
+
+	// Load the validation profile, if one was selected
+	if name := r.FormValue("profile"); name != "" {
+		var err error
+		profile, err = loadProfile(name)
+		if errors.Is(err, ErrProfileNotFound) {
+			http.Error(w, "Unknown profile: "+name, http.StatusBadRequest)
+			return nil, nil, nil, false
+		}
+		if err != nil {
+			http.Error(w, "Failed to load profile: "+err.Error(), http.StatusInternalServerError)
+			return nil, nil, nil, false
+		}
+	}
+
+	// Record the job so any replica can report on it
+	job = &Job{
+		ID:         newJobID(),
+		Tenant:     tenant,
+		ExternalID: externalID,
+		Filename:   filename,
+		Status:     JobQueued,
+		Workers:    workers,
+		Instance:   instanceName,
+		CreatedAt:  time.Now(),
+	}
+	if externalID != "" {
+		owner, err := jobStore.ClaimExternalID(tenant, externalID, job.ID)
+		if err != nil {
+			http.Error(w, "Failed to record external_id: "+err.Error(), http.StatusInternalServerError)
+			return nil, nil, nil, false
+		}
+		if owner != job.ID {
+			w.Header().Set("Location", "/jobs/"+owner)
+			http.Error(w, fmt.Sprintf("external_id %s is already used by job %s", externalID, owner), http.StatusConflict)
+			return nil, nil, nil, false
+		}
+	}
+	saveJob(job)
+	w.Header().Set("X-Job-ID", job.ID)
+
+	// Wait for a free job slot
+	release, err := jobQueue.Acquire(r.Context())
+	if err != nil {
+		finishJob(job, err)
+		http.Error(w, "Upload cancelled while waiting for a job slot", http.StatusServiceUnavailable)
+		return nil, nil, nil, false
+	}
+
+	startedAt := time.Now()
+	job.Status = JobRunning
+	job.StartedAt = &startedAt
+	saveJob(job)
+	return job, profile, release, true
+}
+
+// runJob processes the input of a job, lets the transformation service
+// rewrite the validated rows and stores the result. The caller records the
+// outcome with finishJob.
+func runJob(ctx context.Context, job *Job, input io.Reader, opts ProcessOptions, requestedWorkers int, workersWarning string) (*OutputFormat, error) {
+	processingStarted := time.Now()
+	opts.JobID = job.ID
+	dictionary, err := tenantDictionary(job.Tenant)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get dictionary: %v", err)
+	}
+	opts.Dictionary = dictionary
+	result, err := processCSV(ctx, input, opts)
+	if err != nil {
+		return nil, err
+	}
+	result.Metadata.JobID = job.ID
+	result.Metadata.RequestedWorkers = requestedWorkers
+	if workersWarning != "" {
+		result.Warnings = append(result.Warnings, workersWarning)
+	}
+
+	// Let the transformation service rewrite the validated rows
+	started := time.Now()
+	if err := runCallout(ctx, result, job.Tenant); err != nil {
+		return nil, err
+	}
+	opts.Hooks.stageComplete(StageTransform, len(result.Conversion.Rows), started)
+	computed := opts.Computed
+	if computed == nil {
+		computed = opts.Profile.computedColumns()
+	}
+	result.Warnings = append(result.Warnings, computeColumns(result, computed)...)
+	checks := opts.Checks
+	if checks == nil {
+		checks = opts.Profile.checkSet()
+	}
+	checkCrossRow(result, checks)
+	countSeverities(result)
+	result.Summary = summarize(result, time.Since(processingStarted))
+
+	// Store the result before marking the job complete so it is never
+	// reported as completed without one
+	started = time.Now()
+	if err := jobStore.SaveResult(job.ID, result); err != nil {
+		log.Printf("Failed to save result of job %s: %v", job.ID, err)
+	}
+	materializeViews(job.ID, result)
+	opts.Hooks.stageComplete(StageStore, len(result.Conversion.Rows), started)
+	job.ProcessedRows = len(result.Conversion.Rows)
+	job.countFailures(result.Validation)
+	return result, nil
+}
+
+// finishJob records the outcome of a job in the job store
+func finishJob(job *Job, err error) {
+	finishedAt := time.Now()
+	job.FinishedAt = &finishedAt
+	job.Status = JobCompleted
+	if err != nil {
+		job.Status = JobFailed
+		job.Error = err.Error()
+	}
+	saveJob(job)
+	notifyJob(job)
+}
+
+// parseWorkers parses the workers form value, defaulting to the number of CPU
+// cores. Values above the configured maximum are clamped with a warning.
+// The requested count is returned as 0 when the default was used.
+func parseWorkers(value string) (workers, requested int, warning string, err error) {
+	workers = min(runtime.NumCPU(), cfg.MaxWorkers)
+	if value == "" {
+		return workers, 0, "", nil
+	}
+	requested, err = strconv.Atoi(strings.TrimSpace(value))
+	if err != nil || requested < 1 {
+		return 0, 0, "", fmt.Errorf("workers must be a whole number between 1 and %d, got %q", cfg.MaxWorkers, value)
+	}
+	if requested > cfg.MaxWorkers {
+		warning = fmt.Sprintf("Requested %d workers, clamped to the server maximum of %d", requested, cfg.MaxWorkers)
+		return cfg.MaxWorkers, requested, warning, nil
+	}
+	return requested, requested, "", nil
+}
+
+// formBool reports whether a form field is set to a true value such as
+// "true", "1" or a checkbox's "on"
+func formBool(r *http.Request, name string) bool {
+	value := strings.ToLower(strings.TrimSpace(r.FormValue(name)))
+	if value == "on" {
+		return true
+	}
+	b, _ := strconv.ParseBool(value)
+	return b
 }
 
 // statusHandler returns the current status of worker goroutines
@@ -343,25 +1506,40 @@ func statusHandler(w http.ResponseWriter, r *http.Request) {
 		statuses = append(statuses, &statusCopy)
 	}
 	statusMutex.RUnlock()
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].ID < statuses[j].ID
+	})
+	
+	// Collect active jobs from the shared store, which includes jobs
+	// running on other replicas
+	activeJobs := []*Job{}
+	jobs, err := jobStore.ListJobs(100)
+	if err != nil {
+		log.Printf("Failed to list jobs: %v", err)
+	}
+	for _, job := range jobs {
+		if job.Active() {
+			activeJobs = append(activeJobs, job)
+		}
+	}
 	
 	// Create response
 	response := struct {
-		JobActive bool           `json:"job_active"`
-		Workers   []*WorkerStatus `json:"workers"`
+		JobActive  bool            `json:"job_active"`
+		Workers    []*WorkerStatus `json:"workers"`
+		Queue      QueueStats      `json:"queue"`
+		Memory     MemoryStats     `json:"memory"`
+		ActiveJobs []*Job          `json:"active_jobs"`
 	}{
-		JobActive: isActive,
-		Workers:   statuses,
+		JobActive:  isActive,
+		Workers:    statuses,
+		Queue:      jobQueue.Stats(),
+		Memory:     memoryMeter.Stats(),
+		ActiveJobs: activeJobs,
 	}
 	
-	// Return as JSON
-	w.Header().Set("Content-Type", "application/json")
-	w.Header().Set("Access-Control-Allow-Origin", "*")
-	encoder := json.NewEncoder(w)
-	encoder.SetIndent("", "  ")
-	if err := encoder.Encode(response); err != nil {
-		http.Error(w, "Failed to encode status: "+err.Error(), http.StatusInternalServerError)
-		return
-	}
+	// Return as JSON, answering unchanged polls with 304
+	writeCachedJSON(w, r, response)
 }
 
 // indexHandler serves the upload form with worker visualization
@@ -560,17 +1738,47 @@ func indexHandler(w http.ResponseWriter, r *http.Request) {
 </head>
 <body>
     <h1>CSV Processor</h1>
-    <p>Upload a CSV file to process it and validate royalty percentages and date formats.</p>
+    <p>Upload a CSV or Excel file to process it and validate royalty percentages and date formats.</p>
     
     <form id="upload-form">
         <div class="form-group">
-            <label for="csvFile">CSV File:</label>
-            <input type="file" id="csvFile" name="csvFile" accept=".csv" required>
+            <label for="csvFile">CSV, TSV or Excel (XLSX, XLS) File:</label>
+            <input type="file" id="csvFile" name="csvFile" accept=".csv,.tsv,.txt,.ndjson,.jsonl,.xlsx,.xls,.parquet,.avro,.gz,.zip">
+        </div>
+        
+        <div class="form-group">
+            <label for="sheet_url">Or a Google Sheets link:</label>
+            <input type="url" id="sheet_url" name="sheet_url" placeholder="https://docs.google.com/spreadsheets/d/...">
+        </div>
+        
+        <div class="form-group">
+            <label for="sheet">Sheet (Excel workbooks only, default is the first sheet):</label>
+            <input type="text" id="sheet" name="sheet">
         </div>
         
         <div class="form-group">
             <label for="workers">Number of Workers (default is number of CPU cores):</label>
-            <input type="number" id="workers" name="workers" min="1" value="` + strconv.Itoa(runtime.NumCPU()) + `">
+            <input type="number" id="workers" name="workers" min="1" max="` + strconv.Itoa(cfg.MaxWorkers) + `" value="` + strconv.Itoa(min(runtime.NumCPU(), cfg.MaxWorkers)) + `">
+        </div>
+        
+        <div class="form-group">
+            <label><input type="checkbox" name="scan_pii" value="true"> Scan for personal data (emails, phone numbers, addresses)</label>
+        </div>
+        
+        <div class="form-group">
+            <label><input type="checkbox" name="repair_numerics" value="true"> Repair UPCs mangled by Excel (scientific notation, dropped leading zeros)</label>
+        </div>
+        
+        <div class="form-group">
+            <label><input type="checkbox" name="normalize" value="true"> Normalize values (whitespace, accented letters, case of artist and label names)</label>
+        </div>
+        
+        <div class="form-group">
+            <label><input type="checkbox" name="normalize_royalties" value="true"> Rewrite royalty shares given as fractions (0.5) or with a % sign as plain percentages</label>
+        </div>
+        
+        <div class="form-group">
+            <label><input type="checkbox" name="dedupe" value="true"> Drop rows duplicating an earlier row</label>
         </div>
         
         <button type="submit" class="btn">Process CSV</button>
@@ -603,6 +1811,7 @@ func indexHandler(w http.ResponseWriter, r *http.Request) {
     <div id="results-container">
         <h2>Results</h2>
         <div class="validation-summary" id="validation-summary"></div>
+        <p><a id="report-link" class="btn" href="#" download style="display: none; text-decoration: none;">Download report</a></p>
         
         <div class="tab-container">
             <div class="tab">
@@ -619,6 +1828,8 @@ func indexHandler(w http.ResponseWriter, r *http.Request) {
                             <th>Release ID</th>
                             <th>Royalties Sum</th>
                             <th>Date Format</th>
+                            <th>Territories</th>
+                            <th>Rules</th>
                         </tr>
                     </thead>
                     <tbody id="validation-body">
@@ -792,6 +2003,15 @@ func indexHandler(w http.ResponseWriter, r *http.Request) {
             // Display raw JSON
             document.getElementById('json-output').textContent = JSON.stringify(data, null, 2);
             
+            // Link the shareable HTML report of the job
+            const reportLink = document.getElementById('report-link');
+            if (data.metadata && data.metadata.job_id) {
+                reportLink.href = '/jobs/' + encodeURIComponent(data.metadata.job_id) + '/report.html';
+                reportLink.style.display = 'inline-block';
+            } else {
+                reportLink.style.display = 'none';
+            }
+            
             // Process validation data
             const validationBody = document.getElementById('validation-body');
             validationBody.innerHTML = '';
@@ -821,9 +2041,24 @@ func indexHandler(w http.ResponseWriter, r *http.Request) {
                 tdDate.style.color = validation.date_format ? 'green' : 'red';
                 tr.appendChild(tdDate);
                 
+                const territoryIssues = validation.territory_issues || [];
+                const tdTerritories = document.createElement('td');
+                tdTerritories.textContent = (validation.territories ? (territoryIssues.length === 0 ? '✓' : '⚠') : '✗') +
+                    (territoryIssues.length > 0 ? ' ' + territoryIssues.join('; ') : '');
+                tdTerritories.style.color = validation.territories ? (territoryIssues.length === 0 ? 'green' : 'orange') : 'red';
+                tr.appendChild(tdTerritories);
+                
+                const failedRules = Object.entries(validation.rules || {})
+                    .filter(([name, passed]) => !passed)
+                    .map(([name]) => name);
+                const tdRules = document.createElement('td');
+                tdRules.textContent = failedRules.length === 0 ? '✓' : '✗ ' + failedRules.join(', ');
+                tdRules.style.color = failedRules.length === 0 ? 'green' : 'red';
+                tr.appendChild(tdRules);
+                
                 validationBody.appendChild(tr);
                 
-                if (!validation.royalties_sum || !validation.date_format) {
+                if (!validation.royalties_sum || !validation.date_format || !validation.territories || failedRules.length > 0) {
                     allValid = false;
                 }
             }
@@ -904,7 +2139,9 @@ func indexHandler(w http.ResponseWriter, r *http.Request) {
             })
             .then(response => {
                 if (!response.ok) {
-                    throw new Error('Server error: ' + response.status);
+                    return response.text().then(text => {
+                        throw new Error(text.trim() || ('Server error: ' + response.status));
+                    });
                 }
                 return response.json();
             })
@@ -944,19 +2181,70 @@ func indexHandler(w http.ResponseWriter, r *http.Request) {
 
 func main() {
 	// Define API routes
-	http.HandleFunc("/", indexHandler)
-	http.HandleFunc("/upload", uploadHandler)
-	http.HandleFunc("/status", statusHandler)
+	http.HandleFunc("/", withDeadline(cfg.RequestTimeout, indexHandler))
+	http.HandleFunc("/upload", withDeadline(cfg.ProcessingTimeout, uploadHandler))
+	http.HandleFunc("POST /validate-text", withDeadline(cfg.ProcessingTimeout, validateTextHandler))
+	http.HandleFunc("/status", withDeadline(cfg.RequestTimeout, statusHandler))
+	http.HandleFunc("/metrics", withDeadline(cfg.RequestTimeout, metricsHandler))
+	http.HandleFunc("GET /jobs", withDeadline(cfg.RequestTimeout, jobsHandler))
+	http.HandleFunc("GET /jobs/{id}", withDeadline(cfg.RequestTimeout, jobHandler))
+	http.HandleFunc("GET /jobs/{id}/result", withDeadline(cfg.RequestTimeout, jobResultHandler))
+	http.HandleFunc("GET /jobs/{id}/upload", withDeadline(cfg.RequestTimeout, jobUploadHandler))
+	http.HandleFunc("GET /jobs/{id}/export.csv", withDeadline(cfg.RequestTimeout, exportHandler))
+	http.HandleFunc("GET /jobs/{id}/export.xlsx", withDeadline(cfg.RequestTimeout, exportHandler))
+	http.HandleFunc("GET /jobs/{id}/export.parquet", withDeadline(cfg.RequestTimeout, exportHandler))
+	http.HandleFunc("GET /jobs/{id}/export.sqlite", withDeadline(cfg.RequestTimeout, exportHandler))
+	http.HandleFunc("GET /jobs/{id}/export", withDeadline(cfg.RequestTimeout, exportHandler))
+	http.HandleFunc("GET /jobs/{id}/report.html", withDeadline(cfg.RequestTimeout, reportHandler))
+	http.HandleFunc("POST /jobs/{id}/revalidate", withDeadline(cfg.RequestTimeout, revalidateHandler))
+	http.HandleFunc("POST /jobs/{id}/append", withDeadline(cfg.ProcessingTimeout, appendHandler))
+	http.HandleFunc("GET /jobs/{id}/badge.svg", withDeadline(cfg.RequestTimeout, badgeHandler))
+	http.HandleFunc("GET /jobs/{id}/rows/{key}/annotations", withDeadline(cfg.RequestTimeout, annotationsHandler))
+	http.HandleFunc("POST /jobs/{id}/rows/{key}/annotations", withDeadline(cfg.RequestTimeout, addAnnotationHandler))
+	http.HandleFunc("GET /reports/digest", withDeadline(cfg.RequestTimeout, digestHandler))
+	http.HandleFunc("GET /version", withDeadline(cfg.RequestTimeout, versionHandler))
+	http.HandleFunc("GET /profiles", withDeadline(cfg.RequestTimeout, profilesHandler))
+	http.HandleFunc("GET /profiles/{name}", withDeadline(cfg.RequestTimeout, profileHandler))
+	http.HandleFunc("GET /schemas", withDeadline(cfg.RequestTimeout, schemasHandler))
+	http.HandleFunc("GET /schemas/{name}", withDeadline(cfg.RequestTimeout, schemaHandler))
+	http.HandleFunc("POST /admin/purge", withDeadline(cfg.ProcessingTimeout, purgeHandler))
+	http.HandleFunc("GET /admin/tombstones", withDeadline(cfg.RequestTimeout, tombstonesHandler))
+	http.HandleFunc("GET /admin/overview", withDeadline(cfg.RequestTimeout, adminOverviewHandler))
+	http.HandleFunc("GET /admin/uploads", withDeadline(cfg.RequestTimeout, uploadStoreHandler))
+	http.HandleFunc("GET /admin/tenants", withDeadline(cfg.RequestTimeout, tenantSettingsListHandler))
+	http.HandleFunc("GET /admin/tenants/{tenant}", withDeadline(cfg.RequestTimeout, tenantSettingsHandler))
+	http.HandleFunc("PUT /admin/tenants/{tenant}", withDeadline(cfg.RequestTimeout, putTenantSettingsHandler))
+	http.HandleFunc("DELETE /admin/tenants/{tenant}", withDeadline(cfg.RequestTimeout, deleteTenantSettingsHandler))
+	http.HandleFunc("GET /admin/tenants/{tenant}/dictionary", withDeadline(cfg.RequestTimeout, dictionaryHandler))
+	http.HandleFunc("PUT /admin/tenants/{tenant}/dictionary", withDeadline(cfg.RequestTimeout, putDictionaryHandler))
+	http.HandleFunc("DELETE /admin/tenants/{tenant}/dictionary", withDeadline(cfg.RequestTimeout, deleteDictionaryHandler))
+	http.HandleFunc("GET /admin/validators", withDeadline(cfg.RequestTimeout, validatorsHandler))
+	http.HandleFunc("PUT /admin/validators/{name}", withDeadline(cfg.RequestTimeout, putValidatorHandler))
+	http.HandleFunc("DELETE /admin/validators/{name}", withDeadline(cfg.RequestTimeout, deleteValidatorHandler))
+	http.HandleFunc("GET /admin/deliveries", withDeadline(cfg.RequestTimeout, deliveriesHandler))
+	http.HandleFunc("POST /admin/deliveries/retry", withDeadline(cfg.ProcessingTimeout, retryDeliveriesHandler))
+	http.HandleFunc("GET /admin/deliveries/{id}", withDeadline(cfg.RequestTimeout, deliveryHandler))
+	http.HandleFunc("POST /admin/deliveries/{id}/retry", withDeadline(cfg.RequestTimeout, retryDeliveryHandler))
+	http.HandleFunc("DELETE /admin/deliveries/{id}", withDeadline(cfg.RequestTimeout, deleteDeliveryHandler))
+
+	// Sweep stored uploads no job refers to
+	if uploadStore != nil {
+		go runUploadSweeper()
+	}
+
+	// Re-drive failed webhook deliveries
+	if cfg.DeliveryRetryInterval > 0 {
+		go runDeliveryRetrier()
+	}
 
-	// Read port from environment variable or use default
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "8080"
+	// Deliver scheduled digest reports
+	if cfg.DigestSchedule != "" {
+		go runDigestScheduler()
 	}
 
 	// Start the server
-	fmt.Printf("Server starting on port %s...\n", port)
-	if err := http.ListenAndServe(":"+port, nil); err != nil {
+	fmt.Printf("Server %s starting on port %s...\n", version, cfg.Port)
+	if err := newServer(http.DefaultServeMux).ListenAndServe(); err != nil {
 		log.Fatalf("Failed to start server: %v", err)
 	}
 } 
\ No newline at end of file
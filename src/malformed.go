@@ -0,0 +1,60 @@
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+)
+
+// maxMalformedRows limits the malformed rows listed in a result
+const maxMalformedRows = 1000
+
+// MalformedRow is a row of a file that could not be read, with more or
+// fewer fields than the header or with broken quoting. Such rows are left
+// out of the result.
+type MalformedRow struct {
+	// Line is the line of the file the row starts on, and Part the part it
+	// was appended in
+	Line int `json:"line"`
+	Part int `json:"part,omitempty"`
+
+	// Fields is the number of fields of a row whose field count differs
+	// from the header's, Expected
+	Fields   int `json:"fields,omitempty"`
+	Expected int `json:"expected,omitempty"`
+
+	Message string `json:"message"`
+}
+
+// newMalformedRow describes a row the CSV reader rejected. fields are the
+// fields of the row as read, for a field count mismatch.
+func newMalformedRow(fields []string, expected int, err *csv.ParseError) MalformedRow {
+	row := MalformedRow{Line: err.StartLine, Message: err.Err.Error()}
+	if errors.Is(err.Err, csv.ErrFieldCount) {
+		row.Fields, row.Expected = len(fields), expected
+		row.Message = fmt.Sprintf("row has %d fields, the header %d", len(fields), expected)
+	}
+	return row
+}
+
+// malformedRows collects the malformed rows of a file, listing the first
+// maxMalformedRows and counting the rest
+type malformedRows struct {
+	rows  []MalformedRow
+	count int
+}
+
+func (m *malformedRows) add(row MalformedRow) {
+	m.count++
+	if len(m.rows) < maxMalformedRows {
+		m.rows = append(m.rows, row)
+	}
+}
+
+// warning notes the malformed rows left out of the list, if any
+func (m *malformedRows) warning() string {
+	if m.count <= len(m.rows) {
+		return ""
+	}
+	return fmt.Sprintf("%d malformed rows are listed, %d more were skipped", len(m.rows), m.count-len(m.rows))
+}
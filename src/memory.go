@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"sync"
+)
+
+// MemoryMeter tracks the approximate memory processing jobs hold: rows
+// queued between the reader, the workers and the collector, and the rows
+// and validations collected for the result. With a limit, readers pause
+// while the total is over it, and a job needing more than the limit on its
+// own fails.
+type MemoryMeter struct {
+	mu      sync.Mutex
+	seq     int
+	limit   int64
+	total   int64
+	peak    int64
+	pauses  int
+	waiting int
+	changed chan struct{}
+	jobs    map[*JobMemory]struct{}
+}
+
+// JobMemory is the memory held by one processing job
+type JobMemory struct {
+	meter   *MemoryMeter
+	seq     int
+	jobID   string
+	queued  int64
+	results int64
+}
+
+// MemoryStats is a snapshot of the memory meter
+type MemoryStats struct {
+	LimitBytes    int64            `json:"limit_bytes,omitempty"`
+	InFlightBytes int64            `json:"in_flight_bytes"`
+	PeakBytes     int64            `json:"peak_bytes"`
+	ReaderPauses  int              `json:"reader_pauses"`
+	Jobs          []JobMemoryStats `json:"jobs"`
+}
+
+// JobMemoryStats is the memory held by one processing job
+type JobMemoryStats struct {
+	JobID       string `json:"job_id,omitempty"`
+	QueuedBytes int64  `json:"queued_bytes"`
+	ResultBytes int64  `json:"result_bytes"`
+}
+
+// memoryMeter is the process-wide memory meter
+var memoryMeter = NewMemoryMeter(cfg.MaxInFlightBytes)
+
+// NewMemoryMeter creates a meter enforcing limit bytes, or none if limit is 0
+func NewMemoryMeter(limit int64) *MemoryMeter {
+	return &MemoryMeter{
+		limit:   limit,
+		changed: make(chan struct{}),
+		jobs:    make(map[*JobMemory]struct{}),
+	}
+}
+
+// Track starts tracking the memory of a job. Done must be called once the
+// job's processing ends.
+func (m *MemoryMeter) Track(jobID string) *JobMemory {
+	m.mu.Lock()
+	m.seq++
+	j := &JobMemory{meter: m, seq: m.seq, jobID: jobID}
+	m.jobs[j] = struct{}{}
+	m.mu.Unlock()
+	return j
+}
+
+// Stats returns a snapshot of the meter, jobs holding the most first
+func (m *MemoryMeter) Stats() MemoryStats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	stats := MemoryStats{
+		LimitBytes:    m.limit,
+		InFlightBytes: m.total,
+		PeakBytes:     m.peak,
+		ReaderPauses:  m.pauses,
+		Jobs:          make([]JobMemoryStats, 0, len(m.jobs)),
+	}
+	for j := range m.jobs {
+		stats.Jobs = append(stats.Jobs, JobMemoryStats{JobID: j.jobID, QueuedBytes: j.queued, ResultBytes: j.results})
+	}
+	sort.Slice(stats.Jobs, func(a, b int) bool {
+		return stats.Jobs[a].QueuedBytes+stats.Jobs[a].ResultBytes > stats.Jobs[b].QueuedBytes+stats.Jobs[b].ResultBytes
+	})
+	return stats
+}
+
+// add changes the total by n and wakes paused readers to check it again.
+// The caller must hold the lock.
+func (m *MemoryMeter) add(n int64) {
+	m.total += n
+	m.peak = max(m.peak, m.total)
+	if m.waiting > 0 {
+		close(m.changed)
+		m.changed = make(chan struct{})
+	}
+}
+
+// Queue accounts for a row about to be queued that will hold n bytes once
+// collected. While the total is over the limit it waits for the job's
+// queued rows to be collected and, unless the job started first, for other
+// jobs to release memory, so the oldest job always proceeds. It fails if
+// the job alone holds more than the limit or ctx is cancelled.
+func (j *JobMemory) Queue(ctx context.Context, n int64) error {
+	m := j.meter
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.limit > 0 && j.queued+j.results+n > m.limit {
+		return fileErrorf(http.StatusRequestEntityTooLarge,
+			"file needs more than the %d MB of memory a job may hold", m.limit>>20)
+	}
+	paused := false
+	for m.limit > 0 && m.total+n > m.limit && (j.queued > 0 || !m.oldest(j)) {
+		if !paused {
+			paused = true
+			m.pauses++
+		}
+		changed := m.changed
+		m.waiting++
+		m.mu.Unlock()
+		select {
+		case <-changed:
+		case <-ctx.Done():
+		}
+		m.mu.Lock()
+		m.waiting--
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+	}
+	j.queued += n
+	m.total += n
+	m.peak = max(m.peak, m.total)
+	return nil
+}
+
+// oldest reports whether j is the earliest job still tracked. The caller
+// must hold the lock.
+func (m *MemoryMeter) oldest(j *JobMemory) bool {
+	for other := range m.jobs {
+		if other.seq < j.seq {
+			return false
+		}
+	}
+	return true
+}
+
+// Collect moves a row queued as queued bytes into the result, where it
+// holds result bytes
+func (j *JobMemory) Collect(queued, result int64) {
+	m := j.meter
+	m.mu.Lock()
+	j.queued -= queued
+	j.results += result
+	m.add(result - queued)
+	m.mu.Unlock()
+}
+
+// Done stops tracking the job and releases its memory
+func (j *JobMemory) Done() {
+	m := j.meter
+	m.mu.Lock()
+	delete(m.jobs, j)
+	m.add(-(j.queued + j.results))
+	j.queued, j.results = 0, 0
+	m.mu.Unlock()
+}
+
+// rowSize approximates the memory a row will hold once collected under
+// the given column names, as recordSize counts it without issues
+func rowSize(row, names []string) int64 {
+	n := int64(recordOverhead)
+	for i, field := range row {
+		n += int64(fieldOverhead + len(field))
+		if i < len(names) {
+			n += int64(len(names[i]))
+		}
+	}
+	return n
+}
+
+// Approximate memory of a collected row and its validation, and of each of
+// its fields, beyond the text itself
+const (
+	recordOverhead = 256
+	fieldOverhead  = 48
+)
+
+// recordSize approximates the memory a collected row and its validation
+// hold
+func recordSize(record map[string]string, validation RowValidation) int64 {
+	n := int64(recordOverhead)
+	for column, value := range record {
+		n += int64(fieldOverhead + len(column) + len(value))
+	}
+	n += int64(fieldOverhead * (len(validation.Checks) + len(validation.Validators)))
+	for _, rules := range validation.ProfileRules {
+		n += int64(fieldOverhead * (1 + len(rules)))
+	}
+	n += int64(len(validation.OriginalReleaseDate))
+	for _, issue := range validation.Issues {
+		n += int64(fieldOverhead + len(issue.Check) + len(issue.Column) + len(issue.Value) + len(issue.Message))
+	}
+	for _, issues := range [][]string{validation.TerritoryIssues, validation.PayeeIssues, validation.NumericIssues, validation.ReleaseTypeIssues, validation.ISRCIssues, validation.MissingFields, validation.DateIssues, validation.GenreIssues, validation.GenreSuggestions, validation.LabelIssues, validation.LabelSuggestions, validation.RightsHolderIssues, validation.RightsHolderSuggestions, validation.ReleaseConflicts} {
+		for _, issue := range issues {
+			n += int64(16 + len(issue))
+		}
+	}
+	return n
+}
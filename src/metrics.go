@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// JobQueue limits how many jobs process at once and tracks how long
+// uploads wait for a free slot
+type JobQueue struct {
+	slots chan struct{}
+
+	mu            sync.Mutex
+	queued        int
+	running       int
+	completed     int
+	waitSum       time.Duration
+	waitCount     int
+	waitMax       time.Duration
+	alertsSent    int
+	lastAlertTime time.Time
+}
+
+// QueueStats is a snapshot of the job queue counters
+type QueueStats struct {
+	Slots       int     `json:"slots"`
+	Queued      int     `json:"queued"`
+	Running     int     `json:"running"`
+	Completed   int     `json:"completed"`
+	WaitSeconds float64 `json:"wait_seconds_total"`
+	WaitCount   int     `json:"wait_count"`
+	WaitMax     float64 `json:"wait_seconds_max"`
+	AlertsSent  int     `json:"alerts_sent"`
+}
+
+// jobQueue is the process-wide job queue
+var jobQueue = NewJobQueue(cfg.MaxConcurrentJobs)
+
+// NewJobQueue creates a queue allowing the given number of concurrent jobs
+func NewJobQueue(slots int) *JobQueue {
+	if slots < 1 {
+		slots = 1
+	}
+	return &JobQueue{slots: make(chan struct{}, slots)}
+}
+
+// Acquire blocks until a job slot is free or ctx is cancelled. The returned
+// function must be called to release the slot once the job finishes.
+func (q *JobQueue) Acquire(ctx context.Context) (func(), error) {
+	enqueued := time.Now()
+
+	q.mu.Lock()
+	q.queued++
+	queued := q.queued
+	q.mu.Unlock()
+	q.checkQueueLength(queued)
+
+	select {
+	case q.slots <- struct{}{}:
+	case <-ctx.Done():
+		q.mu.Lock()
+		q.queued--
+		q.mu.Unlock()
+		return nil, ctx.Err()
+	}
+
+	wait := time.Since(enqueued)
+	q.mu.Lock()
+	q.queued--
+	q.running++
+	q.waitSum += wait
+	q.waitCount++
+	if wait > q.waitMax {
+		q.waitMax = wait
+	}
+	q.mu.Unlock()
+	q.checkWaitTime(wait)
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			q.mu.Lock()
+			q.running--
+			q.completed++
+			q.mu.Unlock()
+			<-q.slots
+		})
+	}, nil
+}
+
+// Stats returns a snapshot of the queue counters
+func (q *JobQueue) Stats() QueueStats {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return QueueStats{
+		Slots:       cap(q.slots),
+		Queued:      q.queued,
+		Running:     q.running,
+		Completed:   q.completed,
+		WaitSeconds: q.waitSum.Seconds(),
+		WaitCount:   q.waitCount,
+		WaitMax:     q.waitMax.Seconds(),
+		AlertsSent:  q.alertsSent,
+	}
+}
+
+// checkQueueLength raises an alert when the queue is longer than configured
+func (q *JobQueue) checkQueueLength(queued int) {
+	if cfg.AlertQueueLength > 0 && queued > cfg.AlertQueueLength {
+		q.alert("queue_length", fmt.Sprintf("%d jobs waiting for a slot (threshold %d)", queued, cfg.AlertQueueLength))
+	}
+}
+
+// checkWaitTime raises an alert when a job waited longer than configured
+func (q *JobQueue) checkWaitTime(wait time.Duration) {
+	if cfg.AlertQueueWait > 0 && wait > cfg.AlertQueueWait {
+		q.alert("queue_wait", fmt.Sprintf("job waited %s for a slot (threshold %s)", wait.Round(time.Millisecond), cfg.AlertQueueWait))
+	}
+}
+
+// alert logs a saturation alert and posts it to the alert webhook if one is
+// configured. Alerts are rate limited by the configured cooldown.
+func (q *JobQueue) alert(kind, message string) {
+	q.mu.Lock()
+	if !q.lastAlertTime.IsZero() && time.Since(q.lastAlertTime) < cfg.AlertCooldown {
+		q.mu.Unlock()
+		return
+	}
+	q.lastAlertTime = time.Now()
+	q.alertsSent++
+	q.mu.Unlock()
+
+	stats := q.Stats()
+	log.Printf("ALERT job queue saturated: %s", message)
+
+	if cfg.AlertWebhookURL == "" {
+		return
+	}
+	go func() {
+		payload, err := json.Marshal(map[string]interface{}{
+			"alert":   kind,
+			"message": message,
+			"queue":   stats,
+			"time":    time.Now(),
+		})
+		if err != nil {
+			log.Printf("Failed to encode alert: %v", err)
+			return
+		}
+		client := &http.Client{Timeout: 10 * time.Second}
+		resp, err := client.Post(cfg.AlertWebhookURL, "application/json", bytes.NewReader(payload))
+		if err != nil {
+			log.Printf("Failed to deliver alert: %v", err)
+			return
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			log.Printf("Alert webhook returned %s", resp.Status)
+		}
+	}()
+}
+
+// metricsHandler exposes the job queue metrics in Prometheus text format
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	stats := jobQueue.Stats()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	writeMetric(w, "csvapi_job_slots", "gauge", "Maximum number of concurrently processing jobs.", float64(stats.Slots))
+	writeMetric(w, "csvapi_jobs_running", "gauge", "Jobs currently processing.", float64(stats.Running))
+	writeMetric(w, "csvapi_jobs_queued", "gauge", "Jobs waiting for a free slot.", float64(stats.Queued))
+	writeMetric(w, "csvapi_jobs_completed_total", "counter", "Jobs that finished processing.", float64(stats.Completed))
+	writeMetric(w, "csvapi_queue_wait_seconds_sum", "counter", "Total time jobs spent waiting for a slot.", stats.WaitSeconds)
+	writeMetric(w, "csvapi_queue_wait_seconds_count", "counter", "Number of jobs that waited for a slot.", float64(stats.WaitCount))
+	writeMetric(w, "csvapi_queue_wait_seconds_max", "gauge", "Longest time a job waited for a slot.", stats.WaitMax)
+	writeMetric(w, "csvapi_saturation_alerts_total", "counter", "Queue saturation alerts raised.", float64(stats.AlertsSent))
+
+	memory := memoryMeter.Stats()
+	var queued, results int64
+	for _, job := range memory.Jobs {
+		queued += job.QueuedBytes
+		results += job.ResultBytes
+	}
+	writeMetric(w, "csvapi_memory_in_flight_bytes", "gauge", "Approximate memory held by processing jobs.", float64(memory.InFlightBytes))
+	writeMetric(w, "csvapi_memory_queued_bytes", "gauge", "Approximate memory of rows queued between reader, workers and collector.", float64(queued))
+	writeMetric(w, "csvapi_memory_result_bytes", "gauge", "Approximate memory of rows and validations collected for results.", float64(results))
+	writeMetric(w, "csvapi_memory_peak_bytes", "gauge", "Highest approximate memory held by processing jobs.", float64(memory.PeakBytes))
+	writeMetric(w, "csvapi_memory_limit_bytes", "gauge", "Memory processing jobs may hold, 0 if unlimited.", float64(memory.LimitBytes))
+	writeMetric(w, "csvapi_reader_pauses_total", "counter", "Times a reader paused for memory to be released.", float64(memory.ReaderPauses))
+
+	if deliveries, err := jobStore.ListDeliveries(); err == nil {
+		writeMetric(w, "csvapi_deliveries_parked", "gauge", "Failed webhook deliveries parked for retry.", float64(len(deliveries)))
+	}
+}
+
+// writeMetric writes a single metric with its help and type lines
+func writeMetric(w http.ResponseWriter, name, kind, help string, value float64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %g\n", name, help, name, kind, name, value)
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// maxProfiles bounds the further profiles a file is validated against in
+// one pass
+const maxProfiles = 8
+
+// profileRules are the rules of a further profile, resolved against the
+// output columns of a file
+type profileRules struct {
+	name  string
+	rules []*Rule
+}
+
+// parseProfiles loads the comma-separated profiles of the profiles field
+func parseProfiles(value string) ([]*Profile, error) {
+	var names []string
+	for _, name := range strings.Split(value, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+	if len(names) > maxProfiles {
+		return nil, fileErrorf(http.StatusBadRequest, "at most %d profiles can be given, got %d", maxProfiles, len(names))
+	}
+	return loadProfiles(names)
+}
+
+// loadProfiles loads further profiles by name, each once
+func loadProfiles(names []string) ([]*Profile, error) {
+	var profiles []*Profile
+	seen := make(map[string]bool, len(names))
+	for _, name := range names {
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+		profile, err := loadProfile(name)
+		if errors.Is(err, ErrProfileNotFound) {
+			return nil, fileErrorf(http.StatusBadRequest, "unknown profile %s", name)
+		}
+		if err != nil {
+			return nil, err
+		}
+		profiles = append(profiles, profile)
+	}
+	return profiles, nil
+}
+
+// profileNames returns the names of profiles
+func profileNames(profiles []*Profile) []string {
+	names := make([]string, len(profiles))
+	for i, profile := range profiles {
+		names[i] = profile.Name
+	}
+	return names
+}
+
+// compileProfileRules resolves the rules of further profiles against the
+// output columns. Only rules are taken from them; the columns are those
+// of the file and its own profile.
+func compileProfileRules(profiles []*Profile, columns []string) ([]profileRules, []string, error) {
+	compiled := make([]profileRules, 0, len(profiles))
+	var warnings []string
+	for _, profile := range profiles {
+		rules, ruleWarnings, err := compileRules(profile.Rules, columns)
+		if err != nil {
+			return nil, nil, fmt.Errorf("profile %s: %v", profile.Name, err)
+		}
+		for _, warning := range ruleWarnings {
+			warnings = append(warnings, "Profile "+profile.Name+": "+warning)
+		}
+		compiled = append(compiled, profileRules{name: profile.Name, rules: rules})
+	}
+	return compiled, warnings, nil
+}
+
+// checkProfileRules evaluates the rules of each further profile against a
+// record, keyed by profile and rule
+func checkProfileRules(record map[string]string, profiles []profileRules) map[string]map[string]bool {
+	if len(profiles) == 0 {
+		return nil
+	}
+	results := make(map[string]map[string]bool, len(profiles))
+	for _, profile := range profiles {
+		rules := make(map[string]bool, len(profile.rules))
+		for _, rule := range profile.rules {
+			rules[rule.Name] = rule.Check(record)
+		}
+		results[profile.name] = rules
+	}
+	return results
+}
+
+// FailedProfiles returns the further profiles a row fails, sorted: every
+// one if the row fails a check of its own, otherwise those whose rules
+// it fails
+func (v RowValidation) FailedProfiles() []string {
+	if len(v.ProfileRules) == 0 {
+		return nil
+	}
+	profileFailures := 0
+	for _, rules := range v.ProfileRules {
+		for _, passed := range rules {
+			if !passed {
+				profileFailures++
+			}
+		}
+	}
+	own := len(v.FailedChecks()) > profileFailures
+	var failed []string
+	for _, name := range sortedKeys(v.ProfileRules) {
+		passed := !own
+		for _, ok := range v.ProfileRules[name] {
+			passed = passed && ok
+		}
+		if !passed {
+			failed = append(failed, name)
+		}
+	}
+	return failed
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// maxNDJSONLine limits the size of a single JSON Lines record
+const maxNDJSONLine = 16 << 20
+
+// isNDJSONExtension reports whether a file extension names JSON Lines
+func isNDJSONExtension(extension string) bool {
+	return extension == ".ndjson" || extension == ".jsonl"
+}
+
+// streamNDJSON converts newline-delimited JSON records to CSV as they are
+// read, so JSON Lines uploads go through the same pipeline as CSV files.
+// The field names of the first record become the header row.
+func streamNDJSON(r io.Reader) io.ReadCloser {
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(writeNDJSONCSV(r, csv.NewWriter(pw)))
+	}()
+	return pr
+}
+
+// writeNDJSONCSV writes the records of r to w. Later records may leave out
+// fields, which are written empty, but may not introduce new ones. Blank
+// lines are skipped.
+func writeNDJSONCSV(r io.Reader, w *csv.Writer) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64<<10), maxNDJSONLine)
+
+	var header []string
+	var index map[string]int
+	line := 0
+	for scanner.Scan() {
+		line++
+		data := bytes.TrimSpace(scanner.Bytes())
+		if len(data) == 0 {
+			continue
+		}
+		fields, values, err := decodeNDJSONRecord(data)
+		if err != nil {
+			return fileErrorf(http.StatusUnprocessableEntity, "invalid JSON on line %d: %v", line, err)
+		}
+
+		if header == nil {
+			header, index = fields, make(map[string]int, len(fields))
+			for i, field := range fields {
+				index[field] = i
+			}
+			if err := w.Write(header); err != nil {
+				return err
+			}
+		}
+		row := make([]string, len(header))
+		for i, field := range fields {
+			column, ok := index[field]
+			if !ok {
+				return fileErrorf(http.StatusUnprocessableEntity,
+					"line %d: field %q is not in the first record", line, field)
+			}
+			row[column] = values[i]
+		}
+		if err := w.Write(row); err != nil {
+			return err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		if err == bufio.ErrTooLong {
+			return fileErrorf(http.StatusUnprocessableEntity,
+				"line %d: record exceeds %d MB", line+1, maxNDJSONLine>>20)
+		}
+		return err
+	}
+	w.Flush()
+	return w.Error()
+}
+
+// decodeNDJSONRecord decodes a JSON object into its field names, in the
+// order they appear, and their values as CSV cells
+func decodeNDJSONRecord(data []byte) (fields, values []string, err error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := expectDelim(decoder, '{'); err != nil {
+		return nil, nil, fmt.Errorf("expected an object")
+	}
+	seen := make(map[string]bool)
+	for decoder.More() {
+		token, err := decoder.Token()
+		if err != nil {
+			return nil, nil, err
+		}
+		field, _ := token.(string)
+		if seen[field] {
+			return nil, nil, fmt.Errorf("duplicate field %q", field)
+		}
+		seen[field] = true
+
+		var value interface{}
+		if err := decoder.Decode(&value); err != nil {
+			return nil, nil, err
+		}
+		cell, err := ndjsonCell(value)
+		if err != nil {
+			return nil, nil, fmt.Errorf("field %q: %v", field, err)
+		}
+		fields = append(fields, field)
+		values = append(values, cell)
+	}
+	if err := expectDelim(decoder, '}'); err != nil {
+		return nil, nil, err
+	}
+	if decoder.More() {
+		return nil, nil, fmt.Errorf("unexpected data after the record")
+	}
+	return fields, values, nil
+}
+
+// ndjsonCell renders a JSON value as a CSV cell: strings as they are,
+// numbers and booleans as written, null as empty and arrays of those as a
+// comma-separated list, as territory lists are written in CSV files
+func ndjsonCell(value interface{}) (string, error) {
+	switch v := value.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return v, nil
+	case json.Number:
+		return v.String(), nil
+	case bool:
+		if v {
+			return "true", nil
+		}
+		return "false", nil
+	case []interface{}:
+		items := make([]string, len(v))
+		for i, item := range v {
+			if _, nested := item.([]interface{}); nested {
+				return "", fmt.Errorf("nested arrays are not supported")
+			}
+			cell, err := ndjsonCell(item)
+			if err != nil {
+				return "", err
+			}
+			items[i] = cell
+		}
+		return strings.Join(items, ","), nil
+	default:
+		return "", fmt.Errorf("objects are not supported")
+	}
+}
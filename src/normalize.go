@@ -0,0 +1,266 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"unicode"
+)
+
+// titleCaseColumns are the columns normalization title-cases
+var titleCaseColumns = map[string]bool{
+	"Artist Name": true,
+	labelColumn:   true,
+}
+
+// Normalization tidies the values of a file's columns before validation:
+// it trims them, collapses runs of whitespace into one space, composes
+// accented letters (Unicode NFC) and title-cases artist and label names
+type Normalization struct {
+	// columns turns normalization on or off for columns by their
+	// normalized name; others follow all
+	columns map[string]bool
+	all     bool
+}
+
+// parseNormalization reads the normalize option of a request: true to
+// normalize every column, or a JSON object turning columns on or off, e.g.
+// {"Track Title": false}. Columns the object leaves out follow its "*"
+// entry, and are normalized without one. It returns nil if normalization is
+// off.
+func parseNormalization(r *http.Request) (*Normalization, error) {
+	value := strings.TrimSpace(r.FormValue("normalize"))
+	switch value {
+	case "", "false":
+		return nil, nil
+	case "true":
+		return &Normalization{all: true}, nil
+	}
+	n := new(Normalization)
+	if err := json.Unmarshal([]byte(value), n); err != nil {
+		return nil, fileErrorf(http.StatusBadRequest, "normalize must be true or a JSON object of columns and booleans: %v", err)
+	}
+	return n, nil
+}
+
+// MarshalJSON writes a normalization as the object of the normalize
+// option, so results record how their rows were normalized
+func (n *Normalization) MarshalJSON() ([]byte, error) {
+	columns := make(map[string]bool, len(n.columns)+1)
+	for column, on := range n.columns {
+		columns[column] = on
+	}
+	columns["*"] = n.all
+	return json.Marshal(columns)
+}
+
+// UnmarshalJSON reads the object of the normalize option
+func (n *Normalization) UnmarshalJSON(data []byte) error {
+	var columns map[string]bool
+	if err := json.Unmarshal(data, &columns); err != nil {
+		return err
+	}
+	*n = Normalization{columns: make(map[string]bool, len(columns)), all: true}
+	for column, on := range columns {
+		if column == "*" {
+			n.all = on
+			continue
+		}
+		n.columns[normalizeColumnName(column)] = on
+	}
+	return nil
+}
+
+// applies reports whether a column is normalized
+func (n *Normalization) applies(column string) bool {
+	if on, ok := n.columns[normalizeColumnName(column)]; ok {
+		return on
+	}
+	return n.all
+}
+
+// apply normalizes the values of a record in place and returns the number
+// of cells changed
+func (n *Normalization) apply(record map[string]string) int {
+	if n == nil {
+		return 0
+	}
+	changed := 0
+	for column, value := range record {
+		if !n.applies(column) {
+			continue
+		}
+		if normalized := normalizeValue(value, titleCaseColumns[column]); normalized != value {
+			record[column] = normalized
+			changed++
+		}
+	}
+	return changed
+}
+
+// normalizeValue trims a value, collapses its whitespace and composes its
+// accented letters, and title-cases it if asked to
+func normalizeValue(value string, title bool) string {
+	value = strings.Join(strings.Fields(composeNFC(value)), " ")
+	if title {
+		value = titleCase(value)
+	}
+	return value
+}
+
+// titleCase capitalizes the first letter of each word of a name written
+// entirely in lower or upper case. Names mixing cases, such as McCartney,
+// are left as written.
+func titleCase(value string) string {
+	var upper, lower bool
+	for _, r := range value {
+		upper = upper || unicode.IsUpper(r)
+		lower = lower || unicode.IsLower(r)
+	}
+	if upper && lower {
+		return value
+	}
+	var b strings.Builder
+	b.Grow(len(value))
+	inWord := false
+	for _, r := range value {
+		switch {
+		case !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '\'':
+			inWord = false
+		case inWord:
+			r = unicode.ToLower(r)
+		default:
+			r = unicode.ToTitle(r)
+			inWord = true
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// composeNFC composes the Latin letters followed by combining accents, and
+// the Hangul syllables written as separate jamo, into their precomposed
+// forms, as Unicode normalization form C does. Files exported on macOS
+// often carry names decomposed this way, which then fail to match the same
+// names typed elsewhere.
+func composeNFC(value string) string {
+	if !strings.ContainsFunc(value, isComposable) {
+		return value
+	}
+	runes := make([]rune, 0, len(value))
+	for _, r := range value {
+		if n := len(runes); n > 0 && isComposable(r) {
+			if composed, ok := compose(runes[n-1], r); ok {
+				runes[n-1] = composed
+				continue
+			}
+		}
+		runes = append(runes, r)
+	}
+	return string(runes)
+}
+
+// Hangul syllables are composed arithmetically from their jamo
+const (
+	hangulBase   = 0xAC00
+	hangulLBase  = 0x1100
+	hangulVBase  = 0x1161
+	hangulTBase  = 0x11A7
+	hangulLCount = 19
+	hangulVCount = 21
+	hangulTCount = 28
+)
+
+// isComposable reports whether a rune may compose with the one before it
+func isComposable(r rune) bool {
+	return (r >= 0x0300 && r < 0x0370) || (r >= hangulVBase && r < hangulTBase+hangulTCount)
+}
+
+// compose returns the precomposed form of a letter followed by a combining
+// mark, or of Hangul jamo, if there is one
+func compose(a, b rune) (rune, bool) {
+	switch {
+	case a >= hangulLBase && a < hangulLBase+hangulLCount && b >= hangulVBase && b < hangulVBase+hangulVCount:
+		return hangulBase + ((a-hangulLBase)*hangulVCount+b-hangulVBase)*hangulTCount, true
+	case a >= hangulBase && a < hangulBase+hangulLCount*hangulVCount*hangulTCount && (a-hangulBase)%hangulTCount == 0 &&
+		b > hangulTBase && b < hangulTBase+hangulTCount:
+		return a + b - hangulTBase, true
+	}
+	composed, ok := compositions[[2]rune{a, b}]
+	return composed, ok
+}
+
+// compositions maps letters and combining marks to the precomposed letters
+// of the Latin blocks
+var compositions = func() map[[2]rune]rune {
+	compositions := make(map[[2]rune]rune)
+	for mark, pairs := range latinCompositions {
+		runes := []rune(pairs)
+		for i := 0; i+1 < len(runes); i += 2 {
+			compositions[[2]rune{runes[i], mark}] = runes[i+1]
+		}
+	}
+	return compositions
+}()
+
+// latinCompositions lists, for each combining mark, the letters it
+// composes with, each followed by the precomposed letter
+var latinCompositions = map[rune]string{
+	// grave accent
+	0x0300: "AÀEÈIÌOÒUÙaàeèiìoòuùÜǛüǜNǸnǹĒḔēḕŌṐōṑWẀwẁÂẦâầĂẰăằÊỀêềÔỒôồƠỜơờƯỪưừ" +
+		"YỲyỳ",
+	// acute accent
+	0x0301: "AÁEÉIÍOÓUÚYÝaáeéiíoóuúyýCĆcćLĹlĺNŃnńRŔrŕSŚsśZŹzźÜǗüǘGǴgǵÅǺåǻÆǼæǽ" +
+		"ØǾøǿÇḈçḉĒḖēḗÏḮïḯKḰkḱMḾmḿÕṌõṍŌṒōṓPṔpṕŨṸũṹWẂwẃÂẤâấĂẮăắÊẾêếÔỐôốƠỚơớ" +
+		"ƯỨưứ",
+	// circumflex accent
+	0x0302: "AÂEÊIÎOÔUÛaâeêiîoôuûCĈcĉGĜgĝHĤhĥJĴjĵSŜsŝWŴwŵYŶyŷZẐzẑẠẬạậẸỆẹệỌỘọộ",
+	// tilde
+	0x0303: "AÃNÑOÕaãnñoõIĨiĩUŨuũVṼvṽÂẪâẫĂẴăẵEẼeẽÊỄêễÔỖôỗƠỠơỡƯỮưữYỸyỹ",
+	// macron
+	0x0304: "AĀaāEĒeēIĪiīOŌoōUŪuūÜǕüǖÄǞäǟȦǠȧǡÆǢæǣǪǬǫǭÖȪöȫÕȬõȭȮȰȯȱYȲyȳGḠgḡḶḸḷḹ" +
+		"ṚṜṛṝ",
+	// breve
+	0x0306: "AĂaăEĔeĕGĞgğIĬiĭOŎoŏUŬuŭȨḜȩḝẠẶạặ",
+	// dot above
+	0x0307: "CĊcċEĖeėGĠgġIİZŻzżAȦaȧOȮoȯBḂbḃDḊdḋFḞfḟHḢhḣMṀmṁNṄnṅPṖpṗRṘrṙSṠsṡŚṤ" +
+		"śṥŠṦšṧṢṨṣṩTṪtṫWẆwẇXẊxẋYẎyẏſẛ",
+	// diaeresis
+	0x0308: "AÄEËIÏOÖUÜaäeëiïoöuüyÿYŸHḦhḧÕṎõṏŪṺūṻWẄwẅXẌxẍtẗ",
+	// hook above
+	0x0309: "AẢaảÂẨâẩĂẲăẳEẺeẻÊỂêểIỈiỉOỎoỏÔỔôổƠỞơởUỦuủƯỬưửYỶyỷ",
+	// ring above
+	0x030A: "AÅaåUŮuůwẘyẙ",
+	// double acute accent
+	0x030B: "OŐoőUŰuű",
+	// caron
+	0x030C: "CČcčDĎdďEĚeěLĽlľNŇnňRŘrřSŠsšTŤtťZŽzžAǍaǎIǏiǐOǑoǒUǓuǔÜǙüǚGǦgǧKǨkǩ" +
+		"ƷǮʒǯjǰHȞhȟ",
+	// double grave accent
+	0x030F: "AȀaȁEȄeȅIȈiȉOȌoȍRȐrȑUȔuȕ",
+	// inverted breve
+	0x0311: "AȂaȃEȆeȇIȊiȋOȎoȏRȒrȓUȖuȗ",
+	// horn
+	0x031B: "OƠoơUƯuư",
+	// dot below
+	0x0323: "BḄbḅDḌdḍHḤhḥKḲkḳLḶlḷMṂmṃNṆnṇRṚrṛSṢsṣTṬtṭVṾvṿWẈwẉZẒzẓAẠaạEẸeẹIỊiị" +
+		"OỌoọƠỢơợUỤuụƯỰưựYỴyỵ",
+	// diaeresis below
+	0x0324: "UṲuṳ",
+	// ring below
+	0x0325: "AḀaḁ",
+	// comma below
+	0x0326: "SȘsșTȚtț",
+	// cedilla
+	0x0327: "CÇcçGĢgģKĶkķLĻlļNŅnņRŖrŗSŞsşTŢtţEȨeȩDḐdḑHḨhḩ",
+	// ogonek
+	0x0328: "AĄaąEĘeęIĮiįUŲuųOǪoǫ",
+	// circumflex accent below
+	0x032D: "DḒdḓEḘeḙLḼlḽNṊnṋTṰtṱUṶuṷ",
+	// breve below
+	0x032E: "HḪhḫ",
+	// tilde below
+	0x0330: "EḚeḛIḬiḭUṴuṵ",
+	// macron below
+	0x0331: "BḆbḇDḎdḏKḴkḵLḺlḻNṈnṉRṞrṟTṮtṯZẔzẕhẖ",
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// notificationRoutes maps tenants to the chat webhook receiving their job
+// notifications, parsed from NOTIFY_ROUTES entries of the form tenant=url
+var notificationRoutes = func() map[string]string {
+	routes := make(map[string]string)
+	for _, route := range cfg.NotifyRoutes {
+		tenant, webhook, ok := strings.Cut(route, "=")
+		if !ok || strings.TrimSpace(tenant) == "" || strings.TrimSpace(webhook) == "" {
+			log.Printf("Ignoring invalid NOTIFY_ROUTES entry %q, expected tenant=url", route)
+			continue
+		}
+		routes[strings.TrimSpace(tenant)] = strings.TrimSpace(webhook)
+	}
+	return routes
+}()
+
+// notificationWebhook returns the webhook for a tenant's notifications: the
+// channel in its settings or its own route if it has one, the default
+// webhook otherwise
+func notificationWebhook(tenant string, settings *TenantSettings) string {
+	if settings != nil && settings.NotificationChannel != "" {
+		return settings.NotificationChannel
+	}
+	if webhook, ok := notificationRoutes[tenant]; ok {
+		return webhook
+	}
+	return cfg.NotifyWebhookURL
+}
+
+// notifyJob posts a summary of a finished job to the tenant's chat webhook,
+// and the job itself to the tenant's webhook, in the background. Failed
+// deliveries are parked for retry.
+func notifyJob(job *Job) {
+	settings, err := tenantSettings(job.Tenant)
+	if err != nil {
+		log.Printf("Failed to get settings of tenant %s to notify job %s: %v", job.Tenant, job.ID, err)
+	}
+	if settings != nil && settings.WebhookURL != "" {
+		postJobWebhook(settings.WebhookURL, job)
+	}
+
+	webhook := notificationWebhook(job.Tenant, settings)
+	if webhook == "" {
+		return
+	}
+	payload, err := chatMessage(webhook, jobSummary(job))
+	if err != nil {
+		log.Printf("Failed to encode notification for job %s: %v", job.ID, err)
+		return
+	}
+	deliver(&Delivery{Sink: SinkNotification, URL: webhook, JobID: job.ID, Tenant: job.Tenant, Payload: payload})
+}
+
+// jobSummary describes the outcome of a finished job in a line or two
+func jobSummary(job *Job) string {
+	name := job.Filename
+	if name == "" {
+		name = job.ID
+	}
+	if job.Status == JobFailed {
+		return fmt.Sprintf("❌ %s (tenant %s, job %s) failed: %s", name, job.Tenant, job.ID, job.Error)
+	}
+
+	summary := fmt.Sprintf("✅ %s (tenant %s, job %s) completed: %d rows, %d failing validation",
+		name, job.Tenant, job.ID, job.ProcessedRows, job.FailedRows)
+	if len(job.Failures) > 0 {
+		checks := make([]string, 0, len(job.Failures))
+		for check := range job.Failures {
+			checks = append(checks, check)
+		}
+		sort.Slice(checks, func(i, j int) bool {
+			if job.Failures[checks[i]] != job.Failures[checks[j]] {
+				return job.Failures[checks[i]] > job.Failures[checks[j]]
+			}
+			return checks[i] < checks[j]
+		})
+		if len(checks) > topFailureCount {
+			checks = checks[:topFailureCount]
+		}
+		for i, check := range checks {
+			checks[i] = fmt.Sprintf("%s: %d", check, job.Failures[check])
+		}
+		summary += "\n" + strings.Join(checks, ", ")
+	}
+	return summary
+}
+
+// chatMessage encodes a plain-text message for a Slack or Microsoft Teams
+// incoming webhook. Teams webhooks are recognised by their host; anything
+// else receives Slack's payload format.
+func chatMessage(webhook, text string) ([]byte, error) {
+	var payload interface{} = map[string]string{"text": text}
+	if isTeamsWebhook(webhook) {
+		payload = map[string]string{
+			"@type":    "MessageCard",
+			"@context": "https://schema.org/extensions",
+			"summary":  strings.SplitN(text, "\n", 2)[0],
+			"text":     strings.ReplaceAll(text, "\n", "\n\n"),
+		}
+	}
+	return json.Marshal(payload)
+}
+
+// isTeamsWebhook reports whether the URL is a Microsoft Teams webhook
+func isTeamsWebhook(webhook string) bool {
+	u, err := url.Parse(webhook)
+	if err != nil {
+		return false
+	}
+	host := strings.ToLower(u.Hostname())
+	return strings.HasSuffix(host, ".office.com") || strings.HasSuffix(host, ".office365.com") ||
+		strings.HasSuffix(host, ".logic.azure.com")
+}
@@ -0,0 +1,924 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/big"
+	"mime/multipart"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// parquetMagic starts and ends every Parquet file
+const parquetMagic = "PAR1"
+
+// maxParquetFooter limits the size of the file metadata read into memory
+const maxParquetFooter = 64 << 20
+
+// maxParquetChunkValues limits the values of a column in one row group.
+// Runs of nulls take a few bytes however long they are, so the count in
+// the metadata is bounded rather than trusted.
+const maxParquetChunkValues = 1 << 24
+
+// maxParquetPage limits the size of a page once decompressed
+const maxParquetPage = maxParquetFooter * 16
+
+// maxDecimalScale limits the digits after the point of decimals read from
+// Parquet and Avro files, as PostgreSQL's numeric does
+const maxDecimalScale = 16383
+
+// Parquet physical types
+const (
+	parquetBoolean   = 0
+	parquetInt32     = 1
+	parquetInt64     = 2
+	parquetInt96     = 3
+	parquetFloat     = 4
+	parquetDouble    = 5
+	parquetByteArray = 6
+	parquetFixed     = 7
+)
+
+// Parquet page types, encodings and compression codecs
+const (
+	parquetDataPage       = 0
+	parquetDictionaryPage = 2
+	parquetDataPageV2     = 3
+
+	parquetPlain           = 0
+	parquetPlainDictionary = 2
+	parquetRLE             = 3
+	parquetRLEDictionary   = 8
+
+	parquetUncompressed = 0
+	parquetSnappy       = 1
+	parquetGzip         = 2
+)
+
+// parquetColumn is a leaf column of a flat Parquet schema
+type parquetColumn struct {
+	name      string
+	physical  int64
+	optional  bool
+	typeLen   int
+	converted int64
+	scale     int
+	logical   thriftStruct
+}
+
+// parquetChunk locates the data of a column within a row group
+type parquetChunk struct {
+	codec  int64
+	offset int64
+	size   int64
+	values int64
+}
+
+// parquetFile reads a Parquet file one row group at a time. It implements
+// RowSource: the column names come first, then every row with its cells
+// formatted as they would appear in a CSV export.
+type parquetFile struct {
+	r       io.ReaderAt
+	size    int64
+	columns []parquetColumn
+	groups  [][]parquetChunk
+
+	header bool
+	group  int
+	cells  [][]string
+	row    int
+}
+
+// checkParquetContent rejects uploads that do not start with the Parquet
+// magic bytes. The file is rewound to the beginning afterwards.
+func checkParquetContent(file multipart.File) error {
+	magic := make([]byte, len(parquetMagic))
+	n, err := io.ReadFull(file, magic)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return fmt.Errorf("failed to read upload: %v", err)
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("failed to rewind upload: %v", err)
+	}
+	if string(magic[:n]) != parquetMagic {
+		return fileErrorf(http.StatusUnsupportedMediaType,
+			"file content is not a Parquet file (detected %s)", http.DetectContentType(magic[:n]))
+	}
+	return nil
+}
+
+// openParquet reads the metadata of a Parquet file. Only flat schemas are
+// supported: every column must be a required or optional leaf.
+func openParquet(r io.ReaderAt, size int64) (*parquetFile, error) {
+	invalid := func(format string, args ...interface{}) error {
+		return fileErrorf(http.StatusUnprocessableEntity, "invalid Parquet file: "+format, args...)
+	}
+
+	tail := make([]byte, 8)
+	if size < 12 {
+		return nil, invalid("file is too short")
+	}
+	if _, err := r.ReadAt(tail, size-8); err != nil {
+		return nil, invalid("%v", err)
+	}
+	if string(tail[4:]) != parquetMagic {
+		return nil, invalid("missing footer")
+	}
+	footerLen := int64(binary.LittleEndian.Uint32(tail))
+	if footerLen > maxParquetFooter || footerLen > size-12 {
+		return nil, invalid("footer of %d bytes is out of range", footerLen)
+	}
+	footer := make([]byte, footerLen)
+	if _, err := r.ReadAt(footer, size-8-footerLen); err != nil {
+		return nil, invalid("%v", err)
+	}
+	meta, err := newThriftReader(footer).readStruct()
+	if err != nil {
+		return nil, invalid("unreadable metadata: %v", err)
+	}
+
+	pf := &parquetFile{r: r, size: size}
+	schema := meta.list(2)
+	if len(schema) < 2 {
+		return nil, invalid("schema has no columns")
+	}
+	for _, item := range schema[1:] {
+		element, _ := item.(thriftStruct)
+		if element.int(5) > 0 || element.int(3) == 2 {
+			return nil, fileErrorf(http.StatusUnprocessableEntity,
+				"Parquet column %q is nested or repeated; only flat schemas are supported", element.string(4))
+		}
+		column := parquetColumn{
+			name:      element.string(4),
+			physical:  element.int(1),
+			typeLen:   int(element.int(2)),
+			optional:  element.int(3) == 1,
+			converted: element.intOr(6, -1),
+			scale:     int(element.int(7)),
+			logical:   element.strct(10),
+		}
+		if scale := column.decimalScale(); column.isDecimal() && (scale < 0 || scale > maxDecimalScale) {
+			return nil, invalid("column %q has a decimal scale of %d", column.name, scale)
+		}
+		pf.columns = append(pf.columns, column)
+	}
+
+	for _, item := range meta.list(4) {
+		group, _ := item.(thriftStruct)
+		chunks := group.list(1)
+		if len(chunks) != len(pf.columns) {
+			return nil, invalid("row group has %d columns, schema has %d", len(chunks), len(pf.columns))
+		}
+		var columns []parquetChunk
+		for _, c := range chunks {
+			chunk, _ := c.(thriftStruct)
+			if chunk.string(1) != "" {
+				return nil, fileErrorf(http.StatusUnprocessableEntity, "Parquet files with external column chunks are not supported")
+			}
+			cm := chunk.strct(3)
+			offset := cm.int(9)
+			if dict := cm.int(11); dict > 0 && dict < offset {
+				offset = dict
+			}
+			columns = append(columns, parquetChunk{
+				codec:  cm.int(4),
+				offset: offset,
+				size:   cm.int(7),
+				values: cm.int(5),
+			})
+		}
+		pf.groups = append(pf.groups, columns)
+	}
+	return pf, nil
+}
+
+// Read returns the header, then the rows of each row group in turn
+func (pf *parquetFile) Read() ([]string, error) {
+	if !pf.header {
+		pf.header = true
+		names := make([]string, len(pf.columns))
+		for i, column := range pf.columns {
+			names[i] = column.name
+		}
+		return names, nil
+	}
+	for pf.cells == nil || pf.row >= len(pf.cells[0]) {
+		if pf.group >= len(pf.groups) {
+			return nil, io.EOF
+		}
+		cells, err := pf.readGroup(pf.groups[pf.group])
+		if err != nil {
+			return nil, err
+		}
+		pf.group++
+		pf.cells, pf.row = cells, 0
+		if len(pf.columns) == 0 {
+			return nil, io.EOF
+		}
+	}
+	row := make([]string, len(pf.cells))
+	for i := range pf.cells {
+		row[i] = pf.cells[i][pf.row]
+	}
+	pf.row++
+	return row, nil
+}
+
+// readGroup decodes every column of a row group into formatted cells
+func (pf *parquetFile) readGroup(chunks []parquetChunk) ([][]string, error) {
+	cells := make([][]string, len(chunks))
+	for i, chunk := range chunks {
+		values, err := pf.readChunk(pf.columns[i], chunk)
+		if err != nil {
+			return nil, fileErrorf(http.StatusUnprocessableEntity, "Parquet column %q: %v", pf.columns[i].name, err)
+		}
+		if i > 0 && len(values) != len(cells[0]) {
+			return nil, fileErrorf(http.StatusUnprocessableEntity,
+				"Parquet column %q has %d values, expected %d", pf.columns[i].name, len(values), len(cells[0]))
+		}
+		cells[i] = values
+	}
+	return cells, nil
+}
+
+// readChunk decodes the pages of a column chunk
+func (pf *parquetFile) readChunk(column parquetColumn, chunk parquetChunk) ([]string, error) {
+	if chunk.size <= 0 || chunk.offset < 0 || chunk.offset > pf.size || chunk.size > pf.size-chunk.offset {
+		return nil, fmt.Errorf("column chunk of %d bytes at %d is out of range", chunk.size, chunk.offset)
+	}
+	if chunk.values < 0 || chunk.values > maxParquetChunkValues {
+		return nil, fmt.Errorf("column chunk of %d values is out of range", chunk.values)
+	}
+	data := make([]byte, chunk.size)
+	if _, err := pf.r.ReadAt(data, chunk.offset); err != nil {
+		return nil, err
+	}
+
+	var dictionary []string
+	values := make([]string, 0, min(chunk.values, chunk.size))
+	tr := newThriftReader(data)
+	for int64(len(values)) < chunk.values {
+		header, err := tr.readStruct()
+		if err != nil {
+			return nil, fmt.Errorf("unreadable page header: %v", err)
+		}
+		size := header.int(3)
+		if size < 0 || size > int64(len(data)-tr.pos) {
+			return nil, fmt.Errorf("page exceeds column chunk")
+		}
+		page := data[tr.pos : tr.pos+int(size)]
+		tr.pos += int(size)
+		// Data pages may hold no more values than the chunk has left
+		remaining := int(chunk.values) - len(values)
+
+		switch header.int(1) {
+		case parquetDictionaryPage:
+			raw, err := decompressPage(chunk.codec, page, int(header.int(2)))
+			if err != nil {
+				return nil, err
+			}
+			count := int(header.strct(7).int(1))
+			if dictionary, _, err = decodePlain(column, raw, count); err != nil {
+				return nil, err
+			}
+
+		case parquetDataPage:
+			raw, err := decompressPage(chunk.codec, page, int(header.int(2)))
+			if err != nil {
+				return nil, err
+			}
+			dph := header.strct(5)
+			count := dph.int(1)
+			if count < 0 || count > int64(remaining) {
+				return nil, fmt.Errorf("data page of %d values is out of range", count)
+			}
+			var defined []bool
+			if column.optional {
+				if len(raw) < 4 {
+					return nil, fmt.Errorf("truncated definition levels")
+				}
+				n := int(binary.LittleEndian.Uint32(raw))
+				if 4+n > len(raw) {
+					return nil, fmt.Errorf("truncated definition levels")
+				}
+				if defined, err = decodeDefinitions(raw[4:4+n], int(count)); err != nil {
+					return nil, err
+				}
+				raw = raw[4+n:]
+			}
+			if values, err = appendPageValues(values, column, dph.int(2), raw, int(count), defined, dictionary); err != nil {
+				return nil, err
+			}
+
+		case parquetDataPageV2:
+			dph := header.strct(8)
+			count := dph.int(1)
+			if count < 0 || count > int64(remaining) {
+				return nil, fmt.Errorf("data page of %d values is out of range", count)
+			}
+			defLen, repLen := dph.int(5), dph.int(6)
+			if defLen < 0 || repLen < 0 || repLen > int64(len(page)) || defLen > int64(len(page))-repLen {
+				return nil, fmt.Errorf("truncated levels")
+			}
+			var defined []bool
+			if column.optional {
+				if defined, err = decodeDefinitions(page[repLen:repLen+defLen], int(count)); err != nil {
+					return nil, err
+				}
+			}
+			raw := page[repLen+defLen:]
+			if dph.boolOr(7, true) {
+				if raw, err = decompressPage(chunk.codec, raw, int(header.int(2)-repLen-defLen)); err != nil {
+					return nil, err
+				}
+			}
+			if values, err = appendPageValues(values, column, dph.int(4), raw, int(count), defined, dictionary); err != nil {
+				return nil, err
+			}
+
+		default:
+			// Index pages carry nothing to read
+		}
+	}
+	return values, nil
+}
+
+// appendPageValues decodes the values of a data page and appends them to
+// values, with empty cells where defined is false
+func appendPageValues(values []string, column parquetColumn, encoding int64, raw []byte, count int, defined []bool, dictionary []string) ([]string, error) {
+	present := count
+	if defined != nil {
+		present = 0
+		for _, d := range defined {
+			if d {
+				present++
+			}
+		}
+	}
+
+	var decoded []string
+	var err error
+	switch encoding {
+	case parquetPlain:
+		decoded, _, err = decodePlain(column, raw, present)
+	case parquetPlainDictionary, parquetRLEDictionary:
+		if dictionary == nil {
+			return nil, fmt.Errorf("dictionary page missing")
+		}
+		if len(raw) == 0 {
+			if present > 0 {
+				return nil, fmt.Errorf("truncated dictionary indices")
+			}
+			break
+		}
+		var indices []int
+		if indices, err = decodeHybrid(raw[1:], int(raw[0]), present); err != nil {
+			return nil, err
+		}
+		decoded = make([]string, present)
+		for i, index := range indices {
+			if index >= len(dictionary) {
+				return nil, fmt.Errorf("dictionary index %d out of range", index)
+			}
+			decoded[i] = dictionary[index]
+		}
+	default:
+		return nil, fmt.Errorf("unsupported encoding %d", encoding)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if defined == nil {
+		return append(values, decoded...), nil
+	}
+	next := 0
+	for _, d := range defined {
+		if d {
+			values = append(values, decoded[next])
+			next++
+		} else {
+			values = append(values, "")
+		}
+	}
+	return values, nil
+}
+
+// decodeDefinitions reads the definition levels of a flat optional column,
+// which are 1 for values and 0 for nulls
+func decodeDefinitions(data []byte, count int) ([]bool, error) {
+	levels, err := decodeHybrid(data, 1, count)
+	if err != nil {
+		return nil, err
+	}
+	defined := make([]bool, count)
+	for i, level := range levels {
+		defined[i] = level == 1
+	}
+	return defined, nil
+}
+
+// decodeHybrid reads count values of the RLE / bit-packing hybrid encoding
+func decodeHybrid(data []byte, bitWidth, count int) ([]int, error) {
+	if bitWidth < 0 || bitWidth > 32 {
+		return nil, fmt.Errorf("invalid bit width %d", bitWidth)
+	}
+	if count < 0 {
+		return nil, fmt.Errorf("invalid value count %d", count)
+	}
+	values := make([]int, 0, min(count, len(data)*8))
+	pos := 0
+	for len(values) < count {
+		header, n := binary.Uvarint(data[pos:])
+		if n <= 0 {
+			return nil, fmt.Errorf("truncated run header")
+		}
+		pos += n
+		if header&1 == 0 {
+			// Run of a single repeated value
+			width := (bitWidth + 7) / 8
+			if pos+width > len(data) {
+				return nil, fmt.Errorf("truncated run")
+			}
+			value := 0
+			for i := 0; i < width; i++ {
+				value |= int(data[pos+i]) << (8 * i)
+			}
+			pos += width
+			for run := int(header >> 1); run > 0 && len(values) < count; run-- {
+				values = append(values, value)
+			}
+			continue
+		}
+		// Groups of eight bit-packed values, least significant bit first
+		groups := header >> 1
+		if groups*uint64(bitWidth) > uint64(len(data)-pos) || groups > uint64(len(data)) {
+			return nil, fmt.Errorf("truncated bit-packed run")
+		}
+		end := pos + int(groups)*bitWidth
+		for i := 0; i < int(groups)*8 && len(values) < count; i++ {
+			value := 0
+			for b := 0; b < bitWidth; b++ {
+				bit := i*bitWidth + b
+				if data[pos+bit/8]&(1<<(bit%8)) != 0 {
+					value |= 1 << b
+				}
+			}
+			values = append(values, value)
+		}
+		pos = end
+	}
+	return values, nil
+}
+
+// decodePlain reads count plain-encoded values as formatted cells and
+// returns them with the number of bytes consumed
+func decodePlain(column parquetColumn, data []byte, count int) ([]string, int, error) {
+	// Every value takes at least a bit
+	if count < 0 || count > len(data)*8 {
+		return nil, 0, fmt.Errorf("%d values do not fit in %d bytes", count, len(data))
+	}
+	values := make([]string, count)
+	pos := 0
+	need := func(n int) error {
+		if n < 0 || pos+n > len(data) {
+			return fmt.Errorf("truncated values")
+		}
+		return nil
+	}
+	for i := 0; i < count; i++ {
+		switch column.physical {
+		case parquetBoolean:
+			if err := need((i+8)/8 - pos); err != nil {
+				return nil, 0, err
+			}
+			values[i] = strconv.FormatBool(data[i/8]&(1<<(i%8)) != 0)
+			if i == count-1 {
+				pos = (count + 7) / 8
+			}
+		case parquetInt32:
+			if err := need(4); err != nil {
+				return nil, 0, err
+			}
+			values[i] = column.formatInt(int64(int32(binary.LittleEndian.Uint32(data[pos:]))))
+			pos += 4
+		case parquetInt64:
+			if err := need(8); err != nil {
+				return nil, 0, err
+			}
+			values[i] = column.formatInt(int64(binary.LittleEndian.Uint64(data[pos:])))
+			pos += 8
+		case parquetInt96:
+			if err := need(12); err != nil {
+				return nil, 0, err
+			}
+			nanos := int64(binary.LittleEndian.Uint64(data[pos:]))
+			julianDay := int64(binary.LittleEndian.Uint32(data[pos+8:]))
+			values[i] = time.Unix((julianDay-2440588)*86400, nanos).UTC().Format(time.RFC3339Nano)
+			pos += 12
+		case parquetFloat:
+			if err := need(4); err != nil {
+				return nil, 0, err
+			}
+			values[i] = strconv.FormatFloat(float64(math.Float32frombits(binary.LittleEndian.Uint32(data[pos:]))), 'f', -1, 32)
+			pos += 4
+		case parquetDouble:
+			if err := need(8); err != nil {
+				return nil, 0, err
+			}
+			values[i] = strconv.FormatFloat(math.Float64frombits(binary.LittleEndian.Uint64(data[pos:])), 'f', -1, 64)
+			pos += 8
+		case parquetByteArray:
+			if err := need(4); err != nil {
+				return nil, 0, err
+			}
+			n := int(binary.LittleEndian.Uint32(data[pos:]))
+			pos += 4
+			if err := need(n); err != nil {
+				return nil, 0, err
+			}
+			values[i] = column.formatBytes(data[pos : pos+n])
+			pos += n
+		case parquetFixed:
+			if err := need(column.typeLen); err != nil {
+				return nil, 0, err
+			}
+			values[i] = column.formatBytes(data[pos : pos+column.typeLen])
+			pos += column.typeLen
+		default:
+			return nil, 0, fmt.Errorf("unsupported type %d", column.physical)
+		}
+	}
+	return values, pos, nil
+}
+
+// isDecimal reports whether the column holds decimals, by its logical or
+// converted type
+func (c parquetColumn) isDecimal() bool {
+	return c.logical.has(5) || c.converted == 5
+}
+
+// formatInt formats an integer cell, applying dates, timestamps and
+// decimal scales
+func (c parquetColumn) formatInt(v int64) string {
+	switch {
+	case c.logical.has(6) || c.converted == 6:
+		return time.Unix(v*86400, 0).UTC().Format("2006-01-02")
+	case c.isDecimal():
+		return formatDecimal(big.NewInt(v), c.decimalScale())
+	case c.logical.has(8):
+		switch unit := c.logical.strct(8).strct(2); {
+		case unit.has(1):
+			return time.UnixMilli(v).UTC().Format(time.RFC3339Nano)
+		case unit.has(2):
+			return time.UnixMicro(v).UTC().Format(time.RFC3339Nano)
+		default:
+			return time.Unix(0, v).UTC().Format(time.RFC3339Nano)
+		}
+	case c.converted == 9:
+		return time.UnixMilli(v).UTC().Format(time.RFC3339Nano)
+	case c.converted == 10:
+		return time.UnixMicro(v).UTC().Format(time.RFC3339Nano)
+	}
+	return strconv.FormatInt(v, 10)
+}
+
+// formatBytes formats a byte array cell: decimals as numbers, anything
+// else as text
+func (c parquetColumn) formatBytes(b []byte) string {
+	if c.isDecimal() && len(b) > 0 {
+		v := new(big.Int).SetBytes(b)
+		if b[0]&0x80 != 0 {
+			v.Sub(v, new(big.Int).Lsh(big.NewInt(1), uint(8*len(b))))
+		}
+		return formatDecimal(v, c.decimalScale())
+	}
+	return string(b)
+}
+
+// decimalScale returns the scale of a decimal column
+func (c parquetColumn) decimalScale() int {
+	if c.logical.has(5) {
+		return int(c.logical.strct(5).int(1))
+	}
+	return c.scale
+}
+
+// formatDecimal writes an unscaled decimal with scale digits after the point
+func formatDecimal(v *big.Int, scale int) string {
+	if scale <= 0 {
+		return v.String()
+	}
+	digits := new(big.Int).Abs(v).String()
+	if len(digits) <= scale {
+		digits = strings.Repeat("0", scale-len(digits)+1) + digits
+	}
+	sign := ""
+	if v.Sign() < 0 {
+		sign = "-"
+	}
+	return sign + digits[:len(digits)-scale] + "." + digits[len(digits)-scale:]
+}
+
+// decompressPage decompresses a page with the chunk's codec
+func decompressPage(codec int64, data []byte, size int) ([]byte, error) {
+	switch codec {
+	case parquetUncompressed:
+		return data, nil
+	case parquetSnappy:
+		return decodeSnappy(data)
+	case parquetGzip:
+		zr, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		if size < 0 || size > maxParquetPage {
+			return nil, fmt.Errorf("page of %d bytes is out of range", size)
+		}
+		// The buffer grows with the data rather than the size claimed
+		var buf bytes.Buffer
+		if _, err := io.Copy(&buf, io.LimitReader(zr, int64(size)+1)); err != nil {
+			return nil, err
+		}
+		if buf.Len() != size {
+			return nil, fmt.Errorf("page decompressed to %d bytes, expected %d", buf.Len(), size)
+		}
+		return buf.Bytes(), nil
+	}
+	return nil, fmt.Errorf("unsupported compression codec %d; use uncompressed, Snappy or gzip", codec)
+}
+
+// decodeSnappy decompresses a Snappy block
+func decodeSnappy(src []byte) ([]byte, error) {
+	errCorrupt := errors.New("corrupt Snappy data")
+	length, n := binary.Uvarint(src)
+	// No tag expands to more than 22 times its size
+	if n <= 0 || length > maxParquetPage || length > uint64(len(src))*22 {
+		return nil, errCorrupt
+	}
+	dst := make([]byte, 0, length)
+	for pos := n; pos < len(src); {
+		tag := src[pos]
+		pos++
+		var size, offset int
+		switch tag & 3 {
+		case 0:
+			size = int(tag >> 2)
+			if size >= 60 {
+				extra := size - 59
+				if pos+extra > len(src) {
+					return nil, errCorrupt
+				}
+				size = 0
+				for i := 0; i < extra; i++ {
+					size |= int(src[pos+i]) << (8 * i)
+				}
+				pos += extra
+			}
+			size++
+			if size <= 0 || pos+size > len(src) {
+				return nil, errCorrupt
+			}
+			dst = append(dst, src[pos:pos+size]...)
+			pos += size
+			continue
+		case 1:
+			if pos >= len(src) {
+				return nil, errCorrupt
+			}
+			size = 4 + int(tag>>2)&7
+			offset = int(tag&0xe0)<<3 | int(src[pos])
+			pos++
+		case 2:
+			if pos+2 > len(src) {
+				return nil, errCorrupt
+			}
+			size = 1 + int(tag>>2)
+			offset = int(binary.LittleEndian.Uint16(src[pos:]))
+			pos += 2
+		case 3:
+			if pos+4 > len(src) {
+				return nil, errCorrupt
+			}
+			size = 1 + int(tag>>2)
+			offset = int(binary.LittleEndian.Uint32(src[pos:]))
+			pos += 4
+		}
+		if offset <= 0 || offset > len(dst) {
+			return nil, errCorrupt
+		}
+		// Copies may overlap their own output
+		start := len(dst) - offset
+		for i := 0; i < size; i++ {
+			dst = append(dst, dst[start+i])
+		}
+	}
+	if uint64(len(dst)) != length {
+		return nil, errCorrupt
+	}
+	return dst, nil
+}
+
+// thriftStruct is a decoded Thrift struct: field values by field ID. Values
+// are int64, bool, float64, []byte, []interface{} or thriftStruct.
+type thriftStruct map[int16]interface{}
+
+func (s thriftStruct) has(id int16) bool {
+	_, ok := s[id]
+	return ok
+}
+
+func (s thriftStruct) int(id int16) int64 {
+	return s.intOr(id, 0)
+}
+
+func (s thriftStruct) intOr(id int16, def int64) int64 {
+	if v, ok := s[id].(int64); ok {
+		return v
+	}
+	return def
+}
+
+func (s thriftStruct) boolOr(id int16, def bool) bool {
+	if v, ok := s[id].(bool); ok {
+		return v
+	}
+	return def
+}
+
+func (s thriftStruct) string(id int16) string {
+	v, _ := s[id].([]byte)
+	return string(v)
+}
+
+func (s thriftStruct) list(id int16) []interface{} {
+	v, _ := s[id].([]interface{})
+	return v
+}
+
+func (s thriftStruct) strct(id int16) thriftStruct {
+	v, _ := s[id].(thriftStruct)
+	return v
+}
+
+// thriftReader decodes the Thrift compact protocol Parquet metadata is
+// written in, keeping every field so no generated code is needed
+type thriftReader struct {
+	data  []byte
+	pos   int
+	depth int
+}
+
+func newThriftReader(data []byte) *thriftReader {
+	return &thriftReader{data: data}
+}
+
+var errThriftTruncated = errors.New("truncated metadata")
+
+func (t *thriftReader) byte() (byte, error) {
+	if t.pos >= len(t.data) {
+		return 0, errThriftTruncated
+	}
+	b := t.data[t.pos]
+	t.pos++
+	return b, nil
+}
+
+func (t *thriftReader) uvarint() (uint64, error) {
+	v, n := binary.Uvarint(t.data[t.pos:])
+	if n <= 0 {
+		return 0, errThriftTruncated
+	}
+	t.pos += n
+	return v, nil
+}
+
+func (t *thriftReader) varint() (int64, error) {
+	v, err := t.uvarint()
+	return int64(v>>1) ^ -int64(v&1), err
+}
+
+// readStruct reads fields up to the stop field
+func (t *thriftReader) readStruct() (thriftStruct, error) {
+	if t.depth++; t.depth > 32 {
+		return nil, errors.New("metadata nested too deeply")
+	}
+	defer func() { t.depth-- }()
+
+	s := make(thriftStruct)
+	var id int16
+	for {
+		header, err := t.byte()
+		if err != nil {
+			return nil, err
+		}
+		kind := header & 0x0f
+		if kind == 0 {
+			return s, nil
+		}
+		if delta := header >> 4; delta != 0 {
+			id += int16(delta)
+		} else {
+			v, err := t.varint()
+			if err != nil {
+				return nil, err
+			}
+			id = int16(v)
+		}
+		switch kind {
+		case 1:
+			s[id] = true
+		case 2:
+			s[id] = false
+		default:
+			if s[id], err = t.readValue(kind); err != nil {
+				return nil, err
+			}
+		}
+	}
+}
+
+// readValue reads a value of the given compact type
+func (t *thriftReader) readValue(kind byte) (interface{}, error) {
+	switch kind {
+	case 1, 2:
+		b, err := t.byte()
+		return b == 1, err
+	case 3:
+		b, err := t.byte()
+		return int64(int8(b)), err
+	case 4, 5, 6:
+		return t.varint()
+	case 7:
+		if t.pos+8 > len(t.data) {
+			return nil, errThriftTruncated
+		}
+		v := math.Float64frombits(binary.LittleEndian.Uint64(t.data[t.pos:]))
+		t.pos += 8
+		return v, nil
+	case 8:
+		n, err := t.uvarint()
+		if err != nil {
+			return nil, err
+		}
+		if n > uint64(len(t.data)-t.pos) {
+			return nil, errThriftTruncated
+		}
+		b := t.data[t.pos : t.pos+int(n)]
+		t.pos += int(n)
+		return b, nil
+	case 9, 10:
+		header, err := t.byte()
+		if err != nil {
+			return nil, err
+		}
+		size := uint64(header >> 4)
+		if size == 15 {
+			if size, err = t.uvarint(); err != nil {
+				return nil, err
+			}
+		}
+		if size > uint64(len(t.data)-t.pos) {
+			return nil, errThriftTruncated
+		}
+		items := make([]interface{}, size)
+		for i := range items {
+			if items[i], err = t.readValue(header & 0x0f); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	case 11:
+		size, err := t.uvarint()
+		if err != nil || size == 0 {
+			return nil, err
+		}
+		if size > uint64(len(t.data)-t.pos) {
+			return nil, errThriftTruncated
+		}
+		types, err := t.byte()
+		if err != nil {
+			return nil, err
+		}
+		for i := uint64(0); i < 2*size; i++ {
+			kind := types >> 4
+			if i%2 == 1 {
+				kind = types & 0x0f
+			}
+			if _, err := t.readValue(kind); err != nil {
+				return nil, err
+			}
+		}
+		return nil, nil
+	case 12:
+		return t.readStruct()
+	}
+	return nil, fmt.Errorf("unknown field type %d", kind)
+}
@@ -0,0 +1,438 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"io"
+	"os"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// readParquet opens a Parquet file and reads its header and rows
+func readParquet(data []byte) ([][]string, error) {
+	pf, err := openParquet(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, err
+	}
+	var rows [][]string
+	for {
+		row, err := pf.Read()
+		if err == io.EOF {
+			return rows, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		rows = append(rows, row)
+	}
+}
+
+func TestParquetFixture(t *testing.T) {
+	data, err := os.ReadFile("testdata/releases.parquet")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows, err := readParquet(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := [][]string{
+		{"Release ID", "Track Title", "Release Date", "Royalty Artist %"},
+		{"REL001", "Song Title 1", "2023-01-15", "70"},
+		{"REL001", "Pájaro ☂", "", "62.5"},
+		{"REL002", "", "1969-12-31", ""},
+	}
+	if !reflect.DeepEqual(rows, want) {
+		t.Errorf("rows = %q, want %q", rows, want)
+	}
+}
+
+// TestParquetCorrupt reads every truncation of the fixture and every
+// corruption of each of its bytes: they may fail but not panic, nor
+// allocate far beyond the size of the file
+func TestParquetCorrupt(t *testing.T) {
+	data, err := os.ReadFile("testdata/releases.parquet")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for n := range data {
+		if _, err := readParquet(data[:n]); err == nil {
+			t.Errorf("file truncated to %d bytes was read", n)
+		}
+	}
+
+	var before, after runtime.MemStats
+	corrupt := make([]byte, len(data))
+	for i := range data {
+		for _, flip := range []byte{0x01, 0x80, 0xff} {
+			copy(corrupt, data)
+			corrupt[i] ^= flip
+			runtime.ReadMemStats(&before)
+			readParquet(corrupt)
+			runtime.ReadMemStats(&after)
+			if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 16<<20 {
+				t.Errorf("byte %d ^ %#x: allocated %d bytes", i, flip, allocated)
+			}
+		}
+	}
+}
+
+// parquetTestChunk is the single column chunk of a test file: an optional
+// column of the given physical type, a decimal if decimal is set, and its
+// pages
+type parquetTestChunk struct {
+	physical int64
+	decimal  bool
+	scale    int64
+	codec    int64
+	values   int64
+	size     int64 // the size of the pages when zero
+	pages    [][]byte
+}
+
+// file writes the chunk as a Parquet file of one row group
+func (c parquetTestChunk) file() []byte {
+	file := []byte(parquetMagic)
+	for _, page := range c.pages {
+		file = append(file, page...)
+	}
+	size := c.size
+	if size == 0 {
+		size = int64(len(file) - len(parquetMagic))
+	}
+
+	var meta thriftWriter
+	meta.i32(1, 1)
+	meta.structList(2, 2, func(i int) {
+		if i == 0 {
+			meta.binary(4, "schema")
+			meta.i32(5, 1)
+			return
+		}
+		meta.i32(1, c.physical)
+		meta.i32(3, 1)
+		meta.binary(4, "Track Title")
+		if c.decimal {
+			meta.i32(6, 5)
+			meta.i32(7, c.scale)
+		}
+	})
+	meta.i64(3, c.values)
+	meta.structList(4, 1, func(int) {
+		meta.structList(1, 1, func(int) {
+			meta.i64(2, int64(len(parquetMagic)))
+			meta.strct(3, func() {
+				meta.i32(1, c.physical)
+				meta.i32(4, c.codec)
+				meta.i64(5, c.values)
+				meta.i64(7, size)
+				meta.i64(9, int64(len(parquetMagic)))
+			})
+		})
+		meta.i64(2, size)
+		meta.i64(3, c.values)
+	})
+	meta.stop()
+
+	file = append(file, meta.buf...)
+	file = binary.LittleEndian.AppendUint32(file, uint32(len(meta.buf)))
+	return append(file, parquetMagic...)
+}
+
+// parquetTestPage writes a page: its header, whose type-specific fields
+// fields writes, then its data
+func parquetTestPage(kind int64, size int, data []byte, fields func(h *thriftWriter)) []byte {
+	var header thriftWriter
+	header.i32(1, kind)
+	header.i32(2, int64(size))
+	header.i32(3, int64(len(data)))
+	fields(&header)
+	header.stop()
+	return append(header.buf, data...)
+}
+
+// parquetTestDataPage writes a version 1 data page of count values
+func parquetTestDataPage(count, encoding int64, raw []byte) []byte {
+	return parquetTestPage(parquetDataPage, len(raw), raw, func(h *thriftWriter) {
+		h.strct(5, func() {
+			h.i32(1, count)
+			h.i32(2, encoding)
+		})
+	})
+}
+
+// parquetTestLevels prefixes values with the definition levels of a
+// version 1 data page
+func parquetTestLevels(defined []bool, values []byte) []byte {
+	levels := encodeDefinitions(defined)
+	raw := binary.LittleEndian.AppendUint32(nil, uint32(len(levels)))
+	return append(append(raw, levels...), values...)
+}
+
+// parquetTestStrings plain-encodes byte arrays
+func parquetTestStrings(values ...string) []byte {
+	var out []byte
+	for _, v := range values {
+		out = binary.LittleEndian.AppendUint32(out, uint32(len(v)))
+		out = append(out, v...)
+	}
+	return out
+}
+
+func TestParquetPages(t *testing.T) {
+	all := []bool{true, true, true}
+	dictionary := parquetTestPage(parquetDictionaryPage, 10, parquetTestStrings("x", "y"), func(h *thriftWriter) {
+		h.strct(7, func() {
+			h.i32(1, 2)
+			h.i32(2, parquetPlain)
+		})
+	})
+	// 16 bytes of two plain values: a literal of the first, then a copy
+	// of it at offset 8
+	snappy := append([]byte{16, 7 << 2}, parquetTestStrings("abcd")...)
+	snappy = append(snappy, 1|4<<2, 8)
+	var gzipped bytes.Buffer
+	zw := gzip.NewWriter(&gzipped)
+	zw.Write(parquetTestLevels(all, parquetTestStrings("a", "b", "c")))
+	zw.Close()
+	v2 := func(count, defLen, repLen int64, size int, data []byte) []byte {
+		return parquetTestPage(parquetDataPageV2, size, data, func(h *thriftWriter) {
+			h.strct(8, func() {
+				h.i32(1, count)
+				h.i32(3, count)
+				h.i32(4, parquetPlain)
+				h.i32(5, defLen)
+				h.i32(6, repLen)
+			})
+		})
+	}
+	levels := encodeDefinitions([]bool{true, true})
+
+	tests := []struct {
+		name  string
+		chunk parquetTestChunk
+		want  []string
+		err   string
+	}{
+		{
+			name: "plain with nulls",
+			chunk: parquetTestChunk{physical: parquetByteArray, values: 3, pages: [][]byte{
+				parquetTestDataPage(3, parquetPlain, parquetTestLevels([]bool{true, false, true}, parquetTestStrings("a", "b"))),
+			}},
+			want: []string{"a", "", "b"},
+		},
+		{
+			name: "pages split a chunk",
+			chunk: parquetTestChunk{physical: parquetInt32, values: 3, pages: [][]byte{
+				parquetTestDataPage(1, parquetPlain, parquetTestLevels([]bool{true}, []byte{0xff, 0xff, 0xff, 0xff})),
+				parquetTestDataPage(2, parquetPlain, parquetTestLevels([]bool{false, true}, []byte{0xff, 0xff, 0xff, 0x7f})),
+			}},
+			want: []string{"-1", "", "2147483647"},
+		},
+		{
+			name: "booleans",
+			chunk: parquetTestChunk{physical: parquetBoolean, values: 3, pages: [][]byte{
+				parquetTestDataPage(3, parquetPlain, parquetTestLevels(all, []byte{0b101})),
+			}},
+			want: []string{"true", "false", "true"},
+		},
+		{
+			name: "dictionary",
+			chunk: parquetTestChunk{physical: parquetByteArray, values: 3, pages: [][]byte{
+				dictionary,
+				// Bit width 1, then one group of bit-packed indices
+				parquetTestDataPage(3, parquetRLEDictionary, parquetTestLevels(all, []byte{1, 3, 0b101})),
+			}},
+			want: []string{"y", "x", "y"},
+		},
+		{
+			name: "gzip",
+			chunk: parquetTestChunk{physical: parquetByteArray, codec: parquetGzip, values: 3, pages: [][]byte{
+				parquetTestPage(parquetDataPage, 4+len(encodeDefinitions(all))+15, gzipped.Bytes(), func(h *thriftWriter) {
+					h.strct(5, func() { h.i32(1, 3) })
+				}),
+			}},
+			want: []string{"a", "b", "c"},
+		},
+		{
+			name: "version 2 snappy",
+			chunk: parquetTestChunk{physical: parquetByteArray, codec: parquetSnappy, values: 2, pages: [][]byte{
+				v2(2, int64(len(levels)), 0, len(levels)+16, append(append([]byte(nil), levels...), snappy...)),
+			}},
+			want: []string{"abcd", "abcd"},
+		},
+		{
+			name: "decimals",
+			chunk: parquetTestChunk{physical: parquetInt32, decimal: true, scale: 2, values: 3, pages: [][]byte{
+				parquetTestDataPage(3, parquetPlain, parquetTestLevels(all, binary.LittleEndian.AppendUint32(
+					binary.LittleEndian.AppendUint32(binary.LittleEndian.AppendUint32(nil, 12345), 7), 0xfffffff9))),
+			}},
+			want: []string{"123.45", "0.07", "-0.07"},
+		},
+		{
+			name: "byte array decimals",
+			chunk: parquetTestChunk{physical: parquetByteArray, decimal: true, scale: 4, values: 2, pages: [][]byte{
+				parquetTestDataPage(2, parquetPlain, parquetTestLevels([]bool{true, true}, parquetTestStrings("\xff\x85", "\x01\x00\x00"))),
+			}},
+			want: []string{"-0.0123", "6.5536"},
+		},
+		{
+			name:  "decimal scale out of range",
+			chunk: parquetTestChunk{physical: parquetInt32, decimal: true, scale: 1 << 30, values: 0, pages: [][]byte{parquetTestDataPage(0, parquetPlain, parquetTestLevels(nil, nil))}},
+			err:   `column "Track Title" has a decimal scale of 1073741824`,
+		},
+		{
+			name:  "negative values",
+			chunk: parquetTestChunk{physical: parquetByteArray, values: -1, pages: [][]byte{parquetTestDataPage(0, parquetPlain, parquetTestLevels(nil, nil))}},
+			err:   "column chunk of -1 values is out of range",
+		},
+		{
+			name:  "too many values",
+			chunk: parquetTestChunk{physical: parquetByteArray, values: 1 << 40, pages: [][]byte{parquetTestDataPage(0, parquetPlain, parquetTestLevels(nil, nil))}},
+			err:   "values is out of range",
+		},
+		{
+			name: "chunk beyond the file",
+			chunk: parquetTestChunk{physical: parquetByteArray, values: 1, size: 1 << 30, pages: [][]byte{
+				parquetTestDataPage(1, parquetPlain, parquetTestLevels([]bool{true}, parquetTestStrings("a"))),
+			}},
+			err: "column chunk of 1073741824 bytes at 4 is out of range",
+		},
+		{
+			name: "page of negative values",
+			chunk: parquetTestChunk{physical: parquetByteArray, values: 1, pages: [][]byte{
+				parquetTestDataPage(-1, parquetPlain, parquetTestLevels([]bool{true}, parquetTestStrings("a"))),
+			}},
+			err: "data page of -1 values is out of range",
+		},
+		{
+			name: "page of more values than the chunk",
+			chunk: parquetTestChunk{physical: parquetByteArray, values: 1, pages: [][]byte{
+				parquetTestDataPage(2, parquetPlain, parquetTestLevels([]bool{true, true}, parquetTestStrings("a", "b"))),
+			}},
+			err: "data page of 2 values is out of range",
+		},
+		{
+			name: "values missing",
+			chunk: parquetTestChunk{physical: parquetByteArray, values: 2, pages: [][]byte{
+				parquetTestDataPage(2, parquetPlain, parquetTestLevels([]bool{true, true}, parquetTestStrings("a")[:3])),
+			}},
+			err: "truncated values",
+		},
+		{
+			name: "dictionary larger than its page",
+			chunk: parquetTestChunk{physical: parquetByteArray, values: 1, pages: [][]byte{
+				parquetTestPage(parquetDictionaryPage, 5, parquetTestStrings("x"), func(h *thriftWriter) {
+					h.strct(7, func() { h.i32(1, 1<<30) })
+				}),
+			}},
+			err: "1073741824 values do not fit in 5 bytes",
+		},
+		{
+			name: "dictionary index out of range",
+			chunk: parquetTestChunk{physical: parquetByteArray, values: 3, pages: [][]byte{
+				dictionary,
+				parquetTestDataPage(3, parquetRLEDictionary, parquetTestLevels(all, []byte{2, 3, 0b10, 0})),
+			}},
+			err: "dictionary index 2 out of range",
+		},
+		{
+			name: "bit-packed run longer than the page",
+			chunk: parquetTestChunk{physical: parquetByteArray, values: 1, pages: [][]byte{
+				dictionary,
+				// 2^59 groups of 32 bits overflow a count of bytes
+				parquetTestDataPage(1, parquetRLEDictionary, parquetTestLevels([]bool{true},
+					append([]byte{32}, binary.AppendUvarint(nil, 1<<60|1)...))),
+			}},
+			err: "truncated bit-packed run",
+		},
+		{
+			name: "levels longer than the page",
+			chunk: parquetTestChunk{physical: parquetByteArray, values: 2, pages: [][]byte{
+				v2(2, 1<<62, 1<<62, 16, snappy),
+			}},
+			err: "truncated levels",
+		},
+		{
+			name: "snappy length beyond its data",
+			chunk: parquetTestChunk{physical: parquetByteArray, codec: parquetSnappy, values: 2, pages: [][]byte{
+				v2(2, int64(len(levels)), 0, 1<<29, append(append([]byte(nil), levels...), binary.AppendUvarint(nil, 1<<29)...)),
+			}},
+			err: "corrupt Snappy data",
+		},
+		{
+			name: "gzip size misstated",
+			chunk: parquetTestChunk{physical: parquetByteArray, codec: parquetGzip, values: 3, pages: [][]byte{
+				parquetTestPage(parquetDataPage, 1<<30, gzipped.Bytes(), func(h *thriftWriter) {
+					h.strct(5, func() { h.i32(1, 3) })
+				}),
+			}},
+			err: "expected 1073741824",
+		},
+		{
+			name: "gzip size negative",
+			chunk: parquetTestChunk{physical: parquetByteArray, codec: parquetGzip, values: 3, pages: [][]byte{
+				parquetTestPage(parquetDataPage, -1, gzipped.Bytes(), func(h *thriftWriter) {
+					h.strct(5, func() { h.i32(1, 3) })
+				}),
+			}},
+			err: "page of -1 bytes is out of range",
+		},
+	}
+	for _, test := range tests {
+		rows, err := readParquet(test.chunk.file())
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%s: error %v, want one containing %q", test.name, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		var got []string
+		for _, row := range rows[1:] {
+			got = append(got, row[0])
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s = %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestDecodeSnappy(t *testing.T) {
+	tests := []struct {
+		name string
+		src  []byte
+		want string
+		ok   bool
+	}{
+		{"literal", []byte{3, 2 << 2, 'a', 'b', 'c'}, "abc", true},
+		{"overlapping copy", []byte{6, 0, 'a', 1 | 1<<2, 1}, "aaaaaa", true},
+		{"copy with a 2-byte offset", []byte{5, 0, 'a', 2 | 3<<2, 1, 0}, "aaaaa", true},
+		{"empty", []byte{0}, "", true},
+		{"length too long", []byte{4, 0, 'a'}, "", false},
+		{"literal past the end", []byte{3, 2 << 2, 'a'}, "", false},
+		{"offset before the start", []byte{5, 0, 'a', 1, 2}, "", false},
+		{"offset of zero", []byte{5, 0, 'a', 1, 0}, "", false},
+		{"length beyond any expansion", []byte{0xff, 0xff, 0xff, 0x03, 0}, "", false},
+		{"no length", nil, "", false},
+	}
+	for _, test := range tests {
+		got, err := decodeSnappy(test.src)
+		if !test.ok {
+			if err == nil {
+				t.Errorf("%s: decoded %q, want an error", test.name, got)
+			}
+			continue
+		}
+		if err != nil || string(got) != test.want {
+			t.Errorf("%s = %q, %v, want %q", test.name, got, err, test.want)
+		}
+	}
+}
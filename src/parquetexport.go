@@ -0,0 +1,307 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"math"
+	"time"
+)
+
+// parquetContentType is the media type of Parquet files
+const parquetContentType = "application/vnd.apache.parquet"
+
+// parquetRowGroupRows is the number of rows written per row group
+const parquetRowGroupRows = 64 << 10
+
+// Parquet converted types written for typed columns
+const (
+	parquetUTF8 = 0
+	parquetDate = 6
+)
+
+// parquetColumnTypes are the physical types of columns exported as other
+// than text
+var parquetColumnTypes = map[string]int64{
+	"Release Date":          parquetInt32,
+	"Royalty Artist %":      parquetDouble,
+	"Royalty Label %":       parquetDouble,
+	"Royalty Distributor %": parquetDouble,
+	"Royalty Publisher %":   parquetDouble,
+}
+
+// parquetType returns the physical type a column is exported as
+func parquetType(column string) int64 {
+	if physical, ok := parquetColumnTypes[column]; ok {
+		return physical
+	}
+	return parquetByteArray
+}
+
+// writeConversionParquet writes the converted rows as a Parquet file for
+// loading into Spark and similar tools. Release dates are DATE columns and
+// royalty shares DOUBLE; other columns are UTF-8 text. Every column is
+// optional: empty cells, and typed cells whose value does not parse, are
+// null. Pages are PLAIN-encoded and gzip-compressed.
+func writeConversionParquet(conversion Conversion) ([]byte, error) {
+	columns := exportColumns(conversion)
+	rows := conversion.Rows
+
+	file := []byte(parquetMagic)
+	type chunkMeta struct {
+		offset, values, compressed, uncompressed int64
+	}
+	var groups [][]chunkMeta
+	for start := 0; start < len(rows); start += parquetRowGroupRows {
+		group := rows[start:min(start+parquetRowGroupRows, len(rows))]
+		var chunks []chunkMeta
+		for _, column := range columns {
+			page, err := encodeParquetPage(parquetType(column), column, group)
+			if err != nil {
+				return nil, err
+			}
+			offset := int64(len(file))
+			file = append(file, page.header...)
+			file = append(file, page.data...)
+			chunks = append(chunks, chunkMeta{
+				offset:       offset,
+				values:       int64(len(group)),
+				compressed:   int64(len(page.header) + len(page.data)),
+				uncompressed: int64(len(page.header) + page.size),
+			})
+		}
+		groups = append(groups, chunks)
+	}
+
+	var meta thriftWriter
+	meta.i32(1, 1)
+	meta.structList(2, len(columns)+1, func(i int) {
+		if i == 0 {
+			meta.binary(4, "schema")
+			meta.i32(5, int64(len(columns)))
+			return
+		}
+		column := columns[i-1]
+		physical := parquetType(column)
+		meta.i32(1, physical)
+		meta.i32(3, 1)
+		meta.binary(4, column)
+		switch physical {
+		case parquetByteArray:
+			meta.i32(6, parquetUTF8)
+			meta.strct(10, func() { meta.strct(1, func() {}) })
+		case parquetInt32:
+			meta.i32(6, parquetDate)
+			meta.strct(10, func() { meta.strct(6, func() {}) })
+		}
+	})
+	meta.i64(3, int64(len(rows)))
+	meta.structList(4, len(groups), func(g int) {
+		chunks := groups[g]
+		var total int64
+		for _, chunk := range chunks {
+			total += chunk.uncompressed
+		}
+		meta.structList(1, len(chunks), func(i int) {
+			chunk := chunks[i]
+			meta.i64(2, chunk.offset)
+			meta.strct(3, func() {
+				meta.i32(1, parquetType(columns[i]))
+				meta.i32List(2, []int64{parquetPlain, parquetRLE})
+				meta.stringList(3, []string{columns[i]})
+				meta.i32(4, parquetGzip)
+				meta.i64(5, chunk.values)
+				meta.i64(6, chunk.uncompressed)
+				meta.i64(7, chunk.compressed)
+				meta.i64(9, chunk.offset)
+			})
+		})
+		meta.i64(2, total)
+		meta.i64(3, chunks[0].values)
+	})
+	meta.binary(6, "orchestration-go")
+	meta.stop()
+
+	file = append(file, meta.buf...)
+	file = binary.LittleEndian.AppendUint32(file, uint32(len(meta.buf)))
+	return append(file, parquetMagic...), nil
+}
+
+// parquetPage is an encoded data page and its header
+type parquetPage struct {
+	header []byte
+	data   []byte
+	size   int
+}
+
+// encodeParquetPage encodes the cells of a column as a data page: the
+// definition levels marking null cells, then the values present
+func encodeParquetPage(physical int64, column string, rows []map[string]string) (parquetPage, error) {
+	defined := make([]bool, len(rows))
+	var values []byte
+	for i, row := range rows {
+		value := row[column]
+		if value == "" {
+			continue
+		}
+		switch physical {
+		case parquetInt32:
+			date, err := time.Parse("2006-01-02", value)
+			if err != nil || !dateRegex.MatchString(value) {
+				continue
+			}
+			values = binary.LittleEndian.AppendUint32(values, uint32(int32(date.Unix()/86400)))
+		case parquetDouble:
+			v, err := parsePercentage(value)
+			if err != nil {
+				continue
+			}
+			values = binary.LittleEndian.AppendUint64(values, math.Float64bits(v))
+		default:
+			values = binary.LittleEndian.AppendUint32(values, uint32(len(value)))
+			values = append(values, value...)
+		}
+		defined[i] = true
+	}
+
+	levels := encodeDefinitions(defined)
+	raw := binary.LittleEndian.AppendUint32(nil, uint32(len(levels)))
+	raw = append(raw, levels...)
+	raw = append(raw, values...)
+
+	var compressed bytes.Buffer
+	zw := gzip.NewWriter(&compressed)
+	if _, err := zw.Write(raw); err != nil {
+		return parquetPage{}, err
+	}
+	if err := zw.Close(); err != nil {
+		return parquetPage{}, err
+	}
+
+	var header thriftWriter
+	header.i32(1, parquetDataPage)
+	header.i32(2, int64(len(raw)))
+	header.i32(3, int64(compressed.Len()))
+	header.strct(5, func() {
+		header.i32(1, int64(len(rows)))
+		header.i32(2, parquetPlain)
+		header.i32(3, parquetRLE)
+		header.i32(4, parquetRLE)
+	})
+	header.stop()
+	return parquetPage{header: header.buf, data: compressed.Bytes(), size: len(raw)}, nil
+}
+
+// encodeDefinitions encodes definition levels of bit width 1 as runs of
+// the RLE/bit-packing hybrid encoding, the inverse of decodeDefinitions
+func encodeDefinitions(defined []bool) []byte {
+	var out []byte
+	for i := 0; i < len(defined); {
+		j := i
+		for j < len(defined) && defined[j] == defined[i] {
+			j++
+		}
+		out = binary.AppendUvarint(out, uint64(j-i)<<1)
+		if defined[i] {
+			out = append(out, 1)
+		} else {
+			out = append(out, 0)
+		}
+		i = j
+	}
+	return out
+}
+
+// thriftWriter encodes structs in the Thrift compact protocol, the inverse
+// of thriftReader. Fields are written in increasing ID order within each
+// struct, which stop ends.
+type thriftWriter struct {
+	buf  []byte
+	last int16
+}
+
+// field writes a field header, as a delta from the previous field's ID
+// where it fits
+func (t *thriftWriter) field(id int16, kind byte) {
+	if delta := id - t.last; delta > 0 && delta <= 15 {
+		t.buf = append(t.buf, byte(delta)<<4|kind)
+	} else {
+		t.buf = append(t.buf, kind)
+		t.varint(int64(id))
+	}
+	t.last = id
+}
+
+func (t *thriftWriter) varint(v int64) {
+	t.buf = binary.AppendUvarint(t.buf, uint64(v<<1^v>>63))
+}
+
+func (t *thriftWriter) i32(id int16, v int64) {
+	t.field(id, 5)
+	t.varint(v)
+}
+
+func (t *thriftWriter) i64(id int16, v int64) {
+	t.field(id, 6)
+	t.varint(v)
+}
+
+func (t *thriftWriter) binary(id int16, s string) {
+	t.field(id, 8)
+	t.buf = binary.AppendUvarint(t.buf, uint64(len(s)))
+	t.buf = append(t.buf, s...)
+}
+
+// stop ends the current struct
+func (t *thriftWriter) stop() {
+	t.buf = append(t.buf, 0)
+}
+
+// strct writes a nested struct, whose fields fn writes
+func (t *thriftWriter) strct(id int16, fn func()) {
+	t.field(id, 12)
+	t.nested(fn)
+}
+
+// nested writes the fields of a struct and its stop, numbering them afresh
+func (t *thriftWriter) nested(fn func()) {
+	last := t.last
+	t.last = 0
+	fn()
+	t.stop()
+	t.last = last
+}
+
+// list writes a list header
+func (t *thriftWriter) list(id int16, size int, kind byte) {
+	t.field(id, 9)
+	if size < 15 {
+		t.buf = append(t.buf, byte(size)<<4|kind)
+	} else {
+		t.buf = append(t.buf, 0xf0|kind)
+		t.buf = binary.AppendUvarint(t.buf, uint64(size))
+	}
+}
+
+// structList writes a list of size structs, the fields of each written by fn
+func (t *thriftWriter) structList(id int16, size int, fn func(i int)) {
+	t.list(id, size, 12)
+	for i := 0; i < size; i++ {
+		t.nested(func() { fn(i) })
+	}
+}
+
+func (t *thriftWriter) i32List(id int16, values []int64) {
+	t.list(id, len(values), 5)
+	for _, v := range values {
+		t.varint(v)
+	}
+}
+
+func (t *thriftWriter) stringList(id int16, values []string) {
+	t.list(id, len(values), 8)
+	for _, s := range values {
+		t.buf = binary.AppendUvarint(t.buf, uint64(len(s)))
+		t.buf = append(t.buf, s...)
+	}
+}
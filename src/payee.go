@@ -0,0 +1,116 @@
+package main
+
+import (
+	"sort"
+	"strings"
+)
+
+// payeeIDSuffixes map the normalized endings of payee identifier columns,
+// such as "Artist IPI" or "Publisher IPN", to the identifier they hold
+var payeeIDSuffixes = []struct {
+	suffix, kind string
+}{
+	{"ipinamenumber", "IPI"},
+	{"ipi", "IPI"},
+	{"ipn", "IPN"},
+}
+
+// royaltyColumns are the royalty shares, each paid to the party it names
+var royaltyColumns = []string{"Royalty Artist %", "Royalty Label %", "Royalty Distributor %", "Royalty Publisher %"}
+
+// payeeColumn is a payee identifier column and the party it identifies
+type payeeColumn struct {
+	name, party, kind string
+}
+
+// payeeColumns returns the payee identifier columns of a record, by party.
+// A column named after the identifier alone identifies no particular party.
+func payeeColumns(record map[string]string) []payeeColumn {
+	var columns []payeeColumn
+	for name := range record {
+		normalized := normalizeColumnName(name)
+		for _, id := range payeeIDSuffixes {
+			if strings.HasSuffix(normalized, id.suffix) {
+				columns = append(columns, payeeColumn{name: name, party: strings.TrimSuffix(normalized, id.suffix), kind: id.kind})
+				break
+			}
+		}
+	}
+	sort.Slice(columns, func(i, j int) bool { return columns[i].name < columns[j].name })
+	return columns
+}
+
+// validIPI reports whether value is an IPI Name Number: up to 11 digits,
+// zero-padded on the left, whose last two digits are the sum of the first
+// nine weighted 10 down to 2, modulo 101
+func validIPI(value string) bool {
+	if len(value) == 0 || len(value) > 11 || !isDigits(value) {
+		return false
+	}
+	value = strings.Repeat("0", 11-len(value)) + value
+	sum := 0
+	for i := 0; i < 9; i++ {
+		sum += int(value[i]-'0') * (10 - i)
+	}
+	check := int(value[9]-'0')*10 + int(value[10]-'0')
+	return sum%101 == check
+}
+
+// validIPN reports whether value is an International Performer Number: up
+// to 8 digits. IPNs carry no check digit.
+func validIPN(value string) bool {
+	return len(value) > 0 && len(value) <= 8 && isDigits(value)
+}
+
+// isDigits reports whether s holds only ASCII digits
+func isDigits(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// checkPayees validates the IPI and IPN columns of a record and reports
+// royalty shares assigned to a party that has identifier columns but no
+// identifier on the row, as the royalty system rejects them. Records with
+// no identifier columns are not checked.
+func checkPayees(record map[string]string) []string {
+	columns := payeeColumns(record)
+	if len(columns) == 0 {
+		return nil
+	}
+
+	var issues []string
+	identified := make(map[string]bool)
+	for _, column := range columns {
+		value := strings.ReplaceAll(strings.TrimSpace(record[column.name]), " ", "")
+		if value == "" {
+			if _, known := identified[column.party]; !known {
+				identified[column.party] = false
+			}
+			continue
+		}
+		valid := validIPN
+		if column.kind == "IPI" {
+			valid = validIPI
+		}
+		if !valid(value) {
+			issues = append(issues, column.name+": invalid "+column.kind+" "+value)
+		}
+		identified[column.party] = true
+	}
+
+	for _, column := range royaltyColumns {
+		party := strings.TrimPrefix(normalizeColumnName(column), "royalty")
+		hasID, known := identified[party]
+		if !known || hasID {
+			continue
+		}
+		if pct, err := parsePercentage(record[column]); err == nil && pct > 0 {
+			issues = append(issues, column+": share assigned to a party with no IPI or IPN")
+		}
+	}
+	return issues
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+)
+
+// PIIReport counts likely personal data per column and kind, e.g.
+// {"Artist Name": {"email": 2}}
+type PIIReport map[string]map[string]int
+
+// piiFinding is a single cell that looks like personal data
+type piiFinding struct {
+	Column string
+	Kind   string
+}
+
+var (
+	emailRegex     = regexp.MustCompile(`[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}`)
+	phoneCandidate = regexp.MustCompile(`\+?\(?\d[\d\s().-]{7,18}\d`)
+	addressRegex   = regexp.MustCompile(`(?i)\b\d{1,5}\s+(?:[a-z0-9.'-]+\s+){1,4}(?:street|st|avenue|ave|road|rd|boulevard|blvd|lane|ln|drive|dr|court|ct|way|place|pl|square|sq)\b`)
+)
+
+// scanPII returns the cells of a row that look like emails, phone numbers or
+// street addresses. Columns whose header names the kind of data (e.g.
+// "Contact Email") are expected to hold it and are not flagged.
+func scanPII(record map[string]string) []piiFinding {
+	var findings []piiFinding
+	for column, value := range record {
+		if value == "" {
+			continue
+		}
+		header := strings.ToLower(column)
+		if !strings.Contains(header, "email") && emailRegex.MatchString(value) {
+			findings = append(findings, piiFinding{Column: column, Kind: "email"})
+		}
+		if !strings.Contains(header, "phone") && looksLikePhone(value) {
+			findings = append(findings, piiFinding{Column: column, Kind: "phone"})
+		}
+		if !strings.Contains(header, "address") && addressRegex.MatchString(value) {
+			findings = append(findings, piiFinding{Column: column, Kind: "address"})
+		}
+	}
+	return findings
+}
+
+// looksLikePhone reports whether the value contains a phone-number-like run
+// of 9 to 15 digits written with a leading + or separators, which keeps
+// plain identifiers such as UPCs and dates from matching
+func looksLikePhone(value string) bool {
+	for _, candidate := range phoneCandidate.FindAllString(value, -1) {
+		digits := 0
+		for _, r := range candidate {
+			if r >= '0' && r <= '9' {
+				digits++
+			}
+		}
+		if digits < 9 || digits > 15 {
+			continue
+		}
+		if strings.HasPrefix(candidate, "+") || strings.ContainsAny(candidate, " ().-") {
+			return true
+		}
+	}
+	return false
+}
+
+// add counts a finding in the report
+func (r PIIReport) add(f piiFinding) {
+	if r[f.Column] == nil {
+		r[f.Column] = make(map[string]int)
+	}
+	r[f.Column][f.Kind]++
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxProfilePlans bounds the number of header layouts planned per profile.
+// Partners reuse a handful of layouts; anything beyond is planned per job.
+const maxProfilePlans = 32
+
+// Profile is a named set of validation settings, stored as
+// PROFILES_DIR/<name>.json and selected with the profile form field, such
+// as the delivery spec of a partner
+type Profile struct {
+	Name        string           `json:"name"`
+	Description string           `json:"description,omitempty"`
+	Rules       []RuleDefinition `json:"rules,omitempty"`
+
+	// Checks is the check set of jobs with this profile that send none,
+	// instead of the default one
+	Checks []CheckDefinition `json:"checks,omitempty"`
+	checks *CheckSet
+
+	// Columns is the canonical output schema. When set, conversion rows hold
+	// exactly these columns in this order, whatever the input order.
+	Columns []string `json:"columns,omitempty"`
+
+	// Computed are the computed columns of jobs with this profile that send
+	// none
+	Computed []ComputedColumn `json:"computed,omitempty"`
+	computed []compiledColumn
+
+	// plans caches the plan of each header layout seen with this profile.
+	// A reloaded profile is a new value, so plans never outlive their file.
+	plansMu sync.Mutex
+	plans   map[string]*profilePlan
+}
+
+// profilePlan is everything derived from a profile for one header layout:
+// the output columns and the rules resolved against them. Plans are shared
+// by every job with that layout and must not be modified.
+type profilePlan struct {
+	columns  []string
+	names    []string
+	dropped  []string
+	rules    []*Rule
+	warnings []string
+}
+
+// plan returns the plan for the given headers, building it on first use
+func (p *Profile) plan(headers []string) (*profilePlan, error) {
+	key := strings.Join(headers, "\x00")
+	p.plansMu.Lock()
+	plan, ok := p.plans[key]
+	p.plansMu.Unlock()
+	if ok {
+		return plan, nil
+	}
+
+	plan = &profilePlan{}
+	plan.columns, plan.names, plan.dropped = outputColumns(headers, p.Columns)
+	var err error
+	plan.rules, plan.warnings, err = compileRules(p.Rules, plan.columns)
+	if err != nil {
+		return nil, err
+	}
+
+	p.plansMu.Lock()
+	if p.plans == nil {
+		p.plans = make(map[string]*profilePlan)
+	}
+	if len(p.plans) < maxProfilePlans {
+		p.plans[key] = plan
+	}
+	p.plansMu.Unlock()
+	return plan, nil
+}
+
+// cachedProfile is a loaded profile with the state of the file it came from
+type cachedProfile struct {
+	profile *Profile
+	modTime time.Time
+	size    int64
+}
+
+// profileCache holds loaded profiles by name. Entries are replaced, never
+// modified, when their file changes, so jobs holding the previous profile
+// finish with it undisturbed.
+var profileCache = struct {
+	sync.RWMutex
+	entries map[string]cachedProfile
+}{entries: make(map[string]cachedProfile)}
+
+// ErrProfileNotFound is returned for profile names with no profile file
+var ErrProfileNotFound = errors.New("profile not found")
+
+// profileNameRegex restricts profile names so they cannot escape the
+// profiles directory
+var profileNameRegex = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// loadProfile returns the named profile from the profiles directory. Loaded
+// profiles are cached and only read again when their file changes.
+func loadProfile(name string) (*Profile, error) {
+	if !profileNameRegex.MatchString(name) {
+		return nil, ErrProfileNotFound
+	}
+
+	path := filepath.Join(cfg.ProfilesDir, name+".json")
+	info, err := os.Stat(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		profileCache.Lock()
+		delete(profileCache.entries, name)
+		profileCache.Unlock()
+		return nil, ErrProfileNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read profile %s: %v", name, err)
+	}
+
+	profileCache.RLock()
+	cached, ok := profileCache.entries[name]
+	profileCache.RUnlock()
+	if ok && cached.modTime.Equal(info.ModTime()) && cached.size == info.Size() {
+		return cached.profile, nil
+	}
+
+	profile, err := readProfile(name, path)
+	if err != nil {
+		return nil, err
+	}
+	profileCache.Lock()
+	profileCache.entries[name] = cachedProfile{profile: profile, modTime: info.ModTime(), size: info.Size()}
+	profileCache.Unlock()
+	return profile, nil
+}
+
+// readProfile reads and checks a profile file
+func readProfile(name, path string) (*Profile, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, ErrProfileNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read profile %s: %v", name, err)
+	}
+
+	var profile Profile
+	if err := decodeJSON(bytes.NewReader(data), "profile.json", &profile); err != nil {
+		return nil, fmt.Errorf("invalid profile %s: %v", name, err)
+	}
+	profile.Name = name
+
+	// Catch syntax errors now rather than on the first upload using the rule
+	if _, _, err := compileRules(profile.Rules, nil); err != nil {
+		return nil, fmt.Errorf("invalid profile %s: %v", name, err)
+	}
+	if len(profile.Checks) > 0 {
+		profile.checks = &CheckSet{Checks: profile.Checks}
+		if err := profile.checks.compile(); err != nil {
+			return nil, fmt.Errorf("invalid profile %s: %v", name, err)
+		}
+	}
+	if profile.computed, err = compileComputed(profile.Computed); err != nil {
+		return nil, fmt.Errorf("invalid profile %s: %v", name, err)
+	}
+	return &profile, nil
+}
+
+// checkSet returns the check set of a job with the profile that sent
+// none: the profile's, or the default one
+func (p *Profile) checkSet() *CheckSet {
+	if p == nil || p.checks == nil {
+		return defaultChecks
+	}
+	return p.checks
+}
+
+// profilesHandler lists the profiles of the profiles directory. Profiles
+// that fail to load are left out and logged.
+func profilesHandler(w http.ResponseWriter, r *http.Request) {
+	entries, err := os.ReadDir(cfg.ProfilesDir)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		http.Error(w, "Failed to list profiles: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	profiles := []*Profile{}
+	for _, entry := range entries {
+		name, ok := strings.CutSuffix(entry.Name(), ".json")
+		if !ok || entry.IsDir() || !profileNameRegex.MatchString(name) {
+			continue
+		}
+		profile, err := loadProfile(name)
+		if err != nil {
+			log.Printf("Failed to load profile %s: %v", name, err)
+			continue
+		}
+		profiles = append(profiles, profile)
+	}
+	writeJSON(w, struct {
+		Profiles []*Profile `json:"profiles"`
+	}{profiles})
+}
+
+// profileHandler returns a profile
+func profileHandler(w http.ResponseWriter, r *http.Request) {
+	profile, err := loadProfile(r.PathValue("name"))
+	if errors.Is(err, ErrProfileNotFound) {
+		http.Error(w, "Unknown profile: "+r.PathValue("name"), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to load profile: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, profile)
+}
@@ -0,0 +1,402 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/binary"
+	"math"
+	"mime"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// resultProto is the protobuf definition of results, served at
+// /schemas/result.proto
+//
+//go:embed schemas/result.proto
+var resultProto []byte
+
+// protobufContentType is the media type of protobuf-encoded results
+const protobufContentType = "application/x-protobuf"
+
+// acceptsProtobuf reports whether the client asked for a protobuf result
+func acceptsProtobuf(r *http.Request) bool {
+	return accepts(r, protobufContentType, "application/protobuf")
+}
+
+// accepts reports whether the request's Accept header lists one of the
+// media types
+func accepts(r *http.Request, mediaTypes ...string) bool {
+	for _, accepted := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(accepted))
+		if err != nil || params["q"] == "0" {
+			continue
+		}
+		for _, candidate := range mediaTypes {
+			if mediaType == candidate {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// protoWriter appends fields in the protobuf wire format. Fields holding
+// their zero value are left out, as proto3 does, and map entries are
+// written in key order so the same result always encodes the same way.
+type protoWriter struct {
+	buf []byte
+}
+
+// Wire types
+const (
+	protoVarint  = 0
+	protoFixed64 = 1
+	protoBytes   = 2
+)
+
+func (p *protoWriter) tag(field, wireType int) {
+	p.buf = binary.AppendUvarint(p.buf, uint64(field)<<3|uint64(wireType))
+}
+
+func (p *protoWriter) string(field int, value string) {
+	if value == "" {
+		return
+	}
+	p.tag(field, protoBytes)
+	p.buf = binary.AppendUvarint(p.buf, uint64(len(value)))
+	p.buf = append(p.buf, value...)
+}
+
+// repeatedString writes every value, empty ones included
+func (p *protoWriter) repeatedString(field int, values []string) {
+	for _, value := range values {
+		p.tag(field, protoBytes)
+		p.buf = binary.AppendUvarint(p.buf, uint64(len(value)))
+		p.buf = append(p.buf, value...)
+	}
+}
+
+func (p *protoWriter) int(field int, value int64) {
+	if value == 0 {
+		return
+	}
+	p.tag(field, protoVarint)
+	p.buf = binary.AppendUvarint(p.buf, uint64(value))
+}
+
+func (p *protoWriter) double(field int, value float64) {
+	if value == 0 {
+		return
+	}
+	p.tag(field, protoFixed64)
+	p.buf = binary.LittleEndian.AppendUint64(p.buf, math.Float64bits(value))
+}
+
+func (p *protoWriter) bool(field int, value bool) {
+	if value {
+		p.tag(field, protoVarint)
+		p.buf = append(p.buf, 1)
+	}
+}
+
+// message writes a nested message, encoded by fn. Unlike other fields,
+// empty messages are written, so map entries and rows are never lost.
+func (p *protoWriter) message(field int, fn func(*protoWriter)) {
+	var nested protoWriter
+	fn(&nested)
+	p.tag(field, protoBytes)
+	p.buf = binary.AppendUvarint(p.buf, uint64(len(nested.buf)))
+	p.buf = append(p.buf, nested.buf...)
+}
+
+// sortedKeys returns the keys of a map in order
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// encodeResultProto encodes a result as a Result message of result.proto
+func encodeResultProto(result *OutputFormat) []byte {
+	var p protoWriter
+	columns := result.Conversion.Columns
+	known := make(map[string]bool, len(columns))
+	for _, column := range columns {
+		known[column] = true
+	}
+	p.repeatedString(1, columns)
+	for _, row := range result.Conversion.Rows {
+		p.message(2, func(m *protoWriter) {
+			values := make([]string, len(columns))
+			for i, column := range columns {
+				values[i] = row[column]
+			}
+			m.repeatedString(1, values)
+			if len(row) > len(columns) {
+				for _, key := range sortedKeys(row) {
+					if !known[key] {
+						m.message(2, func(e *protoWriter) {
+							e.string(1, key)
+							e.string(2, row[key])
+						})
+					}
+				}
+			}
+		})
+	}
+
+	for _, key := range sortedKeys(result.Validation) {
+		v := result.Validation[key]
+		p.message(3, func(e *protoWriter) {
+			e.string(1, key)
+			e.message(2, func(m *protoWriter) {
+				m.string(1, v.ReleaseID)
+				m.string(2, v.TrackID)
+				m.bool(3, v.RoyaltiesSum)
+				m.bool(4, v.DateFormat)
+				m.bool(5, v.Territories)
+				m.repeatedString(6, v.TerritoryIssues)
+				for _, rule := range sortedKeys(v.Rules) {
+					m.message(7, func(r *protoWriter) {
+						r.string(1, rule)
+						r.bool(2, v.Rules[rule])
+					})
+				}
+				m.repeatedString(8, v.PayeeIssues)
+				m.bool(9, v.DuplicateTrack)
+				m.repeatedString(10, v.ReleaseConflicts)
+				m.repeatedString(11, v.NumericIssues)
+				m.repeatedString(12, v.ReleaseTypeIssues)
+				m.repeatedString(14, v.ISRCIssues)
+				m.bool(15, v.DuplicateISRC)
+				m.bool(16, v.UPCValid)
+				m.repeatedString(18, v.MissingFields)
+				m.repeatedString(19, v.DateIssues)
+				m.repeatedString(20, v.GenreIssues)
+				m.repeatedString(21, v.GenreSuggestions)
+				if v.RoyaltiesTotal != nil {
+					m.double(22, *v.RoyaltiesTotal)
+				}
+				m.int(23, int64(v.Errors))
+				m.int(24, int64(v.Warnings))
+				m.repeatedString(29, v.LabelIssues)
+				m.repeatedString(30, v.LabelSuggestions)
+				m.repeatedString(31, v.RightsHolderIssues)
+				m.repeatedString(32, v.RightsHolderSuggestions)
+				m.string(33, v.OriginalReleaseDate)
+				m.string(34, v.RoyaltyFormat)
+				for _, issue := range v.Issues {
+					m.message(25, func(i *protoWriter) {
+						i.string(1, issue.Check)
+						i.string(2, issue.Severity)
+						i.string(3, issue.Column)
+						i.string(4, issue.Value)
+						i.string(5, issue.Message)
+					})
+				}
+				m.int(26, int64(v.Line))
+				for _, check := range sortedKeys(v.Checks) {
+					m.message(17, func(c *protoWriter) {
+						c.string(1, check)
+						c.bool(2, v.Checks[check])
+					})
+				}
+				for _, validator := range sortedKeys(v.Validators) {
+					m.message(27, func(c *protoWriter) {
+						c.string(1, validator)
+						c.bool(2, v.Validators[validator])
+					})
+				}
+				for _, check := range sortedKeys(v.Conflicts) {
+					m.message(28, func(c *protoWriter) {
+						c.string(1, check)
+						c.message(2, func(lines *protoWriter) {
+							for _, line := range v.Conflicts[check] {
+								lines.int(1, int64(line))
+							}
+						})
+					})
+				}
+				for _, profile := range sortedKeys(v.ProfileRules) {
+					m.message(13, func(e *protoWriter) {
+						e.string(1, profile)
+						e.message(2, func(results *protoWriter) {
+							for _, rule := range sortedKeys(v.ProfileRules[profile]) {
+								results.message(1, func(r *protoWriter) {
+									r.string(1, rule)
+									r.bool(2, v.ProfileRules[profile][rule])
+								})
+							}
+						})
+					})
+				}
+			})
+		})
+	}
+
+	for _, column := range sortedKeys(result.PII) {
+		kinds := result.PII[column]
+		p.message(4, func(e *protoWriter) {
+			e.string(1, column)
+			e.message(2, func(m *protoWriter) {
+				for _, kind := range sortedKeys(kinds) {
+					m.message(1, func(k *protoWriter) {
+						k.string(1, kind)
+						k.int(2, int64(kinds[kind]))
+					})
+				}
+			})
+		})
+	}
+
+	metadata := result.Metadata
+	p.message(5, func(m *protoWriter) {
+		m.string(1, metadata.JobID)
+		m.int(2, int64(metadata.Workers))
+		m.int(3, int64(metadata.RequestedWorkers))
+		m.string(4, metadata.Profile)
+		m.int(5, int64(metadata.Parts))
+		m.string(6, metadata.Delimiter)
+		m.int(7, int64(metadata.SkippedLines))
+		m.repeatedString(8, metadata.Columns)
+		m.int(9, int64(metadata.RepairedCells))
+		if dialect := metadata.Dialect; dialect != nil {
+			m.message(10, func(d *protoWriter) {
+				d.string(1, dialect.Delimiter)
+				d.string(2, dialect.Quoting)
+				d.string(3, dialect.LineEndings)
+				d.bool(4, dialect.BOM)
+				d.bool(5, dialect.Header)
+				d.int(6, int64(dialect.Columns))
+				d.repeatedString(7, dialect.Deviations)
+			})
+		}
+		for _, sub := range metadata.Substitutions {
+			m.message(11, func(s *protoWriter) {
+				s.string(1, sub.Column)
+				s.string(2, sub.From)
+				s.string(3, sub.To)
+				s.int(4, int64(sub.Rows))
+			})
+		}
+		for _, releaseType := range sortedKeys(metadata.ReleaseTypes) {
+			m.message(12, func(e *protoWriter) {
+				e.string(1, releaseType)
+				e.int(2, int64(metadata.ReleaseTypes[releaseType]))
+			})
+		}
+		m.repeatedString(13, metadata.Profiles)
+		m.repeatedString(14, metadata.WarningChecks)
+		m.int(15, int64(metadata.Errors))
+		m.int(16, int64(metadata.Warnings))
+		if rounding := metadata.Rounding; rounding != nil {
+			m.message(19, func(r *protoWriter) {
+				r.string(1, rounding.Arithmetic)
+				r.string(2, rounding.Mode)
+				r.int(3, int64(rounding.Decimals))
+			})
+		}
+		if header := metadata.Header; header != nil {
+			m.message(17, func(h *protoWriter) {
+				h.repeatedString(1, header.Missing)
+				h.repeatedString(2, header.MissingRequired)
+				h.repeatedString(3, header.Unexpected)
+				for _, column := range sortedKeys(header.Misspelled) {
+					h.message(4, func(e *protoWriter) {
+						e.string(1, column)
+						e.string(2, header.Misspelled[column])
+					})
+				}
+			})
+		}
+		m.repeatedString(18, metadata.Validators)
+		m.int(20, int64(metadata.NormalizedCells))
+		if deduplication := metadata.Deduplication; deduplication != nil {
+			m.message(21, func(d *protoWriter) {
+				d.repeatedString(1, deduplication.Key)
+				d.int(2, int64(deduplication.Removed))
+				for _, row := range deduplication.Rows {
+					d.message(3, func(r *protoWriter) {
+						r.int(1, int64(row.Line))
+						r.int(2, int64(row.Part))
+					})
+				}
+			})
+		}
+	})
+	p.repeatedString(6, result.Warnings)
+
+	for _, row := range sortedKeys(result.Annotations) {
+		p.message(7, func(e *protoWriter) {
+			e.string(1, row)
+			e.message(2, func(m *protoWriter) {
+				for _, annotation := range result.Annotations[row] {
+					m.message(1, func(a *protoWriter) {
+						a.string(1, annotation.Row)
+						a.string(2, annotation.Author)
+						a.string(3, annotation.Text)
+						a.string(4, annotation.CreatedAt.Format(time.RFC3339Nano))
+					})
+				}
+			})
+		})
+	}
+
+	if result.Encryption != nil {
+		p.message(8, func(m *protoWriter) {
+			m.string(1, result.Encryption.Key)
+			m.repeatedString(2, result.Encryption.Columns)
+		})
+	}
+
+	if result.Duplicates != nil {
+		p.message(9, func(m *protoWriter) {
+			for i, duplicates := range []map[string][]int{result.Duplicates.TrackIDs, result.Duplicates.ISRCs} {
+				for _, value := range sortedKeys(duplicates) {
+					m.message(i+1, func(e *protoWriter) {
+						e.string(1, value)
+						e.message(2, func(rows *protoWriter) {
+							for _, row := range duplicates[value] {
+								rows.int(1, int64(row))
+							}
+						})
+					})
+				}
+			}
+		})
+	}
+
+	for _, row := range result.MalformedRows {
+		p.message(11, func(m *protoWriter) {
+			m.int(1, int64(row.Line))
+			m.int(2, int64(row.Part))
+			m.int(3, int64(row.Fields))
+			m.int(4, int64(row.Expected))
+			m.string(5, row.Message)
+		})
+	}
+
+	if s := result.Summary; s != nil {
+		p.message(10, func(m *protoWriter) {
+			m.int(1, int64(s.Rows))
+			m.int(2, int64(s.PassedRows))
+			m.int(3, int64(s.FailedRows))
+			m.double(4, s.PassRate)
+			for _, check := range sortedKeys(s.Failures) {
+				m.message(5, func(e *protoWriter) {
+					e.string(1, check)
+					e.int(2, int64(s.Failures[check]))
+				})
+			}
+			m.int(6, int64(s.Releases))
+			m.int(7, int64(s.Artists))
+			m.int(8, s.DurationMillis)
+		})
+	}
+	return p.buf
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+// protoTestResult returns a result with every field of result.proto set
+func protoTestResult() *OutputFormat {
+	total := 100.5
+	v := RowValidation{
+		ReleaseID: "REL001", TrackID: "TRK001", Line: 2,
+		RoyaltiesSum: true, RoyaltiesTotal: &total, Errors: 2, Warnings: 1,
+		RoyaltyFormat: "percent", DateFormat: true, Territories: true,
+		TerritoryIssues: []string{"XX"}, Rules: map[string]bool{"b": false, "a": true},
+		Checks: map[string]bool{"royalties_sum": true}, UPCValid: true,
+		MissingFields: []string{"Genre"}, DateIssues: []string{"in the future"},
+		OriginalReleaseDate: "01/15/2023", GenreIssues: []string{"Popp"}, GenreSuggestions: []string{"Pop"},
+		LabelIssues: []string{"Lable X"}, LabelSuggestions: []string{"Label X"},
+		RightsHolderIssues: []string{"Rights"}, RightsHolderSuggestions: []string{"Rights Co"},
+		PayeeIssues: []string{"unknown payee"}, NumericIssues: []string{"UPC in scientific notation"},
+		ReleaseTypeIssues: []string{"mixed"}, ISRCIssues: []string{"bad checksum"},
+		ProfileRules:   map[string]map[string]bool{"store": {"explicit": true}},
+		Validators:     map[string]bool{"catalog.wasm": true},
+		DuplicateTrack: true, ReleaseConflicts: []string{"Release Title"}, DuplicateISRC: true,
+		Conflicts: map[string][]int{"unique_isrc": {3, 4}},
+		Issues:    []Issue{{Check: "date_format", Severity: "error", Column: "Release Date", Value: "2023-02-30", Message: "not a date"}},
+	}
+	return &OutputFormat{
+		Conversion: Conversion{
+			Columns: []string{"Track ID", "Genre", "Track Title"},
+			Rows: []map[string]string{
+				{"Track ID": "TRK001", "Track Title": "Pájaro ☂", "Zeta": "z", "Alpha": ""},
+				{},
+			},
+		},
+		Validation: map[string]RowValidation{"TRK001": v, "TRK002": {}},
+		PII:        PIIReport{"Artist Name": {"email": 2}},
+		Metadata: JobMetadata{
+			JobID: "job-1", Workers: 4, RequestedWorkers: 8, Profile: "store", Parts: 2,
+			Delimiter: ";", SkippedLines: 1, Columns: []string{"Track ID"}, RepairedCells: 3,
+			Dialect: &Dialect{Delimiter: ";", Quoting: "minimal", LineEndings: "crlf", BOM: true, Header: true,
+				Columns: 3, Deviations: []string{"line 4: 2 fields"}},
+			Substitutions: []Substitution{{Column: "Artist Name", From: "Artst A", To: "Artist A", Rows: 1}},
+			ReleaseTypes:  map[string]int{"single": 1},
+			Profiles:      []string{"store"}, WarningChecks: []string{"genre"}, Errors: 2, Warnings: 1,
+			Rounding: &Rounding{Arithmetic: "decimal", Mode: "half_even", Decimals: 2},
+			Header: &HeaderReport{Missing: []string{"UPC"}, MissingRequired: []string{"ISRC"},
+				Unexpected: []string{"Notes"}, Misspelled: map[string]string{"Trak ID": "Track ID"}},
+			Validators:      []string{"catalog.wasm"},
+			NormalizedCells: 5,
+			Deduplication:   &Deduplication{Key: []string{"Track ID"}, Removed: 1, Rows: []RemovedRow{{Line: 5, Part: 1}}},
+		},
+		Warnings:      []string{"2 rows were skipped"},
+		Annotations:   map[string][]Annotation{"TRK001": {{Row: "TRK001", Author: "ana", Text: "checked", CreatedAt: time.Date(2024, 8, 1, 12, 0, 0, 0, time.UTC)}}},
+		Encryption:    &Encryption{Key: "wrapped", Columns: []string{"Artist Name"}},
+		Duplicates:    &Duplicates{TrackIDs: map[string][]int{"TRK001": {1, 2}}, ISRCs: map[string][]int{"USABC1234567": {1, 2}}},
+		MalformedRows: []MalformedRow{{Line: 7, Part: 1, Fields: 2, Expected: 3, Message: "wrong number of fields"}},
+		Summary: &Summary{Rows: 2, PassedRows: 1, FailedRows: 1, PassRate: 0.5,
+			Failures: map[string]int{"date_format": 1}, Releases: 1, Artists: 1, DurationMillis: 12},
+	}
+}
+
+func TestEncodeResultProtoFixture(t *testing.T) {
+	want, err := os.ReadFile("testdata/result.pb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := encodeResultProto(protoTestResult()); !bytes.Equal(got, want) {
+		t.Errorf("encoding differs from testdata/result.pb:\n%x\nwant:\n%x", got, want)
+	}
+}
+
+// protoTestField is a field of a message of result.proto. Map fields have
+// the kind of their entry message, named after the field.
+type protoTestField struct {
+	name string
+	kind string
+}
+
+// protoTestSchema reads the messages of result.proto
+func protoTestSchema(t *testing.T) map[string]map[uint64]protoTestField {
+	messageRe := regexp.MustCompile(`^message (\w+) \{`)
+	fieldRe := regexp.MustCompile(`^\s+(repeated )?(\w+) (\w+) = (\d+);`)
+	mapRe := regexp.MustCompile(`^\s+map<(\w+), (\w+)> (\w+) = (\d+);`)
+
+	schema := make(map[string]map[uint64]protoTestField)
+	var message string
+	for _, line := range strings.Split(string(resultProto), "\n") {
+		if m := messageRe.FindStringSubmatch(line); m != nil {
+			message = m[1]
+			schema[message] = make(map[uint64]protoTestField)
+		} else if m := mapRe.FindStringSubmatch(line); m != nil {
+			number, _ := strconv.ParseUint(m[4], 10, 64)
+			entry := message + "." + m[3]
+			schema[entry] = map[uint64]protoTestField{1: {name: "key", kind: m[1]}, 2: {name: "value", kind: m[2]}}
+			schema[message][number] = protoTestField{name: m[3], kind: entry}
+		} else if m := fieldRe.FindStringSubmatch(line); m != nil {
+			number, _ := strconv.ParseUint(m[4], 10, 64)
+			schema[message][number] = protoTestField{name: m[3], kind: m[2]}
+		}
+	}
+	if len(schema["Result"]) == 0 {
+		t.Fatal("result.proto has no Result message")
+	}
+	return schema
+}
+
+// protoTestCheck checks that b is a well-formed message of the schema,
+// every field of the declared wire type with lengths that fit, and
+// records the fields seen
+func protoTestCheck(schema map[string]map[uint64]protoTestField, message string, b []byte, seen map[string]bool) error {
+	fields, ok := schema[message]
+	if !ok {
+		return fmt.Errorf("unknown message %s", message)
+	}
+	for len(b) > 0 {
+		tag, n := binary.Uvarint(b)
+		if n <= 0 {
+			return fmt.Errorf("%s: truncated tag", message)
+		}
+		b = b[n:]
+		number, wireType := tag>>3, tag&7
+		field, ok := fields[number]
+		if !ok {
+			return fmt.Errorf("%s: unknown field %d", message, number)
+		}
+		name := message + "." + field.name
+		seen[name] = true
+
+		switch wireType {
+		case protoVarint:
+			v, n := binary.Uvarint(b)
+			if n <= 0 {
+				return fmt.Errorf("%s: truncated varint", name)
+			}
+			b = b[n:]
+			switch {
+			case field.kind == "bool" && v > 1:
+				return fmt.Errorf("%s: bool of %d", name, v)
+			case field.kind != "bool" && field.kind != "int64":
+				return fmt.Errorf("%s: varint for a %s", name, field.kind)
+			}
+		case protoFixed64:
+			if field.kind != "double" || len(b) < 8 {
+				return fmt.Errorf("%s: fixed64 for a %s, %d bytes left", name, field.kind, len(b))
+			}
+			b = b[8:]
+		case protoBytes:
+			length, n := binary.Uvarint(b)
+			if n <= 0 || length > uint64(len(b)-n) {
+				return fmt.Errorf("%s: length %d exceeds the message", name, length)
+			}
+			value := b[n : n+int(length)]
+			b = b[n+int(length):]
+			switch field.kind {
+			case "string":
+				if !utf8.Valid(value) {
+					return fmt.Errorf("%s: invalid UTF-8", name)
+				}
+			case "bool", "int64", "double":
+				return fmt.Errorf("%s: length-delimited %s", name, field.kind)
+			default:
+				if err := protoTestCheck(schema, field.kind, value, seen); err != nil {
+					return err
+				}
+			}
+		default:
+			return fmt.Errorf("%s: wire type %d", name, wireType)
+		}
+	}
+	return nil
+}
+
+// TestEncodeResultProtoSchema checks the encoding against result.proto: it
+// must be well-formed and write every field the file declares
+func TestEncodeResultProtoSchema(t *testing.T) {
+	schema := protoTestSchema(t)
+	seen := make(map[string]bool)
+	if err := protoTestCheck(schema, "Result", encodeResultProto(protoTestResult()), seen); err != nil {
+		t.Fatal(err)
+	}
+	for message, fields := range schema {
+		for _, field := range fields {
+			if name := message + "." + field.name; !seen[name] {
+				t.Errorf("%s is never written", name)
+			}
+		}
+	}
+
+	// An empty result is an empty metadata message
+	if got := encodeResultProto(&OutputFormat{}); !bytes.Equal(got, []byte{5<<3 | protoBytes, 0}) {
+		t.Errorf("empty result = %x", got)
+	}
+}
+
+func TestProtoWriter(t *testing.T) {
+	var p protoWriter
+	p.int(1, -1)
+	p.int(2, 0)
+	p.double(3, math.Inf(-1))
+	p.string(4, "")
+	p.repeatedString(5, []string{"", "a"})
+	p.bool(6, false)
+	p.message(7, func(*protoWriter) {})
+	want := []byte{
+		1 << 3, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01,
+		3<<3 | protoFixed64, 0, 0, 0, 0, 0, 0, 0xf0, 0xff,
+		5<<3 | protoBytes, 0, 5<<3 | protoBytes, 1, 'a',
+		7<<3 | protoBytes, 0,
+	}
+	if !bytes.Equal(p.buf, want) {
+		t.Errorf("encoded %x, want %x", p.buf, want)
+	}
+}
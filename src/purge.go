@@ -0,0 +1,221 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// maxPurgeRequestSize limits the size of a purge request body
+const maxPurgeRequestSize = 64 << 10
+
+// defaultPurgeColumns are the columns naming an artist or rights holder
+var defaultPurgeColumns = []string{"Artist Name", "Rights Holder"}
+
+// Tombstone records what a purge deleted without keeping the deleted data,
+// not even the name it was asked to delete
+type Tombstone struct {
+	ID          string    `json:"id"`
+	Reference   string    `json:"reference,omitempty"`
+	Columns     []string  `json:"columns"`
+	Jobs        []string  `json:"jobs"`
+	Rows        int       `json:"rows"`
+	Annotations int       `json:"annotations"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// PurgeResponse is the outcome of a purge. Pending lists jobs still running
+// whose results could not be checked yet; they should be purged again once
+// they finish.
+type PurgeResponse struct {
+	Tombstone *Tombstone `json:"tombstone"`
+	Pending   []string   `json:"pending,omitempty"`
+}
+
+// isAdmin reports whether the request carries the admin token. The admin
+// API is disabled unless ADMIN_TOKEN is set.
+func isAdmin(r *http.Request) bool {
+	if cfg.AdminToken == "" {
+		return false
+	}
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && subtle.ConstantTimeCompare([]byte(token), []byte(cfg.AdminToken)) == 1
+}
+
+// purgeHandler deletes every stored row naming an artist or rights holder,
+// across all jobs kept, together with the annotations on those rows, and
+// writes a tombstone of what was deleted
+func purgeHandler(w http.ResponseWriter, r *http.Request) {
+	if !isAdmin(r) {
+		http.Error(w, "Admin token required", http.StatusForbidden)
+		return
+	}
+
+	var body struct {
+		Name      string   `json:"name"`
+		Columns   []string `json:"columns"`
+		Reference string   `json:"reference"`
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxPurgeRequestSize)
+	if err := decodeJSON(r.Body, "purge-request.json", &body); err != nil {
+		writeError(w, "Invalid purge request: ", err)
+		return
+	}
+	body.Name = strings.TrimSpace(body.Name)
+	if body.Name == "" {
+		http.Error(w, "Invalid purge request: name is required", http.StatusBadRequest)
+		return
+	}
+	if len(body.Columns) == 0 {
+		body.Columns = defaultPurgeColumns
+	}
+
+	response, err := purgeName(body.Name, body.Columns, strings.TrimSpace(body.Reference))
+	if err != nil {
+		writeStoreError(w, "Failed to purge: ", err)
+		return
+	}
+	writeJSON(w, response)
+}
+
+// purgeName removes the rows whose columns hold name, ignoring case and
+// surrounding spaces, from the results of every stored job
+func purgeName(name string, columns []string, reference string) (*PurgeResponse, error) {
+	resultMutex.Lock()
+	defer resultMutex.Unlock()
+
+	jobs, err := jobStore.ListJobs(0)
+	if err != nil {
+		return nil, err
+	}
+
+	tombstone := &Tombstone{
+		ID:        hex.EncodeToString(randomBytes(8)),
+		Reference: reference,
+		Columns:   columns,
+		Jobs:      []string{},
+		CreatedAt: time.Now().UTC(),
+	}
+	response := &PurgeResponse{Tombstone: tombstone}
+	for _, job := range jobs {
+		if job.Active() {
+			response.Pending = append(response.Pending, job.ID)
+			continue
+		}
+		rows, annotations, err := purgeJob(job, name, columns)
+		if err != nil {
+			return nil, err
+		}
+		if rows > 0 {
+			tombstone.Jobs = append(tombstone.Jobs, job.ID)
+			tombstone.Rows += rows
+			tombstone.Annotations += annotations
+		}
+	}
+
+	if err := jobStore.AddTombstone(tombstone); err != nil {
+		return nil, err
+	}
+	log.Printf("Purge %s deleted %d rows and %d annotations from %d jobs",
+		tombstone.ID, tombstone.Rows, tombstone.Annotations, len(tombstone.Jobs))
+	return response, nil
+}
+
+// purgeJob removes the matching rows from a job's result and returns the
+// number of rows and annotations deleted. The caller must hold resultMutex.
+func purgeJob(job *Job, name string, columns []string) (int, int, error) {
+	result, err := jobStore.GetResult(job.ID)
+	if errors.Is(err, ErrJobNotFound) {
+		return 0, 0, nil
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+
+	matched := matchColumns(columns, result.Metadata.Columns)
+	if len(matched) == 0 {
+		return 0, 0, nil
+	}
+
+	var purged []string
+	kept := result.Conversion.Rows[:0:0]
+	for _, row := range result.Conversion.Rows {
+		if !rowNames(row, matched, name) {
+			kept = append(kept, row)
+			continue
+		}
+		purged = append(purged, row["Track ID"])
+	}
+	if len(purged) == 0 {
+		return 0, 0, nil
+	}
+
+	validation := make(map[string]RowValidation, len(result.Validation))
+	for key, v := range result.Validation {
+		validation[key] = v
+	}
+	for _, key := range purged {
+		delete(validation, key)
+	}
+	computed, err := compileComputed(result.Metadata.Computed)
+	if err != nil {
+		return 0, 0, err
+	}
+	purgedResult := *result
+	purgedResult.Conversion.Rows = kept
+	purgedResult.Validation = validation
+	// Substitutions name the artists and labels of the purged rows
+	purgedResult.Metadata.Substitutions = recountSubstitutions(result.Metadata.Substitutions, kept)
+	// Releases may have lost tracks
+	computeColumns(&purgedResult, computed)
+	if err := jobStore.SaveResult(job.ID, &purgedResult); err != nil {
+		return 0, 0, err
+	}
+	materializeViews(job.ID, &purgedResult)
+
+	annotations, err := jobStore.DeleteAnnotations(job.ID, purged)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	job.ProcessedRows = len(kept)
+	job.countFailures(validation)
+	job.ReuseKey = ""
+	// The uploaded files still hold the purged rows
+	forgetUploads(job)
+	saveJob(job)
+	return len(purged), annotations, nil
+}
+
+// rowNames reports whether any of the columns of row holds name
+func rowNames(row map[string]string, columns []string, name string) bool {
+	for _, column := range columns {
+		if strings.EqualFold(strings.TrimSpace(row[column]), name) {
+			return true
+		}
+	}
+	return false
+}
+
+// tombstonesHandler lists the tombstones of past purges, oldest first
+func tombstonesHandler(w http.ResponseWriter, r *http.Request) {
+	if !isAdmin(r) {
+		http.Error(w, "Admin token required", http.StatusForbidden)
+		return
+	}
+	tombstones, err := jobStore.Tombstones()
+	if err != nil {
+		writeStoreError(w, "Failed to list tombstones: ", err)
+		return
+	}
+	if tombstones == nil {
+		tombstones = []*Tombstone{}
+	}
+	writeJSON(w, struct {
+		Tombstones []*Tombstone `json:"tombstones"`
+	}{Tombstones: tombstones})
+}
@@ -0,0 +1,662 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// redisKeyPrefix namespaces all keys written by the service
+const redisKeyPrefix = "csvapi:"
+
+// redisError is an error reply sent by the Redis server
+type redisError string
+
+func (e redisError) Error() string {
+	return "redis: " + string(e)
+}
+
+// RedisClient is a minimal Redis client speaking RESP over a single
+// connection, enough for the job store without pulling in a dependency
+type RedisClient struct {
+	addr     string
+	password string
+	db       int
+
+	mu   sync.Mutex
+	conn net.Conn
+	rd   *bufio.Reader
+}
+
+// NewRedisClient creates a client for the server at addr. The connection is
+// established lazily and re-established after network errors.
+func NewRedisClient(addr, password string, db int) *RedisClient {
+	return &RedisClient{addr: addr, password: password, db: db}
+}
+
+// Do sends a command and returns its reply: string, int64, []interface{}
+// or nil for a null reply
+func (c *RedisClient) Do(args ...string) (interface{}, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.conn == nil {
+		if err := c.connect(); err != nil {
+			return nil, err
+		}
+	}
+
+	reply, err := c.roundTrip(args)
+	var replyErr redisError
+	if err != nil && !errors.As(err, &replyErr) {
+		// Drop the connection so the next command reconnects
+		c.conn.Close()
+		c.conn = nil
+	}
+	return reply, err
+}
+
+// connect dials the server and authenticates. The caller must hold the lock.
+func (c *RedisClient) connect() error {
+	conn, err := net.DialTimeout("tcp", c.addr, 5*time.Second)
+	if err != nil {
+		return fmt.Errorf("redis: failed to connect to %s: %v", c.addr, err)
+	}
+	c.conn = conn
+	c.rd = bufio.NewReader(conn)
+
+	if c.password != "" {
+		if _, err := c.roundTrip([]string{"AUTH", c.password}); err != nil {
+			c.conn.Close()
+			c.conn = nil
+			return err
+		}
+	}
+	if c.db != 0 {
+		if _, err := c.roundTrip([]string{"SELECT", strconv.Itoa(c.db)}); err != nil {
+			c.conn.Close()
+			c.conn = nil
+			return err
+		}
+	}
+	return nil
+}
+
+// roundTrip writes a command and reads its reply. The caller must hold the lock.
+func (c *RedisClient) roundTrip(args []string) (interface{}, error) {
+	c.conn.SetDeadline(time.Now().Add(30 * time.Second))
+
+	w := bufio.NewWriter(c.conn)
+	fmt.Fprintf(w, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(w, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if err := w.Flush(); err != nil {
+		return nil, fmt.Errorf("redis: failed to send command: %v", err)
+	}
+	return c.readReply()
+}
+
+// readReply parses a single RESP reply
+func (c *RedisClient) readReply() (interface{}, error) {
+	line, err := c.rd.ReadString('\n')
+	if err != nil {
+		return nil, fmt.Errorf("redis: failed to read reply: %v", err)
+	}
+	if len(line) < 3 {
+		return nil, fmt.Errorf("redis: malformed reply %q", line)
+	}
+	kind, body := line[0], line[1:len(line)-2]
+
+	switch kind {
+	case '+':
+		return body, nil
+	case '-':
+		return nil, redisError(body)
+	case ':':
+		return strconv.ParseInt(body, 10, 64)
+	case '$':
+		n, err := strconv.Atoi(body)
+		if err != nil {
+			return nil, fmt.Errorf("redis: malformed bulk length %q", body)
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(c.rd, buf); err != nil {
+			return nil, fmt.Errorf("redis: failed to read reply: %v", err)
+		}
+		return string(buf[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(body)
+		if err != nil {
+			return nil, fmt.Errorf("redis: malformed array length %q", body)
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		items := make([]interface{}, n)
+		for i := range items {
+			if items[i], err = c.readReply(); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	default:
+		return nil, fmt.Errorf("redis: unknown reply type %q", kind)
+	}
+}
+
+// RedisJobStore keeps job state and results in Redis so that every replica
+// behind a load balancer sees the same jobs. Keys expire after the TTL.
+type RedisJobStore struct {
+	client *RedisClient
+	ttl    time.Duration
+}
+
+// NewRedisJobStore creates a job store backed by the Redis server at addr
+func NewRedisJobStore(addr, password string, db int, ttl time.Duration) *RedisJobStore {
+	return &RedisJobStore{
+		client: NewRedisClient(addr, password, db),
+		ttl:    ttl,
+	}
+}
+
+func (s *RedisJobStore) jobKey(id string) string         { return redisKeyPrefix + "job:" + id }
+func (s *RedisJobStore) resultKey(id string) string      { return redisKeyPrefix + "result:" + id }
+func (s *RedisJobStore) viewsKey(id string) string       { return redisKeyPrefix + "views:" + id }
+func (s *RedisJobStore) annotationsKey(id string) string { return redisKeyPrefix + "annotations:" + id }
+func (s *RedisJobStore) indexKey() string                { return redisKeyPrefix + "jobs" }
+func (s *RedisJobStore) tombstonesKey() string           { return redisKeyPrefix + "tombstones" }
+func (s *RedisJobStore) settingsKey() string             { return redisKeyPrefix + "tenant-settings" }
+func (s *RedisJobStore) dictionariesKey() string         { return redisKeyPrefix + "dictionaries" }
+func (s *RedisJobStore) deliveriesKey() string           { return redisKeyPrefix + "deliveries" }
+
+func (s *RedisJobStore) externalIDKey(tenant, externalID string) string {
+	return redisKeyPrefix + "external:" + tenant + ":" + externalID
+}
+
+func (s *RedisJobStore) reuseIndexKey(tenant, key string) string {
+	return redisKeyPrefix + "reuse:" + tenant + ":" + key
+}
+
+// SaveJob writes the job and adds it to the creation-time index
+func (s *RedisJobStore) SaveJob(job *Job) error {
+	data, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	if err := s.set(s.jobKey(job.ID), data); err != nil {
+		return err
+	}
+	if job.ReuseKey != "" && job.Status == JobCompleted {
+		if err := s.set(s.reuseIndexKey(job.Tenant, job.ReuseKey), []byte(job.ID)); err != nil {
+			return err
+		}
+	}
+	score := strconv.FormatInt(job.CreatedAt.UnixMilli(), 10)
+	_, err = s.client.Do("ZADD", s.indexKey(), score, job.ID)
+	return err
+}
+
+// GetJob reads a job by ID
+func (s *RedisJobStore) GetJob(id string) (*Job, error) {
+	var job Job
+	if err := s.get(s.jobKey(id), &job); err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+// ListJobs returns up to limit jobs, most recent first. Index entries of
+// expired jobs are pruned along the way.
+func (s *RedisJobStore) ListJobs(limit int) ([]*Job, error) {
+	cutoff := strconv.FormatInt(time.Now().Add(-s.ttl).UnixMilli(), 10)
+	if _, err := s.client.Do("ZREMRANGEBYSCORE", s.indexKey(), "-inf", "("+cutoff); err != nil {
+		return nil, err
+	}
+
+	stop := "-1"
+	if limit > 0 {
+		stop = strconv.Itoa(limit - 1)
+	}
+	reply, err := s.client.Do("ZREVRANGE", s.indexKey(), "0", stop)
+	if err != nil {
+		return nil, err
+	}
+	ids, _ := reply.([]interface{})
+
+	jobs := make([]*Job, 0, len(ids))
+	for _, id := range ids {
+		job, err := s.GetJob(fmt.Sprint(id))
+		if errors.Is(err, ErrJobNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, job)
+	}
+	return jobs, nil
+}
+
+// SaveResult writes the result of a job
+func (s *RedisJobStore) SaveResult(id string, result *OutputFormat) error {
+	data, err := json.Marshal(result)
+	if err != nil {
+		return err
+	}
+	return s.set(s.resultKey(id), data)
+}
+
+// GetResult reads the result of a job
+func (s *RedisJobStore) GetResult(id string) (*OutputFormat, error) {
+	var result OutputFormat
+	if err := s.get(s.resultKey(id), &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// SaveViews replaces the hash of a job's materialized views
+func (s *RedisJobStore) SaveViews(id string, views map[string]*OutputFormat) error {
+	if _, err := s.client.Do("DEL", s.viewsKey(id)); err != nil {
+		return err
+	}
+	if len(views) == 0 {
+		return nil
+	}
+	args := []string{"HSET", s.viewsKey(id)}
+	for name, view := range views {
+		data, err := json.Marshal(view)
+		if err != nil {
+			return err
+		}
+		args = append(args, name, string(data))
+	}
+	if _, err := s.client.Do(args...); err != nil {
+		return err
+	}
+	_, err := s.client.Do("PEXPIRE", s.viewsKey(id), strconv.FormatInt(s.ttl.Milliseconds(), 10))
+	return err
+}
+
+// GetView reads a materialized view of a job's result
+func (s *RedisJobStore) GetView(id, name string) (*OutputFormat, error) {
+	reply, err := s.client.Do("HGET", s.viewsKey(id), name)
+	if err != nil {
+		return nil, err
+	}
+	if reply == nil {
+		return nil, ErrJobNotFound
+	}
+	var view OutputFormat
+	if err := json.Unmarshal([]byte(reply.(string)), &view); err != nil {
+		return nil, err
+	}
+	return &view, nil
+}
+
+// Usage counts the retained jobs and their results. Bytes is the memory
+// used by the whole Redis server, which may hold other data too.
+func (s *RedisJobStore) Usage() (StorageUsage, error) {
+	reply, err := s.client.Do("ZRANGE", s.indexKey(), "0", "-1")
+	if err != nil {
+		return StorageUsage{}, err
+	}
+	ids, _ := reply.([]interface{})
+	usage := StorageUsage{Jobs: len(ids)}
+	if len(ids) > 0 {
+		args := make([]string, 0, len(ids)+1)
+		args = append(args, "EXISTS")
+		for _, id := range ids {
+			args = append(args, s.resultKey(fmt.Sprint(id)))
+		}
+		reply, err := s.client.Do(args...)
+		if err != nil {
+			return usage, err
+		}
+		results, _ := reply.(int64)
+		usage.Results = int(results)
+	}
+
+	reply, err = s.client.Do("INFO", "memory")
+	if err != nil {
+		return usage, err
+	}
+	info, _ := reply.(string)
+	for _, line := range strings.Split(info, "\n") {
+		if value, ok := strings.CutPrefix(strings.TrimSpace(line), "used_memory:"); ok {
+			usage.Bytes, _ = strconv.ParseInt(value, 10, 64)
+		}
+	}
+	return usage, nil
+}
+
+// AddAnnotation appends an annotation to the job's annotation list
+func (s *RedisJobStore) AddAnnotation(id string, annotation Annotation) error {
+	if _, err := s.GetJob(id); err != nil {
+		return err
+	}
+	data, err := json.Marshal(annotation)
+	if err != nil {
+		return err
+	}
+	key := s.annotationsKey(id)
+	if _, err := s.client.Do("RPUSH", key, string(data)); err != nil {
+		return err
+	}
+	_, err = s.client.Do("PEXPIRE", key, strconv.FormatInt(s.ttl.Milliseconds(), 10))
+	return err
+}
+
+// Annotations returns the annotations of a job in the order they were added
+func (s *RedisJobStore) Annotations(id string) ([]Annotation, error) {
+	if _, err := s.GetJob(id); err != nil {
+		return nil, err
+	}
+	reply, err := s.client.Do("LRANGE", s.annotationsKey(id), "0", "-1")
+	if err != nil {
+		return nil, err
+	}
+	items, _ := reply.([]interface{})
+	annotations := make([]Annotation, 0, len(items))
+	for _, item := range items {
+		var annotation Annotation
+		if err := json.Unmarshal([]byte(fmt.Sprint(item)), &annotation); err != nil {
+			return nil, err
+		}
+		annotations = append(annotations, annotation)
+	}
+	return annotations, nil
+}
+
+// ClaimExternalID records the job holding a tenant's external ID. SET NX
+// makes the claim atomic across replicas.
+func (s *RedisJobStore) ClaimExternalID(tenant, externalID, jobID string) (string, error) {
+	key := s.externalIDKey(tenant, externalID)
+	reply, err := s.client.Do("SET", key, jobID, "NX", "PX", strconv.FormatInt(s.ttl.Milliseconds(), 10))
+	if err != nil {
+		return "", err
+	}
+	if reply != nil {
+		return jobID, nil
+	}
+	return s.FindExternalID(tenant, externalID)
+}
+
+// FindExternalID returns the job holding a tenant's external ID
+func (s *RedisJobStore) FindExternalID(tenant, externalID string) (string, error) {
+	reply, err := s.client.Do("GET", s.externalIDKey(tenant, externalID))
+	if err != nil {
+		return "", err
+	}
+	if reply == nil {
+		return "", ErrJobNotFound
+	}
+	return fmt.Sprint(reply), nil
+}
+
+// FindReuseKey returns the last completed job saved with a tenant's reuse
+// key
+func (s *RedisJobStore) FindReuseKey(tenant, key string) (string, error) {
+	reply, err := s.client.Do("GET", s.reuseIndexKey(tenant, key))
+	if err != nil {
+		return "", err
+	}
+	if reply == nil {
+		return "", ErrJobNotFound
+	}
+	return fmt.Sprint(reply), nil
+}
+
+// DeleteAnnotations removes a job's annotations on the given rows by
+// rewriting its annotation list
+func (s *RedisJobStore) DeleteAnnotations(id string, rows []string) (int, error) {
+	annotations, err := s.Annotations(id)
+	if err != nil {
+		return 0, err
+	}
+	deleted := make(map[string]bool, len(rows))
+	for _, row := range rows {
+		deleted[row] = true
+	}
+	args := []string{"RPUSH", s.annotationsKey(id)}
+	for _, annotation := range annotations {
+		if deleted[annotation.Row] {
+			continue
+		}
+		data, err := json.Marshal(annotation)
+		if err != nil {
+			return 0, err
+		}
+		args = append(args, string(data))
+	}
+	removed := len(annotations) - (len(args) - 2)
+	if removed == 0 {
+		return 0, nil
+	}
+
+	if _, err := s.client.Do("DEL", s.annotationsKey(id)); err != nil {
+		return 0, err
+	}
+	if len(args) > 2 {
+		if _, err := s.client.Do(args...); err != nil {
+			return 0, err
+		}
+		if _, err := s.client.Do("PEXPIRE", s.annotationsKey(id), strconv.FormatInt(s.ttl.Milliseconds(), 10)); err != nil {
+			return 0, err
+		}
+	}
+	return removed, nil
+}
+
+// AddTombstone appends a purge to the tombstone list, which never expires
+func (s *RedisJobStore) AddTombstone(tombstone *Tombstone) error {
+	data, err := json.Marshal(tombstone)
+	if err != nil {
+		return err
+	}
+	_, err = s.client.Do("RPUSH", s.tombstonesKey(), string(data))
+	return err
+}
+
+// Tombstones returns the recorded purges, oldest first
+func (s *RedisJobStore) Tombstones() ([]*Tombstone, error) {
+	reply, err := s.client.Do("LRANGE", s.tombstonesKey(), "0", "-1")
+	if err != nil {
+		return nil, err
+	}
+	items, _ := reply.([]interface{})
+	tombstones := make([]*Tombstone, 0, len(items))
+	for _, item := range items {
+		var tombstone Tombstone
+		if err := json.Unmarshal([]byte(fmt.Sprint(item)), &tombstone); err != nil {
+			return nil, err
+		}
+		tombstones = append(tombstones, &tombstone)
+	}
+	return tombstones, nil
+}
+
+// GetTenantSettings reads a tenant's settings from the settings hash
+func (s *RedisJobStore) GetTenantSettings(tenant string) (*TenantSettings, error) {
+	reply, err := s.client.Do("HGET", s.settingsKey(), tenant)
+	if err != nil {
+		return nil, err
+	}
+	if reply == nil {
+		return nil, ErrSettingsNotFound
+	}
+	var settings TenantSettings
+	if err := json.Unmarshal([]byte(fmt.Sprint(reply)), &settings); err != nil {
+		return nil, err
+	}
+	return &settings, nil
+}
+
+// SaveTenantSettings writes a tenant's settings to the settings hash,
+// which never expires
+func (s *RedisJobStore) SaveTenantSettings(settings *TenantSettings) error {
+	data, err := json.Marshal(settings)
+	if err != nil {
+		return err
+	}
+	_, err = s.client.Do("HSET", s.settingsKey(), settings.Tenant, string(data))
+	return err
+}
+
+// DeleteTenantSettings removes a tenant's settings from the settings hash
+func (s *RedisJobStore) DeleteTenantSettings(tenant string) error {
+	reply, err := s.client.Do("HDEL", s.settingsKey(), tenant)
+	if err != nil {
+		return err
+	}
+	if n, _ := reply.(int64); n == 0 {
+		return ErrSettingsNotFound
+	}
+	return nil
+}
+
+// ListTenantSettings reads the settings hash, by tenant
+func (s *RedisJobStore) ListTenantSettings() ([]*TenantSettings, error) {
+	reply, err := s.client.Do("HGETALL", s.settingsKey())
+	if err != nil {
+		return nil, err
+	}
+	items, _ := reply.([]interface{})
+	list := make([]*TenantSettings, 0, len(items)/2)
+	for i := 1; i < len(items); i += 2 {
+		var settings TenantSettings
+		if err := json.Unmarshal([]byte(fmt.Sprint(items[i])), &settings); err != nil {
+			return nil, err
+		}
+		list = append(list, &settings)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Tenant < list[j].Tenant })
+	return list, nil
+}
+
+// GetDictionary reads a tenant's dictionary from the dictionaries hash
+func (s *RedisJobStore) GetDictionary(tenant string) (*Dictionary, error) {
+	reply, err := s.client.Do("HGET", s.dictionariesKey(), tenant)
+	if err != nil {
+		return nil, err
+	}
+	if reply == nil {
+		return nil, ErrDictionaryNotFound
+	}
+	var dictionary Dictionary
+	if err := json.Unmarshal([]byte(fmt.Sprint(reply)), &dictionary); err != nil {
+		return nil, err
+	}
+	return &dictionary, nil
+}
+
+// SaveDictionary writes a tenant's dictionary to the dictionaries hash,
+// which never expires
+func (s *RedisJobStore) SaveDictionary(dictionary *Dictionary) error {
+	data, err := json.Marshal(dictionary)
+	if err != nil {
+		return err
+	}
+	_, err = s.client.Do("HSET", s.dictionariesKey(), dictionary.Tenant, string(data))
+	return err
+}
+
+// DeleteDictionary removes a tenant's dictionary from the dictionaries hash
+func (s *RedisJobStore) DeleteDictionary(tenant string) error {
+	reply, err := s.client.Do("HDEL", s.dictionariesKey(), tenant)
+	if err != nil {
+		return err
+	}
+	if n, _ := reply.(int64); n == 0 {
+		return ErrDictionaryNotFound
+	}
+	return nil
+}
+
+// GetDelivery reads a parked delivery from the deliveries hash
+func (s *RedisJobStore) GetDelivery(id string) (*Delivery, error) {
+	reply, err := s.client.Do("HGET", s.deliveriesKey(), id)
+	if err != nil {
+		return nil, err
+	}
+	if reply == nil {
+		return nil, ErrDeliveryNotFound
+	}
+	var d Delivery
+	if err := json.Unmarshal([]byte(fmt.Sprint(reply)), &d); err != nil {
+		return nil, err
+	}
+	return &d, nil
+}
+
+// SaveDelivery writes a parked delivery to the deliveries hash, which never
+// expires
+func (s *RedisJobStore) SaveDelivery(d *Delivery) error {
+	data, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+	_, err = s.client.Do("HSET", s.deliveriesKey(), d.ID, string(data))
+	return err
+}
+
+// DeleteDelivery removes a parked delivery from the deliveries hash
+func (s *RedisJobStore) DeleteDelivery(id string) error {
+	reply, err := s.client.Do("HDEL", s.deliveriesKey(), id)
+	if err != nil {
+		return err
+	}
+	if n, _ := reply.(int64); n == 0 {
+		return ErrDeliveryNotFound
+	}
+	return nil
+}
+
+// ListDeliveries reads the deliveries hash, oldest first
+func (s *RedisJobStore) ListDeliveries() ([]*Delivery, error) {
+	reply, err := s.client.Do("HGETALL", s.deliveriesKey())
+	if err != nil {
+		return nil, err
+	}
+	items, _ := reply.([]interface{})
+	list := make([]*Delivery, 0, len(items)/2)
+	for i := 1; i < len(items); i += 2 {
+		var d Delivery
+		if err := json.Unmarshal([]byte(fmt.Sprint(items[i])), &d); err != nil {
+			return nil, err
+		}
+		list = append(list, &d)
+	}
+	sortDeliveries(list)
+	return list, nil
+}
+
+// set writes a value with the store's TTL
+func (s *RedisJobStore) set(key string, data []byte) error {
+	_, err := s.client.Do("SET", key, string(data), "PX", strconv.FormatInt(s.ttl.Milliseconds(), 10))
+	return err
+}
+
+// get reads and decodes a JSON value, returning ErrJobNotFound if missing
+func (s *RedisJobStore) get(key string, v interface{}) error {
+	reply, err := s.client.Do("GET", key)
+	if err != nil {
+		return err
+	}
+	if reply == nil {
+		return ErrJobNotFound
+	}
+	return json.Unmarshal([]byte(reply.(string)), v)
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Columns checked against reference lists
+const (
+	labelColumn        = "Label Name"
+	rightsHolderColumn = "Rights Holder"
+)
+
+// Reference suggestions: the number offered for an unknown name, and the
+// number of unknown names whose suggestions are remembered, per list
+const (
+	maxReferenceSuggestions  = 3
+	referenceSuggestionCache = 10000
+)
+
+// referenceList is a list of approved names a column is checked against,
+// such as the labels a distributor has signed
+type referenceList struct {
+	// column is the column checked, and noun what its values are called
+	column, noun string
+
+	// names maps each name in its matching form to its spelling in the list
+	names map[string]string
+	// keys holds each name's comparison key, for suggestions
+	keys map[string]string
+
+	suggestions sync.Map
+	cached      atomic.Int64
+}
+
+// Reference lists of LABELS_FILE and RIGHTS_HOLDERS_FILE, or nil if the
+// column is not checked
+var (
+	labels        = loadReferenceList("LABELS_FILE", cfg.LabelsFile, cfg.LabelsTable, labelColumn, "label")
+	rightsHolders = loadReferenceList("RIGHTS_HOLDERS_FILE", cfg.RightsHoldersFile, cfg.RightsHoldersTable, rightsHolderColumn, "rights holder")
+)
+
+// loadReferenceList reads a reference list from a CSV file with a header
+// row, or from a table of a SQLite database. The names are taken from the
+// column named like the checked column, else from a column called name,
+// else from the first column.
+func loadReferenceList(variable, path, table, column, noun string) *referenceList {
+	if path == "" {
+		return nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		log.Fatalf("Failed to read %s: %v", variable, err)
+	}
+
+	var header []string
+	var rows [][]string
+	if isSQLite(data) {
+		header, rows, err = readSQLiteTable(data, table)
+	} else {
+		reader := csv.NewReader(bytes.NewReader(bytes.TrimPrefix(data, []byte("\xef\xbb\xbf"))))
+		reader.FieldsPerRecord = -1
+		rows, err = reader.ReadAll()
+		if len(rows) > 0 {
+			header, rows = rows[0], rows[1:]
+		}
+	}
+	if err != nil {
+		log.Fatalf("Failed to read %s: %v", variable, err)
+	}
+
+	index := referenceColumn(header, column)
+	list := &referenceList{column: column, noun: noun, names: make(map[string]string), keys: make(map[string]string)}
+	for _, row := range rows {
+		if index >= len(row) {
+			continue
+		}
+		name := strings.TrimSpace(row[index])
+		if name == "" {
+			continue
+		}
+		list.names[dictionaryKey(name)] = name
+		list.keys[name] = genreKey(name)
+	}
+	if len(list.names) == 0 {
+		log.Fatalf("%s %s lists no names", variable, path)
+	}
+	return list
+}
+
+// referenceColumn returns the index of the column of a reference list
+// holding the names of a checked column
+func referenceColumn(header []string, column string) int {
+	for _, want := range []string{normalizeColumnName(column), "name"} {
+		for i, name := range header {
+			if normalizeColumnName(name) == want {
+				return i
+			}
+		}
+	}
+	return 0
+}
+
+// check rewrites the value of the list's column in a record in the list's
+// spelling and returns the issue found with it and the closest names of
+// the list, if it is not in it. Names match regardless of case and
+// spacing. Records without the column, with it empty, or checked without
+// a list pass.
+func (l *referenceList) check(record map[string]string) ([]string, []string) {
+	if l == nil {
+		return nil, nil
+	}
+	value := strings.TrimSpace(record[l.column])
+	if value == "" {
+		return nil, nil
+	}
+	if name, ok := l.names[dictionaryKey(value)]; ok {
+		record[l.column] = name
+		return nil, nil
+	}
+	return []string{fmt.Sprintf("unknown %s %q", l.noun, value)}, l.suggest(value)
+}
+
+// suggest returns the names of the list closest to an unknown one
+func (l *referenceList) suggest(value string) []string {
+	if cached, ok := l.suggestions.Load(value); ok {
+		return cached.([]string)
+	}
+	suggestions := closestNames(value, l.keys, maxReferenceSuggestions)
+	if l.cached.Load() < referenceSuggestionCache {
+		if _, loaded := l.suggestions.LoadOrStore(value, suggestions); !loaded {
+			l.cached.Add(1)
+		}
+	}
+	return suggestions
+}
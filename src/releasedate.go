@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// releaseDateColumn is the column holding each release's date
+const releaseDateColumn = "Release Date"
+
+// earliestReleaseYear is the first year a release date may fall in
+const earliestReleaseYear = 1900
+
+// releaseDateLayouts are the other formats release dates are recognised in
+// and converted from: day first with slashes, month first with dashes, and
+// month names
+var releaseDateLayouts = []string{"2/1/2006", "1-2-2006", "Jan 2, 2006", "January 2, 2006"}
+
+// convertReleaseDate rewrites the release date of a record written in one
+// of releaseDateLayouts as YYYY-MM-DD, and returns the date as written. It
+// returns "" for dates left as they are.
+func convertReleaseDate(record map[string]string) string {
+	value := strings.TrimSpace(record[releaseDateColumn])
+	if value == "" || dateRegex.MatchString(value) {
+		return ""
+	}
+	for _, layout := range releaseDateLayouts {
+		if date, err := time.Parse(layout, value); err == nil {
+			original := record[releaseDateColumn]
+			record[releaseDateColumn] = date.Format("2006-01-02")
+			return original
+		}
+	}
+	return ""
+}
+
+// checkReleaseDate returns the issues found with a release date that has
+// the YYYY-MM-DD format: it must be a calendar date, not before 1900 and,
+// when RELEASE_DATE_MAX_FUTURE_DAYS is set, no further ahead than that.
+// Dates of another format are left to the date_format check, and empty
+// dates pass.
+func checkReleaseDate(record map[string]string, now time.Time) []string {
+	value := strings.TrimSpace(record[releaseDateColumn])
+	if !dateRegex.MatchString(value) {
+		return nil
+	}
+	date, err := time.Parse("2006-01-02", value)
+	if err != nil {
+		return []string{fmt.Sprintf("%s is not a calendar date", value)}
+	}
+	if date.Year() < earliestReleaseYear {
+		return []string{fmt.Sprintf("%s is before %d", value, earliestReleaseYear)}
+	}
+	if days := cfg.ReleaseDateMaxFutureDays; days > 0 {
+		year, month, day := now.UTC().Date()
+		if latest := time.Date(year, month, day+days, 0, 0, 0, 0, time.UTC); date.After(latest) {
+			return []string{fmt.Sprintf("%s is more than %d days in the future", value, days)}
+		}
+	}
+	return nil
+}
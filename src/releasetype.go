@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// releaseTypeColumn is the optional column giving each row's release type
+const releaseTypeColumn = "Release Type"
+
+// canonicalReleaseType returns the allowed release type a value names,
+// ignoring case and surrounding spaces, in its configured spelling
+func canonicalReleaseType(value string) (string, bool) {
+	value = strings.TrimSpace(value)
+	for _, releaseType := range cfg.ReleaseTypes {
+		if strings.EqualFold(value, releaseType) {
+			return releaseType, true
+		}
+	}
+	return "", false
+}
+
+// checkReleaseType rewrites the release type of a record in its canonical
+// spelling and returns the issue found, if any. Records without the column
+// pass.
+func checkReleaseType(record map[string]string) []string {
+	value, ok := record[releaseTypeColumn]
+	if !ok {
+		return nil
+	}
+	if strings.TrimSpace(value) == "" {
+		return []string{"missing release type"}
+	}
+	releaseType, ok := canonicalReleaseType(value)
+	if !ok {
+		return []string{fmt.Sprintf("unknown release type %q, expected one of %s", value, strings.Join(cfg.ReleaseTypes, ", "))}
+	}
+	record[releaseTypeColumn] = releaseType
+	return nil
+}
+
+// releaseTypeCounts counts the rows of each allowed release type
+type releaseTypeCounts map[string]int
+
+func (c releaseTypeCounts) add(record map[string]string) {
+	if releaseType, ok := canonicalReleaseType(record[releaseTypeColumn]); ok {
+		c[releaseType]++
+	}
+}
+
+// report returns the counts, or nil if no row has a release type
+func (c releaseTypeCounts) report() map[string]int {
+	if len(c) == 0 {
+		return nil
+	}
+	return c
+}
+
+// checkSingleReleaseType fails with the breakdown if the rows of a dataset
+// are of more than one release type
+func checkSingleReleaseType(counts map[string]int) error {
+	if len(counts) < 2 {
+		return nil
+	}
+	breakdown := make([]string, 0, len(counts))
+	for _, releaseType := range sortedKeys(counts) {
+		rows := "rows"
+		if counts[releaseType] == 1 {
+			rows = "row"
+		}
+		breakdown = append(breakdown, fmt.Sprintf("%s: %d %s", releaseType, counts[releaseType], rows))
+	}
+	return fileErrorf(http.StatusUnprocessableEntity, "file mixes release types (%s); submit each release type separately", strings.Join(breakdown, ", "))
+}
+
+// mergeReleaseTypes adds up the release types of two parts of a dataset
+func mergeReleaseTypes(a, b map[string]int) map[string]int {
+	counts := make(releaseTypeCounts)
+	for _, part := range []map[string]int{a, b} {
+		for releaseType, rows := range part {
+			counts[releaseType] += rows
+		}
+	}
+	return counts.report()
+}
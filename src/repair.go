@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// upcLength is the length of a UPC-A code. Shorter codes are restored to
+// it; EAN-13 codes with a leading zero are the same GTIN either way.
+const upcLength = 12
+
+// scientificRegex matches numbers as Excel displays large values in
+// scientific notation, such as 8.85123E+11
+var scientificRegex = regexp.MustCompile(`^([0-9])(?:[.,]([0-9]*))?[eE]\+?([0-9]{1,2})$`)
+
+// repairNumerics reverses the damage Excel does to the UPC column of a
+// record when a spreadsheet is saved back to CSV: large numbers written in
+// scientific notation and leading zeros dropped. It returns the number of
+// cells repaired and issues for values that cannot be repaired without
+// guessing.
+func repairNumerics(record map[string]string) (repaired int, issues []string) {
+	value, ok := record["UPC"]
+	if !ok {
+		return 0, nil
+	}
+	fixed, issue := repairUPC(strings.TrimSpace(value))
+	if issue != "" {
+		return 0, []string{fmt.Sprintf("UPC %s: %s", value, issue)}
+	}
+	if fixed == value {
+		return 0, nil
+	}
+	record["UPC"] = fixed
+	return 1, nil
+}
+
+// repairUPC returns the UPC a cell held before Excel mangled it, or why it
+// cannot be known
+func repairUPC(value string) (string, string) {
+	if m := scientificRegex.FindStringSubmatch(value); m != nil {
+		digits := m[1] + m[2]
+		exponent, _ := strconv.Atoi(m[3])
+		// Excel keeps 15 significant digits but displays fewer, so the
+		// digits past those shown are lost unless none are missing
+		if len(digits) > exponent+1 || exponent+1 > 14 {
+			return "", "not a whole number of UPC length"
+		}
+		if len(digits) < exponent+1 {
+			return "", "digits lost to scientific notation; re-export with the column formatted as text"
+		}
+		value = digits
+	}
+	if value == "" || !isDigits(value) || len(value) >= upcLength {
+		return value, ""
+	}
+	padded := strings.Repeat("0", upcLength-len(value)) + value
+	if !validGTIN(padded) {
+		return "", "too short, and not a valid UPC once leading zeros are restored"
+	}
+	return padded, ""
+}
+
+// validUPC reports whether a UPC is a UPC-A or EAN-13 code with a correct
+// GS1 check digit. Empty UPCs pass; REQUIRED_COLUMNS can require them.
+func validUPC(value string) bool {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return true
+	}
+	return (len(value) == upcLength || len(value) == upcLength+1) && isDigits(value) && validGTIN(value)
+}
+
+// validGTIN reports whether the last digit of a GTIN is its check digit
+func validGTIN(code string) bool {
+	sum := 0
+	for i := len(code) - 2; i >= 0; i-- {
+		digit := int(code[i] - '0')
+		if (len(code)-2-i)%2 == 0 {
+			digit *= 3
+		}
+		sum += digit
+	}
+	return (10-sum%10)%10 == int(code[len(code)-1]-'0')
+}
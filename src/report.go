@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// maxReportRows limits the failing rows listed in a report
+const maxReportRows = 1000
+
+// reportBar is a bar of a report chart, its width a percentage of the
+// longest bar
+type reportBar struct {
+	Label string
+	Count int
+	Width float64
+}
+
+// reportRow is a failing row listed in a report
+type reportRow struct {
+	Line      int
+	TrackID   string
+	ReleaseID string
+	Reasons   string
+}
+
+// reportData is what a report is rendered from
+type reportData struct {
+	Job         *Job
+	Result      *OutputFormat
+	Generated   time.Time
+	Rows        int
+	Passed      int
+	Failed      int
+	PassedWidth float64
+	Checks      []reportBar
+	Types       []reportBar
+	PII         []reportBar
+	Failing     []reportRow
+	MoreFailing int
+}
+
+// newReportBars turns counts into chart bars, largest first
+func newReportBars(counts map[string]int) []reportBar {
+	bars := make([]reportBar, 0, len(counts))
+	largest := 0
+	for label, count := range counts {
+		bars = append(bars, reportBar{Label: label, Count: count})
+		largest = max(largest, count)
+	}
+	sort.Slice(bars, func(i, j int) bool {
+		if bars[i].Count != bars[j].Count {
+			return bars[i].Count > bars[j].Count
+		}
+		return bars[i].Label < bars[j].Label
+	})
+	for i := range bars {
+		if largest > 0 {
+			bars[i].Width = 100 * float64(bars[i].Count) / float64(largest)
+		}
+	}
+	return bars
+}
+
+// writeReport renders a job and its result as a standalone HTML page, with
+// the styles and charts inline so it can be shared as a single file
+func writeReport(job *Job, result *OutputFormat) ([]byte, error) {
+	data := reportData{Job: job, Result: result, Generated: time.Now().UTC(), Rows: len(result.Conversion.Rows)}
+	failures := make(map[string]int)
+	for i, row := range result.Conversion.Rows {
+		v, ok := result.Validation[row["Track ID"]]
+		if !ok {
+			continue
+		}
+		for _, check := range v.FailedChecks() {
+			failures[check]++
+		}
+		if !v.Failed() {
+			continue
+		}
+		data.Failed++
+		if len(data.Failing) < maxReportRows {
+			data.Failing = append(data.Failing, reportRow{Line: i + 1, TrackID: v.TrackID, ReleaseID: v.ReleaseID, Reasons: failureReasons(v)})
+		} else {
+			data.MoreFailing++
+		}
+	}
+	data.Passed = data.Rows - data.Failed
+	if data.Rows > 0 {
+		data.PassedWidth = 100 * float64(data.Passed) / float64(data.Rows)
+	}
+	data.Checks = newReportBars(failures)
+	data.Types = newReportBars(result.Metadata.ReleaseTypes)
+	pii := make(map[string]int)
+	for column, kinds := range result.PII {
+		for kind, count := range kinds {
+			pii[column+" ("+kind+")"] += count
+		}
+	}
+	data.PII = newReportBars(pii)
+
+	var buf bytes.Buffer
+	if err := reportTemplate.Execute(&buf, data); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// reportHandler returns a job's validation results as a self-contained
+// HTML report, for sharing with people who cannot reach the server, e.g.
+// GET /jobs/{id}/report.html
+func reportHandler(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	job, err := jobStore.GetJob(id)
+	if err != nil {
+		writeStoreError(w, "Failed to get job: ", err)
+		return
+	}
+	result, err := jobStore.GetResult(id)
+	if err != nil {
+		writeStoreError(w, "Failed to get result: ", err)
+		return
+	}
+	data, err := writeReport(job, result)
+	if err != nil {
+		http.Error(w, "Failed to write report: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	serveDownload(w, r, "report-"+id+".html", "text/html; charset=utf-8", data)
+}
+
+// reportTemplate is the page of a report. Charts are drawn with CSS so
+// the page needs nothing but itself.
+var reportTemplate = template.Must(template.New("report").Funcs(template.FuncMap{
+	"percent": func(part, whole int) string {
+		if whole == 0 {
+			return "0%"
+		}
+		return fmt.Sprintf("%.1f%%", 100*float64(part)/float64(whole))
+	},
+	"width": func(width float64) template.CSS { return template.CSS(fmt.Sprintf("width: %.2f%%", width)) },
+	"time":  func(t time.Time) string { return t.UTC().Format("2006-01-02 15:04 MST") },
+}).Parse(`{{define "bars"}}<div class="bars">
+{{range .}}<div class="bar-label">{{.Label}}</div><div class="bar-track"><div class="bar" style="{{width .Width}}"></div></div><div class="bar-count">{{.Count}}</div>
+{{end}}</div>{{end}}<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>Validation report: {{.Job.Filename}}</title>
+<style>
+body { font-family: Arial, sans-serif; max-width: 1000px; margin: 0 auto; padding: 20px; color: #222; }
+h1 { font-size: 1.5em; margin-bottom: 0; }
+h2 { font-size: 1.2em; margin-top: 2em; border-bottom: 1px solid #ddd; padding-bottom: 4px; }
+.subtitle, .note { color: #666; font-size: 0.9em; }
+.tiles { display: flex; gap: 12px; margin: 20px 0 8px; }
+.tile { flex: 1; border: 1px solid #ddd; border-radius: 4px; padding: 12px; }
+.tile .value { font-size: 1.8em; font-weight: bold; }
+.passed .value { color: #2e7d32; }
+.failed .value { color: #c62828; }
+.split { display: flex; height: 16px; border-radius: 4px; overflow: hidden; background: #e57373; }
+.split .ok { background: #66bb6a; }
+.bars { display: grid; grid-template-columns: max-content 1fr max-content; gap: 6px 10px; align-items: center; }
+.bar-track { background: #f2f2f2; border-radius: 3px; }
+.bar { height: 14px; background: #5c6bc0; border-radius: 3px; min-width: 2px; }
+.bar-count { text-align: right; font-variant-numeric: tabular-nums; }
+table { width: 100%; border-collapse: collapse; font-size: 0.9em; }
+th, td { border: 1px solid #ddd; padding: 6px 8px; text-align: left; vertical-align: top; }
+th { background: #f2f2f2; }
+tr:nth-child(even) { background: #f9f9f9; }
+</style>
+</head>
+<body>
+<h1>Validation report: {{.Job.Filename}}</h1>
+<p class="subtitle">Job {{.Job.ID}}{{if .Job.Tenant}} · tenant {{.Job.Tenant}}{{end}}{{with .Result.Metadata.Profile}} · profile {{.}}{{end}} · uploaded {{time .Job.CreatedAt}} · report generated {{time .Generated}}</p>
+
+<div class="tiles">
+<div class="tile"><div>Rows</div><div class="value">{{.Rows}}</div></div>
+<div class="tile passed"><div>Passed</div><div class="value">{{.Passed}}</div><div>{{percent .Passed .Rows}}</div></div>
+<div class="tile failed"><div>Failed</div><div class="value">{{.Failed}}</div><div>{{percent .Failed .Rows}}</div></div>
+</div>
+<div class="split" role="img" aria-label="{{.Passed}} rows passed, {{.Failed}} failed"><div class="ok" style="{{width .PassedWidth}}"></div></div>
+
+<h2>Failures by check</h2>
+{{if .Checks}}{{template "bars" .Checks}}{{else}}<p>Every row passed every check.</p>{{end}}
+
+{{if .Types}}<h2>Release types</h2>
+{{template "bars" .Types}}{{end}}
+
+{{if .PII}}<h2>Possible personal data</h2>
+{{template "bars" .PII}}{{end}}
+
+{{with .Result.Warnings}}<h2>Warnings</h2>
+<ul>{{range .}}<li>{{.}}</li>{{end}}</ul>{{end}}
+
+{{if .Failing}}<h2>Failing rows</h2>
+<table>
+<thead><tr><th>Row</th><th>Track ID</th><th>Release ID</th><th>Failed checks</th></tr></thead>
+<tbody>
+{{range .Failing}}<tr><td>{{.Line}}</td><td>{{.TrackID}}</td><td>{{.ReleaseID}}</td><td>{{.Reasons}}</td></tr>
+{{end}}</tbody>
+</table>
+{{if .MoreFailing}}<p class="note">{{.MoreFailing}} further failing rows are not listed.</p>{{end}}{{end}}
+
+{{with .Result.Metadata.Substitutions}}<h2>Name substitutions</h2>
+<table>
+<thead><tr><th>Column</th><th>Replaced</th><th>With</th><th>Rows</th></tr></thead>
+<tbody>
+{{range .}}<tr><td>{{.Column}}</td><td>{{.From}}</td><td>{{.To}}</td><td>{{.Rows}}</td></tr>
+{{end}}</tbody>
+</table>{{end}}
+
+<h2>File</h2>
+<table>
+<tbody>
+<tr><th>Columns</th><td>{{len .Result.Metadata.Columns}}</td></tr>
+{{with .Result.Metadata.Delimiter}}<tr><th>Delimiter</th><td>{{.}}</td></tr>{{end}}
+{{with .Result.Metadata.Dialect}}<tr><th>Quoting</th><td>{{.Quoting}}</td></tr>
+<tr><th>Line endings</th><td>{{.LineEndings}}</td></tr>
+{{with .Deviations}}<tr><th>Deviations</th><td>{{range .}}{{.}}<br>{{end}}</td></tr>{{end}}{{end}}
+{{with .Result.Metadata.SkippedLines}}<tr><th>Lines skipped above the header</th><td>{{.}}</td></tr>{{end}}
+{{with .Result.Metadata.RepairedCells}}<tr><th>Repaired cells</th><td>{{.}}</td></tr>{{end}}
+{{with .Result.Metadata.NormalizedCells}}<tr><th>Normalized cells</th><td>{{.}}</td></tr>{{end}}
+{{with .Result.Metadata.Deduplication}}<tr><th>Duplicate rows removed</th><td>{{.Removed}}</td></tr>{{end}}
+{{with .Result.Metadata.Parts}}<tr><th>Parts</th><td>{{.}}</td></tr>{{end}}
+</tbody>
+</table>
+</body>
+</html>
+`))
@@ -0,0 +1,15 @@
+package main
+
+import "strings"
+
+// missingFields returns the required columns a record leaves empty or
+// lacks, in the order of REQUIRED_COLUMNS
+func missingFields(record map[string]string) []string {
+	var missing []string
+	for _, column := range cfg.RequiredColumns {
+		if strings.TrimSpace(record[column]) == "" {
+			missing = append(missing, column)
+		}
+	}
+	return missing
+}
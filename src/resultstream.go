@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"net/http"
+)
+
+// resultStreamChunk is the number of rows, or row validations, sent to the
+// client at a time
+const resultStreamChunk = 1000
+
+// resultStream writes a result as indented JSON while encoding it, a chunk
+// of rows at a time, so the client receives a large result as it is
+// encoded rather than once the whole document is in memory. The response
+// has no length and is sent with chunked transfer encoding.
+type resultStream struct {
+	w       http.ResponseWriter
+	buf     *bufio.Writer
+	scratch bytes.Buffer
+	pending int
+}
+
+// streamResult writes a result in the given shape. The status is sent
+// before encoding starts, so errors, such as the client going away, can
+// only be returned for logging.
+func streamResult(w http.ResponseWriter, shape resultShape, result *OutputFormat) error {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	s := &resultStream{w: w, buf: bufio.NewWriterSize(w, 64<<10)}
+	result = shape.Filter.apply(result)
+
+	s.buf.WriteString("{\n")
+	conversion := result.Conversion.splitting(shape.Split)
+	if shape.Nested {
+		rows := nestedRows{conversion: conversion, validation: result.Validation, values: shape.Conversion}
+		if err := s.rows("rows", conversion, shape.Conversion, rows.field); err != nil {
+			return err
+		}
+	} else {
+		if err := s.validation(result.Validation); err != nil {
+			return err
+		}
+		if shape.Conversion {
+			if err := s.rows("conversion", conversion, true, nil); err != nil {
+				return err
+			}
+		}
+	}
+
+	if shape.Cells != "" {
+		if err := s.cells(resultCells(result, shape.Cells)); err != nil {
+			return err
+		}
+	}
+
+	// The remaining sections are small; they are written as one object,
+	// less its opening brace
+	tail, err := json.MarshalIndent(newResultTail(result), "", "  ")
+	if err != nil {
+		return err
+	}
+	s.buf.Write(tail[2:])
+	s.buf.WriteByte('\n')
+	return s.flush()
+}
+
+// key starts a section of the result
+func (s *resultStream) key(name string) {
+	k, _ := json.Marshal(name)
+	s.buf.WriteString("  ")
+	s.buf.Write(k)
+	s.buf.WriteString(": ")
+}
+
+// validation writes the validation section, keyed by Track ID in sorted
+// order as encoding/json would
+func (s *resultStream) validation(validation map[string]RowValidation) error {
+	s.key("validation")
+	if validation == nil {
+		s.buf.WriteString("null,\n")
+		return nil
+	}
+	s.buf.WriteByte('{')
+	for i, trackID := range sortedKeys(validation) {
+		if i > 0 {
+			s.buf.WriteByte(',')
+		}
+		k, _ := json.Marshal(trackID)
+		v, err := json.MarshalIndent(validation[trackID], "    ", "  ")
+		if err != nil {
+			return err
+		}
+		s.buf.WriteString("\n    ")
+		s.buf.Write(k)
+		s.buf.WriteString(": ")
+		s.buf.Write(v)
+		if err := s.written(); err != nil {
+			return err
+		}
+	}
+	if len(validation) > 0 {
+		s.buf.WriteString("\n  ")
+	}
+	s.buf.WriteString("},\n")
+	return nil
+}
+
+// rows writes a section of rows as the conversion would be written
+func (s *resultStream) rows(name string, conversion Conversion, values bool, extra rowField) error {
+	s.key(name)
+	known := conversion.known()
+	s.buf.WriteByte('[')
+	var row bytes.Buffer
+	for i, record := range conversion.Rows {
+		if i > 0 {
+			s.buf.WriteByte(',')
+		}
+		row.Reset()
+		if err := conversion.writeRow(&row, record, known, values, extra); err != nil {
+			return err
+		}
+		s.scratch.Reset()
+		if err := json.Indent(&s.scratch, row.Bytes(), "    ", "  "); err != nil {
+			return err
+		}
+		s.buf.WriteString("\n    ")
+		s.buf.Write(s.scratch.Bytes())
+		if err := s.written(); err != nil {
+			return err
+		}
+	}
+	if len(conversion.Rows) > 0 {
+		s.buf.WriteString("\n  ")
+	}
+	s.buf.WriteString("],\n")
+	return nil
+}
+
+// cells writes the cell-level section
+func (s *resultStream) cells(cells []Cell) error {
+	s.key("cells")
+	s.buf.WriteByte('[')
+	for i, cell := range cells {
+		if i > 0 {
+			s.buf.WriteByte(',')
+		}
+		c, err := json.Marshal(cell)
+		if err != nil {
+			return err
+		}
+		s.buf.WriteString("\n    ")
+		s.buf.Write(c)
+		if err := s.written(); err != nil {
+			return err
+		}
+	}
+	if len(cells) > 0 {
+		s.buf.WriteString("\n  ")
+	}
+	s.buf.WriteString("],\n")
+	return nil
+}
+
+// written counts an entry written, sending the chunk to the client once
+// it is complete
+func (s *resultStream) written() error {
+	s.pending++
+	if s.pending < resultStreamChunk {
+		return nil
+	}
+	s.pending = 0
+	return s.flush()
+}
+
+// flush sends what has been written so far to the client
+func (s *resultStream) flush() error {
+	if err := s.buf.Flush(); err != nil {
+		return err
+	}
+	if flusher, ok := s.w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+	return nil
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// presentationFields are the upload fields that change how a result is
+// returned or recorded rather than the result itself, so files uploaded
+// with different values may share a result
+var presentationFields = map[string]bool{
+	"external_id": true,
+	"tenant":      true,
+	"shape":       true,
+	"conversion":  true,
+	"cells":       true,
+	"split":       true,
+	"failures":    true,
+	"label":       true,
+	"genre":       true,
+	"territory":   true,
+	"workers":     true,
+	"reprocess":   true,
+}
+
+// persistentJobStore reports whether jobs outlive this process, which
+// results are only reused with
+func persistentJobStore() bool {
+	return cfg.JobStore == "file" || cfg.JobStore == "redis"
+}
+
+// hashUpload returns the SHA-256 of an uploaded file, or "" if it cannot
+// be read. The file is left at its start.
+func hashUpload(file io.ReadSeeker) string {
+	hash := sha256.New()
+	_, err := io.Copy(hash, file)
+	if _, seekErr := file.Seek(0, io.SeekStart); err == nil {
+		err = seekErr
+	}
+	if err != nil {
+		log.Printf("Failed to hash upload: %v", err)
+		return ""
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// reuseKey identifies the result of processing a file with the options
+// of a request: the file's SHA-256 and the upload fields other than
+// presentationFields
+func reuseKey(r *http.Request, contentHash string) string {
+	names := make([]string, 0, len(r.Form))
+	for name := range r.Form {
+		if !presentationFields[name] {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	hash := sha256.New()
+	fmt.Fprintf(hash, "%s\n", contentHash)
+	for _, name := range names {
+		for _, value := range r.Form[name] {
+			fmt.Fprintf(hash, "%q=%q\n", name, value)
+		}
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// priorResult returns the tenant's completed job that processed the same
+// file with the same options, and its result, if the job store keeps one
+// whose result has not changed since
+func priorResult(tenant, key string) (*Job, *OutputFormat, bool) {
+	id, err := jobStore.FindReuseKey(tenant, key)
+	if err != nil {
+		if !errors.Is(err, ErrJobNotFound) {
+			log.Printf("Failed to look up earlier results: %v", err)
+		}
+		return nil, nil, false
+	}
+	job, err := jobStore.GetJob(id)
+	if err != nil || job.Tenant != tenant || job.ReuseKey != key || job.Status != JobCompleted {
+		return nil, nil, false
+	}
+	result, err := jobStore.GetResult(id)
+	if err != nil {
+		return nil, nil, false
+	}
+	return job, result, true
+}
+
+// reuseResult answers an upload with the result of an earlier job that
+// processed the same file with the same options, with a warning naming it
+func reuseResult(w http.ResponseWriter, shape resultShape, job *Job, result *OutputFormat) {
+	reused := *result
+	finished := job.CreatedAt
+	if job.FinishedAt != nil {
+		finished = *job.FinishedAt
+	}
+	reused.Warnings = append(append([]string(nil), result.Warnings...),
+		fmt.Sprintf("The same file was already processed by job %s at %s; its result is returned. Send reprocess=true to process the file again.",
+			job.ID, finished.UTC().Format(time.RFC3339)))
+	log.Printf("Returning the result of job %s for an upload of the same file", job.ID)
+
+	w.Header().Set("X-Job-ID", job.ID)
+	w.Header().Set("X-Reused-Result", "true")
+	if err := streamResult(w, shape, &reused); err != nil {
+		log.Printf("Failed to send result of job %s: %v", job.ID, err)
+	}
+}
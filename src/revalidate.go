@@ -0,0 +1,313 @@
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"mime"
+	"net/http"
+	"slices"
+	"sync"
+)
+
+// maxRevalidateSize limits the size of a revalidation request; it carries
+// corrected rows only, not a whole file
+const maxRevalidateSize = 10 << 20
+
+// resultMutex serialises revalidations and purges, which read, modify and
+// write back stored results
+var resultMutex sync.Mutex
+
+// RevalidateResponse is the outcome of re-running validation on corrected rows
+type RevalidateResponse struct {
+	Validation map[string]RowValidation `json:"validation"`
+	Unmatched  []string                 `json:"unmatched,omitempty"`
+	FailedRows int                      `json:"failed_rows"`
+}
+
+// revalidateHandler re-runs validation for corrected rows of a completed job
+// and merges the outcome into its stored result. Rows are matched to the
+// original ones by Track ID, and only the columns supplied are replaced.
+func revalidateHandler(w http.ResponseWriter, r *http.Request) {
+	jobID := r.PathValue("id")
+
+	resultMutex.Lock()
+	defer resultMutex.Unlock()
+
+	job, err := jobStore.GetJob(jobID)
+	if err != nil {
+		writeStoreError(w, "Failed to get job: ", err)
+		return
+	}
+	if job.Status != JobCompleted {
+		http.Error(w, "Only completed jobs can be revalidated, job is "+job.Status, http.StatusConflict)
+		return
+	}
+	result, err := jobStore.GetResult(jobID)
+	if err != nil {
+		writeStoreError(w, "Failed to get result: ", err)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxRevalidateSize)
+	corrections, err := readCorrections(r, result.Metadata.Columns)
+	if err != nil {
+		writeError(w, "Invalid corrections: ", err)
+		return
+	}
+
+	// Rules and checks are those of the profile as it is now
+	var profile *Profile
+	var rules []*Rule
+	if result.Metadata.Profile != "" {
+		profile, err = loadProfile(result.Metadata.Profile)
+		if errors.Is(err, ErrProfileNotFound) {
+			http.Error(w, "Profile no longer exists: "+result.Metadata.Profile, http.StatusConflict)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Failed to load profile: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		plan, err := profile.plan(result.Metadata.Columns)
+		if err != nil {
+			http.Error(w, "Failed to compile profile rules: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		rules = plan.rules
+	}
+	profiles, err := loadProfiles(result.Metadata.Profiles)
+	if err != nil {
+		http.Error(w, "Failed to load profiles: "+err.Error(), http.StatusConflict)
+		return
+	}
+	profileRules, _, err := compileProfileRules(profiles, result.Metadata.Columns)
+	if err != nil {
+		http.Error(w, "Failed to compile profile rules: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	checks, err := storedChecks(result.Metadata.Checks)
+	if err != nil {
+		http.Error(w, "Failed to compile checks: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if checks == nil {
+		checks = profile.checkSet()
+	}
+	computed, err := compileComputed(result.Metadata.Computed)
+	if err != nil {
+		http.Error(w, "Failed to compile computed columns: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	validators, err := loadValidators(result.Metadata.Validators)
+	if err != nil {
+		http.Error(w, "Failed to load validators: "+err.Error(), http.StatusConflict)
+		return
+	}
+	// Corrected names are replaced with the dictionary as it is now
+	var names canonicalizer
+	if result.Metadata.Dictionary {
+		dictionary, err := tenantDictionary(job.Tenant)
+		if err != nil {
+			http.Error(w, "Failed to get dictionary: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		names = dictionary.canonicalizer()
+	}
+
+	// The stored result is shared with readers, so corrections are made to
+	// a copy that replaces it once saved
+	revised := *result
+	revised.Conversion.Rows = slices.Clone(result.Conversion.Rows)
+	revised.Validation = maps.Clone(result.Validation)
+	result = &revised
+
+	rowIndex := make(map[string]int, len(result.Conversion.Rows))
+	for i, row := range result.Conversion.Rows {
+		rowIndex[row["Track ID"]] = i
+	}
+
+	response := RevalidateResponse{Validation: make(map[string]RowValidation)}
+	for _, correction := range corrections {
+		trackID := correction["Track ID"]
+		i, ok := rowIndex[trackID]
+		if !ok {
+			response.Unmatched = append(response.Unmatched, trackID)
+			continue
+		}
+		previous := result.Validation[trackID]
+
+		// Corrected values are cleaned as the uploaded ones were
+		result.Metadata.Normalize.apply(correction)
+		names.apply(correction)
+		record := maps.Clone(result.Conversion.Rows[i])
+		// The stored release date was converted to YYYY-MM-DD; it is
+		// checked as written until corrected
+		if _, corrected := correction[releaseDateColumn]; !corrected && previous.OriginalReleaseDate != "" {
+			record[releaseDateColumn] = previous.OriginalReleaseDate
+		}
+		maps.Copy(record, correction)
+		royaltyFormat := previous.RoyaltyFormat
+		if result.Metadata.NormalizeRoyalties && slices.ContainsFunc(royaltyColumns, func(column string) bool {
+			_, corrected := correction[column]
+			return corrected
+		}) {
+			royaltyFormat = normalizeShares(record)
+		}
+		// A UPC that could not be repaired stays flagged until corrected
+		numericIssues := previous.NumericIssues
+		if _, corrected := correction["UPC"]; corrected {
+			numericIssues = nil
+			if result.Metadata.RepairNumerics {
+				_, numericIssues = repairNumerics(record)
+			}
+		}
+
+		validation := validateRow(record, checks, rules)
+		// The stored territory list is already normalized, so notices of
+		// redundant entries stay until the list is corrected
+		if _, corrected := correction["Territories"]; !corrected {
+			validation.TerritoryIssues = previous.TerritoryIssues
+		}
+		validation.NumericIssues = numericIssues
+		validation.RoyaltyFormat = royaltyFormat
+		validation.ProfileRules = checkProfileRules(record, profileRules)
+		validation.Line = previous.Line
+		validation.describe(record, rules, profileRules)
+		var validatorIssues []Issue
+		validation.Validators, validatorIssues = checkValidators(record, validators)
+		validation.Issues = append(validation.Issues, validatorIssues...)
+
+		result.Conversion.Rows[i] = record
+		result.Validation[trackID] = validation
+		response.Validation[trackID] = validation
+	}
+
+	if len(response.Validation) > 0 {
+		// Corrections may change the values computed from them, and resolve
+		// or introduce conflicts with other rows. Failures to compute are
+		// only reported for uploads.
+		computeColumns(result, computed)
+		checkCrossRow(result, checks)
+		countSeverities(result)
+		result.Summary = summarize(result, result.Summary.duration())
+		for trackID := range response.Validation {
+			response.Validation[trackID] = result.Validation[trackID]
+		}
+		if err := jobStore.SaveResult(jobID, result); err != nil {
+			http.Error(w, "Failed to save result: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		materializeViews(jobID, result)
+		job.countFailures(result.Validation)
+		job.ReuseKey = ""
+		saveJob(job)
+	}
+	response.FailedRows = job.FailedRows
+
+	writeJSON(w, response)
+}
+
+// readCorrections reads corrected rows from a JSON array of objects, or from
+// a CSV file sent as the request body or as the csvFile form field. Column
+// names are matched to the job's columns ignoring case, spaces and
+// punctuation; every row must have a Track ID.
+func readCorrections(r *http.Request, columns []string) ([]map[string]string, error) {
+	byNormalized := make(map[string]string, len(columns))
+	for _, column := range columns {
+		byNormalized[normalizeColumnName(column)] = column
+	}
+	resolve := func(name string) (string, error) {
+		column, ok := byNormalized[normalizeColumnName(name)]
+		if !ok {
+			return "", fileErrorf(http.StatusBadRequest, "unknown column %q", name)
+		}
+		return column, nil
+	}
+
+	var raw []map[string]string
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch mediaType {
+	case "application/json":
+		if err := decodeJSON(r.Body, "revalidate-request.json", &raw); err != nil {
+			return nil, err
+		}
+	case "multipart/form-data":
+		file, _, err := r.FormFile("csvFile")
+		if err != nil {
+			return nil, fileErrorf(http.StatusBadRequest, "failed to get file: %v", err)
+		}
+		defer file.Close()
+		if raw, err = readCorrectionsCSV(file); err != nil {
+			return nil, err
+		}
+	default:
+		var err error
+		if raw, err = readCorrectionsCSV(r.Body); err != nil {
+			return nil, err
+		}
+	}
+	if len(raw) == 0 {
+		return nil, fileErrorf(http.StatusBadRequest, "no rows to revalidate")
+	}
+
+	corrections := make([]map[string]string, 0, len(raw))
+	for _, row := range raw {
+		correction := make(map[string]string, len(row))
+		for name, value := range row {
+			column, err := resolve(name)
+			if err != nil {
+				return nil, err
+			}
+			correction[column] = value
+		}
+		if correction["Track ID"] == "" {
+			return nil, fileErrorf(http.StatusBadRequest, "every row needs a Track ID")
+		}
+		corrections = append(corrections, correction)
+	}
+	return corrections, nil
+}
+
+// readCorrectionsCSV reads CSV rows into maps keyed by the header row
+func readCorrectionsCSV(rd io.Reader) ([]map[string]string, error) {
+	reader := csv.NewReader(rd)
+	headers, err := reader.Read()
+	if err == io.EOF {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errorWithStatus(err, "failed to read CSV header")
+	}
+
+	var rows []map[string]string
+	for {
+		row, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, errorWithStatus(err, "failed to read CSV row")
+		}
+		record := make(map[string]string, len(headers))
+		for i, value := range row {
+			if i < len(headers) {
+				record[headers[i]] = value
+			}
+		}
+		rows = append(rows, record)
+	}
+	return rows, nil
+}
+
+// errorWithStatus keeps oversized bodies as 413 and reports any other read
+// error as a bad request
+func errorWithStatus(err error, message string) error {
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		return fmt.Errorf("%s: %w", message, err)
+	}
+	return fileErrorf(http.StatusBadRequest, "%s: %v", message, err)
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// revalidateTestJob processes a CSV file as a completed job and returns
+// its ID
+func revalidateTestJob(t *testing.T, file io.Reader) string {
+	t.Helper()
+	job := &Job{ID: newJobID(), Filename: "revalidate.csv", Status: JobRunning}
+	saveJob(job)
+	if _, err := runJob(context.Background(), job, file, ProcessOptions{Workers: 1}, 0, ""); err != nil {
+		t.Fatal(err)
+	}
+	finishJob(job, nil)
+	return job.ID
+}
+
+// revalidateTest posts JSON corrections to a job and returns the
+// validations of the corrected rows
+func revalidateTest(t *testing.T, jobID, corrections string) map[string]RowValidation {
+	t.Helper()
+	r := httptest.NewRequest(http.MethodPost, "/jobs/"+jobID+"/revalidate", strings.NewReader(corrections))
+	r.Header.Set("Content-Type", "application/json")
+	r.SetPathValue("id", jobID)
+	w := httptest.NewRecorder()
+	revalidateHandler(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("revalidate returned %d: %s", w.Code, w.Body)
+	}
+	var response RevalidateResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	return response.Validation
+}
+
+func TestRevalidateKeepsReleaseDateAsWritten(t *testing.T) {
+	file, err := os.Open("sample-data/sample-with-errors.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	jobID := revalidateTestJob(t, file)
+	result, err := jobStore.GetResult(jobID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	uploaded := result.Validation["TRK003"]
+	if uploaded.DateFormat || uploaded.OriginalReleaseDate != "15/10/2024" {
+		t.Fatalf("uploaded TRK003: date_format %v, original_release_date %q", uploaded.DateFormat, uploaded.OriginalReleaseDate)
+	}
+
+	// A correction of another column leaves the date flagged
+	v := revalidateTest(t, jobID, `[{"Track ID": "TRK003", "Track Title": "Good Date Format"}]`)["TRK003"]
+	if v.DateFormat || v.OriginalReleaseDate != "15/10/2024" || v.Errors != uploaded.Errors {
+		t.Errorf("after a title correction: date_format %v, original_release_date %q, %d errors, want false, 15/10/2024, %d",
+			v.DateFormat, v.OriginalReleaseDate, v.Errors, uploaded.Errors)
+	}
+	if result, _ := jobStore.GetResult(jobID); result.Conversion.Rows[2]["Release Date"] != "2024-10-15" {
+		t.Errorf("stored release date %q, want 2024-10-15", result.Conversion.Rows[2]["Release Date"])
+	}
+
+	// A corrected date is checked as it is now
+	v = revalidateTest(t, jobID, `[{"Track ID": "TRK003", "Release Date": "2024-10-15"}]`)["TRK003"]
+	if !v.DateFormat || v.OriginalReleaseDate != "" {
+		t.Errorf("after a date correction: date_format %v, original_release_date %q, want true and none", v.DateFormat, v.OriginalReleaseDate)
+	}
+}
+
+func TestRevalidateKeepsTerritoryNotices(t *testing.T) {
+	jobID := revalidateTestJob(t, strings.NewReader(
+		"Release ID,Release Title,Track ID,Track Title,ISRC,Artist Name,Genre,Release Date,Label Name,UPC,Language,Explicit,Territories,Rights Holder,File URL,Royalty Artist %,Royalty Label %,Royalty Distributor %,Royalty Publisher %\n"+
+			"RLS001,Midnight Drive,TRK001,Starry Night,USABC2300001,Luna Ray,Chillwave,2024-08-01,Moonlit Records,123456789012,en,No,\"FR, US, FR\",Moonlit Records Ltd.,https://example.com/files/starry_night.wav,50%,30%,15%,5%\n"))
+
+	v := revalidateTest(t, jobID, `[{"Track ID": "TRK001", "Track Title": "Starry Night (Remastered)"}]`)["TRK001"]
+	if want := []string{"FR is listed more than once"}; !slices.Equal(v.TerritoryIssues, want) {
+		t.Errorf("after a title correction: territory_issues %q, want %q", v.TerritoryIssues, want)
+	}
+	v = revalidateTest(t, jobID, `[{"Track ID": "TRK001", "Territories": "FR, US"}]`)["TRK001"]
+	if len(v.TerritoryIssues) > 0 {
+		t.Errorf("after a territory correction: territory_issues %q, want none", v.TerritoryIssues)
+	}
+}
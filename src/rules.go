@@ -0,0 +1,422 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// Rule is a compiled cross-field expression evaluated against every row,
+// e.g. `Explicit == 'Yes' implies Language != ""`
+//
+// The grammar, loosest binding first:
+//
+//	expr       = or [ ("implies" | "requires") or ]
+//	or         = and { "or" and }
+//	and        = not { "and" not }
+//	not        = "not" not | comparison
+//	comparison = operand [ ("==" | "!=" | "<" | "<=" | ">" | ">=") operand ]
+//	operand    = 'string' | "string" | number | column | [Column Name] | "(" expr ")"
+//
+// Bare column names match headers ignoring case, spaces and punctuation, so
+// ReleaseDate refers to "Release Date". A column on its own is true when it
+// is non-empty. Comparisons are numeric when both sides are numbers and
+// lexical otherwise, which orders ISO dates correctly.
+type Rule struct {
+	Name string
+	Expr string
+	root ruleNode
+}
+
+// RuleDefinition is a named rule expression as written in a profile.
+// Failing a rule of warning severity does not fail the row.
+type RuleDefinition struct {
+	Name     string `json:"name"`
+	Expr     string `json:"expr"`
+	Severity string `json:"severity,omitempty"`
+}
+
+// name returns the name a rule is reported under, its expression if it
+// has no name
+func (d RuleDefinition) name() string {
+	if d.Name == "" {
+		return d.Expr
+	}
+	return d.Name
+}
+
+// Check evaluates the rule against a row
+func (r *Rule) Check(row map[string]string) bool {
+	return r.root.eval(row).truthy()
+}
+
+// compileRules parses rule definitions and resolves their column references
+// against the file headers. Columns missing from the file evaluate as empty
+// and are reported as warnings.
+func compileRules(defs []RuleDefinition, headers []string) ([]*Rule, []string, error) {
+	columns := make(map[string]string, len(headers))
+	for _, h := range headers {
+		columns[normalizeColumnName(h)] = h
+	}
+
+	var rules []*Rule
+	var warnings []string
+	for _, def := range defs {
+		p := &ruleParser{columns: columns}
+		if err := p.tokenize(def.Expr); err != nil {
+			return nil, nil, fmt.Errorf("rule %q: %v", def.Expr, err)
+		}
+		root, err := p.parseExpr()
+		if err == nil && p.pos < len(p.tokens) {
+			err = fmt.Errorf("unexpected %q", p.tokens[p.pos].text)
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("rule %q: %v", def.Expr, err)
+		}
+		for _, missing := range p.missing {
+			warnings = append(warnings, fmt.Sprintf("Rule %q references column %q which is not in the file", def.Expr, missing))
+		}
+		rules = append(rules, &Rule{Name: def.name(), Expr: def.Expr, root: root})
+	}
+	return rules, warnings, nil
+}
+
+// normalizeColumnName lowercases a column name and strips everything but
+// letters and digits
+func normalizeColumnName(name string) string {
+	var b strings.Builder
+	for _, r := range name {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			b.WriteRune(unicode.ToLower(r))
+		}
+	}
+	return b.String()
+}
+
+// ruleValue is the result of evaluating a node: a boolean for logic and
+// comparisons, a string for columns and literals
+type ruleValue struct {
+	isBool bool
+	b      bool
+	s      string
+}
+
+func (v ruleValue) truthy() bool {
+	if v.isBool {
+		return v.b
+	}
+	return strings.TrimSpace(v.s) != ""
+}
+
+func (v ruleValue) String() string {
+	if v.isBool {
+		return fmt.Sprint(v.b)
+	}
+	return strings.TrimSpace(v.s)
+}
+
+type ruleNode interface {
+	eval(row map[string]string) ruleValue
+}
+
+type columnNode struct{ column string }
+type literalNode struct{ value string }
+type notNode struct{ operand ruleNode }
+type logicNode struct {
+	op          string
+	left, right ruleNode
+}
+type compareNode struct {
+	op          string
+	left, right ruleNode
+}
+
+func (n columnNode) eval(row map[string]string) ruleValue  { return ruleValue{s: row[n.column]} }
+func (n literalNode) eval(row map[string]string) ruleValue { return ruleValue{s: n.value} }
+
+func (n notNode) eval(row map[string]string) ruleValue {
+	return ruleValue{isBool: true, b: !n.operand.eval(row).truthy()}
+}
+
+func (n logicNode) eval(row map[string]string) ruleValue {
+	left := n.left.eval(row).truthy()
+	var b bool
+	switch n.op {
+	case "and":
+		b = left && n.right.eval(row).truthy()
+	case "or":
+		b = left || n.right.eval(row).truthy()
+	default: // implies, requires
+		b = !left || n.right.eval(row).truthy()
+	}
+	return ruleValue{isBool: true, b: b}
+}
+
+func (n compareNode) eval(row map[string]string) ruleValue {
+	left, right := n.left.eval(row).String(), n.right.eval(row).String()
+
+	cmp := strings.Compare(left, right)
+	if l, err := parsePercentage(left); err == nil {
+		if r, err := parsePercentage(right); err == nil {
+			switch {
+			case l < r:
+				cmp = -1
+			case l > r:
+				cmp = 1
+			default:
+				cmp = 0
+			}
+		}
+	}
+
+	var b bool
+	switch n.op {
+	case "==":
+		b = cmp == 0
+	case "!=":
+		b = cmp != 0
+	case "<":
+		b = cmp < 0
+	case "<=":
+		b = cmp <= 0
+	case ">":
+		b = cmp > 0
+	case ">=":
+		b = cmp >= 0
+	}
+	return ruleValue{isBool: true, b: b}
+}
+
+// Token kinds
+const (
+	tokIdent = iota
+	tokColumn
+	tokString
+	tokNumber
+	tokOp
+)
+
+type ruleToken struct {
+	kind int
+	text string
+}
+
+// ruleParser is a recursive-descent parser for rule expressions
+type ruleParser struct {
+	tokens  []ruleToken
+	pos     int
+	columns map[string]string
+	missing []string
+}
+
+// tokenize splits the expression into tokens
+func (p *ruleParser) tokenize(expr string) error {
+	runes := []rune(expr)
+	for i := 0; i < len(runes); {
+		c := runes[i]
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case c == '\'' || c == '"':
+			end := i + 1
+			for end < len(runes) && runes[end] != c {
+				end++
+			}
+			if end == len(runes) {
+				return fmt.Errorf("unterminated string")
+			}
+			p.tokens = append(p.tokens, ruleToken{tokString, string(runes[i+1 : end])})
+			i = end + 1
+		case c == '[':
+			end := i + 1
+			for end < len(runes) && runes[end] != ']' {
+				end++
+			}
+			if end == len(runes) {
+				return fmt.Errorf("unterminated column reference")
+			}
+			p.tokens = append(p.tokens, ruleToken{tokColumn, strings.TrimSpace(string(runes[i+1 : end]))})
+			i = end + 1
+		case unicode.IsDigit(c) || (c == '-' && i+1 < len(runes) && unicode.IsDigit(runes[i+1])):
+			end := i + 1
+			for end < len(runes) && (unicode.IsDigit(runes[end]) || runes[end] == '.') {
+				end++
+			}
+			p.tokens = append(p.tokens, ruleToken{tokNumber, string(runes[i:end])})
+			i = end
+		case unicode.IsLetter(c) || c == '_':
+			end := i + 1
+			for end < len(runes) && (unicode.IsLetter(runes[end]) || unicode.IsDigit(runes[end]) || runes[end] == '_') {
+				end++
+			}
+			p.tokens = append(p.tokens, ruleToken{tokIdent, string(runes[i:end])})
+			i = end
+		default:
+			op, width := string(c), 1
+			if i+1 < len(runes) {
+				switch two := string(runes[i : i+2]); two {
+				case "==", "!=", "<=", ">=", "&&", "||", "=>":
+					op, width = two, 2
+				}
+			}
+			switch op {
+			case "==", "!=", "<=", ">=", "<", ">", "(", ")":
+			case "&&":
+				op = "and"
+			case "||":
+				op = "or"
+			case "=>":
+				op = "implies"
+			case "!":
+				op = "not"
+			case "=":
+				op = "=="
+			default:
+				return fmt.Errorf("unexpected character %q", c)
+			}
+			p.tokens = append(p.tokens, ruleToken{tokOp, op})
+			i += width
+		}
+	}
+	return nil
+}
+
+// keyword reports whether the current token is the given operator or keyword
+func (p *ruleParser) keyword(words ...string) (string, bool) {
+	if p.pos >= len(p.tokens) {
+		return "", false
+	}
+	tok := p.tokens[p.pos]
+	if tok.kind != tokOp && tok.kind != tokIdent {
+		return "", false
+	}
+	for _, w := range words {
+		if strings.EqualFold(tok.text, w) {
+			return w, true
+		}
+	}
+	return "", false
+}
+
+func (p *ruleParser) parseExpr() (ruleNode, error) {
+	left, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if op, ok := p.keyword("implies", "requires"); ok {
+		p.pos++
+		right, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		return logicNode{op: op, left: left, right: right}, nil
+	}
+	return left, nil
+}
+
+func (p *ruleParser) parseOr() (ruleNode, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		if _, ok := p.keyword("or"); !ok {
+			return left, nil
+		}
+		p.pos++
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = logicNode{op: "or", left: left, right: right}
+	}
+}
+
+func (p *ruleParser) parseAnd() (ruleNode, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		if _, ok := p.keyword("and"); !ok {
+			return left, nil
+		}
+		p.pos++
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		left = logicNode{op: "and", left: left, right: right}
+	}
+}
+
+func (p *ruleParser) parseNot() (ruleNode, error) {
+	if _, ok := p.keyword("not"); ok {
+		p.pos++
+		operand, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return notNode{operand: operand}, nil
+	}
+	return p.parseComparison()
+}
+
+func (p *ruleParser) parseComparison() (ruleNode, error) {
+	left, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+	if op, ok := p.keyword("==", "!=", "<=", ">=", "<", ">"); ok {
+		p.pos++
+		right, err := p.parseOperand()
+		if err != nil {
+			return nil, err
+		}
+		return compareNode{op: op, left: left, right: right}, nil
+	}
+	return left, nil
+}
+
+func (p *ruleParser) parseOperand() (ruleNode, error) {
+	if p.pos >= len(p.tokens) {
+		return nil, fmt.Errorf("unexpected end of expression")
+	}
+	tok := p.tokens[p.pos]
+	p.pos++
+
+	switch tok.kind {
+	case tokString, tokNumber:
+		return literalNode{value: tok.text}, nil
+	case tokColumn, tokIdent:
+		if tok.kind == tokIdent {
+			switch strings.ToLower(tok.text) {
+			case "and", "or", "not", "implies", "requires":
+				return nil, fmt.Errorf("unexpected %q", tok.text)
+			}
+		}
+		return p.column(tok.text), nil
+	}
+
+	if tok.text != "(" {
+		return nil, fmt.Errorf("unexpected %q", tok.text)
+	}
+	node, err := p.parseExpr()
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := p.keyword(")"); !ok {
+		return nil, fmt.Errorf("missing closing parenthesis")
+	}
+	p.pos++
+	return node, nil
+}
+
+// column resolves a column reference against the file headers
+func (p *ruleParser) column(name string) ruleNode {
+	if header, ok := p.columns[normalizeColumnName(name)]; ok {
+		return columnNode{column: header}
+	}
+	p.missing = append(p.missing, name)
+	return columnNode{column: name}
+}
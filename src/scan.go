@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// scanChunkSize is the size of the chunks streamed to the scanner
+const scanChunkSize = 64 << 10
+
+// ScanError is a failure to reach or understand the virus scanner. Uploads
+// are rejected rather than processed unscanned.
+type ScanError struct {
+	Err error
+}
+
+func (e *ScanError) Error() string {
+	return "virus scanner unavailable: " + e.Err.Error()
+}
+
+// scanUpload streams the uploaded file to the configured virus scanner and
+// rejects infected files. It does nothing when no scanner is configured.
+// The file is rewound to the beginning afterwards.
+func scanUpload(file multipart.File, filename string) error {
+	if cfg.VirusScanURL == "" {
+		return nil
+	}
+	scanURL, err := url.Parse(cfg.VirusScanURL)
+	if err != nil {
+		return &ScanError{Err: err}
+	}
+
+	var signature string
+	switch scanURL.Scheme {
+	case "clamd", "tcp":
+		signature, err = scanClamd(scanURL.Host, file)
+	case "icap":
+		signature, err = scanICAP(scanURL, file, filename)
+	default:
+		err = fmt.Errorf("unsupported scanner scheme %q", scanURL.Scheme)
+	}
+	if err != nil {
+		return &ScanError{Err: err}
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("failed to rewind upload: %v", err)
+	}
+
+	if signature != "" {
+		log.Printf("Rejected infected upload %q: %s", filename, signature)
+		return fileErrorf(http.StatusUnprocessableEntity, "virus scan found %s", signature)
+	}
+	return nil
+}
+
+// dialScanner connects to the scanner with the configured timeout applied
+// to the whole exchange
+func dialScanner(addr string) (net.Conn, error) {
+	conn, err := net.DialTimeout("tcp", addr, 10*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(cfg.VirusScanTimeout))
+	return conn, nil
+}
+
+// scanClamd scans the file with clamd's INSTREAM command and returns the
+// signature found, or "" for a clean file
+func scanClamd(addr string, file io.Reader) (string, error) {
+	conn, err := dialScanner(addr)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	w := bufio.NewWriter(conn)
+	w.WriteString("zINSTREAM\x00")
+	buf := make([]byte, scanChunkSize)
+	var size [4]byte
+	for {
+		n, err := file.Read(buf)
+		if n > 0 {
+			binary.BigEndian.PutUint32(size[:], uint32(n))
+			w.Write(size[:])
+			w.Write(buf[:n])
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", fmt.Errorf("failed to read upload: %v", err)
+		}
+	}
+	w.Write([]byte{0, 0, 0, 0})
+	if err := w.Flush(); err != nil {
+		return "", err
+	}
+
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	reply = strings.TrimRight(reply, "\x00\n")
+
+	// Replies are "stream: OK", "stream: <signature> FOUND" or "<message> ERROR"
+	switch {
+	case strings.HasSuffix(reply, " OK"):
+		return "", nil
+	case strings.HasSuffix(reply, " FOUND"):
+		return strings.TrimSuffix(strings.TrimPrefix(reply, "stream: "), " FOUND"), nil
+	}
+	return "", fmt.Errorf("clamd: %s", reply)
+}
+
+// scanICAP submits the file to an ICAP service with RESPMOD and returns the
+// threat reported, or "" for a clean file. A 204 reply means the content is
+// clean; a 200 reply means the service blocked or replaced it.
+func scanICAP(scanURL *url.URL, file io.Reader, filename string) (string, error) {
+	addr := scanURL.Host
+	if scanURL.Port() == "" {
+		addr = net.JoinHostPort(scanURL.Hostname(), "1344")
+	}
+	conn, err := dialScanner(addr)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	httpHeader := "HTTP/1.1 200 OK\r\n" +
+		"Content-Type: text/csv\r\n" +
+		"Content-Disposition: attachment; filename=\"" + strings.ReplaceAll(filename, `"`, "") + "\"\r\n" +
+		"Transfer-Encoding: chunked\r\n\r\n"
+
+	w := bufio.NewWriter(conn)
+	fmt.Fprintf(w, "RESPMOD %s ICAP/1.0\r\n", scanURL.String())
+	fmt.Fprintf(w, "Host: %s\r\n", scanURL.Host)
+	w.WriteString("Allow: 204\r\n")
+	fmt.Fprintf(w, "Encapsulated: res-hdr=0, res-body=%d\r\n\r\n", len(httpHeader))
+	w.WriteString(httpHeader)
+	buf := make([]byte, scanChunkSize)
+	for {
+		n, err := file.Read(buf)
+		if n > 0 {
+			fmt.Fprintf(w, "%x\r\n", n)
+			w.Write(buf[:n])
+			w.WriteString("\r\n")
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", fmt.Errorf("failed to read upload: %v", err)
+		}
+	}
+	w.WriteString("0\r\n\r\n")
+	if err := w.Flush(); err != nil {
+		return "", err
+	}
+
+	tp := textproto.NewReader(bufio.NewReader(conn))
+	status, err := tp.ReadLine()
+	if err != nil {
+		return "", err
+	}
+	header, err := tp.ReadMIMEHeader()
+	if err != nil {
+		return "", err
+	}
+
+	fields := strings.Fields(status)
+	if len(fields) < 2 || !strings.HasPrefix(fields[0], "ICAP/") {
+		return "", fmt.Errorf("icap: malformed status line %q", status)
+	}
+	switch fields[1] {
+	case "204":
+		return "", nil
+	case "200":
+		// X-Infection-Found looks like "Type=0; Resolution=2; Threat=Eicar;"
+		if found := header.Get("X-Infection-Found"); found != "" {
+			for _, part := range strings.Split(found, ";") {
+				if threat, ok := strings.CutPrefix(strings.TrimSpace(part), "Threat="); ok {
+					return threat, nil
+				}
+			}
+			return found, nil
+		}
+		for _, name := range []string{"X-Virus-Id", "X-Violations-Found"} {
+			if threat := header.Get(name); threat != "" {
+				return threat, nil
+			}
+		}
+		return "content blocked by ICAP service", nil
+	}
+	return "", fmt.Errorf("icap: %s", status)
+}
@@ -0,0 +1,398 @@
+package main
+
+import (
+	"bytes"
+	"embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// schemaFiles holds the JSON Schemas of the request and response bodies,
+// served at /schemas/<name>.json
+//
+//go:embed schemas/*.json
+var schemaFiles embed.FS
+
+// maxSchemaErrors bounds the number of violations reported for one body
+const maxSchemaErrors = 20
+
+// Schema is the subset of JSON Schema used to describe the API: types,
+// object properties, array items, enums, string lengths and patterns,
+// numeric bounds and $ref to another schema file
+type Schema struct {
+	Ref                  string             `json:"$ref"`
+	Type                 schemaTypes        `json:"type"`
+	Properties           map[string]*Schema `json:"properties"`
+	Required             []string           `json:"required"`
+	AdditionalProperties json.RawMessage    `json:"additionalProperties"`
+	Items                *Schema            `json:"items"`
+	Enum                 []interface{}      `json:"enum"`
+	MinLength            *int               `json:"minLength"`
+	MaxLength            *int               `json:"maxLength"`
+	Pattern              string             `json:"pattern"`
+	MinItems             *int               `json:"minItems"`
+	MaxItems             *int               `json:"maxItems"`
+	Minimum              *float64           `json:"minimum"`
+	Maximum              *float64           `json:"maximum"`
+
+	pattern    *regexp.Regexp
+	additional *Schema
+	closed     bool
+}
+
+// schemaTypes is the type keyword, a single type name or a list of them
+type schemaTypes []string
+
+func (t *schemaTypes) UnmarshalJSON(data []byte) error {
+	var name string
+	if err := json.Unmarshal(data, &name); err == nil {
+		*t = schemaTypes{name}
+		return nil
+	}
+	return json.Unmarshal(data, (*[]string)(t))
+}
+
+// SchemaViolation is a value that does not match its schema, located by a
+// JSON Pointer into the body
+type SchemaViolation struct {
+	Pointer string
+	Message string
+}
+
+// SchemaError lists the violations found in a request body
+type SchemaError struct {
+	Violations []SchemaViolation
+}
+
+func (e *SchemaError) Error() string {
+	messages := make([]string, len(e.Violations))
+	for i, v := range e.Violations {
+		pointer := v.Pointer
+		if pointer == "" {
+			pointer = "/"
+		}
+		messages[i] = pointer + ": " + v.Message
+	}
+	return strings.Join(messages, "; ")
+}
+
+// schemas are the parsed schemas by file name
+var schemas = loadSchemas()
+
+// loadSchemas parses the embedded schemas. They are part of the binary, so
+// a broken schema is a programming error.
+func loadSchemas() map[string]*Schema {
+	entries, err := schemaFiles.ReadDir("schemas")
+	if err != nil {
+		log.Fatalf("Failed to read schemas: %v", err)
+	}
+	loaded := make(map[string]*Schema, len(entries))
+	for _, entry := range entries {
+		data, err := schemaFiles.ReadFile("schemas/" + entry.Name())
+		if err != nil {
+			log.Fatalf("Failed to read schema %s: %v", entry.Name(), err)
+		}
+		var schema Schema
+		if err := json.Unmarshal(data, &schema); err != nil {
+			log.Fatalf("Invalid schema %s: %v", entry.Name(), err)
+		}
+		if err := schema.compile(); err != nil {
+			log.Fatalf("Invalid schema %s: %v", entry.Name(), err)
+		}
+		loaded[entry.Name()] = &schema
+	}
+	for name, schema := range loaded {
+		if err := schema.checkRefs(loaded); err != nil {
+			log.Fatalf("Invalid schema %s: %v", name, err)
+		}
+	}
+	return loaded
+}
+
+// compile prepares patterns and additionalProperties of the schema and the
+// schemas nested in it
+func (s *Schema) compile() error {
+	if s.Pattern != "" {
+		var err error
+		if s.pattern, err = regexp.Compile(s.Pattern); err != nil {
+			return err
+		}
+	}
+	switch raw := bytes.TrimSpace(s.AdditionalProperties); {
+	case len(raw) == 0 || string(raw) == "true":
+	case string(raw) == "false":
+		s.closed = true
+	default:
+		s.additional = &Schema{}
+		if err := json.Unmarshal(raw, s.additional); err != nil {
+			return fmt.Errorf("additionalProperties: %v", err)
+		}
+	}
+	for _, nested := range s.nested() {
+		if err := nested.compile(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkRefs reports references to schemas that do not exist
+func (s *Schema) checkRefs(loaded map[string]*Schema) error {
+	if s.Ref != "" && loaded[s.Ref] == nil {
+		return fmt.Errorf("unknown $ref %q", s.Ref)
+	}
+	for _, nested := range s.nested() {
+		if err := nested.checkRefs(loaded); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// nested returns the schemas directly inside s
+func (s *Schema) nested() []*Schema {
+	var nested []*Schema
+	for _, property := range s.Properties {
+		nested = append(nested, property)
+	}
+	if s.Items != nil {
+		nested = append(nested, s.Items)
+	}
+	if s.additional != nil {
+		nested = append(nested, s.additional)
+	}
+	return nested
+}
+
+// validate appends the violations of value, found at pointer, to errs
+func (s *Schema) validate(value interface{}, pointer string, errs *[]SchemaViolation) {
+	if len(*errs) >= maxSchemaErrors {
+		return
+	}
+	if s.Ref != "" {
+		schemas[s.Ref].validate(value, pointer, errs)
+		return
+	}
+	fail := func(format string, args ...interface{}) {
+		*errs = append(*errs, SchemaViolation{Pointer: pointer, Message: fmt.Sprintf(format, args...)})
+	}
+
+	kind := jsonType(value)
+	if len(s.Type) > 0 && !s.allowsType(kind) {
+		fail("expected %s, got %s", strings.Join(s.Type, " or "), kind)
+		return
+	}
+	if len(s.Enum) > 0 && !inEnum(s.Enum, value) {
+		fail("must be one of %s", formatEnum(s.Enum))
+		return
+	}
+
+	switch v := value.(type) {
+	case string:
+		length := utf8.RuneCountInString(v)
+		if s.MinLength != nil && length < *s.MinLength {
+			if *s.MinLength == 1 {
+				fail("must not be empty")
+			} else {
+				fail("must be at least %d characters", *s.MinLength)
+			}
+		}
+		if s.MaxLength != nil && length > *s.MaxLength {
+			fail("must be at most %d characters", *s.MaxLength)
+		}
+		if s.pattern != nil && !s.pattern.MatchString(v) {
+			fail("does not match %s", s.Pattern)
+		}
+	case json.Number:
+		n, _ := v.Float64()
+		if s.Minimum != nil && n < *s.Minimum {
+			fail("must be at least %v", *s.Minimum)
+		}
+		if s.Maximum != nil && n > *s.Maximum {
+			fail("must be at most %v", *s.Maximum)
+		}
+	case []interface{}:
+		if s.MinItems != nil && len(v) < *s.MinItems {
+			fail("must have at least %d items", *s.MinItems)
+		}
+		if s.MaxItems != nil && len(v) > *s.MaxItems {
+			fail("must have at most %d items", *s.MaxItems)
+		}
+		if s.Items != nil {
+			for i, item := range v {
+				s.Items.validate(item, fmt.Sprintf("%s/%d", pointer, i), errs)
+			}
+		}
+	case map[string]interface{}:
+		for _, name := range s.Required {
+			if _, ok := v[name]; !ok {
+				*errs = append(*errs, SchemaViolation{Pointer: pointer + "/" + escapePointer(name), Message: "is required"})
+			}
+		}
+		names := make([]string, 0, len(v))
+		for name := range v {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			child := pointer + "/" + escapePointer(name)
+			switch property, ok := s.Properties[name]; {
+			case ok:
+				property.validate(v[name], child, errs)
+			case s.additional != nil:
+				s.additional.validate(v[name], child, errs)
+			case s.closed:
+				*errs = append(*errs, SchemaViolation{Pointer: child, Message: "is not allowed"})
+			}
+		}
+	}
+}
+
+// allowsType reports whether the schema accepts values of the JSON type
+// kind; integers are numbers too
+func (s *Schema) allowsType(kind string) bool {
+	for _, t := range s.Type {
+		if t == kind || (t == "number" && kind == "integer") {
+			return true
+		}
+	}
+	return false
+}
+
+// jsonType names the JSON type of a decoded value
+func jsonType(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case string:
+		return "string"
+	case json.Number:
+		if _, err := v.Int64(); err == nil {
+			return "integer"
+		}
+		return "number"
+	case []interface{}:
+		return "array"
+	default:
+		return "object"
+	}
+}
+
+// inEnum reports whether value is one of the enum values
+func inEnum(enum []interface{}, value interface{}) bool {
+	for _, allowed := range enum {
+		if fmt.Sprint(allowed) == fmt.Sprint(value) {
+			return true
+		}
+	}
+	return false
+}
+
+// formatEnum lists the enum values for an error message
+func formatEnum(enum []interface{}) string {
+	values := make([]string, len(enum))
+	for i, v := range enum {
+		data, _ := json.Marshal(v)
+		values[i] = string(data)
+	}
+	return strings.Join(values, ", ")
+}
+
+// escapePointer escapes a property name for use in a JSON Pointer
+func escapePointer(name string) string {
+	return strings.NewReplacer("~", "~0", "/", "~1").Replace(name)
+}
+
+// decodeJSON checks a JSON document against the named schema and decodes it
+// into v. Malformed JSON and schema violations are reported as bad requests
+// naming the offending location.
+func decodeJSON(r io.Reader, schemaName string, v interface{}) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return errorWithStatus(err, "failed to read body")
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var document interface{}
+	if err := decoder.Decode(&document); err != nil {
+		return fileErrorf(http.StatusBadRequest, "%s", describeJSONError(data, err))
+	}
+	if decoder.More() {
+		return fileErrorf(http.StatusBadRequest, "unexpected data after the JSON value")
+	}
+
+	var violations []SchemaViolation
+	schemas[schemaName].validate(document, "", &violations)
+	if len(violations) > 0 {
+		return &FileError{Status: http.StatusBadRequest, Message: (&SchemaError{Violations: violations}).Error()}
+	}
+	return json.Unmarshal(data, v)
+}
+
+// describeJSONError locates a JSON syntax error by line and column
+func describeJSONError(data []byte, err error) string {
+	var syntaxErr *json.SyntaxError
+	if errors.As(err, &syntaxErr) {
+		line, column := 1, 1
+		for _, b := range data[:min(int(syntaxErr.Offset), len(data))] {
+			if b == '\n' {
+				line, column = line+1, 1
+			} else {
+				column++
+			}
+		}
+		return fmt.Sprintf("malformed JSON at line %d, column %d: %v", line, column, err)
+	}
+	if err == io.EOF {
+		return "empty body, expected JSON"
+	}
+	return "malformed JSON: " + err.Error()
+}
+
+// schemasHandler lists the available schemas and the protobuf definition
+// of results
+func schemasHandler(w http.ResponseWriter, r *http.Request) {
+	names := make([]string, 0, len(schemas)+1)
+	for name := range schemas {
+		names = append(names, "/schemas/"+name)
+	}
+	names = append(names, "/schemas/result.proto")
+	sort.Strings(names)
+	writeJSON(w, struct {
+		Schemas []string `json:"schemas"`
+	}{Schemas: names})
+}
+
+// schemaHandler serves a single schema
+func schemaHandler(w http.ResponseWriter, r *http.Request) {
+	name := path.Base(r.PathValue("name"))
+	if name == "result.proto" {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Write(resultProto)
+		return
+	}
+	if !strings.HasSuffix(name, ".json") {
+		name += ".json"
+	}
+	data, err := schemaFiles.ReadFile("schemas/" + name)
+	if err != nil {
+		http.Error(w, "Unknown schema: "+r.PathValue("name"), http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/schema+json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Write(data)
+}
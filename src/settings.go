@@ -0,0 +1,209 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxSettingsRequestSize limits the size of a tenant settings body
+const maxSettingsRequestSize = 16 << 10
+
+// ErrSettingsNotFound is returned for tenants without settings
+var ErrSettingsNotFound = errors.New("tenant has no settings")
+
+// TenantSettings are a tenant's defaults. The profile and workers apply to
+// uploads that do not choose their own; the webhook and notification
+// channel receive every finished job of the tenant.
+type TenantSettings struct {
+	Tenant         string `json:"tenant"`
+	DefaultProfile string `json:"default_profile,omitempty"`
+	DefaultWorkers int    `json:"default_workers,omitempty"`
+
+	// SingleReleaseType rejects uploads mixing release types, for tenants
+	// whose pipeline takes each release type as a separate submission
+	SingleReleaseType bool `json:"single_release_type,omitempty"`
+
+	// WebhookURL receives the job record as JSON when a job finishes
+	WebhookURL string `json:"webhook_url,omitempty"`
+
+	// NotificationChannel is a Slack or Teams webhook for job summaries,
+	// in place of the tenant's NOTIFY_ROUTES entry
+	NotificationChannel string `json:"notification_channel,omitempty"`
+
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// tenantSettings returns a tenant's settings, or nil if it has none
+func tenantSettings(tenant string) (*TenantSettings, error) {
+	settings, err := jobStore.GetTenantSettings(tenant)
+	if errors.Is(err, ErrSettingsNotFound) {
+		return nil, nil
+	}
+	return settings, err
+}
+
+// applyTenantSettings fills in the profile, workers and release type
+// options the request leaves out from its tenant's settings. It writes an error and returns
+// false if the settings cannot be read.
+func applyTenantSettings(w http.ResponseWriter, r *http.Request) bool {
+	tenant, ok := tenantFromRequest(r)
+	if !ok {
+		// Rejected with the rest of the upload's options
+		return true
+	}
+	settings, err := tenantSettings(tenant)
+	if err != nil {
+		http.Error(w, "Failed to get tenant settings: "+err.Error(), http.StatusInternalServerError)
+		return false
+	}
+	if settings == nil {
+		return true
+	}
+	if settings.DefaultProfile != "" && r.FormValue("profile") == "" {
+		r.Form.Set("profile", settings.DefaultProfile)
+	}
+	if settings.DefaultWorkers > 0 && r.FormValue("workers") == "" {
+		r.Form.Set("workers", strconv.Itoa(settings.DefaultWorkers))
+	}
+	if settings.SingleReleaseType && r.FormValue("single_release_type") == "" {
+		r.Form.Set("single_release_type", "true")
+	}
+	return true
+}
+
+// checkWebhookURL checks that a setting holds an absolute HTTP(S) URL
+func checkWebhookURL(field, value string) error {
+	if value == "" {
+		return nil
+	}
+	u, err := url.Parse(value)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("%s must be an http or https URL", field)
+	}
+	return nil
+}
+
+// postJobWebhook posts a finished job to the tenant's webhook in the
+// background. Failed deliveries are parked for retry.
+func postJobWebhook(webhook string, job *Job) {
+	data, err := json.Marshal(job)
+	if err != nil {
+		log.Printf("Failed to encode job %s for its webhook: %v", job.ID, err)
+		return
+	}
+	deliver(&Delivery{Sink: SinkJobWebhook, URL: webhook, JobID: job.ID, Tenant: job.Tenant, Payload: data})
+}
+
+// tenantSettingsListHandler lists the settings of every tenant
+func tenantSettingsListHandler(w http.ResponseWriter, r *http.Request) {
+	if !isAdmin(r) {
+		http.Error(w, "Admin token required", http.StatusForbidden)
+		return
+	}
+	list, err := jobStore.ListTenantSettings()
+	if err != nil {
+		http.Error(w, "Failed to list tenant settings: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, struct {
+		Tenants []*TenantSettings `json:"tenants"`
+	}{Tenants: list})
+}
+
+// tenantSettingsHandler returns a tenant's settings
+func tenantSettingsHandler(w http.ResponseWriter, r *http.Request) {
+	if !isAdmin(r) {
+		http.Error(w, "Admin token required", http.StatusForbidden)
+		return
+	}
+	settings, err := jobStore.GetTenantSettings(r.PathValue("tenant"))
+	if errors.Is(err, ErrSettingsNotFound) {
+		http.Error(w, "Tenant has no settings", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to get tenant settings: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, settings)
+}
+
+// putTenantSettingsHandler creates or replaces a tenant's settings. Fields
+// left out are cleared.
+func putTenantSettingsHandler(w http.ResponseWriter, r *http.Request) {
+	if !isAdmin(r) {
+		http.Error(w, "Admin token required", http.StatusForbidden)
+		return
+	}
+	tenant := r.PathValue("tenant")
+	if !tenantRegex.MatchString(tenant) {
+		http.Error(w, "Invalid tenant: "+tenant, http.StatusBadRequest)
+		return
+	}
+
+	var settings TenantSettings
+	r.Body = http.MaxBytesReader(w, r.Body, maxSettingsRequestSize)
+	if err := decodeJSON(r.Body, "tenant-settings-request.json", &settings); err != nil {
+		writeError(w, "Invalid tenant settings: ", err)
+		return
+	}
+	settings.Tenant = tenant
+	settings.WebhookURL = strings.TrimSpace(settings.WebhookURL)
+	settings.NotificationChannel = strings.TrimSpace(settings.NotificationChannel)
+	if settings.DefaultProfile != "" {
+		_, err := loadProfile(settings.DefaultProfile)
+		if errors.Is(err, ErrProfileNotFound) {
+			http.Error(w, "Invalid tenant settings: unknown profile "+settings.DefaultProfile, http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Failed to load profile: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	if settings.DefaultWorkers > cfg.MaxWorkers {
+		http.Error(w, fmt.Sprintf("Invalid tenant settings: default_workers must be at most %d", cfg.MaxWorkers), http.StatusBadRequest)
+		return
+	}
+	err := checkWebhookURL("webhook_url", settings.WebhookURL)
+	if err == nil {
+		err = checkWebhookURL("notification_channel", settings.NotificationChannel)
+	}
+	if err != nil {
+		http.Error(w, "Invalid tenant settings: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	settings.UpdatedAt = time.Now().UTC()
+
+	if err := jobStore.SaveTenantSettings(&settings); err != nil {
+		http.Error(w, "Failed to save tenant settings: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Updated settings of tenant %s", tenant)
+	writeJSON(w, settings)
+}
+
+// deleteTenantSettingsHandler removes a tenant's settings
+func deleteTenantSettingsHandler(w http.ResponseWriter, r *http.Request) {
+	if !isAdmin(r) {
+		http.Error(w, "Admin token required", http.StatusForbidden)
+		return
+	}
+	err := jobStore.DeleteTenantSettings(r.PathValue("tenant"))
+	if errors.Is(err, ErrSettingsNotFound) {
+		http.Error(w, "Tenant has no settings", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to delete tenant settings: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
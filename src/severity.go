@@ -0,0 +1,93 @@
+package main
+
+import "slices"
+
+// Severities of checks and rules. Rows fail on errors; warnings are
+// reported without failing them.
+const (
+	severityError   = "error"
+	severityWarning = "warning"
+)
+
+// warningChecks returns the names of the checks whose failures are
+// warnings: those of WARNING_CHECKS, and the checks of the check set and
+// rules of the profiles whose severity is warning. Rules of further
+// profiles are named <profile>:<rule>, as in failures.
+func warningChecks(checks *CheckSet, profile *Profile, profiles []*Profile) []string {
+	names := make(map[string]bool)
+	for _, name := range cfg.WarningChecks {
+		names[name] = true
+	}
+	for _, check := range checks.Checks {
+		if check.Severity == severityWarning {
+			names[check.Name] = true
+		}
+	}
+	if profile != nil {
+		for _, rule := range profile.Rules {
+			if rule.Severity == severityWarning {
+				names[rule.name()] = true
+			}
+		}
+	}
+	for _, further := range profiles {
+		for _, rule := range further.Rules {
+			if rule.Severity == severityWarning {
+				names[further.Name+":"+rule.name()] = true
+			}
+		}
+	}
+	if len(names) == 0 {
+		return nil
+	}
+	return sortedKeys(names)
+}
+
+// warningSet returns warning check names as a set
+func warningSet(names []string) map[string]bool {
+	set := make(map[string]bool, len(names))
+	for _, name := range names {
+		set[name] = true
+	}
+	return set
+}
+
+// classify counts the failed checks of a row by severity, and sets the
+// severity of its issues
+func (v *RowValidation) classify(warnings map[string]bool) {
+	v.Errors, v.Warnings = 0, 0
+	for _, check := range v.FailedChecks() {
+		if warnings[check] {
+			v.Warnings++
+		} else {
+			v.Errors++
+		}
+	}
+	// The issues may be shared with a stored result
+	v.Issues = slices.Clone(v.Issues)
+	for i := range v.Issues {
+		v.Issues[i].Severity = severityError
+		if warnings[v.Issues[i].Check] {
+			v.Issues[i].Severity = severityWarning
+		}
+	}
+}
+
+// Failed reports whether the row failed a check of error severity. Rows
+// of results stored before severities count every failed check as one.
+func (v RowValidation) Failed() bool {
+	return len(v.FailedChecks()) > v.Warnings
+}
+
+// countSeverities classifies the failed checks of every row of a result
+// by the severities recorded in its metadata, and totals them
+func countSeverities(result *OutputFormat) {
+	warnings := warningSet(result.Metadata.WarningChecks)
+	result.Metadata.Errors, result.Metadata.Warnings = 0, 0
+	for trackID, validation := range result.Validation {
+		validation.classify(warnings)
+		result.Metadata.Errors += validation.Errors
+		result.Metadata.Warnings += validation.Warnings
+		result.Validation[trackID] = validation
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// nestedValidationKey is the key of a row's validation in nested results.
+// The underscore keeps it apart from the file's columns.
+const nestedValidationKey = "_validation"
+
+// resultShape is the JSON shape a client asks a result in
+type resultShape struct {
+	Nested     bool
+	Conversion bool
+
+	// Cells is the cells listed in a cell-level section, if any: all or
+	// failed
+	Cells string
+
+	// Split is the columns written as arrays of the values they list
+	Split []string
+
+	// Filter, if set, selects the rows returned
+	Filter *rowFilter
+}
+
+// parseShape reads the shape, conversion, cells and split options of a
+// request, and the row filter. shape=nested puts each row's validation
+// inside the row, conversion=false leaves the converted values out,
+// cells=all or cells=failed adds the outcome of the checks on each cell,
+// and split writes the values of columns as arrays.
+func parseShape(r *http.Request) (resultShape, error) {
+	shape := resultShape{Conversion: r.FormValue("conversion") != "false"}
+	switch value := r.FormValue("shape"); value {
+	case "", "keyed":
+	case "nested":
+		shape.Nested = true
+	default:
+		return shape, fileErrorf(http.StatusBadRequest, "unsupported shape %q, expected keyed or nested", value)
+	}
+	cells, err := parseCells(r)
+	if err != nil {
+		return shape, err
+	}
+	shape.Cells = cells
+	if shape.Split, err = parseSplit(r); err != nil {
+		return shape, err
+	}
+	if shape.Filter, err = parseRowFilter(r); err != nil {
+		return shape, err
+	}
+	return shape, nil
+}
+
+// apply returns the result in the shape, for encoding as JSON
+func (s resultShape) apply(result *OutputFormat) interface{} {
+	result = s.Filter.apply(result)
+	if s.Cells != "" {
+		withCells := *result
+		withCells.Cells = resultCells(result, s.Cells)
+		result = &withCells
+	}
+	if len(s.Split) > 0 {
+		withSplit := *result
+		withSplit.Conversion = result.Conversion.splitting(s.Split)
+		result = &withSplit
+	}
+	if s.Nested {
+		return nestedResult{
+			Rows:       nestedRows{conversion: result.Conversion, validation: result.Validation, values: s.Conversion},
+			resultTail: newResultTail(result),
+		}
+	}
+	if !s.Conversion {
+		return resultWithoutConversion{OutputFormat: result}
+	}
+	return result
+}
+
+// nestedRows writes the rows with each row's validation inside it,
+// optionally without the row values
+type nestedRows struct {
+	conversion Conversion
+	validation map[string]RowValidation
+	values     bool
+}
+
+func (n nestedRows) MarshalJSON() ([]byte, error) {
+	return n.conversion.marshalRows(n.values, n.field)
+}
+
+// field returns the validation of a row
+func (n nestedRows) field(row map[string]string) (string, []byte, error) {
+	validation, ok := n.validation[row["Track ID"]]
+	if !ok {
+		return nestedValidationKey, []byte("null"), nil
+	}
+	data, err := json.Marshal(validation)
+	return nestedValidationKey, data, err
+}
+
+// nestedResult is a result in the nested shape, one array of rows in place
+// of the validation map and the conversion
+type nestedResult struct {
+	Rows nestedRows `json:"rows"`
+	resultTail
+}
+
+// resultTail is the sections of a result following its rows, in either
+// shape
+type resultTail struct {
+	PII         PIIReport               `json:"pii,omitempty"`
+	Metadata    JobMetadata             `json:"metadata"`
+	Warnings    []string                `json:"warnings,omitempty"`
+	Summary     *Summary                `json:"summary,omitempty"`
+	Malformed   []MalformedRow          `json:"malformed_rows,omitempty"`
+	Cells       []Cell                  `json:"cells,omitempty"`
+	Duplicates  *Duplicates             `json:"duplicates,omitempty"`
+	Annotations map[string][]Annotation `json:"annotations,omitempty"`
+	Encryption  *Encryption             `json:"encryption,omitempty"`
+}
+
+func newResultTail(result *OutputFormat) resultTail {
+	return resultTail{
+		PII:         result.PII,
+		Metadata:    result.Metadata,
+		Warnings:    result.Warnings,
+		Summary:     result.Summary,
+		Malformed:   result.MalformedRows,
+		Cells:       result.Cells,
+		Duplicates:  result.Duplicates,
+		Annotations: result.Annotations,
+		Encryption:  result.Encryption,
+	}
+}
+
+// resultWithoutConversion is a result in the keyed shape without its
+// conversion
+type resultWithoutConversion struct {
+	*OutputFormat
+	Conversion *Conversion `json:"conversion,omitempty"`
+}
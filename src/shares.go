@@ -0,0 +1,63 @@
+package main
+
+import (
+	"math/big"
+	"strings"
+)
+
+// How the royalty shares of a row are written: as fractions of 1 (0.5),
+// as percentages with the sign (50%) or as plain numbers (50)
+const (
+	shareFraction = "fraction"
+	sharePercent  = "percent"
+	shareNumber   = "number"
+)
+
+// fractionSlack is how far the shares of a row may add up past 1 and
+// still be read as fractions, the default royalty tolerance scaled to 1
+var fractionSlack = big.NewRat(1, 1000)
+
+// normalizeShares rewrites the royalty shares of a record as plain
+// percentages, such as 50, and returns how they were written. Shares are
+// fractions if none has a % sign, each is from 0 to 1 and together they
+// add up to no more than 1. Rows with a share that is not a number, or
+// without shares, are left as they are and "" is returned.
+func normalizeShares(record map[string]string) string {
+	shares := make(map[string]*big.Rat, len(royaltyColumns))
+	format := shareNumber
+	total := new(big.Rat)
+	one := big.NewRat(1, 1)
+	for _, column := range royaltyColumns {
+		value := strings.TrimSpace(record[column])
+		if value == "" {
+			continue
+		}
+		share, ok := parseDecimal(value)
+		if !ok {
+			return ""
+		}
+		if strings.HasSuffix(value, "%") {
+			format = sharePercent
+		}
+		shares[column] = share
+		total.Add(total, share)
+	}
+	if len(shares) == 0 {
+		return ""
+	}
+
+	fractions := format == shareNumber && total.Sign() > 0 && total.Cmp(new(big.Rat).Add(one, fractionSlack)) <= 0
+	for _, share := range shares {
+		fractions = fractions && share.Sign() >= 0 && share.Cmp(one) <= 0
+	}
+	if fractions {
+		format = shareFraction
+	}
+	for column, share := range shares {
+		if fractions {
+			share.Mul(share, big.NewRat(100, 1))
+		}
+		record[column] = formatExact(share)
+	}
+	return format
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// sheetPathRegex matches the path of a Google Sheets link and captures the
+// spreadsheet ID
+var sheetPathRegex = regexp.MustCompile(`^/spreadsheets/d/([A-Za-z0-9_-]+)(/.*)?$`)
+
+// sheetGIDRegex matches a worksheet ID
+var sheetGIDRegex = regexp.MustCompile(`^[0-9]+$`)
+
+// sheetsClient fetches Google Sheets; requests are bounded by the upload's
+// context
+var sheetsClient = &http.Client{}
+
+// sheetFile is a fetched sheet, kept in a temporary file so it can be
+// checked and processed as an uploaded file
+type sheetFile struct {
+	*os.File
+	name string
+	size int64
+}
+
+// Close removes the temporary file
+func (f *sheetFile) Close() error {
+	err := f.File.Close()
+	os.Remove(f.File.Name())
+	return err
+}
+
+// sheetExportURL turns a Google Sheets share link into the link exporting
+// the shared worksheet as CSV, and returns it with the spreadsheet ID. Only
+// Google Sheets links are accepted, so the server cannot be made to fetch
+// arbitrary addresses.
+func sheetExportURL(link string) (string, string, error) {
+	u, err := url.Parse(strings.TrimSpace(link))
+	if err != nil || u.Scheme != "https" || u.Host != "docs.google.com" {
+		return "", "", fileErrorf(http.StatusBadRequest, "not a Google Sheets link: %q", link)
+	}
+	match := sheetPathRegex.FindStringSubmatch(u.Path)
+	if match == nil {
+		return "", "", fileErrorf(http.StatusBadRequest, "not a Google Sheets link: %q", link)
+	}
+
+	// The worksheet is given as ?gid= or #gid= depending on where the
+	// link was copied from; without one the first worksheet is exported
+	gid := u.Query().Get("gid")
+	if fragment, err := url.ParseQuery(u.Fragment); err == nil && fragment.Get("gid") != "" {
+		gid = fragment.Get("gid")
+	}
+	query := url.Values{"format": {"csv"}}
+	if gid != "" {
+		if !sheetGIDRegex.MatchString(gid) {
+			return "", "", fileErrorf(http.StatusBadRequest, "invalid worksheet ID %q", gid)
+		}
+		query.Set("gid", gid)
+	}
+	exportURL := strings.TrimSuffix(cfg.GoogleSheetsURL, "/") + "/spreadsheets/d/" + match[1] + "/export?" + query.Encode()
+	return exportURL, match[1], nil
+}
+
+// fetchSheet downloads a Google Sheet as CSV. Sheets shared by link need no
+// token; private sheets need an OAuth access token with read access.
+func fetchSheet(ctx context.Context, link, token string) (*sheetFile, error) {
+	exportURL, id, err := sheetExportURL(link)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, exportURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := sheetsClient.Do(req)
+	if err != nil {
+		return nil, fileErrorf(http.StatusBadGateway, "failed to reach Google Sheets: %v", err)
+	}
+	defer resp.Body.Close()
+
+	// Sheets that are not shared redirect to a sign-in page
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	switch {
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden ||
+		(resp.StatusCode == http.StatusOK && mediaType == "text/html"):
+		return nil, fileErrorf(http.StatusUnprocessableEntity,
+			"the sheet is not shared by link; share it or pass an OAuth access token in sheet_token")
+	case resp.StatusCode == http.StatusNotFound:
+		return nil, fileErrorf(http.StatusUnprocessableEntity, "the sheet or worksheet does not exist")
+	case resp.StatusCode != http.StatusOK:
+		return nil, fileErrorf(http.StatusBadGateway, "Google Sheets returned %s", resp.Status)
+	}
+
+	tmp, err := os.CreateTemp("", "sheet-*.csv")
+	if err != nil {
+		return nil, err
+	}
+	sheet := &sheetFile{File: tmp, name: sheetFilename(resp, id)}
+	if sheet.size, err = io.Copy(tmp, io.LimitReader(resp.Body, cfg.MaxUploadSize+1)); err != nil {
+		sheet.Close()
+		return nil, fileErrorf(http.StatusBadGateway, "failed to download the sheet: %v", err)
+	}
+	if sheet.size > cfg.MaxUploadSize {
+		sheet.Close()
+		return nil, fileErrorf(http.StatusRequestEntityTooLarge, "sheet exceeds %d MB", cfg.MaxUploadSize>>20)
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		sheet.Close()
+		return nil, err
+	}
+	return sheet, nil
+}
+
+// sheetFilename names the fetched sheet after the file name Google offers,
+// "<spreadsheet> - <worksheet>.csv", or after the spreadsheet ID
+func sheetFilename(resp *http.Response, id string) string {
+	if _, params, err := mime.ParseMediaType(resp.Header.Get("Content-Disposition")); err == nil {
+		if name := path.Base(params["filename"]); strings.HasSuffix(strings.ToLower(name), ".csv") {
+			return name
+		}
+	}
+	return id + ".csv"
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"strings"
+)
+
+// sniffLen is how many leading bytes of an upload are inspected
+const sniffLen = 8192
+
+// maxControlRatio is the share of control characters above which the
+// sample is considered binary rather than text
+const maxControlRatio = 0.1
+
+// checkTextContent inspects the start of the uploaded file and rejects
+// content that is not plain text, no matter what the file is called.
+// The file is rewound to the beginning afterwards.
+func checkTextContent(file multipart.File) error {
+	buf := make([]byte, sniffLen)
+	n, err := io.ReadFull(file, buf)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return fmt.Errorf("failed to read upload: %v", err)
+	}
+	buf = buf[:n]
+
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("failed to rewind upload: %v", err)
+	}
+	return checkTextSample(buf)
+}
+
+// checkTextSample rejects a sample of the upload that is not plain text
+func checkTextSample(buf []byte) error {
+	// Magic byte detection catches images, archives, PDFs and the like
+	contentType := http.DetectContentType(buf)
+	if !strings.HasPrefix(contentType, "text/") {
+		return fileErrorf(http.StatusUnsupportedMediaType,
+			"file content is not text (detected %s)", contentType)
+	}
+
+	// DetectContentType only looks at the first 512 bytes, so scan the
+	// whole sample for NUL bytes and an excess of control characters
+	if isBinary(buf) {
+		return fileErrorf(http.StatusUnsupportedMediaType,
+			"file content looks binary, expected delimited text")
+	}
+	return nil
+}
+
+// isBinary reports whether the sample contains NUL bytes or a high share of
+// control characters other than tabs, line breaks and form feeds
+func isBinary(sample []byte) bool {
+	if len(sample) == 0 {
+		return false
+	}
+	control := 0
+	for _, b := range sample {
+		switch {
+		case b == 0:
+			return true
+		case b == '\t' || b == '\n' || b == '\r' || b == '\f':
+		case b < 0x20 || b == 0x7f:
+			control++
+		}
+	}
+	return float64(control)/float64(len(sample)) > maxControlRatio
+}
+
+// checkXLSXContent rejects uploads that are not zip packages, as every XLSX
+// workbook is. The file is rewound to the beginning afterwards.
+func checkXLSXContent(file multipart.File) error {
+	return checkZipPackage(file, "an XLSX workbook")
+}
+
+// checkZipContent rejects uploads that are not zip archives. The file is
+// rewound to the beginning afterwards.
+func checkZipContent(file multipart.File) error {
+	return checkZipPackage(file, "a zip archive")
+}
+
+// checkZipPackage checks the upload starts with a zip local file header,
+// describing the expected content as kind if it does not
+func checkZipPackage(file multipart.File, kind string) error {
+	magic := make([]byte, 4)
+	n, err := io.ReadFull(file, magic)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return fmt.Errorf("failed to read upload: %v", err)
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("failed to rewind upload: %v", err)
+	}
+	if string(magic[:n]) != "PK\x03\x04" {
+		return fileErrorf(http.StatusUnsupportedMediaType,
+			"file content is not %s (detected %s)", kind, http.DetectContentType(magic[:n]))
+	}
+	return nil
+}
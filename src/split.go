@@ -0,0 +1,67 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// maxSplitColumns limits the columns a request may split
+const maxSplitColumns = 32
+
+// multiValueSeparators separate the values listed in a cell of a column;
+// other columns list values separated by semicolons
+var multiValueSeparators = map[string]string{
+	"Territories": ",",
+}
+
+// parseSplit reads the split option of a request: comma-separated columns
+// whose values are written as arrays of the values they list
+func parseSplit(r *http.Request) ([]string, error) {
+	var columns []string
+	for _, column := range strings.Split(r.FormValue("split"), ",") {
+		if column = strings.TrimSpace(column); column != "" {
+			columns = append(columns, column)
+		}
+	}
+	if len(columns) > maxSplitColumns {
+		return nil, fileErrorf(http.StatusBadRequest, "split names %d columns, at most %d may be split", len(columns), maxSplitColumns)
+	}
+	return columns, nil
+}
+
+// splitting returns the conversion with the columns named, ignoring case,
+// spaces and punctuation, written as arrays
+func (c Conversion) splitting(columns []string) Conversion {
+	if len(columns) == 0 {
+		return c
+	}
+	wanted := make(map[string]bool, len(columns))
+	for _, column := range columns {
+		wanted[normalizeColumnName(column)] = true
+	}
+	c.split = make(map[string]bool, len(columns))
+	for _, column := range c.Columns {
+		if wanted[normalizeColumnName(column)] {
+			c.split[column] = true
+		}
+	}
+	return c
+}
+
+// splitValue writes the values a cell lists as a JSON array, leaving out
+// empty ones
+func splitValue(column, value string) []byte {
+	separator, ok := multiValueSeparators[column]
+	if !ok {
+		separator = ";"
+	}
+	values := []string{}
+	for _, part := range strings.Split(value, separator) {
+		if part = strings.TrimSpace(part); part != "" {
+			values = append(values, part)
+		}
+	}
+	data, _ := json.Marshal(values)
+	return data
+}
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// sqliteMagic starts every SQLite database file
+const sqliteMagic = "SQLite format 3\x00"
+
+// isSQLite reports whether data is a SQLite database
+func isSQLite(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(sqliteMagic))
+}
+
+// readSQLiteTable reads a table of a SQLite database: its column names and
+// the values of each row as text, NULL as empty. The file is read directly
+// in the SQLite file format; WITHOUT ROWID tables and databases in UTF-16
+// are not supported.
+func readSQLiteTable(data []byte, table string) ([]string, [][]string, error) {
+	if !isSQLite(data) || len(data) < 100 {
+		return nil, nil, fmt.Errorf("not a SQLite database")
+	}
+	db := &sqliteReader{data: data, pageSize: int(binary.BigEndian.Uint16(data[16:]))}
+	if db.pageSize == 1 {
+		db.pageSize = 65536
+	}
+	if db.pageSize < 512 || db.pageSize&(db.pageSize-1) != 0 {
+		return nil, nil, fmt.Errorf("invalid page size %d", db.pageSize)
+	}
+	db.usable = db.pageSize - int(data[20])
+	if encoding := binary.BigEndian.Uint32(data[56:]); encoding > 1 {
+		return nil, nil, fmt.Errorf("only UTF-8 databases are supported")
+	}
+
+	// Find the table in the schema table: type, name, tbl_name, rootpage, sql
+	var root int
+	var sql string
+	err := db.walk(1, 0, func(_ int64, values []string) error {
+		if len(values) >= 5 && values[0] == "table" && strings.EqualFold(values[1], table) {
+			root, _ = strconv.Atoi(values[3])
+			sql = values[4]
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	if root == 0 {
+		return nil, nil, fmt.Errorf("no table %q", table)
+	}
+	columns, rowid := sqliteColumns(sql)
+	if len(columns) == 0 {
+		return nil, nil, fmt.Errorf("cannot read the columns of table %q", table)
+	}
+
+	var rows [][]string
+	err = db.walk(root, 0, func(key int64, values []string) error {
+		row := make([]string, len(columns))
+		copy(row, values)
+		// An INTEGER PRIMARY KEY column aliases the rowid and is stored as NULL
+		if rowid >= 0 {
+			row[rowid] = strconv.FormatInt(key, 10)
+		}
+		rows = append(rows, row)
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return columns, rows, nil
+}
+
+// sqliteColumns returns the column names of a CREATE TABLE statement, and
+// the index of the column aliasing the rowid or -1
+func sqliteColumns(sql string) ([]string, int) {
+	start, end := strings.Index(sql, "("), strings.LastIndex(sql, ")")
+	if start < 0 || end < start {
+		return nil, -1
+	}
+	if strings.Contains(strings.ToUpper(sql[end:]), "WITHOUT ROWID") {
+		return nil, -1
+	}
+
+	// Split the definitions on commas outside parentheses and quotes
+	var definitions []string
+	depth, from := 0, start+1
+	var quote byte
+	for i := start + 1; i < end; i++ {
+		switch c := sql[i]; {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '`' || c == '\'':
+			quote = c
+		case c == '[':
+			quote = ']'
+		case c == '(':
+			depth++
+		case c == ')':
+			depth--
+		case c == ',' && depth == 0:
+			definitions = append(definitions, sql[from:i])
+			from = i + 1
+		}
+	}
+	definitions = append(definitions, sql[from:end])
+
+	var columns []string
+	rowid := -1
+	for _, definition := range definitions {
+		definition = strings.TrimSpace(definition)
+		upper := strings.ToUpper(definition)
+		constraint := false
+		for _, keyword := range []string{"CONSTRAINT", "PRIMARY", "UNIQUE", "CHECK", "FOREIGN"} {
+			if strings.HasPrefix(upper, keyword+" ") || strings.HasPrefix(upper, keyword+"(") {
+				constraint = true
+			}
+		}
+		if constraint || definition == "" {
+			continue
+		}
+		name, rest := definition, ""
+		if i := strings.IndexByte("\"`[", definition[0]); i >= 0 {
+			closing := "\"`]"[i]
+			if j := strings.IndexByte(definition[1:], closing); j >= 0 {
+				name, rest = definition[1:j+1], definition[j+2:]
+			}
+		} else if fields := strings.Fields(definition); len(fields) > 0 {
+			name, rest = fields[0], strings.TrimPrefix(definition, fields[0])
+		}
+		if fields := strings.Fields(strings.ToUpper(rest)); len(fields) >= 3 &&
+			fields[0] == "INTEGER" && fields[1] == "PRIMARY" && fields[2] == "KEY" {
+			rowid = len(columns)
+		}
+		columns = append(columns, name)
+	}
+	return columns, rowid
+}
+
+// sqliteReader reads the pages of a database
+type sqliteReader struct {
+	data     []byte
+	pageSize int
+	usable   int
+}
+
+// page returns a page by its number, counting from 1
+func (r *sqliteReader) page(n int) ([]byte, error) {
+	if n < 1 || n*r.pageSize > len(r.data) {
+		return nil, fmt.Errorf("page %d is out of range", n)
+	}
+	return r.data[(n-1)*r.pageSize : n*r.pageSize], nil
+}
+
+// sqliteMaxDepth limits the depth of the b-trees walked, against
+// corrupted files pointing back at a parent page
+const sqliteMaxDepth = 32
+
+// walk calls fn with the rowid and the values of each record of the table
+// b-tree rooted at a page, in rowid order
+func (r *sqliteReader) walk(n, depth int, fn func(int64, []string) error) error {
+	if depth > sqliteMaxDepth {
+		return fmt.Errorf("table b-tree is too deep")
+	}
+	page, err := r.page(n)
+	if err != nil {
+		return err
+	}
+	header := 0
+	if n == 1 {
+		header = 100
+	}
+	if len(page) < header+12 {
+		return fmt.Errorf("page %d is truncated", n)
+	}
+	kind := page[header]
+	cells := int(binary.BigEndian.Uint16(page[header+3:]))
+	pointers := header + 8
+	switch kind {
+	case 0x05:
+		pointers = header + 12
+	case 0x0d:
+	default:
+		return fmt.Errorf("page %d is not a table b-tree page", n)
+	}
+	if pointers+2*cells > len(page) {
+		return fmt.Errorf("page %d is truncated", n)
+	}
+
+	for i := 0; i < cells; i++ {
+		offset := int(binary.BigEndian.Uint16(page[pointers+2*i:]))
+		if offset >= len(page) {
+			return fmt.Errorf("page %d is corrupted", n)
+		}
+		cell := page[offset:]
+		if kind == 0x05 {
+			if len(cell) < 4 {
+				return fmt.Errorf("page %d is corrupted", n)
+			}
+			if err := r.walk(int(binary.BigEndian.Uint32(cell)), depth+1, fn); err != nil {
+				return err
+			}
+			continue
+		}
+		size, k := sqliteReadVarint(cell)
+		key, l := sqliteReadVarint(cell[k:])
+		payload, err := r.payload(cell[k+l:], int(size))
+		if err != nil {
+			return fmt.Errorf("page %d: %w", n, err)
+		}
+		values, err := sqliteValues(payload)
+		if err != nil {
+			return fmt.Errorf("page %d: %w", n, err)
+		}
+		if err := fn(int64(key), values); err != nil {
+			return err
+		}
+	}
+	if kind == 0x05 {
+		return r.walk(int(binary.BigEndian.Uint32(page[header+8:])), depth+1, fn)
+	}
+	return nil
+}
+
+// payload returns the record of a leaf cell, following its overflow pages
+func (r *sqliteReader) payload(cell []byte, size int) ([]byte, error) {
+	// Thresholds from the file format, as in leafCell
+	maxLocal := r.usable - 35
+	minLocal := (r.usable-12)*32/255 - 23
+	local := size
+	if size > maxLocal {
+		local = minLocal + (size-minLocal)%(r.usable-4)
+		if local > maxLocal {
+			local = minLocal
+		}
+	}
+	if size < 0 || local > len(cell) || size > len(r.data) {
+		return nil, fmt.Errorf("record is truncated")
+	}
+	record := append([]byte(nil), cell[:local]...)
+	if local == size {
+		return record, nil
+	}
+	if local+4 > len(cell) {
+		return nil, fmt.Errorf("record is truncated")
+	}
+	next := int(binary.BigEndian.Uint32(cell[local:]))
+	for len(record) < size {
+		page, err := r.page(next)
+		if err != nil {
+			return nil, err
+		}
+		n := min(size-len(record), r.usable-4)
+		record = append(record, page[4:4+n]...)
+		next = int(binary.BigEndian.Uint32(page))
+	}
+	return record, nil
+}
+
+// sqliteValues decodes the values of a record as text
+func sqliteValues(record []byte) ([]string, error) {
+	headerSize, n := sqliteReadVarint(record)
+	if n == 0 || int(headerSize) < n || int(headerSize) > len(record) {
+		return nil, fmt.Errorf("record header is truncated")
+	}
+	header, body := record[n:headerSize], record[headerSize:]
+	var values []string
+	for len(header) > 0 {
+		serial, n := sqliteReadVarint(header)
+		if n == 0 {
+			return nil, fmt.Errorf("record header is truncated")
+		}
+		header = header[n:]
+
+		var size int
+		switch {
+		case serial >= 12:
+			size = int((serial - 12) / 2)
+		case serial >= 1 && serial <= 4:
+			size = int(serial)
+		case serial == 5:
+			size = 6
+		case serial == 6 || serial == 7:
+			size = 8
+		}
+		if size > len(body) {
+			return nil, fmt.Errorf("record is truncated")
+		}
+		value := body[:size]
+		body = body[size:]
+
+		switch {
+		case serial == 0:
+			values = append(values, "")
+		case serial <= 6:
+			// Big-endian two's complement integers of 1 to 8 bytes
+			v := int64(int8(value[0]))
+			for _, b := range value[1:] {
+				v = v<<8 | int64(b)
+			}
+			values = append(values, strconv.FormatInt(v, 10))
+		case serial == 7:
+			f := math.Float64frombits(binary.BigEndian.Uint64(value))
+			values = append(values, strconv.FormatFloat(f, 'g', -1, 64))
+		case serial == 8:
+			values = append(values, "0")
+		case serial == 9:
+			values = append(values, "1")
+		case serial >= 12:
+			values = append(values, string(value))
+		default:
+			return nil, fmt.Errorf("invalid serial type %d", serial)
+		}
+	}
+	return values, nil
+}
+
+// sqliteReadVarint decodes a SQLite varint and returns it with its length,
+// which is zero if b is too short
+func sqliteReadVarint(b []byte) (uint64, int) {
+	var v uint64
+	for i := 0; i < 9; i++ {
+		if i >= len(b) {
+			return 0, 0
+		}
+		if i == 8 {
+			return v<<8 | uint64(b[i]), 9
+		}
+		v = v<<7 | uint64(b[i]&0x7f)
+		if b[i]&0x80 == 0 {
+			return v, i + 1
+		}
+	}
+	return v, 9
+}
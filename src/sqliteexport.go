@@ -0,0 +1,344 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+)
+
+// sqliteContentType is the media type of SQLite databases
+const sqliteContentType = "application/vnd.sqlite3"
+
+// sqlitePageSize is the page size of exported databases
+const sqlitePageSize = 4096
+
+// sqliteVersion is the SQLite version recorded as having written the file
+const sqliteVersion = 3045000
+
+// writeResultSQLite writes a result as a SQLite database for querying
+// locally. The rows table holds the converted rows and the validations
+// table the validation of each row, both keyed by the row number, e.g.
+//
+//	SELECT r.* FROM rows r JOIN validations v USING ("row") WHERE NOT v.passed
+//
+// Royalty shares are REAL where they parse; empty cells are NULL. The
+// database is written directly in the SQLite file format, one table
+// b-tree per table, without indexes.
+func writeResultSQLite(result *OutputFormat) ([]byte, error) {
+	columns := exportColumns(result.Conversion)
+	rows := result.Conversion.Rows
+	db := &sqliteWriter{}
+	db.allocate() // page 1 holds the schema
+
+	// The row number is the rowid; an INTEGER PRIMARY KEY column aliases it
+	// and is stored as NULL
+	definitions := []string{`"row" INTEGER PRIMARY KEY`}
+	for _, column := range columns {
+		affinity := "TEXT"
+		if parquetType(column) == parquetDouble {
+			affinity = "REAL"
+		}
+		definitions = append(definitions, sqliteIdentifier(column)+" "+affinity)
+	}
+	records := make([][]byte, len(rows))
+	for i, row := range rows {
+		values := []interface{}{nil}
+		for _, column := range columns {
+			values = append(values, sqliteCell(column, row[column]))
+		}
+		records[i] = sqliteRecord(values)
+	}
+	rowsRoot := db.table(records)
+
+	validationColumns := []string{
+		`"row" INTEGER PRIMARY KEY`, "track_id TEXT", "release_id TEXT", "passed INTEGER",
+		"royalties_sum INTEGER", "date_format INTEGER", "territories INTEGER", "upc_valid INTEGER", "duplicate_track INTEGER",
+		"failed_checks TEXT", "reasons TEXT",
+	}
+	records = make([][]byte, len(rows))
+	for i, row := range rows {
+		v, ok := result.Validation[row["Track ID"]]
+		if !ok {
+			records[i] = sqliteRecord([]interface{}{nil, row["Track ID"], row["Release ID"]})
+			continue
+		}
+		failed := v.FailedChecks()
+		sort.Strings(failed)
+		records[i] = sqliteRecord([]interface{}{nil, v.TrackID, v.ReleaseID, !v.Failed(),
+			v.RoyaltiesSum, v.DateFormat, v.Territories, v.UPCValid, v.DuplicateTrack,
+			strings.Join(failed, ", "), failureReasons(v)})
+	}
+	validationsRoot := db.table(records)
+
+	schema := [][]byte{
+		sqliteRecord([]interface{}{"table", "rows", "rows", int64(rowsRoot),
+			"CREATE TABLE rows (" + strings.Join(definitions, ", ") + ")"}),
+		sqliteRecord([]interface{}{"table", "validations", "validations", int64(validationsRoot),
+			"CREATE TABLE validations (" + strings.Join(validationColumns, ", ") + ")"}),
+	}
+	if err := db.schema(schema); err != nil {
+		return nil, err
+	}
+	db.header()
+	return db.bytes(), nil
+}
+
+// sqliteIdentifier quotes a column name for SQL
+func sqliteIdentifier(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
+
+// sqliteCell returns the value a cell is stored as: NULL if empty, a float
+// for royalty shares that parse, and text otherwise
+func sqliteCell(column, value string) interface{} {
+	if value == "" {
+		return nil
+	}
+	if parquetType(column) == parquetDouble {
+		if v, err := parsePercentage(value); err == nil {
+			return v
+		}
+	}
+	return value
+}
+
+// sqliteRecord encodes values in the record format: a header of serial
+// types followed by the values. Values are nil, bool, int64, float64 or
+// string.
+func sqliteRecord(values []interface{}) []byte {
+	var types, body []byte
+	for _, value := range values {
+		switch v := value.(type) {
+		case nil:
+			types = sqliteVarint(types, 0)
+		case bool:
+			if v {
+				types = sqliteVarint(types, 9)
+			} else {
+				types = sqliteVarint(types, 8)
+			}
+		case int64:
+			types = sqliteVarint(types, 6)
+			body = binary.BigEndian.AppendUint64(body, uint64(v))
+		case float64:
+			types = sqliteVarint(types, 7)
+			body = binary.BigEndian.AppendUint64(body, math.Float64bits(v))
+		case string:
+			types = sqliteVarint(types, uint64(len(v))*2+13)
+			body = append(body, v...)
+		}
+	}
+	// The header size counts its own varint
+	size := len(types) + 1
+	for len(sqliteVarint(nil, uint64(size)))+len(types) != size {
+		size = len(sqliteVarint(nil, uint64(size))) + len(types)
+	}
+	record := sqliteVarint(nil, uint64(size))
+	record = append(record, types...)
+	return append(record, body...)
+}
+
+// sqliteVarint appends v as a SQLite varint: big-endian groups of 7 bits,
+// the ninth byte holding 8
+func sqliteVarint(b []byte, v uint64) []byte {
+	if v > 1<<56-1 {
+		var buf [9]byte
+		buf[8] = byte(v)
+		v >>= 8
+		for i := 7; i >= 0; i-- {
+			buf[i] = byte(v&0x7f) | 0x80
+			v >>= 7
+		}
+		return append(b, buf[:]...)
+	}
+	var buf [8]byte
+	i := len(buf) - 1
+	buf[i] = byte(v & 0x7f)
+	for v >>= 7; v > 0; v >>= 7 {
+		i--
+		buf[i] = byte(v&0x7f) | 0x80
+	}
+	return append(b, buf[i:]...)
+}
+
+// sqliteWriter lays out the pages of a database
+type sqliteWriter struct {
+	pages [][]byte
+}
+
+// allocate adds a page and returns its number, counting from 1
+func (w *sqliteWriter) allocate() int {
+	w.pages = append(w.pages, make([]byte, sqlitePageSize))
+	return len(w.pages)
+}
+
+// sqliteTreeCell is a cell of a table b-tree page
+type sqliteTreeCell struct {
+	data []byte
+	key  int64
+}
+
+// table writes records as a table b-tree keyed by rowids from 1 and
+// returns its root page
+func (w *sqliteWriter) table(records [][]byte) int {
+	// Fill leaf pages in rowid order
+	type child struct {
+		page int
+		key  int64
+	}
+	var children []child
+	var cells []sqliteTreeCell
+	used := 8
+	flush := func() {
+		page := w.allocate()
+		w.writePage(page, 0x0d, cells, 0)
+		var key int64
+		if len(cells) > 0 {
+			key = cells[len(cells)-1].key
+		}
+		children = append(children, child{page, key})
+		cells, used = nil, 8
+	}
+	for i, record := range records {
+		key := int64(i + 1)
+		cell := w.leafCell(key, record)
+		if used+len(cell)+2 > sqlitePageSize {
+			flush()
+		}
+		cells = append(cells, sqliteTreeCell{data: cell, key: key})
+		used += len(cell) + 2
+	}
+	if len(cells) > 0 || len(children) == 0 {
+		flush()
+	}
+
+	// Add interior levels until a single page holds the tree. Each interior
+	// cell points at a child and holds its largest rowid; the last child is
+	// the right-most pointer.
+	for len(children) > 1 {
+		var parents []child
+		var level []sqliteTreeCell
+		used := 12
+		for i, c := range children {
+			cell := binary.BigEndian.AppendUint32(nil, uint32(c.page))
+			cell = sqliteVarint(cell, uint64(c.key))
+			last := i == len(children)-1
+			if !last && used+len(cell)+2 <= sqlitePageSize {
+				level = append(level, sqliteTreeCell{data: cell, key: c.key})
+				used += len(cell) + 2
+				continue
+			}
+			page := w.allocate()
+			w.writePage(page, 0x05, level, c.page)
+			parents = append(parents, child{page, c.key})
+			level, used = nil, 12
+		}
+		children = parents
+	}
+	return children[0].page
+}
+
+// leafCell encodes a table leaf cell, moving the end of a large record to
+// overflow pages
+func (w *sqliteWriter) leafCell(rowid int64, record []byte) []byte {
+	cell := sqliteVarint(nil, uint64(len(record)))
+	cell = sqliteVarint(cell, uint64(rowid))
+
+	// Thresholds from the file format: records up to maxLocal bytes are
+	// stored whole, larger ones keep at least minLocal bytes on the page
+	const usable = sqlitePageSize
+	const maxLocal = usable - 35
+	const minLocal = (usable-12)*32/255 - 23
+	if len(record) <= maxLocal {
+		return append(cell, record...)
+	}
+	local := minLocal + (len(record)-minLocal)%(usable-4)
+	if local > maxLocal {
+		local = minLocal
+	}
+	cell = append(cell, record[:local]...)
+
+	rest := record[local:]
+	first := len(w.pages) + 1
+	for len(rest) > 0 {
+		page := w.allocate()
+		n := copy(w.pages[page-1][4:], rest)
+		rest = rest[n:]
+		if len(rest) > 0 {
+			binary.BigEndian.PutUint32(w.pages[page-1], uint32(page+1))
+		}
+	}
+	return binary.BigEndian.AppendUint32(cell, uint32(first))
+}
+
+// schema writes the records of the schema table on the first page, after
+// the database header
+func (w *sqliteWriter) schema(records [][]byte) error {
+	var cells []sqliteTreeCell
+	used := 100 + 8
+	for i, record := range records {
+		cell := w.leafCell(int64(i+1), record)
+		cells = append(cells, sqliteTreeCell{data: cell, key: int64(i + 1)})
+		used += len(cell) + 2
+	}
+	if used > sqlitePageSize {
+		return fmt.Errorf("schema does not fit on the first page")
+	}
+	w.writePage(1, 0x0d, cells, 0)
+	return nil
+}
+
+// writePage writes a b-tree page: its header and cell pointers, and the
+// cells packed at the end of the page. Interior pages have a right-most
+// child.
+func (w *sqliteWriter) writePage(page int, kind byte, cells []sqliteTreeCell, right int) {
+	data := w.pages[page-1]
+	header := 0
+	if page == 1 {
+		header = 100
+	}
+	content := sqlitePageSize
+	pointers := header + 8
+	if kind == 0x05 {
+		pointers = header + 12
+	}
+	for _, cell := range cells {
+		content -= len(cell.data)
+		copy(data[content:], cell.data)
+		binary.BigEndian.PutUint16(data[pointers:], uint16(content))
+		pointers += 2
+	}
+	data[header] = kind
+	binary.BigEndian.PutUint16(data[header+3:], uint16(len(cells)))
+	binary.BigEndian.PutUint16(data[header+5:], uint16(content%sqlitePageSize))
+	if kind == 0x05 {
+		binary.BigEndian.PutUint32(data[header+8:], uint32(right))
+	}
+}
+
+// header writes the database header at the start of the first page
+func (w *sqliteWriter) header() {
+	h := w.pages[0][:100]
+	copy(h, sqliteMagic)
+	binary.BigEndian.PutUint16(h[16:], sqlitePageSize)
+	h[18], h[19] = 1, 1 // legacy journal
+	h[21], h[22], h[23] = 64, 32, 32
+	binary.BigEndian.PutUint32(h[24:], 1) // change counter
+	binary.BigEndian.PutUint32(h[28:], uint32(len(w.pages)))
+	binary.BigEndian.PutUint32(h[40:], 1) // schema cookie
+	binary.BigEndian.PutUint32(h[44:], 4) // schema format
+	binary.BigEndian.PutUint32(h[56:], 1) // UTF-8
+	binary.BigEndian.PutUint32(h[92:], 1) // version-valid-for, the change counter
+	binary.BigEndian.PutUint32(h[96:], sqliteVersion)
+}
+
+// bytes returns the database file
+func (w *sqliteWriter) bytes() []byte {
+	data := make([]byte, 0, len(w.pages)*sqlitePageSize)
+	for _, page := range w.pages {
+		data = append(data, page...)
+	}
+	return data
+}
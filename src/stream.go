@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// ndjsonContentType is the media type of streamed upload responses
+const ndjsonContentType = "application/x-ndjson"
+
+// streamFlushInterval is how often streamed rows are flushed to the client
+const streamFlushInterval = time.Second
+
+// acceptsNDJSON reports whether the client asked for the upload response
+// to be streamed as JSON Lines
+func acceptsNDJSON(r *http.Request) bool {
+	return accepts(r, ndjsonContentType, "application/jsonl")
+}
+
+// StreamedRow is a record of a streamed upload response: a converted row
+// with its validation, written as it leaves the worker pool
+type StreamedRow struct {
+	Type       string            `json:"type"`
+	Row        map[string]string `json:"row"`
+	Validation RowValidation     `json:"validation"`
+}
+
+// StreamSummary is the last record of a streamed upload response. Checks
+// across rows run once every row is in, so Validation holds the revised
+// validation of the rows they failed.
+type StreamSummary struct {
+	Type       string                   `json:"type"`
+	JobID      string                   `json:"job_id"`
+	Rows       int                      `json:"rows"`
+	FailedRows int                      `json:"failed_rows"`
+	Failures   map[string]int           `json:"failures,omitempty"`
+	Validation map[string]RowValidation `json:"validation,omitempty"`
+	PII        PIIReport                `json:"pii,omitempty"`
+	Metadata   JobMetadata              `json:"metadata"`
+	Warnings   []string                 `json:"warnings,omitempty"`
+	Summary    *Summary                 `json:"summary,omitempty"`
+	Malformed  []MalformedRow           `json:"malformed_rows,omitempty"`
+	Duplicates *Duplicates              `json:"duplicates,omitempty"`
+}
+
+// StreamError ends a streamed upload response that failed after rows were
+// written
+type StreamError struct {
+	Type  string `json:"type"`
+	Error string `json:"error"`
+}
+
+// rowStream writes an upload response as JSON Lines. The response starts
+// with the first row, so errors before it are reported as usual.
+type rowStream struct {
+	w         http.ResponseWriter
+	buf       *bufio.Writer
+	encoder   *json.Encoder
+	started   bool
+	lastFlush time.Time
+
+	// held marks rows held back until the job is done, as for files
+	// deduplicated once every row is in
+	held bool
+
+	// computed are the computed columns added to each row streamed
+	computed []compiledColumn
+}
+
+// newRowStream creates a stream writing to w. Rows are written as they are
+// processed, with the computed columns that need no other row, unless held
+// is set, in which case they are written from the result before the
+// summary.
+func newRowStream(w http.ResponseWriter, held bool, computed []compiledColumn) *rowStream {
+	buf := bufio.NewWriterSize(w, 64<<10)
+	return &rowStream{w: w, buf: buf, encoder: json.NewEncoder(buf), held: held, computed: computed}
+}
+
+// hooks returns the hooks streaming each processed row, or nil if rows
+// are held back
+func (s *rowStream) hooks() *Hooks {
+	if s.held {
+		return nil
+	}
+	return &Hooks{OnRowProcessed: func(event RowEvent) {
+		s.write(StreamedRow{Type: "row", Row: computeRow(event.Row, s.computed), Validation: event.Validation})
+	}}
+}
+
+// write writes a record, starting the response if needed, and flushes the
+// records written if a while has passed. Write errors, such as the client
+// going away, are left for the request's context to report.
+func (s *rowStream) write(record interface{}) {
+	if !s.started {
+		s.started = true
+		s.w.Header().Set("Content-Type", ndjsonContentType)
+		s.w.WriteHeader(http.StatusOK)
+	}
+	s.encoder.Encode(record)
+	if time.Since(s.lastFlush) >= streamFlushInterval {
+		s.flush()
+	}
+}
+
+// flush sends the records written so far to the client
+func (s *rowStream) flush() {
+	s.buf.Flush()
+	if flusher, ok := s.w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+	s.lastFlush = time.Now()
+}
+
+// summary ends the stream with the outcome of the job, after the rows of
+// its result if they were held back
+func (s *rowStream) summary(job *Job, result *OutputFormat) {
+	if s.held {
+		for _, row := range result.Conversion.Rows {
+			s.write(StreamedRow{Type: "row", Row: row, Validation: result.Validation[row["Track ID"]]})
+		}
+	}
+	summary := StreamSummary{
+		Type:       "summary",
+		JobID:      job.ID,
+		Rows:       job.ProcessedRows,
+		FailedRows: job.FailedRows,
+		Failures:   job.Failures,
+		PII:        result.PII,
+		Metadata:   result.Metadata,
+		Warnings:   result.Warnings,
+		Summary:    result.Summary,
+		Malformed:  result.MalformedRows,
+		Duplicates: result.Duplicates,
+	}
+	for trackID, validation := range result.Validation {
+		if validation.DuplicateTrack || validation.DuplicateISRC || len(validation.ReleaseConflicts) > 0 {
+			if summary.Validation == nil {
+				summary.Validation = make(map[string]RowValidation)
+			}
+			summary.Validation[trackID] = validation
+		}
+	}
+	s.write(summary)
+	s.flush()
+}
+
+// fail ends a started stream with an error record
+func (s *rowStream) fail(err error) {
+	s.write(StreamError{Type: "error", Error: err.Error()})
+	s.flush()
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"math"
+	"strings"
+	"time"
+)
+
+// Summary totals the validation of a file, so callers need not add up the
+// rows of a result themselves
+type Summary struct {
+	Rows       int `json:"rows"`
+	PassedRows int `json:"passed_rows"`
+	FailedRows int `json:"failed_rows"`
+
+	// PassRate is the share of rows passing every check of error severity,
+	// from 0 to 1; 0 for a file without rows
+	PassRate float64 `json:"pass_rate"`
+
+	// Failures is the number of rows failing each check or rule
+	Failures map[string]int `json:"failures,omitempty"`
+
+	// Releases and Artists count the distinct Release IDs and artist names
+	Releases int `json:"releases"`
+	Artists  int `json:"artists"`
+
+	// DurationMillis is the time taken to process the file, with the parts
+	// appended to it
+	DurationMillis int64 `json:"duration_ms"`
+}
+
+// summarize totals the validation of the rows of a result processed in a
+// given time
+func summarize(result *OutputFormat, duration time.Duration) *Summary {
+	rows := result.Conversion.Rows
+	summary := &Summary{Rows: len(rows), DurationMillis: duration.Milliseconds()}
+	releases := make(map[string]bool)
+	artists := make(map[string]bool)
+	for _, row := range rows {
+		if release := strings.TrimSpace(row["Release ID"]); release != "" {
+			releases[release] = true
+		}
+		if artist := strings.TrimSpace(row["Artist Name"]); artist != "" {
+			artists[dictionaryKey(artist)] = true
+		}
+		v, ok := result.Validation[row["Track ID"]]
+		if !ok {
+			continue
+		}
+		for _, check := range v.FailedChecks() {
+			if summary.Failures == nil {
+				summary.Failures = make(map[string]int)
+			}
+			summary.Failures[check]++
+		}
+		if v.Failed() {
+			summary.FailedRows++
+		}
+	}
+	summary.PassedRows = summary.Rows - summary.FailedRows
+	if summary.Rows > 0 {
+		// Four decimals, so 2 of 3 rows is 0.6667
+		summary.PassRate = math.Round(10000*float64(summary.PassedRows)/float64(summary.Rows)) / 10000
+	}
+	summary.Releases = len(releases)
+	summary.Artists = len(artists)
+	return summary
+}
+
+// duration returns the processing time of a summary, zero if there is none
+func (s *Summary) duration() time.Duration {
+	if s == nil {
+		return 0
+	}
+	return time.Duration(s.DurationMillis) * time.Millisecond
+}
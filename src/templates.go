@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"mime"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+	"unicode/utf8"
+)
+
+// ExportTemplate is an operator-defined export format, stored as
+// TEMPLATES_DIR/<name>.<extension>.tmpl and requested with
+// format=template:<name>. The extension names the type of file produced.
+type ExportTemplate struct {
+	Name      string
+	Extension string
+	template  *template.Template
+}
+
+// TemplateData is what export templates are executed with
+type TemplateData struct {
+	JobID       string
+	Columns     []string
+	Rows        []TemplateRow
+	Summary     TemplateSummary
+	GeneratedAt time.Time
+}
+
+// TemplateRow is a converted row with the checks it failed
+type TemplateRow struct {
+	Values map[string]string
+	Failed []string
+}
+
+// Get returns the value of a column, or "" if the row has none
+func (r TemplateRow) Get(column string) string {
+	return r.Values[column]
+}
+
+// TemplateSummary sums up the exported rows
+type TemplateSummary struct {
+	Rows       int
+	FailedRows int
+	Failures   map[string]int
+	Profile    string
+	Parts      int
+}
+
+// templateFuncs are the helpers available to export templates, mostly for
+// the fixed-width and padded layouts of legacy flat files
+var templateFuncs = template.FuncMap{
+	"upper":   strings.ToUpper,
+	"lower":   strings.ToLower,
+	"trim":    strings.TrimSpace,
+	"replace": strings.ReplaceAll,
+	"join":    strings.Join,
+	"pad":     padRight,
+	"padLeft": padLeft,
+	"date":    formatTemplateDate,
+	"csv":     quoteCSV,
+}
+
+// padRight fits s to width characters, cutting it or padding it with spaces
+// on the right
+func padRight(width int, s string) string {
+	s = truncateRunes(s, width)
+	return s + strings.Repeat(" ", width-utf8.RuneCountInString(s))
+}
+
+// padLeft fits s to width characters, cutting it or padding it with pad on
+// the left, as for zero-padded numbers: padLeft 8 "0" .
+func padLeft(width int, pad, s string) string {
+	s = truncateRunes(s, width)
+	if pad == "" {
+		pad = " "
+	}
+	return strings.Repeat(pad, width-utf8.RuneCountInString(s)) + s
+}
+
+// truncateRunes cuts s to at most n characters
+func truncateRunes(s string, n int) string {
+	if utf8.RuneCountInString(s) <= n {
+		return s
+	}
+	return string([]rune(s)[:max(n, 0)])
+}
+
+// formatTemplateDate rewrites a YYYY-MM-DD date in a Go layout, leaving
+// values that are not such dates unchanged
+func formatTemplateDate(layout, value string) string {
+	date, err := time.Parse("2006-01-02", value)
+	if err != nil {
+		return value
+	}
+	return date.Format(layout)
+}
+
+// quoteCSV quotes a value for a comma-separated line if it needs it
+func quoteCSV(value string) string {
+	if !strings.ContainsAny(value, ",\"\r\n") {
+		return value
+	}
+	return `"` + strings.ReplaceAll(value, `"`, `""`) + `"`
+}
+
+// cachedTemplate is a loaded template with the state of its file
+type cachedTemplate struct {
+	template *ExportTemplate
+	path     string
+	modTime  time.Time
+	size     int64
+}
+
+// templateCache holds loaded templates by name, replaced when their file
+// changes, as profiles are
+var templateCache = struct {
+	sync.RWMutex
+	entries map[string]cachedTemplate
+}{entries: make(map[string]cachedTemplate)}
+
+// ErrTemplateNotFound is returned for template names with no template file
+var ErrTemplateNotFound = errors.New("template not found")
+
+// loadTemplate returns the named export template from the templates
+// directory. Loaded templates are cached and only parsed again when their
+// file changes.
+func loadTemplate(name string) (*ExportTemplate, error) {
+	if !profileNameRegex.MatchString(name) {
+		return nil, ErrTemplateNotFound
+	}
+	matches, err := filepath.Glob(filepath.Join(cfg.TemplatesDir, name+".*.tmpl"))
+	if err != nil {
+		return nil, err
+	}
+	if len(matches) == 0 {
+		templateCache.Lock()
+		delete(templateCache.entries, name)
+		templateCache.Unlock()
+		return nil, ErrTemplateNotFound
+	}
+	if len(matches) > 1 {
+		return nil, fmt.Errorf("template %s is defined by more than one file", name)
+	}
+	path := matches[0]
+	info, err := os.Stat(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, ErrTemplateNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read template %s: %v", name, err)
+	}
+
+	templateCache.RLock()
+	cached, ok := templateCache.entries[name]
+	templateCache.RUnlock()
+	if ok && cached.path == path && cached.modTime.Equal(info.ModTime()) && cached.size == info.Size() {
+		return cached.template, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read template %s: %v", name, err)
+	}
+	parsed, err := template.New(name).Funcs(templateFuncs).Option("missingkey=zero").Parse(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("invalid template %s: %v", name, err)
+	}
+	exportTemplate := &ExportTemplate{
+		Name:      name,
+		Extension: filepath.Ext(strings.TrimSuffix(path, ".tmpl")),
+		template:  parsed,
+	}
+	templateCache.Lock()
+	templateCache.entries[name] = cachedTemplate{template: exportTemplate, path: path, modTime: info.ModTime(), size: info.Size()}
+	templateCache.Unlock()
+	return exportTemplate, nil
+}
+
+// ContentType is the media type of the files the template produces
+func (t *ExportTemplate) ContentType() string {
+	if contentType := mime.TypeByExtension(t.Extension); contentType != "" {
+		return contentType
+	}
+	return "text/plain; charset=utf-8"
+}
+
+// Render executes the template over the rows of a result
+func (t *ExportTemplate) Render(jobID string, result *OutputFormat) ([]byte, error) {
+	data := TemplateData{
+		JobID:       jobID,
+		Columns:     result.Conversion.Columns,
+		Rows:        make([]TemplateRow, len(result.Conversion.Rows)),
+		GeneratedAt: time.Now().UTC(),
+		Summary: TemplateSummary{
+			Rows:     len(result.Conversion.Rows),
+			Failures: make(map[string]int),
+			Profile:  result.Metadata.Profile,
+			Parts:    max(result.Metadata.Parts, 1),
+		},
+	}
+	for i, row := range result.Conversion.Rows {
+		failed := result.Validation[row["Track ID"]].FailedChecks()
+		sort.Strings(failed)
+		data.Rows[i] = TemplateRow{Values: row, Failed: failed}
+		if result.Validation[row["Track ID"]].Failed() {
+			data.Summary.FailedRows++
+		}
+		for _, check := range failed {
+			data.Summary.Failures[check]++
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := t.template.Execute(&buf, data); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
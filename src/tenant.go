@@ -0,0 +1,27 @@
+package main
+
+import (
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// defaultTenant is used for requests that do not name a tenant
+const defaultTenant = "default"
+
+// tenantRegex restricts tenant names to a safe set of characters
+var tenantRegex = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,64}$`)
+
+// tenantFromRequest returns the tenant named by the X-Tenant-ID header or
+// the tenant form field, falling back to the default tenant. ok is false if
+// the name is not a valid tenant name.
+func tenantFromRequest(r *http.Request) (tenant string, ok bool) {
+	tenant = strings.TrimSpace(r.Header.Get("X-Tenant-ID"))
+	if tenant == "" {
+		tenant = strings.TrimSpace(r.FormValue("tenant"))
+	}
+	if tenant == "" {
+		return defaultTenant, true
+	}
+	return tenant, tenantRegex.MatchString(tenant)
+}
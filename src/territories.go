@@ -0,0 +1,302 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+// worldwideTerritory is the canonical code for every country
+const worldwideTerritory = "WW"
+
+// isoCountries lists the ISO 3166-1 alpha-2 country codes
+var isoCountries = strings.Fields(`
+	AD AE AF AG AI AL AM AO AQ AR AS AT AU AW AX AZ BA BB BD BE BF BG BH BI BJ
+	BL BM BN BO BQ BR BS BT BV BW BY BZ CA CC CD CF CG CH CI CK CL CM CN CO CR
+	CU CV CW CX CY CZ DE DJ DK DM DO DZ EC EE EG EH ER ES ET FI FJ FK FM FO FR
+	GA GB GD GE GF GG GH GI GL GM GN GP GQ GR GS GT GU GW GY HK HM HN HR HT HU
+	ID IE IL IM IN IO IQ IR IS IT JE JM JO JP KE KG KH KI KM KN KP KR KW KY KZ
+	LA LB LC LI LK LR LS LT LU LV LY MA MC MD ME MF MG MH MK ML MM MN MO MP MQ
+	MR MS MT MU MV MW MX MY MZ NA NC NE NF NG NI NL NO NP NR NU NZ OM PA PE PF
+	PG PH PK PL PM PN PR PS PT PW PY QA RE RO RS RU RW SA SB SC SD SE SG SH SI
+	SJ SK SL SM SN SO SR SS ST SV SX SY SZ TC TD TF TG TH TJ TK TL TM TN TO TR
+	TT TV TW TZ UA UG UM US UY UZ VA VC VE VG VI VN VU WF WS YE YT ZA ZM ZW
+`)
+
+// territoryRegions maps region codes to the countries they cover, with
+// the regions of TERRITORIES_FILE
+var territoryRegions = loadTerritoryRegions(map[string][]string{
+	worldwideTerritory: isoCountries,
+	"EU": strings.Fields(`
+		AT BE BG CY CZ DE DK EE ES FI FR GR HR HU IE IT LT LU LV MT NL PL PT RO
+		SE SI SK
+	`),
+	"LATAM": strings.Fields(`
+		AR BO BR CL CO CR CU DO EC GT HN HT MX NI PA PE PR PY SV UY VE
+	`),
+})
+
+// regionNameRegex matches the names regions of TERRITORIES_FILE may have
+var regionNameRegex = regexp.MustCompile(`^[A-Z][A-Z0-9_]+$`)
+
+// loadTerritoryRegions adds the regions of TERRITORIES_FILE to the built-in
+// ones, replacing those of the same name. The file is a JSON object of
+// region names and the countries they cover, which may be given as aliases
+// or built-in regions, e.g. {"NORDICS": ["DK", "FI", "IS", "NO", "SE"]}.
+func loadTerritoryRegions(regions map[string][]string) map[string][]string {
+	if cfg.TerritoriesFile == "" {
+		return regions
+	}
+	data, err := os.ReadFile(cfg.TerritoriesFile)
+	if err != nil {
+		log.Fatalf("Failed to read TERRITORIES_FILE: %v", err)
+	}
+	var entries map[string][]string
+	if err := json.Unmarshal(data, &entries); err != nil {
+		log.Fatalf("Failed to read TERRITORIES_FILE: %v", err)
+	}
+
+	countries := make(map[string]bool, len(isoCountries))
+	for _, code := range isoCountries {
+		countries[code] = true
+	}
+	added := make(map[string][]string, len(entries))
+	for name, members := range entries {
+		region := strings.ToUpper(strings.TrimSpace(name))
+		switch {
+		case !regionNameRegex.MatchString(region):
+			log.Fatalf("TERRITORIES_FILE region %q must be a name of letters and digits", name)
+		case countries[region] || region == worldwideTerritory || territoryExclusionWords[region] || territoryFillerWords[region]:
+			log.Fatalf("TERRITORIES_FILE region %s cannot be redefined", region)
+		case added[region] != nil:
+			log.Fatalf("TERRITORIES_FILE region %s is listed more than once", region)
+		}
+		var codes []string
+		for _, member := range members {
+			code := strings.ToUpper(strings.TrimSpace(member))
+			if alias, ok := territoryAliases[code]; ok {
+				code = alias
+			}
+			switch {
+			case countries[code]:
+				codes = append(codes, code)
+			case regions[code] != nil:
+				codes = append(codes, regions[code]...)
+			default:
+				log.Fatalf("TERRITORIES_FILE region %s: unknown territory %s", region, member)
+			}
+		}
+		if len(codes) == 0 {
+			log.Fatalf("TERRITORIES_FILE region %s lists no territories", region)
+		}
+		added[region] = codes
+	}
+	for region, codes := range added {
+		regions[region] = codes
+	}
+	return regions
+}
+
+// territoryAliases maps common non-ISO codes to their canonical code
+var territoryAliases = map[string]string{
+	"UK":        "GB",
+	"EL":        "GR",
+	"WORLD":     worldwideTerritory,
+	"WORLDWIDE": worldwideTerritory,
+}
+
+// territoryExclusionWords introduce the excluded part of a territory list,
+// as in "WW ex. CN, RU"
+var territoryExclusionWords = map[string]bool{
+	"EX":        true,
+	"EXCL":      true,
+	"EXCLUDING": true,
+	"EXCEPT":    true,
+	"MINUS":     true,
+}
+
+// territoryFillerWords carry no meaning, as in "EU only"
+var territoryFillerWords = map[string]bool{
+	"ONLY": true,
+}
+
+// territorySet is a set of countries indexed by their two-letter code
+type territorySet [26 * 26]bool
+
+// territoryIndex returns the set index of a two-letter code
+func territoryIndex(code string) int {
+	return int(code[0]-'A')*26 + int(code[1]-'A')
+}
+
+// territoryCode returns the two-letter code of a set index
+func territoryCode(index int) string {
+	return string([]byte{byte('A' + index/26), byte('A' + index%26)})
+}
+
+// add adds the countries of other to s
+func (s *territorySet) add(other *territorySet) {
+	for i, ok := range other {
+		if ok {
+			s[i] = true
+		}
+	}
+}
+
+// remove removes the countries of other from s
+func (s *territorySet) remove(other *territorySet) {
+	for i, ok := range other {
+		if ok {
+			s[i] = false
+		}
+	}
+}
+
+// contains reports whether every country of other is in s
+func (s *territorySet) contains(other *territorySet) bool {
+	for i, ok := range other {
+		if ok && !s[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// overlaps reports whether s and other have a country in common
+func (s *territorySet) overlaps(other *territorySet) bool {
+	for i, ok := range other {
+		if ok && s[i] {
+			return true
+		}
+	}
+	return false
+}
+
+// codes returns the codes in the set in alphabetical order
+func (s *territorySet) codes() []string {
+	var codes []string
+	for i, ok := range s {
+		if ok {
+			codes = append(codes, territoryCode(i))
+		}
+	}
+	return codes
+}
+
+// territorySets holds the countries covered by every known code, built once
+var territorySets = func() map[string]*territorySet {
+	sets := make(map[string]*territorySet, len(isoCountries)+len(territoryRegions))
+	for _, code := range isoCountries {
+		var set territorySet
+		set[territoryIndex(code)] = true
+		sets[code] = &set
+	}
+	for region, countries := range territoryRegions {
+		var set territorySet
+		for _, code := range countries {
+			set[territoryIndex(code)] = true
+		}
+		sets[region] = &set
+	}
+	return sets
+}()
+
+// normalizeTerritories rewrites a Territories value as a sorted,
+// deduplicated list of ISO country codes, with regions expanded and
+// exclusions applied. A value covering every country is written as "WW".
+//
+// issues describes redundant entries (duplicates, countries already covered
+// by a listed region, exclusions of countries that were never included) and
+// contradictory ones. valid is false for unknown codes, countries both
+// included and excluded, and lists that leave no country; such values are
+// returned unchanged because their intent cannot be known.
+func normalizeTerritories(value string) (normalized string, issues []string, valid bool) {
+	tokens := strings.FieldsFunc(strings.ToUpper(value), func(r rune) bool {
+		return r == ',' || r == ';' || r == '/' || r == '|' || unicode.IsSpace(r)
+	})
+	if len(tokens) == 0 {
+		return value, nil, true
+	}
+
+	valid = true
+	var included, excluded []string
+	seen := make(map[string]bool)
+	excluding := false
+	for _, token := range tokens {
+		token = strings.TrimSuffix(token, ".")
+		if territoryExclusionWords[token] {
+			excluding = true
+			continue
+		}
+		if territoryFillerWords[token] || token == "" {
+			continue
+		}
+
+		exclude := excluding
+		if strings.HasPrefix(token, "-") || strings.HasPrefix(token, "!") {
+			exclude = true
+			token = token[1:]
+		}
+		// Regions of TERRITORIES_FILE take precedence over aliases
+		if alias, ok := territoryAliases[token]; ok && territorySets[token] == nil {
+			token = alias
+		}
+		if _, ok := territorySets[token]; !ok {
+			issues = append(issues, fmt.Sprintf("unknown territory %s", token))
+			valid = false
+			continue
+		}
+
+		key := token
+		if exclude {
+			key = "-" + token
+		}
+		if seen[key] {
+			issues = append(issues, fmt.Sprintf("%s is listed more than once", token))
+			continue
+		}
+		seen[key] = true
+		if exclude {
+			excluded = append(excluded, token)
+		} else {
+			included = append(included, token)
+		}
+	}
+
+	var territories territorySet
+	for _, code := range included {
+		territories.add(territorySets[code])
+		for _, other := range included {
+			if other != code && territorySets[other].contains(territorySets[code]) {
+				issues = append(issues, fmt.Sprintf("%s is already covered by %s", code, other))
+				break
+			}
+		}
+	}
+	for _, code := range excluded {
+		if seen[code] {
+			issues = append(issues, fmt.Sprintf("%s is both included and excluded", code))
+			valid = false
+		} else if !territories.overlaps(territorySets[code]) {
+			issues = append(issues, fmt.Sprintf("%s is excluded but not included", code))
+		}
+	}
+	if !valid {
+		return value, issues, false
+	}
+
+	for _, code := range excluded {
+		territories.remove(territorySets[code])
+	}
+	codes := territories.codes()
+	switch {
+	case len(codes) == 0:
+		return value, append(issues, "no territories remain after exclusions"), false
+	case len(codes) == len(isoCountries):
+		return worldwideTerritory, issues, true
+	}
+	return strings.Join(codes, ", "), issues, true
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"time"
+)
+
+// withDeadline bounds the time a handler may take. The deadline is carried
+// by the request context, so queue waits, row processing and callouts stop
+// once it passes, as they do when the client goes away. A zero timeout
+// leaves the handler unbounded.
+func withDeadline(timeout time.Duration, handler http.HandlerFunc) http.HandlerFunc {
+	if timeout <= 0 {
+		return handler
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+		handler(w, r.WithContext(ctx))
+	}
+}
+
+// newServer creates the HTTP server with the configured connection
+// timeouts, so slow or stalled clients cannot hold connections and
+// goroutines indefinitely
+func newServer(handler http.Handler) *http.Server {
+	if cfg.WriteTimeout > 0 && (cfg.ProcessingTimeout <= 0 || cfg.WriteTimeout <= cfg.ProcessingTimeout) {
+		log.Printf("WRITE_TIMEOUT_SECONDS (%s) does not exceed PROCESSING_TIMEOUT_SECONDS (%s); long uploads may be cut off before their response is written",
+			cfg.WriteTimeout, cfg.ProcessingTimeout)
+	}
+	return &http.Server{
+		Addr:              ":" + cfg.Port,
+		Handler:           handler,
+		ReadHeaderTimeout: cfg.ReadHeaderTimeout,
+		ReadTimeout:       cfg.ReadTimeout,
+		WriteTimeout:      cfg.WriteTimeout,
+		IdleTimeout:       cfg.IdleTimeout,
+	}
+}
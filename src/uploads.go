@@ -0,0 +1,385 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Stored uploads are swept once an hour. References younger than the grace
+// period are kept even if their job cannot be found yet, and so are blobs
+// without references, so an upload is not swept between being stored and
+// its job being saved.
+const (
+	uploadSweepInterval = time.Hour
+	uploadGracePeriod   = time.Hour
+)
+
+// digestRegex matches the SHA-256 digests naming stored uploads
+var digestRegex = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// ErrUploadNotFound is returned for uploads no longer stored
+var ErrUploadNotFound = errors.New("upload not stored")
+
+// UploadStore keeps uploaded files by the SHA-256 of their content, so
+// identical files uploaded by any job or tenant are stored once. Each job
+// keeping a file holds a reference to it, and a file is deleted once no
+// job refers to it. Blobs are stored as blobs/<ab>/<digest> and references
+// as refs/<digest>/<job ID> under the store's directory, which replicas
+// may share.
+type UploadStore struct {
+	mu  sync.Mutex
+	dir string
+}
+
+// UploadStoreUsage is what the upload store holds. ReferencedBytes is the
+// space the uploads would take without deduplication.
+type UploadStoreUsage struct {
+	Blobs           int   `json:"blobs"`
+	Bytes           int64 `json:"bytes"`
+	References      int   `json:"references"`
+	ReferencedBytes int64 `json:"referenced_bytes"`
+}
+
+// uploadStore is the configured upload store, or nil if uploads are not kept
+var uploadStore = newUploadStore()
+
+// newUploadStore opens the upload store in UPLOAD_STORE_DIR, if set
+func newUploadStore() *UploadStore {
+	if cfg.UploadStoreDir == "" {
+		return nil
+	}
+	store, err := NewUploadStore(cfg.UploadStoreDir)
+	if err != nil {
+		log.Fatalf("Failed to open upload store in %s: %v", cfg.UploadStoreDir, err)
+	}
+	return store
+}
+
+// NewUploadStore creates an upload store in dir
+func NewUploadStore(dir string) (*UploadStore, error) {
+	for _, sub := range []string{"blobs", "refs", "tmp"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0o700); err != nil {
+			return nil, err
+		}
+	}
+	return &UploadStore{dir: dir}, nil
+}
+
+func (s *UploadStore) blobPath(digest string) string {
+	return filepath.Join(s.dir, "blobs", digest[:2], digest)
+}
+
+func (s *UploadStore) refsPath(digest string) string {
+	return filepath.Join(s.dir, "refs", digest)
+}
+
+// Put stores the content of r unless a file with the same content is
+// already stored, and returns its digest
+func (s *UploadStore) Put(r io.Reader) (string, error) {
+	tmp, err := os.CreateTemp(filepath.Join(s.dir, "tmp"), "upload-*")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+	hash := sha256.New()
+	_, err = io.Copy(io.MultiWriter(tmp, hash), r)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return "", err
+	}
+	digest := hex.EncodeToString(hash.Sum(nil))
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	path := s.blobPath(digest)
+	if _, err := os.Stat(path); err == nil {
+		// Restart the grace period of a blob that lost its references
+		now := time.Now()
+		return digest, os.Chtimes(path, now, now)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return "", err
+	}
+	return digest, os.Rename(tmp.Name(), path)
+}
+
+// Ref records that a job keeps the stored upload
+func (s *UploadStore) Ref(digest, jobID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := os.Stat(s.blobPath(digest)); err != nil {
+		return ErrUploadNotFound
+	}
+	if err := os.MkdirAll(s.refsPath(digest), 0o700); err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(s.refsPath(digest), jobID), nil, 0o600)
+}
+
+// Release drops a job's reference to a stored upload, deleting the upload
+// if no other job refers to it
+func (s *UploadStore) Release(digest, jobID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err := os.Remove(filepath.Join(s.refsPath(digest), jobID))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return s.removeUnreferenced(digest)
+}
+
+// removeUnreferenced deletes a stored upload without references. The
+// caller must hold the lock.
+func (s *UploadStore) removeUnreferenced(digest string) error {
+	// Removing the directory fails while it holds references
+	if err := os.Remove(s.refsPath(digest)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	err := os.Remove(s.blobPath(digest))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// Open returns a stored upload
+func (s *UploadStore) Open(digest string) (*os.File, error) {
+	if !digestRegex.MatchString(digest) {
+		return nil, ErrUploadNotFound
+	}
+	file, err := os.Open(s.blobPath(digest))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, ErrUploadNotFound
+	}
+	return file, err
+}
+
+// Sweep drops the references of jobs the job store no longer keeps and
+// deletes the uploads left without references. It returns the number of
+// uploads deleted and the bytes freed.
+func (s *UploadStore) Sweep(jobs JobStore) (int, int64, error) {
+	digests, err := s.digests()
+	if err != nil {
+		return 0, 0, err
+	}
+	cutoff := time.Now().Add(-uploadGracePeriod)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	removed, freed := 0, int64(0)
+	for _, digest := range digests {
+		refs, err := os.ReadDir(s.refsPath(digest))
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return removed, freed, err
+		}
+		for _, ref := range refs {
+			info, err := ref.Info()
+			if err != nil || info.ModTime().After(cutoff) {
+				continue
+			}
+			_, err = jobs.GetJob(ref.Name())
+			if errors.Is(err, ErrJobNotFound) {
+				err = os.Remove(filepath.Join(s.refsPath(digest), ref.Name()))
+			}
+			if err != nil {
+				return removed, freed, err
+			}
+		}
+
+		info, err := os.Stat(s.blobPath(digest))
+		if err != nil || info.ModTime().After(cutoff) {
+			continue
+		}
+		if err := s.removeUnreferenced(digest); err != nil {
+			return removed, freed, err
+		}
+		if _, err := os.Stat(s.blobPath(digest)); errors.Is(err, fs.ErrNotExist) {
+			removed++
+			freed += info.Size()
+		}
+	}
+	return removed, freed, nil
+}
+
+// Usage counts the stored uploads and their references
+func (s *UploadStore) Usage() (UploadStoreUsage, error) {
+	var usage UploadStoreUsage
+	digests, err := s.digests()
+	if err != nil {
+		return usage, err
+	}
+	for _, digest := range digests {
+		info, err := os.Stat(s.blobPath(digest))
+		if err != nil {
+			continue
+		}
+		refs, err := os.ReadDir(s.refsPath(digest))
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return usage, err
+		}
+		usage.Blobs++
+		usage.Bytes += info.Size()
+		usage.References += len(refs)
+		usage.ReferencedBytes += int64(len(refs)) * info.Size()
+	}
+	return usage, nil
+}
+
+// digests lists the digests of the stored uploads
+func (s *UploadStore) digests() ([]string, error) {
+	var digests []string
+	err := filepath.WalkDir(filepath.Join(s.dir, "blobs"), func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !entry.IsDir() && digestRegex.MatchString(entry.Name()) {
+			digests = append(digests, entry.Name())
+		}
+		return nil
+	})
+	return digests, err
+}
+
+// keepUpload stores an uploaded file if uploads are kept and returns its
+// digest for referenceUpload, or "" if it was not stored. The file is left
+// at its start. Failures are logged rather than failing the upload.
+func keepUpload(file io.ReadSeeker) string {
+	if uploadStore == nil {
+		return ""
+	}
+	digest, err := uploadStore.Put(file)
+	if err != nil {
+		log.Printf("Failed to store upload: %v", err)
+		digest = ""
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		log.Printf("Failed to rewind upload: %v", err)
+	}
+	return digest
+}
+
+// referenceUpload records a stored upload as kept by the job. The caller
+// saves the job.
+func referenceUpload(job *Job, digest string) {
+	if uploadStore == nil || digest == "" {
+		return
+	}
+	if err := uploadStore.Ref(digest, job.ID); err != nil {
+		log.Printf("Failed to keep upload %s for job %s: %v", digest, job.ID, err)
+		return
+	}
+	job.Uploads = append(job.Uploads, digest)
+}
+
+// forgetUploads releases the stored uploads of a job, deleting those no
+// other job keeps. The caller saves the job.
+func forgetUploads(job *Job) {
+	if uploadStore == nil {
+		return
+	}
+	for _, digest := range job.Uploads {
+		if err := uploadStore.Release(digest, job.ID); err != nil {
+			log.Printf("Failed to release upload %s of job %s: %v", digest, job.ID, err)
+		}
+	}
+	job.Uploads = nil
+}
+
+// runUploadSweeper sweeps the upload store periodically
+func runUploadSweeper() {
+	for {
+		time.Sleep(uploadSweepInterval)
+		removed, freed, err := uploadStore.Sweep(jobStore)
+		if err != nil {
+			log.Printf("Failed to sweep upload store: %v", err)
+		}
+		if removed > 0 {
+			log.Printf("Deleted %d stored uploads no longer referenced, freeing %d bytes", removed, freed)
+		}
+	}
+}
+
+// jobUploadHandler returns a file uploaded for a job. ?part= selects a
+// part appended later, counting the original upload as part 1.
+func jobUploadHandler(w http.ResponseWriter, r *http.Request) {
+	if uploadStore == nil {
+		http.Error(w, "Uploads are not kept, set UPLOAD_STORE_DIR", http.StatusNotFound)
+		return
+	}
+	// Uploads hold every column in plain text
+	if !canReadSensitive(r) {
+		http.Error(w, "Sensitive read token required", http.StatusForbidden)
+		return
+	}
+	id := r.PathValue("id")
+	job, err := jobStore.GetJob(id)
+	if err != nil {
+		writeStoreError(w, "Failed to get job: ", err)
+		return
+	}
+	part := 1
+	if value := r.URL.Query().Get("part"); value != "" {
+		if part, err = strconv.Atoi(value); err != nil || part < 1 {
+			http.Error(w, "Invalid part: "+value, http.StatusBadRequest)
+			return
+		}
+	}
+	if part > len(job.Uploads) {
+		http.Error(w, fmt.Sprintf("Job %s has no stored upload for part %d", id, part), http.StatusNotFound)
+		return
+	}
+
+	digest := job.Uploads[part-1]
+	file, err := uploadStore.Open(digest)
+	if errors.Is(err, ErrUploadNotFound) {
+		http.Error(w, "Upload no longer stored", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to open upload: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer file.Close()
+
+	filename := job.Filename
+	if part > 1 {
+		filename = fmt.Sprintf("%s-part%d", id, part)
+	}
+	w.Header().Set("ETag", `"`+digest+`"`)
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": filename}))
+	http.ServeContent(w, r, filename, time.Time{}, file)
+}
+
+// uploadStoreHandler reports what the upload store holds
+func uploadStoreHandler(w http.ResponseWriter, r *http.Request) {
+	if !isAdmin(r) {
+		http.Error(w, "Admin token required", http.StatusForbidden)
+		return
+	}
+	if uploadStore == nil {
+		http.Error(w, "Uploads are not kept, set UPLOAD_STORE_DIR", http.StatusNotFound)
+		return
+	}
+	usage, err := uploadStore.Usage()
+	if err != nil {
+		http.Error(w, "Failed to read upload store: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, usage)
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+)
+
+// bodyFile lets a request body read into memory be checked like an
+// uploaded file
+type bodyFile struct {
+	*bytes.Reader
+}
+
+func (bodyFile) Close() error { return nil }
+
+// validateTextHandler processes CSV sent as the raw request body, for CLI
+// tools and pipelines: curl --data-binary @file.csv -H 'Content-Type: text/csv'.
+// Options are given in the query string, with the names of the upload form
+// fields. The response is that of an upload.
+func validateTextHandler(w http.ResponseWriter, r *http.Request) {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		http.Error(w, "Content-Type must be text/csv, text/tab-separated-values or text/plain", http.StatusUnsupportedMediaType)
+		return
+	}
+	filename := "body.csv"
+	switch mediaType {
+	case "text/csv", "application/csv", "text/plain":
+	case "text/tab-separated-values":
+		filename = "body.tsv"
+	default:
+		http.Error(w, "Content-Type must be text/csv, text/tab-separated-values or text/plain, got "+mediaType, http.StatusUnsupportedMediaType)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, cfg.MaxUploadSize)
+	data, err := io.ReadAll(r.Body)
+	if err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			writeError(w, "Failed to read body: ", err)
+			return
+		}
+		http.Error(w, "Failed to read body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(bytes.TrimSpace(data)) == 0 {
+		http.Error(w, "Invalid body: body is empty", http.StatusUnprocessableEntity)
+		return
+	}
+	if err := checkTextSample(data[:min(len(data), sniffLen)]); err != nil {
+		writeError(w, "Invalid body: ", err)
+		return
+	}
+	if err := scanUpload(bodyFile{bytes.NewReader(data)}, filename); err != nil {
+		writeError(w, "Upload rejected: ", err)
+		return
+	}
+
+	if !applyTenantSettings(w, r) {
+		return
+	}
+	numWorkers, requestedWorkers, workersWarning, err := parseWorkers(r.FormValue("workers"))
+	if err != nil {
+		http.Error(w, "Invalid workers value: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	delimiter, err := parseDelimiter(r.FormValue("delimiter"))
+	if err != nil {
+		http.Error(w, "Invalid delimiter: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if delimiter == 0 && mediaType == "text/tab-separated-values" {
+		delimiter = '\t'
+	}
+	shape, err := parseShape(r)
+	if err != nil {
+		writeError(w, "Invalid shape: ", err)
+		return
+	}
+	profiles, err := parseProfiles(r.FormValue("profiles"))
+	if err != nil {
+		writeError(w, "Invalid profiles: ", err)
+		return
+	}
+	checks, err := uploadChecks(r)
+	if err != nil {
+		writeError(w, "Invalid checks: ", err)
+		return
+	}
+	validators, err := parseValidators(r.FormValue("validators"))
+	if err != nil {
+		writeError(w, "Invalid validators: ", err)
+		return
+	}
+	normalization, err := parseNormalization(r)
+	if err != nil {
+		writeError(w, "Invalid normalize: ", err)
+		return
+	}
+	computed, err := uploadComputed(r)
+	if err != nil {
+		writeError(w, "Invalid computed: ", err)
+		return
+	}
+	dedupe, err := parseDedupe(r)
+	if err != nil {
+		writeError(w, "Invalid dedupe: ", err)
+		return
+	}
+
+	job, profile, release, ok := startUploadJob(w, r, filename, numWorkers)
+	if !ok {
+		return
+	}
+	defer release()
+	referenceUpload(job, keepUpload(bytes.NewReader(data)))
+
+	opts := ProcessOptions{
+		Workers:            numWorkers,
+		ScanPII:            formBool(r, "scan_pii"),
+		RepairNumerics:     formBool(r, "repair_numerics"),
+		Normalization:      normalization,
+		NormalizeRoyalties: formBool(r, "normalize_royalties"),
+		SingleReleaseType:  formBool(r, "single_release_type"),
+		StrictHeader:       formBool(r, "strict_header"),
+		Profile:            profile,
+		Profiles:           profiles,
+		Checks:             checks,
+		Validators:         validators,
+		Computed:           computed,
+		Dedupe:             dedupe,
+		MaxHeaderSkip:      cfg.MaxHeaderSkip,
+		Delimiter:          delimiter,
+		Progress: func(rows int) {
+			job.ProcessedRows = rows
+			saveJob(job)
+		},
+	}
+	result, err := runJob(r.Context(), job, bytes.NewReader(data), opts, requestedWorkers, workersWarning)
+	finishJob(job, err)
+	if err != nil {
+		writeError(w, "Failed to process CSV: ", err)
+		return
+	}
+	if err := streamResult(w, shape, result); err != nil {
+		log.Printf("Failed to send result of job %s: %v", job.ID, err)
+	}
+}
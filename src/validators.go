@@ -0,0 +1,393 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Limits of validators: the size of a module, the validators one upload
+// may name and the size of the findings a module may return for a row
+const (
+	maxValidatorSize     = 16 << 20
+	maxValidators        = 8
+	maxValidatorFindings = 1 << 20
+)
+
+// validatorCheckPrefix starts the names of the checks of validators
+const validatorCheckPrefix = "validator:"
+
+// Validator is a WebAssembly module checking rows, stored as
+// VALIDATORS_DIR/<name>.wasm and selected with the validators form field.
+// Modules export their memory and
+//
+//	alloc(size i32) i32                   memory for the row passed in
+//	validate(ptr i32, len i32) i64        findings of a row
+//	dealloc(ptr i32, len i32)             optional, frees either buffer
+//
+// validate receives the row as a JSON object of column names and values
+// and returns the address of its findings in the high 32 bits and their
+// length in the low 32 bits: a JSON array of objects with a message and
+// optionally the column at fault. An empty array, or nothing, passes.
+type Validator struct {
+	Name string
+
+	module    *wasmModule
+	instances sync.Pool
+}
+
+// ValidatorFinding is a problem a validator found with a row
+type ValidatorFinding struct {
+	Column  string `json:"column,omitempty"`
+	Message string `json:"message"`
+}
+
+// ValidatorInfo describes a stored validator
+type ValidatorInfo struct {
+	Name      string    `json:"name"`
+	Size      int64     `json:"size"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// validatorInstance is an instance of a validator's module with its
+// exports resolved
+type validatorInstance struct {
+	*wasmInstance
+	alloc, validate uint32
+	dealloc         int64
+}
+
+// ErrValidatorNotFound is returned for names with no module file
+var ErrValidatorNotFound = errors.New("validator not found")
+
+// cachedValidator is a loaded validator with the state of its file
+type cachedValidator struct {
+	validator *Validator
+	modTime   time.Time
+	size      int64
+}
+
+// validatorCache holds loaded validators by name. Entries are replaced when
+// their file changes, so running jobs finish with the module they started
+// with.
+var validatorCache = struct {
+	sync.RWMutex
+	entries map[string]cachedValidator
+}{entries: make(map[string]cachedValidator)}
+
+// loadValidator returns the named validator from the validators directory.
+// Modules are decoded once and only read again when their file changes.
+func loadValidator(name string) (*Validator, error) {
+	if !profileNameRegex.MatchString(name) {
+		return nil, ErrValidatorNotFound
+	}
+	path := filepath.Join(cfg.ValidatorsDir, name+".wasm")
+	info, err := os.Stat(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		validatorCache.Lock()
+		delete(validatorCache.entries, name)
+		validatorCache.Unlock()
+		return nil, ErrValidatorNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read validator %s: %v", name, err)
+	}
+
+	validatorCache.RLock()
+	cached, ok := validatorCache.entries[name]
+	validatorCache.RUnlock()
+	if ok && cached.modTime.Equal(info.ModTime()) && cached.size == info.Size() {
+		return cached.validator, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read validator %s: %v", name, err)
+	}
+	validator, err := newValidator(name, data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid validator %s: %v", name, err)
+	}
+	validatorCache.Lock()
+	validatorCache.entries[name] = cachedValidator{validator: validator, modTime: info.ModTime(), size: info.Size()}
+	validatorCache.Unlock()
+	return validator, nil
+}
+
+// newValidator decodes a module and checks it can be instantiated with
+// the exports validators need
+func newValidator(name string, data []byte) (*Validator, error) {
+	module, err := decodeWasm(data)
+	if err != nil {
+		return nil, err
+	}
+	if export, ok := module.exports["memory"]; !ok || export.kind != wasmExportMemory {
+		return nil, errors.New("module does not export its memory")
+	}
+	validator := &Validator{Name: name, module: module}
+	instance, err := validator.instantiate()
+	if err != nil {
+		return nil, err
+	}
+	validator.instances.Put(instance)
+	return validator, nil
+}
+
+// instantiate creates an instance of the validator's module
+func (v *Validator) instantiate() (*validatorInstance, error) {
+	inst, err := v.module.instantiate(cfg.ValidatorFuel)
+	if err != nil {
+		return nil, err
+	}
+	instance := &validatorInstance{wasmInstance: inst, dealloc: -1}
+	if instance.alloc, err = inst.export("alloc", []byte{wasmI32}, []byte{wasmI32}); err != nil {
+		return nil, err
+	}
+	if instance.validate, err = inst.export("validate", []byte{wasmI32, wasmI32}, []byte{wasmI64}); err != nil {
+		return nil, err
+	}
+	if _, ok := v.module.exports["dealloc"]; ok {
+		dealloc, err := inst.export("dealloc", []byte{wasmI32, wasmI32}, nil)
+		if err != nil {
+			return nil, err
+		}
+		instance.dealloc = int64(dealloc)
+	}
+	return instance, nil
+}
+
+// check runs the validator against a record. Instances are reused across
+// rows; one that fails is discarded, as its state may be broken.
+func (v *Validator) check(record map[string]string) ([]ValidatorFinding, error) {
+	instance, _ := v.instances.Get().(*validatorInstance)
+	if instance == nil {
+		var err error
+		if instance, err = v.instantiate(); err != nil {
+			return nil, err
+		}
+	}
+	input, err := json.Marshal(record)
+	if err != nil {
+		return nil, err
+	}
+	fuel := cfg.ValidatorFuel
+
+	results, err := instance.call(instance.alloc, []uint64{uint64(len(input))}, fuel)
+	if err != nil {
+		return nil, err
+	}
+	ptr := uint32(results[0])
+	if uint64(ptr)+uint64(len(input)) > uint64(len(instance.memory)) {
+		return nil, errors.New("alloc returned memory out of bounds")
+	}
+	copy(instance.memory[ptr:], input)
+	if results, err = instance.call(instance.validate, []uint64{uint64(ptr), uint64(len(input))}, fuel); err != nil {
+		return nil, err
+	}
+	out, n := uint32(results[0]>>32), uint32(results[0])
+	if n > maxValidatorFindings || uint64(out)+uint64(n) > uint64(len(instance.memory)) {
+		return nil, errors.New("validate returned findings out of bounds")
+	}
+	output := append([]byte(nil), instance.memory[out:out+n]...)
+	if instance.dealloc >= 0 {
+		if _, err := instance.call(uint32(instance.dealloc), []uint64{uint64(ptr), uint64(len(input))}, fuel); err != nil {
+			return nil, err
+		}
+		if n > 0 {
+			if _, err := instance.call(uint32(instance.dealloc), []uint64{uint64(out), uint64(n)}, fuel); err != nil {
+				return nil, err
+			}
+		}
+	}
+	v.instances.Put(instance)
+
+	if strings.TrimSpace(string(output)) == "" {
+		return nil, nil
+	}
+	var findings []ValidatorFinding
+	if err := json.Unmarshal(output, &findings); err != nil {
+		return nil, fmt.Errorf("invalid findings: %v", err)
+	}
+	return findings, nil
+}
+
+// checkValidators runs validators against a record, returning the outcome
+// of each and an issue for each finding. A validator that fails to run
+// fails its check.
+func checkValidators(record map[string]string, validators []*Validator) (map[string]bool, []Issue) {
+	if len(validators) == 0 {
+		return nil, nil
+	}
+	outcomes := make(map[string]bool, len(validators))
+	var issues []Issue
+	for _, validator := range validators {
+		check := validatorCheckPrefix + validator.Name
+		findings, err := validator.check(record)
+		if err != nil {
+			issues = append(issues, Issue{Check: check, Message: fmt.Sprintf("validator %s failed: %v", validator.Name, err)})
+			outcomes[validator.Name] = false
+			continue
+		}
+		for _, finding := range findings {
+			issue := Issue{Check: check, Column: finding.Column, Message: finding.Message}
+			if finding.Column != "" {
+				issue.Value = record[finding.Column]
+			}
+			issues = append(issues, issue)
+		}
+		outcomes[validator.Name] = len(findings) == 0
+	}
+	return outcomes, issues
+}
+
+// parseValidators loads the comma-separated validators of the validators
+// field
+func parseValidators(value string) ([]*Validator, error) {
+	var names []string
+	for _, name := range strings.Split(value, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+	if len(names) > maxValidators {
+		return nil, fileErrorf(http.StatusBadRequest, "at most %d validators can be given, got %d", maxValidators, len(names))
+	}
+	return loadValidators(names)
+}
+
+// loadValidators loads validators by name, each once
+func loadValidators(names []string) ([]*Validator, error) {
+	var validators []*Validator
+	seen := make(map[string]bool, len(names))
+	for _, name := range names {
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+		validator, err := loadValidator(name)
+		if errors.Is(err, ErrValidatorNotFound) {
+			return nil, fileErrorf(http.StatusBadRequest, "unknown validator %s", name)
+		}
+		if err != nil {
+			return nil, err
+		}
+		validators = append(validators, validator)
+	}
+	return validators, nil
+}
+
+// validatorNames returns the names of validators
+func validatorNames(validators []*Validator) []string {
+	names := make([]string, len(validators))
+	for i, validator := range validators {
+		names[i] = validator.Name
+	}
+	return names
+}
+
+// validatorsHandler lists the stored validators
+func validatorsHandler(w http.ResponseWriter, r *http.Request) {
+	if !isAdmin(r) {
+		http.Error(w, "Admin token required", http.StatusForbidden)
+		return
+	}
+	entries, err := os.ReadDir(cfg.ValidatorsDir)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		http.Error(w, "Failed to list validators: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	validators := []ValidatorInfo{}
+	for _, entry := range entries {
+		name, ok := strings.CutSuffix(entry.Name(), ".wasm")
+		if !ok || entry.IsDir() || !profileNameRegex.MatchString(name) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		validators = append(validators, ValidatorInfo{Name: name, Size: info.Size(), UpdatedAt: info.ModTime().UTC()})
+	}
+	sort.Slice(validators, func(i, j int) bool { return validators[i].Name < validators[j].Name })
+	writeJSON(w, struct {
+		Validators []ValidatorInfo `json:"validators"`
+	}{validators})
+}
+
+// putValidatorHandler stores the WebAssembly module sent as the request
+// body as a validator, once it is known to load
+func putValidatorHandler(w http.ResponseWriter, r *http.Request) {
+	if !isAdmin(r) {
+		http.Error(w, "Admin token required", http.StatusForbidden)
+		return
+	}
+	name := r.PathValue("name")
+	if !profileNameRegex.MatchString(name) {
+		http.Error(w, "Invalid validator name: "+name, http.StatusBadRequest)
+		return
+	}
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxValidatorSize))
+	if err != nil {
+		writeError(w, "Failed to read module: ", err)
+		return
+	}
+	if _, err := newValidator(name, data); err != nil {
+		http.Error(w, "Invalid validator: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := os.MkdirAll(cfg.ValidatorsDir, 0o755); err != nil {
+		http.Error(w, "Failed to save validator: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	path := filepath.Join(cfg.ValidatorsDir, name+".wasm")
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		http.Error(w, "Failed to save validator: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		http.Error(w, "Failed to save validator: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		http.Error(w, "Failed to save validator: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Stored validator %s of %d bytes", name, len(data))
+	writeJSON(w, ValidatorInfo{Name: name, Size: info.Size(), UpdatedAt: info.ModTime().UTC()})
+}
+
+// deleteValidatorHandler removes a stored validator
+func deleteValidatorHandler(w http.ResponseWriter, r *http.Request) {
+	if !isAdmin(r) {
+		http.Error(w, "Admin token required", http.StatusForbidden)
+		return
+	}
+	name := r.PathValue("name")
+	if !profileNameRegex.MatchString(name) {
+		http.Error(w, "Unknown validator: "+name, http.StatusNotFound)
+		return
+	}
+	err := os.Remove(filepath.Join(cfg.ValidatorsDir, name+".wasm"))
+	if errors.Is(err, fs.ErrNotExist) {
+		http.Error(w, "Unknown validator: "+name, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to delete validator: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
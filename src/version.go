@@ -0,0 +1,89 @@
+package main
+
+import (
+	"net/http"
+	"runtime"
+	"runtime/debug"
+	"strings"
+)
+
+// Build information, injected at build time with
+// -ldflags "-X main.version=... -X main.commit=... -X main.buildDate=..."
+var (
+	version   = "dev"
+	commit    = ""
+	buildDate = ""
+)
+
+// VersionInfo describes the running build
+type VersionInfo struct {
+	Version   string   `json:"version"`
+	Commit    string   `json:"commit"`
+	BuildDate string   `json:"build_date"`
+	GoVersion string   `json:"go_version"`
+	Features  []string `json:"features"`
+}
+
+// buildVersionInfo returns the build information, falling back to the VCS
+// details embedded by the Go toolchain when no flags were injected
+func buildVersionInfo() VersionInfo {
+	info := VersionInfo{
+		Version:   version,
+		Commit:    commit,
+		BuildDate: buildDate,
+		GoVersion: runtime.Version(),
+		Features:  enabledFeatures(),
+	}
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range bi.Settings {
+			switch {
+			case setting.Key == "vcs.revision" && info.Commit == "":
+				info.Commit = setting.Value
+			case setting.Key == "vcs.time" && info.BuildDate == "":
+				info.BuildDate = setting.Value
+			}
+		}
+	}
+	if info.Commit == "" {
+		info.Commit = "unknown"
+	}
+	if info.BuildDate == "" {
+		info.BuildDate = "unknown"
+	}
+	return info
+}
+
+// enabledFeatures lists the optional features switched on in this deployment
+func enabledFeatures() []string {
+	features := []string{"job_store:" + cfg.JobStore}
+	if cfg.AlertQueueLength > 0 || cfg.AlertQueueWait > 0 {
+		features = append(features, "queue_alerts")
+	}
+	if cfg.AlertWebhookURL != "" {
+		features = append(features, "alert_webhook")
+	}
+	if cfg.VirusScanURL != "" {
+		features = append(features, "virus_scan")
+	}
+	if cfg.NotifyWebhookURL != "" || len(cfg.NotifyRoutes) > 0 {
+		features = append(features, "notifications")
+	}
+	if len(cfg.EncryptColumns) > 0 {
+		features = append(features, "field_encryption")
+	}
+	if cfg.CalloutURL != "" {
+		features = append(features, "callout:"+cfg.CalloutFailurePolicy)
+	}
+	if len(materializedViews) > 0 {
+		features = append(features, "views:"+strings.Join(materializedViews, ","))
+	}
+	if cfg.DigestSchedule != "" {
+		features = append(features, "digest:"+cfg.DigestSchedule)
+	}
+	return features
+}
+
+// versionHandler reports which build is running
+func versionHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, buildVersionInfo())
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// Materialized view kinds, listed in MATERIALIZED_VIEWS
+const (
+	ViewLabel    = "label"
+	ViewGenre    = "genre"
+	ViewFailures = "failures"
+)
+
+// viewColumns are the columns the label and genre views slice results by
+var viewColumns = map[string]string{
+	ViewLabel: "Label Name",
+	ViewGenre: "Genre",
+}
+
+// materializedViews are the view kinds precomputed as jobs complete
+var materializedViews = func() []string {
+	for _, kind := range cfg.MaterializedViews {
+		if _, ok := viewColumns[kind]; !ok && kind != ViewFailures {
+			log.Fatalf("Unknown MATERIALIZED_VIEWS entry %q, expected label, genre or failures", kind)
+		}
+	}
+	return cfg.MaterializedViews
+}()
+
+// viewName names the view of rows whose kind column holds value, such as
+// label:warp records, or the failures view if kind is failures
+func viewName(kind, value string) string {
+	if kind == ViewFailures {
+		return ViewFailures
+	}
+	return kind + ":" + strings.ToLower(strings.TrimSpace(value))
+}
+
+// buildViews slices a result into the views of the given kinds: one per
+// distinct label or genre value and one of the rows failing any check
+func buildViews(result *OutputFormat, kinds []string) map[string]*OutputFormat {
+	views := make(map[string]*OutputFormat)
+	for _, kind := range kinds {
+		if kind == ViewFailures {
+			views[ViewFailures] = sliceResult(result, func(row map[string]string) bool {
+				return failedRow(result, row)
+			})
+			continue
+		}
+		column := viewColumns[kind]
+		for _, row := range result.Conversion.Rows {
+			if strings.TrimSpace(row[column]) == "" {
+				continue
+			}
+			name := viewName(kind, row[column])
+			view := views[name]
+			if view == nil {
+				view = sliceResult(result, func(map[string]string) bool { return false })
+				views[name] = view
+			}
+			view.Conversion.Rows = append(view.Conversion.Rows, row)
+			if validation, ok := result.Validation[row["Track ID"]]; ok {
+				view.Validation[row["Track ID"]] = validation
+			}
+		}
+	}
+	return views
+}
+
+// sliceResult returns the part of a result with the rows keep accepts and
+// their validations
+func sliceResult(result *OutputFormat, keep func(row map[string]string) bool) *OutputFormat {
+	slice := &OutputFormat{
+		Validation:       make(map[string]RowValidation),
+		Conversion:       Conversion{Columns: result.Conversion.Columns, Rows: []map[string]string{}},
+		Metadata:         result.Metadata,
+		SensitiveColumns: result.SensitiveColumns,
+	}
+	for _, row := range result.Conversion.Rows {
+		if !keep(row) {
+			continue
+		}
+		slice.Conversion.Rows = append(slice.Conversion.Rows, row)
+		if validation, ok := result.Validation[row["Track ID"]]; ok {
+			slice.Validation[row["Track ID"]] = validation
+		}
+	}
+	return slice
+}
+
+// failedRow reports whether a row of the result failed a check of error
+// severity
+func failedRow(result *OutputFormat, row map[string]string) bool {
+	validation, ok := result.Validation[row["Track ID"]]
+	return ok && validation.Failed()
+}
+
+// materializeViews replaces the stored views of a job with those of its
+// current result, logging rather than failing when the store is unavailable
+func materializeViews(id string, result *OutputFormat) {
+	if len(materializedViews) == 0 {
+		return
+	}
+	if err := jobStore.SaveViews(id, buildViews(result, materializedViews)); err != nil {
+		log.Printf("Failed to save views of job %s: %v", id, err)
+	}
+}
+
+// exportView parses the filter of an export request, ?label=, ?genre= or
+// ?failures=true, and returns the name of the view it selects, or "" for
+// the whole result
+func exportView(r *http.Request) (string, error) {
+	query := r.URL.Query()
+	var views []string
+	for _, kind := range []string{ViewLabel, ViewGenre} {
+		if query.Has(kind) {
+			views = append(views, viewName(kind, query.Get(kind)))
+		}
+	}
+	if query.Has(ViewFailures) {
+		switch query.Get(ViewFailures) {
+		case "true", "1":
+			views = append(views, ViewFailures)
+		case "false", "0":
+		default:
+			return "", fmt.Errorf("failures must be true or false")
+		}
+	}
+	if len(views) > 1 {
+		return "", fmt.Errorf("only one of label, genre and failures may be given")
+	}
+	if len(views) == 0 {
+		return "", nil
+	}
+	return views[0], nil
+}
+
+// loadView returns a view of a job's result, from the materialized views if
+// it was precomputed and sliced from the result otherwise
+func loadView(id, name string) (*OutputFormat, error) {
+	view, err := jobStore.GetView(id, name)
+	if err == nil {
+		// Stored rows carry the columns, so an empty view needs them back
+		if len(view.Conversion.Rows) == 0 {
+			view.Conversion.Columns = view.Metadata.Columns
+		}
+		return view, nil
+	}
+	if !errors.Is(err, ErrJobNotFound) {
+		return nil, err
+	}
+
+	result, err := jobStore.GetResult(id)
+	if err != nil {
+		return nil, err
+	}
+	if name == ViewFailures {
+		return sliceResult(result, func(row map[string]string) bool {
+			return failedRow(result, row)
+		}), nil
+	}
+	kind, _, _ := strings.Cut(name, ":")
+	return sliceResult(result, func(row map[string]string) bool {
+		return viewName(kind, row[viewColumns[kind]]) == name
+	}), nil
+}
@@ -0,0 +1,1522 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"math/bits"
+)
+
+// WebAssembly limits of validator modules: the pages of memory an instance
+// may grow to, the depth of nested calls and the instructions one call may
+// run before it is stopped
+const (
+	wasmMaxPages     = 256
+	wasmMaxCallDepth = 1000
+	wasmPageSize     = 1 << 16
+)
+
+// Value types
+const (
+	wasmI32 = 0x7f
+	wasmI64 = 0x7e
+	wasmF32 = 0x7d
+	wasmF64 = 0x7c
+)
+
+// Export kinds
+const (
+	wasmExportFunc   = 0
+	wasmExportMemory = 2
+)
+
+// errWasmFuel is the trap of a call that ran out of instructions
+var errWasmFuel = errors.New("instruction limit exceeded")
+
+// wasmTrap is a run-time error of a WebAssembly function
+type wasmTrap struct{ reason string }
+
+func (t *wasmTrap) Error() string { return "wasm trap: " + t.reason }
+
+func trap(format string, args ...any) *wasmTrap {
+	return &wasmTrap{reason: fmt.Sprintf(format, args...)}
+}
+
+// wasmModule is a decoded WebAssembly module. Only self-contained modules
+// are supported: they may not import anything. Floating point, bulk memory,
+// sign extension and saturating truncation instructions are supported, as
+// emitted by current compilers; reference types, SIMD and threads are not.
+type wasmModule struct {
+	types     []wasmFuncType
+	funcs     []wasmFunc
+	tableSize uint32
+	hasMemory bool
+	memMin    uint32
+	memMax    uint32
+	globals   []wasmGlobal
+	exports   map[string]wasmExport
+	start     int
+	elements  []wasmElement
+	data      []wasmData
+}
+
+type wasmFuncType struct {
+	params, results []byte
+}
+
+type wasmFunc struct {
+	typ    uint32
+	locals []byte
+	code   []wasmInstr
+}
+
+type wasmGlobal struct {
+	mutable bool
+	init    uint64
+}
+
+type wasmExport struct {
+	kind  byte
+	index uint32
+}
+
+type wasmElement struct {
+	offset uint32
+	funcs  []uint32
+}
+
+type wasmData struct {
+	active bool
+	offset uint32
+	bytes  []byte
+}
+
+// wasmInstr is a decoded instruction. Opcodes after the 0xFC prefix are
+// numbered from 0x100. Blocks record the positions of their else and end
+// in a and b, and their type in typ.
+type wasmInstr struct {
+	op   uint16
+	a, b uint64
+	typ  int64
+	tab  []uint32
+}
+
+// wasmReader decodes the binary format
+type wasmReader struct {
+	buf []byte
+	pos int
+}
+
+var errWasmEOF = errors.New("unexpected end of module")
+
+func (r *wasmReader) byte() (byte, error) {
+	if r.pos >= len(r.buf) {
+		return 0, errWasmEOF
+	}
+	b := r.buf[r.pos]
+	r.pos++
+	return b, nil
+}
+
+func (r *wasmReader) bytes(n int) ([]byte, error) {
+	if n < 0 || r.pos+n > len(r.buf) {
+		return nil, errWasmEOF
+	}
+	b := r.buf[r.pos : r.pos+n]
+	r.pos += n
+	return b, nil
+}
+
+func (r *wasmReader) u32() (uint32, error) {
+	v, err := r.uleb(32)
+	return uint32(v), err
+}
+
+func (r *wasmReader) uleb(size uint) (uint64, error) {
+	var result uint64
+	var shift uint
+	for {
+		b, err := r.byte()
+		if err != nil {
+			return 0, err
+		}
+		result |= uint64(b&0x7f) << shift
+		shift += 7
+		if b&0x80 == 0 {
+			if size < 64 && result>>size != 0 {
+				return 0, errors.New("integer too large")
+			}
+			return result, nil
+		}
+		if shift >= size {
+			return 0, errors.New("integer too long")
+		}
+	}
+}
+
+func (r *wasmReader) sleb(size uint) (int64, error) {
+	var result int64
+	var shift uint
+	for {
+		b, err := r.byte()
+		if err != nil {
+			return 0, err
+		}
+		result |= int64(b&0x7f) << shift
+		shift += 7
+		if b&0x80 == 0 {
+			if shift < 64 && b&0x40 != 0 {
+				result |= -1 << shift
+			}
+			return result, nil
+		}
+		if shift >= size {
+			return 0, errors.New("integer too long")
+		}
+	}
+}
+
+func (r *wasmReader) name() (string, error) {
+	n, err := r.u32()
+	if err != nil {
+		return "", err
+	}
+	b, err := r.bytes(int(n))
+	return string(b), err
+}
+
+func (r *wasmReader) limits() (min, max uint32, hasMax bool, err error) {
+	flag, err := r.byte()
+	if err != nil {
+		return 0, 0, false, err
+	}
+	if min, err = r.u32(); err != nil {
+		return 0, 0, false, err
+	}
+	switch flag {
+	case 0:
+		return min, 0, false, nil
+	case 1:
+		max, err = r.u32()
+		return min, max, true, err
+	}
+	return 0, 0, false, fmt.Errorf("unsupported limits 0x%02x", flag)
+}
+
+// constExpr evaluates a constant expression: a constant or the value of
+// an earlier global
+func (r *wasmReader) constExpr(globals []wasmGlobal) (uint64, error) {
+	op, err := r.byte()
+	if err != nil {
+		return 0, err
+	}
+	var value uint64
+	switch op {
+	case 0x41:
+		v, err := r.sleb(32)
+		if err != nil {
+			return 0, err
+		}
+		value = uint64(uint32(v))
+	case 0x42:
+		v, err := r.sleb(64)
+		if err != nil {
+			return 0, err
+		}
+		value = uint64(v)
+	case 0x43:
+		b, err := r.bytes(4)
+		if err != nil {
+			return 0, err
+		}
+		value = uint64(binary.LittleEndian.Uint32(b))
+	case 0x44:
+		b, err := r.bytes(8)
+		if err != nil {
+			return 0, err
+		}
+		value = binary.LittleEndian.Uint64(b)
+	case 0x23:
+		i, err := r.u32()
+		if err != nil {
+			return 0, err
+		}
+		if int(i) >= len(globals) {
+			return 0, fmt.Errorf("unknown global %d", i)
+		}
+		value = globals[i].init
+	default:
+		return 0, fmt.Errorf("unsupported constant expression 0x%02x", op)
+	}
+	if end, err := r.byte(); err != nil || end != 0x0b {
+		return 0, errors.New("constant expression not terminated")
+	}
+	return value, nil
+}
+
+// decodeWasm decodes a module in the WebAssembly binary format
+func decodeWasm(data []byte) (*wasmModule, error) {
+	if len(data) < 8 || string(data[:4]) != "\x00asm" || binary.LittleEndian.Uint32(data[4:8]) != 1 {
+		return nil, errors.New("not a WebAssembly module")
+	}
+	m := &wasmModule{exports: make(map[string]wasmExport), start: -1}
+	r := &wasmReader{buf: data, pos: 8}
+	var funcTypes []uint32
+	for r.pos < len(r.buf) {
+		id, err := r.byte()
+		if err != nil {
+			return nil, err
+		}
+		size, err := r.u32()
+		if err != nil {
+			return nil, err
+		}
+		body, err := r.bytes(int(size))
+		if err != nil {
+			return nil, err
+		}
+		s := &wasmReader{buf: body}
+		switch id {
+		case 0, 12: // custom sections, data count
+			continue
+		case 1:
+			err = m.decodeTypes(s)
+		case 2:
+			var count uint32
+			if count, err = s.u32(); err == nil && count > 0 {
+				module, _ := s.name()
+				name, _ := s.name()
+				err = fmt.Errorf("validator modules cannot import anything, but it imports %s.%s", module, name)
+			}
+		case 3:
+			funcTypes, err = decodeVector(s, func(s *wasmReader) (uint32, error) { return s.u32() })
+		case 4:
+			err = m.decodeTable(s)
+		case 5:
+			err = m.decodeMemory(s)
+		case 6:
+			err = m.decodeGlobals(s)
+		case 7:
+			err = m.decodeExports(s)
+		case 8:
+			var start uint32
+			start, err = s.u32()
+			m.start = int(start)
+		case 9:
+			err = m.decodeElements(s)
+		case 10:
+			err = m.decodeCode(s, funcTypes)
+		case 11:
+			err = m.decodeData(s)
+		default:
+			err = fmt.Errorf("unknown section %d", id)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(m.funcs) != len(funcTypes) {
+		return nil, errors.New("function and code sections disagree")
+	}
+	for _, f := range m.funcs {
+		if int(f.typ) >= len(m.types) {
+			return nil, fmt.Errorf("unknown type %d", f.typ)
+		}
+	}
+	if m.start >= len(m.funcs) {
+		return nil, fmt.Errorf("unknown start function %d", m.start)
+	}
+	for name, export := range m.exports {
+		if export.kind == wasmExportFunc && int(export.index) >= len(m.funcs) {
+			return nil, fmt.Errorf("export %s: unknown function %d", name, export.index)
+		}
+	}
+	return m, nil
+}
+
+// decodeVector decodes a vector of items
+func decodeVector[T any](r *wasmReader, item func(*wasmReader) (T, error)) ([]T, error) {
+	count, err := r.u32()
+	if err != nil {
+		return nil, err
+	}
+	if int(count) > len(r.buf)-r.pos {
+		return nil, errWasmEOF
+	}
+	items := make([]T, 0, count)
+	for i := uint32(0); i < count; i++ {
+		v, err := item(r)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, v)
+	}
+	return items, nil
+}
+
+func (m *wasmModule) decodeTypes(r *wasmReader) (err error) {
+	valueTypes := func(r *wasmReader) ([]byte, error) {
+		n, err := r.u32()
+		if err != nil {
+			return nil, err
+		}
+		types, err := r.bytes(int(n))
+		for _, t := range types {
+			if t < wasmF64 || t > wasmI32 {
+				return nil, fmt.Errorf("unsupported value type 0x%02x", t)
+			}
+		}
+		return types, err
+	}
+	m.types, err = decodeVector(r, func(r *wasmReader) (wasmFuncType, error) {
+		if form, err := r.byte(); err != nil || form != 0x60 {
+			return wasmFuncType{}, errors.New("malformed function type")
+		}
+		params, err := valueTypes(r)
+		if err != nil {
+			return wasmFuncType{}, err
+		}
+		results, err := valueTypes(r)
+		return wasmFuncType{params: params, results: results}, err
+	})
+	return err
+}
+
+func (m *wasmModule) decodeTable(r *wasmReader) error {
+	count, err := r.u32()
+	if err != nil || count == 0 {
+		return err
+	}
+	if count > 1 {
+		return errors.New("only one table is supported")
+	}
+	if kind, err := r.byte(); err != nil || kind != 0x70 {
+		return errors.New("only function tables are supported")
+	}
+	m.tableSize, _, _, err = r.limits()
+	if m.tableSize > 1<<20 {
+		return errors.New("table too large")
+	}
+	return err
+}
+
+func (m *wasmModule) decodeMemory(r *wasmReader) error {
+	count, err := r.u32()
+	if err != nil || count == 0 {
+		return err
+	}
+	if count > 1 {
+		return errors.New("only one memory is supported")
+	}
+	min, max, hasMax, err := r.limits()
+	if err != nil {
+		return err
+	}
+	if !hasMax || max > wasmMaxPages {
+		max = wasmMaxPages
+	}
+	if min > max {
+		return fmt.Errorf("memory of %d pages exceeds the limit of %d", min, wasmMaxPages)
+	}
+	m.hasMemory, m.memMin, m.memMax = true, min, max
+	return nil
+}
+
+func (m *wasmModule) decodeGlobals(r *wasmReader) error {
+	count, err := r.u32()
+	if err != nil {
+		return err
+	}
+	for i := uint32(0); i < count; i++ {
+		if _, err := r.byte(); err != nil {
+			return err
+		}
+		mutable, err := r.byte()
+		if err != nil {
+			return err
+		}
+		init, err := r.constExpr(m.globals)
+		if err != nil {
+			return err
+		}
+		m.globals = append(m.globals, wasmGlobal{mutable: mutable == 1, init: init})
+	}
+	return nil
+}
+
+func (m *wasmModule) decodeExports(r *wasmReader) error {
+	count, err := r.u32()
+	if err != nil {
+		return err
+	}
+	for i := uint32(0); i < count; i++ {
+		name, err := r.name()
+		if err != nil {
+			return err
+		}
+		kind, err := r.byte()
+		if err != nil {
+			return err
+		}
+		index, err := r.u32()
+		if err != nil {
+			return err
+		}
+		m.exports[name] = wasmExport{kind: kind, index: index}
+	}
+	return nil
+}
+
+func (m *wasmModule) decodeElements(r *wasmReader) error {
+	count, err := r.u32()
+	if err != nil {
+		return err
+	}
+	for i := uint32(0); i < count; i++ {
+		flags, err := r.u32()
+		if err != nil {
+			return err
+		}
+		if flags != 0 {
+			return fmt.Errorf("unsupported element segment kind %d", flags)
+		}
+		offset, err := r.constExpr(m.globals)
+		if err != nil {
+			return err
+		}
+		funcs, err := decodeVector(r, func(r *wasmReader) (uint32, error) { return r.u32() })
+		if err != nil {
+			return err
+		}
+		m.elements = append(m.elements, wasmElement{offset: uint32(offset), funcs: funcs})
+	}
+	return nil
+}
+
+func (m *wasmModule) decodeData(r *wasmReader) error {
+	count, err := r.u32()
+	if err != nil {
+		return err
+	}
+	for i := uint32(0); i < count; i++ {
+		flags, err := r.u32()
+		if err != nil {
+			return err
+		}
+		segment := wasmData{active: flags != 1}
+		switch flags {
+		case 0, 1:
+		case 2:
+			if memory, err := r.u32(); err != nil || memory != 0 {
+				return errors.New("unknown memory in data segment")
+			}
+		default:
+			return fmt.Errorf("unsupported data segment kind %d", flags)
+		}
+		if segment.active {
+			offset, err := r.constExpr(m.globals)
+			if err != nil {
+				return err
+			}
+			segment.offset = uint32(offset)
+		}
+		n, err := r.u32()
+		if err != nil {
+			return err
+		}
+		if segment.bytes, err = r.bytes(int(n)); err != nil {
+			return err
+		}
+		m.data = append(m.data, segment)
+	}
+	return nil
+}
+
+func (m *wasmModule) decodeCode(r *wasmReader, funcTypes []uint32) error {
+	count, err := r.u32()
+	if err != nil {
+		return err
+	}
+	if int(count) != len(funcTypes) {
+		return errors.New("function and code sections disagree")
+	}
+	for i := uint32(0); i < count; i++ {
+		size, err := r.u32()
+		if err != nil {
+			return err
+		}
+		body, err := r.bytes(int(size))
+		if err != nil {
+			return err
+		}
+		f := wasmFunc{typ: funcTypes[i]}
+		b := &wasmReader{buf: body}
+		groups, err := b.u32()
+		if err != nil {
+			return err
+		}
+		for j := uint32(0); j < groups; j++ {
+			n, err := b.u32()
+			if err != nil {
+				return err
+			}
+			t, err := b.byte()
+			if err != nil {
+				return err
+			}
+			if len(f.locals)+int(n) > 50000 {
+				return fmt.Errorf("function %d has too many locals", i)
+			}
+			for k := uint32(0); k < n; k++ {
+				f.locals = append(f.locals, t)
+			}
+		}
+		if f.code, err = decodeInstructions(b); err != nil {
+			return fmt.Errorf("function %d: %v", i, err)
+		}
+		m.funcs = append(m.funcs, f)
+	}
+	return nil
+}
+
+// decodeInstructions decodes a function body, pairing each block with its
+// else and end
+func decodeInstructions(r *wasmReader) ([]wasmInstr, error) {
+	var code []wasmInstr
+	var open []int
+	for r.pos < len(r.buf) {
+		op, err := r.byte()
+		if err != nil {
+			return nil, err
+		}
+		in := wasmInstr{op: uint16(op)}
+		switch {
+		case op == 0x02 || op == 0x03 || op == 0x04:
+			if in.typ, err = r.sleb(33); err != nil {
+				return nil, err
+			}
+			open = append(open, len(code))
+		case op == 0x05:
+			if len(open) == 0 || code[open[len(open)-1]].op != 0x04 {
+				return nil, errors.New("else outside if")
+			}
+			code[open[len(open)-1]].a = uint64(len(code))
+		case op == 0x0b:
+			if len(open) > 0 {
+				start := open[len(open)-1]
+				open = open[:len(open)-1]
+				code[start].b = uint64(len(code))
+				if code[start].op == 0x04 {
+					if code[start].a == 0 {
+						code[start].a = uint64(len(code))
+					} else {
+						// The else jumps to the end of its if
+						code[code[start].a].b = uint64(len(code))
+					}
+				}
+			}
+		case op == 0x0c || op == 0x0d || op == 0x10 || (op >= 0x20 && op <= 0x24):
+			v, err := r.u32()
+			if err != nil {
+				return nil, err
+			}
+			in.a = uint64(v)
+		case op == 0x0e:
+			if in.tab, err = decodeVector(r, func(r *wasmReader) (uint32, error) { return r.u32() }); err != nil {
+				return nil, err
+			}
+			v, err := r.u32()
+			if err != nil {
+				return nil, err
+			}
+			in.a = uint64(v)
+		case op == 0x11:
+			typ, err := r.u32()
+			if err != nil {
+				return nil, err
+			}
+			if table, err := r.u32(); err != nil || table != 0 {
+				return nil, errors.New("unknown table")
+			}
+			in.a = uint64(typ)
+		case op == 0x1c:
+			if _, err := decodeVector(r, func(r *wasmReader) (byte, error) { return r.byte() }); err != nil {
+				return nil, err
+			}
+			in.op = 0x1b
+		case op >= 0x28 && op <= 0x3e:
+			if _, err := r.u32(); err != nil { // alignment
+				return nil, err
+			}
+			v, err := r.u32()
+			if err != nil {
+				return nil, err
+			}
+			in.a = uint64(v)
+		case op == 0x3f || op == 0x40:
+			if _, err := r.byte(); err != nil {
+				return nil, err
+			}
+		case op == 0x41:
+			v, err := r.sleb(32)
+			if err != nil {
+				return nil, err
+			}
+			in.a = uint64(uint32(v))
+		case op == 0x42:
+			v, err := r.sleb(64)
+			if err != nil {
+				return nil, err
+			}
+			in.a = uint64(v)
+		case op == 0x43:
+			b, err := r.bytes(4)
+			if err != nil {
+				return nil, err
+			}
+			in.a = uint64(binary.LittleEndian.Uint32(b))
+		case op == 0x44:
+			b, err := r.bytes(8)
+			if err != nil {
+				return nil, err
+			}
+			in.a = binary.LittleEndian.Uint64(b)
+		case op == 0xfc:
+			sub, err := r.u32()
+			if err != nil {
+				return nil, err
+			}
+			in.op = 0x100 + uint16(sub)
+			switch sub {
+			case 0, 1, 2, 3, 4, 5, 6, 7:
+			case 8: // memory.init
+				v, err := r.u32()
+				if err != nil {
+					return nil, err
+				}
+				in.a = uint64(v)
+				if _, err := r.byte(); err != nil {
+					return nil, err
+				}
+			case 9: // data.drop
+				v, err := r.u32()
+				if err != nil {
+					return nil, err
+				}
+				in.a = uint64(v)
+			case 10: // memory.copy
+				if _, err := r.bytes(2); err != nil {
+					return nil, err
+				}
+			case 11: // memory.fill
+				if _, err := r.byte(); err != nil {
+					return nil, err
+				}
+			default:
+				return nil, fmt.Errorf("unsupported instruction 0xfc %d", sub)
+			}
+		case op == 0x00 || op == 0x01 || op == 0x0f || op == 0x1a || op == 0x1b || (op >= 0x45 && op <= 0xc4):
+		default:
+			return nil, fmt.Errorf("unsupported instruction 0x%02x", op)
+		}
+		code = append(code, in)
+	}
+	if len(open) > 0 || len(code) == 0 || code[len(code)-1].op != 0x0b {
+		return nil, errors.New("unterminated function body")
+	}
+	return code, nil
+}
+
+// wasmInstance is an instantiated module. Instances are not safe for
+// concurrent use.
+type wasmInstance struct {
+	module  *wasmModule
+	memory  []byte
+	globals []uint64
+	table   []int64
+	dropped []bool
+	stack   []uint64
+	fuel    int64
+	depth   int
+}
+
+// instantiate creates an instance of the module and runs its start function
+func (m *wasmModule) instantiate(fuel int64) (*wasmInstance, error) {
+	inst := &wasmInstance{module: m, dropped: make([]bool, len(m.data))}
+	if m.hasMemory {
+		inst.memory = make([]byte, int(m.memMin)*wasmPageSize)
+	}
+	for _, g := range m.globals {
+		inst.globals = append(inst.globals, g.init)
+	}
+	inst.table = make([]int64, m.tableSize)
+	for i := range inst.table {
+		inst.table[i] = -1
+	}
+	for _, e := range m.elements {
+		if uint64(e.offset)+uint64(len(e.funcs)) > uint64(len(inst.table)) {
+			return nil, errors.New("element segment out of table bounds")
+		}
+		for i, f := range e.funcs {
+			if int(f) >= len(m.funcs) {
+				return nil, fmt.Errorf("element segment: unknown function %d", f)
+			}
+			inst.table[int(e.offset)+i] = int64(f)
+		}
+	}
+	for i, d := range m.data {
+		if !d.active {
+			continue
+		}
+		if uint64(d.offset)+uint64(len(d.bytes)) > uint64(len(inst.memory)) {
+			return nil, errors.New("data segment out of memory bounds")
+		}
+		copy(inst.memory[d.offset:], d.bytes)
+		inst.dropped[i] = true
+	}
+	if m.start >= 0 {
+		if _, err := inst.call(uint32(m.start), nil, fuel); err != nil {
+			return nil, fmt.Errorf("start function: %w", err)
+		}
+	}
+	return inst, nil
+}
+
+// export returns the index of an exported function of the given type
+func (inst *wasmInstance) export(name string, params, results []byte) (uint32, error) {
+	export, ok := inst.module.exports[name]
+	if !ok || export.kind != wasmExportFunc {
+		return 0, fmt.Errorf("module does not export function %s", name)
+	}
+	t := inst.module.types[inst.module.funcs[export.index].typ]
+	if string(t.params) != string(params) || string(t.results) != string(results) {
+		return 0, fmt.Errorf("exported function %s has the wrong signature", name)
+	}
+	return export.index, nil
+}
+
+// call runs a function with at most fuel instructions. Any fault of the
+// module, such as a malformed body, is returned as a trap.
+func (inst *wasmInstance) call(f uint32, args []uint64, fuel int64) (results []uint64, err error) {
+	inst.fuel, inst.depth = fuel, 0
+	inst.stack = append(inst.stack[:0], args...)
+	defer func() {
+		if r := recover(); r != nil {
+			if t, ok := r.(*wasmTrap); ok {
+				err = t
+			} else {
+				err = trap("invalid module: %v", r)
+			}
+		}
+	}()
+	if err := inst.invoke(f); err != nil {
+		return nil, err
+	}
+	return append([]uint64(nil), inst.stack...), nil
+}
+
+type wasmLabel struct {
+	cont   int
+	height int
+	arity  int
+}
+
+// blockArity returns the parameter and result counts of a block type
+func (inst *wasmInstance) blockArity(typ int64) (params, results int) {
+	switch {
+	case typ == -64: // empty
+		return 0, 0
+	case typ < 0: // a value type
+		return 0, 1
+	}
+	t := inst.module.types[typ]
+	return len(t.params), len(t.results)
+}
+
+// invoke runs a function on the shared stack, leaving its results in
+// place of its arguments
+func (inst *wasmInstance) invoke(index uint32) error {
+	inst.depth++
+	if inst.depth > wasmMaxCallDepth {
+		return trap("call stack exhausted")
+	}
+	defer func() { inst.depth-- }()
+
+	f := &inst.module.funcs[index]
+	t := inst.module.types[f.typ]
+	base := len(inst.stack) - len(t.params)
+	if base < 0 {
+		panic(trap("stack underflow"))
+	}
+	locals := make([]uint64, len(t.params)+len(f.locals))
+	copy(locals, inst.stack[base:])
+	inst.stack = inst.stack[:base]
+
+	labels := []wasmLabel{{cont: len(f.code), height: base, arity: len(t.results)}}
+	code := f.code
+	for pc := 0; pc < len(code); pc++ {
+		inst.fuel--
+		if inst.fuel < 0 {
+			return errWasmFuel
+		}
+		in := &code[pc]
+		switch in.op {
+		case 0x00:
+			return trap("unreachable")
+		case 0x01:
+		case 0x02, 0x03:
+			params, results := inst.blockArity(in.typ)
+			label := wasmLabel{cont: int(in.b), height: len(inst.stack) - params, arity: results}
+			if in.op == 0x03 {
+				label = wasmLabel{cont: pc, height: len(inst.stack) - params, arity: params}
+			}
+			labels = append(labels, label)
+		case 0x04:
+			cond := inst.pop32()
+			params, results := inst.blockArity(in.typ)
+			labels = append(labels, wasmLabel{cont: int(in.b), height: len(inst.stack) - params, arity: results})
+			if cond == 0 {
+				// Jump into the else arm, or onto the end
+				pc = int(in.a)
+				if code[pc].op == 0x0b {
+					pc--
+				}
+			}
+		case 0x05:
+			pc = int(in.b) - 1
+		case 0x0b:
+			labels = labels[:len(labels)-1]
+		case 0x0c:
+			pc = inst.branch(&labels, int(in.a), code)
+		case 0x0d:
+			if inst.pop32() != 0 {
+				pc = inst.branch(&labels, int(in.a), code)
+			}
+		case 0x0e:
+			i := inst.pop32()
+			depth := in.a
+			if uint64(i) < uint64(len(in.tab)) {
+				depth = uint64(in.tab[i])
+			}
+			pc = inst.branch(&labels, int(depth), code)
+		case 0x0f:
+			pc = inst.branch(&labels, len(labels)-1, code)
+		case 0x10:
+			if err := inst.invoke(uint32(in.a)); err != nil {
+				return err
+			}
+		case 0x11:
+			i := inst.pop32()
+			if uint64(i) >= uint64(len(inst.table)) || inst.table[i] < 0 {
+				return trap("undefined table element %d", i)
+			}
+			callee := uint32(inst.table[i])
+			want, got := inst.module.types[in.a], inst.module.types[inst.module.funcs[callee].typ]
+			if string(want.params) != string(got.params) || string(want.results) != string(got.results) {
+				return trap("indirect call signature mismatch")
+			}
+			if err := inst.invoke(callee); err != nil {
+				return err
+			}
+		case 0x1a:
+			inst.pop()
+		case 0x1b:
+			cond := inst.pop32()
+			b := inst.pop()
+			if cond == 0 {
+				inst.stack[len(inst.stack)-1] = b
+			}
+		case 0x20:
+			inst.push(locals[in.a])
+		case 0x21:
+			locals[in.a] = inst.pop()
+		case 0x22:
+			locals[in.a] = inst.stack[len(inst.stack)-1]
+		case 0x23:
+			inst.push(inst.globals[in.a])
+		case 0x24:
+			inst.globals[in.a] = inst.pop()
+		case 0x3f:
+			inst.push(uint64(len(inst.memory) / wasmPageSize))
+		case 0x40:
+			inst.push(uint64(inst.grow(inst.pop32())))
+		case 0x41, 0x42, 0x43, 0x44:
+			inst.push(in.a)
+		case 0x100 + 8: // memory.init
+			n, src, dst := inst.pop32(), inst.pop32(), inst.pop32()
+			segment := inst.module.data[in.a].bytes
+			if inst.dropped[in.a] {
+				segment = nil
+			}
+			if uint64(src)+uint64(n) > uint64(len(segment)) {
+				return trap("out of bounds memory access")
+			}
+			copy(inst.mem(dst, n), segment[src:src+n])
+		case 0x100 + 9: // data.drop
+			inst.dropped[in.a] = true
+		case 0x100 + 10: // memory.copy
+			n, src, dst := inst.pop32(), inst.pop32(), inst.pop32()
+			copy(inst.mem(dst, n), inst.mem(src, n))
+		case 0x100 + 11: // memory.fill
+			n, value, dst := inst.pop32(), inst.pop32(), inst.pop32()
+			region := inst.mem(dst, n)
+			for i := range region {
+				region[i] = byte(value)
+			}
+		default:
+			switch {
+			case in.op >= 0x28 && in.op <= 0x35:
+				inst.load(in.op, in.a)
+			case in.op >= 0x36 && in.op <= 0x3e:
+				inst.store(in.op, in.a)
+			default:
+				inst.numeric(in.op)
+			}
+		}
+	}
+
+	// Leave the results in place of the arguments
+	n := len(t.results)
+	if len(inst.stack)-n < base {
+		panic(trap("stack underflow"))
+	}
+	copy(inst.stack[base:], inst.stack[len(inst.stack)-n:])
+	inst.stack = inst.stack[:base+n]
+	return nil
+}
+
+// branch unwinds to the label at the given depth and returns the position
+// before the instruction to continue at
+func (inst *wasmInstance) branch(labels *[]wasmLabel, depth int, code []wasmInstr) int {
+	l := *labels
+	label := l[len(l)-1-depth]
+	values := inst.stack[len(inst.stack)-label.arity:]
+	copy(inst.stack[label.height:], values)
+	inst.stack = inst.stack[:label.height+label.arity]
+	if label.cont < len(code) && code[label.cont].op == 0x03 {
+		// Loops restart with their label in place
+		*labels = l[:len(l)-depth]
+		return label.cont
+	}
+	*labels = l[:len(l)-1-depth]
+	return label.cont
+}
+
+func (inst *wasmInstance) push(v uint64) { inst.stack = append(inst.stack, v) }
+
+func (inst *wasmInstance) pop() uint64 {
+	v := inst.stack[len(inst.stack)-1]
+	inst.stack = inst.stack[:len(inst.stack)-1]
+	return v
+}
+
+func (inst *wasmInstance) pop32() uint32 { return uint32(inst.pop()) }
+
+// grow grows memory by n pages, returning the previous size in pages or
+// -1 past the limit
+func (inst *wasmInstance) grow(n uint32) int32 {
+	pages := uint32(len(inst.memory) / wasmPageSize)
+	if !inst.module.hasMemory || uint64(pages)+uint64(n) > uint64(inst.module.memMax) {
+		return -1
+	}
+	inst.memory = append(inst.memory, make([]byte, int(n)*wasmPageSize)...)
+	return int32(pages)
+}
+
+// mem returns n bytes of memory at an address, trapping out of bounds
+func (inst *wasmInstance) mem(addr uint32, n uint32) []byte {
+	if uint64(addr)+uint64(n) > uint64(len(inst.memory)) {
+		panic(trap("out of bounds memory access"))
+	}
+	return inst.memory[addr : addr+n]
+}
+
+func (inst *wasmInstance) load(op uint16, offset uint64) {
+	addr := uint64(inst.pop32()) + offset
+	if addr > math.MaxUint32 {
+		panic(trap("out of bounds memory access"))
+	}
+	a := uint32(addr)
+	le := binary.LittleEndian
+	var v uint64
+	switch op {
+	case 0x28, 0x2a, 0x35:
+		v = uint64(le.Uint32(inst.mem(a, 4)))
+	case 0x29, 0x2b:
+		v = le.Uint64(inst.mem(a, 8))
+	case 0x2c:
+		v = uint64(uint32(int32(int8(inst.mem(a, 1)[0]))))
+	case 0x2d, 0x31:
+		v = uint64(inst.mem(a, 1)[0])
+	case 0x2e:
+		v = uint64(uint32(int32(int16(le.Uint16(inst.mem(a, 2))))))
+	case 0x2f, 0x33:
+		v = uint64(le.Uint16(inst.mem(a, 2)))
+	case 0x30:
+		v = uint64(int64(int8(inst.mem(a, 1)[0])))
+	case 0x32:
+		v = uint64(int64(int16(le.Uint16(inst.mem(a, 2)))))
+	case 0x34:
+		v = uint64(int64(int32(le.Uint32(inst.mem(a, 4)))))
+	}
+	inst.push(v)
+}
+
+func (inst *wasmInstance) store(op uint16, offset uint64) {
+	v := inst.pop()
+	addr := uint64(inst.pop32()) + offset
+	if addr > math.MaxUint32 {
+		panic(trap("out of bounds memory access"))
+	}
+	a := uint32(addr)
+	le := binary.LittleEndian
+	switch op {
+	case 0x36, 0x38, 0x3e:
+		le.PutUint32(inst.mem(a, 4), uint32(v))
+	case 0x37, 0x39:
+		le.PutUint64(inst.mem(a, 8), v)
+	case 0x3a, 0x3c:
+		inst.mem(a, 1)[0] = byte(v)
+	case 0x3b, 0x3d:
+		le.PutUint16(inst.mem(a, 2), uint16(v))
+	}
+}
+
+func f32(v uint64) float32  { return math.Float32frombits(uint32(v)) }
+func f64(v uint64) float64  { return math.Float64frombits(v) }
+func uf32(f float32) uint64 { return uint64(math.Float32bits(f)) }
+func uf64(f float64) uint64 { return math.Float64bits(f) }
+
+func b2u(b bool) uint64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// numeric runs a comparison, arithmetic or conversion instruction
+func (inst *wasmInstance) numeric(op uint16) {
+	// Unary instructions
+	switch op {
+	case 0x45:
+		inst.push(b2u(inst.pop32() == 0))
+		return
+	case 0x50:
+		inst.push(b2u(inst.pop() == 0))
+		return
+	case 0x67, 0x68, 0x69, 0x79, 0x7a, 0x7b,
+		0x8b, 0x8c, 0x8d, 0x8e, 0x8f, 0x90, 0x91, 0x99, 0x9a, 0x9b, 0x9c, 0x9d, 0x9e, 0x9f:
+		inst.push(unaryOp(op, inst.pop()))
+		return
+	}
+	if op >= 0xa7 && op <= 0xc4 || op >= 0x100 && op <= 0x107 {
+		inst.push(convertOp(op, inst.pop()))
+		return
+	}
+
+	b := inst.pop()
+	a := inst.pop()
+	var v uint64
+	switch {
+	case op >= 0x46 && op <= 0x4f:
+		v = compareI32(op, uint32(a), uint32(b))
+	case op >= 0x51 && op <= 0x5a:
+		v = compareI64(op-0x0b, a, b)
+	case op >= 0x5b && op <= 0x60:
+		x, y := float64(f32(a)), float64(f32(b))
+		v = compareFloat(op-0x5b, x, y)
+	case op >= 0x61 && op <= 0x66:
+		v = compareFloat(op-0x61, f64(a), f64(b))
+	case op >= 0x6a && op <= 0x78:
+		v = binaryI32(op, uint32(a), uint32(b))
+	case op >= 0x7c && op <= 0x8a:
+		v = binaryI64(op-0x12, a, b)
+	case op >= 0x92 && op <= 0x98:
+		v = uf32(float32(binaryFloat(op-0x92, float64(f32(a)), float64(f32(b)), true)))
+	case op >= 0xa0 && op <= 0xa6:
+		v = uf64(binaryFloat(op-0xa0, f64(a), f64(b), false))
+	default:
+		panic(trap("invalid instruction 0x%02x", op))
+	}
+	inst.push(v)
+}
+
+func compareI32(op uint16, a, b uint32) uint64 {
+	x, y := int32(a), int32(b)
+	switch op {
+	case 0x46:
+		return b2u(a == b)
+	case 0x47:
+		return b2u(a != b)
+	case 0x48:
+		return b2u(x < y)
+	case 0x49:
+		return b2u(a < b)
+	case 0x4a:
+		return b2u(x > y)
+	case 0x4b:
+		return b2u(a > b)
+	case 0x4c:
+		return b2u(x <= y)
+	case 0x4d:
+		return b2u(a <= b)
+	case 0x4e:
+		return b2u(x >= y)
+	}
+	return b2u(a >= b)
+}
+
+// compareI64 compares 64-bit integers, with opcodes shifted onto those of
+// compareI32
+func compareI64(op uint16, a, b uint64) uint64 {
+	x, y := int64(a), int64(b)
+	switch op {
+	case 0x46:
+		return b2u(a == b)
+	case 0x47:
+		return b2u(a != b)
+	case 0x48:
+		return b2u(x < y)
+	case 0x49:
+		return b2u(a < b)
+	case 0x4a:
+		return b2u(x > y)
+	case 0x4b:
+		return b2u(a > b)
+	case 0x4c:
+		return b2u(x <= y)
+	case 0x4d:
+		return b2u(a <= b)
+	case 0x4e:
+		return b2u(x >= y)
+	}
+	return b2u(a >= b)
+}
+
+// compareFloat compares floats: eq, ne, lt, gt, le, ge
+func compareFloat(op uint16, a, b float64) uint64 {
+	switch op {
+	case 0:
+		return b2u(a == b)
+	case 1:
+		return b2u(a != b)
+	case 2:
+		return b2u(a < b)
+	case 3:
+		return b2u(a > b)
+	case 4:
+		return b2u(a <= b)
+	}
+	return b2u(a >= b)
+}
+
+func binaryI32(op uint16, a, b uint32) uint64 {
+	x, y := int32(a), int32(b)
+	var v uint32
+	switch op {
+	case 0x6a:
+		v = a + b
+	case 0x6b:
+		v = a - b
+	case 0x6c:
+		v = a * b
+	case 0x6d:
+		if y == 0 {
+			panic(trap("integer divide by zero"))
+		}
+		if x == math.MinInt32 && y == -1 {
+			panic(trap("integer overflow"))
+		}
+		v = uint32(x / y)
+	case 0x6e:
+		if b == 0 {
+			panic(trap("integer divide by zero"))
+		}
+		v = a / b
+	case 0x6f:
+		if y == 0 {
+			panic(trap("integer divide by zero"))
+		}
+		if y == -1 {
+			v = 0
+		} else {
+			v = uint32(x % y)
+		}
+	case 0x70:
+		if b == 0 {
+			panic(trap("integer divide by zero"))
+		}
+		v = a % b
+	case 0x71:
+		v = a & b
+	case 0x72:
+		v = a | b
+	case 0x73:
+		v = a ^ b
+	case 0x74:
+		v = a << (b & 31)
+	case 0x75:
+		v = uint32(x >> (b & 31))
+	case 0x76:
+		v = a >> (b & 31)
+	case 0x77:
+		v = bits.RotateLeft32(a, int(b&31))
+	case 0x78:
+		v = bits.RotateLeft32(a, -int(b&31))
+	}
+	return uint64(v)
+}
+
+// binaryI64 runs 64-bit integer arithmetic, with opcodes shifted onto
+// those of binaryI32
+func binaryI64(op uint16, a, b uint64) uint64 {
+	x, y := int64(a), int64(b)
+	switch op {
+	case 0x6a:
+		return a + b
+	case 0x6b:
+		return a - b
+	case 0x6c:
+		return a * b
+	case 0x6d:
+		if y == 0 {
+			panic(trap("integer divide by zero"))
+		}
+		if x == math.MinInt64 && y == -1 {
+			panic(trap("integer overflow"))
+		}
+		return uint64(x / y)
+	case 0x6e:
+		if b == 0 {
+			panic(trap("integer divide by zero"))
+		}
+		return a / b
+	case 0x6f:
+		if y == 0 {
+			panic(trap("integer divide by zero"))
+		}
+		if y == -1 {
+			return 0
+		}
+		return uint64(x % y)
+	case 0x70:
+		if b == 0 {
+			panic(trap("integer divide by zero"))
+		}
+		return a % b
+	case 0x71:
+		return a & b
+	case 0x72:
+		return a | b
+	case 0x73:
+		return a ^ b
+	case 0x74:
+		return a << (b & 63)
+	case 0x75:
+		return uint64(x >> (b & 63))
+	case 0x76:
+		return a >> (b & 63)
+	case 0x77:
+		return bits.RotateLeft64(a, int(b&63))
+	}
+	return bits.RotateLeft64(a, -int(b&63))
+}
+
+// binaryFloat runs float arithmetic: add, sub, mul, div, min, max,
+// copysign. Single precision operations round their result to float32.
+func binaryFloat(op uint16, a, b float64, single bool) float64 {
+	round := func(v float64) float64 {
+		if single {
+			return float64(float32(v))
+		}
+		return v
+	}
+	switch op {
+	case 0:
+		return round(a + b)
+	case 1:
+		return round(a - b)
+	case 2:
+		return round(a * b)
+	case 3:
+		return round(a / b)
+	case 4, 5:
+		if math.IsNaN(a) || math.IsNaN(b) {
+			return math.NaN()
+		}
+		if a == b && a == 0 {
+			// min prefers -0, max +0
+			if (op == 4) == math.Signbit(a) {
+				return a
+			}
+			return b
+		}
+		if (op == 4) == (a < b) {
+			return a
+		}
+		return b
+	}
+	return math.Copysign(a, b)
+}
+
+func unaryOp(op uint16, v uint64) uint64 {
+	switch op {
+	case 0x67:
+		return uint64(bits.LeadingZeros32(uint32(v)))
+	case 0x68:
+		return uint64(bits.TrailingZeros32(uint32(v)))
+	case 0x69:
+		return uint64(bits.OnesCount32(uint32(v)))
+	case 0x79:
+		return uint64(bits.LeadingZeros64(v))
+	case 0x7a:
+		return uint64(bits.TrailingZeros64(v))
+	case 0x7b:
+		return uint64(bits.OnesCount64(v))
+	case 0x8b:
+		return v & 0x7fffffff
+	case 0x8c:
+		return v ^ 0x80000000
+	case 0x99:
+		return v &^ (1 << 63)
+	case 0x9a:
+		return v ^ (1 << 63)
+	}
+	single := op < 0x99
+	x := f64(v)
+	if single {
+		x = float64(f32(v))
+		op += 0x99 - 0x8b
+	}
+	switch op {
+	case 0x9b:
+		x = math.Ceil(x)
+	case 0x9c:
+		x = math.Floor(x)
+	case 0x9d:
+		x = math.Trunc(x)
+	case 0x9e:
+		x = math.RoundToEven(x)
+	case 0x9f:
+		x = math.Sqrt(x)
+	}
+	if single {
+		return uf32(float32(x))
+	}
+	return uf64(x)
+}
+
+// convertOp runs a conversion instruction, saturating ones included
+func convertOp(op uint16, v uint64) uint64 {
+	switch op {
+	case 0xa7:
+		return uint64(uint32(v))
+	case 0xa8, 0xa9, 0xaa, 0xab, 0xae, 0xaf, 0xb0, 0xb1:
+		x := f64(v)
+		if op == 0xa8 || op == 0xa9 || op == 0xae || op == 0xaf {
+			x = float64(f32(v))
+		}
+		return truncate(x, op, false)
+	case 0x100, 0x101, 0x102, 0x103, 0x104, 0x105, 0x106, 0x107:
+		// The saturating truncations mirror the trapping ones
+		base := [...]uint16{0xa8, 0xa9, 0xaa, 0xab, 0xae, 0xaf, 0xb0, 0xb1}[op-0x100]
+		x := f64(v)
+		if base == 0xa8 || base == 0xa9 || base == 0xae || base == 0xaf {
+			x = float64(f32(v))
+		}
+		return truncate(x, base, true)
+	case 0xac:
+		return uint64(int64(int32(uint32(v))))
+	case 0xad:
+		return uint64(uint32(v))
+	case 0xb2:
+		return uf32(float32(int32(uint32(v))))
+	case 0xb3:
+		return uf32(float32(uint32(v)))
+	case 0xb4:
+		return uf32(float32(int64(v)))
+	case 0xb5:
+		return uf32(float32(v))
+	case 0xb6:
+		return uf32(float32(f64(v)))
+	case 0xb7:
+		return uf64(float64(int32(uint32(v))))
+	case 0xb8:
+		return uf64(float64(uint32(v)))
+	case 0xb9:
+		return uf64(float64(int64(v)))
+	case 0xba:
+		return uf64(float64(v))
+	case 0xbb:
+		return uf64(float64(f32(v)))
+	case 0xbc, 0xbe:
+		return uint64(uint32(v))
+	case 0xbd, 0xbf:
+		return v
+	case 0xc0:
+		return uint64(uint32(int32(int8(v))))
+	case 0xc1:
+		return uint64(uint32(int32(int16(v))))
+	case 0xc2:
+		return uint64(int64(int8(v)))
+	case 0xc3:
+		return uint64(int64(int16(v)))
+	case 0xc4:
+		return uint64(int64(int32(v)))
+	}
+	panic(trap("invalid instruction 0x%02x", op))
+}
+
+// truncate converts a float to an integer for the trunc instructions,
+// trapping on NaN and out of range values unless saturating
+func truncate(x float64, op uint16, saturate bool) uint64 {
+	var lo, hi float64
+	signed := op == 0xa8 || op == 0xaa || op == 0xae || op == 0xb0
+	wide := op >= 0xae
+	switch {
+	case signed && !wide:
+		lo, hi = math.MinInt32, math.MaxInt32
+	case !signed && !wide:
+		lo, hi = 0, math.MaxUint32
+	case signed:
+		lo, hi = math.MinInt64, math.MaxInt64
+	default:
+		lo, hi = 0, math.MaxUint64
+	}
+	t := math.Trunc(x)
+	// The bounds of 64-bit ranges round up to a power of two as floats,
+	// which is itself out of range
+	outOfRange := math.IsNaN(x) || t < lo || t > hi || (wide && t >= hi)
+	if outOfRange && !saturate {
+		if math.IsNaN(x) {
+			panic(trap("invalid conversion to integer"))
+		}
+		panic(trap("integer overflow"))
+	}
+	if outOfRange {
+		switch {
+		case math.IsNaN(x):
+			return 0
+		case t < lo:
+			t = lo
+		default:
+			if !wide {
+				t = hi
+			} else if signed {
+				return uint64(math.MaxInt64)
+			} else {
+				return math.MaxUint64
+			}
+		}
+	}
+	switch {
+	case signed && !wide:
+		return uint64(uint32(int32(t)))
+	case !signed && !wide:
+		return uint64(uint32(t))
+	case signed:
+		return uint64(int64(t))
+	}
+	return uint64(t)
+}
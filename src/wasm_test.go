@@ -0,0 +1,290 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+// Modules are assembled by hand from the sections of the binary format
+
+func wasmULEB(n uint64) []byte {
+	var b []byte
+	for {
+		c := byte(n & 0x7f)
+		n >>= 7
+		if n == 0 {
+			return append(b, c)
+		}
+		b = append(b, c|0x80)
+	}
+}
+
+func wasmVec(items ...[]byte) []byte {
+	b := wasmULEB(uint64(len(items)))
+	for _, item := range items {
+		b = append(b, item...)
+	}
+	return b
+}
+
+func wasmSection(id byte, body []byte) []byte {
+	return append(append([]byte{id}, wasmULEB(uint64(len(body)))...), body...)
+}
+
+func wasmName(name string) []byte {
+	return append(wasmULEB(uint64(len(name))), name...)
+}
+
+func wasmBytes(sections ...[]byte) []byte {
+	b := []byte("\x00asm\x01\x00\x00\x00")
+	for _, section := range sections {
+		b = append(b, section...)
+	}
+	return b
+}
+
+// wasmFuncDef is a function of a test module: its type, its locals of
+// type i32 and its body, without the final end
+type wasmFuncDef struct {
+	params, results []byte
+	locals          int
+	body            []byte
+	export          string
+}
+
+// assembleWasm returns a module of functions, each with a type of its own,
+// and a memory of one page exported as memory
+func assembleWasm(funcs ...wasmFuncDef) []byte {
+	var types, indices, exports, bodies [][]byte
+	for i, f := range funcs {
+		types = append(types, append(append([]byte{0x60}, wasmVec(wasmSplit(f.params)...)...), wasmVec(wasmSplit(f.results)...)...))
+		indices = append(indices, wasmULEB(uint64(i)))
+		if f.export != "" {
+			exports = append(exports, append(append(wasmName(f.export), wasmExportFunc), wasmULEB(uint64(i))...))
+		}
+		var locals []byte
+		if f.locals > 0 {
+			locals = wasmVec(append(wasmULEB(uint64(f.locals)), wasmI32))
+		} else {
+			locals = wasmVec()
+		}
+		body := append(append(locals, f.body...), 0x0b)
+		bodies = append(bodies, append(wasmULEB(uint64(len(body))), body...))
+	}
+	exports = append(exports, append(append(wasmName("memory"), wasmExportMemory), 0))
+	return wasmBytes(
+		wasmSection(1, wasmVec(types...)),
+		wasmSection(3, wasmVec(indices...)),
+		wasmSection(5, wasmVec([]byte{0x00, 0x01})),
+		wasmSection(7, wasmVec(exports...)),
+		wasmSection(10, wasmVec(bodies...)),
+	)
+}
+
+func wasmSplit(b []byte) [][]byte {
+	items := make([][]byte, len(b))
+	for i := range b {
+		items[i] = b[i : i+1]
+	}
+	return items
+}
+
+// testModule decodes and instantiates a module of funcs
+func testModule(t *testing.T, funcs ...wasmFuncDef) *wasmInstance {
+	t.Helper()
+	module, err := decodeWasm(assembleWasm(funcs...))
+	if err != nil {
+		t.Fatalf("decodeWasm: %v", err)
+	}
+	inst, err := module.instantiate(1000)
+	if err != nil {
+		t.Fatalf("instantiate: %v", err)
+	}
+	return inst
+}
+
+func TestWasmCall(t *testing.T) {
+	i32, i64 := []byte{wasmI32}, []byte{wasmI64}
+	tests := []struct {
+		name string
+		f    wasmFuncDef
+		args []uint64
+		want uint64
+	}{
+		// local.get 0, local.get 1, i32.add
+		{"add", wasmFuncDef{params: []byte{wasmI32, wasmI32}, results: i32, body: []byte{0x20, 0, 0x20, 1, 0x6a}}, []uint64{2, 3}, 5},
+		// i32 arithmetic wraps
+		{"wrap", wasmFuncDef{params: []byte{wasmI32, wasmI32}, results: i32, body: []byte{0x20, 0, 0x20, 1, 0x6a}}, []uint64{0xffffffff, 2}, 1},
+		// if (param) 10 else 20
+		{"if then", wasmFuncDef{params: i32, results: i32, body: []byte{0x20, 0, 0x04, wasmI32, 0x41, 10, 0x05, 0x41, 20, 0x0b}}, []uint64{1}, 10},
+		{"if else", wasmFuncDef{params: i32, results: i32, body: []byte{0x20, 0, 0x04, wasmI32, 0x41, 10, 0x05, 0x41, 20, 0x0b}}, []uint64{0}, 20},
+		// sum of 1..n: loop adding n to local 1 while decrementing n
+		{"loop", wasmFuncDef{params: i32, results: i32, locals: 1, body: []byte{
+			0x03, 0x40, // loop
+			0x20, 1, 0x20, 0, 0x6a, 0x21, 1, // acc += n
+			0x20, 0, 0x41, 1, 0x6b, 0x22, 0, // n--
+			0x0d, 0, // br_if 0
+			0x0b,
+			0x20, 1,
+		}}, []uint64{10}, 55},
+		// i32.store then i64.load8_u at address 8
+		{"memory", wasmFuncDef{results: i64, body: []byte{0x41, 8, 0x41, 0xc1, 0x00, 0x36, 2, 0, 0x41, 8, 0x31, 0, 0}}, nil, 0x41},
+		// memory.size
+		{"memory size", wasmFuncDef{results: i32, body: []byte{0x3f, 0}}, nil, 1},
+	}
+	for _, test := range tests {
+		test.f.export = "f"
+		inst := testModule(t, test.f)
+		results, err := inst.call(0, test.args, 1000)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if len(results) != 1 || results[0] != test.want {
+			t.Errorf("%s = %v, want [%d]", test.name, results, test.want)
+		}
+	}
+}
+
+func TestWasmTraps(t *testing.T) {
+	i32 := []byte{wasmI32}
+	tests := []struct {
+		name string
+		f    wasmFuncDef
+		want string
+	}{
+		{"unreachable", wasmFuncDef{body: []byte{0x00}}, "unreachable"},
+		{"divide by zero", wasmFuncDef{results: i32, body: []byte{0x41, 1, 0x41, 0, 0x6d}}, "integer divide by zero"},
+		{"out of bounds load", wasmFuncDef{results: i32, body: []byte{0x41, 0x80, 0x80, 0x04, 0x28, 2, 0}}, "out of bounds memory access"},
+		{"out of bounds store", wasmFuncDef{body: []byte{0x41, 0x7f, 0x41, 0, 0x36, 2, 0}}, "out of bounds memory access"},
+		{"recursion", wasmFuncDef{body: []byte{0x10, 0}}, "call stack exhausted"},
+		{"indirect call without table", wasmFuncDef{body: []byte{0x41, 0, 0x11, 0, 0}}, "undefined table element"},
+		{"stack underflow", wasmFuncDef{results: i32, body: []byte{0x6a}}, "invalid module"},
+	}
+	for _, test := range tests {
+		inst := testModule(t, test.f)
+		_, err := inst.call(0, nil, 1_000_000)
+		var trap *wasmTrap
+		if !errors.As(err, &trap) || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("%s: error %v, want a trap containing %q", test.name, err, test.want)
+		}
+	}
+}
+
+func TestWasmFuel(t *testing.T) {
+	// loop br 0 end
+	inst := testModule(t, wasmFuncDef{body: []byte{0x03, 0x40, 0x0c, 0, 0x0b}})
+	if _, err := inst.call(0, nil, 10_000); !errors.Is(err, errWasmFuel) {
+		t.Fatalf("endless loop: error %v, want %v", err, errWasmFuel)
+	}
+	// The instance is usable again with fresh fuel
+	inst = testModule(t, wasmFuncDef{results: []byte{wasmI32}, body: []byte{0x41, 7}})
+	for i := 0; i < 2; i++ {
+		if results, err := inst.call(0, nil, 2); err != nil || results[0] != 7 {
+			t.Fatalf("call %d = %v, %v", i, results, err)
+		}
+	}
+	if _, err := inst.call(0, nil, 1); !errors.Is(err, errWasmFuel) {
+		t.Errorf("call with too little fuel: error %v, want %v", err, errWasmFuel)
+	}
+}
+
+func TestWasmGrow(t *testing.T) {
+	// memory.grow by the parameter
+	inst := testModule(t, wasmFuncDef{params: []byte{wasmI32}, results: []byte{wasmI32}, body: []byte{0x20, 0, 0x40, 0}})
+	if results, err := inst.call(0, []uint64{2}, 100); err != nil || results[0] != 1 {
+		t.Fatalf("grow by 2 = %v, %v, want the previous size 1", results, err)
+	}
+	if results, err := inst.call(0, []uint64{wasmMaxPages}, 100); err != nil || int32(results[0]) != -1 {
+		t.Fatalf("grow past the limit = %v, %v, want -1", results, err)
+	}
+	if len(inst.memory) != 3*wasmPageSize {
+		t.Errorf("memory is %d bytes, want 3 pages", len(inst.memory))
+	}
+}
+
+func TestDecodeWasmMalformed(t *testing.T) {
+	valid := assembleWasm(wasmFuncDef{export: "f", body: []byte{0x01}})
+	if _, err := decodeWasm(valid); err != nil {
+		t.Fatalf("decodeWasm(valid): %v", err)
+	}
+	tests := []struct {
+		name string
+		data []byte
+		want string
+	}{
+		{"empty", nil, "not a WebAssembly module"},
+		{"bad magic", []byte("\x00wasm\x01\x00\x00\x00"), "not a WebAssembly module"},
+		{"version 2", []byte("\x00asm\x02\x00\x00\x00"), "not a WebAssembly module"},
+		{"truncated section", valid[:len(valid)-3], "unexpected end of module"},
+		{"section past the end", wasmBytes([]byte{1, 0x7f, 0x00}), "unexpected end of module"},
+		{"overlong size", wasmBytes([]byte{1, 0x80, 0x80, 0x80, 0x80, 0x80, 0x01}), "integer too long"},
+		{"unknown section", wasmBytes(wasmSection(13, nil)), "unknown section 13"},
+		{"import", wasmBytes(wasmSection(2, wasmVec(append(append(wasmName("env"), wasmName("log")...), 0, 0)))), "imports env.log"},
+		{"huge vector", wasmBytes(wasmSection(3, wasmULEB(1<<32-1))), "unexpected end of module"},
+		{"functions without code", wasmBytes(wasmSection(1, wasmVec([]byte{0x60, 0, 0})), wasmSection(3, wasmVec([]byte{0}))), "function and code sections disagree"},
+		{"unknown type", wasmBytes(wasmSection(3, wasmVec([]byte{3})), wasmSection(10, wasmVec([]byte{2, 0, 0x0b}))), "unknown type 3"},
+		{"unterminated body", wasmBytes(wasmSection(1, wasmVec([]byte{0x60, 0, 0})), wasmSection(3, wasmVec([]byte{0})), wasmSection(10, wasmVec([]byte{2, 0, 0x01}))), "unterminated function body"},
+		{"unsupported instruction", wasmBytes(wasmSection(1, wasmVec([]byte{0x60, 0, 0})), wasmSection(3, wasmVec([]byte{0})), wasmSection(10, wasmVec([]byte{3, 0, 0xfd, 0x0b}))), "unsupported instruction 0xfd"},
+		{"too many locals", wasmBytes(wasmSection(1, wasmVec([]byte{0x60, 0, 0})), wasmSection(3, wasmVec([]byte{0})), wasmSection(10, wasmVec(append([]byte{6, 1}, append(wasmULEB(1<<20), wasmI32, 0x0b)...)))), "too many locals"},
+		{"memory over the limit", wasmBytes(wasmSection(5, wasmVec(append([]byte{0}, wasmULEB(wasmMaxPages+1)...)))), "exceeds the limit"},
+		{"unknown export", wasmBytes(wasmSection(7, wasmVec(append(append(wasmName("f"), wasmExportFunc), 5)))), "unknown function 5"},
+		{"unknown start", wasmBytes(wasmSection(8, []byte{0})), "unknown start function 0"},
+	}
+	for _, test := range tests {
+		_, err := decodeWasm(test.data)
+		if err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("%s: error %v, want one containing %q", test.name, err, test.want)
+		}
+	}
+}
+
+func TestWasmInstantiateBounds(t *testing.T) {
+	// A data segment writing past the memory of one page
+	data := wasmSection(11, wasmVec(append([]byte{0, 0x41, 0xff, 0xff, 0x03, 0x0b}, wasmVec([]byte{1}, []byte{2})...)))
+	module, err := decodeWasm(append(assembleWasm(), data...))
+	if err != nil {
+		t.Fatalf("decodeWasm: %v", err)
+	}
+	if _, err := module.instantiate(1000); err == nil || !strings.Contains(err.Error(), "out of memory bounds") {
+		t.Errorf("instantiate: error %v, want the data segment out of bounds", err)
+	}
+}
+
+// TestWasmCorrupt decodes every truncation and single-byte corruption of a
+// module and runs what still decodes: none may panic
+func TestWasmCorrupt(t *testing.T) {
+	valid := assembleWasm(
+		wasmFuncDef{export: "f", params: []byte{wasmI32}, results: []byte{wasmI32}, locals: 1, body: []byte{
+			0x03, 0x40, 0x20, 1, 0x20, 0, 0x6a, 0x21, 1, 0x20, 0, 0x41, 1, 0x6b, 0x22, 0, 0x0d, 0, 0x0b,
+			0x20, 1, 0x41, 4, 0x28, 2, 0, 0x6a, 0x10, 1,
+		}},
+		wasmFuncDef{params: []byte{wasmI32}, results: []byte{wasmI32}, body: []byte{0x20, 0, 0x04, wasmI32, 0x41, 1, 0x05, 0x41, 2, 0x0b, 0x6a}},
+	)
+	run := func(data []byte) {
+		module, err := decodeWasm(data)
+		if err != nil {
+			return
+		}
+		inst, err := module.instantiate(10_000)
+		if err != nil {
+			return
+		}
+		for _, export := range module.exports {
+			if export.kind == wasmExportFunc {
+				inst.call(export.index, []uint64{5}, 10_000)
+			}
+		}
+	}
+	for n := range valid {
+		run(valid[:n])
+	}
+	for i := 8; i < len(valid); i++ {
+		for _, b := range []byte{0x00, 0x01, 0x7f, 0x80, 0xff, valid[i] ^ 0x40} {
+			corrupt := append([]byte(nil), valid...)
+			corrupt[i] = b
+			run(corrupt)
+		}
+	}
+}
@@ -0,0 +1,746 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"mime/multipart"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+)
+
+// oleMagic starts every OLE2 compound file, the container of .xls workbooks
+const oleMagic = "\xd0\xcf\x11\xe0\xa1\xb1\x1a\xe1"
+
+// OLE2 sector chain markers
+const (
+	oleEndOfChain   = 0xFFFFFFFE
+	oleMaxRegSector = 0xFFFFFFFA
+)
+
+// BIFF8 record types
+const (
+	biffFormula     = 0x0006
+	biffEOF         = 0x000A
+	biffDateMode    = 0x0022
+	biffFilePass    = 0x002F
+	biffContinue    = 0x003C
+	biffBoundSheet  = 0x0085
+	biffMulRK       = 0x00BD
+	biffRString     = 0x00D6
+	biffXF          = 0x00E0
+	biffSST         = 0x00FC
+	biffLabelSST    = 0x00FD
+	biffNumber      = 0x0203
+	biffLabel       = 0x0204
+	biffBoolErr     = 0x0205
+	biffStringValue = 0x0207
+	biffRK          = 0x027E
+	biffFormat      = 0x041E
+	biffBOF         = 0x0809
+)
+
+// xlsMaxColumns is the number of columns of a BIFF8 worksheet
+const xlsMaxColumns = 256
+
+// xlsErrors are the texts of BIFF error codes
+var xlsErrors = map[byte]string{
+	0x00: "#NULL!", 0x07: "#DIV/0!", 0x0F: "#VALUE!", 0x17: "#REF!",
+	0x1D: "#NAME?", 0x24: "#NUM!", 0x2A: "#N/A",
+}
+
+// xlsWorkbook is an opened Excel 97-2003 workbook. The workbook stream is
+// held in memory, as legacy workbooks are limited to 65,536 rows; sheets
+// are converted to CSV as they are consumed.
+type xlsWorkbook struct {
+	stream        []byte
+	sheets        []xlsSheet
+	sharedStrings []string
+	styles        []cellFormat
+	date1904      bool
+}
+
+// xlsSheet is a worksheet listed in the workbook, with the offset of its
+// records in the workbook stream
+type xlsSheet struct {
+	Name   string
+	Offset int
+}
+
+// checkXLSContent rejects uploads that are not OLE2 compound files. The
+// file is rewound to the beginning afterwards.
+func checkXLSContent(file multipart.File) error {
+	magic := make([]byte, len(oleMagic))
+	n, err := io.ReadFull(file, magic)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return fmt.Errorf("failed to read upload: %v", err)
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("failed to rewind upload: %v", err)
+	}
+	if string(magic[:n]) != oleMagic {
+		return fileErrorf(http.StatusUnsupportedMediaType,
+			"file content is not an Excel 97-2003 workbook (detected %s)", http.DetectContentType(magic[:n]))
+	}
+	return nil
+}
+
+// openXLS reads the workbook globals of an .xls file: its sheets, shared
+// strings and cell styles. Only BIFF8 workbooks, written by Excel 97 and
+// later, are supported.
+func openXLS(file io.ReaderAt, size int64) (*xlsWorkbook, error) {
+	stream, err := readWorkbookStream(file, size)
+	if err != nil {
+		return nil, err
+	}
+	wb := &xlsWorkbook{stream: stream}
+	if err := wb.readGlobals(); err != nil {
+		return nil, err
+	}
+	if len(wb.sheets) == 0 {
+		return nil, fileErrorf(http.StatusUnprocessableEntity, "workbook has no sheets")
+	}
+	return wb, nil
+}
+
+// readWorkbookStream extracts the Workbook stream from an OLE2 compound file
+func readWorkbookStream(file io.ReaderAt, size int64) ([]byte, error) {
+	invalid := func(format string, args ...interface{}) error {
+		return fileErrorf(http.StatusUnprocessableEntity, "invalid XLS file: "+format, args...)
+	}
+
+	header := make([]byte, 512)
+	if _, err := file.ReadAt(header, 0); err != nil || string(header[:8]) != oleMagic {
+		return nil, invalid("missing compound file header")
+	}
+	le := binary.LittleEndian
+	sectorShift := le.Uint16(header[30:])
+	if sectorShift != 9 && sectorShift != 12 {
+		return nil, invalid("unsupported sector size")
+	}
+	if le.Uint16(header[32:]) != 6 {
+		return nil, invalid("unsupported mini sector size")
+	}
+	sectorSize := int64(1) << sectorShift
+	miniSectorSize := int64(64)
+	miniCutoff := int64(le.Uint32(header[56:]))
+	sectors := uint32((size + sectorSize - 1) / sectorSize)
+
+	readSector := func(sector uint32) ([]byte, error) {
+		if sector >= sectors {
+			return nil, errors.New("sector out of range")
+		}
+		buf := make([]byte, sectorSize)
+		n, err := file.ReadAt(buf, (int64(sector)+1)*sectorSize)
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		return buf[:n], nil
+	}
+
+	// The sectors of the allocation table are listed in the header, then
+	// in a chain of further sectors
+	var fatSectors []uint32
+	for i := 0; i < 109; i++ {
+		if sector := le.Uint32(header[76+4*i:]); sector <= oleMaxRegSector {
+			fatSectors = append(fatSectors, sector)
+		}
+	}
+	for sector, seen := le.Uint32(header[68:]), uint32(0); sector <= oleMaxRegSector; seen++ {
+		if seen >= sectors {
+			return nil, invalid("allocation table chain loops")
+		}
+		data, err := readSector(sector)
+		if err != nil || len(data) < int(sectorSize) {
+			return nil, invalid("unreadable allocation table")
+		}
+		for i := 0; i < int(sectorSize)/4-1; i++ {
+			if s := le.Uint32(data[4*i:]); s <= oleMaxRegSector {
+				fatSectors = append(fatSectors, s)
+			}
+		}
+		sector = le.Uint32(data[sectorSize-4:])
+	}
+	if len(fatSectors) > int(sectors) {
+		return nil, invalid("allocation table is larger than the file")
+	}
+	var fat []uint32
+	for _, sector := range fatSectors {
+		data, err := readSector(sector)
+		if err != nil {
+			return nil, invalid("unreadable allocation table")
+		}
+		for i := 0; i+4 <= len(data); i += 4 {
+			fat = append(fat, le.Uint32(data[i:]))
+		}
+	}
+	// Entries past the end of the file are unused, and chains that would
+	// visit more sectors than the file has must loop
+	fat = fat[:min(len(fat), int(sectors))]
+
+	// readChain reads the sectors of a chain, up to size bytes, or all of
+	// them if size is negative
+	readChain := func(table []uint32, start uint32, size int64, read func(uint32) ([]byte, error)) ([]byte, error) {
+		var out []byte
+		for sector, visited := start, 0; sector != oleEndOfChain; sector, visited = table[sector], visited+1 {
+			if int(sector) >= len(table) || visited >= len(table) {
+				return nil, errors.New("broken sector chain")
+			}
+			data, err := read(sector)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, data...)
+			if size >= 0 && int64(len(out)) >= size {
+				return out[:size], nil
+			}
+		}
+		if size > 0 {
+			return nil, errors.New("stream is truncated")
+		}
+		return out, nil
+	}
+
+	directory, err := readChain(fat, le.Uint32(header[48:]), -1, readSector)
+	if err != nil {
+		return nil, invalid("unreadable directory: %v", err)
+	}
+
+	// The root entry comes first and holds the stream of small streams
+	var root, workbook []byte
+	legacy := false
+	for offset := 0; offset+128 <= len(directory); offset += 128 {
+		entry := directory[offset : offset+128]
+		nameLen := int(le.Uint16(entry[64:]))
+		if nameLen < 2 || nameLen > 64 {
+			continue
+		}
+		units := make([]uint16, nameLen/2-1)
+		for i := range units {
+			units[i] = le.Uint16(entry[2*i:])
+		}
+		switch name := string(utf16.Decode(units)); {
+		case entry[66] == 5:
+			root = entry
+		case entry[66] == 2 && strings.EqualFold(name, "Workbook"):
+			workbook = entry
+		case entry[66] == 2 && strings.EqualFold(name, "Book"):
+			legacy = true
+		}
+	}
+	if workbook == nil && legacy {
+		return nil, fileErrorf(http.StatusUnprocessableEntity,
+			"workbook was saved by Excel 95 or earlier; save it as Excel 97-2003 or XLSX")
+	}
+	if workbook == nil {
+		return nil, invalid("no workbook stream found")
+	}
+
+	streamSize := int64(le.Uint32(workbook[120:]))
+	if streamSize > size {
+		return nil, invalid("workbook stream is larger than the file")
+	}
+	start := le.Uint32(workbook[116:])
+	var stream []byte
+	if streamSize < miniCutoff {
+		// Small streams are stored in mini sectors inside the root's stream
+		if root == nil {
+			return nil, invalid("no root entry found")
+		}
+		miniStream, err := readChain(fat, le.Uint32(root[116:]), min(int64(le.Uint32(root[120:])), size), readSector)
+		if err != nil {
+			return nil, invalid("unreadable mini stream: %v", err)
+		}
+		miniFATData, err := readChain(fat, le.Uint32(header[60:]), int64(le.Uint32(header[64:]))*sectorSize, readSector)
+		if err != nil {
+			return nil, invalid("unreadable mini allocation table: %v", err)
+		}
+		miniFAT := make([]uint32, min(len(miniFATData)/4, len(miniStream)/int(miniSectorSize)))
+		for i := range miniFAT {
+			miniFAT[i] = le.Uint32(miniFATData[4*i:])
+		}
+		stream, err = readChain(miniFAT, start, streamSize, func(sector uint32) ([]byte, error) {
+			offset := int64(sector) * miniSectorSize
+			if offset+miniSectorSize > int64(len(miniStream)) {
+				return nil, errors.New("mini sector out of range")
+			}
+			return miniStream[offset : offset+miniSectorSize], nil
+		})
+		if err != nil {
+			return nil, invalid("unreadable workbook stream: %v", err)
+		}
+	} else if stream, err = readChain(fat, start, streamSize, readSector); err != nil {
+		return nil, invalid("unreadable workbook stream: %v", err)
+	}
+	return stream, nil
+}
+
+// biffRecord is a record of the workbook stream
+type biffRecord struct {
+	kind uint16
+	data []byte
+}
+
+// record reads the record at offset and returns it with the offset of the
+// next one
+func (wb *xlsWorkbook) record(offset int) (biffRecord, int, error) {
+	if offset+4 > len(wb.stream) {
+		return biffRecord{}, 0, errors.New("unexpected end of workbook stream")
+	}
+	kind := binary.LittleEndian.Uint16(wb.stream[offset:])
+	length := int(binary.LittleEndian.Uint16(wb.stream[offset+2:]))
+	end := offset + 4 + length
+	if end > len(wb.stream) {
+		return biffRecord{}, 0, errors.New("truncated record")
+	}
+	return biffRecord{kind: kind, data: wb.stream[offset+4 : end]}, end, nil
+}
+
+// readGlobals reads the workbook globals substream, up to its EOF record
+func (wb *xlsWorkbook) readGlobals() error {
+	invalid := func(format string, args ...interface{}) error {
+		return fileErrorf(http.StatusUnprocessableEntity, "invalid XLS file: "+format, args...)
+	}
+
+	bof, offset, err := wb.record(0)
+	if err != nil || bof.kind != biffBOF || len(bof.data) < 4 {
+		return invalid("missing workbook header")
+	}
+	if binary.LittleEndian.Uint16(bof.data) != 0x0600 {
+		return fileErrorf(http.StatusUnprocessableEntity,
+			"workbook was saved by Excel 95 or earlier; save it as Excel 97-2003 or XLSX")
+	}
+
+	custom := make(map[int]cellFormat)
+	var formatIDs []int
+	for {
+		rec, next, err := wb.record(offset)
+		if err != nil {
+			return invalid("%v", err)
+		}
+		offset = next
+		data := rec.data
+		switch rec.kind {
+		case biffEOF:
+			wb.styles = make([]cellFormat, len(formatIDs))
+			for i, id := range formatIDs {
+				format, ok := custom[id]
+				if !ok {
+					format = builtinCellFormats[id]
+				}
+				wb.styles[i] = format
+			}
+			return nil
+		case biffFilePass:
+			return fileErrorf(http.StatusUnprocessableEntity, "workbook is password-protected")
+		case biffDateMode:
+			wb.date1904 = len(data) >= 2 && binary.LittleEndian.Uint16(data) == 1
+		case biffFormat:
+			if len(data) < 2 {
+				return invalid("truncated number format")
+			}
+			code, _, err := biffString(data[2:], 2)
+			if err != nil {
+				return invalid("number format: %v", err)
+			}
+			custom[int(binary.LittleEndian.Uint16(data))] = classifyNumberFormat(code)
+		case biffXF:
+			if len(data) < 4 {
+				return invalid("truncated cell style")
+			}
+			formatIDs = append(formatIDs, int(binary.LittleEndian.Uint16(data[2:])))
+		case biffBoundSheet:
+			// Chart and macro sheets are not listed
+			if len(data) < 8 {
+				return invalid("truncated sheet entry")
+			}
+			name, _, err := biffString(data[6:], 1)
+			if err != nil {
+				return invalid("sheet name: %v", err)
+			}
+			if data[5] == 0 {
+				wb.sheets = append(wb.sheets, xlsSheet{Name: name, Offset: int(binary.LittleEndian.Uint32(data))})
+			}
+		case biffSST:
+			// The table continues in the CONTINUE records that follow
+			segments := [][]byte{data}
+			for {
+				cont, after, err := wb.record(offset)
+				if err != nil || cont.kind != biffContinue {
+					break
+				}
+				segments = append(segments, cont.data)
+				offset = after
+			}
+			if wb.sharedStrings, err = readSST(segments); err != nil {
+				return invalid("shared strings: %v", err)
+			}
+		}
+	}
+}
+
+// biffString decodes a string with a lengthSize-byte character count and
+// an options byte, returning it and the number of bytes read
+func biffString(data []byte, lengthSize int) (string, int, error) {
+	if len(data) < lengthSize+1 {
+		return "", 0, errors.New("truncated string")
+	}
+	count := int(data[0])
+	if lengthSize == 2 {
+		count = int(binary.LittleEndian.Uint16(data))
+	}
+	options := data[lengthSize]
+	pos := lengthSize + 1
+	if options&0x08 != 0 {
+		pos += 2
+	}
+	if options&0x04 != 0 {
+		pos += 4
+	}
+	charSize := 1
+	if options&0x01 != 0 {
+		charSize = 2
+	}
+	if pos+count*charSize > len(data) {
+		return "", 0, errors.New("truncated string")
+	}
+	return decodeBIFFChars(data[pos:pos+count*charSize], charSize == 2), pos + count*charSize, nil
+}
+
+// decodeBIFFChars decodes UTF-16LE characters, or Latin-1 characters when
+// the high bytes were left out
+func decodeBIFFChars(data []byte, wide bool) string {
+	if !wide {
+		runes := make([]rune, len(data))
+		for i, b := range data {
+			runes[i] = rune(b)
+		}
+		return string(runes)
+	}
+	units := make([]uint16, len(data)/2)
+	for i := range units {
+		units[i] = binary.LittleEndian.Uint16(data[2*i:])
+	}
+	return string(utf16.Decode(units))
+}
+
+// sstReader reads the shared string table across the SST record and its
+// CONTINUE records
+type sstReader struct {
+	segments [][]byte
+	segment  int
+	pos      int
+}
+
+// next moves to the next segment once the current one is used up
+func (r *sstReader) next() error {
+	for r.pos >= len(r.segments[r.segment]) {
+		if r.segment+1 >= len(r.segments) {
+			return errors.New("truncated table")
+		}
+		r.segment, r.pos = r.segment+1, 0
+	}
+	return nil
+}
+
+func (r *sstReader) bytes(n int) ([]byte, error) {
+	out := make([]byte, 0, n)
+	for len(out) < n {
+		if err := r.next(); err != nil {
+			return nil, err
+		}
+		take := min(n-len(out), len(r.segments[r.segment])-r.pos)
+		out = append(out, r.segments[r.segment][r.pos:r.pos+take]...)
+		r.pos += take
+	}
+	return out, nil
+}
+
+// skip moves past n bytes
+func (r *sstReader) skip(n int) error {
+	for n > 0 {
+		if err := r.next(); err != nil {
+			return err
+		}
+		take := min(n, len(r.segments[r.segment])-r.pos)
+		r.pos += take
+		n -= take
+	}
+	return nil
+}
+
+// chars reads count characters. A string split across records starts
+// each continuation with a new options byte giving its character size.
+func (r *sstReader) chars(count int, wide bool) (string, error) {
+	var text strings.Builder
+	for count > 0 {
+		if r.pos >= len(r.segments[r.segment]) {
+			if err := r.next(); err != nil {
+				return "", err
+			}
+			options, err := r.bytes(1)
+			if err != nil {
+				return "", err
+			}
+			wide = options[0]&0x01 != 0
+		}
+		charSize := 1
+		if wide {
+			charSize = 2
+		}
+		n := min(count, (len(r.segments[r.segment])-r.pos)/charSize)
+		if n == 0 {
+			return "", errors.New("character split across records")
+		}
+		text.WriteString(decodeBIFFChars(r.segments[r.segment][r.pos:r.pos+n*charSize], wide))
+		r.pos += n * charSize
+		count -= n
+	}
+	return text.String(), nil
+}
+
+// readSST decodes the shared string table. Formatting runs and phonetic
+// data are skipped.
+func readSST(segments [][]byte) ([]string, error) {
+	r := &sstReader{segments: segments}
+	head, err := r.bytes(8)
+	if err != nil {
+		return nil, err
+	}
+	unique := int(binary.LittleEndian.Uint32(head[4:]))
+	strs := make([]string, 0, min(unique, 1<<16))
+	for i := 0; i < unique; i++ {
+		head, err := r.bytes(3)
+		if err != nil {
+			return nil, err
+		}
+		count, options := int(binary.LittleEndian.Uint16(head)), head[2]
+		var runs, extended int
+		if options&0x08 != 0 {
+			b, err := r.bytes(2)
+			if err != nil {
+				return nil, err
+			}
+			runs = int(binary.LittleEndian.Uint16(b))
+		}
+		if options&0x04 != 0 {
+			b, err := r.bytes(4)
+			if err != nil {
+				return nil, err
+			}
+			extended = int(binary.LittleEndian.Uint32(b))
+		}
+		text, err := r.chars(count, options&0x01 != 0)
+		if err != nil {
+			return nil, err
+		}
+		if err := r.skip(4*runs + extended); err != nil {
+			return nil, err
+		}
+		strs = append(strs, text)
+	}
+	return strs, nil
+}
+
+// sheet finds a sheet by name, ignoring case, or the first sheet if name is
+// empty
+func (wb *xlsWorkbook) sheet(name string) (xlsSheet, error) {
+	names := make([]string, len(wb.sheets))
+	for i, sheet := range wb.sheets {
+		names[i] = sheet.Name
+	}
+	i, err := findSheet(names, name)
+	if err != nil {
+		return xlsSheet{}, err
+	}
+	return wb.sheets[i], nil
+}
+
+// streamCSV converts a sheet to CSV in the background and returns a reader
+// of the CSV text, as for XLSX workbooks. Closing the reader stops the
+// conversion.
+func (wb *xlsWorkbook) streamCSV(sheet xlsSheet) io.ReadCloser {
+	pr, pw := io.Pipe()
+	go func() {
+		err := wb.writeSheetCSV(sheet.Offset, csv.NewWriter(pw))
+		if err != nil {
+			err = fileErrorf(http.StatusUnprocessableEntity, "invalid worksheet %q: %v", sheet.Name, err)
+		}
+		pw.CloseWithError(err)
+	}()
+	return pr
+}
+
+// writeSheetCSV streams the rows of the worksheet whose records start at
+// offset. Cells are stored row by row, so a row is written once a cell of
+// a later row comes up.
+func (wb *xlsWorkbook) writeSheetCSV(offset int, w *csv.Writer) error {
+	bof, offset, err := wb.record(offset)
+	if err != nil || bof.kind != biffBOF {
+		return errors.New("missing sheet header")
+	}
+
+	var (
+		row          []string
+		rowNumber    = -1
+		width        int
+		pendingRow   int
+		pendingCol   = -1
+		le           = binary.LittleEndian
+		errTruncated = errors.New("truncated cell")
+	)
+	set := func(r, c int, text string) error {
+		if c >= xlsMaxColumns {
+			return fmt.Errorf("row %d: column %d is out of range", r+1, c+1)
+		}
+		if r != rowNumber {
+			if r < rowNumber {
+				return fmt.Errorf("row %d is out of order", r+1)
+			}
+			if err := writeSheetRow(w, row, &width); err != nil {
+				return err
+			}
+			row, rowNumber = row[:0], r
+		}
+		for len(row) <= c {
+			row = append(row, "")
+		}
+		row[c] = text
+		return nil
+	}
+	number := func(value float64, style int) string {
+		format := formatGeneral
+		if style < len(wb.styles) {
+			format = wb.styles[style]
+		}
+		// Excel displays at most 15 significant digits
+		general, _ := strconv.ParseFloat(strconv.FormatFloat(value, 'g', 15, 64), 64)
+		return numberText(value, strconv.FormatFloat(general, 'f', -1, 64), format, wb.date1904)
+	}
+
+	for {
+		rec, next, err := wb.record(offset)
+		if err != nil {
+			return err
+		}
+		offset = next
+		data := rec.data
+		if rec.kind == biffEOF {
+			if err := writeSheetRow(w, row, &width); err != nil {
+				return err
+			}
+			w.Flush()
+			return w.Error()
+		}
+
+		// A formula's string result is only awaited until the next cell
+		var r, c, style int
+		switch rec.kind {
+		case biffLabelSST, biffLabel, biffRString, biffNumber, biffRK, biffMulRK, biffBoolErr, biffFormula:
+			if len(data) < 6 {
+				return errTruncated
+			}
+			r, c, style = int(le.Uint16(data)), int(le.Uint16(data[2:])), int(le.Uint16(data[4:]))
+			pendingCol = -1
+		}
+
+		switch rec.kind {
+		case biffLabelSST:
+			if len(data) < 10 {
+				return errTruncated
+			}
+			i := int(le.Uint32(data[6:]))
+			if i >= len(wb.sharedStrings) {
+				return fmt.Errorf("row %d, column %d: invalid shared string %d", r+1, c+1, i)
+			}
+			err = set(r, c, wb.sharedStrings[i])
+		case biffLabel, biffRString:
+			var text string
+			if text, _, err = biffString(data[6:], 2); err == nil {
+				err = set(r, c, text)
+			}
+		case biffNumber:
+			if len(data) < 14 {
+				return errTruncated
+			}
+			err = set(r, c, number(math.Float64frombits(le.Uint64(data[6:])), style))
+		case biffRK:
+			if len(data) < 10 {
+				return errTruncated
+			}
+			err = set(r, c, number(decodeRK(le.Uint32(data[6:])), style))
+		case biffMulRK:
+			// One record holds several consecutive number cells of a row
+			for i := 0; i < (len(data)-6)/6 && err == nil; i++ {
+				cell := data[4+6*i:]
+				err = set(r, c+i, number(decodeRK(le.Uint32(cell[2:])), int(le.Uint16(cell))))
+			}
+		case biffBoolErr:
+			if len(data) < 8 {
+				return errTruncated
+			}
+			err = set(r, c, boolErrText(data[6], data[7] != 0))
+		case biffFormula:
+			// The cached result of the formula is shown. A string result
+			// follows in a STRING record.
+			if len(data) < 14 {
+				return errTruncated
+			}
+			result := data[6:14]
+			switch {
+			case le.Uint16(result[6:]) != 0xFFFF:
+				err = set(r, c, number(math.Float64frombits(le.Uint64(result)), style))
+			case result[0] == 0:
+				pendingRow, pendingCol = r, c
+			case result[0] == 1:
+				err = set(r, c, boolErrText(result[2], false))
+			case result[0] == 2:
+				err = set(r, c, boolErrText(result[2], true))
+			}
+		case biffStringValue:
+			if pendingCol >= 0 {
+				var text string
+				if text, _, err = biffString(data, 2); err == nil {
+					err = set(pendingRow, pendingCol, text)
+				}
+				pendingCol = -1
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// decodeRK decodes a number stored in the compact RK form
+func decodeRK(rk uint32) float64 {
+	var value float64
+	if rk&0x02 != 0 {
+		value = float64(int32(rk) >> 2)
+	} else {
+		value = math.Float64frombits(uint64(rk&^0x03) << 32)
+	}
+	if rk&0x01 != 0 {
+		value /= 100
+	}
+	return value
+}
+
+// boolErrText returns the text of a boolean or error cell value
+func boolErrText(value byte, isError bool) string {
+	if isError {
+		if text, ok := xlsErrors[value]; ok {
+			return text
+		}
+		return "#ERROR!"
+	}
+	if value != 0 {
+		return "TRUE"
+	}
+	return "FALSE"
+}
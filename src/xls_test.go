@@ -0,0 +1,389 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"math"
+	"os"
+	"runtime"
+	"strings"
+	"testing"
+	"unicode/utf16"
+)
+
+// readXLS opens a workbook and converts a sheet to CSV
+func readXLS(data []byte, sheet string) (string, error) {
+	wb, err := openXLS(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return "", err
+	}
+	s, err := wb.sheet(sheet)
+	if err != nil {
+		return "", err
+	}
+	rows := wb.streamCSV(s)
+	defer rows.Close()
+	text, err := io.ReadAll(rows)
+	return string(text), err
+}
+
+// xlsTestRecord encodes a BIFF record
+func xlsTestRecord(kind uint16, data ...[]byte) []byte {
+	body := bytes.Join(data, nil)
+	out := binary.LittleEndian.AppendUint16(nil, kind)
+	out = binary.LittleEndian.AppendUint16(out, uint16(len(body)))
+	return append(out, body...)
+}
+
+// xlsTestU16 and xlsTestU32 encode little-endian integers
+func xlsTestU16(values ...uint16) []byte {
+	var out []byte
+	for _, v := range values {
+		out = binary.LittleEndian.AppendUint16(out, v)
+	}
+	return out
+}
+
+func xlsTestU32(v uint32) []byte {
+	return binary.LittleEndian.AppendUint32(nil, v)
+}
+
+// xlsTestString encodes a string of Latin-1 characters with a 2-byte count
+func xlsTestString(s string) []byte {
+	out := append(xlsTestU16(uint16(len(s))), 0)
+	return append(out, s...)
+}
+
+// xlsTestWide encodes characters as UTF-16LE
+func xlsTestWide(s string) []byte {
+	var out []byte
+	for _, unit := range utf16.Encode([]rune(s)) {
+		out = binary.LittleEndian.AppendUint16(out, unit)
+	}
+	return out
+}
+
+// xlsTestBOF starts a substream of the given type
+func xlsTestBOF(kind uint16) []byte {
+	return xlsTestRecord(biffBOF, xlsTestU16(0x0600, kind, 0, 0), make([]byte, 8))
+}
+
+// xlsTestCell starts the data of a cell record
+func xlsTestCell(row, column, style uint16) []byte {
+	return xlsTestU16(row, column, style)
+}
+
+// xlsTestWorkbook returns a Workbook stream: the globals, with a custom
+// date format, cell styles, shared strings split across a CONTINUE record
+// and a chart sheet, then a worksheet with a cell of every kind
+func xlsTestWorkbook() []byte {
+	xf := func(format uint16) []byte {
+		return xlsTestRecord(biffXF, xlsTestU16(0, format), make([]byte, 16))
+	}
+	sheetName := func(name string, kind byte) []byte {
+		return append([]byte{0, kind, byte(len(name)), 0}, name...)
+	}
+	// "Pájaro ☂" starts in the SST record as Latin-1 and continues in
+	// UTF-16; "Track Title" has a formatting run
+	sst := bytes.Join([][]byte{
+		xlsTestU32(5), xlsTestU32(4),
+		xlsTestString("Release ID"),
+		xlsTestU16(11), {0x08}, xlsTestU16(1), []byte("Track Title"), xlsTestU16(0, 0),
+		xlsTestString("Release Date"),
+		xlsTestU16(8), {0}, []byte("P\xe1"),
+	}, nil)
+	sheetBOF := 0
+	globals := func() []byte {
+		return bytes.Join([][]byte{
+			xlsTestBOF(0x0005),
+			xlsTestRecord(biffFormat, xlsTestU16(164), xlsTestString("yyyy\\-mm\\-dd")),
+			xf(0), xf(164), xf(9),
+			xlsTestRecord(biffSST, sst),
+			xlsTestRecord(biffContinue, []byte{0x01}, xlsTestWide("jaro ☂")),
+			xlsTestRecord(biffBoundSheet, xlsTestU32(0), sheetName("Chart", 2)),
+			xlsTestRecord(biffBoundSheet, xlsTestU32(uint32(sheetBOF)), sheetName("Releases", 0)),
+			xlsTestRecord(biffEOF),
+		}, nil)
+	}
+	sheetBOF = len(globals())
+
+	rk := func(v int32, hundredths bool) []byte {
+		rk := uint32(v)<<2 | 2
+		if hundredths {
+			rk |= 1
+		}
+		return xlsTestU32(rk)
+	}
+	number := func(v float64) []byte {
+		return binary.LittleEndian.AppendUint64(nil, math.Float64bits(v))
+	}
+	sheet := bytes.Join([][]byte{
+		xlsTestBOF(0x0010),
+		xlsTestRecord(biffLabelSST, xlsTestCell(0, 0, 0), xlsTestU32(0)),
+		xlsTestRecord(biffLabelSST, xlsTestCell(0, 1, 0), xlsTestU32(1)),
+		xlsTestRecord(biffLabelSST, xlsTestCell(0, 2, 0), xlsTestU32(2)),
+		xlsTestRecord(biffLabel, xlsTestCell(0, 3, 0), xlsTestString("Royalty %")),
+		xlsTestRecord(biffLabel, xlsTestCell(0, 4, 0), xlsTestString("Explicit")),
+		xlsTestRecord(biffLabel, xlsTestCell(1, 0, 0), xlsTestString("REL001")),
+		xlsTestRecord(biffLabelSST, xlsTestCell(1, 1, 0), xlsTestU32(3)),
+		xlsTestRecord(biffRK, xlsTestCell(1, 2, 1), rk(45000, false)),
+		xlsTestRecord(biffNumber, xlsTestCell(1, 3, 2), number(0.625)),
+		xlsTestRecord(biffBoolErr, xlsTestCell(1, 4, 0), []byte{0, 0}),
+		xlsTestRecord(biffMulRK, xlsTestCell(2, 0, 0), rk(42, false), xlsTestU16(0), rk(150, true), xlsTestU16(1)),
+		// A formula with a string result, then one with a number
+		xlsTestRecord(biffFormula, xlsTestCell(2, 2, 0), []byte{0, 0, 0, 0, 0, 0, 0xff, 0xff}, make([]byte, 6)),
+		xlsTestRecord(biffStringValue, xlsTestString("Total")),
+		xlsTestRecord(biffFormula, xlsTestCell(2, 3, 0), number(0.1), make([]byte, 6)),
+		xlsTestRecord(biffBoolErr, xlsTestCell(2, 4, 0), []byte{0x2A, 1}),
+		xlsTestRecord(biffLabel, xlsTestCell(4, 0, 0), xlsTestString("REL002")),
+		xlsTestRecord(biffEOF),
+	}, nil)
+	return append(globals(), sheet...)
+}
+
+// xlsTestWorkbookCSV is the worksheet of xlsTestWorkbook as CSV
+const xlsTestWorkbookCSV = `Release ID,Track Title,Release Date,Royalty %,Explicit
+REL001,Pájaro ☂,2023-03-15,62.5%,FALSE
+42,1.5,Total,0.1,#N/A
+REL002,,,,
+`
+
+// xlsTestCompound stores a stream as a compound file of 512-byte sectors:
+// the allocation table, the directory, then the stream, in mini sectors
+// below the 4096-byte cutoff
+func xlsTestCompound(name string, stream []byte) []byte {
+	const free, endOfChain, fatSector = 0xFFFFFFFF, oleEndOfChain, 0xFFFFFFFD
+	pad := func(b []byte, n int) []byte {
+		return append(b, make([]byte, (n-len(b)%n)%n)...)
+	}
+	mini := len(stream) < 4096
+
+	fat := []uint32{fatSector, endOfChain}
+	chain := func(sectors int) {
+		first := uint32(len(fat))
+		for i := 0; i < sectors; i++ {
+			fat = append(fat, first+uint32(i)+1)
+		}
+		fat[len(fat)-1] = endOfChain
+	}
+	var miniFAT, data []byte
+	start := uint32(2)
+	var rootStart, rootSize uint32 = endOfChain, 0
+	if mini {
+		for i := 0; i < (len(stream)+63)/64; i++ {
+			next := uint32(i + 1)
+			if i == (len(stream)+63)/64-1 {
+				next = endOfChain
+			}
+			miniFAT = binary.LittleEndian.AppendUint32(miniFAT, next)
+		}
+		miniFAT = pad(miniFAT, 512)
+		for i := len(miniFAT) - 1; i >= 0 && miniFAT[i] == 0; i-- {
+			miniFAT[i] = 0xff
+		}
+		chain(1)
+		rootStart, rootSize = uint32(len(fat)), uint32(len(pad(stream, 64)))
+		chain((len(stream) + 511) / 512)
+		data = append(miniFAT, pad(stream, 512)...)
+		start = 0
+	} else {
+		chain((len(stream) + 511) / 512)
+		data = pad(stream, 512)
+	}
+	for len(fat) < 128 {
+		fat = append(fat, free)
+	}
+
+	entry := func(name string, kind byte, start, size uint32) []byte {
+		e := make([]byte, 128)
+		units := xlsTestWide(name)
+		copy(e, units)
+		binary.LittleEndian.PutUint16(e[64:], uint16(len(units)+2))
+		e[66] = kind
+		for _, at := range []int{68, 72, 76} {
+			binary.LittleEndian.PutUint32(e[at:], free)
+		}
+		binary.LittleEndian.PutUint32(e[116:], start)
+		binary.LittleEndian.PutUint32(e[120:], size)
+		return e
+	}
+	root := entry("Root Entry", 5, rootStart, rootSize)
+	binary.LittleEndian.PutUint32(root[76:], 1)
+	directory := pad(append(root, entry(name, 2, start, uint32(len(stream)))...), 512)
+
+	header := make([]byte, 512)
+	copy(header, oleMagic)
+	binary.LittleEndian.PutUint16(header[24:], 0x3E)
+	binary.LittleEndian.PutUint16(header[26:], 3)
+	binary.LittleEndian.PutUint16(header[28:], 0xFFFE)
+	binary.LittleEndian.PutUint16(header[30:], 9)
+	binary.LittleEndian.PutUint16(header[32:], 6)
+	binary.LittleEndian.PutUint32(header[44:], 1)
+	binary.LittleEndian.PutUint32(header[48:], 1)
+	binary.LittleEndian.PutUint32(header[56:], 4096)
+	binary.LittleEndian.PutUint32(header[60:], endOfChain)
+	if mini {
+		binary.LittleEndian.PutUint32(header[60:], 2)
+		binary.LittleEndian.PutUint32(header[64:], 1)
+	}
+	binary.LittleEndian.PutUint32(header[68:], endOfChain)
+	for i := 0; i < 109; i++ {
+		binary.LittleEndian.PutUint32(header[76+4*i:], free)
+	}
+	binary.LittleEndian.PutUint32(header[76:], 0)
+
+	file := append(header, xlsTestU32s(fat)...)
+	file = append(file, directory...)
+	return append(file, data...)
+}
+
+func xlsTestU32s(values []uint32) []byte {
+	var out []byte
+	for _, v := range values {
+		out = binary.LittleEndian.AppendUint32(out, v)
+	}
+	return out
+}
+
+func TestXLSFixture(t *testing.T) {
+	data, err := os.ReadFile("testdata/releases.xls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, sheet := range []string{"", "releases"} {
+		text, err := readXLS(data, sheet)
+		if err != nil {
+			t.Fatalf("sheet %q: %v", sheet, err)
+		}
+		if text != xlsTestWorkbookCSV {
+			t.Errorf("sheet %q:\n%s\nwant:\n%s", sheet, text, xlsTestWorkbookCSV)
+		}
+	}
+	// Chart sheets are not listed
+	if _, err := readXLS(data, "Chart"); err == nil {
+		t.Error("chart sheet was read")
+	}
+}
+
+func TestXLSStreams(t *testing.T) {
+	workbook := xlsTestWorkbook()
+	// Trailing bytes take the stream past the mini stream cutoff
+	large := append(append([]byte(nil), workbook...), make([]byte, 4096)...)
+	excel95 := bytes.Clone(workbook)
+	binary.LittleEndian.PutUint16(excel95[4:], 0x0500)
+	filePass := bytes.Replace(workbook, xlsTestBOF(0x0005), append(xlsTestBOF(0x0005), xlsTestRecord(biffFilePass, make([]byte, 6))...), 1)
+	truncated := workbook[:len(workbook)-10]
+
+	tests := []struct {
+		name string
+		file []byte
+		err  string
+	}{
+		{name: "mini stream", file: xlsTestCompound("Workbook", workbook)},
+		{name: "regular sectors", file: xlsTestCompound("Workbook", large)},
+		{name: "Excel 5 stream", file: xlsTestCompound("Book", workbook), err: "Excel 95 or earlier"},
+		{name: "Excel 5 workbook", file: xlsTestCompound("Workbook", excel95), err: "Excel 95 or earlier"},
+		{name: "password", file: xlsTestCompound("Workbook", filePass), err: "password-protected"},
+		{name: "no workbook", file: xlsTestCompound("WordDocument", workbook), err: "no workbook stream found"},
+		{name: "truncated worksheet", file: xlsTestCompound("Workbook", truncated), err: "truncated record"},
+		{name: "not a compound file", file: make([]byte, 1024), err: "missing compound file header"},
+	}
+	for _, test := range tests {
+		text, err := readXLS(test.file, "")
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%s: error %v, want one containing %q", test.name, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if text != xlsTestWorkbookCSV {
+			t.Errorf("%s:\n%s\nwant:\n%s", test.name, text, xlsTestWorkbookCSV)
+		}
+	}
+}
+
+// TestXLSMalformed reads compound files whose header or tables are
+// inconsistent; they must fail without reading beyond the file's size
+func TestXLSMalformed(t *testing.T) {
+	base := xlsTestCompound("Workbook", xlsTestWorkbook())
+	tests := []struct {
+		name   string
+		modify func(file []byte)
+		err    string
+	}{
+		{"mini sector shift", func(f []byte) { f[32] = 63 }, "unsupported mini sector size"},
+		{"sector shift", func(f []byte) { f[30] = 20 }, "unsupported sector size"},
+		{"allocation table repeated", func(f []byte) {
+			for i := 0; i < 109; i++ {
+				binary.LittleEndian.PutUint32(f[76+4*i:], 0)
+			}
+		}, "allocation table is larger than the file"},
+		{"directory loops", func(f []byte) { binary.LittleEndian.PutUint32(f[512+4:], 1) }, "broken sector chain"},
+		// A looping chain is read no further than the stream's size
+		{"mini stream loops", func(f []byte) { binary.LittleEndian.PutUint32(f[3*512:], 0) }, "invalid XLS file"},
+		{"stream larger than the file", func(f []byte) { binary.LittleEndian.PutUint32(f[2*512+128+120:], 1<<30) }, "larger than the file"},
+		{"allocation table out of range", func(f []byte) { binary.LittleEndian.PutUint32(f[76:], 1000) }, "unreadable allocation table"},
+		{"shared string out of range", func(f []byte) {
+			i := bytes.Index(f, xlsTestRecord(biffLabelSST, xlsTestCell(1, 1, 0), xlsTestU32(3)))
+			binary.LittleEndian.PutUint32(f[i+10:], 4)
+		}, "invalid shared string 4"},
+		{"column out of range", func(f []byte) {
+			i := bytes.Index(f, xlsTestRecord(biffLabel, xlsTestCell(4, 0, 0), xlsTestString("REL002")))
+			binary.LittleEndian.PutUint16(f[i+6:], 256)
+		}, "column 257 is out of range"},
+		{"rows out of order", func(f []byte) {
+			i := bytes.Index(f, xlsTestRecord(biffLabel, xlsTestCell(4, 0, 0), xlsTestString("REL002")))
+			binary.LittleEndian.PutUint16(f[i+4:], 1)
+		}, "row 2 is out of order"},
+	}
+	var before, after runtime.MemStats
+	for _, test := range tests {
+		file := append([]byte(nil), base...)
+		test.modify(file)
+		runtime.ReadMemStats(&before)
+		_, err := readXLS(file, "")
+		runtime.ReadMemStats(&after)
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%s: error %v, want one containing %q", test.name, err, test.err)
+		}
+		if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 1<<20 {
+			t.Errorf("%s: allocated %d bytes", test.name, allocated)
+		}
+	}
+}
+
+// TestXLSCorrupt reads every truncation of the fixture and every
+// corruption of each of its bytes: they may fail but not panic, nor
+// allocate far beyond the size of the file
+func TestXLSCorrupt(t *testing.T) {
+	data, err := os.ReadFile("testdata/releases.xls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The last sectors end in padding, so some truncations still read
+	for n := range data {
+		if text, err := readXLS(data[:n], ""); err == nil && text != xlsTestWorkbookCSV {
+			t.Errorf("file truncated to %d bytes read as:\n%s", n, text)
+		}
+	}
+
+	var before, after runtime.MemStats
+	corrupt := make([]byte, len(data))
+	for i := range data {
+		for _, flip := range []byte{0x01, 0x80, 0xff} {
+			copy(corrupt, data)
+			corrupt[i] ^= flip
+			runtime.ReadMemStats(&before)
+			readXLS(corrupt, "")
+			runtime.ReadMemStats(&after)
+			if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 16<<20 {
+				t.Errorf("byte %d ^ %#x: allocated %d bytes", i, flip, allocated)
+			}
+		}
+	}
+}
@@ -0,0 +1,486 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/csv"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cellFormat is how a numeric cell is displayed, as far as conversion to
+// text is concerned
+type cellFormat int
+
+const (
+	formatGeneral cellFormat = iota
+	formatDate
+	formatTime
+	formatPercent
+)
+
+// builtinCellFormats are the built-in number formats that are not general
+var builtinCellFormats = map[int]cellFormat{
+	9: formatPercent, 10: formatPercent,
+	14: formatDate, 15: formatDate, 16: formatDate, 17: formatDate, 22: formatDate,
+	18: formatTime, 19: formatTime, 20: formatTime, 21: formatTime,
+	45: formatTime, 46: formatTime, 47: formatTime,
+}
+
+// xlsxWorkbook is an opened workbook whose sheets can be streamed. Shared
+// strings and cell styles are loaded up front; sheet rows are read as they
+// are consumed, so memory stays flat however many rows a sheet has.
+type xlsxWorkbook struct {
+	files         map[string]*zip.File
+	sheets        []xlsxSheet
+	sharedStrings []string
+	styles        []cellFormat
+	date1904      bool
+}
+
+// xlsxSheet is a worksheet listed in the workbook
+type xlsxSheet struct {
+	Name string
+	Path string
+}
+
+// openXLSX reads the workbook structure of an XLSX file
+func openXLSX(file io.ReaderAt, size int64) (*xlsxWorkbook, error) {
+	archive, err := zip.NewReader(file, size)
+	if err != nil {
+		return nil, fileErrorf(http.StatusUnprocessableEntity, "invalid XLSX file: %v", err)
+	}
+	wb := &xlsxWorkbook{files: make(map[string]*zip.File, len(archive.File))}
+	for _, f := range archive.File {
+		wb.files[f.Name] = f
+	}
+	if wb.files["xl/workbook.xml"] == nil {
+		return nil, fileErrorf(http.StatusUnprocessableEntity, "invalid XLSX file: no workbook found")
+	}
+
+	steps := []struct {
+		name string
+		read func(*xml.Decoder) error
+	}{
+		{"xl/workbook.xml", wb.readWorkbook},
+		{"xl/_rels/workbook.xml.rels", wb.readRelationships},
+		{"xl/sharedStrings.xml", wb.readSharedStrings},
+		{"xl/styles.xml", wb.readStyles},
+	}
+	for _, step := range steps {
+		if err := wb.decode(step.name, step.read); err != nil {
+			return nil, fileErrorf(http.StatusUnprocessableEntity, "invalid XLSX file: %s: %v", step.name, err)
+		}
+	}
+	if len(wb.sheets) == 0 {
+		return nil, fileErrorf(http.StatusUnprocessableEntity, "workbook has no sheets")
+	}
+	return wb, nil
+}
+
+// decode runs read over a part of the package. Missing optional parts are
+// skipped.
+func (wb *xlsxWorkbook) decode(name string, read func(*xml.Decoder) error) error {
+	f := wb.files[name]
+	if f == nil {
+		return nil
+	}
+	rc, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	return read(xml.NewDecoder(rc))
+}
+
+// readWorkbook lists the sheets in workbook order. Their paths hold the
+// relationship IDs until readRelationships resolves them.
+func (wb *xlsxWorkbook) readWorkbook(decoder *xml.Decoder) error {
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		start, ok := token.(xml.StartElement)
+		if !ok {
+			continue
+		}
+		switch start.Name.Local {
+		case "workbookPr":
+			value := attr(start, "date1904")
+			wb.date1904 = value == "1" || value == "true"
+		case "sheet":
+			sheet := xlsxSheet{Name: attr(start, "name")}
+			for _, a := range start.Attr {
+				if a.Name.Local == "id" && a.Name.Space != "" {
+					sheet.Path = a.Value
+				}
+			}
+			wb.sheets = append(wb.sheets, sheet)
+		}
+	}
+}
+
+// readRelationships resolves the sheets' relationship IDs to part names
+func (wb *xlsxWorkbook) readRelationships(decoder *xml.Decoder) error {
+	targets := make(map[string]string)
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if start, ok := token.(xml.StartElement); ok && start.Name.Local == "Relationship" {
+			target := attr(start, "Target")
+			if strings.HasPrefix(target, "/") {
+				target = strings.TrimPrefix(target, "/")
+			} else {
+				target = path.Join("xl", target)
+			}
+			targets[attr(start, "Id")] = target
+		}
+	}
+	for i := range wb.sheets {
+		wb.sheets[i].Path = targets[wb.sheets[i].Path]
+	}
+	return nil
+}
+
+// readSharedStrings loads the shared string table. Phonetic runs are
+// skipped.
+func (wb *xlsxWorkbook) readSharedStrings(decoder *xml.Decoder) error {
+	var text strings.Builder
+	inText, phonetic := false, false
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		switch t := token.(type) {
+		case xml.StartElement:
+			switch t.Name.Local {
+			case "si":
+				text.Reset()
+			case "t":
+				inText = true
+			case "rPh":
+				phonetic = true
+			}
+		case xml.EndElement:
+			switch t.Name.Local {
+			case "si":
+				wb.sharedStrings = append(wb.sharedStrings, text.String())
+			case "t":
+				inText = false
+			case "rPh":
+				phonetic = false
+			}
+		case xml.CharData:
+			if inText && !phonetic {
+				text.Write(t)
+			}
+		}
+	}
+}
+
+// readStyles works out the display format of every cell style
+func (wb *xlsxWorkbook) readStyles(decoder *xml.Decoder) error {
+	custom := make(map[int]cellFormat)
+	inCellXfs := false
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		switch t := token.(type) {
+		case xml.StartElement:
+			switch {
+			case t.Name.Local == "numFmt":
+				id, _ := strconv.Atoi(attr(t, "numFmtId"))
+				custom[id] = classifyNumberFormat(attr(t, "formatCode"))
+			case t.Name.Local == "cellXfs":
+				inCellXfs = true
+			case t.Name.Local == "xf" && inCellXfs:
+				id, _ := strconv.Atoi(attr(t, "numFmtId"))
+				format, ok := custom[id]
+				if !ok {
+					format = builtinCellFormats[id]
+				}
+				wb.styles = append(wb.styles, format)
+			}
+		case xml.EndElement:
+			if t.Name.Local == "cellXfs" {
+				inCellXfs = false
+			}
+		}
+	}
+}
+
+// classifyNumberFormat recognises date, time and percentage format codes.
+// Quoted text, escaped characters and bracketed sections such as colours
+// are ignored.
+func classifyNumberFormat(code string) cellFormat {
+	var plain strings.Builder
+	for i := 0; i < len(code); i++ {
+		switch c := code[i]; c {
+		case '"':
+			if end := strings.IndexByte(code[i+1:], '"'); end >= 0 {
+				i += end + 1
+			}
+		case '[':
+			if end := strings.IndexByte(code[i+1:], ']'); end >= 0 {
+				i += end + 1
+			}
+		case '\\', '_', '*':
+			i++
+		default:
+			plain.WriteByte(c)
+		}
+	}
+	format := strings.ToLower(plain.String())
+	switch {
+	case strings.ContainsAny(format, "yd"):
+		return formatDate
+	case strings.ContainsAny(format, "hs"):
+		return formatTime
+	case strings.Contains(format, "%"):
+		return formatPercent
+	}
+	return formatGeneral
+}
+
+// sheet finds a sheet by name, ignoring case, or the first sheet if name is
+// empty
+func (wb *xlsxWorkbook) sheet(name string) (xlsxSheet, error) {
+	names := make([]string, len(wb.sheets))
+	for i, sheet := range wb.sheets {
+		names[i] = sheet.Name
+	}
+	i, err := findSheet(names, name)
+	if err != nil {
+		return xlsxSheet{}, err
+	}
+	return wb.sheets[i], nil
+}
+
+// findSheet returns the index of the sheet with the given name, ignoring
+// case, or of the first sheet if name is empty
+func findSheet(names []string, name string) (int, error) {
+	if name == "" {
+		return 0, nil
+	}
+	for i, sheetName := range names {
+		if strings.EqualFold(sheetName, name) {
+			return i, nil
+		}
+	}
+	return 0, fileErrorf(http.StatusUnprocessableEntity, "workbook has no sheet named %q (sheets: %s)",
+		name, strings.Join(names, ", "))
+}
+
+// streamCSV converts a sheet to CSV in the background and returns a reader
+// of the CSV text, so the sheet goes through the same pipeline as CSV
+// uploads. Closing the reader stops the conversion.
+func (wb *xlsxWorkbook) streamCSV(sheet xlsxSheet) (io.ReadCloser, error) {
+	f := wb.files[sheet.Path]
+	if f == nil {
+		return nil, fileErrorf(http.StatusUnprocessableEntity, "invalid XLSX file: sheet %q is missing", sheet.Name)
+	}
+	rc, err := f.Open()
+	if err != nil {
+		return nil, fileErrorf(http.StatusUnprocessableEntity, "invalid XLSX file: %v", err)
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		defer rc.Close()
+		err := wb.writeSheetCSV(xml.NewDecoder(rc), csv.NewWriter(pw))
+		if err != nil {
+			err = fileErrorf(http.StatusUnprocessableEntity, "invalid worksheet %q: %v", sheet.Name, err)
+		}
+		pw.CloseWithError(err)
+	}()
+	return pr, nil
+}
+
+// writeSheetCSV streams the rows of a worksheet to w. Cells are placed by
+// their reference, trailing empty cells are trimmed and rows are padded to
+// the widest row so far, and rows without any values are skipped.
+func (wb *xlsxWorkbook) writeSheetCSV(decoder *xml.Decoder, w *csv.Writer) error {
+	var (
+		row             []string
+		rowNumber       int
+		width, column   int
+		cellType, style string
+		value           strings.Builder
+		inValue         bool
+	)
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			w.Flush()
+			return w.Error()
+		}
+		if err != nil {
+			return err
+		}
+
+		switch t := token.(type) {
+		case xml.StartElement:
+			switch t.Name.Local {
+			case "row":
+				row, column = row[:0], 0
+				rowNumber++
+				if n, err := strconv.Atoi(attr(t, "r")); err == nil {
+					rowNumber = n
+				}
+			case "c":
+				if ref := attr(t, "r"); ref != "" {
+					column = columnIndex(ref)
+				}
+				cellType, style = attr(t, "t"), attr(t, "s")
+				value.Reset()
+			case "v", "t":
+				inValue = true
+			}
+		case xml.CharData:
+			if inValue {
+				value.Write(t)
+			}
+		case xml.EndElement:
+			switch t.Name.Local {
+			case "v", "t":
+				inValue = false
+			case "c":
+				text, err := wb.cellText(cellType, style, value.String())
+				if err != nil {
+					return fmt.Errorf("row %d, column %d: %v", rowNumber, column+1, err)
+				}
+				for len(row) <= column {
+					row = append(row, "")
+				}
+				row[column] = text
+				column++
+			case "row":
+				if err := writeSheetRow(w, row, &width); err != nil {
+					return err
+				}
+			}
+		}
+	}
+}
+
+// writeSheetRow writes a row of cells with trailing empty cells trimmed,
+// padded to width, the widest row so far. Rows without any values are
+// skipped.
+func writeSheetRow(w *csv.Writer, row []string, width *int) error {
+	for len(row) > 0 && row[len(row)-1] == "" {
+		row = row[:len(row)-1]
+	}
+	if len(row) == 0 {
+		return nil
+	}
+	*width = max(*width, len(row))
+	for len(row) < *width {
+		row = append(row, "")
+	}
+	return w.Write(row)
+}
+
+// cellText converts a cell's stored value to the text it displays
+func (wb *xlsxWorkbook) cellText(cellType, style, value string) (string, error) {
+	switch cellType {
+	case "s":
+		i, err := strconv.Atoi(value)
+		if err != nil || i < 0 || i >= len(wb.sharedStrings) {
+			return "", fmt.Errorf("invalid shared string %q", value)
+		}
+		return wb.sharedStrings[i], nil
+	case "b":
+		if value == "1" {
+			return "TRUE", nil
+		}
+		return "FALSE", nil
+	case "str", "inlineStr", "e", "d":
+		return value, nil
+	}
+
+	if value == "" {
+		return "", nil
+	}
+	number, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return value, nil
+	}
+	format := formatGeneral
+	if i, err := strconv.Atoi(style); err == nil && i >= 0 && i < len(wb.styles) {
+		format = wb.styles[i]
+	}
+	return numberText(number, value, format, wb.date1904), nil
+}
+
+// numberText converts a number stored as value to the text it displays in
+// the given format. Dates count days from the workbook's epoch.
+func numberText(number float64, value string, format cellFormat, date1904 bool) string {
+	switch format {
+	case formatDate, formatTime:
+		epoch := time.Date(1899, 12, 30, 0, 0, 0, 0, time.UTC)
+		if date1904 {
+			epoch = time.Date(1904, 1, 1, 0, 0, 0, 0, time.UTC)
+		}
+		t := epoch.Add(time.Duration(math.Round(number*86400)) * time.Second)
+		switch {
+		case format == formatTime:
+			return t.Format("15:04:05")
+		case number == math.Trunc(number):
+			return t.Format("2006-01-02")
+		}
+		return t.Format("2006-01-02 15:04:05")
+	case formatPercent:
+		return strconv.FormatFloat(math.Round(number*100*1e9)/1e9, 'f', -1, 64) + "%"
+	}
+	if strings.ContainsAny(value, "eE") {
+		return strconv.FormatFloat(number, 'f', -1, 64)
+	}
+	return value
+}
+
+// columnIndex returns the zero-based column of a cell reference such as
+// "AB12"
+func columnIndex(ref string) int {
+	index := 0
+	for _, c := range strings.ToUpper(ref) {
+		if c < 'A' || c > 'Z' {
+			break
+		}
+		index = index*26 + int(c-'A') + 1
+	}
+	return index - 1
+}
+
+// attr returns the value of an element's attribute, ignoring namespaces
+func attr(start xml.StartElement, name string) string {
+	for _, a := range start.Attr {
+		if a.Name.Local == name {
+			return a.Value
+		}
+	}
+	return ""
+}
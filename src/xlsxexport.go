@@ -0,0 +1,297 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// xlsxContentType is the media type of XLSX workbooks
+const xlsxContentType = "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet"
+
+// checkColumns are the columns whose cells are highlighted when a row fails
+// a check. Payee identifier columns and release fields are added per result.
+var checkColumns = map[string][]string{
+	"royalties_sum":   royaltyColumns,
+	"royalty_range":   royaltyColumns,
+	"date_format":     {"Release Date"},
+	"release_date":    {releaseDateColumn},
+	"territories":     {"Territories"},
+	"numerics":        {"UPC"},
+	"upc":             {"UPC"},
+	"required_fields": cfg.RequiredColumns,
+	"release_type":    {releaseTypeColumn},
+	"isrc":            {isrcColumn},
+	"genre":           {genreColumn},
+	"label":           {labelColumn},
+	"rights_holder":   {rightsHolderColumn},
+	"duplicate_track": {"Track ID"},
+	"duplicate_isrc":  {isrcColumn},
+}
+
+// validationColumns are the columns of the Validation sheet. Failed checks
+// and release conflicts are listed separated by ", ", which the conditional
+// formatting of the Data sheet searches.
+var validationColumns = []string{"Track ID", "Release ID", "Status", "Failed Checks", "Release Conflicts", "Issues"}
+
+// Columns of the Validation sheet the conditional formatting refers to
+const (
+	validationFailedColumn    = "D"
+	validationConflictsColumn = "E"
+)
+
+// writeResultXLSX writes a result as an XLSX workbook with a Data sheet of
+// the converted rows and a Validation sheet with the outcome of each row,
+// on the same line. Cells of the Data sheet that failed a check are
+// highlighted by conditional formatting on the Validation sheet, so the
+// highlighting follows edits to it. Values are written as text, keeping
+// identifiers such as UPCs intact.
+func writeResultXLSX(result *OutputFormat) ([]byte, error) {
+	columns := exportColumns(result.Conversion)
+	rows := result.Conversion.Rows
+
+	validation := make([][]string, len(rows))
+	for i, row := range rows {
+		v, ok := result.Validation[row["Track ID"]]
+		if !ok {
+			validation[i] = []string{row["Track ID"], row["Release ID"]}
+			continue
+		}
+		status := "passed"
+		failed := v.FailedChecks()
+		if v.Failed() {
+			status = "failed"
+		}
+		sort.Strings(failed)
+		var issues []string
+		if len(v.MissingFields) > 0 {
+			issues = append(issues, "missing "+strings.Join(v.MissingFields, ", "))
+		}
+		issues = append(issues, v.DateIssues...)
+		issues = append(issues, v.TerritoryIssues...)
+		issues = append(issues, v.PayeeIssues...)
+		issues = append(issues, v.NumericIssues...)
+		issues = append(issues, v.ReleaseTypeIssues...)
+		issues = append(issues, v.ISRCIssues...)
+		issues = append(issues, v.GenreIssues...)
+		issues = append(issues, v.LabelIssues...)
+		issues = append(issues, v.RightsHolderIssues...)
+		validation[i] = []string{v.TrackID, v.ReleaseID, status, strings.Join(failed, ", "),
+			strings.Join(v.ReleaseConflicts, ", "), strings.Join(issues, "; ")}
+	}
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	parts := []struct {
+		name  string
+		write func(io.Writer) error
+	}{
+		{"[Content_Types].xml", writeStatic(xlsxContentTypes)},
+		{"_rels/.rels", writeStatic(xlsxRootRels)},
+		{"xl/workbook.xml", writeStatic(xlsxWorkbookXML)},
+		{"xl/_rels/workbook.xml.rels", writeStatic(xlsxWorkbookRels)},
+		{"xl/styles.xml", writeStatic(xlsxStyles)},
+		{"xl/worksheets/sheet1.xml", func(w io.Writer) error {
+			return writeWorksheet(w, columns, len(rows), func(i int) []string {
+				record := make([]string, len(columns))
+				for j, column := range columns {
+					record[j] = rows[i][column]
+				}
+				return record
+			}, failingCellRules(columns, len(rows)))
+		}},
+		{"xl/worksheets/sheet2.xml", func(w io.Writer) error {
+			return writeWorksheet(w, validationColumns, len(rows), func(i int) []string {
+				return validation[i]
+			}, failedStatusRule(len(rows)))
+		}},
+	}
+	for _, part := range parts {
+		w, err := zw.Create(part.name)
+		if err != nil {
+			return nil, err
+		}
+		if err := part.write(w); err != nil {
+			return nil, err
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// writeStatic returns a writer of a fixed part of the package
+func writeStatic(content string) func(io.Writer) error {
+	return func(w io.Writer) error {
+		_, err := io.WriteString(w, xml.Header+content)
+		return err
+	}
+}
+
+// writeWorksheet writes a sheet of a bold, frozen header row and count rows
+// of text cells, followed by the sheet's conditional formatting
+func writeWorksheet(w io.Writer, header []string, count int, row func(i int) []string, formatting string) error {
+	bw := &errWriter{w: w}
+	bw.WriteString(xml.Header)
+	bw.WriteString(`<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main">`)
+	bw.WriteString(`<sheetViews><sheetView workbookViewId="0"><pane ySplit="1" topLeftCell="A2" activePane="bottomLeft" state="frozen"/></sheetView></sheetViews>`)
+	bw.WriteString(`<sheetData>`)
+	writeXLSXRow(bw, 1, header, 1)
+	for i := 0; i < count; i++ {
+		writeXLSXRow(bw, i+2, row(i), 0)
+	}
+	bw.WriteString(`</sheetData>`)
+	bw.WriteString(formatting)
+	bw.WriteString(`</worksheet>`)
+	return bw.err
+}
+
+// writeXLSXRow writes a row of inline text cells in the given style.
+// Empty cells are left out.
+func writeXLSXRow(w *errWriter, number int, values []string, style int) {
+	fmt.Fprintf(w, `<row r="%d">`, number)
+	for i, value := range values {
+		if value == "" {
+			continue
+		}
+		fmt.Fprintf(w, `<c r="%s%d" t="inlineStr"`, columnName(i), number)
+		if style != 0 {
+			fmt.Fprintf(w, ` s="%d"`, style)
+		}
+		w.WriteString(`><is><t xml:space="preserve">`)
+		xml.EscapeText(w, []byte(value))
+		w.WriteString(`</t></is></c>`)
+	}
+	w.WriteString(`</row>`)
+}
+
+// failingCellRules returns the conditional formatting of the Data sheet:
+// for each check, the columns it concerns are highlighted on rows whose
+// failed checks on the Validation sheet include it, and release fields on
+// rows whose release disagrees on them
+func failingCellRules(columns []string, count int) string {
+	if count == 0 {
+		return ""
+	}
+	index := make(map[string]int, len(columns))
+	header := make(map[string]string, len(columns))
+	for i, column := range columns {
+		index[column] = i
+		header[column] = ""
+	}
+
+	rules := make(map[string][]string)
+	for check, checked := range checkColumns {
+		rules[check] = checked
+	}
+	for _, column := range payeeColumns(header) {
+		rules["payee_ids"] = append(rules["payee_ids"], column.name)
+	}
+
+	var b strings.Builder
+	priority := 0
+	add := func(column, listColumn, name string) {
+		i, ok := index[column]
+		if !ok {
+			return
+		}
+		priority++
+		ref := columnName(i)
+		fmt.Fprintf(&b, `<conditionalFormatting sqref="%s2:%s%d">`, ref, ref, count+1)
+		fmt.Fprintf(&b, `<cfRule type="expression" dxfId="0" priority="%d"><formula>`, priority)
+		formula := fmt.Sprintf(`ISNUMBER(SEARCH(", %s,",", "&Validation!$%s2&","))`, name, listColumn)
+		xml.EscapeText(&b, []byte(formula))
+		b.WriteString(`</formula></cfRule></conditionalFormatting>`)
+	}
+	for _, check := range sortedKeys(rules) {
+		for _, column := range rules[check] {
+			add(column, validationFailedColumn, check)
+		}
+	}
+	for _, field := range releaseFields {
+		add(field, validationConflictsColumn, field)
+	}
+	return b.String()
+}
+
+// failedStatusRule returns the conditional formatting highlighting failed
+// rows on the Validation sheet
+func failedStatusRule(count int) string {
+	if count == 0 {
+		return ""
+	}
+	return fmt.Sprintf(`<conditionalFormatting sqref="C2:C%d"><cfRule type="cellIs" dxfId="0" priority="1" operator="equal"><formula>"failed"</formula></cfRule></conditionalFormatting>`, count+1)
+}
+
+// columnName returns the letters of a zero-based column, such as "AB" for
+// 27, the inverse of columnIndex
+func columnName(index int) string {
+	name := ""
+	for index++; index > 0; index = (index - 1) / 26 {
+		name = string(rune('A'+(index-1)%26)) + name
+	}
+	return name
+}
+
+// errWriter keeps the first write error, so a sheet can be written without
+// checking every write
+type errWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (w *errWriter) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	n, err := w.w.Write(p)
+	w.err = err
+	return n, err
+}
+
+func (w *errWriter) WriteString(s string) {
+	w.Write([]byte(s))
+}
+
+// The fixed parts of an exported workbook. Style 1 is the bold header and
+// differential format 0 the light red fill with dark red text of failing
+// cells.
+const (
+	xlsxContentTypes = `<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types">` +
+		`<Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/>` +
+		`<Default Extension="xml" ContentType="application/xml"/>` +
+		`<Override PartName="/xl/workbook.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.sheet.main+xml"/>` +
+		`<Override PartName="/xl/styles.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.styles+xml"/>` +
+		`<Override PartName="/xl/worksheets/sheet1.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.worksheet+xml"/>` +
+		`<Override PartName="/xl/worksheets/sheet2.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.worksheet+xml"/>` +
+		`</Types>`
+
+	xlsxRootRels = `<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` +
+		`<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/officeDocument" Target="xl/workbook.xml"/>` +
+		`</Relationships>`
+
+	xlsxWorkbookXML = `<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships">` +
+		`<sheets><sheet name="Data" sheetId="1" r:id="rId1"/><sheet name="Validation" sheetId="2" r:id="rId2"/></sheets>` +
+		`</workbook>`
+
+	xlsxWorkbookRels = `<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` +
+		`<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/worksheet" Target="worksheets/sheet1.xml"/>` +
+		`<Relationship Id="rId2" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/worksheet" Target="worksheets/sheet2.xml"/>` +
+		`<Relationship Id="rId3" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/styles" Target="styles.xml"/>` +
+		`</Relationships>`
+
+	xlsxStyles = `<styleSheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main">` +
+		`<fonts count="2"><font><sz val="11"/><name val="Calibri"/></font><font><b/><sz val="11"/><name val="Calibri"/></font></fonts>` +
+		`<fills count="2"><fill><patternFill patternType="none"/></fill><fill><patternFill patternType="gray125"/></fill></fills>` +
+		`<borders count="1"><border><left/><right/><top/><bottom/><diagonal/></border></borders>` +
+		`<cellStyleXfs count="1"><xf numFmtId="0" fontId="0" fillId="0" borderId="0"/></cellStyleXfs>` +
+		`<cellXfs count="2"><xf numFmtId="0" fontId="0" fillId="0" borderId="0" xfId="0"/><xf numFmtId="0" fontId="1" fillId="0" borderId="0" xfId="0" applyFont="1"/></cellXfs>` +
+		`<cellStyles count="1"><cellStyle name="Normal" xfId="0" builtinId="0"/></cellStyles>` +
+		`<dxfs count="1"><dxf><font><color rgb="FF9C0006"/></font><fill><patternFill><bgColor rgb="FFFFC7CE"/></patternFill></fill></dxf></dxfs>` +
+		`</styleSheet>`
+)
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// yamlMediaTypes are the media types YAML documents are sent as
+var yamlMediaTypes = map[string]bool{
+	"application/yaml":   true,
+	"application/x-yaml": true,
+	"text/yaml":          true,
+	"text/x-yaml":        true,
+}
+
+// isYAML reports whether a document is written in YAML, by the extension of
+// its file name or its media type
+func isYAML(name, contentType string) bool {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".yaml", ".yml":
+		return true
+	}
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	return yamlMediaTypes[mediaType]
+}
+
+// maxYAMLNodes bounds the values of a YAML document once its aliases are
+// expanded, so a small document cannot expand into a huge one
+const maxYAMLNodes = 1 << 20
+
+// yamlToJSON reads a YAML document and returns it as JSON, so it can be
+// checked against the schema of its JSON form. Dates and times are kept as
+// written rather than read as timestamps, and aliases are expanded.
+func yamlToJSON(r io.Reader) (io.Reader, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, errorWithStatus(err, "failed to read body")
+	}
+	var document yaml.Node
+	if err := yaml.Unmarshal(data, &document); err != nil {
+		return nil, fileErrorf(http.StatusBadRequest, "invalid YAML: %v", err)
+	}
+	nodes := 0
+	value, err := yamlValue(&document, &nodes)
+	if err != nil {
+		return nil, fileErrorf(http.StatusBadRequest, "invalid YAML: %v", err)
+	}
+	converted, err := json.Marshal(value)
+	if err != nil {
+		return nil, fileErrorf(http.StatusBadRequest, "YAML document has no JSON form: %v", err)
+	}
+	return bytes.NewReader(converted), nil
+}
+
+// yamlValue returns the value of a YAML node as JSON would decode it,
+// counting the nodes converted in nodes
+func yamlValue(node *yaml.Node, nodes *int) (any, error) {
+	if *nodes++; *nodes > maxYAMLNodes {
+		return nil, fmt.Errorf("more than %d values", maxYAMLNodes)
+	}
+	switch node.Kind {
+	case yaml.DocumentNode:
+		if len(node.Content) == 0 {
+			return nil, nil
+		}
+		return yamlValue(node.Content[0], nodes)
+	case yaml.AliasNode:
+		return yamlValue(node.Alias, nodes)
+	case yaml.SequenceNode:
+		values := make([]any, len(node.Content))
+		for i, item := range node.Content {
+			var err error
+			if values[i], err = yamlValue(item, nodes); err != nil {
+				return nil, err
+			}
+		}
+		return values, nil
+	case yaml.MappingNode:
+		values := make(map[string]any, len(node.Content)/2)
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key := node.Content[i]
+			if key.Kind != yaml.ScalarNode {
+				return nil, fmt.Errorf("line %d: keys must be scalars", key.Line)
+			}
+			var err error
+			if values[key.Value], err = yamlValue(node.Content[i+1], nodes); err != nil {
+				return nil, err
+			}
+		}
+		return values, nil
+	}
+	if node.ShortTag() == "!!timestamp" {
+		return node.Value, nil
+	}
+	var value any
+	if err := node.Decode(&value); err != nil {
+		return nil, fmt.Errorf("line %d: %v", node.Line, err)
+	}
+	return value, nil
+}
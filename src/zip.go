@@ -0,0 +1,72 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"mime/multipart"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// openArchive opens an uploaded zip archive and returns the files to
+// process. Directories and the hidden files left by archivers are skipped.
+func openArchive(file multipart.File, size int64) ([]*zip.File, error) {
+	archive, err := zip.NewReader(file, size)
+	if err != nil {
+		return nil, fileErrorf(http.StatusUnprocessableEntity, "invalid zip archive: %v", err)
+	}
+
+	var members []*zip.File
+	var total uint64
+	for _, member := range archive.File {
+		base := path.Base(member.Name)
+		if member.FileInfo().IsDir() || strings.HasPrefix(member.Name, "__MACOSX/") || strings.HasPrefix(base, ".") {
+			continue
+		}
+		members = append(members, member)
+		total += member.UncompressedSize64
+	}
+	if len(members) == 0 {
+		return nil, fileErrorf(http.StatusUnprocessableEntity, "zip archive contains no files")
+	}
+	if len(members) > maxBatchFiles {
+		return nil, fileErrorf(http.StatusUnprocessableEntity,
+			"zip archive contains %d files, at most %d are accepted", len(members), maxBatchFiles)
+	}
+	// The zip reader fails on members larger than their declared size, so
+	// the declared sizes bound what is decompressed
+	if total > uint64(cfg.MaxDecompressedSize) {
+		return nil, fileErrorf(http.StatusRequestEntityTooLarge,
+			"decompressed archive exceeds %d MB", cfg.MaxDecompressedSize>>20)
+	}
+	return members, nil
+}
+
+// processArchive processes each file of an archive as a job of its own,
+// recorded with the archive's job as parent
+func processArchive(ctx context.Context, w http.ResponseWriter, job *Job, members []*zip.File, opts ProcessOptions, requestedWorkers int, workersWarning string) {
+	names := make([]string, len(members))
+	for i, member := range members {
+		names[i] = member.Name
+	}
+	processBatch(ctx, w, job, names, workersWarning, func(ctx context.Context, child *Job, i int) (*OutputFormat, error) {
+		return processArchiveMember(ctx, child, members[i], opts, requestedWorkers)
+	})
+}
+
+// processArchiveMember checks and processes a single file of an archive as
+// the given job
+func processArchiveMember(ctx context.Context, job *Job, member *zip.File, opts ProcessOptions, requestedWorkers int) (*OutputFormat, error) {
+	extension := strings.ToLower(path.Ext(member.Name))
+	if !isBatchExtension(extension) {
+		return nil, fileErrorf(http.StatusUnsupportedMediaType, "only CSV, TSV and JSON Lines files are processed from archives")
+	}
+
+	rc, err := member.Open()
+	if err != nil {
+		return nil, fileErrorf(http.StatusUnprocessableEntity, "failed to open file in archive: %v", err)
+	}
+	defer rc.Close()
+	return processBatchInput(ctx, job, extension, rc, opts, requestedWorkers)
+}